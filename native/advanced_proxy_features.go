@@ -18,19 +18,42 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	mathrand "math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	utls "github.com/refraction-networking/utls"
 )
 
 // Advanced Proxy Manager
@@ -43,6 +66,8 @@ type AdvancedProxyManager struct {
 	stealthProtocols    *StealthProtocolManager
 	topologyHider       *NetworkTopologyHider
 	connectionPool      *ConnectionPool
+	circuitBreakers     *CircuitBreakerSet
+	router              *Router
 	logger              *log.Logger
 	ctx                 context.Context
 	cancel              context.CancelFunc
@@ -54,8 +79,16 @@ type AdvancedProxyConfig struct {
 	// Traffic Analysis Resistance
 	EnableTrafficObfuscation bool `json:"enableTrafficObfuscation"`
 	ObfuscationLevel        int  `json:"obfuscationLevel"` // 1-5
+	ObfuscationCipher       string `json:"obfuscationCipher"` // aes-ctr or chacha20
 	EnableDummyTraffic      bool `json:"enableDummyTraffic"`
 	TrafficPaddingSize      int  `json:"trafficPaddingSize"`
+	DummyTrafficInterval    time.Duration `json:"dummyTrafficInterval"`  // mean time between dummy sends, default 5s
+	DummyIntervalModel      string        `json:"dummyIntervalModel"`    // poisson (default), uniform or fixed
+	DummySizeModel          string        `json:"dummySizeModel"`        // lognormal (default) or uniform
+	DummySizeMedian         int           `json:"dummySizeMedian"`       // bytes, default 300
+	DummySizeSigma          float64       `json:"dummySizeSigma"`        // log-normal shape, default 1.0
+	DummySizeMax            int           `json:"dummySizeMax"`          // bytes, default 16384
+	DummyTrafficInterleave  bool          `json:"dummyTrafficInterleave"` // also send padding-only frames on obfuscated connections
 	
 	// DPI Evasion
 	EnableDPIEvasion        bool     `json:"enableDPIEvasion"`
@@ -66,13 +99,27 @@ type AdvancedProxyConfig struct {
 	// Protocol Tunneling
 	EnableProtocolTunneling bool     `json:"enableProtocolTunneling"`
 	TunnelProtocols         []string `json:"tunnelProtocols"`
+	Tunnels                 map[string]ProtocolTunnel `json:"-"` // pluggable transports usable in TunnelProtocols
 	EncapsulationMethods    []string `json:"encapsulationMethods"`
+	WebSocketHost           string   `json:"webSocketHost"` // Host header for the handshake; defaults to the remote address
+	WebSocketPath           string   `json:"webSocketPath"`
+	TLSTunnelServerName     string   `json:"tlsTunnelServerName"` // SNI and verified name for the tls tunnel; defaults to the target host
+	TLSTunnelInsecure       bool     `json:"tlsTunnelInsecure"`   // skip certificate verification on the tls tunnel
+	TLSFingerprint          string   `json:"tlsFingerprint"`      // ClientHello to mimic: go (default), chrome, firefox, safari, edge, ios, randomized
 	
 	// Load Balancing
 	EnableLoadBalancing     bool              `json:"enableLoadBalancing"`
 	LoadBalancingAlgorithm  string            `json:"loadBalancingAlgorithm"`
 	UpstreamProxies         []UpstreamProxy   `json:"upstreamProxies"`
 	HealthCheckInterval     time.Duration     `json:"healthCheckInterval"`
+	MaxUpstreamRetries      int               `json:"maxUpstreamRetries"` // extra upstreams tried when one fails
+	HealthCheckTimeout      time.Duration     `json:"healthCheckTimeout"`
+	HealthCheckPath         string            `json:"healthCheckPath"` // HTTP probe path; empty for a TCP dial only
+	HealthyThreshold        int               `json:"healthyThreshold"`   // consecutive successes to mark healthy
+	UnhealthyThreshold      int               `json:"unhealthyThreshold"` // consecutive failures to mark unhealthy
+	CircuitBreakerThreshold int               `json:"circuitBreakerThreshold"` // consecutive failures that open a breaker; 0 disables
+	CircuitBreakerCooldown  time.Duration     `json:"circuitBreakerCooldown"`  // how long a breaker stays open before a probe
+	Routes                  []RouteRule       `json:"routes"` // consulted in order before the load balancer
 	
 	// Stealth Protocols
 	EnableStealthProtocols  bool     `json:"enableStealthProtocols"`
@@ -80,24 +127,57 @@ type AdvancedProxyConfig struct {
 	DomainFronting          bool     `json:"domainFronting"`
 	CDNIntegration          bool     `json:"cdnIntegration"`
 	
+	// Connection Pool
+	PoolMaxIdlePerHost      int           `json:"poolMaxIdlePerHost"`
+	PoolIdleTimeout         time.Duration `json:"poolIdleTimeout"`
+	
 	// Network Topology Hiding
 	EnableTopologyHiding    bool   `json:"enableTopologyHiding"`
 	HopCountRandomization   bool   `json:"hopCountRandomization"`
 	TTLManipulation         bool   `json:"ttlManipulation"`
 	RouteObfuscation        bool   `json:"routeObfuscation"`
+	DecoyRoutes             []DecoyRoute  `json:"decoyRoutes"`   // replaces the built-in decoy route when set
+	DecoyInterval           time.Duration `json:"decoyInterval"` // mean time between decoys, default 30s
+	DecoyJitter             float64       `json:"decoyJitter"`   // fraction of the interval to randomize by, 0-1, default 0.5
+}
+
+// Route requests for matching destination hosts to a named upstream
+type RouteRule struct {
+	Pattern  string `json:"pattern"`  // host glob such as *.cn, or a regular expression between slashes
+	Upstream string `json:"upstream"` // upstream name, or "direct" to bypass upstreams
+}
+
+// Routing table compiled from the configured route rules
+type Router struct {
+	routes []compiledRoute
+}
+
+type compiledRoute struct {
+	glob     string
+	regex    *regexp.Regexp
+	upstream string
 }
 
 // Upstream Proxy Configuration
 type UpstreamProxy struct {
 	Name      string `json:"name"`
-	Type      string `json:"type"` // http, socks5, shadowsocks, etc.
+	Type      string `json:"type"` // http, https, socks5, ss
 	Address   string `json:"address"`
 	Port      int    `json:"port"`
 	Username  string `json:"username,omitempty"`
 	Password  string `json:"password,omitempty"`
+	Method    string `json:"method,omitempty"` // Shadowsocks AEAD cipher, chacha20-ietf-poly1305 by default
 	Weight    int    `json:"weight"`
 	Healthy   bool   `json:"healthy"`
 	Latency   time.Duration `json:"latency"`
+	ActiveConnections int64 `json:"activeConnections"` // updated atomically by the load balancer
+	
+	// TLS settings used when the upstream is reached over TLS (type https)
+	ServerName         string   `json:"serverName,omitempty"`
+	ALPN               []string `json:"alpn,omitempty"`
+	CAFile             string   `json:"caFile,omitempty"`
+	SPKIPins           []string `json:"spkiPins,omitempty"` // base64 SHA-256 of the SubjectPublicKeyInfo
+	InsecureSkipVerify bool     `json:"insecureSkipVerify,omitempty"`
 }
 
 // Traffic Obfuscator
@@ -105,9 +185,22 @@ type TrafficObfuscator struct {
 	obfuscationKey []byte
 	paddingPool    *sync.Pool
 	dummyTraffic   chan []byte
+	dummyModel     *DummyTrafficModel
 	config         *AdvancedProxyConfig
 }
 
+// Dummy traffic timing model. Intervals and payload sizes are drawn from
+// distributions resembling browsing, so the cover traffic has no fixed period
+// or size for an observer to filter out.
+type DummyTrafficModel struct {
+	Interval      time.Duration
+	IntervalModel string
+	SizeModel     string
+	SizeMedian    int
+	SizeSigma     float64
+	SizeMax       int
+}
+
 // DPI Evasion Engine
 type DPIEvasionEngine struct {
 	fragmentationRules map[string]FragmentationRule
@@ -142,6 +235,7 @@ type ProtocolTunnelManager struct {
 	tunnels     map[string]ProtocolTunnel
 	encapsulators map[string]Encapsulator
 	config      *AdvancedProxyConfig
+	mutex       sync.RWMutex
 }
 
 type ProtocolTunnel interface {
@@ -150,6 +244,12 @@ type ProtocolTunnel interface {
 	GetType() string
 }
 
+// Implemented by tunnels that need the host:port the connection was dialed for,
+// which the connection's remote address cannot tell them
+type TargetedTunnel interface {
+	WrapTarget(conn net.Conn, target string) (net.Conn, error)
+}
+
 type Encapsulator interface {
 	Encapsulate(data []byte) []byte
 	Decapsulate(data []byte) []byte
@@ -161,10 +261,39 @@ type LoadBalancer struct {
 	upstreams   []UpstreamProxy
 	algorithm   LoadBalancingAlgorithm
 	healthCheck *HealthChecker
+	breakers    *CircuitBreakerSet
 	mutex       sync.RWMutex
 	config      *AdvancedProxyConfig
 }
 
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// Per-upstream circuit breaker. It opens after threshold consecutive failures,
+// fast-fails while open, and after the cooldown lets a single probe through
+// (half-open) whose outcome closes or re-opens it.
+type CircuitBreaker struct {
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	cooldown  time.Duration
+	mutex     sync.Mutex
+}
+
+// Circuit breakers keyed by upstream name, or destination host for direct connections
+type CircuitBreakerSet struct {
+	breakers  map[string]*CircuitBreaker
+	threshold int
+	cooldown  time.Duration
+	mutex     sync.Mutex
+}
+
 type LoadBalancingAlgorithm interface {
 	SelectUpstream(upstreams []UpstreamProxy) *UpstreamProxy
 	GetName() string
@@ -173,6 +302,9 @@ type LoadBalancingAlgorithm interface {
 type HealthChecker struct {
 	interval time.Duration
 	timeout  time.Duration
+	path     string
+	healthyThreshold   int
+	unhealthyThreshold int
 	checks   map[string]HealthCheck
 }
 
@@ -180,7 +312,9 @@ type HealthCheck struct {
 	LastCheck time.Time `json:"lastCheck"`
 	Healthy   bool      `json:"healthy"`
 	Latency   time.Duration `json:"latency"`
-	Errors    int       `json:"errors"`
+	Errors    int       `json:"errors"`    // consecutive failures
+	Successes int       `json:"successes"` // consecutive successes
+	LastError string    `json:"lastError,omitempty"`
 }
 
 // Stealth Protocol Manager
@@ -222,6 +356,7 @@ type NetworkTopologyHider struct {
 	ttlManipulator *TTLManipulator
 	routeObfuscator *RouteObfuscator
 	config         *AdvancedProxyConfig
+	ttlWarning     sync.Once
 }
 
 type HopRandomizer struct {
@@ -237,19 +372,27 @@ type TTLManipulator struct {
 type RouteObfuscator struct {
 	decoyRoutes []DecoyRoute
 	enabled     bool
+	interval    time.Duration
+	jitter      float64
+	timeout     time.Duration
+	send        func(ctx context.Context, route DecoyRoute) error
+	sent        int64
+	logger      *log.Logger
 }
 
 type DecoyRoute struct {
-	Target    string `json:"target"`
+	Target    string `json:"target"` // host, or host:port for tcp/udp/http
 	Hops      []string `json:"hops"`
-	Protocol  string `json:"protocol"`
+	Protocol  string `json:"protocol"` // icmp, tcp, udp, http
 	Active    bool   `json:"active"`
 }
 
 // Connection Pool
 type ConnectionPool struct {
-	pools   map[string]*sync.Pool
-	metrics map[string]*PoolMetrics
+	idle    map[string][]*PooledConnection // idle connections by target and route
+	metrics map[string]*PoolMetrics        // by connection type
+	maxIdlePerKey int
+	idleTimeout   time.Duration
 	mutex   sync.RWMutex
 }
 
@@ -270,10 +413,14 @@ type ProxyMetrics struct {
 	LoadBalancerHits    int64         `json:"loadBalancerHits"`
 	StealthConnections  int64         `json:"stealthConnections"`
 	TopologyHidingApplied int64       `json:"topologyHidingApplied"`
+	UpstreamFailovers   int64         `json:"upstreamFailovers"`
+	CircuitBreakerRejections int64    `json:"circuitBreakerRejections"`
+	DecoysSent          int64         `json:"decoysSent"`
 }
 
-// NewAdvancedProxyManager creates a new advanced proxy manager
-func NewAdvancedProxyManager(config *AdvancedProxyConfig) *AdvancedProxyManager {
+// NewAdvancedProxyManager creates a new advanced proxy manager, failing if the
+// config names a tunnel protocol that is not registered
+func NewAdvancedProxyManager(config *AdvancedProxyConfig) (*AdvancedProxyManager, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	manager := &AdvancedProxyManager{
@@ -285,15 +432,25 @@ func NewAdvancedProxyManager(config *AdvancedProxyConfig) *AdvancedProxyManager
 	}
 	
 	// Initialize components
+	manager.circuitBreakers = NewCircuitBreakerSet(config.CircuitBreakerThreshold, config.CircuitBreakerCooldown)
+	manager.initRouter()
 	manager.initTrafficObfuscator()
 	manager.initDPIEvasion()
-	manager.initProtocolTunnel()
+	if err := manager.initProtocolTunnel(); err != nil {
+		cancel()
+		return nil, err
+	}
 	manager.initLoadBalancer()
 	manager.initStealthProtocols()
 	manager.initTopologyHider()
 	manager.initConnectionPool()
 	
-	return manager
+	return manager, nil
+}
+
+// Stop background work such as decoy traffic
+func (m *AdvancedProxyManager) Close() {
+	m.cancel()
 }
 
 // Initialize traffic obfuscator
@@ -306,6 +463,11 @@ func (m *AdvancedProxyManager) initTrafficObfuscator() {
 	key := make([]byte, 32)
 	rand.Read(key)
 	
+	if _, exists := obfuscationCiphers[m.config.ObfuscationCipher]; !exists && m.config.ObfuscationCipher != "" {
+		m.logger.Printf("Unknown obfuscation cipher %q, using aes-ctr", m.config.ObfuscationCipher)
+		m.config.ObfuscationCipher = ""
+	}
+	
 	m.trafficObfuscator = &TrafficObfuscator{
 		obfuscationKey: key,
 		config:         m.config,
@@ -315,11 +477,12 @@ func (m *AdvancedProxyManager) initTrafficObfuscator() {
 			},
 		},
 		dummyTraffic: make(chan []byte, 100),
+		dummyModel:   newDummyTrafficModel(m.config),
 	}
 	
 	// Start dummy traffic generator
 	if m.config.EnableDummyTraffic {
-		go m.trafficObfuscator.generateDummyTraffic()
+		go m.trafficObfuscator.generateDummyTraffic(m.ctx)
 	}
 	
 	m.logger.Println("Traffic obfuscator initialized")
@@ -390,9 +553,9 @@ func (m *AdvancedProxyManager) initDPIEvasion() {
 }
 
 // Initialize protocol tunnel
-func (m *AdvancedProxyManager) initProtocolTunnel() {
+func (m *AdvancedProxyManager) initProtocolTunnel() error {
 	if !m.config.EnableProtocolTunneling {
-		return
+		return nil
 	}
 	
 	m.protocolTunnel = &ProtocolTunnelManager{
@@ -402,15 +565,90 @@ func (m *AdvancedProxyManager) initProtocolTunnel() {
 	}
 	
 	// Register available tunnels
-	m.protocolTunnel.tunnels["websocket"] = &WebSocketTunnel{}
-	m.protocolTunnel.tunnels["tls"] = &TLSTunnel{}
-	m.protocolTunnel.tunnels["http2"] = &HTTP2Tunnel{}
+	m.protocolTunnel.RegisterTunnel("websocket", &WebSocketTunnel{
+		Host: m.config.WebSocketHost,
+		Path: m.config.WebSocketPath,
+	})
+	m.protocolTunnel.RegisterTunnel("tls", &TLSTunnel{
+		ServerName:  m.config.TLSTunnelServerName,
+		Insecure:    m.config.TLSTunnelInsecure,
+		Fingerprint: m.config.TLSFingerprint,
+	})
+	m.protocolTunnel.RegisterTunnel("http2", &HTTP2Tunnel{})
 	
 	// Register encapsulators
-	m.protocolTunnel.encapsulators["dns"] = &DNSEncapsulator{}
-	m.protocolTunnel.encapsulators["icmp"] = &ICMPEncapsulator{}
+	m.protocolTunnel.RegisterEncapsulator("dns", &DNSEncapsulator{})
+	m.protocolTunnel.RegisterEncapsulator("icmp", &ICMPEncapsulator{})
+	
+	for name, tunnel := range m.config.Tunnels {
+		if err := m.protocolTunnel.RegisterTunnel(name, tunnel); err != nil {
+			return err
+		}
+	}
+	
+	// A misspelled protocol would otherwise only fail on the first tunneled connection
+	if _, err := m.protocolTunnel.resolveTunnels(m.config.TunnelProtocols); err != nil {
+		return err
+	}
 	
 	m.logger.Printf("Protocol tunnel initialized with %d tunnels", len(m.protocolTunnel.tunnels))
+	return nil
+}
+
+// RegisterTunnel adds a pluggable transport, replacing any tunnel with the same name
+func (p *ProtocolTunnelManager) RegisterTunnel(name string, tunnel ProtocolTunnel) error {
+	if name == "" || tunnel == nil {
+		return fmt.Errorf("tunnel name and implementation are required")
+	}
+	
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.tunnels[name] = tunnel
+	return nil
+}
+
+// RegisterEncapsulator adds an encapsulation method, replacing any with the same name
+func (p *ProtocolTunnelManager) RegisterEncapsulator(name string, encapsulator Encapsulator) error {
+	if name == "" || encapsulator == nil {
+		return fmt.Errorf("encapsulator name and implementation are required")
+	}
+	
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.encapsulators[name] = encapsulator
+	return nil
+}
+
+// Look up tunnels by name, in order
+func (p *ProtocolTunnelManager) resolveTunnels(names []string) ([]ProtocolTunnel, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	
+	tunnels := make([]ProtocolTunnel, 0, len(names))
+	for _, name := range names {
+		tunnel, exists := p.tunnels[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown tunnel protocol: %s", name)
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels, nil
+}
+
+// RegisterTunnel adds a pluggable transport to the manager's tunnel registry
+func (m *AdvancedProxyManager) RegisterTunnel(name string, tunnel ProtocolTunnel) error {
+	if m.protocolTunnel == nil {
+		return fmt.Errorf("protocol tunneling is not enabled")
+	}
+	return m.protocolTunnel.RegisterTunnel(name, tunnel)
+}
+
+// RegisterEncapsulator adds an encapsulation method to the manager's registry
+func (m *AdvancedProxyManager) RegisterEncapsulator(name string, encapsulator Encapsulator) error {
+	if m.protocolTunnel == nil {
+		return fmt.Errorf("protocol tunneling is not enabled")
+	}
+	return m.protocolTunnel.RegisterEncapsulator(name, encapsulator)
 }
 
 // Initialize load balancer
@@ -419,14 +657,32 @@ func (m *AdvancedProxyManager) initLoadBalancer() {
 		return
 	}
 	
+	healthCheck := &HealthChecker{
+		interval:           m.config.HealthCheckInterval,
+		timeout:            m.config.HealthCheckTimeout,
+		path:               m.config.HealthCheckPath,
+		healthyThreshold:   m.config.HealthyThreshold,
+		unhealthyThreshold: m.config.UnhealthyThreshold,
+		checks:             make(map[string]HealthCheck),
+	}
+	if healthCheck.interval <= 0 {
+		healthCheck.interval = 30 * time.Second
+	}
+	if healthCheck.timeout <= 0 {
+		healthCheck.timeout = 10 * time.Second
+	}
+	if healthCheck.healthyThreshold <= 0 {
+		healthCheck.healthyThreshold = 1
+	}
+	if healthCheck.unhealthyThreshold <= 0 {
+		healthCheck.unhealthyThreshold = 3
+	}
+	
 	m.loadBalancer = &LoadBalancer{
-		config:    m.config,
-		upstreams: m.config.UpstreamProxies,
-		healthCheck: &HealthChecker{
-			interval: m.config.HealthCheckInterval,
-			timeout:  10 * time.Second,
-			checks:   make(map[string]HealthCheck),
-		},
+		config:      m.config,
+		upstreams:   m.config.UpstreamProxies,
+		healthCheck: healthCheck,
+		breakers:    m.circuitBreakers,
 	}
 	
 	// Set load balancing algorithm
@@ -437,6 +693,8 @@ func (m *AdvancedProxyManager) initLoadBalancer() {
 		m.loadBalancer.algorithm = &WeightedAlgorithm{}
 	case "least_connections":
 		m.loadBalancer.algorithm = &LeastConnectionsAlgorithm{}
+	case "lowest_latency":
+		m.loadBalancer.algorithm = &LowestLatencyAlgorithm{}
 	default:
 		m.loadBalancer.algorithm = &RoundRobinAlgorithm{}
 	}
@@ -523,30 +781,50 @@ func (m *AdvancedProxyManager) initTopologyHider() {
 					Active:   true,
 				},
 			},
+			interval: m.config.DecoyInterval,
+			jitter:   m.config.DecoyJitter,
+			timeout:  5 * time.Second,
+			logger:   m.logger,
 		},
 	}
 	
+	obfuscator := m.topologyHider.routeObfuscator
+	if len(m.config.DecoyRoutes) > 0 {
+		obfuscator.decoyRoutes = m.config.DecoyRoutes
+	}
+	if obfuscator.interval <= 0 {
+		obfuscator.interval = 30 * time.Second
+	}
+	if obfuscator.jitter <= 0 || obfuscator.jitter > 1 {
+		obfuscator.jitter = 0.5
+	}
+	obfuscator.send = obfuscator.sendDecoy
+	
+	if obfuscator.enabled {
+		go obfuscator.run(m.ctx, &m.metrics.DecoysSent)
+	}
+	
 	m.logger.Println("Network topology hider initialized")
 }
 
 // Initialize connection pool
 func (m *AdvancedProxyManager) initConnectionPool() {
 	m.connectionPool = &ConnectionPool{
-		pools:   make(map[string]*sync.Pool),
-		metrics: make(map[string]*PoolMetrics),
+		idle:          make(map[string][]*PooledConnection),
+		metrics:       make(map[string]*PoolMetrics),
+		maxIdlePerKey: m.config.PoolMaxIdlePerHost,
+		idleTimeout:   m.config.PoolIdleTimeout,
+	}
+	if m.connectionPool.maxIdlePerKey <= 0 {
+		m.connectionPool.maxIdlePerKey = 4
+	}
+	if m.connectionPool.idleTimeout <= 0 {
+		m.connectionPool.idleTimeout = 90 * time.Second
 	}
 	
-	// Create pools for different connection types
-	connectionTypes := []string{"http", "https", "socks5", "websocket"}
+	// Create metrics for the known connection types
+	connectionTypes := []string{"direct", "http", "https", "socks5", "ss"}
 	for _, connType := range connectionTypes {
-		m.connectionPool.pools[connType] = &sync.Pool{
-			New: func() interface{} {
-				return &PooledConnection{
-					connType: connType,
-					created:  time.Now(),
-				}
-			},
-		}
 		m.connectionPool.metrics[connType] = &PoolMetrics{}
 	}
 	
@@ -556,21 +834,34 @@ func (m *AdvancedProxyManager) initConnectionPool() {
 // Process HTTP request with advanced features
 func (m *AdvancedProxyManager) ProcessHTTPRequest(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
-	m.metrics.RequestsProcessed++
+	atomic.AddInt64(&m.metrics.RequestsProcessed, 1)
 	
 	m.logger.Printf("Processing request: %s %s", r.Method, r.URL.String())
 	
 	// Apply DPI evasion
 	if m.config.EnableDPIEvasion {
 		r = m.applyDPIEvasion(r)
-		m.metrics.DPIEvasionsApplied++
+		atomic.AddInt64(&m.metrics.DPIEvasionsApplied, 1)
 	}
 	
-	// Select upstream proxy
+	// Select upstream proxy from the routing table, falling back to the load balancer
 	var upstream *UpstreamProxy
-	if m.config.EnableLoadBalancing && len(m.config.UpstreamProxies) > 0 {
-		upstream = m.loadBalancer.algorithm.SelectUpstream(m.loadBalancer.upstreams)
-		m.metrics.LoadBalancerHits++
+	routeName, routed := m.router.Match(r.URL.Host)
+	if routed {
+		upstream = m.upstreamByName(routeName)
+		if upstream != nil && !m.circuitBreakers.Allow(circuitBreakerKey(r.URL.Host, upstream)) {
+			atomic.AddInt64(&m.metrics.CircuitBreakerRejections, 1)
+			http.Error(w, "Upstream temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	} else if m.config.EnableLoadBalancing && len(m.config.UpstreamProxies) > 0 {
+		upstream = m.loadBalancer.selectUpstream(nil)
+		atomic.AddInt64(&m.metrics.LoadBalancerHits, 1)
+	}
+	
+	if r.Method == http.MethodConnect {
+		m.handleConnect(w, r, upstream)
+		return
 	}
 	
 	// Apply stealth protocols
@@ -579,51 +870,72 @@ func (m *AdvancedProxyManager) ProcessHTTPRequest(w http.ResponseWriter, r *http
 		if err != nil {
 			m.logger.Printf("Failed to apply stealth protocol: %v", err)
 		} else {
-			m.metrics.StealthConnections++
+			atomic.AddInt64(&m.metrics.StealthConnections, 1)
 		}
 	}
 	
-	// Process request through tunnel
-	var conn net.Conn
-	var err error
-	
-	if m.config.EnableProtocolTunneling {
-		conn, err = m.createTunneledConnection(r.URL.Host, upstream)
-	} else {
-		conn, err = m.createDirectConnection(r.URL.Host, upstream)
-	}
-	
-	if err != nil {
-		http.Error(w, "Failed to establish connection", http.StatusBadGateway)
-		return
-	}
-	defer conn.Close()
-	
-	// Apply traffic obfuscation
-	if m.config.EnableTrafficObfuscation {
-		conn = m.obfuscateConnection(conn)
-		m.metrics.TrafficObfuscated++
+	// Routed requests stay on their upstream rather than failing over to another
+	maxAttempts := 1
+	if upstream != nil && !routed && m.config.MaxUpstreamRetries > 0 {
+		maxAttempts += m.config.MaxUpstreamRetries
 	}
 	
-	// Apply topology hiding
-	if m.config.EnableTopologyHiding {
-		m.applyTopologyHiding(conn)
-		m.metrics.TopologyHidingApplied++
-	}
+	// Buffer small bodies so idempotent requests can be replayed on another upstream
+	replayable := maxAttempts > 1 && isIdempotentMethod(r.Method) && bufferRequestBody(r, maxReplayBodySize)
 	
-	// Forward request
-	err = r.Write(conn)
-	if err != nil {
-		http.Error(w, "Failed to forward request", http.StatusBadGateway)
+	// Fast-fail while the breaker for a direct destination is open; upstream
+	// breakers are checked during selection
+	if upstream == nil && !m.circuitBreakers.Allow(circuitBreakerKey(r.URL.Host, nil)) {
+		atomic.AddInt64(&m.metrics.CircuitBreakerRejections, 1)
+		http.Error(w, "Destination temporarily unavailable", http.StatusServiceUnavailable)
 		return
 	}
 	
-	// Read response
-	resp, err := http.ReadResponse(bufio.NewReader(conn), r)
-	if err != nil {
-		http.Error(w, "Failed to read response", http.StatusBadGateway)
-		return
+	// Process request through tunnel, failing over to other upstreams on errors
+	var resp *http.Response
+	var done func(reuse bool)
+	tried := make(map[string]bool)
+	for attempt := 1; ; attempt++ {
+		var sent bool
+		var err error
+		resp, done, sent, err = m.forwardRequest(r, upstream)
+		breakerKey := circuitBreakerKey(r.URL.Host, upstream)
+		if err == nil {
+			m.circuitBreakers.RecordSuccess(breakerKey)
+			break
+		}
+		m.circuitBreakers.RecordFailure(breakerKey)
+		
+		if upstream != nil {
+			m.logger.Printf("Upstream %s failed: %v", upstream.Name, err)
+			m.loadBalancer.markUnhealthy(upstream, err)
+			tried[upstream.Name] = true
+		}
+		
+		// A request that reached the upstream is only replayed if that is safe
+		var next *UpstreamProxy
+		if attempt < maxAttempts && (!sent || replayable) {
+			next = m.loadBalancer.selectUpstream(tried)
+		}
+		if next != nil && sent && resetRequestBody(r) != nil {
+			next = nil
+		}
+		if next == nil {
+			if sent {
+				http.Error(w, "Failed to forward request", http.StatusBadGateway)
+			} else {
+				http.Error(w, "Failed to establish connection", http.StatusBadGateway)
+			}
+			return
+		}
+		
+		upstream = next
+		atomic.AddInt64(&m.metrics.UpstreamFailovers, 1)
 	}
+	
+	// The connection goes back to the pool only if the response was read in full
+	reuse := false
+	defer func() { done(reuse) }()
 	defer resp.Body.Close()
 	
 	// Copy response headers
@@ -641,15 +953,286 @@ func (m *AdvancedProxyManager) ProcessHTTPRequest(w http.ResponseWriter, r *http
 		m.logger.Printf("Error copying response: %v", err)
 		return
 	}
+	reuse = !resp.Close && !r.Close
 	
 	// Update metrics
-	m.metrics.BytesTransferred += bytesTransferred
+	atomic.AddInt64(&m.metrics.BytesTransferred, bytesTransferred)
 	duration := time.Since(startTime)
 	m.updateLatencyMetrics(duration)
 	
 	m.logger.Printf("Request completed in %v, %d bytes transferred", duration, bytesTransferred)
 }
 
+// Tunnel a CONNECT request to its target through upstream, or directly when nil
+func (m *AdvancedProxyManager) handleConnect(w http.ResponseWriter, r *http.Request, upstream *UpstreamProxy) {
+	if upstream == nil && !m.circuitBreakers.Allow(circuitBreakerKey(r.URL.Host, nil)) {
+		atomic.AddInt64(&m.metrics.CircuitBreakerRejections, 1)
+		http.Error(w, "Destination temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	
+	release := m.loadBalancer.Acquire(upstream)
+	defer release()
+	
+	breakerKey := circuitBreakerKey(r.URL.Host, upstream)
+	targetConn, err := m.createDirectConnection(r.URL.Host, upstream)
+	if err != nil {
+		m.circuitBreakers.RecordFailure(breakerKey)
+		m.logger.Printf("CONNECT to %s failed: %v", r.URL.Host, err)
+		http.Error(w, "Failed to establish connection", http.StatusBadGateway)
+		return
+	}
+	m.circuitBreakers.RecordSuccess(breakerKey)
+	defer targetConn.Close()
+	
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		m.logger.Printf("Failed to hijack CONNECT connection: %v", err)
+		return
+	}
+	defer clientConn.Close()
+	
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	
+	// Bytes the client sent after the CONNECT request may already be buffered
+	if n := buffered.Reader.Buffered(); n > 0 {
+		if _, err := io.CopyN(targetConn, buffered, int64(n)); err != nil {
+			return
+		}
+	}
+	
+	done := make(chan int64, 2)
+	go func() {
+		n, _ := io.Copy(targetConn, clientConn)
+		if tcpConn, ok := targetConn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		done <- n
+	}()
+	go func() {
+		n, _ := io.Copy(clientConn, targetConn)
+		if tcpConn, ok := clientConn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		done <- n
+	}()
+	
+	transferred := <-done
+	transferred += <-done
+	atomic.AddInt64(&m.metrics.BytesTransferred, transferred)
+}
+
+// Compile the configured routes, skipping invalid patterns
+func (m *AdvancedProxyManager) initRouter() {
+	router, errs := NewRouter(m.config.Routes)
+	for _, err := range errs {
+		m.logger.Printf("Skipping route: %v", err)
+	}
+	m.router = router
+}
+
+// Find a configured upstream by name; "direct" and unknown names return nil
+func (m *AdvancedProxyManager) upstreamByName(name string) *UpstreamProxy {
+	for i := range m.config.UpstreamProxies {
+		if m.config.UpstreamProxies[i].Name == name {
+			return &m.config.UpstreamProxies[i]
+		}
+	}
+	if name != "direct" {
+		m.logger.Printf("Route refers to unknown upstream %q, connecting directly", name)
+	}
+	return nil
+}
+
+// Compile route rules in order. Rules that fail to compile are left out and reported.
+func NewRouter(rules []RouteRule) (*Router, []error) {
+	router := &Router{}
+	var errs []error
+	
+	for _, rule := range rules {
+		route := compiledRoute{upstream: rule.Upstream}
+		pattern := strings.ToLower(strings.TrimSpace(rule.Pattern))
+		
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			regex, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid route pattern %q: %v", rule.Pattern, err))
+				continue
+			}
+			route.regex = regex
+		} else {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("invalid route pattern %q: %v", rule.Pattern, err))
+				continue
+			}
+			route.glob = pattern
+		}
+		
+		router.routes = append(router.routes, route)
+	}
+	
+	return router, errs
+}
+
+// Return the upstream name of the first route matching host, which may carry a port
+func (rt *Router) Match(host string) (string, bool) {
+	if rt == nil || len(rt.routes) == 0 {
+		return "", false
+	}
+	
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	
+	for _, route := range rt.routes {
+		if route.regex != nil {
+			if route.regex.MatchString(host) {
+				return route.upstream, true
+			}
+		} else if matched, _ := path.Match(route.glob, host); matched {
+			return route.upstream, true
+		}
+	}
+	return "", false
+}
+
+// Send the request through upstream (or directly) and read the response,
+// reusing a pooled connection when one is idle. done must be called once the
+// response has been consumed; reuse returns the connection to the pool. sent
+// reports whether any part of the request may have reached the server.
+func (m *AdvancedProxyManager) forwardRequest(r *http.Request, upstream *UpstreamProxy) (*http.Response, func(reuse bool), bool, error) {
+	key := connectionPoolKey(r.URL.Host, upstream)
+	release := m.loadBalancer.Acquire(upstream)
+	
+	conn := m.connectionPool.Get(key)
+	for {
+		reused := conn != nil
+		if !reused {
+			var err error
+			conn, err = m.newPooledConnection(r.URL.Host, upstream, key)
+			if err != nil {
+				release()
+				return nil, nil, false, fmt.Errorf("failed to establish connection: %v", err)
+			}
+		}
+		
+		resp, err := conn.roundTrip(r)
+		if err == nil {
+			done := func(reuse bool) {
+				if reuse {
+					m.connectionPool.Put(conn)
+				} else {
+					conn.Close()
+				}
+				release()
+			}
+			return resp, done, true, nil
+		}
+		conn.Close()
+		
+		// An idle connection may have been closed by the server; retry once on a fresh one
+		if reused && isIdempotentMethod(r.Method) && resetRequestBody(r) == nil {
+			conn = nil
+			continue
+		}
+		
+		release()
+		return nil, nil, true, err
+	}
+}
+
+// Dial a new connection for target with tunneling and obfuscation applied
+func (m *AdvancedProxyManager) newPooledConnection(target string, upstream *UpstreamProxy, key string) (*PooledConnection, error) {
+	var conn net.Conn
+	var err error
+	if m.config.EnableProtocolTunneling {
+		conn, err = m.createTunneledConnection(target, upstream)
+	} else {
+		conn, err = m.createDirectConnection(target, upstream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	// Apply traffic obfuscation
+	if m.config.EnableTrafficObfuscation {
+		conn = m.obfuscateConnection(conn)
+		atomic.AddInt64(&m.metrics.TrafficObfuscated, 1)
+	}
+	
+	// Apply topology hiding
+	if m.config.EnableTopologyHiding {
+		m.applyTopologyHiding(conn)
+		atomic.AddInt64(&m.metrics.TopologyHidingApplied, 1)
+	}
+	
+	connType := "direct"
+	if upstream != nil {
+		connType = upstream.Type
+	}
+	return m.connectionPool.newConnection(conn, connType, key), nil
+}
+
+// Largest request body buffered for replay on failover
+const maxReplayBodySize = 1 << 20
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Buffer the request body up to limit bytes so it can be resent. Returns false,
+// leaving the body readable in full, if it is larger than limit.
+func bufferRequestBody(r *http.Request, limit int64) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return false
+	}
+	
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return true
+}
+
+// Rewind the request body before a retry
+func resetRequestBody(r *http.Request) error {
+	if r.GetBody == nil {
+		if r.Body == nil || r.Body == http.NoBody {
+			return nil
+		}
+		return fmt.Errorf("request body cannot be replayed")
+	}
+	
+	body, err := r.GetBody()
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	return nil
+}
+
 // Apply DPI evasion techniques
 func (m *AdvancedProxyManager) applyDPIEvasion(r *http.Request) *http.Request {
 	// Apply header obfuscation
@@ -742,9 +1325,13 @@ func (m *AdvancedProxyManager) applyCDNIntegration(r *http.Request) {
 
 // Create tunneled connection
 func (m *AdvancedProxyManager) createTunneledConnection(target string, upstream *UpstreamProxy) (net.Conn, error) {
+	tunnels, err := m.protocolTunnel.resolveTunnels(m.config.TunnelProtocols)
+	if err != nil {
+		return nil, err
+	}
+	
 	// First establish base connection
 	var conn net.Conn
-	var err error
 	
 	if upstream != nil {
 		conn, err = m.connectThroughUpstream(target, upstream)
@@ -757,14 +1344,18 @@ func (m *AdvancedProxyManager) createTunneledConnection(target string, upstream
 	}
 	
 	// Apply tunneling protocols in order
-	for _, tunnelType := range m.config.TunnelProtocols {
-		if tunnel, exists := m.protocolTunnel.tunnels[tunnelType]; exists {
-			conn, err = tunnel.Wrap(conn)
-			if err != nil {
-				conn.Close()
-				return nil, fmt.Errorf("failed to apply %s tunnel: %v", tunnelType, err)
-			}
+	for i, tunnel := range tunnels {
+		var wrapped net.Conn
+		if targeted, ok := tunnel.(TargetedTunnel); ok {
+			wrapped, err = targeted.WrapTarget(conn, target)
+		} else {
+			wrapped, err = tunnel.Wrap(conn)
 		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to apply %s tunnel: %v", m.config.TunnelProtocols[i], err)
+		}
+		conn = wrapped
 	}
 	
 	return conn, nil
@@ -783,47 +1374,197 @@ func (m *AdvancedProxyManager) connectThroughUpstream(target string, upstream *U
 	upstreamAddr := fmt.Sprintf("%s:%d", upstream.Address, upstream.Port)
 	
 	switch upstream.Type {
-	case "http":
+	case "http", "https":
 		return m.connectHTTPProxy(upstreamAddr, target, upstream)
 	case "socks5":
 		return m.connectSOCKS5Proxy(upstreamAddr, target, upstream)
+	case "ss", "shadowsocks":
+		return m.connectShadowsocks(upstreamAddr, target, upstream)
 	default:
 		return nil, fmt.Errorf("unsupported upstream proxy type: %s", upstream.Type)
 	}
 }
 
-// Connect through HTTP proxy
-func (m *AdvancedProxyManager) connectHTTPProxy(proxyAddr, target string, upstream *UpstreamProxy) (net.Conn, error) {
+// Dial an upstream proxy, wrapping the connection in TLS for https upstreams
+func (m *AdvancedProxyManager) dialUpstream(proxyAddr string, upstream *UpstreamProxy) (net.Conn, error) {
 	conn, err := net.DialTimeout("tcp", proxyAddr, 30*time.Second)
 	if err != nil {
 		return nil, err
 	}
 	
-	// Send CONNECT request
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
-	if upstream.Username != "" && upstream.Password != "" {
-		// Add basic auth
-		auth := fmt.Sprintf("%s:%s", upstream.Username, upstream.Password)
-		encoded := encodeBase64(auth)
-		connectReq += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", encoded)
+	if upstream.Type != "https" {
+		return conn, nil
 	}
-	connectReq += "\r\n"
 	
-	_, err = conn.Write([]byte(connectReq))
+	tlsConfig, err := buildUpstreamTLSConfig(upstream)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 	
-	// Read response
-	resp := make([]byte, 1024)
-	_, err = conn.Read(resp)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	tlsConn, err := tlsHandshake(conn, tlsConfig, m.config.TLSFingerprint)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, fmt.Errorf("TLS handshake with upstream %s failed: %v", upstream.Name, err)
 	}
+	conn.SetDeadline(time.Time{})
 	
-	if !strings.Contains(string(resp), "200 Connection established") {
+	return tlsConn, nil
+}
+
+// ClientHello profiles selectable with TLSFingerprint
+var utlsProfiles = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"safari":     utls.HelloSafari_Auto,
+	"edge":       utls.HelloEdge_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"randomized": utls.HelloRandomizedNoALPN,
+}
+
+// Perform a client TLS handshake, sending the ClientHello of the named browser
+// profile instead of Go's own, which DPI can single out
+func tlsHandshake(conn net.Conn, config *tls.Config, fingerprint string) (net.Conn, error) {
+	if fingerprint == "" || fingerprint == "go" {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	
+	helloID, exists := utlsProfiles[fingerprint]
+	if !exists {
+		return nil, fmt.Errorf("unknown TLS fingerprint %q", fingerprint)
+	}
+	
+	uconfig := &utls.Config{
+		ServerName:         config.ServerName,
+		NextProtos:         config.NextProtos,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		RootCAs:            config.RootCAs,
+	}
+	if config.VerifyConnection != nil {
+		uconfig.VerifyConnection = func(cs utls.ConnectionState) error {
+			return config.VerifyConnection(tls.ConnectionState{
+				ServerName:         cs.ServerName,
+				PeerCertificates:   cs.PeerCertificates,
+				VerifiedChains:     cs.VerifiedChains,
+				NegotiatedProtocol: cs.NegotiatedProtocol,
+			})
+		}
+	}
+	
+	if helloID == utls.HelloRandomizedNoALPN {
+		uconn := utls.UClient(conn, uconfig, helloID)
+		if err := uconn.Handshake(); err != nil {
+			return nil, err
+		}
+		return uconn, nil
+	}
+	
+	// Browser profiles advertise h2, which the tunnelled HTTP/1.1 stream cannot
+	// speak, so their ALPN list is replaced with ours
+	spec, err := utls.UTLSIdToSpec(helloID)
+	if err != nil {
+		return nil, fmt.Errorf("TLS fingerprint %q: %v", fingerprint, err)
+	}
+	protocols := config.NextProtos
+	if len(protocols) == 0 {
+		protocols = []string{"http/1.1"}
+	}
+	for _, extension := range spec.Extensions {
+		if alpn, ok := extension.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = protocols
+		}
+	}
+	
+	uconn := utls.UClient(conn, uconfig, utls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, fmt.Errorf("TLS fingerprint %q: %v", fingerprint, err)
+	}
+	if err := uconn.Handshake(); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// Build the TLS client configuration for an upstream proxy
+func buildUpstreamTLSConfig(upstream *UpstreamProxy) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         upstream.ServerName,
+		NextProtos:         upstream.ALPN,
+		InsecureSkipVerify: upstream.InsecureSkipVerify,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = upstream.Address
+	}
+	
+	if upstream.CAFile != "" {
+		caData, err := os.ReadFile(upstream.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file for upstream %s: %v", upstream.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", upstream.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	
+	if len(upstream.SPKIPins) > 0 {
+		pins := make(map[string]bool, len(upstream.SPKIPins))
+		for _, pin := range upstream.SPKIPins {
+			pins[pin] = true
+		}
+		// VerifyConnection runs even with InsecureSkipVerify, so pins are always enforced
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("no certificate matches the pinned SPKI hashes for upstream %s", upstream.Name)
+		}
+	}
+	
+	return tlsConfig, nil
+}
+
+// Connect through HTTP proxy
+func (m *AdvancedProxyManager) connectHTTPProxy(proxyAddr, target string, upstream *UpstreamProxy) (net.Conn, error) {
+	conn, err := m.dialUpstream(proxyAddr, upstream)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Send CONNECT request
+	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if upstream.Username != "" && upstream.Password != "" {
+		// Add basic auth
+		auth := fmt.Sprintf("%s:%s", upstream.Username, upstream.Password)
+		encoded := encodeBase64(auth)
+		connectReq += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", encoded)
+	}
+	connectReq += "\r\n"
+	
+	_, err = conn.Write([]byte(connectReq))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	
+	// Read response
+	resp := make([]byte, 1024)
+	_, err = conn.Read(resp)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	
+	if !strings.Contains(string(resp), "200 Connection established") {
 		conn.Close()
 		return nil, fmt.Errorf("proxy connection failed: %s", string(resp))
 	}
@@ -889,6 +1630,29 @@ func (m *AdvancedProxyManager) connectSOCKS5Proxy(proxyAddr, target string, upst
 	return conn, nil
 }
 
+// Encode a host and port as a SOCKS5 address (ATYP, address, port)
+func encodeSOCKSAddress(host, port string) ([]byte, error) {
+	var addr []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			addr = append([]byte{0x01}, ip4...) // IPv4
+		} else {
+			addr = append([]byte{0x04}, ip...) // IPv6
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		addr = append([]byte{0x03, byte(len(host))}, host...) // Domain name
+	}
+	
+	portNum, err := parsePort(port)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint16(addr, uint16(portNum)), nil
+}
+
 // Perform SOCKS5 authentication
 func (m *AdvancedProxyManager) performSOCKS5Auth(conn net.Conn, username, password string) error {
 	// Send authentication request
@@ -920,26 +1684,14 @@ func (m *AdvancedProxyManager) performSOCKS5Auth(conn net.Conn, username, passwo
 // Send SOCKS5 connect request
 func (m *AdvancedProxyManager) sendSOCKS5ConnectRequest(conn net.Conn, host, port string) error {
 	// Build connect request
-	req := []byte{0x05, 0x01, 0x00} // Version 5, Connect command, Reserved
-	
-	// Add destination address
-	if net.ParseIP(host) != nil {
-		req = append(req, 0x01) // IPv4
-		req = append(req, net.ParseIP(host).To4()...)
-	} else {
-		req = append(req, 0x03) // Domain name
-		req = append(req, byte(len(host)))
-		req = append(req, []byte(host)...)
+	addr, err := encodeSOCKSAddress(host, port)
+	if err != nil {
+		return err
 	}
-	
-	// Add port
-	portNum := parsePort(port)
-	portBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(portBytes, uint16(portNum))
-	req = append(req, portBytes...)
+	req := append([]byte{0x05, 0x01, 0x00}, addr...) // Version 5, Connect command, Reserved
 	
 	// Send request
-	_, err := conn.Write(req)
+	_, err = conn.Write(req)
 	if err != nil {
 		return err
 	}
@@ -958,91 +1710,900 @@ func (m *AdvancedProxyManager) sendSOCKS5ConnectRequest(conn net.Conn, host, por
 	return nil
 }
 
+// Connect through a Shadowsocks AEAD upstream
+func (m *AdvancedProxyManager) connectShadowsocks(proxyAddr, target string, upstream *UpstreamProxy) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := encodeSOCKSAddress(host, port)
+	if err != nil {
+		return nil, err
+	}
+	
+	conn, err := net.DialTimeout("tcp", proxyAddr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	
+	ssConn, err := newShadowsocksConn(conn, upstream.Method, upstream.Password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	
+	// The target address is the first payload of the stream
+	if _, err := ssConn.Write(addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	
+	return ssConn, nil
+}
+
 // Obfuscate connection traffic
 func (m *AdvancedProxyManager) obfuscateConnection(conn net.Conn) net.Conn {
-	return &ObfuscatedConnection{
-		Conn:      conn,
-		key:       m.trafficObfuscator.obfuscationKey,
-		level:     m.config.ObfuscationLevel,
-		padding:   m.config.TrafficPaddingSize,
+	oc := &ObfuscatedConnection{
+		Conn:         conn,
+		key:          m.trafficObfuscator.obfuscationKey,
+		streamCipher: obfuscationCiphers[m.config.ObfuscationCipher],
+		level:        m.config.ObfuscationLevel,
+		padding:      m.config.TrafficPaddingSize,
+		closed:       make(chan struct{}),
+	}
+	if m.config.EnableDummyTraffic && m.config.DummyTrafficInterleave {
+		go oc.interleaveDummyTraffic(m.trafficObfuscator.dummyModel)
 	}
+	return oc
 }
 
 // Apply topology hiding
 func (m *AdvancedProxyManager) applyTopologyHiding(conn net.Conn) {
-	// This would involve actual network-level modifications
-	// For now, we simulate by logging the application
-	m.logger.Println("Applied topology hiding techniques")
+	hider := m.topologyHider
+	if hider == nil {
+		return
+	}
+	
+	if m.config.TTLManipulation {
+		if _, err := hider.ttlManipulator.Apply(conn); err != nil {
+			hider.ttlWarning.Do(func() {
+				m.logger.Printf("TTL manipulation unavailable, keeping the system default TTL: %v", err)
+			})
+		}
+	}
+}
+
+// TTL of baseTTL ± variance, kept within the valid 1-255 range
+func (t *TTLManipulator) nextTTL() int {
+	ttl := t.baseTTL
+	if t.variance > 0 {
+		ttl += mathrand.Intn(2*t.variance+1) - t.variance
+	}
+	if ttl < 1 {
+		ttl = 1
+	}
+	if ttl > 255 {
+		ttl = 255
+	}
+	return ttl
+}
+
+// Set a randomized IP TTL, or IPv6 hop limit, on the socket under conn so the
+// hop count seen by the far end does not reveal the local OS or network depth
+func (t *TTLManipulator) Apply(conn net.Conn) (int, error) {
+	tcpConn, ok := underlyingTCPConn(conn)
+	if !ok {
+		return 0, fmt.Errorf("not a TCP connection: %T", conn)
+	}
+	
+	ttl := t.nextTTL()
+	if addr, ok := tcpConn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		return ttl, ipv6.NewConn(tcpConn).SetHopLimit(ttl)
+	}
+	return ttl, ipv4.NewConn(tcpConn).SetTTL(ttl)
+}
+
+// Find the TCP socket beneath the connection wrappers used by the proxy
+func underlyingTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case *ObfuscatedConnection:
+			conn = c.Conn
+		case *ShadowsocksConn:
+			conn = c.Conn
+		case *webSocketConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }: // crypto/tls and uTLS connections
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Emit decoys along the active routes until ctx is cancelled. Decoys go out one at
+// a time on their own sockets, never through the connection pool, so they cannot
+// hold up proxied traffic.
+func (r *RouteObfuscator) run(ctx context.Context, counter *int64) {
+	timer := time.NewTimer(r.nextDelay())
+	defer timer.Stop()
+	
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		
+		if route, ok := r.pickRoute(); ok {
+			sendCtx, cancel := context.WithTimeout(ctx, r.timeout)
+			err := r.send(sendCtx, route)
+			cancel()
+			if err != nil {
+				r.logger.Printf("Decoy to %s (%s) failed: %v", route.Target, route.Protocol, err)
+			} else {
+				atomic.AddInt64(&r.sent, 1)
+				atomic.AddInt64(counter, 1)
+			}
+		}
+		timer.Reset(r.nextDelay())
+	}
+}
+
+// Interval randomized by up to ±jitter so decoys have no fixed period
+func (r *RouteObfuscator) nextDelay() time.Duration {
+	spread := (mathrand.Float64()*2 - 1) * r.jitter
+	delay := time.Duration(float64(r.interval) * (1 + spread))
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	return delay
+}
+
+// Random active decoy route
+func (r *RouteObfuscator) pickRoute() (DecoyRoute, bool) {
+	var active []DecoyRoute
+	for _, route := range r.decoyRoutes {
+		if route.Active {
+			active = append(active, route)
+		}
+	}
+	if len(active) == 0 {
+		return DecoyRoute{}, false
+	}
+	return active[mathrand.Intn(len(active))], true
+}
+
+// Number of decoys sent successfully
+func (r *RouteObfuscator) Sent() int64 {
+	return atomic.LoadInt64(&r.sent)
+}
+
+// Send one small decoy to the route's target
+func (r *RouteObfuscator) sendDecoy(ctx context.Context, route DecoyRoute) error {
+	payload := make([]byte, 32+mathrand.Intn(96))
+	rand.Read(payload)
+	
+	var dialer net.Dialer
+	switch route.Protocol {
+	case "icmp":
+		conn, err := dialer.DialContext(ctx, "ip4:icmp", route.Target)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write(icmpEchoRequest(uint16(mathrand.Intn(1<<16)), 1, payload))
+		return err
+		
+	case "tcp":
+		conn, err := dialer.DialContext(ctx, "tcp", decoyAddress(route.Target, "443"))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+		
+	case "udp":
+		conn, err := dialer.DialContext(ctx, "udp", decoyAddress(route.Target, "443"))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write(payload)
+		return err
+		
+	case "http":
+		target := route.Target
+		if !strings.Contains(target, "://") {
+			target = "http://" + target
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(target, "/")+"/"+generateRandomString(8), nil)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		return resp.Body.Close()
+		
+	default:
+		return fmt.Errorf("unsupported decoy protocol %q", route.Protocol)
+	}
+}
+
+// Append defaultPort to target unless it already has a port
+func decoyAddress(target, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(target, defaultPort)
+}
+
+// ICMP echo request with the RFC 1071 checksum filled in
+func icmpEchoRequest(id, seq uint16, payload []byte) []byte {
+	msg := make([]byte, 8+len(payload))
+	msg[0] = 8 // echo request
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], payload)
+	
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(msg[2:], ^uint16(sum))
+	return msg
 }
 
 // Update latency metrics
 func (m *AdvancedProxyManager) updateLatencyMetrics(duration time.Duration) {
-	// Simple moving average
-	if m.metrics.AvgLatency == 0 {
-		m.metrics.AvgLatency = duration
-	} else {
-		m.metrics.AvgLatency = (m.metrics.AvgLatency + duration) / 2
+	avg := (*int64)(&m.metrics.AvgLatency)
+	for {
+		// Simple moving average
+		old := atomic.LoadInt64(avg)
+		next := int64(duration)
+		if old != 0 {
+			next = (old + int64(duration)) / 2
+		}
+		if atomic.CompareAndSwapInt64(avg, old, next) {
+			return
+		}
+	}
+}
+
+// Consistent copy of the proxy counters
+func (m *AdvancedProxyManager) GetMetrics() ProxyMetrics {
+	return ProxyMetrics{
+		RequestsProcessed:        atomic.LoadInt64(&m.metrics.RequestsProcessed),
+		BytesTransferred:         atomic.LoadInt64(&m.metrics.BytesTransferred),
+		AvgLatency:               time.Duration(atomic.LoadInt64((*int64)(&m.metrics.AvgLatency))),
+		DPIEvasionsApplied:       atomic.LoadInt64(&m.metrics.DPIEvasionsApplied),
+		TrafficObfuscated:        atomic.LoadInt64(&m.metrics.TrafficObfuscated),
+		LoadBalancerHits:         atomic.LoadInt64(&m.metrics.LoadBalancerHits),
+		StealthConnections:       atomic.LoadInt64(&m.metrics.StealthConnections),
+		TopologyHidingApplied:    atomic.LoadInt64(&m.metrics.TopologyHidingApplied),
+		UpstreamFailovers:        atomic.LoadInt64(&m.metrics.UpstreamFailovers),
+		CircuitBreakerRejections: atomic.LoadInt64(&m.metrics.CircuitBreakerRejections),
+		DecoysSent:               atomic.LoadInt64(&m.metrics.DecoysSent),
+	}
+}
+
+// Serve the metrics as JSON on /metrics. Proxied requests for a /metrics path on
+// some other host carry an absolute URL and are passed on to ProcessHTTPRequest.
+func (m *AdvancedProxyManager) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.URL.IsAbs() || r.Method == http.MethodConnect {
+		m.ProcessHTTPRequest(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	
+	report := struct {
+		Proxy           ProxyMetrics           `json:"proxy"`
+		ConnectionPools map[string]PoolMetrics `json:"connectionPools"`
+		CircuitBreakers map[string]string      `json:"circuitBreakers"`
+	}{
+		Proxy:           m.GetMetrics(),
+		ConnectionPools: m.connectionPool.GetMetrics(),
+		CircuitBreakers: m.circuitBreakers.States(),
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
 }
 
 // Utility functions
+// Random alphanumeric string from crypto/rand. Bytes that would bias the
+// modulo are rejected; panics only if the system RNG fails.
 func generateRandomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+	const limit = 256 - 256%len(charset)
+	
+	b := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(b) < length {
+		if _, err := rand.Read(buf); err != nil {
+			panic(fmt.Sprintf("crypto/rand failed: %v", err))
+		}
+		for _, r := range buf {
+			if int(r) < limit && len(b) < length {
+				b = append(b, charset[int(r)%len(charset)])
+			}
+		}
 	}
 	return string(b)
 }
 
 func encodeBase64(s string) string {
-	// Simple base64 encoding simulation
-	return "encoded_" + s
+	return base64.StdEncoding.EncodeToString([]byte(s))
 }
 
-func parsePort(port string) int {
-	// Simple port parsing
-	if port == "80" {
-		return 80
-	} else if port == "443" {
-		return 443
+func parsePort(port string) (int, error) {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: %v", port, err)
+	}
+	if portNum < 1 || portNum > 65535 {
+		return 0, fmt.Errorf("port out of range: %d", portNum)
 	}
-	return 8080
+	return portNum, nil
 }
 
 // Interface implementations for various components would go here...
 // (Simplified for brevity)
 
+// Obfuscated stream. Each direction starts with a random IV followed by
+// AES-CTR encrypted frames of [payload length][padding length][payload][padding].
 type ObfuscatedConnection struct {
 	net.Conn
-	key     []byte
-	level   int
-	padding int
+	key          []byte
+	level        int
+	padding      int
+	streamCipher obfuscationCipher
+	
+	writeStream cipher.Stream
+	writeMu     sync.Mutex
+	readStream  cipher.Stream
+	readBuf     []byte
+	readMu      sync.Mutex
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+const (
+	obfuscationFrameHeader  = 4
+	obfuscationMaxFrameData = 0xFFFF
+)
+
+// Stream cipher keyed by the 32-byte obfuscation key. The random nonce sent at the
+// start of each direction makes every connection's keystream distinct.
+type obfuscationCipher struct {
+	nonceSize int
+	newStream func(key, nonce []byte) (cipher.Stream, error)
+}
+
+var obfuscationCiphers = map[string]obfuscationCipher{
+	"":         {nonceSize: aes.BlockSize, newStream: newAESCTR},
+	"aes-ctr":  {nonceSize: aes.BlockSize, newStream: newAESCTR},
+	"chacha20": {nonceSize: chacha20.NonceSize, newStream: newChaCha20},
+}
+
+func newAESCTR(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+func newChaCha20(key, nonce []byte) (cipher.Stream, error) {
+	return chacha20.NewUnauthenticatedCipher(key, nonce)
+}
+
+func (oc *ObfuscatedConnection) Write(b []byte) (n int, err error) {
+	oc.writeMu.Lock()
+	defer oc.writeMu.Unlock()
+	
+	if err := oc.startWriteStream(); err != nil {
+		return 0, err
+	}
+	
+	padding := oc.padding
+	if padding > obfuscationMaxFrameData {
+		padding = obfuscationMaxFrameData
+	}
+	
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > obfuscationMaxFrameData {
+			chunk = chunk[:obfuscationMaxFrameData]
+		}
+		
+		frame := make([]byte, obfuscationFrameHeader+len(chunk)+padding)
+		binary.BigEndian.PutUint16(frame[0:2], uint16(len(chunk)))
+		binary.BigEndian.PutUint16(frame[2:4], uint16(padding))
+		copy(frame[obfuscationFrameHeader:], chunk)
+		
+		// Add padding
+		if _, err := rand.Read(frame[obfuscationFrameHeader+len(chunk):]); err != nil {
+			return n, err
+		}
+		
+		oc.writeStream.XORKeyStream(frame, frame)
+		if _, err := oc.Conn.Write(frame); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	
+	return n, nil
+}
+
+// Send the nonce for the write direction, once. Callers hold writeMu.
+func (oc *ObfuscatedConnection) startWriteStream() error {
+	if oc.writeStream != nil {
+		return nil
+	}
+	
+	iv := make([]byte, oc.nonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	stream, err := oc.newStream(iv)
+	if err != nil {
+		return err
+	}
+	if _, err := oc.Conn.Write(iv); err != nil {
+		return err
+	}
+	oc.writeStream = stream
+	return nil
+}
+
+// Write a frame carrying only padding, which the reader discards
+func (oc *ObfuscatedConnection) writeDummyFrame(size int) error {
+	oc.writeMu.Lock()
+	defer oc.writeMu.Unlock()
+	
+	if err := oc.startWriteStream(); err != nil {
+		return err
+	}
+	if size > obfuscationMaxFrameData {
+		size = obfuscationMaxFrameData
+	}
+	
+	frame := make([]byte, obfuscationFrameHeader+size)
+	binary.BigEndian.PutUint16(frame[2:4], uint16(size))
+	if _, err := rand.Read(frame[obfuscationFrameHeader:]); err != nil {
+		return err
+	}
+	
+	oc.writeStream.XORKeyStream(frame, frame)
+	_, err := oc.Conn.Write(frame)
+	return err
+}
+
+// Mix dummy frames into the connection until it is closed or a write fails
+func (oc *ObfuscatedConnection) interleaveDummyTraffic(model *DummyTrafficModel) {
+	timer := time.NewTimer(model.NextInterval())
+	defer timer.Stop()
+	
+	for {
+		select {
+		case <-oc.closed:
+			return
+		case <-timer.C:
+		}
+		
+		if err := oc.writeDummyFrame(model.NextSize()); err != nil {
+			return
+		}
+		timer.Reset(model.NextInterval())
+	}
+}
+
+func (oc *ObfuscatedConnection) Close() error {
+	if oc.closed != nil {
+		oc.closeOnce.Do(func() { close(oc.closed) })
+	}
+	return oc.Conn.Close()
+}
+
+func (oc *ObfuscatedConnection) Read(b []byte) (n int, err error) {
+	oc.readMu.Lock()
+	defer oc.readMu.Unlock()
+	
+	if oc.readStream == nil {
+		iv := make([]byte, oc.nonceSize())
+		if _, err := io.ReadFull(oc.Conn, iv); err != nil {
+			return 0, err
+		}
+		stream, err := oc.newStream(iv)
+		if err != nil {
+			return 0, err
+		}
+		oc.readStream = stream
+	}
+	
+	// Skip frames that carry only padding
+	for len(oc.readBuf) == 0 {
+		header := make([]byte, obfuscationFrameHeader)
+		if _, err := io.ReadFull(oc.Conn, header); err != nil {
+			return 0, err
+		}
+		oc.readStream.XORKeyStream(header, header)
+		
+		length := int(binary.BigEndian.Uint16(header[0:2]))
+		padding := int(binary.BigEndian.Uint16(header[2:4]))
+		
+		body := make([]byte, length+padding)
+		if _, err := io.ReadFull(oc.Conn, body); err != nil {
+			return 0, err
+		}
+		oc.readStream.XORKeyStream(body, body)
+		oc.readBuf = body[:length]
+	}
+	
+	n = copy(b, oc.readBuf)
+	oc.readBuf = oc.readBuf[n:]
+	return n, nil
+}
+
+func (oc *ObfuscatedConnection) nonceSize() int {
+	if oc.streamCipher.newStream == nil {
+		return aes.BlockSize
+	}
+	return oc.streamCipher.nonceSize
+}
+
+func (oc *ObfuscatedConnection) newStream(iv []byte) (cipher.Stream, error) {
+	newStream := oc.streamCipher.newStream
+	if newStream == nil {
+		newStream = newAESCTR
+	}
+	stream, err := newStream(oc.key, iv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid obfuscation key: %v", err)
+	}
+	return stream, nil
+}
+
+type shadowsocksCipher struct {
+	keyLen  int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var shadowsocksCiphers = map[string]shadowsocksCipher{
+	"chacha20-ietf-poly1305": {keyLen: chacha20poly1305.KeySize, newAEAD: chacha20poly1305.New},
+	"aes-256-gcm":            {keyLen: 32, newAEAD: newAESGCM},
+	"aes-128-gcm":            {keyLen: 16, newAEAD: newAESGCM},
+}
+
+const shadowsocksMaxPayload = 0x3FFF
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Shadowsocks AEAD stream (SIP004). Each direction begins with a random salt
+// from which a session subkey is derived, followed by sealed chunks of
+// [length][payload] with an incrementing nonce.
+type ShadowsocksConn struct {
+	net.Conn
+	cipher     shadowsocksCipher
+	key        []byte
+	writeAEAD  cipher.AEAD
+	writeNonce []byte
+	writeMu    sync.Mutex
+	readAEAD   cipher.AEAD
+	readNonce  []byte
+	readBuf    []byte
+	readMu     sync.Mutex
+}
+
+func newShadowsocksConn(conn net.Conn, method, password string) (*ShadowsocksConn, error) {
+	if method == "" {
+		method = "chacha20-ietf-poly1305"
+	}
+	ssCipher, exists := shadowsocksCiphers[method]
+	if !exists {
+		return nil, fmt.Errorf("unsupported shadowsocks method: %s", method)
+	}
+	
+	return &ShadowsocksConn{
+		Conn:   conn,
+		cipher: ssCipher,
+		key:    shadowsocksKey(password, ssCipher.keyLen),
+	}, nil
+}
+
+// Derive the master key from the password (OpenSSL EVP_BytesToKey with MD5)
+func shadowsocksKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		hash := md5.New()
+		hash.Write(prev)
+		hash.Write([]byte(password))
+		prev = hash.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+// Create the AEAD for a session from its salt
+func (c *ShadowsocksConn) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.cipher.keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.cipher.newAEAD(subkey)
+}
+
+func (c *ShadowsocksConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	
+	var out []byte
+	if c.writeAEAD == nil {
+		salt := make([]byte, c.cipher.keyLen)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.sessionAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writeAEAD = aead
+		c.writeNonce = make([]byte, aead.NonceSize())
+		out = salt
+	}
+	
+	for start := 0; start < len(b); start += shadowsocksMaxPayload {
+		end := start + shadowsocksMaxPayload
+		if end > len(b) {
+			end = len(b)
+		}
+		
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(end-start))
+		out = c.writeAEAD.Seal(out, c.writeNonce, length[:], nil)
+		incrementNonce(c.writeNonce)
+		out = c.writeAEAD.Seal(out, c.writeNonce, b[start:end], nil)
+		incrementNonce(c.writeNonce)
+	}
+	
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *ShadowsocksConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	
+	if c.readAEAD == nil {
+		salt := make([]byte, c.cipher.keyLen)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.sessionAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.readAEAD = aead
+		c.readNonce = make([]byte, aead.NonceSize())
+	}
+	
+	if len(c.readBuf) == 0 {
+		overhead := c.readAEAD.Overhead()
+		header := make([]byte, 2+overhead)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		length, err := c.readAEAD.Open(header[:0], c.readNonce, header, nil)
+		if err != nil {
+			return 0, fmt.Errorf("shadowsocks: invalid chunk length: %v", err)
+		}
+		incrementNonce(c.readNonce)
+		
+		size := int(binary.BigEndian.Uint16(length)) & shadowsocksMaxPayload
+		payload := make([]byte, size+overhead)
+		if _, err := io.ReadFull(c.Conn, payload); err != nil {
+			return 0, err
+		}
+		c.readBuf, err = c.readAEAD.Open(payload[:0], c.readNonce, payload, nil)
+		if err != nil {
+			return 0, fmt.Errorf("shadowsocks: invalid chunk payload: %v", err)
+		}
+		incrementNonce(c.readNonce)
+	}
+	
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Increment a little-endian nonce
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+type PooledConnection struct {
+	net.Conn
+	connType string
+	key      string
+	reader   *bufio.Reader // kept with the connection so buffered bytes are not lost between requests
+	created  time.Time
+	lastUsed time.Time
+	reused   int
+	pool     *ConnectionPool
+	closeOnce sync.Once
+}
+
+// Identify connections that can be shared: same target over the same route
+func connectionPoolKey(target string, upstream *UpstreamProxy) string {
+	if upstream == nil {
+		return "direct|" + target
+	}
+	return fmt.Sprintf("%s|%s|%s", upstream.Type, upstream.Name, target)
+}
+
+// Wrap a newly dialed connection and count it as active
+func (p *ConnectionPool) newConnection(conn net.Conn, connType, key string) *PooledConnection {
+	now := time.Now()
+	pc := &PooledConnection{
+		Conn:     conn,
+		connType: connType,
+		key:      key,
+		reader:   bufio.NewReader(conn),
+		created:  now,
+		lastUsed: now,
+		pool:     p,
+	}
+	
+	metrics := p.metricsFor(connType)
+	atomic.AddInt64(&metrics.Created, 1)
+	atomic.AddInt64(&metrics.Active, 1)
+	return pc
+}
+
+// Check out an idle connection for key, discarding expired or dead ones
+func (p *ConnectionPool) Get(key string) *PooledConnection {
+	for {
+		p.mutex.Lock()
+		idle := p.idle[key]
+		if len(idle) == 0 {
+			p.mutex.Unlock()
+			return nil
+		}
+		pc := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		p.mutex.Unlock()
+		
+		metrics := p.metricsFor(pc.connType)
+		atomic.AddInt64(&metrics.Active, 1)
+		
+		if time.Since(pc.lastUsed) > p.idleTimeout || !pc.isAlive() {
+			pc.Close()
+			continue
+		}
+		
+		pc.reused++
+		atomic.AddInt64(&metrics.Reused, 1)
+		return pc
+	}
+}
+
+// Return a connection to the idle list, closing it if the list is full
+func (p *ConnectionPool) Put(pc *PooledConnection) {
+	pc.lastUsed = time.Now()
+	
+	p.mutex.Lock()
+	if len(p.idle[pc.key]) >= p.maxIdlePerKey {
+		p.mutex.Unlock()
+		pc.Close()
+		return
+	}
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+	p.mutex.Unlock()
+	
+	atomic.AddInt64(&p.metricsFor(pc.connType).Active, -1)
+}
+
+// Snapshot of the metrics for each connection type
+func (p *ConnectionPool) GetMetrics() map[string]PoolMetrics {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	
+	snapshot := make(map[string]PoolMetrics, len(p.metrics))
+	for connType, metrics := range p.metrics {
+		snapshot[connType] = PoolMetrics{
+			Created: atomic.LoadInt64(&metrics.Created),
+			Reused:  atomic.LoadInt64(&metrics.Reused),
+			Closed:  atomic.LoadInt64(&metrics.Closed),
+			Active:  atomic.LoadInt64(&metrics.Active),
+		}
+	}
+	return snapshot
+}
+
+func (p *ConnectionPool) metricsFor(connType string) *PoolMetrics {
+	p.mutex.RLock()
+	metrics, exists := p.metrics[connType]
+	p.mutex.RUnlock()
+	if exists {
+		return metrics
+	}
+	
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if metrics, exists = p.metrics[connType]; !exists {
+		metrics = &PoolMetrics{}
+		p.metrics[connType] = metrics
+	}
+	return metrics
 }
 
-func (oc *ObfuscatedConnection) Write(b []byte) (n int, err error) {
-	// Apply obfuscation
-	obfuscated := make([]byte, len(b)+oc.padding)
-	copy(obfuscated, b)
-	
-	// Add padding
-	for i := len(b); i < len(obfuscated); i++ {
-		obfuscated[i] = byte(rand.Intn(256))
+// An idle connection is healthy if nothing is waiting to be read. Data or EOF
+// on an idle HTTP connection means the server closed or desynchronised it.
+func (pc *PooledConnection) isAlive() bool {
+	if pc.reader.Buffered() > 0 {
+		return false
 	}
 	
-	// Simple XOR obfuscation
-	for i := 0; i < len(obfuscated); i++ {
-		obfuscated[i] ^= oc.key[i%len(oc.key)]
+	pc.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := pc.reader.Peek(1)
+	pc.Conn.SetReadDeadline(time.Time{})
+	
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Write the request and read its response on this connection
+func (pc *PooledConnection) roundTrip(r *http.Request) (*http.Response, error) {
+	if err := r.Write(pc.Conn); err != nil {
+		return nil, fmt.Errorf("failed to forward request: %v", err)
 	}
 	
-	return oc.Conn.Write(obfuscated)
+	resp, err := http.ReadResponse(pc.reader, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp, nil
 }
 
-type PooledConnection struct {
-	net.Conn
-	connType string
-	created  time.Time
-	reused   int
+// Close the underlying connection and remove it from the active count
+func (pc *PooledConnection) Close() error {
+	var err error
+	pc.closeOnce.Do(func() {
+		err = pc.Conn.Close()
+		metrics := pc.pool.metricsFor(pc.connType)
+		atomic.AddInt64(&metrics.Closed, 1)
+		atomic.AddInt64(&metrics.Active, -1)
+	})
+	return err
 }
 
 // Load balancing algorithms
@@ -1068,16 +2629,41 @@ func (rr *RoundRobinAlgorithm) GetName() string {
 	return "round_robin"
 }
 
-type WeightedAlgorithm struct{}
+// Smooth weighted round-robin: every pick adds each upstream's weight to its
+// current weight, selects the largest and subtracts the total from it, which
+// spreads selections evenly in proportion to Weight.
+type WeightedAlgorithm struct {
+	current map[string]int // current weight by upstream name
+	mutex   sync.Mutex
+}
 
 func (w *WeightedAlgorithm) SelectUpstream(upstreams []UpstreamProxy) *UpstreamProxy {
-	// Simplified weighted selection
-	for _, upstream := range upstreams {
-		if upstream.Healthy && upstream.Weight > 0 {
-			return &upstream
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	
+	if w.current == nil {
+		w.current = make(map[string]int)
+	}
+	
+	var selected *UpstreamProxy
+	total := 0
+	for i := range upstreams {
+		upstream := &upstreams[i]
+		if !upstream.Healthy || upstream.Weight <= 0 {
+			continue
+		}
+		
+		w.current[upstream.Name] += upstream.Weight
+		total += upstream.Weight
+		if selected == nil || w.current[upstream.Name] > w.current[selected.Name] {
+			selected = upstream
 		}
 	}
-	return nil
+	
+	if selected != nil {
+		w.current[selected.Name] -= total
+	}
+	return selected
 }
 
 func (w *WeightedAlgorithm) GetName() string {
@@ -1086,20 +2672,262 @@ func (w *WeightedAlgorithm) GetName() string {
 
 type LeastConnectionsAlgorithm struct{}
 
+// Pick the healthy upstream with the fewest active connections
 func (lc *LeastConnectionsAlgorithm) SelectUpstream(upstreams []UpstreamProxy) *UpstreamProxy {
-	// Simplified implementation - would track actual connections in practice
-	for _, upstream := range upstreams {
-		if upstream.Healthy {
-			return &upstream
+	var selected *UpstreamProxy
+	var fewest int64
+	for i := range upstreams {
+		upstream := &upstreams[i]
+		if !upstream.Healthy {
+			continue
+		}
+		
+		active := atomic.LoadInt64(&upstream.ActiveConnections)
+		if selected == nil || active < fewest {
+			selected = upstream
+			fewest = active
+		}
+	}
+	return selected
+}
+
+// Count a connection against upstream. The returned release function must be
+// called exactly once when the connection ends, including on dial errors;
+// extra calls are ignored.
+func (lb *LoadBalancer) Acquire(upstream *UpstreamProxy) func() {
+	if lb == nil || upstream == nil {
+		return func() {}
+	}
+	
+	atomic.AddInt64(&upstream.ActiveConnections, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&upstream.ActiveConnections, -1)
+		})
+	}
+}
+
+// Select an upstream with the configured algorithm. When exclude is non-empty
+// (a failover), upstreams in it and unhealthy ones are skipped, falling back to
+// the first remaining healthy upstream. Upstreams whose circuit breaker is open
+// are always skipped.
+func (lb *LoadBalancer) selectUpstream(exclude map[string]bool) *UpstreamProxy {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	
+	upstream := lb.algorithm.SelectUpstream(lb.upstreams)
+	if len(exclude) == 0 && (upstream == nil || lb.breakers.Allow(upstream.Name)) {
+		return upstream
+	}
+	if upstream != nil && upstream.Healthy && !exclude[upstream.Name] && lb.breakers.Allow(upstream.Name) {
+		return upstream
+	}
+	
+	for i := range lb.upstreams {
+		candidate := &lb.upstreams[i]
+		if candidate.Healthy && !exclude[candidate.Name] && lb.breakers.Allow(candidate.Name) {
+			return candidate
 		}
 	}
 	return nil
 }
 
+// Mark an upstream unhealthy after a failed connection. The health checker
+// restores it once probes succeed again.
+func (lb *LoadBalancer) markUnhealthy(upstream *UpstreamProxy, err error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	
+	upstream.Healthy = false
+	
+	check := lb.healthCheck.checks[upstream.Name]
+	check.LastCheck = time.Now()
+	check.Healthy = false
+	check.Errors++
+	check.Successes = 0
+	check.LastError = err.Error()
+	lb.healthCheck.checks[upstream.Name] = check
+}
+
+// Create a breaker set; a threshold of 0 or less disables circuit breaking
+func NewCircuitBreakerSet(threshold int, cooldown time.Duration) *CircuitBreakerSet {
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &CircuitBreakerSet{
+		breakers:  make(map[string]*CircuitBreaker),
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Key requests by upstream, or by destination host when connecting directly
+func circuitBreakerKey(host string, upstream *UpstreamProxy) string {
+	if upstream != nil {
+		return upstream.Name
+	}
+	return "direct:" + host
+}
+
+// Return the breaker for key, creating it on first use
+func (s *CircuitBreakerSet) get(key string) *CircuitBreaker {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	breaker, exists := s.breakers[key]
+	if !exists {
+		breaker = &CircuitBreaker{state: circuitClosed, threshold: s.threshold, cooldown: s.cooldown}
+		s.breakers[key] = breaker
+	}
+	return breaker
+}
+
+// Report whether a request to key may proceed. Nil or disabled sets allow everything.
+func (s *CircuitBreakerSet) Allow(key string) bool {
+	if s == nil || s.threshold <= 0 {
+		return true
+	}
+	return s.get(key).Allow(time.Now())
+}
+
+func (s *CircuitBreakerSet) RecordSuccess(key string) {
+	if s == nil || s.threshold <= 0 {
+		return
+	}
+	s.get(key).RecordSuccess()
+}
+
+func (s *CircuitBreakerSet) RecordFailure(key string) {
+	if s == nil || s.threshold <= 0 {
+		return
+	}
+	s.get(key).RecordFailure(time.Now())
+}
+
+// Current state of every breaker, keyed like the set
+func (s *CircuitBreakerSet) States() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	states := make(map[string]string, len(s.breakers))
+	for key, breaker := range s.breakers {
+		states[key] = breaker.State()
+	}
+	return states
+}
+
+// Report whether a request may proceed. Once the cooldown has passed an open
+// breaker goes half-open and admits exactly one probe until it is resolved.
+func (b *CircuitBreaker) Allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Close the breaker after a successful request
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	
+	b.state = circuitClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Count a failure, opening the breaker at the threshold or if a probe failed
+func (b *CircuitBreaker) RecordFailure(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	
+	b.failures++
+	b.probing = false
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openedAt = now
+	}
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
 func (lc *LeastConnectionsAlgorithm) GetName() string {
 	return "least_connections"
 }
 
+// Latency difference under which upstreams are considered tied
+const defaultLatencyTolerance = 5 * time.Millisecond
+
+type LowestLatencyAlgorithm struct {
+	Tolerance time.Duration
+}
+
+// Pick the healthy upstream with the lowest measured latency. Upstreams within
+// Tolerance of the fastest are chosen at random so clients don't all pile onto
+// one upstream. Upstreams without a measurement are used only if none have one.
+func (ll *LowestLatencyAlgorithm) SelectUpstream(upstreams []UpstreamProxy) *UpstreamProxy {
+	tolerance := ll.Tolerance
+	if tolerance <= 0 {
+		tolerance = defaultLatencyTolerance
+	}
+	
+	var fastest time.Duration = -1
+	var unmeasured []*UpstreamProxy
+	for i := range upstreams {
+		upstream := &upstreams[i]
+		if !upstream.Healthy {
+			continue
+		}
+		if upstream.Latency <= 0 {
+			unmeasured = append(unmeasured, upstream)
+			continue
+		}
+		if fastest < 0 || upstream.Latency < fastest {
+			fastest = upstream.Latency
+		}
+	}
+	
+	if fastest < 0 {
+		if len(unmeasured) == 0 {
+			return nil
+		}
+		return unmeasured[mathrand.Intn(len(unmeasured))]
+	}
+	
+	var candidates []*UpstreamProxy
+	for i := range upstreams {
+		upstream := &upstreams[i]
+		if upstream.Healthy && upstream.Latency > 0 && upstream.Latency-fastest <= tolerance {
+			candidates = append(candidates, upstream)
+		}
+	}
+	return candidates[mathrand.Intn(len(candidates))]
+}
+
+func (ll *LowestLatencyAlgorithm) GetName() string {
+	return "lowest_latency"
+}
+
 // Start health checking
 func (lb *LoadBalancer) startHealthChecking() {
 	ticker := time.NewTicker(lb.healthCheck.interval)
@@ -1113,40 +2941,150 @@ func (lb *LoadBalancer) startHealthChecking() {
 func (lb *LoadBalancer) performHealthChecks() {
 	for i := range lb.upstreams {
 		upstream := &lb.upstreams[i]
-		start := time.Now()
-		
-		// Simple health check
-		conn, err := net.DialTimeout("tcp", 
-			fmt.Sprintf("%s:%d", upstream.Address, upstream.Port), 
-			lb.healthCheck.timeout)
-		
+		latency, err := lb.probeUpstream(upstream)
+		lb.recordHealthCheck(upstream, latency, err)
+	}
+}
+
+// Probe an upstream with a TCP dial, or an HTTP request to the probe path
+// when one is configured. HTTP probes require a 2xx response.
+func (lb *LoadBalancer) probeUpstream(upstream *UpstreamProxy) (time.Duration, error) {
+	addr := net.JoinHostPort(upstream.Address, strconv.Itoa(upstream.Port))
+	start := time.Now()
+	
+	if lb.healthCheck.path == "" || upstream.Type == "socks5" {
+		conn, err := net.DialTimeout("tcp", addr, lb.healthCheck.timeout)
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return time.Since(start), nil
+	}
+	
+	scheme := "http"
+	transport := &http.Transport{DisableKeepAlives: true}
+	if upstream.Type == "https" {
+		tlsConfig, err := buildUpstreamTLSConfig(upstream)
 		if err != nil {
+			return 0, err
+		}
+		scheme = "https"
+		transport.TLSClientConfig = tlsConfig
+	}
+	defer transport.CloseIdleConnections()
+	
+	client := &http.Client{
+		Timeout:   lb.healthCheck.timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	
+	resp, err := client.Get(fmt.Sprintf("%s://%s%s", scheme, addr, lb.healthCheck.path))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("health probe returned %s", resp.Status)
+	}
+	return time.Since(start), nil
+}
+
+// Record a probe result. Health only flips after the configured number of
+// consecutive successes or failures.
+func (lb *LoadBalancer) recordHealthCheck(upstream *UpstreamProxy, latency time.Duration, err error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	
+	check := lb.healthCheck.checks[upstream.Name]
+	check.LastCheck = time.Now()
+	
+	if err != nil {
+		check.Errors++
+		check.Successes = 0
+		check.LastError = err.Error()
+		if check.Errors >= lb.healthCheck.unhealthyThreshold {
 			upstream.Healthy = false
-			lb.healthCheck.checks[upstream.Name] = HealthCheck{
-				LastCheck: time.Now(),
-				Healthy:   false,
-				Errors:    lb.healthCheck.checks[upstream.Name].Errors + 1,
-			}
-		} else {
-			conn.Close()
+		}
+	} else {
+		check.Errors = 0
+		check.Successes++
+		check.LastError = ""
+		check.Latency = latency
+		upstream.Latency = latency
+		if check.Successes >= lb.healthCheck.healthyThreshold {
 			upstream.Healthy = true
-			upstream.Latency = time.Since(start)
-			lb.healthCheck.checks[upstream.Name] = HealthCheck{
-				LastCheck: time.Now(),
-				Healthy:   true,
-				Latency:   upstream.Latency,
-				Errors:    0,
-			}
 		}
 	}
+	
+	check.Healthy = upstream.Healthy
+	lb.healthCheck.checks[upstream.Name] = check
 }
 
 // Tunnel implementations (simplified)
-type WebSocketTunnel struct{}
+type WebSocketTunnel struct {
+	Host string
+	Path string
+}
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+	
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
 
+// Perform a client WebSocket handshake and frame all further traffic as binary messages
 func (wst *WebSocketTunnel) Wrap(conn net.Conn) (net.Conn, error) {
-	// WebSocket tunnel implementation would go here
-	return conn, nil
+	host := wst.Host
+	if host == "" {
+		host = conn.RemoteAddr().String()
+	}
+	path := wst.Path
+	if path == "" {
+		path = "/"
+	}
+	
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate websocket key: %v", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+	
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read websocket handshake: %v", err)
+	}
+	resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("websocket handshake failed: missing upgrade header")
+	}
+	
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("websocket handshake failed: invalid accept key")
+	}
+	
+	return &webSocketConn{Conn: conn, reader: reader}, nil
 }
 
 func (wst *WebSocketTunnel) Unwrap(conn net.Conn) (net.Conn, error) {
@@ -1157,11 +3095,209 @@ func (wst *WebSocketTunnel) GetType() string {
 	return "websocket"
 }
 
-type TLSTunnel struct{}
+// Client side of a WebSocket connection carrying a byte stream in binary messages
+type webSocketConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	remaining uint64 // unread payload bytes of the current data frame
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	closed    bool
+	writeMu   sync.Mutex
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// Read frame headers until a data frame with payload is found, answering control frames
+func (c *webSocketConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return err
+		}
+	}
+	
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		// Fragments are delivered in order as part of the stream
+		c.remaining = length
+		c.mask = mask
+		c.masked = masked
+		c.maskPos = 0
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > 125 {
+			return fmt.Errorf("websocket control frame too large: %d bytes", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		
+		switch opcode {
+		case wsOpPing:
+			return c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			c.writeClose(payload)
+			return io.EOF
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported websocket opcode: %d", opcode)
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write a single masked frame with the FIN bit set
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	
+	if c.closed {
+		return net.ErrClosed
+	}
+	
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[start+i] ^= mask[i%4]
+	}
+	
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Send a close frame once, echoing the peer's status code if given
+func (c *webSocketConn) writeClose(payload []byte) {
+	if len(payload) > 2 {
+		payload = payload[:2]
+	}
+	if len(payload) < 2 {
+		payload = []byte{0x03, 0xE8} // 1000 normal closure
+	}
+	c.writeFrame(wsOpClose, payload)
+	
+	c.writeMu.Lock()
+	c.closed = true
+	c.writeMu.Unlock()
+}
+
+func (c *webSocketConn) Close() error {
+	c.writeClose(nil)
+	return c.Conn.Close()
+}
+
+// TLS tunnel. Certificates are verified against ServerName, or the target host when
+// it is unset, unless Insecure is set.
+type TLSTunnel struct {
+	ServerName  string
+	Insecure    bool
+	Fingerprint string // ClientHello profile, see TLSFingerprint
+}
 
+// Wrap without a target can only use the configured ServerName
 func (tt *TLSTunnel) Wrap(conn net.Conn) (net.Conn, error) {
-	// TLS tunnel implementation
-	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	return tt.WrapTarget(conn, "")
+}
+
+func (tt *TLSTunnel) WrapTarget(conn net.Conn, target string) (net.Conn, error) {
+	serverName := tt.ServerName
+	if serverName == "" {
+		serverName = target
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			serverName = host
+		}
+	}
+	if serverName == "" {
+		return nil, fmt.Errorf("TLS tunnel has no server name: set tlsTunnelServerName")
+	}
+	
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: tt.Insecure,
+	}
+	
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	tlsConn, err := tlsHandshake(conn, config, tt.Fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("TLS tunnel handshake with %s failed: %v", serverName, err)
+	}
+	conn.SetDeadline(time.Time{})
 	return tlsConn, nil
 }
 
@@ -1266,13 +3402,19 @@ func (ctp *CDNTunnelProtocol) GetFingerprint() string {
 }
 
 // Dummy traffic generator
-func (to *TrafficObfuscator) generateDummyTraffic() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+func (to *TrafficObfuscator) generateDummyTraffic(ctx context.Context) {
+	timer := time.NewTimer(to.dummyModel.NextInterval())
+	defer timer.Stop()
 	
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		
 		// Generate dummy traffic
-		dummyData := make([]byte, 100+rand.Intn(400))
+		dummyData := make([]byte, to.dummyModel.NextSize())
 		rand.Read(dummyData)
 		
 		select {
@@ -1280,7 +3422,78 @@ func (to *TrafficObfuscator) generateDummyTraffic() {
 		default:
 			// Channel full, skip
 		}
+		timer.Reset(to.dummyModel.NextInterval())
+	}
+}
+
+// Dummy traffic model from the config, with defaults for unset parameters
+func newDummyTrafficModel(config *AdvancedProxyConfig) *DummyTrafficModel {
+	model := &DummyTrafficModel{
+		Interval:      config.DummyTrafficInterval,
+		IntervalModel: config.DummyIntervalModel,
+		SizeModel:     config.DummySizeModel,
+		SizeMedian:    config.DummySizeMedian,
+		SizeSigma:     config.DummySizeSigma,
+		SizeMax:       config.DummySizeMax,
+	}
+	if model.Interval <= 0 {
+		model.Interval = 5 * time.Second
+	}
+	if model.IntervalModel == "" {
+		model.IntervalModel = "poisson"
+	}
+	if model.SizeModel == "" {
+		model.SizeModel = "lognormal"
+	}
+	if model.SizeMax <= 0 || model.SizeMax > obfuscationMaxFrameData {
+		model.SizeMax = 16384
 	}
+	if model.SizeMedian <= 0 {
+		model.SizeMedian = 300
+	}
+	if model.SizeMedian > model.SizeMax {
+		model.SizeMedian = model.SizeMax
+	}
+	if model.SizeSigma <= 0 {
+		model.SizeSigma = 1.0
+	}
+	return model
+}
+
+// Time until the next dummy send. Poisson arrivals have exponentially
+// distributed gaps with the configured mean.
+func (d *DummyTrafficModel) NextInterval() time.Duration {
+	var interval time.Duration
+	switch d.IntervalModel {
+	case "fixed":
+		interval = d.Interval
+	case "uniform":
+		interval = time.Duration(mathrand.Float64() * 2 * float64(d.Interval))
+	default:
+		interval = time.Duration(mathrand.ExpFloat64() * float64(d.Interval))
+	}
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	return interval
+}
+
+// Size of the next dummy payload, between 1 and SizeMax bytes
+func (d *DummyTrafficModel) NextSize() int {
+	var size int
+	switch d.SizeModel {
+	case "uniform":
+		size = 1 + mathrand.Intn(2*d.SizeMedian)
+	default:
+		size = int(math.Exp(math.Log(float64(d.SizeMedian)) + d.SizeSigma*mathrand.NormFloat64()))
+	}
+	if size < 1 {
+		size = 1
+	}
+	if size > d.SizeMax {
+		size = d.SizeMax
+	}
+	return size
 }
 
 // Main function for testing
@@ -1317,10 +3530,14 @@ func main() {
 		RouteObfuscation:       true,
 	}
 	
-	manager := NewAdvancedProxyManager(config)
+	manager, err := NewAdvancedProxyManager(config)
+	if err != nil {
+		log.Fatalf("Failed to create advanced proxy manager: %v", err)
+	}
 	
 	// Start HTTP server with advanced proxy features
 	http.HandleFunc("/", manager.ProcessHTTPRequest)
+	http.HandleFunc("/metrics", manager.HandleMetrics)
 	
 	fmt.Println("Advanced proxy server starting on :8080...")
 	log.Fatal(http.ListenAndServe(":8080", nil))
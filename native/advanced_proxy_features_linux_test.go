@@ -0,0 +1,83 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// loopbackTCPPair connects to a listener on addr and returns the client side
+func loopbackTCPPair(t *testing.T, network, addr string) net.Conn {
+	t.Helper()
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("no %s loopback: %v", network, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	conn, err := net.Dial(network, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestTTLManipulatorApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		wrap    func(net.Conn) net.Conn
+	}{
+		{"ipv4", "tcp4", "127.0.0.1:0", nil},
+		{"ipv6 hop limit", "tcp6", "[::1]:0", nil},
+		{"obfuscated", "tcp4", "127.0.0.1:0", func(c net.Conn) net.Conn { return &ObfuscatedConnection{Conn: c} }},
+		{"tls", "tcp4", "127.0.0.1:0", func(c net.Conn) net.Conn { return tls.Client(c, &tls.Config{}) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := loopbackTCPPair(t, tt.network, tt.addr)
+			conn := raw
+			if tt.wrap != nil {
+				conn = tt.wrap(raw)
+			}
+
+			manipulator := &TTLManipulator{baseTTL: 64, variance: 16}
+			for i := 0; i < 20; i++ {
+				ttl, err := manipulator.Apply(conn)
+				if err != nil {
+					t.Fatalf("Apply: %v", err)
+				}
+				if ttl < 48 || ttl > 80 {
+					t.Fatalf("TTL %d outside 64±16", ttl)
+				}
+
+				// Read the option back from the socket
+				var got int
+				if tt.network == "tcp6" {
+					got, err = ipv6.NewConn(raw).HopLimit()
+				} else {
+					got, err = ipv4.NewConn(raw).TTL()
+				}
+				if err != nil {
+					t.Fatalf("reading TTL back: %v", err)
+				}
+				if got != ttl {
+					t.Fatalf("socket TTL = %d, Apply reported %d", got, ttl)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,2713 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/websocket"
+)
+
+// startTLSUpstream serves TLS on a loopback port and reports the SNI and ALPN
+// protocols of each ClientHello it receives
+func startTLSUpstream(t *testing.T) (*httptest.Server, <-chan *tls.ClientHelloInfo) {
+	t.Helper()
+	hellos := make(chan *tls.ClientHelloInfo, 8)
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- hello
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, hellos
+}
+
+func TestDialUpstreamTLS(t *testing.T) {
+	srv, hellos := startTLSUpstream(t)
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	otherSum := sha256.Sum256([]byte("another key"))
+	otherPin := base64.StdEncoding.EncodeToString(otherSum[:])
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		upstream UpstreamProxy
+		wantSNI  string
+		wantALPN []string
+		wantErr  string
+	}{
+		{
+			name:     "fronted sni and alpn with matching pin",
+			upstream: UpstreamProxy{Name: "front", ServerName: "front.example.com", ALPN: []string{"h2", "http/1.1"}, SPKIPins: []string{otherPin, pin}, InsecureSkipVerify: true},
+			wantSNI:  "front.example.com",
+			wantALPN: []string{"h2", "http/1.1"},
+		},
+		{
+			name:     "verified against ca file",
+			upstream: UpstreamProxy{Name: "ca", ServerName: "example.com", CAFile: caFile},
+			wantSNI:  "example.com",
+		},
+		{
+			name:     "pinned upstream with ca file",
+			upstream: UpstreamProxy{Name: "ca-pinned", ServerName: "example.com", CAFile: caFile, SPKIPins: []string{pin}},
+			wantSNI:  "example.com",
+		},
+		{
+			name:     "pin mismatch",
+			upstream: UpstreamProxy{Name: "mismatch", ServerName: "example.com", CAFile: caFile, SPKIPins: []string{otherPin}},
+			wantErr:  "pinned SPKI",
+		},
+		{
+			name:     "pin mismatch without verification",
+			upstream: UpstreamProxy{Name: "insecure-mismatch", SPKIPins: []string{otherPin}, InsecureSkipVerify: true},
+			wantErr:  "pinned SPKI",
+		},
+		{
+			name:     "untrusted certificate",
+			upstream: UpstreamProxy{Name: "untrusted", ServerName: "example.com"},
+			wantErr:  "handshake",
+		},
+		{
+			name:     "missing ca file",
+			upstream: UpstreamProxy{Name: "missing-ca", CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+			wantErr:  "CA file",
+		},
+	}
+
+	m := &AdvancedProxyManager{config: &AdvancedProxyConfig{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := tt.upstream
+			upstream.Type = "https"
+			upstream.Address = host
+			upstream.Port = port
+
+			conn, err := m.dialUpstream(srv.Listener.Addr().String(), &upstream)
+			if tt.wantErr != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dialUpstream succeeded, want error containing %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dialUpstream = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialUpstream: %v", err)
+			}
+			conn.Close()
+
+			hello := <-hellos
+			if hello.ServerName != tt.wantSNI {
+				t.Errorf("SNI = %q, want %q", hello.ServerName, tt.wantSNI)
+			}
+			if strings.Join(hello.SupportedProtos, ",") != strings.Join(tt.wantALPN, ",") {
+				t.Errorf("ALPN = %v, want %v", hello.SupportedProtos, tt.wantALPN)
+			}
+		})
+		// Drop the hellos of failed handshakes so the next case reads its own
+		for len(hellos) > 0 {
+			<-hellos
+		}
+	}
+}
+
+func TestWebSocketTunnelEcho(t *testing.T) {
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}})
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		size   int
+		writes int
+	}{
+		{"small frames", 100, 10},
+		{"16-bit length", 1000, 3},
+		{"64-bit length", 70000, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+
+			conn, err := (&WebSocketTunnel{Path: "/echo"}).Wrap(raw)
+			if err != nil {
+				t.Fatalf("Wrap: %v", err)
+			}
+
+			sent := make([]byte, tt.size*tt.writes)
+			rand.Read(sent)
+			go func() {
+				for i := 0; i < tt.writes; i++ {
+					conn.Write(sent[i*tt.size : (i+1)*tt.size])
+				}
+			}()
+
+			received := make([]byte, len(sent))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, received); err != nil {
+				t.Fatalf("read echo: %v", err)
+			}
+			if !bytes.Equal(received, sent) {
+				t.Error("echoed stream differs from what was sent")
+			}
+		})
+	}
+}
+
+// wsServerFrame builds an unmasked server-to-client frame
+func wsServerFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	return append([]byte{first, byte(len(payload))}, payload...)
+}
+
+// readWSClientFrame reads a masked client frame and returns its opcode and payload
+func readWSClientFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("read client frame: %v", err)
+	}
+	if header[1]&0x80 == 0 {
+		t.Error("client frame is not masked")
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read client payload: %v", err)
+	}
+	for i := range payload {
+		payload[i] ^= header[2+i%4]
+	}
+	return header[0] & 0x0F, payload
+}
+
+func TestWebSocketConnControlFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &webSocketConn{Conn: client, reader: bufio.NewReader(client)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var frames []byte
+		frames = append(frames, wsServerFrame(false, wsOpText, "frag")...)
+		frames = append(frames, wsServerFrame(true, wsOpPing, "are you there")...)
+		frames = append(frames, wsServerFrame(true, wsOpContinuation, "mented")...)
+		frames = append(frames, wsServerFrame(true, wsOpClose, "\x03\xe9going away")...)
+		server.Write(frames)
+
+		if opcode, payload := readWSClientFrame(t, server); opcode != wsOpPong || string(payload) != "are you there" {
+			t.Errorf("reply to ping = opcode %d %q, want a pong echoing the payload", opcode, payload)
+		}
+		if opcode, payload := readWSClientFrame(t, server); opcode != wsOpClose || !bytes.Equal(payload, []byte{0x03, 0xe9}) {
+			t.Errorf("reply to close = opcode %d %v, want a close echoing status 1001", opcode, payload)
+		}
+	}()
+
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(data) != "fragmented" {
+		t.Errorf("stream = %q, want the reassembled fragments", data)
+	}
+	<-done
+
+	if _, err := conn.Write([]byte("late")); err == nil {
+		t.Error("Write succeeded after the close handshake")
+	}
+}
+
+func TestWebSocketTunnelHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		wantErr  string
+	}{
+		{"not switching protocols", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", "403"},
+		{"missing upgrade", "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n\r\n", "missing upgrade"},
+		{"wrong accept key", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: bm90IHRoZSBrZXk=\r\n\r\n", "invalid accept key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				http.ReadRequest(bufio.NewReader(server))
+				io.WriteString(server, tt.response)
+			}()
+
+			_, err := (&WebSocketTunnel{Host: "example.com"}).Wrap(client)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Wrap = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestObfuscatedConnectionLoopback(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tests := []struct {
+		name    string
+		cipher  string
+		padding int
+		sizes   []int
+	}{
+		{"aes-ctr without padding", "aes-ctr", 0, []int{1, 100, 4096}},
+		{"aes-ctr with padding", "aes-ctr", 64, []int{1, 100, 4096}},
+		{"chacha20 with padding", "chacha20", 32, []int{17, 1500}},
+		{"frames split at the size limit", "", 8, []int{obfuscationMaxFrameData + 1000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			sender := &ObfuscatedConnection{Conn: a, key: key, streamCipher: obfuscationCiphers[tt.cipher], padding: tt.padding, closed: make(chan struct{})}
+			receiver := &ObfuscatedConnection{Conn: b, key: key, streamCipher: obfuscationCiphers[tt.cipher], closed: make(chan struct{})}
+			defer receiver.Close()
+
+			var sent []byte
+			for _, size := range tt.sizes {
+				chunk := make([]byte, size)
+				rand.Read(chunk)
+				sent = append(sent, chunk...)
+			}
+			go func() {
+				defer sender.Close()
+				offset := 0
+				for i, size := range tt.sizes {
+					// Padding-only frames in between must be skipped by the reader
+					if i > 0 {
+						sender.writeDummyFrame(size)
+					}
+					sender.Write(sent[offset : offset+size])
+					offset += size
+				}
+			}()
+
+			received, err := io.ReadAll(receiver)
+			if err != nil && err != io.ErrClosedPipe {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(received, sent) {
+				t.Errorf("received %d bytes that differ from the %d sent", len(received), len(sent))
+			}
+		})
+	}
+}
+
+func TestObfuscatedConnectionHidesPayload(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	a, b := net.Pipe()
+	defer b.Close()
+
+	payload := bytes.Repeat([]byte("plaintext "), 20)
+	go func() {
+		defer a.Close()
+		(&ObfuscatedConnection{Conn: a, key: key}).Write(payload)
+	}()
+
+	wire, _ := io.ReadAll(b)
+	if bytes.Contains(wire, []byte("plaintext")) {
+		t.Error("payload appears in clear on the wire")
+	}
+	if len(wire) != aes.BlockSize+obfuscationFrameHeader+len(payload) {
+		t.Errorf("wire length = %d, want nonce, header and payload", len(wire))
+	}
+}
+
+// obfuscatedWire writes payload through a fresh ObfuscatedConnection and returns
+// the bytes that reached the wire
+func obfuscatedWire(key []byte, name string, padding int, payload []byte) []byte {
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		defer a.Close()
+		(&ObfuscatedConnection{Conn: a, key: key, streamCipher: obfuscationCiphers[name], padding: padding}).Write(payload)
+	}()
+	wire, _ := io.ReadAll(b)
+	return wire
+}
+
+func TestObfuscatedConnectionDistinctNonces(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	payload := bytes.Repeat([]byte("same payload "), 10)
+
+	tests := []struct {
+		cipher    string
+		nonceSize int
+		padding   int
+	}{
+		{"aes-ctr", aes.BlockSize, 0},
+		{"chacha20", chacha20.NonceSize, 0},
+		{"chacha20", chacha20.NonceSize, 48},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s padding %d", tt.cipher, tt.padding), func(t *testing.T) {
+			first := obfuscatedWire(key, tt.cipher, tt.padding, payload)
+			second := obfuscatedWire(key, tt.cipher, tt.padding, payload)
+
+			if bytes.Equal(first[:tt.nonceSize], second[:tt.nonceSize]) {
+				t.Error("two connections used the same nonce")
+			}
+			if bytes.Equal(first[tt.nonceSize:], second[tt.nonceSize:]) {
+				t.Error("same payload gave the same ciphertext on two connections")
+			}
+			if tt.padding == 0 && len(first) != tt.nonceSize+obfuscationFrameHeader+len(payload) {
+				t.Errorf("wire length = %d, want nonce, header and payload", len(first))
+			}
+
+			// Each wire image decrypts to the payload, with its padding stripped
+			for _, wire := range [][]byte{first, second} {
+				a, b := net.Pipe()
+				go func() {
+					defer a.Close()
+					a.Write(wire)
+				}()
+				receiver := &ObfuscatedConnection{Conn: b, key: key, streamCipher: obfuscationCiphers[tt.cipher], closed: make(chan struct{})}
+				received, err := io.ReadAll(receiver)
+				receiver.Close()
+				if err != nil && err != io.ErrClosedPipe {
+					t.Fatalf("read: %v", err)
+				}
+				if !bytes.Equal(received, payload) {
+					t.Errorf("decrypted %q, want %q", received, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestObfuscationCipherSelection(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		configured string
+		wantNonce  int
+	}{
+		{"", aes.BlockSize},
+		{"aes-ctr", aes.BlockSize},
+		{"chacha20", chacha20.NonceSize},
+		{"rot13", aes.BlockSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.configured), func(t *testing.T) {
+			m := newTestProxyManager(t, &AdvancedProxyConfig{EnableTrafficObfuscation: true, ObfuscationCipher: tt.configured})
+			defer m.Close()
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			conn := m.obfuscateConnection(client).(*ObfuscatedConnection)
+			if got := conn.nonceSize(); got != tt.wantNonce {
+				t.Errorf("nonce size = %d, want %d", got, tt.wantNonce)
+			}
+		})
+	}
+}
+
+// newTestProxyManager creates a manager, failing the test if the config is rejected
+func newTestProxyManager(t *testing.T, config *AdvancedProxyConfig) *AdvancedProxyManager {
+	t.Helper()
+	m, err := NewAdvancedProxyManager(config)
+	if err != nil {
+		t.Fatalf("NewAdvancedProxyManager: %v", err)
+	}
+	return m
+}
+
+// startFakeUpstream accepts one connection on a loopback port and hands it to serve
+func startFakeUpstream(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestConnectHTTPProxyAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantAuth string
+	}{
+		{"basic credentials", "alice", "s3cret", "Basic YWxpY2U6czNjcmV0"},
+		{"colon in password", "bob", "pa:ss", "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pa:ss"))},
+		{"no credentials", "", "", ""},
+	}
+
+	m := &AdvancedProxyManager{config: &AdvancedProxyConfig{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan *http.Request, 1)
+			addr := startFakeUpstream(t, func(conn net.Conn) {
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					close(requests)
+					return
+				}
+				requests <- req
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			})
+
+			upstream := &UpstreamProxy{Type: "http", Username: tt.username, Password: tt.password}
+			conn, err := m.connectHTTPProxy(addr, "example.com:8443", upstream)
+			if err != nil {
+				t.Fatalf("connectHTTPProxy: %v", err)
+			}
+			conn.Close()
+
+			req := <-requests
+			if req == nil {
+				t.Fatal("proxy received no valid request")
+			}
+			if req.Method != http.MethodConnect || req.Host != "example.com:8443" {
+				t.Errorf("request = %s %s, want CONNECT example.com:8443", req.Method, req.Host)
+			}
+			if got := req.Header.Get("Proxy-Authorization"); got != tt.wantAuth {
+				t.Errorf("Proxy-Authorization = %q, want %q", got, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ConnectRequestPort(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   []byte
+	}{
+		{"ipv4 on 8443", "10.0.0.1:8443", []byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x20, 0xFB}},
+		{"domain on 8443", "example.com:8443", append(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, "example.com"...), 0x20, 0xFB)},
+		{"ipv6 on 65535", "[::1]:65535", append(append([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("::1")...), 0xFF, 0xFF)},
+	}
+
+	m := &AdvancedProxyManager{config: &AdvancedProxyConfig{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan []byte, 1)
+			addr := startFakeUpstream(t, func(conn net.Conn) {
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				conn.Write([]byte{0x05, 0x00})
+
+				req := make([]byte, len(tt.want))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				requests <- req
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			})
+
+			conn, err := m.connectSOCKS5Proxy(addr, tt.target, &UpstreamProxy{Type: "socks5"})
+			if err != nil {
+				t.Fatalf("connectSOCKS5Proxy: %v", err)
+			}
+			conn.Close()
+
+			if got := <-requests; !bytes.Equal(got, tt.want) {
+				t.Errorf("connect request = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		port    string
+		want    int
+		wantErr bool
+	}{
+		{"80", 80, false},
+		{"8443", 8443, false},
+		{"65535", 65535, false},
+		{"0", 0, true},
+		{"65536", 0, true},
+		{"http", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePort(tt.port)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePort(%q) = %d, %v, want %d (error %v)", tt.port, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGenerateRandomStringUniform(t *testing.T) {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	const samples = 10000
+	const length = 62
+
+	counts := make(map[rune]int)
+	for i := 0; i < samples; i++ {
+		s := generateRandomString(length)
+		if len(s) != length {
+			t.Fatalf("len(generateRandomString(%d)) = %d", length, len(s))
+		}
+		for _, c := range s {
+			counts[c]++
+		}
+	}
+
+	// Chi-squared with 61 degrees of freedom; 120 is far beyond the p = 0.0001
+	// critical value, so a fair generator essentially never fails
+	expected := float64(samples*length) / float64(len(charset))
+	var chi2 float64
+	for _, c := range charset {
+		diff := float64(counts[c]) - expected
+		chi2 += diff * diff / expected
+	}
+	if len(counts) != len(charset) {
+		t.Errorf("saw %d distinct characters, want %d", len(counts), len(charset))
+	}
+	if chi2 > 120 {
+		t.Errorf("chi-squared = %.1f, distribution is not uniform", chi2)
+	}
+}
+
+func TestWeightedAlgorithmDistribution(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []UpstreamProxy
+		want      map[string]float64
+	}{
+		{
+			name: "proportional to weight",
+			upstreams: []UpstreamProxy{
+				{Name: "a", Weight: 5, Healthy: true},
+				{Name: "b", Weight: 3, Healthy: true},
+				{Name: "c", Weight: 2, Healthy: true},
+			},
+			want: map[string]float64{"a": 0.5, "b": 0.3, "c": 0.2},
+		},
+		{
+			name: "unhealthy and zero weight skipped",
+			upstreams: []UpstreamProxy{
+				{Name: "a", Weight: 1, Healthy: true},
+				{Name: "b", Weight: 10, Healthy: false},
+				{Name: "c", Weight: 3, Healthy: true},
+				{Name: "d", Weight: 0, Healthy: true},
+			},
+			want: map[string]float64{"a": 0.25, "c": 0.75},
+		},
+	}
+
+	const selections = 10000
+	const workers = 8
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algorithm := &WeightedAlgorithm{}
+			results := make(chan string, selections)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < selections/workers; j++ {
+						if upstream := algorithm.SelectUpstream(tt.upstreams); upstream != nil {
+							results <- upstream.Name
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(results)
+
+			counts := make(map[string]int)
+			for name := range results {
+				counts[name]++
+			}
+			for name := range counts {
+				if _, ok := tt.want[name]; !ok {
+					t.Errorf("selected %s %d times, want never", name, counts[name])
+				}
+			}
+			for name, ratio := range tt.want {
+				got := float64(counts[name]) / selections
+				if got < ratio-0.01 || got > ratio+0.01 {
+					t.Errorf("%s share = %.3f, want %.3f", name, got, ratio)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedAlgorithmNoHealthyUpstream(t *testing.T) {
+	upstreams := []UpstreamProxy{{Name: "a", Weight: 1}, {Name: "b", Weight: 2}}
+	if got := (&WeightedAlgorithm{}).SelectUpstream(upstreams); got != nil {
+		t.Errorf("SelectUpstream = %s, want nil when every upstream is down", got.Name)
+	}
+}
+
+func TestLeastConnectionsTracksActiveConnections(t *testing.T) {
+	lb := &LoadBalancer{
+		upstreams: []UpstreamProxy{
+			{Name: "a", Healthy: true},
+			{Name: "b", Healthy: true},
+			{Name: "c", Healthy: true},
+		},
+		algorithm: &LeastConnectionsAlgorithm{},
+	}
+
+	// Open connections in the order the algorithm picks them; each pick must go to
+	// an upstream with the fewest connections so far
+	var releases []func()
+	for i := 0; i < 9; i++ {
+		upstream := lb.algorithm.SelectUpstream(lb.upstreams)
+		for _, other := range lb.upstreams {
+			if other.ActiveConnections < upstream.ActiveConnections {
+				t.Fatalf("pick %d chose %s with %d connections over %s with %d", i, upstream.Name, upstream.ActiveConnections, other.Name, other.ActiveConnections)
+			}
+		}
+		releases = append(releases, lb.Acquire(upstream))
+	}
+	for _, upstream := range lb.upstreams {
+		if upstream.ActiveConnections != 3 {
+			t.Errorf("%s has %d connections, want 3", upstream.Name, upstream.ActiveConnections)
+		}
+	}
+
+	// Freeing two connections on b makes it the least loaded
+	bRelease := lb.Acquire(&lb.upstreams[1])
+	bRelease()
+	bRelease()
+	releases[1]()
+	releases[4]()
+	if got := lb.algorithm.SelectUpstream(lb.upstreams); got.Name != "b" {
+		t.Errorf("selected %s, want the least-loaded upstream b", got.Name)
+	}
+
+	// An unhealthy upstream is never chosen, however idle
+	lb.upstreams[1].Healthy = false
+	if got := lb.algorithm.SelectUpstream(lb.upstreams); got.Name == "b" {
+		t.Error("selected the unhealthy upstream b")
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	for _, upstream := range lb.upstreams {
+		if upstream.ActiveConnections != 0 {
+			t.Errorf("%s has %d connections after release, want 0", upstream.Name, upstream.ActiveConnections)
+		}
+	}
+}
+
+func TestHealthCheckTransitions(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	lb := &LoadBalancer{
+		upstreams: []UpstreamProxy{{Name: "probe", Type: "http", Address: host, Port: port, Healthy: true}},
+		healthCheck: &HealthChecker{
+			timeout:            2 * time.Second,
+			path:               "/healthz",
+			healthyThreshold:   2,
+			unhealthyThreshold: 3,
+			checks:             make(map[string]HealthCheck),
+		},
+	}
+	upstream := &lb.upstreams[0]
+
+	steps := []struct {
+		status      int
+		wantHealthy bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusInternalServerError, true}, // one failure is not enough to flip
+		{http.StatusInternalServerError, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusOK, false}, // nor is one success
+		{http.StatusOK, true},
+		{http.StatusNoContent, true},
+		{http.StatusServiceUnavailable, true},
+	}
+
+	for i, step := range steps {
+		status.Store(int32(step.status))
+		lb.performHealthChecks()
+
+		check := lb.healthCheck.checks["probe"]
+		if upstream.Healthy != step.wantHealthy || check.Healthy != step.wantHealthy {
+			t.Fatalf("step %d (%d): healthy = %v, check = %v, want %v", i, step.status, upstream.Healthy, check.Healthy, step.wantHealthy)
+		}
+		if step.status >= 300 && !strings.Contains(check.LastError, strconv.Itoa(step.status)) {
+			t.Errorf("step %d: LastError = %q, want the probe status", i, check.LastError)
+		}
+		if step.status < 300 && (check.Latency <= 0 || upstream.Latency != check.Latency) {
+			t.Errorf("step %d: latency = %v / %v, want the measured probe latency", i, upstream.Latency, check.Latency)
+		}
+	}
+}
+
+func TestHealthCheckTCPDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	lb := &LoadBalancer{
+		upstreams: []UpstreamProxy{{Name: "tcp", Address: host, Port: port}},
+		healthCheck: &HealthChecker{
+			timeout:            time.Second,
+			healthyThreshold:   1,
+			unhealthyThreshold: 1,
+			checks:             make(map[string]HealthCheck),
+		},
+	}
+
+	lb.performHealthChecks()
+	if !lb.upstreams[0].Healthy {
+		t.Errorf("listening upstream unhealthy: %s", lb.healthCheck.checks["tcp"].LastError)
+	}
+
+	ln.Close()
+	lb.performHealthChecks()
+	if lb.upstreams[0].Healthy {
+		t.Error("closed upstream still healthy")
+	}
+}
+
+func TestLowestLatencyAlgorithm(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		upstreams []UpstreamProxy
+		want      []string // acceptable picks
+	}{
+		{
+			name: "fastest wins",
+			upstreams: []UpstreamProxy{
+				{Name: "slow", Latency: 120 * ms, Healthy: true},
+				{Name: "fast", Latency: 20 * ms, Healthy: true},
+				{Name: "medium", Latency: 60 * ms, Healthy: true},
+			},
+			want: []string{"fast"},
+		},
+		{
+			name: "unhealthy fastest skipped",
+			upstreams: []UpstreamProxy{
+				{Name: "slow", Latency: 120 * ms, Healthy: true},
+				{Name: "fast", Latency: 20 * ms, Healthy: false},
+				{Name: "medium", Latency: 60 * ms, Healthy: true},
+			},
+			want: []string{"medium"},
+		},
+		{
+			name: "near ties share the load",
+			upstreams: []UpstreamProxy{
+				{Name: "a", Latency: 20 * ms, Healthy: true},
+				{Name: "b", Latency: 22 * ms, Healthy: true},
+				{Name: "c", Latency: 90 * ms, Healthy: true},
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "unmeasured used only as a last resort",
+			upstreams: []UpstreamProxy{
+				{Name: "new", Healthy: true},
+				{Name: "measured", Latency: 200 * ms, Healthy: true},
+			},
+			want: []string{"measured"},
+		},
+		{
+			name: "nothing healthy",
+			upstreams: []UpstreamProxy{
+				{Name: "down", Latency: 10 * ms},
+			},
+		},
+	}
+
+	algorithm := &LowestLatencyAlgorithm{Tolerance: 5 * ms}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			for i := 0; i < 200; i++ {
+				upstream := algorithm.SelectUpstream(tt.upstreams)
+				if upstream == nil {
+					if len(tt.want) != 0 {
+						t.Fatal("SelectUpstream = nil")
+					}
+					continue
+				}
+				seen[upstream.Name] = true
+			}
+			for _, name := range tt.want {
+				if !seen[name] {
+					t.Errorf("%s never selected", name)
+				}
+				delete(seen, name)
+			}
+			for name := range seen {
+				t.Errorf("selected %s, want one of %v", name, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitLoadBalancerAlgorithms(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"round_robin", "round_robin"},
+		{"weighted", "weighted"},
+		{"least_connections", "least_connections"},
+		{"lowest_latency", "lowest_latency"},
+		{"unknown", "round_robin"},
+	}
+
+	for _, tt := range tests {
+		m := &AdvancedProxyManager{
+			config: &AdvancedProxyConfig{
+				EnableLoadBalancing:    true,
+				LoadBalancingAlgorithm: tt.config,
+				HealthCheckInterval:    time.Hour,
+			},
+			logger: log.New(io.Discard, "", 0),
+		}
+		m.initLoadBalancer()
+		if got := m.loadBalancer.algorithm.GetName(); got != tt.want {
+			t.Errorf("algorithm %q = %s, want %s", tt.config, got, tt.want)
+		}
+	}
+}
+
+// startConnectProxy runs an HTTP CONNECT proxy on a loopback port. When broken,
+// it accepts the tunnel but drops each connection once the request arrives.
+func startConnectProxy(t *testing.T, broken bool) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var tunnels atomic.Int32
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close()
+				reader := bufio.NewReader(client)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				tunnels.Add(1)
+				if broken {
+					io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+					reader.ReadByte()
+					return
+				}
+
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, reader)
+				io.Copy(client, target)
+			}()
+		}
+	}()
+	return ln.Addr().String(), &tunnels
+}
+
+func TestProcessHTTPRequestFailover(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+string(body))
+	}))
+	defer origin.Close()
+
+	// A port with nothing listening on it
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	// The manager logs through the standard logger's writer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	good, goodTunnels := startConnectProxy(t, false)
+	broken, _ := startConnectProxy(t, true)
+
+	tests := []struct {
+		name       string
+		first      string
+		method     string
+		body       string
+		retries    int
+		wantStatus int
+		wantBody   string
+	}{
+		{"connect failure fails over", deadAddr, "GET", "", 2, http.StatusOK, "GET "},
+		{"connect failure replays nothing", deadAddr, "POST", "payload", 1, http.StatusOK, "POST payload"},
+		{"sent idempotent request replayed", broken, "PUT", "payload", 1, http.StatusOK, "PUT payload"},
+		{"sent non-idempotent request not replayed", broken, "POST", "payload", 1, http.StatusBadGateway, ""},
+		{"retries disabled", deadAddr, "GET", "", 0, http.StatusBadGateway, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := func(name, addr string) UpstreamProxy {
+				host, portStr, _ := net.SplitHostPort(addr)
+				port, _ := strconv.Atoi(portStr)
+				return UpstreamProxy{Name: name, Type: "http", Address: host, Port: port, Weight: 1, Healthy: true}
+			}
+			m := newTestProxyManager(t, &AdvancedProxyConfig{
+				EnableLoadBalancing:    true,
+				LoadBalancingAlgorithm: "round_robin",
+				HealthCheckInterval:    time.Hour,
+				MaxUpstreamRetries:     tt.retries,
+				UpstreamProxies:        []UpstreamProxy{upstream("first", tt.first), upstream("second", good)},
+			})
+			defer m.Close()
+			before := goodTunnels.Load()
+
+			req := httptest.NewRequest(tt.method, origin.URL+"/resource", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			m.ProcessHTTPRequest(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if goodTunnels.Load() != before {
+					t.Error("request reached the second upstream")
+				}
+				return
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if m.loadBalancer.upstreams[0].Healthy {
+				t.Error("failed upstream still marked healthy")
+			}
+			if got := atomic.LoadInt64(&m.metrics.UpstreamFailovers); got != 1 {
+				t.Errorf("failovers = %d, want 1", got)
+			}
+		})
+	}
+}
+
+// ssTestStream is one direction of a Shadowsocks AEAD session, written
+// independently of ShadowsocksConn so the test checks the wire format
+type ssTestStream struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newSSTestStream(method, password string, salt []byte) (*ssTestStream, error) {
+	keyLen := map[string]int{"chacha20-ietf-poly1305": 32, "aes-256-gcm": 32, "aes-128-gcm": 16}[method]
+
+	// EVP_BytesToKey with MD5, then the HKDF-SHA1 session subkey
+	var key, prev []byte
+	for len(key) < keyLen {
+		sum := md5.Sum(append(prev, password...))
+		prev = sum[:]
+		key = append(key, prev...)
+	}
+	subkey := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, key[:keyLen], salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+
+	var aead cipher.AEAD
+	var err error
+	if method == "chacha20-ietf-poly1305" {
+		aead, err = chacha20poly1305.New(subkey)
+	} else {
+		var block cipher.Block
+		if block, err = aes.NewCipher(subkey); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ssTestStream{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (s *ssTestStream) next() []byte {
+	nonce := append([]byte(nil), s.nonce...)
+	for i := range s.nonce {
+		s.nonce[i]++
+		if s.nonce[i] != 0 {
+			break
+		}
+	}
+	return nonce
+}
+
+func (s *ssTestStream) readChunk(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2+s.aead.Overhead())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length, err := s.aead.Open(nil, s.next(), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, int(binary.BigEndian.Uint16(length))+s.aead.Overhead())
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return s.aead.Open(nil, s.next(), payload, nil)
+}
+
+func (s *ssTestStream) sealChunk(dst, payload []byte) []byte {
+	length := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+	dst = s.aead.Seal(dst, s.next(), length, nil)
+	return s.aead.Seal(dst, s.next(), payload, nil)
+}
+
+// startShadowsocksServer runs a minimal Shadowsocks AEAD server that relays
+// each connection to the address in its first chunk
+func startShadowsocksServer(t *testing.T, method, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	saltLen := map[string]int{"chacha20-ietf-poly1305": 32, "aes-256-gcm": 32, "aes-128-gcm": 16}[method]
+	serve := func(client net.Conn) {
+		defer client.Close()
+		salt := make([]byte, saltLen)
+		if _, err := io.ReadFull(client, salt); err != nil {
+			return
+		}
+		in, err := newSSTestStream(method, password, salt)
+		if err != nil {
+			return
+		}
+		first, err := in.readChunk(client)
+		if err != nil || len(first) < 1 {
+			return
+		}
+
+		var host string
+		var rest []byte
+		switch first[0] {
+		case 0x01:
+			host, rest = net.IP(first[1:5]).String(), first[5:]
+		case 0x03:
+			host, rest = string(first[2:2+first[1]]), first[2+first[1]:]
+		default:
+			return
+		}
+		port := binary.BigEndian.Uint16(rest)
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			return
+		}
+		defer target.Close()
+		target.Write(rest[2:])
+
+		go func() {
+			for {
+				chunk, err := in.readChunk(client)
+				if err != nil {
+					target.Close()
+					return
+				}
+				target.Write(chunk)
+			}
+		}()
+
+		outSalt := make([]byte, saltLen)
+		rand.Read(outSalt)
+		out, _ := newSSTestStream(method, password, outSalt)
+		client.Write(outSalt)
+		buf := make([]byte, 4096)
+		for {
+			n, err := target.Read(buf)
+			if n > 0 {
+				client.Write(out.sealChunk(nil, buf[:n]))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestShadowsocksUpstreamRoundTrip(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.URL.Path+" "+string(body))
+	}))
+	defer origin.Close()
+
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name           string
+		method         string
+		serverPassword string
+		body           string
+		wantStatus     int
+	}{
+		{"chacha20-ietf-poly1305", "chacha20-ietf-poly1305", "secret", "hello", http.StatusOK},
+		{"aes-256-gcm", "aes-256-gcm", "secret", "hello", http.StatusOK},
+		{"aes-128-gcm", "aes-128-gcm", "secret", "hello", http.StatusOK},
+		{"body larger than one chunk", "chacha20-ietf-poly1305", "secret", strings.Repeat("x", 40000), http.StatusOK},
+		{"wrong password", "chacha20-ietf-poly1305", "other", "hello", http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, portStr, _ := net.SplitHostPort(startShadowsocksServer(t, tt.method, tt.serverPassword))
+			port, _ := strconv.Atoi(portStr)
+			m := newTestProxyManager(t, &AdvancedProxyConfig{
+				EnableLoadBalancing: true,
+				HealthCheckInterval: time.Hour,
+				UpstreamProxies: []UpstreamProxy{
+					{Name: "ss", Type: "ss", Address: host, Port: port, Method: tt.method, Password: "secret", Healthy: true},
+				},
+			})
+			defer m.Close()
+
+			req := httptest.NewRequest("POST", origin.URL+"/echo", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			m.ProcessHTTPRequest(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != "/echo "+tt.body {
+				t.Errorf("body = %.40q, want the echoed request", rec.Body.String())
+			}
+		})
+	}
+}
+
+// fakeTunnel marks each connection it wraps by writing its prefix first
+type fakeTunnel struct {
+	prefix  string
+	wrapped atomic.Int32
+	err     error
+}
+
+func (f *fakeTunnel) Wrap(conn net.Conn) (net.Conn, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.wrapped.Add(1)
+	if _, err := io.WriteString(conn, f.prefix); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (f *fakeTunnel) Unwrap(conn net.Conn) (net.Conn, error) { return conn, nil }
+func (f *fakeTunnel) GetType() string                        { return "fake" }
+
+func TestRegisterTunnel(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	received := make(chan string, 1)
+	target := startFakeUpstream(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _ := io.ReadAtLeast(conn, buf, len("obfs:meek:"))
+		received <- string(buf[:n])
+	})
+
+	obfs := &fakeTunnel{prefix: "obfs:"}
+	meek := &fakeTunnel{prefix: "meek:"}
+	m := newTestProxyManager(t, &AdvancedProxyConfig{
+		EnableProtocolTunneling: true,
+		TunnelProtocols:         []string{"obfs", "meek"},
+		Tunnels:                 map[string]ProtocolTunnel{"obfs": obfs, "meek": meek},
+	})
+	defer m.Close()
+
+	conn, err := m.createTunneledConnection(target, nil)
+	if err != nil {
+		t.Fatalf("createTunneledConnection: %v", err)
+	}
+	defer conn.Close()
+	if got := <-received; got != "obfs:meek:" {
+		t.Errorf("target received %q, want the tunnels applied in order", got)
+	}
+	if obfs.wrapped.Load() != 1 || meek.wrapped.Load() != 1 {
+		t.Errorf("wrap calls = %d, %d, want 1 each", obfs.wrapped.Load(), meek.wrapped.Load())
+	}
+
+	m.RegisterTunnel("meek", &fakeTunnel{err: io.ErrUnexpectedEOF})
+	if _, err := m.createTunneledConnection(target, nil); err == nil || !strings.Contains(err.Error(), "failed to apply meek tunnel") {
+		t.Errorf("createTunneledConnection with failing tunnel = %v, want a meek error", err)
+	}
+}
+
+func TestUnknownTunnelProtocolRejected(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name    string
+		config  *AdvancedProxyConfig
+		wantErr string
+	}{
+		{"built-in tunnels", &AdvancedProxyConfig{EnableProtocolTunneling: true, TunnelProtocols: []string{"tls", "websocket"}}, ""},
+		{"unknown tunnel", &AdvancedProxyConfig{EnableProtocolTunneling: true, TunnelProtocols: []string{"tls", "obfs"}}, "unknown tunnel protocol: obfs"},
+		{"tunneling disabled", &AdvancedProxyConfig{TunnelProtocols: []string{"obfs"}}, ""},
+		{"pluggable tunnel", &AdvancedProxyConfig{
+			EnableProtocolTunneling: true,
+			TunnelProtocols:         []string{"obfs"},
+			Tunnels:                 map[string]ProtocolTunnel{"obfs": &fakeTunnel{}},
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewAdvancedProxyManager(tt.config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewAdvancedProxyManager: %v", err)
+				}
+				m.Close()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewAdvancedProxyManager error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegisterTunnelValidation(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	enabled := newTestProxyManager(t, &AdvancedProxyConfig{EnableProtocolTunneling: true})
+	defer enabled.Close()
+	disabled := newTestProxyManager(t, &AdvancedProxyConfig{})
+	defer disabled.Close()
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{"valid tunnel", enabled.RegisterTunnel("snowflake", &fakeTunnel{}), ""},
+		{"valid encapsulator", enabled.RegisterEncapsulator("dns2", &DNSEncapsulator{}), ""},
+		{"empty tunnel name", enabled.RegisterTunnel("", &fakeTunnel{}), "required"},
+		{"nil tunnel", enabled.RegisterTunnel("nil", nil), "required"},
+		{"nil encapsulator", enabled.RegisterEncapsulator("nil", nil), "required"},
+		{"tunneling disabled", disabled.RegisterTunnel("snowflake", &fakeTunnel{}), "not enabled"},
+		{"encapsulation disabled", disabled.RegisterEncapsulator("dns2", &DNSEncapsulator{}), "not enabled"},
+	}
+
+	for _, tt := range tests {
+		if tt.wantErr == "" && tt.err != nil {
+			t.Errorf("%s: %v", tt.name, tt.err)
+		}
+		if tt.wantErr != "" && (tt.err == nil || !strings.Contains(tt.err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, tt.err, tt.wantErr)
+		}
+	}
+}
+
+func TestConnectionPoolReuse(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name        string
+		closeConn   bool // origin asks for the connection to be closed
+		dropIdle    bool // origin drops idle connections between requests
+		wantCreated int64
+		wantReused  int64
+	}{
+		{"keep-alive origin", false, false, 1, 9},
+		{"connection close", true, false, 10, 0},
+		{"dead idle connections", false, true, 10, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.closeConn {
+					w.Header().Set("Connection", "close")
+				}
+				io.WriteString(w, "ok")
+			}))
+			defer origin.Close()
+
+			m := newTestProxyManager(t, &AdvancedProxyConfig{})
+			defer m.Close()
+
+			for i := 0; i < 10; i++ {
+				rec := httptest.NewRecorder()
+				m.ProcessHTTPRequest(rec, httptest.NewRequest("GET", origin.URL+"/", nil))
+				if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+					t.Fatalf("request %d: %d %q", i, rec.Code, rec.Body.String())
+				}
+				if tt.dropIdle {
+					origin.CloseClientConnections()
+				}
+			}
+
+			metrics := m.connectionPool.GetMetrics()["direct"]
+			if metrics.Created != tt.wantCreated || metrics.Reused != tt.wantReused {
+				t.Errorf("created = %d, reused = %d, want %d and %d", metrics.Created, metrics.Reused, tt.wantCreated, tt.wantReused)
+			}
+			if metrics.Active != 0 {
+				t.Errorf("active = %d after all requests finished, want 0", metrics.Active)
+			}
+			if idle := int64(len(m.connectionPool.idle[connectionPoolKey(origin.Listener.Addr().String(), nil)])); metrics.Created-metrics.Closed != idle {
+				t.Errorf("created %d - closed %d != %d idle connections", metrics.Created, metrics.Closed, idle)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const cooldown = time.Minute
+	start := time.Now()
+
+	// Each step is applied at the given offset from start; allow steps check the
+	// result of Allow, the others record an outcome
+	type step struct {
+		at        time.Duration
+		op        string // allow, success, failure
+		wantAllow bool
+		wantState string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens at threshold", []step{
+			{0, "failure", false, circuitClosed},
+			{0, "allow", true, circuitClosed},
+			{0, "failure", false, circuitClosed},
+			{0, "failure", false, circuitOpen},
+			{time.Second, "allow", false, circuitOpen},
+		}},
+		{"success resets the count", []step{
+			{0, "failure", false, circuitClosed},
+			{0, "failure", false, circuitClosed},
+			{0, "success", false, circuitClosed},
+			{0, "failure", false, circuitClosed},
+			{0, "allow", true, circuitClosed},
+		}},
+		{"half-opens after cooldown and recovers", []step{
+			{0, "failure", false, circuitClosed},
+			{0, "failure", false, circuitClosed},
+			{0, "failure", false, circuitOpen},
+			{cooldown, "allow", true, circuitHalfOpen},
+			{cooldown, "allow", false, circuitHalfOpen},
+			{cooldown, "success", false, circuitClosed},
+			{cooldown, "allow", true, circuitClosed},
+		}},
+		{"failed probe re-opens", []step{
+			{0, "failure", false, circuitClosed},
+			{0, "failure", false, circuitClosed},
+			{0, "failure", false, circuitOpen},
+			{cooldown, "allow", true, circuitHalfOpen},
+			{cooldown, "failure", false, circuitOpen},
+			{cooldown + time.Second, "allow", false, circuitOpen},
+			{2 * cooldown, "allow", true, circuitHalfOpen},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &CircuitBreaker{state: circuitClosed, threshold: 3, cooldown: cooldown}
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				switch s.op {
+				case "allow":
+					if got := b.Allow(now); got != s.wantAllow {
+						t.Fatalf("step %d: Allow = %v, want %v", i, got, s.wantAllow)
+					}
+				case "success":
+					b.RecordSuccess()
+				case "failure":
+					b.RecordFailure(now)
+				}
+				if got := b.State(); got != s.wantState {
+					t.Fatalf("step %d (%s): state = %s, want %s", i, s.op, got, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerSetDisabled(t *testing.T) {
+	for _, s := range []*CircuitBreakerSet{nil, NewCircuitBreakerSet(0, 0)} {
+		for i := 0; i < 10; i++ {
+			s.RecordFailure("upstream")
+		}
+		if !s.Allow("upstream") {
+			t.Errorf("disabled set %v rejected a request", s)
+		}
+	}
+}
+
+func TestLoadBalancerSkipsOpenBreaker(t *testing.T) {
+	m := newTestProxyManager(t, &AdvancedProxyConfig{
+		EnableLoadBalancing:     true,
+		LoadBalancingAlgorithm:  "round_robin",
+		HealthCheckInterval:     time.Hour,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCooldown:  time.Hour,
+		UpstreamProxies: []UpstreamProxy{
+			{Name: "first", Type: "http", Address: "127.0.0.1", Port: 1, Weight: 1, Healthy: true},
+			{Name: "second", Type: "http", Address: "127.0.0.1", Port: 2, Weight: 1, Healthy: true},
+		},
+	})
+	defer m.Close()
+	m.circuitBreakers.RecordFailure("first")
+
+	for i := 0; i < 10; i++ {
+		if upstream := m.loadBalancer.selectUpstream(nil); upstream == nil || upstream.Name != "second" {
+			t.Fatalf("selection %d = %v, want second", i, upstream)
+		}
+	}
+}
+
+func TestProcessHTTPRequestCircuitBreaker(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	// Reserve a port, then leave it closed so dials to it are refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	const cooldown = 100 * time.Millisecond
+	m := newTestProxyManager(t, &AdvancedProxyConfig{
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  cooldown,
+	})
+	defer m.Close()
+
+	get := func() int {
+		rec := httptest.NewRecorder()
+		m.ProcessHTTPRequest(rec, httptest.NewRequest("GET", "http://"+addr+"/", nil))
+		return rec.Code
+	}
+	key := circuitBreakerKey(addr, nil)
+
+	// Failures up to the threshold reach the destination, then requests fast-fail
+	for i, want := range []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusServiceUnavailable} {
+		if got := get(); got != want {
+			t.Fatalf("request %d: status = %d, want %d", i, got, want)
+		}
+	}
+	if got := m.circuitBreakers.States()[key]; got != circuitOpen {
+		t.Fatalf("state = %s, want %s", got, circuitOpen)
+	}
+	if got := atomic.LoadInt64(&m.metrics.CircuitBreakerRejections); got != 2 {
+		t.Errorf("rejections = %d, want 2", got)
+	}
+
+	// The destination comes back; after the cooldown the probe succeeds and closes
+	// the breaker
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	time.Sleep(cooldown)
+	for i := 0; i < 3; i++ {
+		if got := get(); got != http.StatusOK {
+			t.Fatalf("request %d after recovery: status = %d, want 200", i, got)
+		}
+	}
+	if got := m.circuitBreakers.States()[key]; got != circuitClosed {
+		t.Errorf("state = %s after recovery, want %s", got, circuitClosed)
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	router, errs := NewRouter([]RouteRule{
+		{Pattern: "*.cn", Upstream: "china"},
+		{Pattern: "/^(ads|track)\\./", Upstream: "blackhole"},
+		{Pattern: "Example.COM", Upstream: "direct"},
+		{Pattern: "*.example.com", Upstream: "corp"},
+		{Pattern: "*", Upstream: "default"},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("NewRouter: %v", errs)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.baidu.cn", "china"},
+		{"www.baidu.cn:443", "china"},
+		{"WWW.BAIDU.CN.", "china"},
+		{"ads.example.com", "blackhole"}, // earlier rules win
+		{"track.example.org", "blackhole"},
+		{"example.com", "direct"},
+		{"mail.example.com", "corp"},
+		{"deep.mail.example.com", "corp"}, // a glob star spans several labels
+		{"golang.org", "default"},
+	}
+
+	for _, tt := range tests {
+		got, ok := router.Match(tt.host)
+		if !ok || got != tt.want {
+			t.Errorf("Match(%q) = %q, %v, want %q", tt.host, got, ok, tt.want)
+		}
+	}
+}
+
+func TestRouterNoMatch(t *testing.T) {
+	router, _ := NewRouter([]RouteRule{{Pattern: "*.cn", Upstream: "china"}})
+	for _, r := range []*Router{nil, {}, router} {
+		if got, ok := r.Match("example.com"); ok {
+			t.Errorf("Match(example.com) = %q on %v, want no match", got, r)
+		}
+	}
+}
+
+func TestNewRouterInvalidPatterns(t *testing.T) {
+	router, errs := NewRouter([]RouteRule{
+		{Pattern: "[", Upstream: "broken-glob"},
+		{Pattern: "/(/", Upstream: "broken-regex"},
+		{Pattern: "*.cn", Upstream: "china"},
+	})
+	if len(errs) != 2 {
+		t.Errorf("got %d errors, want 2: %v", len(errs), errs)
+	}
+	if got, ok := router.Match("baidu.cn"); !ok || got != "china" {
+		t.Errorf("valid route after invalid ones: Match = %q, %v", got, ok)
+	}
+}
+
+// connectThrough opens a CONNECT tunnel to target through the proxy at proxyAddr and
+// fetches / from it, returning the response body
+func connectThrough(t *testing.T, proxyAddr, target string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("tunnelled response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestProcessHTTPRequestRouting(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin")
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	china, chinaTunnels := startConnectProxy(t, false)
+	fallback, fallbackTunnels := startConnectProxy(t, false)
+	upstream := func(name, addr string) UpstreamProxy {
+		host, portStr, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(portStr)
+		return UpstreamProxy{Name: name, Type: "http", Address: host, Port: port, Weight: 1, Healthy: true}
+	}
+
+	// localhost and 127.0.0.1 both reach the origin, so the host alone picks the route
+	tests := []struct {
+		name         string
+		host         string
+		routes       []RouteRule
+		loadBalance  bool
+		connect      bool
+		wantUpstream string // "" for a direct connection
+	}{
+		{"glob route", "localhost", []RouteRule{{Pattern: "local*", Upstream: "china"}}, true, false, "china"},
+		{"regex route", "127.0.0.1", []RouteRule{{Pattern: `/^127\./`, Upstream: "china"}}, true, false, "china"},
+		{"direct route", "localhost", []RouteRule{{Pattern: "localhost", Upstream: "direct"}}, true, false, ""},
+		{"no match falls back to load balancer", "127.0.0.1", []RouteRule{{Pattern: "localhost", Upstream: "china"}}, true, false, "fallback"},
+		{"no match without load balancer", "127.0.0.1", []RouteRule{{Pattern: "localhost", Upstream: "china"}}, false, false, ""},
+		{"CONNECT routed on host", "localhost", []RouteRule{{Pattern: "localhost", Upstream: "china"}}, true, true, "china"},
+		{"CONNECT falls back to load balancer", "127.0.0.1", []RouteRule{{Pattern: "localhost", Upstream: "china"}}, true, true, "fallback"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The load balancer only knows the fallback upstream; routes name the other
+			upstreams := []UpstreamProxy{upstream("fallback", fallback), upstream("china", china)}
+			m := newTestProxyManager(t, &AdvancedProxyConfig{
+				EnableLoadBalancing:    tt.loadBalance,
+				LoadBalancingAlgorithm: "round_robin",
+				HealthCheckInterval:    time.Hour,
+				UpstreamProxies:        upstreams,
+				Routes:                 tt.routes,
+			})
+			defer m.Close()
+			if tt.loadBalance {
+				m.loadBalancer.upstreams = upstreams[:1]
+			}
+			beforeChina, beforeFallback := chinaTunnels.Load(), fallbackTunnels.Load()
+
+			target := net.JoinHostPort(tt.host, port)
+			var body string
+			if tt.connect {
+				proxy := httptest.NewServer(http.HandlerFunc(m.ProcessHTTPRequest))
+				defer proxy.Close()
+				body = connectThrough(t, proxy.Listener.Addr().String(), target)
+			} else {
+				rec := httptest.NewRecorder()
+				m.ProcessHTTPRequest(rec, httptest.NewRequest("GET", "http://"+target+"/", nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d, want 200", rec.Code)
+				}
+				body = rec.Body.String()
+			}
+			if body != "origin" {
+				t.Errorf("body = %q, want origin", body)
+			}
+
+			used := map[string]int32{
+				"china":    chinaTunnels.Load() - beforeChina,
+				"fallback": fallbackTunnels.Load() - beforeFallback,
+			}
+			for name, n := range used {
+				if want := name == tt.wantUpstream; (n > 0) != want {
+					t.Errorf("upstream %s carried %d tunnels, want used = %v", name, n, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecoyTrafficCadence(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+
+	const interval = 50 * time.Millisecond
+	m := newTestProxyManager(t, &AdvancedProxyConfig{
+		EnableTopologyHiding: true,
+		RouteObfuscation:     true,
+		DecoyRoutes:          []DecoyRoute{{Target: listener.Addr().String(), Protocol: "tcp", Active: true}},
+		DecoyInterval:        interval,
+		DecoyJitter:          0.2,
+	})
+
+	time.Sleep(20 * interval)
+	m.Close()
+	// A decoy already in flight when Close was called may still land
+	time.Sleep(interval)
+	sent := accepted.Load()
+	if sent < 10 || sent > 30 {
+		t.Errorf("%d decoys in %v at one per %v, want about 20", sent, 20*interval, interval)
+	}
+	// Close may cancel a decoy after its connection reached the target
+	if n := atomic.LoadInt64(&m.metrics.DecoysSent); n != int64(sent) && n != int64(sent)-1 {
+		t.Errorf("DecoysSent = %d, target saw %d", n, sent)
+	}
+
+	time.Sleep(5 * interval)
+	if after := accepted.Load(); after != sent {
+		t.Errorf("%d more decoys after Close, want none", after-sent)
+	}
+}
+
+func TestDecoyTrafficDisabled(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name             string
+		routeObfuscation bool
+		active           bool
+	}{
+		{"route obfuscation off", false, true},
+		{"no active route", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted.Store(0)
+			m := newTestProxyManager(t, &AdvancedProxyConfig{
+				EnableTopologyHiding: true,
+				RouteObfuscation:     tt.routeObfuscation,
+				DecoyRoutes:          []DecoyRoute{{Target: listener.Addr().String(), Protocol: "tcp", Active: tt.active}},
+				DecoyInterval:        time.Millisecond,
+			})
+			defer m.Close()
+
+			time.Sleep(50 * time.Millisecond)
+			if n := accepted.Load(); n != 0 {
+				t.Errorf("%d decoys sent, want none", n)
+			}
+		})
+	}
+}
+
+func TestDecoyNextDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		jitter   float64
+	}{
+		{"half jitter", time.Second, 0.5},
+		{"small jitter", time.Second, 0.1},
+		{"full jitter", 10 * time.Millisecond, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RouteObfuscator{interval: tt.interval, jitter: tt.jitter}
+			low := time.Duration(float64(tt.interval) * (1 - tt.jitter))
+			if low < time.Millisecond {
+				low = time.Millisecond
+			}
+			high := time.Duration(float64(tt.interval) * (1 + tt.jitter))
+
+			distinct := make(map[time.Duration]bool)
+			for i := 0; i < 1000; i++ {
+				delay := r.nextDelay()
+				if delay < low || delay > high {
+					t.Fatalf("delay %v outside [%v, %v]", delay, low, high)
+				}
+				distinct[delay] = true
+			}
+			if len(distinct) < 100 {
+				t.Errorf("only %d distinct delays in 1000, want jitter", len(distinct))
+			}
+		})
+	}
+}
+
+func TestSendDecoy(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	tcpSeen := make(chan struct{}, 1)
+	go func() {
+		if conn, err := tcpListener.Accept(); err == nil {
+			conn.Close()
+			tcpSeen <- struct{}{}
+		}
+	}()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	udpSeen := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		if n, _, err := udpConn.ReadFrom(buf); err == nil {
+			udpSeen <- n
+		}
+	}()
+
+	httpSeen := make(chan string, 1)
+	httpTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpSeen <- r.URL.Path
+	}))
+	defer httpTarget.Close()
+
+	tests := []struct {
+		name    string
+		route   DecoyRoute
+		check   func(t *testing.T)
+		wantErr bool
+	}{
+		{"tcp connect", DecoyRoute{Target: tcpListener.Addr().String(), Protocol: "tcp"}, func(t *testing.T) { <-tcpSeen }, false},
+		{"udp datagram", DecoyRoute{Target: udpConn.LocalAddr().String(), Protocol: "udp"}, func(t *testing.T) {
+			if n := <-udpSeen; n < 32 || n > 128 {
+				t.Errorf("decoy datagram is %d bytes, want 32-127", n)
+			}
+		}, false},
+		{"http request", DecoyRoute{Target: httpTarget.URL, Protocol: "http"}, func(t *testing.T) {
+			if path := <-httpSeen; len(path) != 9 {
+				t.Errorf("decoy path %q, want a random 8 character path", path)
+			}
+		}, false},
+		{"refused", DecoyRoute{Target: closedTCPAddr(t), Protocol: "tcp"}, nil, true},
+		{"unknown protocol", DecoyRoute{Target: "127.0.0.1", Protocol: "sctp"}, nil, true},
+	}
+
+	r := &RouteObfuscator{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := r.sendDecoy(ctx, tt.route)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendDecoy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t)
+			}
+		})
+	}
+}
+
+// closedTCPAddr returns a loopback address nothing listens on
+func closedTCPAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestICMPEchoRequestChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"even length", []byte("abcdefgh")},
+		{"odd length", []byte("abcdefg")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := icmpEchoRequest(0x1234, 7, tt.payload)
+			if msg[0] != 8 || msg[1] != 0 {
+				t.Errorf("type/code = %d/%d, want 8/0", msg[0], msg[1])
+			}
+			if id, seq := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[6:]); id != 0x1234 || seq != 7 {
+				t.Errorf("id/seq = %#x/%d, want 0x1234/7", id, seq)
+			}
+			if !bytes.Equal(msg[8:], tt.payload) {
+				t.Errorf("payload = %q, want %q", msg[8:], tt.payload)
+			}
+
+			// Summing a message including its checksum gives all ones
+			var sum uint32
+			for i := 0; i+1 < len(msg); i += 2 {
+				sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+			}
+			if len(msg)%2 == 1 {
+				sum += uint32(msg[len(msg)-1]) << 8
+			}
+			for sum > 0xffff {
+				sum = (sum >> 16) + (sum & 0xffff)
+			}
+			if sum != 0xffff {
+				t.Errorf("checksum does not verify: sum %#x", sum)
+			}
+		})
+	}
+}
+
+func TestNextTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      int
+		variance  int
+		low, high int
+	}{
+		{"no variance", 64, 0, 64, 64},
+		{"within range", 64, 16, 48, 80},
+		{"clamped low", 3, 10, 1, 13},
+		{"clamped high", 250, 20, 230, 255},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manipulator := &TTLManipulator{baseTTL: tt.base, variance: tt.variance}
+			seen := make(map[int]bool)
+			for i := 0; i < 2000; i++ {
+				ttl := manipulator.nextTTL()
+				if ttl < tt.low || ttl > tt.high {
+					t.Fatalf("TTL %d outside [%d, %d]", ttl, tt.low, tt.high)
+				}
+				seen[ttl] = true
+			}
+			if !seen[tt.low] || !seen[tt.high] {
+				t.Errorf("range [%d, %d] not covered: %v", tt.low, tt.high, seen)
+			}
+		})
+	}
+}
+
+func TestTTLManipulationUnsupported(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	m := newTestProxyManager(t, &AdvancedProxyConfig{EnableTopologyHiding: true, TTLManipulation: true})
+	defer m.Close()
+	m.logger = log.New(&logs, "", 0)
+
+	// A pipe has no IP socket to set the TTL on
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := m.topologyHider.ttlManipulator.Apply(client); err == nil {
+		t.Fatal("Apply on a pipe succeeded")
+	}
+
+	m.applyTopologyHiding(client)
+	m.applyTopologyHiding(client)
+	if n := strings.Count(logs.String(), "TTL manipulation unavailable"); n != 1 {
+		t.Errorf("warned %d times, want once:\n%s", n, logs.String())
+	}
+}
+
+func TestMetricsConcurrentRequests(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	const body = "hello"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+
+	upstreamAddr, tunnels := startConnectProxy(t, false)
+	host, portStr, _ := net.SplitHostPort(upstreamAddr)
+	port, _ := strconv.Atoi(portStr)
+	m := newTestProxyManager(t, &AdvancedProxyConfig{
+		EnableDPIEvasion:       true,
+		EnableLoadBalancing:    true,
+		LoadBalancingAlgorithm: "round_robin",
+		HealthCheckInterval:    time.Hour,
+		UpstreamProxies:        []UpstreamProxy{{Name: "up", Type: "http", Address: host, Port: port, Weight: 1, Healthy: true}},
+	})
+	defer m.Close()
+
+	const workers, perWorker = 16, 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				rec := httptest.NewRecorder()
+				m.ProcessHTTPRequest(rec, httptest.NewRequest("GET", origin.URL+"/", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("status = %d, want 200", rec.Code)
+				}
+
+				// Reading the metrics while requests run must not race
+				m.GetMetrics()
+				m.HandleMetrics(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+			}
+		}()
+	}
+	wg.Wait()
+
+	const total = workers * perWorker
+	metrics := m.GetMetrics()
+	tests := []struct {
+		name string
+		got  int64
+		want int64
+	}{
+		{"RequestsProcessed", metrics.RequestsProcessed, total},
+		{"DPIEvasionsApplied", metrics.DPIEvasionsApplied, total},
+		{"LoadBalancerHits", metrics.LoadBalancerHits, total},
+		{"BytesTransferred", metrics.BytesTransferred, total * int64(len(body))},
+		{"UpstreamFailovers", metrics.UpstreamFailovers, 0},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+	if metrics.AvgLatency <= 0 {
+		t.Errorf("AvgLatency = %v, want it measured", metrics.AvgLatency)
+	}
+	if tunnels.Load() == 0 {
+		t.Error("no request went through the upstream")
+	}
+
+	rec := httptest.NewRecorder()
+	m.HandleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var report struct {
+		Proxy ProxyMetrics `json:"proxy"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decode /metrics: %v", err)
+	}
+	if report.Proxy != metrics {
+		t.Errorf("/metrics = %+v, want %+v", report.Proxy, metrics)
+	}
+}
+
+func TestHandleMetricsRequests(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin metrics")
+	}))
+	defer origin.Close()
+
+	m := newTestProxyManager(t, &AdvancedProxyConfig{})
+	defer m.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		wantStatus  int
+		wantProxied bool
+	}{
+		{"local metrics", "GET", "/metrics", http.StatusOK, false},
+		{"wrong method", "POST", "/metrics", http.StatusMethodNotAllowed, false},
+		{"proxied metrics path", "GET", origin.URL + "/metrics", http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			m.HandleMetrics(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if proxied := rec.Body.String() == "origin metrics"; proxied != tt.wantProxied {
+				t.Errorf("body = %q, proxied %v, want %v", rec.Body.String(), proxied, tt.wantProxied)
+			}
+		})
+	}
+}
+
+// rawClientHello is the part of a captured ClientHello that identifies its stack
+type rawClientHello struct {
+	cipherSuites []uint16
+	extensions   []uint16
+	alpn         []string
+}
+
+// isGREASE reports whether v is a reserved GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// captureRawClientHello accepts one connection, runs handshake against it and
+// parses the first TLS record it sends. The handshake itself is expected to fail.
+func captureRawClientHello(t *testing.T, handshake func(conn net.Conn) error) rawClientHello {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	records := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			records <- nil
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			records <- nil
+			return
+		}
+		record := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+		if _, err := io.ReadFull(conn, record); err != nil {
+			records <- nil
+			return
+		}
+		records <- record
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go handshake(conn)
+
+	record := <-records
+	if len(record) < 4 || record[0] != 1 {
+		t.Fatalf("first record is not a ClientHello: %x", record)
+	}
+	return parseRawClientHello(t, record[4:])
+}
+
+func parseRawClientHello(t *testing.T, body []byte) rawClientHello {
+	t.Helper()
+	var hello rawClientHello
+	pos := 2 + 32 // version, random
+	take := func(n int) []byte {
+		if pos+n > len(body) {
+			t.Fatalf("ClientHello truncated at %d", pos)
+		}
+		b := body[pos : pos+n]
+		pos += n
+		return b
+	}
+
+	take(int(take(1)[0])) // session ID
+	suites := take(int(binary.BigEndian.Uint16(take(2))))
+	for i := 0; i+1 < len(suites); i += 2 {
+		hello.cipherSuites = append(hello.cipherSuites, binary.BigEndian.Uint16(suites[i:]))
+	}
+	take(int(take(1)[0])) // compression methods
+
+	extensions := take(int(binary.BigEndian.Uint16(take(2))))
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		data := extensions[4 : 4+int(binary.BigEndian.Uint16(extensions[2:]))]
+		extensions = extensions[4+len(data):]
+		hello.extensions = append(hello.extensions, extType)
+
+		if extType == 16 { // application_layer_protocol_negotiation
+			for list := data[2:]; len(list) > 0; list = list[1+int(list[0]):] {
+				hello.alpn = append(hello.alpn, string(list[1:1+int(list[0])]))
+			}
+		}
+	}
+	return hello
+}
+
+// profileHello lists the cipher suites and extensions of a uTLS profile, leaving
+// out GREASE and padding, whose values and presence vary between handshakes
+func profileHello(t *testing.T, id utls.ClientHelloID) rawClientHello {
+	t.Helper()
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hello rawClientHello
+	for _, suite := range spec.CipherSuites {
+		if !isGREASE(suite) {
+			hello.cipherSuites = append(hello.cipherSuites, suite)
+		}
+	}
+	for _, extension := range spec.Extensions {
+		switch extension.(type) {
+		case *utls.UtlsGREASEExtension, *utls.UtlsPaddingExtension:
+			continue
+		case *utls.SNIExtension:
+			// Empty until the server name is filled in, so it cannot be read
+			hello.extensions = append(hello.extensions, 0)
+			continue
+		}
+		buf := make([]byte, extension.Len())
+		if _, err := extension.Read(buf); err != nil && err != io.EOF {
+			t.Fatalf("%T: %v", extension, err)
+		}
+		hello.extensions = append(hello.extensions, binary.BigEndian.Uint16(buf))
+	}
+	return hello
+}
+
+// withoutVariable drops GREASE values and the padding extension
+func withoutVariable(values []uint16) []uint16 {
+	var kept []uint16
+	for _, v := range values {
+		if !isGREASE(v) && v != 21 {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func sortedCopy(values []uint16) []uint16 {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func TestTLSHandshakeFingerprint(t *testing.T) {
+	tests := []struct {
+		fingerprint string
+		shuffled    bool // the profile randomizes its extension order
+	}{
+		{"chrome", true},
+		{"firefox", false},
+		{"safari", false},
+		{"edge", false},
+		{"ios", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fingerprint, func(t *testing.T) {
+			got := captureRawClientHello(t, func(conn net.Conn) error {
+				_, err := tlsHandshake(conn, &tls.Config{ServerName: "example.com"}, tt.fingerprint)
+				return err
+			})
+			want := profileHello(t, utlsProfiles[tt.fingerprint])
+
+			if !reflect.DeepEqual(withoutVariable(got.cipherSuites), want.cipherSuites) {
+				t.Errorf("cipher suites = %x, want %x", withoutVariable(got.cipherSuites), want.cipherSuites)
+			}
+			gotExtensions, wantExtensions := withoutVariable(got.extensions), withoutVariable(want.extensions)
+			if tt.shuffled {
+				gotExtensions, wantExtensions = sortedCopy(gotExtensions), sortedCopy(wantExtensions)
+			}
+			if !reflect.DeepEqual(gotExtensions, wantExtensions) {
+				t.Errorf("extensions = %v, want %v", gotExtensions, wantExtensions)
+			}
+			// The tunnelled stream is HTTP/1.1, whatever the browser would offer
+			if strings.Join(got.alpn, ",") != "http/1.1" {
+				t.Errorf("ALPN = %v, want [http/1.1]", got.alpn)
+			}
+		})
+	}
+
+	t.Run("go", func(t *testing.T) {
+		got := captureRawClientHello(t, func(conn net.Conn) error {
+			_, err := tlsHandshake(conn, &tls.Config{ServerName: "example.com"}, "")
+			return err
+		})
+		for _, v := range append(got.cipherSuites, got.extensions...) {
+			if isGREASE(v) {
+				t.Errorf("Go ClientHello carries GREASE value %#x", v)
+			}
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		if _, err := tlsHandshake(client, &tls.Config{}, "netscape"); err == nil || !strings.Contains(err.Error(), "unknown TLS fingerprint") {
+			t.Errorf("tlsHandshake = %v, want an unknown fingerprint error", err)
+		}
+	})
+}
+
+func TestTLSTunnelVerification(t *testing.T) {
+	srv, _ := startTLSUpstream(t)
+
+	tests := []struct {
+		name    string
+		tunnel  TLSTunnel
+		wantErr bool
+	}{
+		{"untrusted by default", TLSTunnel{ServerName: "example.com"}, true},
+		{"untrusted with a fingerprint", TLSTunnel{ServerName: "example.com", Fingerprint: "firefox"}, true},
+		{"insecure", TLSTunnel{ServerName: "example.com", Insecure: true}, false},
+		{"insecure with a fingerprint", TLSTunnel{ServerName: "example.com", Insecure: true, Fingerprint: "chrome"}, false},
+		{"no server name", TLSTunnel{Insecure: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			tunnel := tt.tunnel
+			wrapped, err := tunnel.Wrap(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Wrap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				wrapped.Close()
+			}
+		})
+	}
+}
+
+func TestTLSTunnelServerName(t *testing.T) {
+	srv, hellos := startTLSUpstream(t)
+
+	tests := []struct {
+		name   string
+		tunnel TLSTunnel
+		target string
+		want   string
+	}{
+		{"target host", TLSTunnel{Insecure: true}, "target.example:443", "target.example"},
+		{"configured name wins", TLSTunnel{ServerName: "front.example", Insecure: true}, "target.example:443", "front.example"},
+		{"configured name without a target", TLSTunnel{ServerName: "front.example", Insecure: true}, "", "front.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			tunnel := tt.tunnel
+			wrapped, err := tunnel.WrapTarget(conn, tt.target)
+			if err != nil {
+				t.Fatalf("WrapTarget: %v", err)
+			}
+			wrapped.Close()
+			if hello := <-hellos; hello.ServerName != tt.want {
+				t.Errorf("SNI = %q, want %q", hello.ServerName, tt.want)
+			}
+		})
+	}
+
+	// Without a name the tunnel must not fall back to the peer's address
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := (&TLSTunnel{}).Wrap(client); err == nil || !strings.Contains(err.Error(), "no server name") {
+		t.Errorf("Wrap without a server name = %v, want a no server name error", err)
+	}
+}
+
+// ksStatistic is the Kolmogorov-Smirnov distance between samples and cdf
+func ksStatistic(samples []float64, cdf func(float64) float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	n := float64(len(sorted))
+	var d float64
+	for i, x := range sorted {
+		f := cdf(x)
+		d = math.Max(d, math.Max(f-float64(i)/n, float64(i+1)/n-f))
+	}
+	return d
+}
+
+func TestDummyIntervalDistribution(t *testing.T) {
+	const samples = 20000
+	// Critical KS distance at the 0.1% significance level
+	critical := 1.95 / math.Sqrt(samples)
+	mean := time.Second
+
+	tests := []struct {
+		model string
+		cdf   func(x float64) float64 // x in units of the mean interval
+	}{
+		{"poisson", func(x float64) float64 { return 1 - math.Exp(-x) }},
+		{"uniform", func(x float64) float64 { return math.Min(x/2, 1) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			model := newDummyTrafficModel(&AdvancedProxyConfig{DummyTrafficInterval: mean, DummyIntervalModel: tt.model})
+			values := make([]float64, samples)
+			var sum float64
+			for i := range values {
+				values[i] = float64(model.NextInterval()) / float64(mean)
+				sum += values[i]
+			}
+
+			if got := sum / samples; math.Abs(got-1) > 0.05 {
+				t.Errorf("mean interval = %.3fs, want about 1s", got)
+			}
+			if d := ksStatistic(values, tt.cdf); d > critical {
+				t.Errorf("KS distance %.4f exceeds %.4f: intervals do not follow the %s model", d, critical, tt.model)
+			}
+		})
+	}
+
+	t.Run("fixed", func(t *testing.T) {
+		model := newDummyTrafficModel(&AdvancedProxyConfig{DummyTrafficInterval: mean, DummyIntervalModel: "fixed"})
+		for i := 0; i < 100; i++ {
+			if got := model.NextInterval(); got != mean {
+				t.Fatalf("interval = %v, want %v", got, mean)
+			}
+		}
+	})
+}
+
+func TestDummySizeDistribution(t *testing.T) {
+	const samples = 20000
+	critical := 1.95 / math.Sqrt(samples)
+
+	t.Run("lognormal", func(t *testing.T) {
+		const median, sigma = 300, 0.8
+		model := newDummyTrafficModel(&AdvancedProxyConfig{DummySizeMedian: median, DummySizeSigma: sigma, DummySizeMax: 1 << 15})
+		logs := make([]float64, samples)
+		for i := range logs {
+			size := model.NextSize()
+			if size < 1 || size > 1<<15 {
+				t.Fatalf("size %d outside [1, %d]", size, 1<<15)
+			}
+			logs[i] = math.Log(float64(size))
+		}
+
+		// Sizes are truncated to whole bytes, which shifts the log slightly down
+		normal := func(x float64) float64 { return 0.5 * math.Erfc(-(x-math.Log(median))/(sigma*math.Sqrt2)) }
+		if d := ksStatistic(logs, normal); d > critical+0.01 {
+			t.Errorf("KS distance %.4f exceeds %.4f: sizes are not log-normal", d, critical+0.01)
+		}
+	})
+
+	t.Run("uniform", func(t *testing.T) {
+		const median = 200
+		model := newDummyTrafficModel(&AdvancedProxyConfig{DummySizeModel: "uniform", DummySizeMedian: median})
+		seen := make(map[int]bool)
+		for i := 0; i < samples; i++ {
+			size := model.NextSize()
+			if size < 1 || size > 2*median {
+				t.Fatalf("size %d outside [1, %d]", size, 2*median)
+			}
+			seen[size] = true
+		}
+		if len(seen) < 2*median*9/10 {
+			t.Errorf("only %d distinct sizes of %d", len(seen), 2*median)
+		}
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		model := newDummyTrafficModel(&AdvancedProxyConfig{DummySizeMedian: 1000, DummySizeSigma: 3, DummySizeMax: 1200})
+		for i := 0; i < samples; i++ {
+			if size := model.NextSize(); size > 1200 {
+				t.Fatalf("size %d above the 1200 byte cap", size)
+			}
+		}
+	})
+}
+
+func TestNewDummyTrafficModelDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AdvancedProxyConfig
+		want   DummyTrafficModel
+	}{
+		{"defaults", AdvancedProxyConfig{}, DummyTrafficModel{Interval: 5 * time.Second, IntervalModel: "poisson", SizeModel: "lognormal", SizeMedian: 300, SizeSigma: 1, SizeMax: 16384}},
+		{"configured", AdvancedProxyConfig{DummyTrafficInterval: time.Second, DummyIntervalModel: "uniform", DummySizeModel: "uniform", DummySizeMedian: 100, DummySizeSigma: 0.5, DummySizeMax: 1000},
+			DummyTrafficModel{Interval: time.Second, IntervalModel: "uniform", SizeModel: "uniform", SizeMedian: 100, SizeSigma: 0.5, SizeMax: 1000}},
+		{"median above max", AdvancedProxyConfig{DummySizeMedian: 5000, DummySizeMax: 1000}, DummyTrafficModel{Interval: 5 * time.Second, IntervalModel: "poisson", SizeModel: "lognormal", SizeMedian: 1000, SizeSigma: 1, SizeMax: 1000}},
+		{"max above frame limit", AdvancedProxyConfig{DummySizeMax: obfuscationMaxFrameData + 1}, DummyTrafficModel{Interval: 5 * time.Second, IntervalModel: "poisson", SizeModel: "lognormal", SizeMedian: 300, SizeSigma: 1, SizeMax: 16384}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newDummyTrafficModel(&tt.config); *got != tt.want {
+				t.Errorf("model = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterleaveDummyTraffic(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	m := newTestProxyManager(t, &AdvancedProxyConfig{
+		EnableTrafficObfuscation: true,
+		EnableDummyTraffic:       true,
+		DummyTrafficInterleave:   true,
+		DummyTrafficInterval:     time.Millisecond,
+		DummyIntervalModel:       "fixed",
+		DummySizeMedian:          64,
+	})
+	defer m.Close()
+
+	a, b := net.Pipe()
+	sender := m.obfuscateConnection(a)
+	wire := &countingConn{Conn: b}
+	receiver := &ObfuscatedConnection{Conn: wire, key: m.trafficObfuscator.obfuscationKey, closed: make(chan struct{})}
+	defer receiver.Close()
+
+	payload := []byte("real traffic")
+	go func() {
+		for i := 0; i < 20; i++ {
+			sender.Write(payload)
+			time.Sleep(2 * time.Millisecond)
+		}
+		sender.Close()
+	}()
+
+	received, err := io.ReadAll(receiver)
+	if err != nil && err != io.ErrClosedPipe {
+		t.Fatalf("read: %v", err)
+	}
+	if want := bytes.Repeat(payload, 20); !bytes.Equal(received, want) {
+		t.Fatalf("received %q, want the payload 20 times without dummy bytes", received)
+	}
+	// Everything beyond the nonce and the real frames was dummy traffic
+	realBytes := int64(aes.BlockSize + 20*(obfuscationFrameHeader+len(payload)))
+	if n := wire.read.Load(); n <= realBytes {
+		t.Errorf("%d bytes on the wire, want dummy frames beyond the %d of real traffic", n, realBytes)
+	}
+}
+
+// countingConn counts the bytes read through it
+type countingConn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
@@ -17,21 +17,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
+	
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
 )
 
 // Cross-Platform Testing Framework
@@ -46,6 +56,20 @@ type CrossPlatformTestFramework struct {
 	logger           *log.Logger
 	testResults      map[string]*TestResult
 	mutex            sync.RWMutex
+	workerSlots      chan struct{} // bounds concurrently running test cases to MaxConcurrentTests
+	runStartTime     time.Time
+	summary          *TestSummary
+	serialLock       sync.RWMutex  // held exclusively by serial test cases, shared by the rest
+}
+
+// A single test case dispatched to the worker pool. Serial cases never
+// overlap with any other case, e.g. because they reconfigure the system proxy.
+type testCase struct {
+	name    string
+	enabled bool
+	serial  bool
+	run     func(ctx context.Context) error // ctx ends when the case times out
+	metrics *TestMetrics // filled in by run, attached to the result when it completes
 }
 
 // Test Framework Configuration
@@ -73,20 +97,22 @@ type TestFrameworkConfig struct {
 	TestCPUUsage           bool     `json:"testCPUUsage"`
 	TestNetworkThroughput  bool     `json:"testNetworkThroughput"`
 	TestLatency            bool     `json:"testLatency"`
+	TestLoad               bool     `json:"testLoad"`
 	
 	// Configuration
 	TestTimeout            time.Duration `json:"testTimeout"`
 	MaxConcurrentTests     int          `json:"maxConcurrentTests"`
 	ReportFormat           string       `json:"reportFormat"`
 	OutputDirectory        string       `json:"outputDirectory"`
+	NativeHostPath         string       `json:"nativeHostPath"` // defaults to native_host next to the framework binary
 }
 
 // Platform Tester Interface
 type PlatformTester interface {
-	TestNativeMessaging() *TestResult
-	TestSystemServices() *TestResult
-	TestPermissions() *TestResult
-	TestSystemIntegration() *TestResult
+	TestNativeMessaging(ctx context.Context) *TestResult
+	TestSystemServices(ctx context.Context) *TestResult
+	TestPermissions(ctx context.Context) *TestResult
+	TestSystemIntegration(ctx context.Context) *TestResult
 	GetPlatformName() string
 }
 
@@ -94,7 +120,9 @@ type PlatformTester interface {
 type TestResult struct {
 	TestName      string                 `json:"testName"`
 	Platform      string                 `json:"platform"`
-	Status        string                 `json:"status"` // pass, fail, skip, error
+	Suite         string                 `json:"suite,omitempty"` // set on individual test cases, empty for suite results
+	Status        string                 `json:"status"` // pass, fail, skip, error, timeout
+	TimedOut      bool                   `json:"timedOut,omitempty"`
 	Duration      time.Duration          `json:"duration"`
 	StartTime     time.Time              `json:"startTime"`
 	EndTime       time.Time              `json:"endTime"`
@@ -106,13 +134,36 @@ type TestResult struct {
 	Logs          []string               `json:"logs"`
 }
 
+// Aggregate of the individual test cases in a run. Timed out tests count
+// as errored as well as in TimedOut.
+type TestSummary struct {
+	Total    int           `json:"total"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Errored  int           `json:"errored"`
+	TimedOut int           `json:"timedOut"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exitCode"` // non-zero when any test failed or errored
+}
+
+func (s *TestSummary) String() string {
+	return fmt.Sprintf("%d tests: %d passed, %d failed, %d skipped, %d errored (%d timed out) in %v",
+		s.Total, s.Passed, s.Failed, s.Skipped, s.Errored, s.TimedOut, s.Duration)
+}
+
 type TestMetrics struct {
-	MemoryUsage    int64         `json:"memoryUsage"`
-	CPUUsage       float64       `json:"cpuUsage"`
-	NetworkLatency time.Duration `json:"networkLatency"`
-	Throughput     int64         `json:"throughput"`
-	ErrorRate      float64       `json:"errorRate"`
-	ResponseTime   time.Duration `json:"responseTime"`
+	MemoryUsage     int64         `json:"memoryUsage"`
+	PeakMemory      int64         `json:"peakMemory"`
+	CPUUsage        float64       `json:"cpuUsage"`
+	NetworkLatency  time.Duration `json:"networkLatency"`
+	Throughput      int64         `json:"throughput"`
+	ErrorRate       float64       `json:"errorRate"`
+	ResponseTime    time.Duration `json:"responseTime"` // mean
+	ResponseTimeP50 time.Duration `json:"responseTimeP50,omitempty"`
+	ResponseTimeP95 time.Duration `json:"responseTimeP95,omitempty"`
+	ResponseTimeP99 time.Duration `json:"responseTimeP99,omitempty"`
+	RequestsSent    int64         `json:"requestsSent,omitempty"`
 }
 
 // Native Integration Tester
@@ -126,9 +177,11 @@ type NativeIntegrationTester struct {
 
 type NativeMessagingTest struct {
 	hostManifest   string
+	hostPath       string
 	extensionId    string
 	testMessages   []TestMessage
 	testPort       string
+	timeout        time.Duration // bounds the whole host session
 }
 
 type TestMessage struct {
@@ -272,6 +325,7 @@ type TestEndpoint struct {
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 	Protocol string `json:"protocol"`
+	Path     string `json:"path,omitempty"` // HTTP resource; "{size}" is replaced with the transfer size
 	Timeout  time.Duration `json:"timeout"`
 }
 
@@ -367,12 +421,15 @@ type ResourceUsageTest struct {
 	maxMemoryMB    int64
 	maxCPUPercent  float64
 	monitorDuration time.Duration
+	samples        int          // heap samples taken across monitorDuration
+	workload       func() error // one round of representative work between samples
 }
 
 type LoadTest struct {
-	concurrentUsers int
+	concurrentUsers int // caps the workers of any one scenario
 	testDuration    time.Duration
 	rampUpTime      time.Duration
+	maxErrorRate    float64
 	testScenarios   []LoadScenario
 }
 
@@ -409,17 +466,11 @@ func NewCrossPlatformTestFramework(config *TestFrameworkConfig) *CrossPlatformTe
 		logger:      log.New(os.Stdout, "[TestFramework] ", log.LstdFlags|log.Lshortfile),
 	}
 	
-	// Initialize platform-specific tester
-	switch runtime.GOOS {
-	case "windows":
-		framework.platformTester = &WindowsPlatformTester{config: config}
-	case "darwin":
-		framework.platformTester = &MacOSPlatformTester{config: config}
-	case "linux":
-		framework.platformTester = &LinuxPlatformTester{config: config}
-	default:
-		framework.logger.Printf("Unsupported platform: %s", runtime.GOOS)
+	workers := config.MaxConcurrentTests
+	if workers < 1 {
+		workers = 1
 	}
+	framework.workerSlots = make(chan struct{}, workers)
 	
 	// Initialize test components
 	framework.initNativeIntegrationTester()
@@ -428,6 +479,19 @@ func NewCrossPlatformTestFramework(config *TestFrameworkConfig) *CrossPlatformTe
 	framework.initSecurityTester()
 	framework.initPerformanceTester()
 	
+	// Initialize platform-specific tester
+	messagingTest := framework.nativeIntegration.messagingTest
+	switch runtime.GOOS {
+	case "windows":
+		framework.platformTester = &WindowsPlatformTester{config: config, messagingTest: messagingTest}
+	case "darwin":
+		framework.platformTester = &MacOSPlatformTester{config: config, messagingTest: messagingTest}
+	case "linux":
+		framework.platformTester = &LinuxPlatformTester{config: config, messagingTest: messagingTest}
+	default:
+		framework.logger.Printf("Unsupported platform: %s", runtime.GOOS)
+	}
+	
 	return framework
 }
 
@@ -437,7 +501,9 @@ func (f *CrossPlatformTestFramework) initNativeIntegrationTester() {
 		config: f.config,
 		logger: f.logger,
 		messagingTest: &NativeMessagingTest{
+			hostPath:    f.nativeHostPath(),
 			extensionId: "oblivionfilter-extension",
+			timeout:     10 * time.Second,
 			testMessages: []TestMessage{
 				{
 					ID:   "test-ping",
@@ -482,6 +548,25 @@ func (f *CrossPlatformTestFramework) initNativeIntegrationTester() {
 	}
 }
 
+// Resolve the native host binary under test
+func (f *CrossPlatformTestFramework) nativeHostPath() string {
+	if f.config.NativeHostPath != "" {
+		return f.config.NativeHostPath
+	}
+	
+	name := "native_host"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	
+	executable, err := os.Executable()
+	if err != nil {
+		f.logger.Printf("Failed to locate the framework binary, looking for %s in the working directory: %v", name, err)
+		return name
+	}
+	return filepath.Join(filepath.Dir(executable), name)
+}
+
 // Initialize system tester
 func (f *CrossPlatformTestFramework) initSystemTester() {
 	f.systemTester = &SystemTester{
@@ -599,7 +684,7 @@ func (f *CrossPlatformTestFramework) initNetworkTester() {
 			testSizes:    []int64{1024, 10240, 102400, 1048576}, // 1KB, 10KB, 100KB, 1MB
 			testDuration: 30 * time.Second,
 			endpoints: []TestEndpoint{
-				{Name: "Speed Test", Host: "speedtest.net", Port: 80, Protocol: "tcp"},
+				{Name: "Speed Test", Host: "speed.cloudflare.com", Port: 443, Protocol: "tcp", Path: "/__down?bytes={size}", Timeout: 60 * time.Second},
 			},
 		},
 		latencyTest: &LatencyTest{
@@ -663,11 +748,13 @@ func (f *CrossPlatformTestFramework) initPerformanceTester() {
 			maxMemoryMB:     100,
 			maxCPUPercent:   20.0,
 			monitorDuration: 2 * time.Minute,
+			samples:         12,
 		},
 		loadTest: &LoadTest{
 			concurrentUsers: 100,
 			testDuration:    5 * time.Minute,
 			rampUpTime:      30 * time.Second,
+			maxErrorRate:    0.01, // 1%
 			testScenarios: []LoadScenario{
 				{Name: "HTTP Load", Requests: 1000, Concurrent: 50, Target: "http://localhost:8080"},
 				{Name: "DNS Load", Requests: 5000, Concurrent: 100, Target: "dns://localhost:53"},
@@ -688,9 +775,10 @@ func (f *CrossPlatformTestFramework) initPerformanceTester() {
 	}
 }
 
-// Run all tests
-func (f *CrossPlatformTestFramework) RunAllTests() error {
+// Run all tests and return the process exit code for the run
+func (f *CrossPlatformTestFramework) RunAllTests() (int, error) {
 	f.logger.Println("Starting comprehensive cross-platform testing...")
+	f.runStartTime = time.Now()
 	
 	testSuite := []struct {
 		name     string
@@ -703,111 +791,195 @@ func (f *CrossPlatformTestFramework) RunAllTests() error {
 		{"Performance Tests", f.runPerformanceTests},
 	}
 	
+	// Suites only wait on their cases, so they start together and the
+	// worker pool alone bounds how many cases actually run at once
+	var wg sync.WaitGroup
 	for _, test := range testSuite {
-		f.logger.Printf("Running %s...", test.name)
-		startTime := time.Now()
-		
-		err := test.function()
-		duration := time.Since(startTime)
-		
-		result := &TestResult{
-			TestName:  test.name,
-			Platform:  runtime.GOOS,
-			StartTime: startTime,
-			EndTime:   time.Now(),
-			Duration:  duration,
-		}
-		
-		if err != nil {
-			result.Status = "fail"
-			result.Error = err.Error()
-			f.logger.Printf("%s failed: %v", test.name, err)
-		} else {
-			result.Status = "pass"
-			f.logger.Printf("%s completed successfully in %v", test.name, duration)
-		}
-		
-		f.mutex.Lock()
-		f.testResults[test.name] = result
-		f.mutex.Unlock()
+		wg.Add(1)
+		go func(name string, function func() error) {
+			defer wg.Done()
+			f.runSuite(name, function)
+		}(test.name, test.function)
 	}
+	wg.Wait()
 	
 	// Generate test report
-	return f.generateTestReport()
+	if err := f.generateTestReport(); err != nil {
+		return 1, err
+	}
+	
+	f.logger.Printf("Summary: %s", f.summary)
+	return f.summary.ExitCode, nil
 }
 
-// Run native integration tests
-func (f *CrossPlatformTestFramework) runNativeIntegrationTests() error {
-	if !f.config.TestNativeMessaging && !f.config.TestSystemServices && !f.config.TestPermissions {
-		return nil
-	}
+// Run a single suite and record its result
+func (f *CrossPlatformTestFramework) runSuite(name string, function func() error) {
+	f.logger.Printf("Running %s...", name)
+	startTime := time.Now()
 	
-	var errors []error
+	err := function()
+	duration := time.Since(startTime)
 	
-	// Test native messaging
-	if f.config.TestNativeMessaging {
-		if result := f.platformTester.TestNativeMessaging(); result.Status != "pass" {
-			errors = append(errors, fmt.Errorf("native messaging test failed: %s", result.Error))
-		}
+	result := &TestResult{
+		TestName:  name,
+		Platform:  runtime.GOOS,
+		StartTime: startTime,
+		EndTime:   time.Now(),
+		Duration:  duration,
 	}
 	
-	// Test system services
-	if f.config.TestSystemServices {
-		if result := f.platformTester.TestSystemServices(); result.Status != "pass" {
-			errors = append(errors, fmt.Errorf("system services test failed: %s", result.Error))
-		}
+	if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+		f.logger.Printf("%s failed: %v", name, err)
+	} else {
+		result.Status = "pass"
+		f.logger.Printf("%s completed successfully in %v", name, duration)
 	}
 	
-	// Test permissions
-	if f.config.TestPermissions {
-		if result := f.platformTester.TestPermissions(); result.Status != "pass" {
-			errors = append(errors, fmt.Errorf("permissions test failed: %s", result.Error))
+	f.mutex.Lock()
+	f.testResults[name] = result
+	f.mutex.Unlock()
+}
+
+// Run the enabled cases of a suite on the worker pool, record a result for
+// each and return their failures in case order
+func (f *CrossPlatformTestFramework) runCases(suite string, cases []testCase) []error {
+	results := make([]error, len(cases))
+	
+	var wg sync.WaitGroup
+	for i, tc := range cases {
+		if !tc.enabled {
+			continue
 		}
+		
+		wg.Add(1)
+		go func(i int, tc testCase) {
+			defer wg.Done()
+			
+			// Take the serial lock before a worker slot so a serial case
+			// waiting for exclusivity never holds a slot others need
+			if tc.serial {
+				f.serialLock.Lock()
+				defer f.serialLock.Unlock()
+			} else {
+				f.serialLock.RLock()
+				defer f.serialLock.RUnlock()
+			}
+			
+			f.workerSlots <- struct{}{}
+			defer func() { <-f.workerSlots }()
+			
+			result := f.runCase(suite, tc)
+			switch result.Status {
+			case "timeout":
+				results[i] = fmt.Errorf("%s test timed out: %s", tc.name, result.Error)
+			case "fail":
+				results[i] = fmt.Errorf("%s test failed: %s", tc.name, result.Error)
+			}
+		}(i, tc)
 	}
+	wg.Wait()
 	
-	if len(errors) > 0 {
-		return fmt.Errorf("native integration tests failed: %v", errors)
+	var errors []error
+	for _, err := range results {
+		if err != nil {
+			errors = append(errors, err)
+		}
 	}
 	
-	return nil
+	return errors
 }
 
-// Run system tests
-func (f *CrossPlatformTestFramework) runSystemTests() error {
-	var errors []error
+// Run a single case bounded by TestTimeout and record its result. The case
+// is handed the timeout context so it can stop its own work, and is
+// abandoned rather than waited for if it overruns anyway, so one hanging
+// platform call cannot stall the rest of the run.
+func (f *CrossPlatformTestFramework) runCase(suite string, tc testCase) *TestResult {
+	ctx, cancel := context.WithCancel(context.Background())
+	if f.config.TestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), f.config.TestTimeout)
+	}
+	defer cancel()
 	
-	// Test network adapters
-	if f.config.TestNetworkAdapters {
-		err := f.testNetworkAdapters()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("network adapter test failed: %v", err))
-		}
+	result := &TestResult{
+		TestName:  fmt.Sprintf("%s/%s", suite, tc.name),
+		Suite:     suite,
+		Platform:  runtime.GOOS,
+		StartTime: time.Now(),
 	}
 	
-	// Test proxy configuration
-	if f.config.TestProxyConfiguration {
-		err := f.testProxyConfiguration()
+	// Buffered so an abandoned case can still finish and exit
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.run(ctx)
+	}()
+	
+	select {
+	case err := <-done:
 		if err != nil {
-			errors = append(errors, fmt.Errorf("proxy configuration test failed: %v", err))
+			result.Status = "fail"
+			result.Error = err.Error()
+		} else {
+			result.Status = "pass"
 		}
+		result.Metrics = tc.metrics
+	case <-ctx.Done():
+		result.Status = "timeout"
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("exceeded test timeout of %v", f.config.TestTimeout)
+		f.logger.Printf("%s timed out after %v", result.TestName, f.config.TestTimeout)
 	}
 	
-	// Test firewall integration
-	if f.config.TestFirewallIntegration {
-		err := f.testFirewallIntegration()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("firewall integration test failed: %v", err))
+	result.EndTime = time.Now()
+	result.Duration = result.EndTime.Sub(result.StartTime)
+	
+	f.mutex.Lock()
+	f.testResults[result.TestName] = result
+	f.mutex.Unlock()
+	
+	return result
+}
+
+// Adapt a platform tester check to a test case function
+func platformCheck(check func(context.Context) *TestResult) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if result := check(ctx); result.Status != "pass" {
+			return fmt.Errorf("%s", result.Error)
 		}
+		return nil
+	}
+}
+
+// Run native integration tests
+func (f *CrossPlatformTestFramework) runNativeIntegrationTests() error {
+	if !f.config.TestNativeMessaging && !f.config.TestSystemServices && !f.config.TestPermissions {
+		return nil
 	}
 	
-	// Test DNS filtering
-	if f.config.TestDNSFiltering {
-		err := f.testDNSFiltering()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("DNS filtering test failed: %v", err))
-		}
+	errors := f.runCases("Native Integration", []testCase{
+		{name: "native messaging", enabled: f.config.TestNativeMessaging, run: platformCheck(f.platformTester.TestNativeMessaging)},
+		{name: "system services", enabled: f.config.TestSystemServices, serial: true, run: platformCheck(f.platformTester.TestSystemServices)},
+		{name: "permissions", enabled: f.config.TestPermissions, run: platformCheck(f.platformTester.TestPermissions)},
+	})
+	
+	if len(errors) > 0 {
+		return fmt.Errorf("native integration tests failed: %v", errors)
 	}
 	
+	return nil
+}
+
+// Run system tests
+func (f *CrossPlatformTestFramework) runSystemTests() error {
+	// All of these reconfigure the host, so none may overlap
+	errors := f.runCases("System Tests", []testCase{
+		{name: "network adapter", enabled: f.config.TestNetworkAdapters, serial: true, run: f.testNetworkAdapters},
+		{name: "proxy configuration", enabled: f.config.TestProxyConfiguration, serial: true, run: f.testProxyConfiguration},
+		{name: "firewall integration", enabled: f.config.TestFirewallIntegration, serial: true, run: f.testFirewallIntegration},
+		{name: "DNS filtering", enabled: f.config.TestDNSFiltering, serial: true, run: f.testDNSFiltering},
+	})
+	
 	if len(errors) > 0 {
 		return fmt.Errorf("system tests failed: %v", errors)
 	}
@@ -816,7 +988,7 @@ func (f *CrossPlatformTestFramework) runSystemTests() error {
 }
 
 // Test network adapters
-func (f *CrossPlatformTestFramework) testNetworkAdapters() error {
+func (f *CrossPlatformTestFramework) testNetworkAdapters(ctx context.Context) error {
 	f.logger.Println("Testing network adapter configuration...")
 	
 	// Get available adapters
@@ -843,7 +1015,7 @@ func (f *CrossPlatformTestFramework) testNetworkAdapters() error {
 }
 
 // Test proxy configuration
-func (f *CrossPlatformTestFramework) testProxyConfiguration() error {
+func (f *CrossPlatformTestFramework) testProxyConfiguration(ctx context.Context) error {
 	f.logger.Println("Testing proxy configuration...")
 	
 	for _, scenario := range f.systemTester.proxyTest.testScenarios {
@@ -872,7 +1044,7 @@ func (f *CrossPlatformTestFramework) testProxyConfiguration() error {
 }
 
 // Test firewall integration
-func (f *CrossPlatformTestFramework) testFirewallIntegration() error {
+func (f *CrossPlatformTestFramework) testFirewallIntegration(ctx context.Context) error {
 	f.logger.Println("Testing firewall integration...")
 	
 	for _, scenario := range f.systemTester.firewallTest.testScenarios {
@@ -911,7 +1083,7 @@ func (f *CrossPlatformTestFramework) testFirewallIntegration() error {
 }
 
 // Test DNS filtering
-func (f *CrossPlatformTestFramework) testDNSFiltering() error {
+func (f *CrossPlatformTestFramework) testDNSFiltering(ctx context.Context) error {
 	f.logger.Println("Testing DNS filtering...")
 	
 	for _, scenario := range f.systemTester.dnsTest.testScenarios {
@@ -941,29 +1113,11 @@ func (f *CrossPlatformTestFramework) testDNSFiltering() error {
 
 // Run network tests
 func (f *CrossPlatformTestFramework) runNetworkTests() error {
-	var errors []error
-	
-	// Test connectivity
-	err := f.testNetworkConnectivity()
-	if err != nil {
-		errors = append(errors, fmt.Errorf("connectivity test failed: %v", err))
-	}
-	
-	// Test throughput
-	if f.config.TestNetworkThroughput {
-		err := f.testNetworkThroughput()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("throughput test failed: %v", err))
-		}
-	}
-	
-	// Test latency
-	if f.config.TestLatency {
-		err := f.testNetworkLatency()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("latency test failed: %v", err))
-		}
-	}
+	errors := f.runCases("Network Tests", []testCase{
+		{name: "connectivity", enabled: true, run: f.testNetworkConnectivity},
+		{name: "throughput", enabled: f.config.TestNetworkThroughput, run: f.testNetworkThroughput},
+		{name: "latency", enabled: f.config.TestLatency, run: f.testNetworkLatency},
+	})
 	
 	if len(errors) > 0 {
 		return fmt.Errorf("network tests failed: %v", errors)
@@ -973,15 +1127,15 @@ func (f *CrossPlatformTestFramework) runNetworkTests() error {
 }
 
 // Test network connectivity
-func (f *CrossPlatformTestFramework) testNetworkConnectivity() error {
+func (f *CrossPlatformTestFramework) testNetworkConnectivity(ctx context.Context) error {
 	f.logger.Println("Testing network connectivity...")
 	
 	for _, endpoint := range f.networkTester.connectivityTest.testEndpoints {
 		f.logger.Printf("Testing connectivity to %s", endpoint.Name)
 		
-		conn, err := net.DialTimeout(endpoint.Protocol, 
-			fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port), 
-			endpoint.Timeout)
+		dialer := &net.Dialer{Timeout: endpoint.Timeout}
+		conn, err := dialer.DialContext(ctx, endpoint.Protocol, 
+			fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port))
 		
 		if err != nil {
 			return fmt.Errorf("failed to connect to %s: %v", endpoint.Name, err)
@@ -995,7 +1149,7 @@ func (f *CrossPlatformTestFramework) testNetworkConnectivity() error {
 }
 
 // Test network throughput
-func (f *CrossPlatformTestFramework) testNetworkThroughput() error {
+func (f *CrossPlatformTestFramework) testNetworkThroughput(ctx context.Context) error {
 	f.logger.Println("Testing network throughput...")
 	
 	for _, endpoint := range f.networkTester.throughputTest.endpoints {
@@ -1013,7 +1167,7 @@ func (f *CrossPlatformTestFramework) testNetworkThroughput() error {
 }
 
 // Test network latency
-func (f *CrossPlatformTestFramework) testNetworkLatency() error {
+func (f *CrossPlatformTestFramework) testNetworkLatency(ctx context.Context) error {
 	f.logger.Println("Testing network latency...")
 	
 	for _, endpoint := range f.networkTester.latencyTest.endpoints {
@@ -1037,78 +1191,92 @@ func (f *CrossPlatformTestFramework) testNetworkLatency() error {
 
 // Run security tests
 func (f *CrossPlatformTestFramework) runSecurityTests() error {
-	var errors []error
+	errors := f.runCases("Security Tests", []testCase{
+		{name: "encryption", enabled: f.config.TestEncryption, run: f.testEncryption},
+		{name: "authentication", enabled: f.config.TestAuthentication, run: f.testAuthentication},
+		{name: "privilege escalation", enabled: f.config.TestPrivilegeEscalation, run: f.testPrivilegeEscalation},
+		{name: "code signing", enabled: f.config.TestCodeSigning, run: f.testCodeSigning},
+	})
 	
-	// Test encryption
-	if f.config.TestEncryption {
-		err := f.testEncryption()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("encryption test failed: %v", err))
-		}
+	if len(errors) > 0 {
+		return fmt.Errorf("security tests failed: %v", errors)
 	}
 	
-	// Test authentication
-	if f.config.TestAuthentication {
-		err := f.testAuthentication()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("authentication test failed: %v", err))
-		}
-	}
+	return nil
+}
+
+// Run performance tests
+func (f *CrossPlatformTestFramework) runPerformanceTests() error {
+	memoryMetrics := &TestMetrics{}
 	
-	// Test privilege escalation
-	if f.config.TestPrivilegeEscalation {
-		err := f.testPrivilegeEscalation()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("privilege escalation test failed: %v", err))
-		}
+	// Resource measurements are skewed by other cases running alongside
+	cases := []testCase{
+		{name: "memory usage", enabled: f.config.TestMemoryUsage, serial: true, metrics: memoryMetrics,
+			run: func(ctx context.Context) error { return f.testMemoryUsage(memoryMetrics) }},
+		{name: "CPU usage", enabled: f.config.TestCPUUsage, serial: true, run: f.testCPUUsage},
 	}
 	
-	// Test code signing
-	if f.config.TestCodeSigning {
-		err := f.testCodeSigning()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("code signing test failed: %v", err))
-		}
+	for _, scenario := range f.performanceTester.loadTest.testScenarios {
+		scenario := scenario
+		metrics := &TestMetrics{}
+		cases = append(cases, testCase{
+			name:    "load " + scenario.Name,
+			enabled: f.config.TestLoad,
+			serial:  true,
+			metrics: metrics,
+			run:     func(ctx context.Context) error { return f.runLoadScenario(ctx, scenario, metrics) },
+		})
 	}
 	
+	errors := f.runCases("Performance Tests", cases)
+	
 	if len(errors) > 0 {
-		return fmt.Errorf("security tests failed: %v", errors)
+		return fmt.Errorf("performance tests failed: %v", errors)
 	}
 	
 	return nil
 }
 
-// Run performance tests
-func (f *CrossPlatformTestFramework) runPerformanceTests() error {
-	var errors []error
+// Tally the individual test case results of the run
+func (f *CrossPlatformTestFramework) computeSummary() *TestSummary {
+	summary := &TestSummary{Duration: time.Since(f.runStartTime)}
 	
-	// Test memory usage
-	if f.config.TestMemoryUsage {
-		err := f.testMemoryUsage()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("memory usage test failed: %v", err))
+	f.mutex.RLock()
+	for _, result := range f.testResults {
+		if result.Suite == "" {
+			continue
 		}
-	}
-	
-	// Test CPU usage
-	if f.config.TestCPUUsage {
-		err := f.testCPUUsage()
-		if err != nil {
-			errors = append(errors, fmt.Errorf("CPU usage test failed: %v", err))
+		
+		summary.Total++
+		switch result.Status {
+		case "pass":
+			summary.Passed++
+		case "fail":
+			summary.Failed++
+		case "skip":
+			summary.Skipped++
+		case "timeout":
+			summary.TimedOut++
+			summary.Errored++
+		default:
+			summary.Errored++
 		}
 	}
+	f.mutex.RUnlock()
 	
-	if len(errors) > 0 {
-		return fmt.Errorf("performance tests failed: %v", errors)
+	if summary.Failed > 0 || summary.Errored > 0 {
+		summary.ExitCode = 1
 	}
 	
-	return nil
+	return summary
 }
 
 // Generate test report
 func (f *CrossPlatformTestFramework) generateTestReport() error {
 	f.logger.Println("Generating test report...")
 	
+	f.summary = f.computeSummary()
+	
 	// Ensure output directory exists
 	err := os.MkdirAll(f.config.OutputDirectory, 0755)
 	if err != nil {
@@ -1123,6 +1291,10 @@ func (f *CrossPlatformTestFramework) generateTestReport() error {
 		return f.generateHTMLReport()
 	case "xml":
 		return f.generateXMLReport()
+	case "csv":
+		return f.generateCSVReport()
+	case "tap":
+		return f.generateTAPReport()
 	default:
 		return f.generateTextReport()
 	}
@@ -1139,7 +1311,12 @@ func (f *CrossPlatformTestFramework) generateJSONReport() error {
 	}
 	f.mutex.RUnlock()
 	
-	data, err := json.MarshalIndent(results, "", "  ")
+	report := struct {
+		Summary *TestSummary           `json:"summary"`
+		Results map[string]*TestResult `json:"results"`
+	}{f.summary, results}
+	
+	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal test results: %v", err)
 	}
@@ -1176,6 +1353,7 @@ func (f *CrossPlatformTestFramework) generateHTMLReport() error {
     <h1>OblivionFilter Cross-Platform Test Report</h1>
     <p>Platform: %s</p>
     <p>Generated: %s</p>
+    <p>Summary: %s</p>
     <table>
         <tr>
             <th>Test Name</th>
@@ -1198,7 +1376,7 @@ func (f *CrossPlatformTestFramework) generateHTMLReport() error {
 	}
 	f.mutex.RUnlock()
 	
-	htmlContent := fmt.Sprintf(htmlTemplate, runtime.GOOS, time.Now().Format(time.RFC3339), rows.String())
+	htmlContent := fmt.Sprintf(htmlTemplate, runtime.GOOS, time.Now().Format(time.RFC3339), f.summary, rows.String())
 	
 	err := os.WriteFile(reportPath, []byte(htmlContent), 0644)
 	if err != nil {
@@ -1215,7 +1393,7 @@ func (f *CrossPlatformTestFramework) generateXMLReport() error {
 	
 	// XML template (simplified JUnit format)
 	xmlTemplate := `<?xml version="1.0" encoding="UTF-8"?>
-<testsuite name="OblivionFilter" platform="%s" timestamp="%s">
+<testsuite name="OblivionFilter" platform="%s" timestamp="%s" tests="%d" failures="%d" errors="%d" skipped="%d" time="%.3f">
 %s
 </testsuite>`
 	
@@ -1230,6 +1408,9 @@ func (f *CrossPlatformTestFramework) generateXMLReport() error {
 		if result.Status == "fail" {
 			testCases.WriteString(fmt.Sprintf(
 				`<failure message="%s">%s</failure>`, result.Message, result.Error))
+		} else if result.Status == "error" || result.Status == "timeout" {
+			testCases.WriteString(fmt.Sprintf(
+				`<error type="%s" message="%s">%s</error>`, result.Status, result.Message, result.Error))
 		} else if result.Status == "skip" {
 			testCases.WriteString(`<skipped/>`)
 		}
@@ -1238,7 +1419,9 @@ func (f *CrossPlatformTestFramework) generateXMLReport() error {
 	}
 	f.mutex.RUnlock()
 	
-	xmlContent := fmt.Sprintf(xmlTemplate, runtime.GOOS, time.Now().Format(time.RFC3339), testCases.String())
+	xmlContent := fmt.Sprintf(xmlTemplate, runtime.GOOS, time.Now().Format(time.RFC3339),
+		f.summary.Total, f.summary.Failed, f.summary.Errored, f.summary.Skipped, f.summary.Duration.Seconds(),
+		testCases.String())
 	
 	err := os.WriteFile(reportPath, []byte(xmlContent), 0644)
 	if err != nil {
@@ -1249,6 +1432,115 @@ func (f *CrossPlatformTestFramework) generateXMLReport() error {
 	return nil
 }
 
+// Snapshot the recorded results ordered by test name
+func (f *CrossPlatformTestFramework) sortedResults() []*TestResult {
+	f.mutex.RLock()
+	results := make([]*TestResult, 0, len(f.testResults))
+	for _, result := range f.testResults {
+		results = append(results, result)
+	}
+	f.mutex.RUnlock()
+	
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].TestName < results[j].TestName
+	})
+	return results
+}
+
+// Generate CSV report
+func (f *CrossPlatformTestFramework) generateCSVReport() error {
+	reportPath := filepath.Join(f.config.OutputDirectory, "test-report.csv")
+	
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"name", "platform", "status", "duration", "message"})
+	for _, result := range f.sortedResults() {
+		writer.Write([]string{
+			result.TestName,
+			result.Platform,
+			result.Status,
+			strconv.FormatFloat(result.Duration.Seconds(), 'f', 3, 64),
+			result.Message,
+		})
+	}
+	
+	// Trailing aggregate row so the summary survives spreadsheet imports
+	summaryStatus := "pass"
+	if f.summary.ExitCode != 0 {
+		summaryStatus = "fail"
+	}
+	writer.Write([]string{
+		"SUMMARY",
+		runtime.GOOS,
+		summaryStatus,
+		strconv.FormatFloat(f.summary.Duration.Seconds(), 'f', 3, 64),
+		f.summary.String(),
+	})
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to encode CSV report: %v", err)
+	}
+	
+	err := os.WriteFile(reportPath, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write CSV report: %v", err)
+	}
+	
+	f.logger.Printf("CSV report generated: %s", reportPath)
+	return nil
+}
+
+// Generate TAP version 13 report
+func (f *CrossPlatformTestFramework) generateTAPReport() error {
+	reportPath := filepath.Join(f.config.OutputDirectory, "test-report.tap")
+	
+	results := f.sortedResults()
+	
+	var report strings.Builder
+	report.WriteString("TAP version 13\n")
+	report.WriteString(fmt.Sprintf("1..%d\n", len(results)))
+	
+	for i, result := range results {
+		// Test names must not contain "#", which starts a TAP directive
+		name := strings.ReplaceAll(result.TestName, "#", "")
+		
+		switch result.Status {
+		case "pass":
+			report.WriteString(fmt.Sprintf("ok %d - %s\n", i+1, name))
+		case "skip":
+			report.WriteString(fmt.Sprintf("ok %d - %s # SKIP %s\n", i+1, name, result.Message))
+		default:
+			report.WriteString(fmt.Sprintf("not ok %d - %s\n", i+1, name))
+			report.WriteString("  ---\n")
+			report.WriteString(fmt.Sprintf("  status: %s\n", result.Status))
+			report.WriteString(fmt.Sprintf("  platform: %s\n", result.Platform))
+			report.WriteString(fmt.Sprintf("  duration_ms: %d\n", result.Duration.Milliseconds()))
+			if result.Message != "" {
+				report.WriteString(fmt.Sprintf("  message: %s\n", strconv.Quote(result.Message)))
+			}
+			if result.Error != "" {
+				report.WriteString(fmt.Sprintf("  error: %s\n", strconv.Quote(result.Error)))
+			}
+			report.WriteString("  ...\n")
+		}
+	}
+	
+	report.WriteString(fmt.Sprintf("# tests %d\n", f.summary.Total))
+	report.WriteString(fmt.Sprintf("# pass %d\n", f.summary.Passed))
+	report.WriteString(fmt.Sprintf("# fail %d\n", f.summary.Failed))
+	report.WriteString(fmt.Sprintf("# skip %d\n", f.summary.Skipped))
+	report.WriteString(fmt.Sprintf("# error %d\n", f.summary.Errored))
+	report.WriteString(fmt.Sprintf("# duration %v\n", f.summary.Duration))
+	
+	err := os.WriteFile(reportPath, []byte(report.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write TAP report: %v", err)
+	}
+	
+	f.logger.Printf("TAP report generated: %s", reportPath)
+	return nil
+}
+
 // Generate text report
 func (f *CrossPlatformTestFramework) generateTextReport() error {
 	reportPath := filepath.Join(f.config.OutputDirectory, "test-report.txt")
@@ -1256,7 +1548,8 @@ func (f *CrossPlatformTestFramework) generateTextReport() error {
 	var report strings.Builder
 	report.WriteString(fmt.Sprintf("OblivionFilter Cross-Platform Test Report\n"))
 	report.WriteString(fmt.Sprintf("Platform: %s\n", runtime.GOOS))
-	report.WriteString(fmt.Sprintf("Generated: %s\n\n", time.Now().Format(time.RFC3339)))
+	report.WriteString(fmt.Sprintf("Generated: %s\n", time.Now().Format(time.RFC3339)))
+	report.WriteString(fmt.Sprintf("Summary: %s\n\n", f.summary))
 	
 	f.mutex.RLock()
 	for _, result := range f.testResults {
@@ -1333,71 +1626,600 @@ func (f *CrossPlatformTestFramework) testDNSResolution(domain DNSTestDomain) (st
 	return "resolved", nil
 }
 
+// Download size bytes from the endpoint and return the achieved bytes/sec
 func (f *CrossPlatformTestFramework) measureThroughput(endpoint TestEndpoint, size int64) (int64, error) {
-	// Measure network throughput implementation
-	return 1000000, nil // 1MB/s
+	scheme := "http"
+	if endpoint.Port == 443 {
+		scheme = "https"
+	}
+	host := endpoint.Host
+	if endpoint.Port != 0 && endpoint.Port != 80 && endpoint.Port != 443 {
+		host = net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))
+	}
+	path := strings.ReplaceAll(endpoint.Path, "{size}", strconv.FormatInt(size, 10))
+	url := fmt.Sprintf("%s://%s%s", scheme, host, path)
+	
+	timeout := endpoint.Timeout
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("request to %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	
+	received, err := io.Copy(io.Discard, io.LimitReader(resp.Body, size))
+	elapsed := time.Since(start)
+	if err != nil {
+		return 0, fmt.Errorf("transfer from %s failed after %d bytes: %v", url, received, err)
+	}
+	if received < size {
+		return 0, fmt.Errorf("short transfer from %s: got %d of %d bytes", url, received, size)
+	}
+	
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return int64(float64(received) / elapsed.Seconds()), nil
 }
 
+// Measure round-trip times with ICMP echoes, falling back to TCP connect
+// timing when this process may not open an ICMP socket. Lost echoes are
+// dropped from the samples; losing every one is an error.
 func (f *CrossPlatformTestFramework) measureLatency(endpoint TestEndpoint, count int) ([]time.Duration, error) {
-	// Measure network latency implementation
-	latencies := make([]time.Duration, count)
+	timeout := endpoint.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	
+	dst, err := net.ResolveIPAddr("ip4", endpoint.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", endpoint.Host, err)
+	}
+	
+	conn, network, err := listenICMP()
+	if err != nil {
+		f.logger.Printf("ICMP unavailable (%v), timing TCP connects to %s instead", err, endpoint.Host)
+		return measureTCPConnectLatency(dst.IP, endpoint.Port, count, timeout)
+	}
+	defer conn.Close()
+	
+	// Unprivileged datagram sockets address peers by UDPAddr and let the
+	// kernel rewrite the echo ID
+	var peer net.Addr = dst
+	if network == "udp4" {
+		peer = &net.UDPAddr{IP: dst.IP}
+	}
+	
+	id := os.Getpid() & 0xffff
+	payload := make([]byte, f.networkTester.latencyTest.packetSize)
+	reply := make([]byte, 1500+len(payload))
+	
+	var latencies []time.Duration
+	for seq := 0; seq < count; seq++ {
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+		}
+		data, err := msg.Marshal(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build echo request: %v", err)
+		}
+		
+		start := time.Now()
+		if _, err := conn.WriteTo(data, peer); err != nil {
+			return nil, fmt.Errorf("failed to send echo to %s: %v", dst, err)
+		}
+		
+		deadline := start.Add(timeout)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := conn.ReadFrom(reply)
+			if err != nil {
+				// Timed out: count the echo as lost
+				break
+			}
+			
+			parsed, err := icmp.ParseMessage(1, reply[:n])
+			if err != nil || parsed.Type != ipv4.ICMPTypeEchoReply {
+				continue
+			}
+			echo, ok := parsed.Body.(*icmp.Echo)
+			if !ok || echo.Seq != seq || (network != "udp4" && echo.ID != id) {
+				continue
+			}
+			
+			latencies = append(latencies, time.Since(start))
+			break
+		}
+	}
+	
+	if len(latencies) == 0 {
+		return nil, fmt.Errorf("no echo replies from %s in %d attempts", dst, count)
+	}
+	
+	return latencies, nil
+}
+
+// Open an ICMPv4 socket, preferring the unprivileged datagram kind
+func listenICMP() (*icmp.PacketConn, string, error) {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err == nil {
+		return conn, "udp4", nil
+	}
+	
+	conn, rawErr := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if rawErr == nil {
+		return conn, "ip4:icmp", nil
+	}
+	
+	return nil, "", fmt.Errorf("datagram ICMP: %v; raw ICMP: %v", err, rawErr)
+}
+
+// Time TCP handshakes as a latency estimate. ICMP endpoints carry no
+// port, so those are probed on 443.
+func measureTCPConnectLatency(ip net.IP, port, count int, timeout time.Duration) ([]time.Duration, error) {
+	if port == 0 {
+		port = 443
+	}
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	
+	var latencies []time.Duration
+	var lastErr error
 	for i := 0; i < count; i++ {
-		latencies[i] = 10 * time.Millisecond
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+		conn.Close()
+	}
+	
+	if len(latencies) == 0 {
+		return nil, fmt.Errorf("no TCP connections to %s in %d attempts: %v", address, count, lastErr)
 	}
+	
 	return latencies, nil
 }
 
-func (f *CrossPlatformTestFramework) testEncryption() error {
+func (f *CrossPlatformTestFramework) testEncryption(ctx context.Context) error {
 	// Test encryption implementation
 	return nil
 }
 
-func (f *CrossPlatformTestFramework) testAuthentication() error {
+func (f *CrossPlatformTestFramework) testAuthentication(ctx context.Context) error {
 	// Test authentication implementation
 	return nil
 }
 
-func (f *CrossPlatformTestFramework) testPrivilegeEscalation() error {
+func (f *CrossPlatformTestFramework) testPrivilegeEscalation(ctx context.Context) error {
 	// Test privilege escalation implementation
 	return nil
 }
 
-func (f *CrossPlatformTestFramework) testCodeSigning() error {
+func (f *CrossPlatformTestFramework) testCodeSigning(ctx context.Context) error {
 	// Test code signing implementation
 	return nil
 }
 
-func (f *CrossPlatformTestFramework) testMemoryUsage() error {
-	// Test memory usage implementation
+// Run the workload repeatedly across monitorDuration, sampling the heap
+// after a forced GC each round. Fails when the steady-state heap exceeds
+// maxMemoryMB or grows at every sample, which points to a leak.
+func (f *CrossPlatformTestFramework) testMemoryUsage(metrics *TestMetrics) error {
+	test := f.performanceTester.resourceTest
+	
+	workload := test.workload
+	if workload == nil {
+		loopback, stop, err := newLoopbackWorkload(200)
+		if err != nil {
+			return fmt.Errorf("failed to start workload: %v", err)
+		}
+		defer stop()
+		workload = loopback
+	}
+	
+	samples := test.samples
+	if samples < 2 {
+		samples = 2
+	}
+	interval := test.monitorDuration / time.Duration(samples)
+	
+	var stats runtime.MemStats
+	heap := make([]uint64, 0, samples)
+	for i := 0; i < samples; i++ {
+		roundEnd := time.Now().Add(interval)
+		for {
+			if err := workload(); err != nil {
+				return fmt.Errorf("workload failed: %v", err)
+			}
+			if !time.Now().Before(roundEnd) {
+				break
+			}
+		}
+		
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		heap = append(heap, stats.HeapAlloc)
+		
+		if int64(stats.HeapAlloc) > metrics.PeakMemory {
+			metrics.PeakMemory = int64(stats.HeapAlloc)
+		}
+	}
+	
+	final := heap[len(heap)-1]
+	metrics.MemoryUsage = int64(final)
+	f.logger.Printf("Heap after workload: final %d bytes, peak %d bytes", final, metrics.PeakMemory)
+	
+	limit := uint64(test.maxMemoryMB) * 1024 * 1024
+	if final > limit {
+		return fmt.Errorf("steady-state heap %d bytes exceeds limit of %d MB", final, test.maxMemoryMB)
+	}
+	
+	if heapKeepsGrowing(heap) {
+		return fmt.Errorf("heap grew at every one of %d samples (%d -> %d bytes), possible leak", len(heap), heap[0], final)
+	}
+	
+	return nil
+}
+
+// Report whether the heap rose at every sample and ended more than 10%
+// above where it started. GC noise makes a flat heap wobble, so strictly
+// monotonic growth over several samples is the leak signal.
+func heapKeepsGrowing(heap []uint64) bool {
+	if len(heap) < 4 {
+		return false
+	}
+	
+	for i := 1; i < len(heap); i++ {
+		if heap[i] <= heap[i-1] {
+			return false
+		}
+	}
+	
+	return heap[len(heap)-1] > heap[0]+heap[0]/10
+}
+
+// Serve HTTP on loopback and return a workload issuing the given number of
+// requests against it, shaped like the proxy's request/response path
+func newLoopbackWorkload(requests int) (func() error, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>OblivionFilter workload</body></html>"))
+		}),
+	}
+	go server.Serve(listener)
+	
+	transport := &http.Transport{MaxIdleConnsPerHost: 16}
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	url := fmt.Sprintf("http://%s/", listener.Addr())
+	
+	workload := func() error {
+		for i := 0; i < requests; i++ {
+			resp, err := client.Get(url)
+			if err != nil {
+				return err
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return nil
+	}
+	stop := func() {
+		transport.CloseIdleConnections()
+		server.Close()
+	}
+	
+	return workload, stop, nil
+}
+
+// Drive a load scenario: Concurrent workers, started evenly across
+// rampUpTime, share Requests HTTP GETs against Target. The run stops early
+// once testDuration elapses or ctx is cancelled.
+func (f *CrossPlatformTestFramework) runLoadScenario(ctx context.Context, scenario LoadScenario, metrics *TestMetrics) error {
+	test := f.performanceTester.loadTest
+	
+	if !strings.HasPrefix(scenario.Target, "http://") && !strings.HasPrefix(scenario.Target, "https://") {
+		f.logger.Printf("Skipping load scenario %s: unsupported target %s", scenario.Name, scenario.Target)
+		return nil
+	}
+	
+	workers := scenario.Concurrent
+	if test.concurrentUsers > 0 && workers > test.concurrentUsers {
+		workers = test.concurrentUsers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	
+	ctx, cancel := context.WithTimeout(ctx, test.testDuration)
+	defer cancel()
+	
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: workers},
+		Timeout:   30 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+	
+	var (
+		issued    int64
+		failed    int64
+		mutex     sync.Mutex
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			
+			delay := test.rampUpTime * time.Duration(w) / time.Duration(workers)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			
+			for ctx.Err() == nil && atomic.AddInt64(&issued, 1) <= int64(scenario.Requests) {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, scenario.Target, nil)
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				
+				requestStart := time.Now()
+				resp, err := client.Do(req)
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode >= 500 {
+						err = fmt.Errorf("server returned %s", resp.Status)
+					}
+				}
+				elapsed := time.Since(requestStart)
+				
+				if err != nil {
+					// Requests cut off by testDuration are not server errors
+					if ctx.Err() == nil {
+						atomic.AddInt64(&failed, 1)
+					}
+					continue
+				}
+				
+				mutex.Lock()
+				latencies = append(latencies, elapsed)
+				mutex.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	duration := time.Since(start)
+	
+	succeeded := int64(len(latencies))
+	sent := succeeded + failed
+	metrics.RequestsSent = sent
+	if sent > 0 {
+		metrics.ErrorRate = float64(failed) / float64(sent)
+	}
+	if duration > 0 {
+		// Successful requests per second
+		metrics.Throughput = int64(float64(succeeded) / duration.Seconds())
+	}
+	
+	if succeeded > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		
+		var total time.Duration
+		for _, latency := range latencies {
+			total += latency
+		}
+		metrics.ResponseTime = total / time.Duration(succeeded)
+		metrics.ResponseTimeP50 = percentile(latencies, 50)
+		metrics.ResponseTimeP95 = percentile(latencies, 95)
+		metrics.ResponseTimeP99 = percentile(latencies, 99)
+	}
+	
+	f.logger.Printf("Load scenario %s: %d requests in %v, %d req/s, p95 %v, error rate %.2f%%",
+		scenario.Name, sent, duration, metrics.Throughput, metrics.ResponseTimeP95, metrics.ErrorRate*100)
+	
+	if sent == 0 {
+		return fmt.Errorf("no requests completed against %s", scenario.Target)
+	}
+	if metrics.ErrorRate > test.maxErrorRate {
+		return fmt.Errorf("error rate %.2f%% exceeds %.2f%%", metrics.ErrorRate*100, test.maxErrorRate*100)
+	}
+	
 	return nil
 }
 
-func (f *CrossPlatformTestFramework) testCPUUsage() error {
+// Nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func (f *CrossPlatformTestFramework) testCPUUsage(ctx context.Context) error {
 	// Test CPU usage implementation
 	return nil
 }
 
+// Largest reply accepted from the host; browsers cap host messages at 1MB
+const maxNativeMessageSize = 1024 * 1024
+
+// Launch the native host and exchange each test message with it over the
+// native messaging protocol: a 4-byte little-endian length, then JSON.
+func runNativeMessagingTest(ctx context.Context, testName, platform string, test *NativeMessagingTest) *TestResult {
+	result := &TestResult{
+		TestName:  testName,
+		Platform:  platform,
+		StartTime: time.Now(),
+		Details:   make(map[string]interface{}),
+	}
+	finish := func(status, message string) *TestResult {
+		result.Status = status
+		result.Message = message
+		if status != "pass" {
+			result.Error = message
+		}
+		result.EndTime = time.Now()
+		result.Duration = result.EndTime.Sub(result.StartTime)
+		return result
+	}
+	
+	if _, err := os.Stat(test.hostPath); err != nil {
+		return finish("fail", fmt.Sprintf("native host not found: %v", err))
+	}
+	
+	ctx, cancel := context.WithTimeout(ctx, test.timeout)
+	defer cancel()
+	
+	// Browsers pass the calling extension's origin as the first argument
+	cmd := exec.CommandContext(ctx, test.hostPath, fmt.Sprintf("chrome-extension://%s/", test.extensionId))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return finish("fail", fmt.Sprintf("failed to open host stdin: %v", err))
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return finish("fail", fmt.Sprintf("failed to open host stdout: %v", err))
+	}
+	
+	if err := cmd.Start(); err != nil {
+		return finish("fail", fmt.Sprintf("failed to start native host: %v", err))
+	}
+	
+	// Report a broken exchange together with whatever the host logged
+	hostFailure := func(format string, args ...interface{}) *TestResult {
+		stdin.Close()
+		cmd.Wait()
+		message := fmt.Sprintf(format, args...)
+		if ctx.Err() == context.DeadlineExceeded {
+			message = fmt.Sprintf("native host timed out after %v: %s", test.timeout, message)
+		}
+		if stderr.Len() > 0 {
+			message = fmt.Sprintf("%s; stderr: %s", message, strings.TrimSpace(stderr.String()))
+		}
+		return finish("fail", message)
+	}
+	
+	for _, msg := range test.testMessages {
+		request := map[string]interface{}{"id": msg.ID, "type": msg.Type}
+		for k, v := range msg.Payload {
+			request[k] = v
+		}
+		
+		if err := writeNativeMessage(stdin, request); err != nil {
+			return hostFailure("failed to send %s: %v", msg.ID, err)
+		}
+		
+		response, err := readNativeMessage(stdout)
+		if err != nil {
+			return hostFailure("failed to read reply to %s: %v", msg.ID, err)
+		}
+		result.Details[msg.ID] = response
+		
+		for key, want := range msg.Expected {
+			if got, ok := response[key]; !ok || fmt.Sprint(got) != fmt.Sprint(want) {
+				return hostFailure("reply to %s: expected %s=%v, got %v", msg.ID, key, want, got)
+			}
+		}
+	}
+	
+	// Closing stdin is how the browser tells the host to exit
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		message := fmt.Sprintf("native host exited with error: %v", err)
+		if stderr.Len() > 0 {
+			message = fmt.Sprintf("%s; stderr: %s", message, strings.TrimSpace(stderr.String()))
+		}
+		return finish("fail", message)
+	}
+	
+	return finish("pass", fmt.Sprintf("exchanged %d messages with %s", len(test.testMessages), test.hostPath))
+}
+
+func writeNativeMessage(w io.Writer, message map[string]interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readNativeMessage(r io.Reader) (map[string]interface{}, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	
+	length := binary.LittleEndian.Uint32(header[:])
+	if length > maxNativeMessageSize {
+		return nil, fmt.Errorf("message length %d exceeds %d bytes", length, maxNativeMessageSize)
+	}
+	
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("invalid JSON from host: %v", err)
+	}
+	return message, nil
+}
+
 // Platform-specific tester implementations
 type WindowsPlatformTester struct {
-	config *TestFrameworkConfig
+	config        *TestFrameworkConfig
+	messagingTest *NativeMessagingTest
 }
 
-func (w *WindowsPlatformTester) TestNativeMessaging() *TestResult {
-	// Windows-specific native messaging test
-	return &TestResult{TestName: "Windows Native Messaging", Platform: "windows", Status: "pass"}
+func (w *WindowsPlatformTester) TestNativeMessaging(ctx context.Context) *TestResult {
+	return runNativeMessagingTest(ctx, "Windows Native Messaging", "windows", w.messagingTest)
 }
 
-func (w *WindowsPlatformTester) TestSystemServices() *TestResult {
+func (w *WindowsPlatformTester) TestSystemServices(ctx context.Context) *TestResult {
 	// Windows-specific system services test
 	return &TestResult{TestName: "Windows System Services", Platform: "windows", Status: "pass"}
 }
 
-func (w *WindowsPlatformTester) TestPermissions() *TestResult {
+func (w *WindowsPlatformTester) TestPermissions(ctx context.Context) *TestResult {
 	// Windows-specific permissions test
 	return &TestResult{TestName: "Windows Permissions", Platform: "windows", Status: "pass"}
 }
 
-func (w *WindowsPlatformTester) TestSystemIntegration() *TestResult {
+func (w *WindowsPlatformTester) TestSystemIntegration(ctx context.Context) *TestResult {
 	// Windows-specific system integration test
 	return &TestResult{TestName: "Windows System Integration", Platform: "windows", Status: "pass"}
 }
@@ -1407,25 +2229,25 @@ func (w *WindowsPlatformTester) GetPlatformName() string {
 }
 
 type MacOSPlatformTester struct {
-	config *TestFrameworkConfig
+	config        *TestFrameworkConfig
+	messagingTest *NativeMessagingTest
 }
 
-func (m *MacOSPlatformTester) TestNativeMessaging() *TestResult {
-	// macOS-specific native messaging test
-	return &TestResult{TestName: "macOS Native Messaging", Platform: "darwin", Status: "pass"}
+func (m *MacOSPlatformTester) TestNativeMessaging(ctx context.Context) *TestResult {
+	return runNativeMessagingTest(ctx, "macOS Native Messaging", "darwin", m.messagingTest)
 }
 
-func (m *MacOSPlatformTester) TestSystemServices() *TestResult {
+func (m *MacOSPlatformTester) TestSystemServices(ctx context.Context) *TestResult {
 	// macOS-specific system services test
 	return &TestResult{TestName: "macOS System Services", Platform: "darwin", Status: "pass"}
 }
 
-func (m *MacOSPlatformTester) TestPermissions() *TestResult {
+func (m *MacOSPlatformTester) TestPermissions(ctx context.Context) *TestResult {
 	// macOS-specific permissions test
 	return &TestResult{TestName: "macOS Permissions", Platform: "darwin", Status: "pass"}
 }
 
-func (m *MacOSPlatformTester) TestSystemIntegration() *TestResult {
+func (m *MacOSPlatformTester) TestSystemIntegration(ctx context.Context) *TestResult {
 	// macOS-specific system integration test
 	return &TestResult{TestName: "macOS System Integration", Platform: "darwin", Status: "pass"}
 }
@@ -1435,25 +2257,25 @@ func (m *MacOSPlatformTester) GetPlatformName() string {
 }
 
 type LinuxPlatformTester struct {
-	config *TestFrameworkConfig
+	config        *TestFrameworkConfig
+	messagingTest *NativeMessagingTest
 }
 
-func (l *LinuxPlatformTester) TestNativeMessaging() *TestResult {
-	// Linux-specific native messaging test
-	return &TestResult{TestName: "Linux Native Messaging", Platform: "linux", Status: "pass"}
+func (l *LinuxPlatformTester) TestNativeMessaging(ctx context.Context) *TestResult {
+	return runNativeMessagingTest(ctx, "Linux Native Messaging", "linux", l.messagingTest)
 }
 
-func (l *LinuxPlatformTester) TestSystemServices() *TestResult {
+func (l *LinuxPlatformTester) TestSystemServices(ctx context.Context) *TestResult {
 	// Linux-specific system services test
 	return &TestResult{TestName: "Linux System Services", Platform: "linux", Status: "pass"}
 }
 
-func (l *LinuxPlatformTester) TestPermissions() *TestResult {
+func (l *LinuxPlatformTester) TestPermissions(ctx context.Context) *TestResult {
 	// Linux-specific permissions test
 	return &TestResult{TestName: "Linux Permissions", Platform: "linux", Status: "pass"}
 }
 
-func (l *LinuxPlatformTester) TestSystemIntegration() *TestResult {
+func (l *LinuxPlatformTester) TestSystemIntegration(ctx context.Context) *TestResult {
 	// Linux-specific system integration test
 	return &TestResult{TestName: "Linux System Integration", Platform: "linux", Status: "pass"}
 }
@@ -1481,6 +2303,7 @@ func main() {
 		TestCPUUsage:            true,
 		TestNetworkThroughput:   true,
 		TestLatency:             true,
+		TestLoad:                true,
 		TestTimeout:             30 * time.Minute,
 		MaxConcurrentTests:      10,
 		ReportFormat:            "json",
@@ -1489,10 +2312,15 @@ func main() {
 	
 	framework := NewCrossPlatformTestFramework(config)
 	
-	err := framework.RunAllTests()
+	exitCode, err := framework.RunAllTests()
 	if err != nil {
 		log.Fatalf("Test framework failed: %v", err)
 	}
 	
+	if exitCode != 0 {
+		fmt.Println("Cross-platform testing completed with failures")
+		os.Exit(exitCode)
+	}
+	
 	fmt.Println("Cross-platform testing completed successfully!")
 }
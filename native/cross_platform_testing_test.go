@@ -0,0 +1,996 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNativeHostEnv makes the test binary act as a native messaging host, so
+// the messaging tests can launch it in place of the real one
+const fakeNativeHostEnv = "OBLIVION_FAKE_NATIVE_HOST"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(fakeNativeHostEnv); mode != "" {
+		os.Exit(runFakeNativeHost(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeNativeHost answers native messages on stdin until it closes.
+// mode "ok" replies as the host should, "wrong" with an unexpected reply,
+// "crash" exits with an error after logging to stderr and "hang" never
+// replies.
+func runFakeNativeHost(mode string) int {
+	switch mode {
+	case "crash":
+		fmt.Fprintln(os.Stderr, "fake host: filter engine failed to load")
+		return 3
+	case "hang":
+		time.Sleep(time.Minute)
+		return 0
+	}
+
+	if len(os.Args) < 2 || !strings.HasPrefix(os.Args[1], "chrome-extension://") {
+		fmt.Fprintf(os.Stderr, "fake host: missing extension origin in %q\n", os.Args)
+		return 2
+	}
+
+	for {
+		request, err := readNativeMessage(os.Stdin)
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fake host: %v\n", err)
+			return 1
+		}
+
+		reply := map[string]interface{}{"id": request["id"]}
+		switch request["type"] {
+		case "ping":
+			reply["type"] = "pong"
+		case "getFilterStatus":
+			reply["type"] = "filterStatus"
+			reply["enabled"] = mode != "wrong"
+		default:
+			reply["type"] = "error"
+		}
+		if err := writeNativeMessage(os.Stdout, reply); err != nil {
+			return 1
+		}
+	}
+}
+
+// newTestFramework builds a framework with every suite disabled and its
+// logging discarded
+func newTestFramework(t *testing.T, config *TestFrameworkConfig) *CrossPlatformTestFramework {
+	t.Helper()
+	if config.OutputDirectory == "" {
+		config.OutputDirectory = t.TempDir()
+	}
+	f := NewCrossPlatformTestFramework(config)
+	f.logger = log.New(io.Discard, "", 0)
+	return f
+}
+
+// concurrencyProbe records how many test cases are running at once
+type concurrencyProbe struct {
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func (p *concurrencyProbe) enter() int32 {
+	n := p.running.Add(1)
+	for {
+		peak := p.peak.Load()
+		if n <= peak || p.peak.CompareAndSwap(peak, n) {
+			return n
+		}
+	}
+}
+
+func (p *concurrencyProbe) leave() {
+	p.running.Add(-1)
+}
+
+func TestRunCasesBoundedConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		limit   int32
+	}{
+		{"unset", 0, 1},
+		{"one", 1, 1},
+		{"three", 3, 3},
+		{"eight", 8, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFramework(t, &TestFrameworkConfig{MaxConcurrentTests: tt.workers})
+
+			var probe concurrencyProbe
+			cases := make([]testCase, 16)
+			for i := range cases {
+				fail := i%5 == 0
+				cases[i] = testCase{
+					name:    fmt.Sprintf("case %d", i),
+					enabled: i != 7,
+					run: func(ctx context.Context) error {
+						probe.enter()
+						defer probe.leave()
+						time.Sleep(10 * time.Millisecond)
+						if fail {
+							return fmt.Errorf("deliberate failure")
+						}
+						return nil
+					},
+				}
+			}
+
+			errs := f.runCases("Bounded", cases)
+			if peak := probe.peak.Load(); peak > tt.limit {
+				t.Errorf("%d cases ran at once, limit is %d", peak, tt.limit)
+			}
+			if tt.limit > 1 && probe.peak.Load() < 2 {
+				t.Errorf("cases never ran concurrently with %d workers", tt.limit)
+			}
+			if len(errs) != 4 {
+				t.Errorf("runCases returned %d errors, want 4: %v", len(errs), errs)
+			}
+
+			// Every enabled case is recorded, the disabled one is not
+			if len(f.testResults) != 15 {
+				t.Errorf("recorded %d results, want 15", len(f.testResults))
+			}
+			for i := range cases {
+				result, ok := f.testResults[fmt.Sprintf("Bounded/case %d", i)]
+				switch {
+				case i == 7:
+					if ok {
+						t.Errorf("disabled case %d was run", i)
+					}
+				case !ok:
+					t.Errorf("case %d has no result", i)
+				case i%5 == 0 && result.Status != "fail", i%5 != 0 && result.Status != "pass":
+					t.Errorf("case %d status = %q", i, result.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCasesSerial(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{MaxConcurrentTests: 4})
+
+	var probe concurrencyProbe
+	var mu sync.Mutex
+	var overlapped []string
+	var cases []testCase
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("case %d", i)
+		serial := i%4 == 0
+		cases = append(cases, testCase{
+			name:    name,
+			enabled: true,
+			serial:  serial,
+			run: func(ctx context.Context) error {
+				n := probe.enter()
+				defer probe.leave()
+				time.Sleep(5 * time.Millisecond)
+				if serial && (n != 1 || probe.running.Load() != 1) {
+					mu.Lock()
+					overlapped = append(overlapped, name)
+					mu.Unlock()
+				}
+				return nil
+			},
+		})
+	}
+
+	// Two suites at once, as RunAllTests runs them
+	var wg sync.WaitGroup
+	for _, suite := range []string{"A", "B"} {
+		wg.Add(1)
+		go func(suite string) {
+			defer wg.Done()
+			if errs := f.runCases(suite, cases); len(errs) != 0 {
+				t.Errorf("suite %s: %v", suite, errs)
+			}
+		}(suite)
+	}
+	wg.Wait()
+
+	if len(overlapped) > 0 {
+		t.Errorf("serial cases overlapped with others: %v", overlapped)
+	}
+	if peak := probe.peak.Load(); peak > 4 {
+		t.Errorf("%d cases ran at once, limit is 4", peak)
+	}
+	if len(f.testResults) != 24 {
+		t.Errorf("recorded %d results, want 24", len(f.testResults))
+	}
+}
+
+func TestRunCaseTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		delay    time.Duration
+		err      error
+		want     string
+		timedOut bool
+	}{
+		{"within timeout", 500 * time.Millisecond, 0, nil, "pass", false},
+		{"failure within timeout", 500 * time.Millisecond, 0, fmt.Errorf("boom"), "fail", false},
+		{"exceeds timeout", 20 * time.Millisecond, 5 * time.Second, nil, "timeout", true},
+		{"no timeout configured", 0, 30 * time.Millisecond, nil, "pass", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFramework(t, &TestFrameworkConfig{MaxConcurrentTests: 1, TestTimeout: tt.timeout})
+
+			release := make(chan struct{})
+			defer close(release)
+			start := time.Now()
+			result := f.runCase("Timeouts", testCase{
+				name:    "slow",
+				enabled: true,
+				run: func(ctx context.Context) error {
+					select {
+					case <-time.After(tt.delay):
+					case <-release:
+					}
+					return tt.err
+				},
+			})
+
+			if result.Status != tt.want || result.TimedOut != tt.timedOut {
+				t.Errorf("status = %q, timed out %v, want %q, %v", result.Status, result.TimedOut, tt.want, tt.timedOut)
+			}
+			if tt.timedOut && time.Since(start) > time.Second {
+				t.Errorf("runCase waited %v for a case that timed out", time.Since(start))
+			}
+			if f.testResults["Timeouts/slow"] != result {
+				t.Error("result not recorded")
+			}
+		})
+	}
+}
+
+func TestTimedOutCaseContextCancelled(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{MaxConcurrentTests: 1, TestTimeout: 20 * time.Millisecond})
+
+	stopped := make(chan error, 1)
+	result := f.runCase("Timeouts", testCase{
+		name:    "waits",
+		enabled: true,
+		run: func(ctx context.Context) error {
+			<-ctx.Done()
+			stopped <- ctx.Err()
+			return ctx.Err()
+		},
+	})
+
+	if !result.TimedOut {
+		t.Fatalf("status = %q, want timeout", result.Status)
+	}
+	select {
+	case err := <-stopped:
+		if err != context.DeadlineExceeded {
+			t.Errorf("case context error = %v, want deadline exceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("case context was not cancelled at the timeout")
+	}
+}
+
+func TestTimedOutCaseDoesNotStopSuite(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{MaxConcurrentTests: 1, TestTimeout: 20 * time.Millisecond})
+
+	hang := make(chan struct{})
+	defer close(hang)
+	errs := f.runCases("Suite", []testCase{
+		{name: "hangs", enabled: true, run: func(ctx context.Context) error { <-hang; return nil }},
+		{name: "after", enabled: true, run: func(ctx context.Context) error { return nil }},
+	})
+
+	if len(errs) != 1 {
+		t.Fatalf("runCases returned %v, want one timeout", errs)
+	}
+	if got := f.testResults["Suite/after"]; got == nil || got.Status != "pass" {
+		t.Errorf("case after the timeout = %+v, want pass", got)
+	}
+
+	summary := f.computeSummary()
+	if summary.TimedOut != 1 || summary.Errored != 1 || summary.Failed != 0 || summary.ExitCode != 1 {
+		t.Errorf("summary = %s, exit %d", summary, summary.ExitCode)
+	}
+}
+
+func TestNativeMessagingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		timeout time.Duration
+		want    string
+		errHas  string
+	}{
+		{"replies", "ok", 10 * time.Second, "pass", ""},
+		{"wrong reply", "wrong", 10 * time.Second, "fail", "expected enabled=true, got false"},
+		{"crash", "crash", 10 * time.Second, "fail", "filter engine failed to load"},
+		{"hang", "hang", 100 * time.Millisecond, "fail", "timed out"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(fakeNativeHostEnv, tt.mode)
+			f := newTestFramework(t, &TestFrameworkConfig{NativeHostPath: os.Args[0]})
+			test := f.nativeIntegration.messagingTest
+			test.timeout = tt.timeout
+
+			result := runNativeMessagingTest(context.Background(), "Native Messaging", "test", test)
+			if result.Status != tt.want {
+				t.Fatalf("status = %q (%s), want %q", result.Status, result.Error, tt.want)
+			}
+			if !strings.Contains(result.Error, tt.errHas) {
+				t.Errorf("error = %q, want it to mention %q", result.Error, tt.errHas)
+			}
+			if tt.want == "pass" && len(result.Details) != len(test.testMessages) {
+				t.Errorf("recorded %d replies, want %d", len(result.Details), len(test.testMessages))
+			}
+		})
+	}
+}
+
+func TestNativeMessagingMissingHost(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{NativeHostPath: filepath.Join(t.TempDir(), "missing")})
+	result := runNativeMessagingTest(context.Background(), "Native Messaging", "test", f.nativeIntegration.messagingTest)
+	if result.Status != "fail" || !strings.Contains(result.Error, "native host not found") {
+		t.Errorf("result = %q: %s", result.Status, result.Error)
+	}
+}
+
+func TestNativeHostPathDefault(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	executable, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	if got := f.nativeHostPath(); filepath.Dir(got) != filepath.Dir(executable) {
+		t.Errorf("nativeHostPath = %q, want it next to %q", got, executable)
+	}
+}
+
+// recordKnownResults stores a fixed mix of case results, one per status,
+// plus a suite result that the summary must ignore
+func recordKnownResults(f *CrossPlatformTestFramework) {
+	results := []*TestResult{
+		{TestName: "Network Tests/connectivity", Suite: "Network Tests", Status: "pass", Duration: 1500 * time.Millisecond, Message: "all endpoints reachable"},
+		{TestName: "Network Tests/latency", Suite: "Network Tests", Status: "fail", Duration: 250 * time.Millisecond, Message: "p95 too high", Error: "p95 \"310ms\" over 200ms"},
+		{TestName: "Security Tests/code signing", Suite: "Security Tests", Status: "skip", Message: "unsigned build"},
+		{TestName: "System Tests/firewall #2", Suite: "System Tests", Status: "error", Error: "netsh missing"},
+		{TestName: "System Tests/dns", Suite: "System Tests", Status: "timeout", TimedOut: true, Duration: 30 * time.Second, Error: "exceeded test timeout of 30s"},
+		{TestName: "Network Tests", Status: "fail"},
+	}
+	for _, result := range results {
+		result.Platform = "linux"
+		f.testResults[result.TestName] = result
+	}
+	f.runStartTime = time.Now().Add(-time.Minute)
+}
+
+func TestCSVReport(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{ReportFormat: "csv"})
+	recordKnownResults(f)
+	if err := f.generateTestReport(); err != nil {
+		t.Fatalf("generateTestReport: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(f.config.OutputDirectory, "test-report.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("report is not valid CSV: %v", err)
+	}
+
+	want := [][]string{
+		{"name", "platform", "status", "duration", "message"},
+		{"Network Tests", "linux", "fail", "0.000", ""},
+		{"Network Tests/connectivity", "linux", "pass", "1.500", "all endpoints reachable"},
+		{"Network Tests/latency", "linux", "fail", "0.250", "p95 too high"},
+		{"Security Tests/code signing", "linux", "skip", "0.000", "unsigned build"},
+		{"System Tests/dns", "linux", "timeout", "30.000", ""},
+		{"System Tests/firewall #2", "linux", "error", "0.000", ""},
+	}
+	if len(rows) != len(want)+1 {
+		t.Fatalf("got %d rows, want %d plus the summary: %q", len(rows), len(want), rows)
+	}
+	for i, row := range want {
+		if strings.Join(rows[i], "|") != strings.Join(row, "|") {
+			t.Errorf("row %d = %q, want %q", i, rows[i], row)
+		}
+	}
+	if summary := rows[len(rows)-1]; summary[0] != "SUMMARY" || summary[2] != "fail" {
+		t.Errorf("summary row = %q", summary)
+	}
+}
+
+func TestTAPReport(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{ReportFormat: "tap"})
+	recordKnownResults(f)
+	if err := f.generateTestReport(); err != nil {
+		t.Fatalf("generateTestReport: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(f.config.OutputDirectory, "test-report.tap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines[0] != "TAP version 13" || lines[1] != "1..6" {
+		t.Fatalf("header = %q, want version 13 and plan 1..6", lines[:2])
+	}
+
+	testLine := regexp.MustCompile(`^(ok|not ok) (\d+) - ([^#]+?)( # SKIP .*)?$`)
+	var points []string
+	inYAML := false
+	for _, line := range lines[2:] {
+		switch {
+		case line == "  ---":
+			if inYAML || len(points) == 0 || !strings.HasPrefix(points[len(points)-1], "not ok") {
+				t.Errorf("YAML block not directly after a failing test: %q", points)
+			}
+			inYAML = true
+		case line == "  ...":
+			inYAML = false
+		case inYAML:
+			if !strings.HasPrefix(line, "  ") || !strings.Contains(line, ": ") {
+				t.Errorf("malformed YAML diagnostic %q", line)
+			}
+		case strings.HasPrefix(line, "# "):
+		default:
+			m := testLine.FindStringSubmatch(line)
+			if m == nil {
+				t.Errorf("malformed test line %q", line)
+				continue
+			}
+			if m[2] != fmt.Sprint(len(points)+1) {
+				t.Errorf("test %q numbered %s, want %d", m[3], m[2], len(points)+1)
+			}
+			points = append(points, m[1]+" "+m[3])
+		}
+	}
+	if inYAML {
+		t.Error("unterminated YAML block")
+	}
+
+	want := []string{
+		"not ok Network Tests",
+		"ok Network Tests/connectivity",
+		"not ok Network Tests/latency",
+		"ok Security Tests/code signing",
+		"not ok System Tests/dns",
+		"not ok System Tests/firewall 2",
+	}
+	if strings.Join(points, "\n") != strings.Join(want, "\n") {
+		t.Errorf("test points =\n%s\nwant\n%s", strings.Join(points, "\n"), strings.Join(want, "\n"))
+	}
+	if !strings.Contains(string(data), "ok 4 - Security Tests/code signing # SKIP unsigned build\n") {
+		t.Error("skipped test lacks the SKIP directive")
+	}
+	if !strings.Contains(string(data), `  error: "p95 \"310ms\" over 200ms"`) {
+		t.Error("failure diagnostics lack the quoted error")
+	}
+}
+
+func TestComputeSummary(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	recordKnownResults(f)
+
+	got := f.computeSummary()
+	want := TestSummary{Total: 5, Passed: 1, Failed: 1, Skipped: 1, Errored: 2, TimedOut: 1, ExitCode: 1}
+	got.Duration = 0
+	if *got != want {
+		t.Errorf("summary = %+v, want %+v", *got, want)
+	}
+}
+
+func TestSummaryInEveryReport(t *testing.T) {
+	tests := []struct {
+		format string
+		file   string
+		want   string
+	}{
+		{"json", "test-report.json", `"timedOut": 1`},
+		{"html", "test-report.html", "5 tests: 1 passed, 1 failed, 1 skipped, 2 errored (1 timed out)"},
+		{"xml", "test-report.xml", `tests="5" failures="1" errors="2" skipped="1"`},
+		{"csv", "test-report.csv", "5 tests: 1 passed, 1 failed, 1 skipped, 2 errored (1 timed out)"},
+		{"tap", "test-report.tap", "# tests 5\n# pass 1\n# fail 1\n# skip 1\n# error 2\n"},
+		{"text", "test-report.txt", "Summary: 5 tests: 1 passed, 1 failed, 1 skipped, 2 errored (1 timed out)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			f := newTestFramework(t, &TestFrameworkConfig{ReportFormat: tt.format})
+			recordKnownResults(f)
+			if err := f.generateTestReport(); err != nil {
+				t.Fatalf("generateTestReport: %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(f.config.OutputDirectory, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), tt.want) {
+				t.Errorf("report lacks %q:\n%s", tt.want, data)
+			}
+		})
+	}
+}
+
+func TestRunAllTestsExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   int
+	}{
+		{"all passed", "pass", 0},
+		{"skipped only", "skip", 0},
+		{"failed", "fail", 1},
+		{"errored", "error", 1},
+		{"timed out", "timeout", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every suite is disabled and connectivity, which always runs, has
+			// no endpoints, so the run adds only that passing case
+			f := newTestFramework(t, &TestFrameworkConfig{ReportFormat: "json"})
+			f.networkTester.connectivityTest.testEndpoints = nil
+			f.testResults["Suite/case"] = &TestResult{TestName: "Suite/case", Suite: "Suite", Status: tt.status}
+
+			code, err := f.RunAllTests()
+			if err != nil {
+				t.Fatalf("RunAllTests: %v", err)
+			}
+			if code != tt.want || f.summary.ExitCode != tt.want {
+				t.Errorf("exit code = %d (summary %d), want %d", code, f.summary.ExitCode, tt.want)
+			}
+			if f.summary.Total != 2 {
+				t.Errorf("summary counted %d cases, want 2", f.summary.Total)
+			}
+		})
+	}
+}
+
+// startTCPListener accepts and closes connections on a loopback port
+func startTCPListener(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// checkLatencies asserts count plausible samples that are not all identical
+func checkLatencies(t *testing.T, latencies []time.Duration, count int) {
+	t.Helper()
+	if len(latencies) != count {
+		t.Fatalf("got %d samples, want %d", len(latencies), count)
+	}
+	distinct := map[time.Duration]bool{}
+	for _, latency := range latencies {
+		if latency <= 0 || latency > time.Second {
+			t.Errorf("implausible loopback latency %v", latency)
+		}
+		distinct[latency] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("all %d samples are %v", count, latencies[0])
+	}
+}
+
+func TestMeasureLatencyLoopback(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	f.networkTester.latencyTest.packetSize = 56
+
+	// The port only matters when ICMP is not permitted and TCP timing is used
+	endpoint := TestEndpoint{Name: "loopback", Host: "127.0.0.1", Port: startTCPListener(t), Timeout: time.Second}
+	latencies, err := f.measureLatency(endpoint, 10)
+	if err != nil {
+		t.Fatalf("measureLatency: %v", err)
+	}
+	checkLatencies(t, latencies, 10)
+}
+
+func TestMeasureTCPConnectLatency(t *testing.T) {
+	latencies, err := measureTCPConnectLatency(net.IPv4(127, 0, 0, 1), startTCPListener(t), 10, time.Second)
+	if err != nil {
+		t.Fatalf("measureTCPConnectLatency: %v", err)
+	}
+	checkLatencies(t, latencies, 10)
+
+	// A port nothing listens on yields an error, not fabricated samples
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	if latencies, err := measureTCPConnectLatency(net.IPv4(127, 0, 0, 1), closed, 3, time.Second); err == nil {
+		t.Errorf("connects to a closed port returned %v", latencies)
+	}
+}
+
+// throughputChunk and throughputPause pace the fake download server so a
+// transfer takes a predictable minimum time
+const (
+	throughputChunk = 16 * 1024
+	throughputPause = 5 * time.Millisecond
+)
+
+// startDownloadServer serves /__down?bytes=N with N bytes, paced in chunks.
+// short makes it send half of what was asked for.
+func startDownloadServer(t *testing.T, short bool) TestEndpoint {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/__down" {
+			http.NotFound(w, r)
+			return
+		}
+		size, err := strconv.Atoi(r.URL.Query().Get("bytes"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if short {
+			size /= 2
+		}
+		chunk := make([]byte, throughputChunk)
+		for size > 0 {
+			time.Sleep(throughputPause)
+			n := min(size, len(chunk))
+			w.Write(chunk[:n])
+			w.(http.Flusher).Flush()
+			size -= n
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return TestEndpoint{Name: "local", Host: u.Hostname(), Port: port, Path: "/__down?bytes={size}", Timeout: 10 * time.Second}
+}
+
+func TestMeasureThroughput(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	endpoint := startDownloadServer(t, false)
+
+	for _, size := range []int64{throughputChunk, 4 * throughputChunk, 16 * throughputChunk} {
+		throughput, err := f.measureThroughput(endpoint, size)
+		if err != nil {
+			t.Fatalf("measureThroughput(%d): %v", size, err)
+		}
+
+		// The server pauses before every chunk, which caps the rate
+		chunks := (size + throughputChunk - 1) / throughputChunk
+		ceiling := float64(size) / (time.Duration(chunks) * throughputPause).Seconds()
+		if throughput <= 0 || float64(throughput) > ceiling {
+			t.Errorf("throughput for %d bytes = %d bytes/sec, want (0, %.0f]", size, throughput, ceiling)
+		}
+	}
+}
+
+func TestMeasureThroughputErrors(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+
+	missing := startDownloadServer(t, false)
+	missing.Path = "/missing"
+	short := startDownloadServer(t, true)
+
+	// Start every server before closing the listener so none reuses its port
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := TestEndpoint{Name: "closed", Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, Path: "/", Timeout: time.Second}
+	ln.Close()
+
+	tests := []struct {
+		name     string
+		endpoint TestEndpoint
+		errHas   string
+	}{
+		{"not found", missing, "404"},
+		{"short transfer", short, "short transfer"},
+		{"refused", closed, "request to"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throughput, err := f.measureThroughput(tt.endpoint, 4*throughputChunk)
+			if err == nil || !strings.Contains(err.Error(), tt.errHas) {
+				t.Errorf("measureThroughput = %d, %v, want an error mentioning %q", throughput, err, tt.errHas)
+			}
+		})
+	}
+}
+
+func TestNetworkThroughputEverySize(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	var requested []string
+	endpoint := startDownloadServer(t, false)
+	f.networkTester.throughputTest.endpoints = []TestEndpoint{endpoint}
+	f.networkTester.throughputTest.testSizes = []int64{1024, 10240}
+	f.logger = log.New(&logRecorder{lines: &requested}, "", 0)
+
+	if err := f.testNetworkThroughput(context.Background()); err != nil {
+		t.Fatalf("testNetworkThroughput: %v", err)
+	}
+	for _, size := range []string{"(1024 bytes)", "(10240 bytes)"} {
+		if !strings.Contains(strings.Join(requested, ""), size) {
+			t.Errorf("no throughput reported for %s: %q", size, requested)
+		}
+	}
+}
+
+// logRecorder collects the lines written to a logger
+type logRecorder struct {
+	lines *[]string
+}
+
+func (r *logRecorder) Write(p []byte) (int, error) {
+	*r.lines = append(*r.lines, string(p))
+	return len(p), nil
+}
+
+func TestMemoryUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxMB  int64
+		leak   int // bytes retained per workload call
+		hold   int // bytes retained once, before the run
+		errHas string
+	}{
+		{"steady", 512, 0, 0, ""},
+		{"leaking", 512, 256 * 1024, 0, "possible leak"},
+		{"over limit", 1, 0, 8 * 1024 * 1024, "exceeds limit of 1 MB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFramework(t, &TestFrameworkConfig{})
+
+			retained := [][]byte{make([]byte, tt.hold)}
+			for i := range retained[0] {
+				retained[0][i] = byte(i)
+			}
+			var sink []byte
+			test := f.performanceTester.resourceTest
+			test.maxMemoryMB = tt.maxMB
+			test.monitorDuration = 300 * time.Millisecond
+			test.samples = 6
+			test.workload = func() error {
+				// Garbage every call, and what leaks stays reachable
+				sink = make([]byte, 64*1024)
+				if tt.leak > 0 {
+					retained = append(retained, make([]byte, tt.leak))
+				}
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			}
+
+			var metrics TestMetrics
+			err := f.testMemoryUsage(&metrics)
+			if tt.errHas == "" && err != nil {
+				t.Errorf("testMemoryUsage: %v", err)
+			}
+			if tt.errHas != "" && (err == nil || !strings.Contains(err.Error(), tt.errHas)) {
+				t.Errorf("testMemoryUsage = %v, want an error mentioning %q", err, tt.errHas)
+			}
+			if metrics.MemoryUsage <= 0 || metrics.PeakMemory < metrics.MemoryUsage {
+				t.Errorf("metrics final %d, peak %d", metrics.MemoryUsage, metrics.PeakMemory)
+			}
+			if tt.hold > 0 && metrics.MemoryUsage < int64(tt.hold) {
+				t.Errorf("final heap %d excludes the %d bytes held", metrics.MemoryUsage, tt.hold)
+			}
+			_ = sink
+			_ = retained
+		})
+	}
+}
+
+func TestMemoryUsageWorkloadFailure(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	test := f.performanceTester.resourceTest
+	test.monitorDuration = 10 * time.Millisecond
+	test.workload = func() error { return fmt.Errorf("proxy unreachable") }
+
+	if err := f.testMemoryUsage(&TestMetrics{}); err == nil || !strings.Contains(err.Error(), "proxy unreachable") {
+		t.Errorf("testMemoryUsage = %v, want the workload error", err)
+	}
+}
+
+func TestHeapKeepsGrowing(t *testing.T) {
+	tests := []struct {
+		name string
+		heap []uint64
+		want bool
+	}{
+		{"too few samples", []uint64{100, 200, 300}, false},
+		{"flat", []uint64{100, 100, 100, 100}, false},
+		{"wobble", []uint64{100, 104, 99, 103, 101}, false},
+		{"one dip", []uint64{100, 150, 140, 200, 250}, false},
+		{"slow creep", []uint64{1000, 1001, 1002, 1003, 1004}, false},
+		{"steady growth", []uint64{100, 120, 140, 160, 180}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := heapKeepsGrowing(tt.heap); got != tt.want {
+				t.Errorf("heapKeepsGrowing(%v) = %v, want %v", tt.heap, got, tt.want)
+			}
+		})
+	}
+}
+
+// startLoadTarget serves requests, failing every failEvery-th with a 500 and
+// holding each for delay. It counts requests and the peak in flight.
+func startLoadTarget(t *testing.T, failEvery int64, delay time.Duration) (string, *atomic.Int64, *concurrencyProbe) {
+	t.Helper()
+	var count atomic.Int64
+	var probe concurrencyProbe
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probe.enter()
+		defer probe.leave()
+		n := count.Add(1)
+		time.Sleep(delay)
+		if failEvery > 0 && n%failEvery == 0 {
+			http.Error(w, "overloaded", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, &count, &probe
+}
+
+func TestRunLoadScenario(t *testing.T) {
+	target, count, probe := startLoadTarget(t, 0, time.Millisecond)
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	test := f.performanceTester.loadTest
+	test.concurrentUsers = 4
+	test.testDuration = 30 * time.Second
+	test.rampUpTime = 20 * time.Millisecond
+
+	var metrics TestMetrics
+	scenario := LoadScenario{Name: "local", Requests: 200, Concurrent: 16, Target: target}
+	if err := f.runLoadScenario(context.Background(), scenario, &metrics); err != nil {
+		t.Fatalf("runLoadScenario: %v", err)
+	}
+
+	if got := count.Load(); got != 200 {
+		t.Errorf("server saw %d requests, want 200", got)
+	}
+	if peak := probe.peak.Load(); peak > 4 {
+		t.Errorf("%d requests in flight, concurrentUsers caps workers at 4", peak)
+	}
+	if metrics.RequestsSent != 200 || metrics.ErrorRate != 0 || metrics.Throughput <= 0 {
+		t.Errorf("sent %d, error rate %v, throughput %d", metrics.RequestsSent, metrics.ErrorRate, metrics.Throughput)
+	}
+	if metrics.ResponseTime <= 0 || metrics.ResponseTimeP50 <= 0 ||
+		metrics.ResponseTimeP50 > metrics.ResponseTimeP95 || metrics.ResponseTimeP95 > metrics.ResponseTimeP99 {
+		t.Errorf("latencies mean %v, p50 %v, p95 %v, p99 %v",
+			metrics.ResponseTime, metrics.ResponseTimeP50, metrics.ResponseTimeP95, metrics.ResponseTimeP99)
+	}
+}
+
+func TestRunLoadScenarioErrorRate(t *testing.T) {
+	target, _, _ := startLoadTarget(t, 2, 0)
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	test := f.performanceTester.loadTest
+	test.testDuration = 30 * time.Second
+	test.rampUpTime = 0
+
+	var metrics TestMetrics
+	err := f.runLoadScenario(context.Background(), LoadScenario{Name: "failing", Requests: 100, Concurrent: 4, Target: target}, &metrics)
+	if err == nil || !strings.Contains(err.Error(), "error rate") {
+		t.Errorf("runLoadScenario = %v, want the error rate exceeded", err)
+	}
+	if metrics.RequestsSent != 100 || metrics.ErrorRate != 0.5 {
+		t.Errorf("sent %d, error rate %v, want 100 and 0.5", metrics.RequestsSent, metrics.ErrorRate)
+	}
+}
+
+func TestRunLoadScenarioStopsAtTestDuration(t *testing.T) {
+	target, count, _ := startLoadTarget(t, 0, 20*time.Millisecond)
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	test := f.performanceTester.loadTest
+	test.testDuration = 200 * time.Millisecond
+	test.rampUpTime = time.Minute
+
+	start := time.Now()
+	var metrics TestMetrics
+	if err := f.runLoadScenario(context.Background(), LoadScenario{Name: "long", Requests: 100000, Concurrent: 4, Target: target}, &metrics); err != nil {
+		t.Fatalf("runLoadScenario: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("scenario ran %v past a 200ms test duration", elapsed)
+	}
+	// The ramp-up is longer than the run, so only the first worker starts
+	if got := count.Load(); got == 0 || got > 11 {
+		t.Errorf("server saw %d requests from one worker in 200ms", got)
+	}
+	if metrics.ErrorRate != 0 {
+		t.Errorf("requests cut off by the deadline counted as errors: %v", metrics.ErrorRate)
+	}
+}
+
+func TestRunLoadScenarioUnsupportedTarget(t *testing.T) {
+	f := newTestFramework(t, &TestFrameworkConfig{})
+	var metrics TestMetrics
+	if err := f.runLoadScenario(context.Background(), LoadScenario{Name: "dns", Requests: 10, Concurrent: 1, Target: "dns://localhost:53"}, &metrics); err != nil {
+		t.Errorf("runLoadScenario = %v, want the scenario skipped", err)
+	}
+	if metrics.RequestsSent != 0 {
+		t.Errorf("sent %d requests to an unsupported target", metrics.RequestsSent)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	tests := []struct {
+		samples []time.Duration
+		p       int
+		want    time.Duration
+	}{
+		{sorted, 50, 50 * time.Millisecond},
+		{sorted, 95, 95 * time.Millisecond},
+		{sorted, 99, 99 * time.Millisecond},
+		{sorted, 100, 100 * time.Millisecond},
+		{sorted[:1], 50, time.Millisecond},
+		{sorted[:3], 50, 2 * time.Millisecond},
+		{sorted[:3], 0, time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := percentile(tt.samples, tt.p); got != tt.want {
+			t.Errorf("percentile(%d samples, %d) = %v, want %v", len(tt.samples), tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1039 @@
+/**
+ * OblivionFilter v2.0.0 - Linux Native Integration
+ * 
+ * Provides native Linux system integration for OblivionFilter:
+ * - systemd user/system service management
+ * - System proxy configuration via GNOME gsettings
+ * - DNS redirection to the local filter via NetworkManager or systemd-resolved
+ * - Native messaging host registration for Chromium-based browsers and Firefox
+ * 
+ * @version 2.0.0
+ * @author OblivionFilter Development Team
+ * @license GPL-3.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Linux Native Integration Manager
+type LinuxNativeManager struct {
+	serviceName    string
+	installPath    string
+	stateDir       string
+	unitPath       string
+	userUnit       bool // systemctl --user unit rather than a system unit
+	logger         *log.Logger
+	proxyConfig    *LinuxProxyConfig
+	dnsConfig      *LinuxDNSConfig
+	browserManager *LinuxBrowserManager
+	proxyStatePath string
+	dnsStatePath   string
+	runCommand     func(name string, args ...string) ([]byte, error)
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// Linux Proxy Configuration
+type LinuxProxyConfig struct {
+	Enabled       bool     `json:"enabled"`
+	HTTPProxy     string   `json:"httpProxy"`
+	HTTPSProxy    string   `json:"httpsProxy"`
+	SOCKSProxy    string   `json:"socksProxy"`
+	Port          int      `json:"port"`
+	IgnoreHosts   []string `json:"ignoreHosts"`
+	AutoConfigURL string   `json:"autoConfigURL"` // when set, GNOME uses this PAC URL instead of manual proxies
+	PACFile       string   `json:"pacFile"`
+}
+
+// Linux DNS Configuration
+type LinuxDNSConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Server     string `json:"server"`     // address of the local DNS filter
+	DropInPath string `json:"dropInPath"` // systemd-resolved drop-in written when NetworkManager is not running
+}
+
+// Resolver managers SetupSystemDNS knows how to configure
+const (
+	dnsBackendNetworkManager = "networkmanager"
+	dnsBackendResolved       = "systemd-resolved"
+)
+
+// DNS settings captured before OblivionFilter changes them
+type LinuxDNSState struct {
+	Backend     string            `json:"backend"`
+	Connections []NMConnectionDNS `json:"connections,omitempty"`
+	SavedAt     time.Time         `json:"savedAt"`
+}
+
+// Original DNS properties of a NetworkManager connection
+type NMConnectionDNS struct {
+	Name       string            `json:"name"`
+	UUID       string            `json:"uuid"`
+	Device     string            `json:"device"`
+	Properties map[string]string `json:"properties"`
+}
+
+// NetworkManager properties SetupSystemDNS changes. Ignoring automatic IPv6
+// DNS keeps queries from bypassing the local filter over IPv6.
+var nmDNSProperties = []string{"ipv4.dns", "ipv4.ignore-auto-dns", "ipv6.ignore-auto-dns"}
+
+// GNOME proxy settings captured before OblivionFilter changes them, as
+// GVariant text keyed by "schema key"
+type LinuxProxyState struct {
+	Settings map[string]string `json:"settings"`
+	SavedAt  time.Time         `json:"savedAt"`
+}
+
+// A gsettings key that SetupSystemProxy may change
+type gnomeProxyKey struct {
+	Schema string
+	Key    string
+}
+
+var gnomeProxyKeys = []gnomeProxyKey{
+	{Schema: "org.gnome.system.proxy", Key: "mode"},
+	{Schema: "org.gnome.system.proxy", Key: "autoconfig-url"},
+	{Schema: "org.gnome.system.proxy", Key: "ignore-hosts"},
+	{Schema: "org.gnome.system.proxy.http", Key: "host"},
+	{Schema: "org.gnome.system.proxy.http", Key: "port"},
+	{Schema: "org.gnome.system.proxy.https", Key: "host"},
+	{Schema: "org.gnome.system.proxy.https", Key: "port"},
+	{Schema: "org.gnome.system.proxy.socks", Key: "host"},
+	{Schema: "org.gnome.system.proxy.socks", Key: "port"},
+}
+
+// Linux Browser Manager
+type LinuxBrowserManager struct {
+	supportedBrowsers []LinuxBrowserInfo
+	nativeHostPath    string
+}
+
+type LinuxBrowserInfo struct {
+	Name         string `json:"name"`
+	ManifestPath string `json:"manifestPath"`
+	Firefox      bool   `json:"firefox"` // Firefox manifests list extension IDs instead of origins
+	Supported    bool   `json:"supported"`
+}
+
+// systemd service unit
+type SystemdUnit struct {
+	Description      string
+	ExecStart        []string
+	WorkingDirectory string
+	Restart          string
+	Environment      map[string]string
+	WantedBy         string
+}
+
+// NewLinuxNativeManager creates a new Linux native integration manager
+func NewLinuxNativeManager() *LinuxNativeManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	
+	manager := &LinuxNativeManager{
+		serviceName: "oblivionfilter-native",
+		installPath: getInstallPath(),
+		userUnit:    os.Geteuid() != 0,
+		runCommand:  runLinuxCommand,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	
+	homeDir, _ := os.UserHomeDir()
+	if manager.userUnit {
+		manager.unitPath = filepath.Join(homeDir, ".config/systemd/user", manager.serviceName+".service")
+		manager.stateDir = filepath.Join(homeDir, ".local/state/oblivionfilter")
+	} else {
+		manager.unitPath = filepath.Join("/etc/systemd/system", manager.serviceName+".service")
+		manager.stateDir = "/var/lib/oblivionfilter"
+	}
+	manager.proxyStatePath = filepath.Join(manager.stateDir, "proxy_state.json")
+	manager.dnsStatePath = filepath.Join(manager.stateDir, "dns_state.json")
+	
+	// Initialize logger
+	manager.initLogger()
+	
+	// Initialize components
+	manager.initProxyConfig()
+	manager.initDNSConfig()
+	manager.initBrowserManager()
+	
+	return manager
+}
+
+// Initialize logger
+func (l *LinuxNativeManager) initLogger() {
+	// journald captures stdout for systemd units
+	l.logger = log.New(os.Stdout, "[OblivionFilter] ", log.LstdFlags|log.Lshortfile)
+}
+
+// Initialize proxy configuration
+func (l *LinuxNativeManager) initProxyConfig() {
+	l.proxyConfig = &LinuxProxyConfig{
+		Enabled:     false,
+		HTTPProxy:   "127.0.0.1",
+		HTTPSProxy:  "127.0.0.1",
+		SOCKSProxy:  "127.0.0.1",
+		Port:        8080,
+		IgnoreHosts: []string{"localhost", "127.0.0.0/8", "::1", "*.local"},
+		PACFile:     filepath.Join(l.installPath, "proxy.pac"),
+	}
+}
+
+// Initialize DNS configuration
+func (l *LinuxNativeManager) initDNSConfig() {
+	l.dnsConfig = &LinuxDNSConfig{
+		Enabled:    false,
+		Server:     "127.0.0.1",
+		DropInPath: "/etc/systemd/resolved.conf.d/oblivionfilter.conf",
+	}
+}
+
+// Initialize browser manager
+func (l *LinuxNativeManager) initBrowserManager() {
+	homeDir, _ := os.UserHomeDir()
+	
+	l.browserManager = &LinuxBrowserManager{
+		nativeHostPath: filepath.Join(l.installPath, "native_host"),
+		supportedBrowsers: []LinuxBrowserInfo{
+			{
+				Name:         "Chrome",
+				ManifestPath: filepath.Join(homeDir, ".config/google-chrome/NativeMessagingHosts"),
+				Supported:    true,
+			},
+			{
+				Name:         "Chromium",
+				ManifestPath: filepath.Join(homeDir, ".config/chromium/NativeMessagingHosts"),
+				Supported:    true,
+			},
+			{
+				Name:         "Brave",
+				ManifestPath: filepath.Join(homeDir, ".config/BraveSoftware/Brave-Browser/NativeMessagingHosts"),
+				Supported:    true,
+			},
+			{
+				Name:         "Edge",
+				ManifestPath: filepath.Join(homeDir, ".config/microsoft-edge/NativeMessagingHosts"),
+				Supported:    true,
+			},
+			{
+				Name:         "Firefox",
+				ManifestPath: filepath.Join(homeDir, ".mozilla/native-messaging-hosts"),
+				Firefox:      true,
+				Supported:    true,
+			},
+		},
+	}
+}
+
+// Install systemd service
+func (l *LinuxNativeManager) InstallService() error {
+	l.logger.Println("Installing systemd service...")
+	
+	unit := SystemdUnit{
+		Description: "OblivionFilter Native Service",
+		ExecStart: []string{
+			filepath.Join(l.installPath, "oblivion_native"),
+			"run",
+		},
+		WorkingDirectory: l.installPath,
+		Restart:          "on-failure",
+		Environment: map[string]string{
+			"PATH": "/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin",
+		},
+		WantedBy: "multi-user.target",
+	}
+	if l.userUnit {
+		unit.WantedBy = "default.target"
+	}
+	
+	// Ensure directory exists
+	err := os.MkdirAll(filepath.Dir(l.unitPath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create unit directory: %v", err)
+	}
+	
+	// Write unit file
+	err = os.WriteFile(l.unitPath, l.generateUnitFile(unit), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write unit file: %v", err)
+	}
+	
+	err = l.systemctl("daemon-reload")
+	if err != nil {
+		return err
+	}
+	
+	err = l.systemctl("enable", l.serviceName)
+	if err != nil {
+		return err
+	}
+	
+	l.logger.Println("systemd service installed successfully")
+	return nil
+}
+
+// Uninstall systemd service
+func (l *LinuxNativeManager) UninstallService() error {
+	l.logger.Println("Uninstalling systemd service...")
+	
+	// Disable and stop service
+	err := l.systemctl("disable", "--now", l.serviceName)
+	if err != nil {
+		l.logger.Printf("Failed to disable service: %v", err)
+	}
+	
+	// Remove unit file
+	err = os.Remove(l.unitPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove unit file: %v", err)
+	}
+	
+	err = l.systemctl("daemon-reload")
+	if err != nil {
+		l.logger.Printf("Failed to reload systemd: %v", err)
+	}
+	
+	l.logger.Println("systemd service uninstalled successfully")
+	return nil
+}
+
+// Start systemd service
+func (l *LinuxNativeManager) StartService() error {
+	err := l.systemctl("start", l.serviceName)
+	if err != nil {
+		return err
+	}
+	
+	l.logger.Println("systemd service started successfully")
+	return nil
+}
+
+// Stop systemd service
+func (l *LinuxNativeManager) StopService() error {
+	err := l.systemctl("stop", l.serviceName)
+	if err != nil {
+		return err
+	}
+	
+	l.logger.Println("systemd service stopped successfully")
+	return nil
+}
+
+// Run systemctl against the user or system manager
+func (l *LinuxNativeManager) systemctl(args ...string) error {
+	if l.userUnit {
+		args = append([]string{"--user"}, args...)
+	}
+	output, err := l.runCommand("systemctl", args...)
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %v, output: %s", strings.Join(args, " "), err, output)
+	}
+	return nil
+}
+
+// Run service
+func (l *LinuxNativeManager) RunService() error {
+	l.logger.Println("OblivionFilter Linux service started")
+	
+	// Setup system proxy
+	err := l.SetupSystemProxy()
+	if err != nil {
+		l.logger.Printf("Failed to setup system proxy: %v", err)
+	}
+	
+	// Route DNS through the local filter
+	if l.dnsConfig.Enabled {
+		err = l.SetupSystemDNS()
+		if err != nil {
+			l.logger.Printf("Failed to setup system DNS: %v", err)
+		}
+	}
+	
+	// Setup browser integration
+	err = l.SetupBrowserIntegration()
+	if err != nil {
+		l.logger.Printf("Failed to setup browser integration: %v", err)
+	}
+	
+	// systemd stops units with SIGTERM
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigChan)
+	
+	// Main service loop
+	for {
+		select {
+		case <-l.ctx.Done():
+			l.logger.Println("Service shutdown requested")
+			return l.cleanupSystem()
+		case sig := <-sigChan:
+			l.logger.Printf("Received %v, shutting down", sig)
+			return l.cleanupSystem()
+		case <-time.After(30 * time.Second):
+			// Periodic health check
+			l.performHealthCheck()
+		}
+	}
+}
+
+// Undo system proxy and DNS changes
+func (l *LinuxNativeManager) cleanupSystem() error {
+	proxyErr := l.CleanupSystemProxy()
+	
+	// A DNS snapshot may be left over from a run with DNS enabled
+	dnsErr := l.CleanupSystemDNS()
+	
+	if proxyErr != nil {
+		return proxyErr
+	}
+	return dnsErr
+}
+
+// Setup system proxy using gsettings
+func (l *LinuxNativeManager) SetupSystemProxy() error {
+	l.logger.Println("Setting up GNOME system proxy...")
+	
+	// Snapshot the current settings so cleanup can put them back
+	err := l.saveProxyState()
+	if err != nil {
+		return fmt.Errorf("failed to save current proxy settings: %v", err)
+	}
+	
+	var settings [][3]string
+	if l.proxyConfig.AutoConfigURL != "" {
+		settings = [][3]string{
+			{"org.gnome.system.proxy", "autoconfig-url", gvariantString(l.proxyConfig.AutoConfigURL)},
+			{"org.gnome.system.proxy", "mode", "'auto'"},
+		}
+	} else {
+		port := strconv.Itoa(l.proxyConfig.Port)
+		settings = [][3]string{
+			{"org.gnome.system.proxy.http", "host", gvariantString(l.proxyConfig.HTTPProxy)},
+			{"org.gnome.system.proxy.http", "port", port},
+			{"org.gnome.system.proxy.https", "host", gvariantString(l.proxyConfig.HTTPSProxy)},
+			{"org.gnome.system.proxy.https", "port", port},
+			{"org.gnome.system.proxy.socks", "host", gvariantString(l.proxyConfig.SOCKSProxy)},
+			{"org.gnome.system.proxy.socks", "port", strconv.Itoa(l.proxyConfig.Port + 1)},
+			{"org.gnome.system.proxy", "ignore-hosts", gvariantStringArray(l.proxyConfig.IgnoreHosts)},
+			{"org.gnome.system.proxy", "mode", "'manual'"},
+		}
+	}
+	
+	for _, setting := range settings {
+		err := l.gsettings("set", setting[0], setting[1], setting[2])
+		if err != nil {
+			return fmt.Errorf("failed to set %s %s: %v", setting[0], setting[1], err)
+		}
+	}
+	
+	l.logger.Printf("System proxy configured: %s:%d", l.proxyConfig.HTTPProxy, l.proxyConfig.Port)
+	return nil
+}
+
+// Cleanup system proxy
+func (l *LinuxNativeManager) CleanupSystemProxy() error {
+	l.logger.Println("Cleaning up GNOME system proxy...")
+	
+	state, err := l.loadProxyState()
+	if err == nil {
+		// Mode goes last so the proxy is never switched on with half-restored settings
+		for _, key := range gnomeProxyKeys {
+			if key.Key == "mode" {
+				continue
+			}
+			value, ok := state.Settings[key.Schema+" "+key.Key]
+			if !ok {
+				continue
+			}
+			err := l.gsettings("set", key.Schema, key.Key, value)
+			if err != nil {
+				return fmt.Errorf("failed to restore %s %s: %v", key.Schema, key.Key, err)
+			}
+		}
+		
+		mode, ok := state.Settings["org.gnome.system.proxy mode"]
+		if !ok {
+			mode = "'none'"
+		}
+		err := l.gsettings("set", "org.gnome.system.proxy", "mode", mode)
+		if err != nil {
+			return fmt.Errorf("failed to restore proxy mode: %v", err)
+		}
+		
+		os.Remove(l.proxyStatePath)
+		l.logger.Println("Restored original proxy settings")
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		l.logger.Printf("Failed to read saved proxy settings: %v", err)
+	}
+	
+	// Nothing saved; just turn the proxy off
+	err = l.gsettings("set", "org.gnome.system.proxy", "mode", "'none'")
+	if err != nil {
+		return fmt.Errorf("failed to disable proxy: %v", err)
+	}
+	
+	l.logger.Println("System proxy disabled")
+	return nil
+}
+
+// Save the current GNOME proxy settings. An existing snapshot is from a run
+// that did not clean up and still holds the user's original configuration.
+func (l *LinuxNativeManager) saveProxyState() error {
+	if _, err := os.Stat(l.proxyStatePath); err == nil {
+		l.logger.Println("Keeping existing proxy snapshot")
+		return nil
+	}
+	
+	state := LinuxProxyState{
+		Settings: make(map[string]string),
+		SavedAt:  time.Now(),
+	}
+	for _, key := range gnomeProxyKeys {
+		output, err := l.runCommand("gsettings", "get", key.Schema, key.Key)
+		if err != nil {
+			return fmt.Errorf("gsettings get %s %s failed: %v, output: %s", key.Schema, key.Key, err, output)
+		}
+		state.Settings[key.Schema+" "+key.Key] = strings.TrimSpace(string(output))
+	}
+	
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.proxyStatePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(l.proxyStatePath, data, 0600)
+}
+
+func (l *LinuxNativeManager) loadProxyState() (*LinuxProxyState, error) {
+	data, err := os.ReadFile(l.proxyStatePath)
+	if err != nil {
+		return nil, err
+	}
+	
+	var state LinuxProxyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid proxy state file: %v", err)
+	}
+	return &state, nil
+}
+
+// Run gsettings with the given arguments
+func (l *LinuxNativeManager) gsettings(args ...string) error {
+	output, err := l.runCommand("gsettings", args...)
+	if err != nil {
+		return fmt.Errorf("gsettings %s failed: %v, output: %s", args[0], err, output)
+	}
+	return nil
+}
+
+// Quote s as a GVariant string literal
+func gvariantString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// Format values as a GVariant string array literal
+func gvariantStringArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = gvariantString(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func runLinuxCommand(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// Point the system resolver at the local DNS filter through whichever
+// resolver manager is in use
+func (l *LinuxNativeManager) SetupSystemDNS() error {
+	l.logger.Println("Setting up system DNS...")
+	
+	backend, err := l.detectDNSBackend()
+	if err != nil {
+		return err
+	}
+	
+	switch backend {
+	case dnsBackendNetworkManager:
+		err = l.setupNetworkManagerDNS()
+	case dnsBackendResolved:
+		err = l.setupResolvedDNS()
+	}
+	if err != nil {
+		return err
+	}
+	
+	l.logger.Printf("System DNS configured via %s: %s", backend, l.dnsConfig.Server)
+	return nil
+}
+
+// Restore the DNS settings saved by SetupSystemDNS
+func (l *LinuxNativeManager) CleanupSystemDNS() error {
+	state, err := l.loadDNSState()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read saved DNS settings: %v", err)
+	}
+	
+	l.logger.Println("Cleaning up system DNS...")
+	
+	switch state.Backend {
+	case dnsBackendNetworkManager:
+		err = l.restoreNetworkManagerDNS(state)
+	case dnsBackendResolved:
+		err = l.restoreResolvedDNS()
+	default:
+		err = fmt.Errorf("unknown DNS backend: %s", state.Backend)
+	}
+	if err != nil {
+		return err
+	}
+	
+	os.Remove(l.dnsStatePath)
+	l.logger.Printf("Restored original DNS settings via %s", state.Backend)
+	return nil
+}
+
+// Detect the resolver manager. NetworkManager is preferred since it also
+// drives systemd-resolved when both are running.
+func (l *LinuxNativeManager) detectDNSBackend() (string, error) {
+	output, err := l.runCommand("nmcli", "-t", "-f", "RUNNING", "general")
+	if err == nil && strings.TrimSpace(string(output)) == "running" {
+		return dnsBackendNetworkManager, nil
+	}
+	
+	output, err = l.runCommand("systemctl", "is-active", "systemd-resolved")
+	if err == nil && strings.TrimSpace(string(output)) == "active" {
+		return dnsBackendResolved, nil
+	}
+	
+	return "", fmt.Errorf("no supported resolver manager found (need NetworkManager or systemd-resolved)")
+}
+
+// Set DNS on every active NetworkManager connection
+func (l *LinuxNativeManager) setupNetworkManagerDNS() error {
+	connections, err := l.activeNMConnections()
+	if err != nil {
+		return err
+	}
+	if len(connections) == 0 {
+		return fmt.Errorf("no active NetworkManager connections")
+	}
+	
+	state, err := l.loadDNSState()
+	if err != nil && !os.IsNotExist(err) {
+		l.logger.Printf("Discarding unreadable DNS snapshot: %v", err)
+	}
+	if err != nil || state.Backend != dnsBackendNetworkManager {
+		state = &LinuxDNSState{Backend: dnsBackendNetworkManager, SavedAt: time.Now()}
+	}
+	
+	// Snapshot connections not already saved by a run that did not clean up
+	saved := make(map[string]bool)
+	for _, conn := range state.Connections {
+		saved[conn.UUID] = true
+	}
+	for i := range connections {
+		if saved[connections[i].UUID] {
+			continue
+		}
+		properties, err := l.nmConnectionProperties(connections[i].UUID)
+		if err != nil {
+			return err
+		}
+		connections[i].Properties = properties
+		state.Connections = append(state.Connections, connections[i])
+	}
+	err = l.saveDNSState(state)
+	if err != nil {
+		return fmt.Errorf("failed to save current DNS settings: %v", err)
+	}
+	
+	for _, conn := range connections {
+		err := l.nmcli("connection", "modify", conn.UUID,
+			"ipv4.dns", l.dnsConfig.Server,
+			"ipv4.ignore-auto-dns", "yes",
+			"ipv6.ignore-auto-dns", "yes")
+		if err != nil {
+			return fmt.Errorf("failed to set DNS for %s: %v", conn.Name, err)
+		}
+		
+		// Apply without taking the connection down
+		err = l.nmcli("device", "reapply", conn.Device)
+		if err != nil {
+			l.logger.Printf("Failed to reapply %s: %v", conn.Device, err)
+		}
+	}
+	
+	return nil
+}
+
+// Put back the saved properties of each NetworkManager connection
+func (l *LinuxNativeManager) restoreNetworkManagerDNS(state *LinuxDNSState) error {
+	for _, conn := range state.Connections {
+		args := []string{"connection", "modify", conn.UUID}
+		for _, property := range nmDNSProperties {
+			value, ok := conn.Properties[property]
+			if !ok {
+				continue
+			}
+			args = append(args, property, value)
+		}
+		
+		err := l.nmcli(args...)
+		if err != nil {
+			return fmt.Errorf("failed to restore DNS for %s: %v", conn.Name, err)
+		}
+		
+		err = l.nmcli("device", "reapply", conn.Device)
+		if err != nil {
+			l.logger.Printf("Failed to reapply %s: %v", conn.Device, err)
+		}
+	}
+	return nil
+}
+
+// List active NetworkManager connections, skipping loopback
+func (l *LinuxNativeManager) activeNMConnections() ([]NMConnectionDNS, error) {
+	output, err := l.runCommand("nmcli", "-t", "-f", "NAME,UUID,TYPE,DEVICE", "connection", "show", "--active")
+	if err != nil {
+		return nil, fmt.Errorf("nmcli connection show failed: %v, output: %s", err, output)
+	}
+	
+	var connections []NMConnectionDNS
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := splitNMCLIFields(line)
+		if len(fields) != 4 || fields[2] == "loopback" {
+			continue
+		}
+		connections = append(connections, NMConnectionDNS{
+			Name:   fields[0],
+			UUID:   fields[1],
+			Device: fields[3],
+		})
+	}
+	return connections, nil
+}
+
+// Read the current DNS properties of a connection
+func (l *LinuxNativeManager) nmConnectionProperties(uuid string) (map[string]string, error) {
+	output, err := l.runCommand("nmcli", "-t", "-f", strings.Join(nmDNSProperties, ","), "connection", "show", uuid)
+	if err != nil {
+		return nil, fmt.Errorf("nmcli connection show %s failed: %v, output: %s", uuid, err, output)
+	}
+	
+	properties := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		properties[key] = value
+	}
+	return properties, nil
+}
+
+// Split a line of nmcli terse output, where ":" inside values is escaped as "\:"
+func splitNMCLIFields(line string) []string {
+	if line == "" {
+		return nil
+	}
+	
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// Write a systemd-resolved drop-in that sends all queries to the local filter
+func (l *LinuxNativeManager) setupResolvedDNS() error {
+	err := l.saveDNSState(&LinuxDNSState{Backend: dnsBackendResolved, SavedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to save current DNS settings: %v", err)
+	}
+	
+	// "~." makes this the default route for every domain
+	dropIn := fmt.Sprintf("# Managed by OblivionFilter\n[Resolve]\nDNS=%s\nDomains=~.\n", l.dnsConfig.Server)
+	
+	err = os.MkdirAll(filepath.Dir(l.dnsConfig.DropInPath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create drop-in directory: %v", err)
+	}
+	err = os.WriteFile(l.dnsConfig.DropInPath, []byte(dropIn), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write resolved drop-in: %v", err)
+	}
+	
+	return l.restartResolved()
+}
+
+// Remove the drop-in; resolved falls back to its own configuration
+func (l *LinuxNativeManager) restoreResolvedDNS() error {
+	err := os.Remove(l.dnsConfig.DropInPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove resolved drop-in: %v", err)
+	}
+	return l.restartResolved()
+}
+
+func (l *LinuxNativeManager) restartResolved() error {
+	output, err := l.runCommand("systemctl", "restart", "systemd-resolved")
+	if err != nil {
+		return fmt.Errorf("systemctl restart systemd-resolved failed: %v, output: %s", err, output)
+	}
+	return nil
+}
+
+func (l *LinuxNativeManager) saveDNSState(state *LinuxDNSState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.dnsStatePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(l.dnsStatePath, data, 0600)
+}
+
+func (l *LinuxNativeManager) loadDNSState() (*LinuxDNSState, error) {
+	data, err := os.ReadFile(l.dnsStatePath)
+	if err != nil {
+		return nil, err
+	}
+	
+	var state LinuxDNSState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid DNS state file: %v", err)
+	}
+	return &state, nil
+}
+
+// Run nmcli with the given arguments
+func (l *LinuxNativeManager) nmcli(args ...string) error {
+	output, err := l.runCommand("nmcli", args...)
+	if err != nil {
+		return fmt.Errorf("nmcli %s failed: %v, output: %s", strings.Join(args, " "), err, output)
+	}
+	return nil
+}
+
+// Setup browser integration
+func (l *LinuxNativeManager) SetupBrowserIntegration() error {
+	l.logger.Println("Setting up Linux browser integration...")
+	
+	for _, browser := range l.browserManager.supportedBrowsers {
+		if !browser.Supported {
+			continue
+		}
+		
+		err := l.setupBrowserNativeHost(browser)
+		if err != nil {
+			l.logger.Printf("Failed to setup native host for %s: %v", browser.Name, err)
+			continue
+		}
+		
+		l.logger.Printf("Native host configured for %s", browser.Name)
+	}
+	
+	return nil
+}
+
+// Remove native host manifests from every browser
+func (l *LinuxNativeManager) CleanupBrowserIntegration() error {
+	for _, browser := range l.browserManager.supportedBrowsers {
+		manifestFile := filepath.Join(browser.ManifestPath, "com.oblivionfilter.native.json")
+		err := os.Remove(manifestFile)
+		if err != nil && !os.IsNotExist(err) {
+			l.logger.Printf("Failed to remove native host for %s: %v", browser.Name, err)
+		}
+	}
+	return nil
+}
+
+// Setup native host for specific browser
+func (l *LinuxNativeManager) setupBrowserNativeHost(browser LinuxBrowserInfo) error {
+	manifestJSON, err := l.generateNativeHostManifest(browser)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	
+	// Write manifest file
+	err = os.MkdirAll(browser.ManifestPath, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest directory: %v", err)
+	}
+	
+	manifestFile := filepath.Join(browser.ManifestPath, "com.oblivionfilter.native.json")
+	err = os.WriteFile(manifestFile, manifestJSON, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest file: %v", err)
+	}
+	
+	return nil
+}
+
+// Generate the native messaging manifest for a browser
+func (l *LinuxNativeManager) generateNativeHostManifest(browser LinuxBrowserInfo) ([]byte, error) {
+	manifest := map[string]interface{}{
+		"name":        "com.oblivionfilter.native",
+		"description": "OblivionFilter Native Messaging Host",
+		"path":        l.browserManager.nativeHostPath,
+		"type":        "stdio",
+	}
+	if browser.Firefox {
+		manifest["allowed_extensions"] = []string{"oblivionfilter@oblivionfilter.org"}
+	} else {
+		manifest["allowed_origins"] = []string{"chrome-extension://oblivionfilter-extension-id/"}
+	}
+	
+	return json.MarshalIndent(manifest, "", "  ")
+}
+
+// Generate systemd unit file
+func (l *LinuxNativeManager) generateUnitFile(unit SystemdUnit) []byte {
+	var b strings.Builder
+	
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", unit.Description)
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n")
+	
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=simple\n")
+	
+	// systemd splits ExecStart on whitespace, so quote arguments that contain it
+	args := make([]string, len(unit.ExecStart))
+	for i, arg := range unit.ExecStart {
+		if strings.ContainsAny(arg, " \t\"") {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	
+	if unit.WorkingDirectory != "" {
+		fmt.Fprintf(&b, "WorkingDirectory=%s\n", unit.WorkingDirectory)
+	}
+	if unit.Restart != "" {
+		fmt.Fprintf(&b, "Restart=%s\n", unit.Restart)
+	}
+	
+	// Sorted for stable output
+	keys := make([]string, 0, len(unit.Environment))
+	for key := range unit.Environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "Environment=%s\n", strconv.Quote(key+"="+unit.Environment[key]))
+	}
+	
+	b.WriteString("\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=%s\n", unit.WantedBy)
+	
+	return []byte(b.String())
+}
+
+// Get installation path
+func getInstallPath() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "/opt/oblivionfilter"
+	}
+	return filepath.Dir(exe)
+}
+
+// Perform health check
+func (l *LinuxNativeManager) performHealthCheck() {
+	// Check if proxy is responsive
+	// Check if native host is running
+	// Check system resources
+	l.logger.Println("Health check completed")
+}
+
+// Main function for Linux native integration
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: linux_native [install|uninstall|start|stop|run]")
+		os.Exit(1)
+	}
+	
+	manager := NewLinuxNativeManager()
+	command := os.Args[1]
+	
+	switch command {
+	case "install":
+		err := manager.InstallService()
+		if err != nil {
+			log.Fatalf("Failed to install service: %v", err)
+		}
+		fmt.Println("Service installed successfully")
+	
+	case "uninstall":
+		err := manager.UninstallService()
+		if err != nil {
+			log.Fatalf("Failed to uninstall service: %v", err)
+		}
+		manager.CleanupBrowserIntegration()
+		fmt.Println("Service uninstalled successfully")
+	
+	case "start":
+		err := manager.StartService()
+		if err != nil {
+			log.Fatalf("Failed to start service: %v", err)
+		}
+		fmt.Println("Service started successfully")
+	
+	case "stop":
+		err := manager.StopService()
+		if err != nil {
+			log.Fatalf("Failed to stop service: %v", err)
+		}
+		fmt.Println("Service stopped successfully")
+	
+	case "run":
+		err := manager.RunService()
+		if err != nil {
+			log.Fatalf("Failed to run service: %v", err)
+		}
+	
+	default:
+		fmt.Printf("Unknown command: %s\n", command)
+		os.Exit(1)
+	}
+}
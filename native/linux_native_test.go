@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeLinuxCommands records commands and answers them from canned output keyed
+// by the start of the command line. Keys in failing make matching commands fail.
+type fakeLinuxCommands struct {
+	calls   []string
+	outputs map[string]string
+	failing map[string]bool
+}
+
+func (f *fakeLinuxCommands) run(name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.calls = append(f.calls, line)
+
+	// The longest matching prefix wins so specific answers override general ones
+	var output, matched string
+	for prefix, out := range f.outputs {
+		if strings.HasPrefix(line, prefix) && len(prefix) > len(matched) {
+			output, matched = out, prefix
+		}
+	}
+	for prefix := range f.failing {
+		if strings.HasPrefix(line, prefix) {
+			return []byte(output), fmt.Errorf("exit status 1")
+		}
+	}
+	return []byte(output), nil
+}
+
+func newTestLinuxManager(t *testing.T, commands *fakeLinuxCommands) *LinuxNativeManager {
+	t.Helper()
+	dir := t.TempDir()
+	l := &LinuxNativeManager{
+		serviceName:    "oblivionfilter-native",
+		installPath:    filepath.Join(dir, "opt"),
+		stateDir:       filepath.Join(dir, "state"),
+		unitPath:       filepath.Join(dir, "systemd", "oblivionfilter-native.service"),
+		userUnit:       true,
+		logger:         log.New(io.Discard, "", 0),
+		proxyStatePath: filepath.Join(dir, "state", "proxy_state.json"),
+		dnsStatePath:   filepath.Join(dir, "state", "dns_state.json"),
+		runCommand:     commands.run,
+	}
+	l.initProxyConfig()
+	l.initDNSConfig()
+	l.initBrowserManager()
+	for i := range l.browserManager.supportedBrowsers {
+		browser := &l.browserManager.supportedBrowsers[i]
+		browser.ManifestPath = filepath.Join(dir, "home", browser.Name, "NativeMessagingHosts")
+	}
+	return l
+}
+
+func TestLinuxGenerateUnitFile(t *testing.T) {
+	tests := []struct {
+		name string
+		unit SystemdUnit
+		want string
+	}{
+		{
+			name: "user unit",
+			unit: SystemdUnit{
+				Description:      "OblivionFilter Native Service",
+				ExecStart:        []string{"/opt/oblivion/oblivion_native", "run"},
+				WorkingDirectory: "/opt/oblivion",
+				Restart:          "on-failure",
+				Environment:      map[string]string{"PATH": "/usr/bin:/bin", "LANG": "C.UTF-8"},
+				WantedBy:         "default.target",
+			},
+			want: `[Unit]
+Description=OblivionFilter Native Service
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=/opt/oblivion/oblivion_native run
+WorkingDirectory=/opt/oblivion
+Restart=on-failure
+Environment="LANG=C.UTF-8"
+Environment="PATH=/usr/bin:/bin"
+
+[Install]
+WantedBy=default.target
+`,
+		},
+		{
+			name: "quoted arguments and optional fields omitted",
+			unit: SystemdUnit{
+				Description: "Test",
+				ExecStart:   []string{"/opt/Oblivion Filter/native", "--name", `say "hi"`},
+				WantedBy:    "multi-user.target",
+			},
+			want: `[Unit]
+Description=Test
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart="/opt/Oblivion Filter/native" --name "say \"hi\""
+
+[Install]
+WantedBy=multi-user.target
+`,
+		},
+	}
+
+	l := newTestLinuxManager(t, &fakeLinuxCommands{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(l.generateUnitFile(tt.unit)); got != tt.want {
+				t.Errorf("unit file =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinuxGenerateNativeHostManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		browser LinuxBrowserInfo
+		wantKey string
+		want    []string
+	}{
+		{"chromium", LinuxBrowserInfo{Name: "Chrome"}, "allowed_origins", []string{"chrome-extension://oblivionfilter-extension-id/"}},
+		{"firefox", LinuxBrowserInfo{Name: "Firefox", Firefox: true}, "allowed_extensions", []string{"oblivionfilter@oblivionfilter.org"}},
+	}
+
+	l := newTestLinuxManager(t, &fakeLinuxCommands{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := l.generateNativeHostManifest(tt.browser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var manifest map[string]interface{}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				t.Fatalf("manifest is not JSON: %v", err)
+			}
+
+			if manifest["name"] != "com.oblivionfilter.native" || manifest["type"] != "stdio" {
+				t.Errorf("name/type = %v/%v", manifest["name"], manifest["type"])
+			}
+			if manifest["path"] != l.browserManager.nativeHostPath {
+				t.Errorf("path = %v, want %s", manifest["path"], l.browserManager.nativeHostPath)
+			}
+			var got []string
+			for _, v := range manifest[tt.wantKey].([]interface{}) {
+				got = append(got, v.(string))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.wantKey, got, tt.want)
+			}
+			if len(manifest) != 5 {
+				t.Errorf("manifest has keys %v, want only one allow list", manifest)
+			}
+		})
+	}
+}
+
+func TestLinuxBrowserIntegration(t *testing.T) {
+	l := newTestLinuxManager(t, &fakeLinuxCommands{})
+	l.browserManager.supportedBrowsers[1].Supported = false
+
+	if err := l.SetupBrowserIntegration(); err != nil {
+		t.Fatal(err)
+	}
+	for i, browser := range l.browserManager.supportedBrowsers {
+		_, err := os.Stat(filepath.Join(browser.ManifestPath, "com.oblivionfilter.native.json"))
+		if installed := err == nil; installed != (i != 1) {
+			t.Errorf("%s manifest installed = %v", browser.Name, installed)
+		}
+	}
+
+	if err := l.CleanupBrowserIntegration(); err != nil {
+		t.Fatal(err)
+	}
+	for _, browser := range l.browserManager.supportedBrowsers {
+		if _, err := os.Stat(filepath.Join(browser.ManifestPath, "com.oblivionfilter.native.json")); !os.IsNotExist(err) {
+			t.Errorf("%s manifest left after cleanup", browser.Name)
+		}
+	}
+}
+
+func TestLinuxServiceCommands(t *testing.T) {
+	tests := []struct {
+		name         string
+		userUnit     bool
+		wantInstall  []string
+		wantWantedBy string
+	}{
+		{
+			name:         "user unit",
+			userUnit:     true,
+			wantInstall:  []string{"systemctl --user daemon-reload", "systemctl --user enable oblivionfilter-native"},
+			wantWantedBy: "WantedBy=default.target",
+		},
+		{
+			name:         "system unit",
+			wantInstall:  []string{"systemctl daemon-reload", "systemctl enable oblivionfilter-native"},
+			wantWantedBy: "WantedBy=multi-user.target",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := &fakeLinuxCommands{}
+			l := newTestLinuxManager(t, commands)
+			l.userUnit = tt.userUnit
+			prefix := "systemctl "
+			if tt.userUnit {
+				prefix += "--user "
+			}
+
+			if err := l.InstallService(); err != nil {
+				t.Fatalf("InstallService: %v", err)
+			}
+			if !reflect.DeepEqual(commands.calls, tt.wantInstall) {
+				t.Errorf("install commands = %q, want %q", commands.calls, tt.wantInstall)
+			}
+			unit, err := os.ReadFile(l.unitPath)
+			if err != nil {
+				t.Fatalf("unit file not written: %v", err)
+			}
+			if !strings.Contains(string(unit), tt.wantWantedBy) {
+				t.Errorf("unit file lacks %s:\n%s", tt.wantWantedBy, unit)
+			}
+
+			commands.calls = nil
+			l.StartService()
+			l.StopService()
+			if err := l.UninstallService(); err != nil {
+				t.Fatalf("UninstallService: %v", err)
+			}
+			want := []string{
+				prefix + "start oblivionfilter-native",
+				prefix + "stop oblivionfilter-native",
+				prefix + "disable --now oblivionfilter-native",
+				prefix + "daemon-reload",
+			}
+			if !reflect.DeepEqual(commands.calls, want) {
+				t.Errorf("commands = %q, want %q", commands.calls, want)
+			}
+			if _, err := os.Stat(l.unitPath); !os.IsNotExist(err) {
+				t.Error("unit file left after uninstall")
+			}
+		})
+	}
+}
+
+func TestLinuxSystemctlFailure(t *testing.T) {
+	commands := &fakeLinuxCommands{failing: map[string]bool{"systemctl --user enable": true}}
+	l := newTestLinuxManager(t, commands)
+	if err := l.InstallService(); err == nil || !strings.Contains(err.Error(), "enable") {
+		t.Errorf("InstallService = %v, want the enable failure", err)
+	}
+	if err := l.StartService(); err != nil {
+		t.Errorf("StartService: %v", err)
+	}
+}
+
+func TestLinuxNetworkManagerDNS(t *testing.T) {
+	commands := &fakeLinuxCommands{outputs: map[string]string{
+		"nmcli -t -f RUNNING general": "running\n",
+		"nmcli -t -f NAME,UUID,TYPE,DEVICE connection show --active": "Wired connection 1:uuid-1:802-3-ethernet:eth0\n" +
+			"lo:uuid-lo:loopback:lo\n" +
+			`Home\:5G:uuid-2:802-11-wireless:wlan0` + "\n",
+		"nmcli -t -f ipv4.dns,ipv4.ignore-auto-dns,ipv6.ignore-auto-dns connection show uuid-1": "ipv4.dns:\nipv4.ignore-auto-dns:no\nipv6.ignore-auto-dns:no\n",
+		"nmcli -t -f ipv4.dns,ipv4.ignore-auto-dns,ipv6.ignore-auto-dns connection show uuid-2": "ipv4.dns:1.1.1.1,9.9.9.9\nipv4.ignore-auto-dns:yes\nipv6.ignore-auto-dns:no\n",
+	}}
+	l := newTestLinuxManager(t, commands)
+
+	if err := l.SetupSystemDNS(); err != nil {
+		t.Fatalf("SetupSystemDNS: %v", err)
+	}
+	wantSetup := []string{
+		"nmcli -t -f RUNNING general",
+		"nmcli -t -f NAME,UUID,TYPE,DEVICE connection show --active",
+		"nmcli -t -f ipv4.dns,ipv4.ignore-auto-dns,ipv6.ignore-auto-dns connection show uuid-1",
+		"nmcli -t -f ipv4.dns,ipv4.ignore-auto-dns,ipv6.ignore-auto-dns connection show uuid-2",
+		"nmcli connection modify uuid-1 ipv4.dns 127.0.0.1 ipv4.ignore-auto-dns yes ipv6.ignore-auto-dns yes",
+		"nmcli device reapply eth0",
+		"nmcli connection modify uuid-2 ipv4.dns 127.0.0.1 ipv4.ignore-auto-dns yes ipv6.ignore-auto-dns yes",
+		"nmcli device reapply wlan0",
+	}
+	if !reflect.DeepEqual(commands.calls, wantSetup) {
+		t.Errorf("setup commands =\n%s\nwant\n%s", strings.Join(commands.calls, "\n"), strings.Join(wantSetup, "\n"))
+	}
+
+	// A second run must keep the original snapshot rather than our settings
+	commands.outputs["nmcli -t -f ipv4.dns,ipv4.ignore-auto-dns,ipv6.ignore-auto-dns connection show"] = "ipv4.dns:127.0.0.1\nipv4.ignore-auto-dns:yes\nipv6.ignore-auto-dns:yes\n"
+	delete(commands.outputs, "nmcli -t -f ipv4.dns,ipv4.ignore-auto-dns,ipv6.ignore-auto-dns connection show uuid-1")
+	delete(commands.outputs, "nmcli -t -f ipv4.dns,ipv4.ignore-auto-dns,ipv6.ignore-auto-dns connection show uuid-2")
+	if err := l.SetupSystemDNS(); err != nil {
+		t.Fatalf("second SetupSystemDNS: %v", err)
+	}
+
+	commands.calls = nil
+	if err := l.CleanupSystemDNS(); err != nil {
+		t.Fatalf("CleanupSystemDNS: %v", err)
+	}
+	// uuid-1 had no static DNS, so its value is empty
+	wantRestore := []string{
+		"nmcli connection modify uuid-1 ipv4.dns  ipv4.ignore-auto-dns no ipv6.ignore-auto-dns no",
+		"nmcli device reapply eth0",
+		"nmcli connection modify uuid-2 ipv4.dns 1.1.1.1,9.9.9.9 ipv4.ignore-auto-dns yes ipv6.ignore-auto-dns no",
+		"nmcli device reapply wlan0",
+	}
+	if !reflect.DeepEqual(commands.calls, wantRestore) {
+		t.Errorf("restore commands =\n%s\nwant\n%s", strings.Join(commands.calls, "\n"), strings.Join(wantRestore, "\n"))
+	}
+	if _, err := os.Stat(l.dnsStatePath); !os.IsNotExist(err) {
+		t.Error("DNS state left after cleanup")
+	}
+
+	commands.calls = nil
+	if err := l.CleanupSystemDNS(); err != nil || len(commands.calls) != 0 {
+		t.Errorf("cleanup without saved state = %v, ran %q", err, commands.calls)
+	}
+}
+
+func TestLinuxResolvedDNS(t *testing.T) {
+	commands := &fakeLinuxCommands{
+		outputs: map[string]string{"systemctl is-active systemd-resolved": "active\n"},
+		failing: map[string]bool{"nmcli": true},
+	}
+	l := newTestLinuxManager(t, commands)
+	l.dnsConfig.DropInPath = filepath.Join(t.TempDir(), "resolved.conf.d", "oblivionfilter.conf")
+
+	if err := l.SetupSystemDNS(); err != nil {
+		t.Fatalf("SetupSystemDNS: %v", err)
+	}
+	dropIn, err := os.ReadFile(l.dnsConfig.DropInPath)
+	if err != nil {
+		t.Fatalf("drop-in not written: %v", err)
+	}
+	if !strings.Contains(string(dropIn), "[Resolve]\nDNS=127.0.0.1\nDomains=~.\n") {
+		t.Errorf("drop-in =\n%s", dropIn)
+	}
+	if last := commands.calls[len(commands.calls)-1]; last != "systemctl restart systemd-resolved" {
+		t.Errorf("last setup command = %q, want resolved restarted", last)
+	}
+
+	commands.calls = nil
+	if err := l.CleanupSystemDNS(); err != nil {
+		t.Fatalf("CleanupSystemDNS: %v", err)
+	}
+	if _, err := os.Stat(l.dnsConfig.DropInPath); !os.IsNotExist(err) {
+		t.Error("drop-in left after cleanup")
+	}
+	if want := []string{"systemctl restart systemd-resolved"}; !reflect.DeepEqual(commands.calls, want) {
+		t.Errorf("cleanup commands = %q, want %q", commands.calls, want)
+	}
+}
+
+func TestLinuxDetectDNSBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		outputs map[string]string
+		failing map[string]bool
+		want    string
+	}{
+		{"networkmanager", map[string]string{"nmcli -t -f RUNNING general": "running\n", "systemctl is-active systemd-resolved": "active\n"}, nil, dnsBackendNetworkManager},
+		{"networkmanager stopped", map[string]string{"nmcli -t -f RUNNING general": "starting\n", "systemctl is-active systemd-resolved": "active\n"}, nil, dnsBackendResolved},
+		{"nmcli missing", map[string]string{"systemctl is-active systemd-resolved": "active\n"}, map[string]bool{"nmcli": true}, dnsBackendResolved},
+		{"neither", map[string]string{"systemctl is-active systemd-resolved": "inactive\n"}, map[string]bool{"nmcli": true, "systemctl": true}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLinuxManager(t, &fakeLinuxCommands{outputs: tt.outputs, failing: tt.failing})
+			got, err := l.detectDNSBackend()
+			if got != tt.want || (err != nil) != (tt.want == "") {
+				t.Errorf("detectDNSBackend = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
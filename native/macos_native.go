@@ -19,12 +19,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -40,6 +42,9 @@ type MacOSNativeManager struct {
 	browserManager  *MacOSBrowserManager
 	securityManager *MacOSSecurityManager
 	keychainManager *MacOSKeychainManager
+	proxyStatePath  string
+	runCommand      func(name string, args ...string) ([]byte, error)
+	outputCommand   func(name string, args ...string) ([]byte, error) // stdout only; stderr is in the *exec.ExitError
 	ctx             context.Context
 	cancel          context.CancelFunc
 }
@@ -52,9 +57,50 @@ type MacOSProxyConfig struct {
 	SOCKSProxy    string `json:"socksProxy"`
 	Port          int    `json:"port"`
 	Bypass        string `json:"bypass"`
-	AutoConfigURL string `json:"autoConfigURL"`
+	AutoConfigURL string `json:"autoConfigURL"` // when set, services use this PAC URL instead of manual proxies
 	PACFile       string `json:"pacFile"`
 	NetworkService string `json:"networkService"`
+	NetworkServices []string `json:"networkServices"` // services configured by SetupSystemProxy
+}
+
+// Proxy settings of every network service OblivionFilter modified
+type MacOSProxySnapshot struct {
+	Services []MacOSProxyState `json:"services"`
+	SavedAt  time.Time         `json:"savedAt"`
+}
+
+// Proxy settings of one network service before OblivionFilter changed them
+type MacOSProxyState struct {
+	NetworkService string                       `json:"networkService"`
+	Proxies        map[string]MacOSProxySetting `json:"proxies"` // by proxy kind
+	BypassDomains  []string                     `json:"bypassDomains"`
+	AutoProxy      MacOSAutoProxySetting        `json:"autoProxy"`
+}
+
+type MacOSAutoProxySetting struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url"`
+}
+
+type MacOSProxySetting struct {
+	Enabled       bool   `json:"enabled"`
+	Server        string `json:"server"`
+	Port          int    `json:"port"`
+	Authenticated bool   `json:"authenticated"`
+}
+
+// networksetup verbs for each proxy kind
+type macOSProxyKind struct {
+	Name      string
+	GetVerb   string
+	SetVerb   string
+	StateVerb string
+}
+
+var macOSProxyKinds = []macOSProxyKind{
+	{Name: "web", GetVerb: "-getwebproxy", SetVerb: "-setwebproxy", StateVerb: "-setwebproxystate"},
+	{Name: "secureweb", GetVerb: "-getsecurewebproxy", SetVerb: "-setsecurewebproxy", StateVerb: "-setsecurewebproxystate"},
+	{Name: "socks", GetVerb: "-getsocksfirewallproxy", SetVerb: "-setsocksfirewallproxy", StateVerb: "-setsocksfirewallproxystate"},
 }
 
 // macOS Browser Manager
@@ -94,6 +140,12 @@ type MacOSKeychainManager struct {
 	accountName  string
 }
 
+// ErrKeychainItemNotFound is returned when no OblivionFilter credentials are stored
+var ErrKeychainItemNotFound = errors.New("keychain item not found")
+
+// Exit status of the security tool when an item does not exist
+const securityItemNotFoundStatus = 44
+
 // LaunchAgent plist structure
 type LaunchAgent struct {
 	Label               string            `json:"Label"`
@@ -120,10 +172,14 @@ func NewMacOSNativeManager() *MacOSNativeManager {
 		bundleID:        "com.oblivionfilter.native",
 		installPath:     getInstallPath(),
 		launchAgentPath: filepath.Join(currentUser.HomeDir, "Library/LaunchAgents/com.oblivionfilter.native.plist"),
+		runCommand:      runMacOSCommand,
+		outputCommand:   runMacOSCommandOutput,
 		ctx:             ctx,
 		cancel:          cancel,
 	}
 	
+	manager.proxyStatePath = filepath.Join(manager.installPath, "proxy_state.json")
+	
 	// Initialize logger
 	manager.initLogger()
 	
@@ -387,19 +443,60 @@ func (m *MacOSNativeManager) RunService() error {
 	}
 }
 
-// Setup system proxy using networksetup
+// Setup system proxy using networksetup on every enabled network service
 func (m *MacOSNativeManager) SetupSystemProxy() error {
 	m.logger.Println("Setting up macOS system proxy...")
 	
-	// Detect network service
-	networkService, err := m.detectNetworkService()
+	// Detect network services
+	networkServices, err := m.detectNetworkServices()
+	if err != nil {
+		return fmt.Errorf("failed to detect network services: %v", err)
+	}
+	if len(networkServices) == 0 {
+		return fmt.Errorf("no enabled network services found")
+	}
+	m.proxyConfig.NetworkServices = networkServices
+	m.proxyConfig.NetworkService = networkServices[0]
+	
+	// Snapshot the current settings so cleanup can put them back
+	err = m.saveProxyState(networkServices)
 	if err != nil {
-		return fmt.Errorf("failed to detect network service: %v", err)
+		return fmt.Errorf("failed to save current proxy settings: %v", err)
+	}
+	
+	var failed []string
+	for _, networkService := range networkServices {
+		err := m.configureNetworkService(networkService)
+		if err != nil {
+			m.logger.Printf("Failed to configure proxy for %s: %v", networkService, err)
+			failed = append(failed, networkService)
+			continue
+		}
+		m.logger.Printf("System proxy configured for network service: %s", networkService)
+	}
+	
+	if len(failed) == len(networkServices) {
+		return fmt.Errorf("failed to configure proxy on any network service")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to configure proxy for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Point one network service at the local proxy
+func (m *MacOSNativeManager) configureNetworkService(networkService string) error {
+	// Use the PAC file instead of manual proxies when one is configured
+	if m.proxyConfig.AutoConfigURL != "" {
+		err := m.setAutoProxyURL(networkService)
+		if err != nil {
+			return fmt.Errorf("failed to set auto proxy URL: %v", err)
+		}
+		return nil
 	}
-	m.proxyConfig.NetworkService = networkService
 	
 	// Configure HTTP proxy
-	err = m.setHTTPProxy(networkService)
+	err := m.setHTTPProxy(networkService)
 	if err != nil {
 		return fmt.Errorf("failed to set HTTP proxy: %v", err)
 	}
@@ -422,83 +519,328 @@ func (m *MacOSNativeManager) SetupSystemProxy() error {
 		return fmt.Errorf("failed to set proxy bypass: %v", err)
 	}
 	
-	m.logger.Printf("System proxy configured for network service: %s", networkService)
 	return nil
 }
 
-// Detect active network service
-func (m *MacOSNativeManager) detectNetworkService() (string, error) {
-	cmd := exec.Command("networksetup", "-listnetworkserviceorder")
-	output, err := cmd.Output()
+// List enabled network services. In networksetup -listallnetworkservices output
+// the first line is a legend and disabled services are prefixed with "*".
+func (m *MacOSNativeManager) detectNetworkServices() ([]string, error) {
+	output, err := m.runCommand("networksetup", "-listallnetworkservices")
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%v, output: %s", err, output)
 	}
 	
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
+	var services []string
+	for _, line := range strings.Split(string(output), "\n") {
 		line = strings.TrimSpace(line)
-		if strings.Contains(line, "Wi-Fi") && strings.Contains(line, "(1)") {
-			return "Wi-Fi", nil
-		}
-		if strings.Contains(line, "Ethernet") && strings.Contains(line, "(1)") {
-			return "Ethernet", nil
+		if line == "" || strings.HasPrefix(line, "*") || strings.HasPrefix(line, "An asterisk") {
+			continue
 		}
+		services = append(services, line)
 	}
 	
-	return "Wi-Fi", nil // Default fallback
+	return services, nil
 }
 
 // Set HTTP proxy
 func (m *MacOSNativeManager) setHTTPProxy(networkService string) error {
-	cmd := exec.Command("networksetup", "-setwebproxy", networkService, 
+	return m.networksetup("-setwebproxy", networkService,
 		m.proxyConfig.HTTPProxy, fmt.Sprintf("%d", m.proxyConfig.Port))
-	return cmd.Run()
 }
 
 // Set HTTPS proxy
 func (m *MacOSNativeManager) setHTTPSProxy(networkService string) error {
-	cmd := exec.Command("networksetup", "-setsecurewebproxy", networkService,
+	return m.networksetup("-setsecurewebproxy", networkService,
 		m.proxyConfig.HTTPSProxy, fmt.Sprintf("%d", m.proxyConfig.Port))
-	return cmd.Run()
 }
 
 // Set SOCKS proxy
 func (m *MacOSNativeManager) setSOCKSProxy(networkService string) error {
-	cmd := exec.Command("networksetup", "-setsocksfirewallproxy", networkService,
+	return m.networksetup("-setsocksfirewallproxy", networkService,
 		m.proxyConfig.SOCKSProxy, fmt.Sprintf("%d", m.proxyConfig.Port+1))
-	return cmd.Run()
 }
 
 // Set proxy bypass
 func (m *MacOSNativeManager) setProxyBypass(networkService string) error {
 	bypassDomains := strings.Split(m.proxyConfig.Bypass, ", ")
 	args := append([]string{"-setproxybypassdomains", networkService}, bypassDomains...)
-	cmd := exec.Command("networksetup", args...)
-	return cmd.Run()
+	return m.networksetup(args...)
+}
+
+// Set auto proxy (PAC) URL and enable it
+func (m *MacOSNativeManager) setAutoProxyURL(networkService string) error {
+	err := m.networksetup("-setautoproxyurl", networkService, m.proxyConfig.AutoConfigURL)
+	if err != nil {
+		return err
+	}
+	return m.networksetup("-setautoproxystate", networkService, "on")
+}
+
+// Run networksetup with the given arguments
+func (m *MacOSNativeManager) networksetup(args ...string) error {
+	output, err := m.runCommand("networksetup", args...)
+	if err != nil {
+		return fmt.Errorf("networksetup %s failed: %v, output: %s", args[0], err, output)
+	}
+	return nil
+}
+
+func runMacOSCommand(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// Run a command whose standard output is its result, so warnings on stderr cannot end up in it
+func runMacOSCommandOutput(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+// Return what a command run through outputCommand printed to stderr before failing
+func commandStderr(err error) []byte {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Stderr
+	}
+	return nil
 }
 
 // Cleanup system proxy
 func (m *MacOSNativeManager) CleanupSystemProxy() error {
 	m.logger.Println("Cleaning up macOS system proxy...")
 	
-	networkService := m.proxyConfig.NetworkService
-	
-	// Disable HTTP proxy
-	cmd := exec.Command("networksetup", "-setwebproxystate", networkService, "off")
-	cmd.Run()
-	
-	// Disable HTTPS proxy
-	cmd = exec.Command("networksetup", "-setsecurewebproxystate", networkService, "off")
-	cmd.Run()
+	snapshot, err := m.loadProxyState()
+	if err == nil {
+		var failed []string
+		for i := range snapshot.Services {
+			state := &snapshot.Services[i]
+			err := m.restoreProxyState(state)
+			if err != nil {
+				m.logger.Printf("Failed to restore proxy settings for %s: %v", state.NetworkService, err)
+				failed = append(failed, state.NetworkService)
+				continue
+			}
+			m.logger.Printf("Restored original proxy settings for %s", state.NetworkService)
+		}
+		
+		// Keep the snapshot if anything failed so a later cleanup can retry
+		if len(failed) > 0 {
+			return fmt.Errorf("failed to restore proxy settings for: %s", strings.Join(failed, ", "))
+		}
+		os.Remove(m.proxyStatePath)
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		m.logger.Printf("Failed to read saved proxy settings: %v", err)
+	}
 	
-	// Disable SOCKS proxy
-	cmd = exec.Command("networksetup", "-setsocksfirewallproxystate", networkService, "off")
-	cmd.Run()
+	// Nothing saved; just turn our proxies off
+	networkServices := m.proxyConfig.NetworkServices
+	if len(networkServices) == 0 && m.proxyConfig.NetworkService != "" {
+		networkServices = []string{m.proxyConfig.NetworkService}
+	}
+	for _, networkService := range networkServices {
+		for _, kind := range macOSProxyKinds {
+			m.networksetup(kind.StateVerb, networkService, "off")
+		}
+		m.networksetup("-setautoproxystate", networkService, "off")
+	}
 	
 	m.logger.Println("System proxy disabled")
 	return nil
 }
 
+// Save the current proxy settings of each network service. Services already in
+// an existing snapshot are left alone: that snapshot is from a run that did not
+// clean up, so it still holds the user's original configuration.
+func (m *MacOSNativeManager) saveProxyState(networkServices []string) error {
+	snapshot, err := m.loadProxyState()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logger.Printf("Discarding unreadable proxy snapshot: %v", err)
+		}
+		snapshot = &MacOSProxySnapshot{SavedAt: time.Now()}
+	}
+	
+	saved := make(map[string]bool)
+	for _, state := range snapshot.Services {
+		saved[state.NetworkService] = true
+	}
+	
+	changed := false
+	for _, networkService := range networkServices {
+		if saved[networkService] {
+			m.logger.Printf("Keeping existing proxy snapshot for %s", networkService)
+			continue
+		}
+		
+		state, err := m.captureProxyState(networkService)
+		if err != nil {
+			return err
+		}
+		snapshot.Services = append(snapshot.Services, *state)
+		changed = true
+	}
+	
+	if !changed {
+		return nil
+	}
+	
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.proxyStatePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(m.proxyStatePath, data, 0600)
+}
+
+// Read the current proxy and bypass settings of a network service
+func (m *MacOSNativeManager) captureProxyState(networkService string) (*MacOSProxyState, error) {
+	state := &MacOSProxyState{
+		NetworkService: networkService,
+		Proxies:        make(map[string]MacOSProxySetting),
+	}
+	
+	for _, kind := range macOSProxyKinds {
+		output, err := m.runCommand("networksetup", kind.GetVerb, networkService)
+		if err != nil {
+			return nil, fmt.Errorf("networksetup %s failed: %v, output: %s", kind.GetVerb, err, output)
+		}
+		state.Proxies[kind.Name] = parseMacOSProxySetting(string(output))
+	}
+	
+	output, err := m.runCommand("networksetup", "-getproxybypassdomains", networkService)
+	if err != nil {
+		return nil, fmt.Errorf("networksetup -getproxybypassdomains failed: %v, output: %s", err, output)
+	}
+	state.BypassDomains = parseMacOSBypassDomains(string(output))
+	
+	output, err = m.runCommand("networksetup", "-getautoproxyurl", networkService)
+	if err != nil {
+		return nil, fmt.Errorf("networksetup -getautoproxyurl failed: %v, output: %s", err, output)
+	}
+	state.AutoProxy = parseMacOSAutoProxySetting(string(output))
+	
+	return state, nil
+}
+
+func (m *MacOSNativeManager) loadProxyState() (*MacOSProxySnapshot, error) {
+	data, err := os.ReadFile(m.proxyStatePath)
+	if err != nil {
+		return nil, err
+	}
+	
+	var snapshot MacOSProxySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid proxy state file: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// Apply a saved snapshot: server and port first, then the enabled state
+func (m *MacOSNativeManager) restoreProxyState(state *MacOSProxyState) error {
+	for _, kind := range macOSProxyKinds {
+		setting := state.Proxies[kind.Name]
+		if setting.Server != "" {
+			// Credentials of authenticated proxies are kept by the system and not re-sent here
+			err := m.networksetup(kind.SetVerb, state.NetworkService, setting.Server, strconv.Itoa(setting.Port))
+			if err != nil {
+				return err
+			}
+		}
+		
+		enabled := "off"
+		if setting.Enabled {
+			enabled = "on"
+		}
+		err := m.networksetup(kind.StateVerb, state.NetworkService, enabled)
+		if err != nil {
+			return err
+		}
+	}
+	
+	// Setting the URL enables auto proxy, so the state is applied afterwards
+	if state.AutoProxy.URL != "" {
+		err := m.networksetup("-setautoproxyurl", state.NetworkService, state.AutoProxy.URL)
+		if err != nil {
+			return err
+		}
+	}
+	autoProxy := "off"
+	if state.AutoProxy.Enabled {
+		autoProxy = "on"
+	}
+	err := m.networksetup("-setautoproxystate", state.NetworkService, autoProxy)
+	if err != nil {
+		return err
+	}
+	
+	bypass := state.BypassDomains
+	if len(bypass) == 0 {
+		bypass = []string{"Empty"}
+	}
+	return m.networksetup(append([]string{"-setproxybypassdomains", state.NetworkService}, bypass...)...)
+}
+
+// Parse "Enabled:/Server:/Port:" output of networksetup -getwebproxy and friends
+func parseMacOSProxySetting(output string) MacOSProxySetting {
+	var setting MacOSProxySetting
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		
+		switch strings.TrimSpace(key) {
+		case "Enabled":
+			setting.Enabled = value == "Yes"
+		case "Server":
+			setting.Server = value
+		case "Port":
+			setting.Port, _ = strconv.Atoi(value)
+		case "Authenticated Proxy Enabled":
+			setting.Authenticated = value == "1"
+		}
+	}
+	return setting
+}
+
+// Parse "URL:/Enabled:" output of networksetup -getautoproxyurl
+func parseMacOSAutoProxySetting(output string) MacOSAutoProxySetting {
+	var setting MacOSAutoProxySetting
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		
+		switch strings.TrimSpace(key) {
+		case "URL":
+			if value != "(null)" {
+				setting.URL = value
+			}
+		case "Enabled":
+			setting.Enabled = value == "Yes"
+		}
+	}
+	return setting
+}
+
+// Parse the output of networksetup -getproxybypassdomains, one domain per line
+func parseMacOSBypassDomains(output string) []string {
+	var domains []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "There aren't any bypass domains") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains
+}
+
 // Setup browser integration
 func (m *MacOSNativeManager) SetupBrowserIntegration() error {
 	m.logger.Println("Setting up macOS browser integration...")
@@ -580,13 +922,58 @@ func (m *MacOSNativeManager) storeKeychainCredentials() error {
 	token := "oblivion-native-" + fmt.Sprintf("%d", time.Now().Unix())
 	
 	// Store in keychain using security command
-	cmd := exec.Command("security", "add-generic-password",
+	output, err := m.runCommand("security", "add-generic-password",
 		"-s", m.keychainManager.serviceName,
 		"-a", m.keychainManager.accountName,
 		"-w", token,
 		"-U") // Update if exists
+	if err != nil {
+		return fmt.Errorf("security add-generic-password failed: %v, output: %s", err, output)
+	}
 	
-	return cmd.Run()
+	return nil
+}
+
+// Retrieve the stored token; returns ErrKeychainItemNotFound if none is stored
+func (m *MacOSNativeManager) RetrieveKeychainCredentials() (string, error) {
+	output, err := m.outputCommand("security", "find-generic-password",
+		"-s", m.keychainManager.serviceName,
+		"-a", m.keychainManager.accountName,
+		"-w")
+	if err != nil {
+		stderr := commandStderr(err)
+		if isKeychainItemNotFound(stderr, err) {
+			return "", ErrKeychainItemNotFound
+		}
+		return "", fmt.Errorf("security find-generic-password failed: %v, stderr: %s", err, stderr)
+	}
+	
+	// security prints the password followed by a single newline; anything before it is the password
+	return strings.TrimSuffix(string(output), "\n"), nil
+}
+
+// Delete the stored token; returns ErrKeychainItemNotFound if none is stored
+func (m *MacOSNativeManager) DeleteKeychainCredentials() error {
+	output, err := m.runCommand("security", "delete-generic-password",
+		"-s", m.keychainManager.serviceName,
+		"-a", m.keychainManager.accountName)
+	if err != nil {
+		if isKeychainItemNotFound(output, err) {
+			return ErrKeychainItemNotFound
+		}
+		return fmt.Errorf("security delete-generic-password failed: %v, output: %s", err, output)
+	}
+	
+	return nil
+}
+
+// Report whether a failed security command means the item does not exist
+func isKeychainItemNotFound(output []byte, err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFoundStatus {
+		return true
+	}
+	return strings.Contains(string(output), "could not be found in the keychain")
 }
 
 // Verify code signing
@@ -756,6 +1143,10 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to uninstall launch agent: %v", err)
 		}
+		err = manager.DeleteKeychainCredentials()
+		if err != nil && err != ErrKeychainItemNotFound {
+			log.Printf("Failed to delete keychain credentials: %v", err)
+		}
 		fmt.Println("Launch agent uninstalled successfully")
 		
 	case "start":
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeNetworksetup answers networksetup queries from canned output and records
+// every command that changes settings
+type fakeNetworksetup struct {
+	services string            // -listallnetworkservices output
+	outputs  map[string]string // "verb service" -> output of a -get command
+	failing  map[string]bool   // "verb service" of set commands that fail
+	sets     []string          // set commands run, as "verb service args..."
+	gets     []string          // get commands run, as "verb service"
+}
+
+func (f *fakeNetworksetup) run(name string, args ...string) ([]byte, error) {
+	if name != "networksetup" || len(args) == 0 {
+		return nil, fmt.Errorf("unexpected command %s %v", name, args)
+	}
+	if args[0] == "-listallnetworkservices" {
+		return []byte(f.services), nil
+	}
+
+	key := args[0] + " " + args[1]
+	if strings.HasPrefix(args[0], "-get") {
+		f.gets = append(f.gets, key)
+		if output, ok := f.outputs[key]; ok {
+			return []byte(output), nil
+		}
+		switch args[0] {
+		case "-getproxybypassdomains":
+			return []byte("There aren't any bypass domains set on " + args[1] + ".\n"), nil
+		case "-getautoproxyurl":
+			return []byte("URL: (null)\nEnabled: No\n"), nil
+		}
+		return []byte("Enabled: No\nServer: \nPort: 0\nAuthenticated Proxy Enabled: 0\n"), nil
+	}
+
+	f.sets = append(f.sets, strings.Join(args, " "))
+	if f.failing[key] {
+		return []byte("** Error: unable to commit changes"), fmt.Errorf("exit status 4")
+	}
+	return nil, nil
+}
+
+func newTestMacOSManager(t *testing.T, fake *fakeNetworksetup) *MacOSNativeManager {
+	t.Helper()
+	m := &MacOSNativeManager{
+		installPath:    t.TempDir(),
+		logger:         log.New(io.Discard, "", 0),
+		runCommand:     fake.run,
+		proxyStatePath: filepath.Join(t.TempDir(), "state", "proxy_state.json"),
+	}
+	m.initProxyConfig()
+	return m
+}
+
+const macOSServiceLegend = "An asterisk (*) denotes that a network service is disabled.\n"
+
+func TestMacOSProxySaveAndRestore(t *testing.T) {
+	tests := []struct {
+		name        string
+		outputs     map[string]string
+		wantRestore []string
+	}{
+		{
+			name: "user had a proxy",
+			outputs: map[string]string{
+				"-getwebproxy Wi-Fi":           "Enabled: Yes\nServer: corp.example.com\nPort: 3128\nAuthenticated Proxy Enabled: 0\n",
+				"-getsecurewebproxy Wi-Fi":     "Enabled: Yes\nServer: corp.example.com\nPort: 3129\nAuthenticated Proxy Enabled: 1\n",
+				"-getproxybypassdomains Wi-Fi": "*.local\n169.254/16\n",
+			},
+			wantRestore: []string{
+				"-setwebproxy Wi-Fi corp.example.com 3128",
+				"-setwebproxystate Wi-Fi on",
+				"-setsecurewebproxy Wi-Fi corp.example.com 3129",
+				"-setsecurewebproxystate Wi-Fi on",
+				"-setsocksfirewallproxystate Wi-Fi off",
+				"-setautoproxystate Wi-Fi off",
+				"-setproxybypassdomains Wi-Fi *.local 169.254/16",
+			},
+		},
+		{
+			name: "disabled proxy keeps its server",
+			outputs: map[string]string{
+				"-getsocksfirewallproxy Wi-Fi": "Enabled: No\nServer: socks.example.com\nPort: 1080\nAuthenticated Proxy Enabled: 0\n",
+			},
+			wantRestore: []string{
+				"-setwebproxystate Wi-Fi off",
+				"-setsecurewebproxystate Wi-Fi off",
+				"-setsocksfirewallproxy Wi-Fi socks.example.com 1080",
+				"-setsocksfirewallproxystate Wi-Fi off",
+				"-setautoproxystate Wi-Fi off",
+				"-setproxybypassdomains Wi-Fi Empty",
+			},
+		},
+		{
+			name: "pac url",
+			outputs: map[string]string{
+				"-getautoproxyurl Wi-Fi": "URL: http://wpad.example.com/proxy.pac\nEnabled: Yes\n",
+			},
+			wantRestore: []string{
+				"-setwebproxystate Wi-Fi off",
+				"-setsecurewebproxystate Wi-Fi off",
+				"-setsocksfirewallproxystate Wi-Fi off",
+				"-setautoproxyurl Wi-Fi http://wpad.example.com/proxy.pac",
+				"-setautoproxystate Wi-Fi on",
+				"-setproxybypassdomains Wi-Fi Empty",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeNetworksetup{services: macOSServiceLegend + "Wi-Fi\n", outputs: tt.outputs}
+			m := newTestMacOSManager(t, fake)
+
+			if err := m.SetupSystemProxy(); err != nil {
+				t.Fatalf("SetupSystemProxy: %v", err)
+			}
+			wantGets := []string{"-getwebproxy Wi-Fi", "-getsecurewebproxy Wi-Fi", "-getsocksfirewallproxy Wi-Fi", "-getproxybypassdomains Wi-Fi", "-getautoproxyurl Wi-Fi"}
+			if !reflect.DeepEqual(fake.gets, wantGets) {
+				t.Errorf("snapshot queries = %q, want %q", fake.gets, wantGets)
+			}
+			if len(fake.sets) == 0 || fake.sets[0] != "-setwebproxy Wi-Fi 127.0.0.1 8080" {
+				t.Errorf("setup commands = %q, want the local proxy configured", fake.sets)
+			}
+			if _, err := os.Stat(m.proxyStatePath); err != nil {
+				t.Fatalf("state file not written: %v", err)
+			}
+
+			fake.sets = nil
+			if err := m.CleanupSystemProxy(); err != nil {
+				t.Fatalf("CleanupSystemProxy: %v", err)
+			}
+			if !reflect.DeepEqual(fake.sets, tt.wantRestore) {
+				t.Errorf("restore commands =\n%s\nwant\n%s", strings.Join(fake.sets, "\n"), strings.Join(tt.wantRestore, "\n"))
+			}
+			if _, err := os.Stat(m.proxyStatePath); !os.IsNotExist(err) {
+				t.Errorf("state file left after a successful restore: %v", err)
+			}
+		})
+	}
+}
+
+func TestMacOSProxySnapshotSurvivesRepeatedSetup(t *testing.T) {
+	fake := &fakeNetworksetup{
+		services: macOSServiceLegend + "Wi-Fi\n",
+		outputs: map[string]string{
+			"-getwebproxy Wi-Fi": "Enabled: Yes\nServer: corp.example.com\nPort: 3128\n",
+		},
+	}
+	m := newTestMacOSManager(t, fake)
+	if err := m.SetupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run without cleanup sees our own proxy; it must not replace the
+	// snapshot of the user's original one
+	fake.outputs["-getwebproxy Wi-Fi"] = "Enabled: Yes\nServer: 127.0.0.1\nPort: 8080\n"
+	if err := m.SetupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.sets = nil
+	if err := m.CleanupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.sets) == 0 || fake.sets[0] != "-setwebproxy Wi-Fi corp.example.com 3128" {
+		t.Errorf("restore commands = %q, want the original proxy restored", fake.sets)
+	}
+}
+
+func TestMacOSProxyRestoreFailureKeepsSnapshot(t *testing.T) {
+	fake := &fakeNetworksetup{services: macOSServiceLegend + "Wi-Fi\n"}
+	m := newTestMacOSManager(t, fake)
+	if err := m.SetupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.failing = map[string]bool{"-setwebproxystate Wi-Fi": true}
+	if err := m.CleanupSystemProxy(); err == nil || !strings.Contains(err.Error(), "Wi-Fi") {
+		t.Errorf("CleanupSystemProxy = %v, want an error naming Wi-Fi", err)
+	}
+	if _, err := os.Stat(m.proxyStatePath); err != nil {
+		t.Errorf("snapshot removed after a failed restore: %v", err)
+	}
+}
+
+func TestMacOSCleanupWithoutSnapshot(t *testing.T) {
+	fake := &fakeNetworksetup{}
+	m := newTestMacOSManager(t, fake)
+	m.proxyConfig.NetworkServices = []string{"Wi-Fi"}
+
+	if err := m.CleanupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"-setwebproxystate Wi-Fi off",
+		"-setsecurewebproxystate Wi-Fi off",
+		"-setsocksfirewallproxystate Wi-Fi off",
+		"-setautoproxystate Wi-Fi off",
+	}
+	if !reflect.DeepEqual(fake.sets, want) {
+		t.Errorf("cleanup commands = %q, want %q", fake.sets, want)
+	}
+}
+
+func TestMacOSDetectNetworkServices(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{"single service", macOSServiceLegend + "Wi-Fi\n", []string{"Wi-Fi"}},
+		{"several active", macOSServiceLegend + "Wi-Fi\nEthernet\nUSB 10/100/1000 LAN\n", []string{"Wi-Fi", "Ethernet", "USB 10/100/1000 LAN"}},
+		{"disabled skipped", macOSServiceLegend + "*Bluetooth PAN\nEthernet\n*Thunderbolt Bridge\niPhone USB\n", []string{"Ethernet", "iPhone USB"}},
+		{"all disabled", macOSServiceLegend + "*Wi-Fi\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMacOSManager(t, &fakeNetworksetup{services: tt.list})
+			got, err := m.detectNetworkServices()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("detectNetworkServices = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMacOSSetupConfiguresEveryService(t *testing.T) {
+	tests := []struct {
+		name       string
+		failing    map[string]bool
+		wantErr    string
+		configured []string
+	}{
+		{"all succeed", nil, "", []string{"Wi-Fi", "Ethernet", "USB LAN"}},
+		{"one fails", map[string]bool{"-setwebproxy Ethernet": true}, "Ethernet", []string{"Wi-Fi", "USB LAN"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeNetworksetup{
+				services: macOSServiceLegend + "Wi-Fi\n*Bluetooth PAN\nEthernet\nUSB LAN\n",
+				outputs: map[string]string{
+					"-getwebproxy Ethernet": "Enabled: Yes\nServer: corp.example.com\nPort: 3128\n",
+				},
+				failing: tt.failing,
+			}
+			m := newTestMacOSManager(t, fake)
+
+			err := m.SetupSystemProxy()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("SetupSystemProxy: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("SetupSystemProxy = %v, want an error naming %s", err, tt.wantErr)
+			}
+
+			wantServices := []string{"Wi-Fi", "Ethernet", "USB LAN"}
+			if !reflect.DeepEqual(m.proxyConfig.NetworkServices, wantServices) {
+				t.Errorf("NetworkServices = %q, want %q", m.proxyConfig.NetworkServices, wantServices)
+			}
+			for _, service := range append(wantServices, "Bluetooth PAN") {
+				want := false
+				for _, configured := range tt.configured {
+					want = want || configured == service
+				}
+				got := false
+				for _, cmd := range fake.sets {
+					got = got || cmd == "-setproxybypassdomains "+service+" localhost 127.0.0.1 *.local"
+				}
+				if got != want {
+					t.Errorf("%s configured = %v, want %v", service, got, want)
+				}
+			}
+
+			// Every modified service, including the one that failed part-way, is restored
+			fake.sets, fake.failing = nil, nil
+			if err := m.CleanupSystemProxy(); err != nil {
+				t.Fatal(err)
+			}
+			for _, service := range wantServices {
+				restored := false
+				for _, cmd := range fake.sets {
+					restored = restored || strings.HasPrefix(cmd, "-setautoproxystate "+service+" ")
+				}
+				if !restored {
+					t.Errorf("%s not restored: %q", service, fake.sets)
+				}
+			}
+			if !strings.Contains(strings.Join(fake.sets, "\n"), "-setwebproxy Ethernet corp.example.com 3128") {
+				t.Errorf("Ethernet's original proxy not restored: %q", fake.sets)
+			}
+		})
+	}
+}
+
+func TestMacOSSetupWithoutEnabledServices(t *testing.T) {
+	fake := &fakeNetworksetup{services: macOSServiceLegend + "*Wi-Fi\n"}
+	m := newTestMacOSManager(t, fake)
+	if err := m.SetupSystemProxy(); err == nil {
+		t.Error("SetupSystemProxy succeeded with no enabled services")
+	}
+	if len(fake.sets) != 0 {
+		t.Errorf("ran %q with no enabled services", fake.sets)
+	}
+}
+
+func TestMacOSAutoProxyURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		wantSetup []string
+	}{
+		{
+			name: "pac url",
+			url:  "http://127.0.0.1:8080/proxy.pac",
+			wantSetup: []string{
+				"-setautoproxyurl Wi-Fi http://127.0.0.1:8080/proxy.pac",
+				"-setautoproxystate Wi-Fi on",
+			},
+		},
+		{
+			name: "manual proxies without a pac url",
+			wantSetup: []string{
+				"-setwebproxy Wi-Fi 127.0.0.1 8080",
+				"-setsecurewebproxy Wi-Fi 127.0.0.1 8080",
+				"-setsocksfirewallproxy Wi-Fi 127.0.0.1 8081",
+				"-setproxybypassdomains Wi-Fi localhost 127.0.0.1 *.local",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeNetworksetup{services: macOSServiceLegend + "Wi-Fi\n"}
+			m := newTestMacOSManager(t, fake)
+			m.proxyConfig.AutoConfigURL = tt.url
+
+			if err := m.SetupSystemProxy(); err != nil {
+				t.Fatalf("SetupSystemProxy: %v", err)
+			}
+			if !reflect.DeepEqual(fake.sets, tt.wantSetup) {
+				t.Errorf("setup commands = %q, want %q", fake.sets, tt.wantSetup)
+			}
+
+			// Auto proxy was off before, so cleanup turns it off again
+			fake.sets = nil
+			if err := m.CleanupSystemProxy(); err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, cmd := range fake.sets {
+				found = found || cmd == "-setautoproxystate Wi-Fi off"
+			}
+			if !found {
+				t.Errorf("cleanup commands = %q, want auto proxy turned off", fake.sets)
+			}
+		})
+	}
+}
+
+func TestMacOSAutoProxyURLFailure(t *testing.T) {
+	fake := &fakeNetworksetup{
+		services: macOSServiceLegend + "Wi-Fi\n",
+		failing:  map[string]bool{"-setautoproxyurl Wi-Fi": true},
+	}
+	m := newTestMacOSManager(t, fake)
+	m.proxyConfig.AutoConfigURL = "http://127.0.0.1:8080/proxy.pac"
+
+	if err := m.SetupSystemProxy(); err == nil || !strings.Contains(err.Error(), "any network service") {
+		t.Errorf("SetupSystemProxy = %v, want a failure", err)
+	}
+	for _, cmd := range fake.sets {
+		if strings.HasPrefix(cmd, "-setautoproxystate Wi-Fi on") {
+			t.Error("auto proxy enabled although setting the URL failed")
+		}
+	}
+}
+
+// fakeKeychain emulates the security tool's generic password commands
+type fakeKeychain struct {
+	items    map[string]string // "service/account" -> password
+	notFound error             // error returned for missing items
+	quiet    bool              // print nothing for missing items
+	fail     error             // when set, every command fails with it
+}
+
+func (k *fakeKeychain) run(name string, args ...string) ([]byte, error) {
+	if name != "security" || len(args) == 0 {
+		return nil, fmt.Errorf("unexpected command %s %v", name, args)
+	}
+	if k.fail != nil {
+		return []byte("security: SecKeychainItemCopyContent: internal error"), k.fail
+	}
+
+	flags := make(map[string]string)
+	for i := 1; i < len(args); i++ {
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			flags[args[i]] = args[i+1]
+			i++
+		} else {
+			flags[args[i]] = ""
+		}
+	}
+	key := flags["-s"] + "/" + flags["-a"]
+	var missing []byte
+	if !k.quiet {
+		missing = []byte("security: SecKeychainSearchCopyNext: The specified item could not be found in the keychain.")
+	}
+
+	switch args[0] {
+	case "add-generic-password":
+		if _, exists := k.items[key]; exists {
+			if _, update := flags["-U"]; !update {
+				return []byte("already exists"), fmt.Errorf("exit status 45")
+			}
+		}
+		k.items[key] = flags["-w"]
+		return nil, nil
+	case "find-generic-password":
+		password, exists := k.items[key]
+		if !exists {
+			return missing, k.notFound
+		}
+		if _, print := flags["-w"]; !print {
+			return nil, fmt.Errorf("find without -w")
+		}
+		return []byte(password + "\n"), nil
+	case "delete-generic-password":
+		if _, exists := k.items[key]; !exists {
+			return missing, k.notFound
+		}
+		delete(k.items, key)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected security command %s", args[0])
+}
+
+// output emulates exec.Cmd.Output, which leaves what a failing command printed in
+// the *exec.ExitError instead of returning it
+func (k *fakeKeychain) output(name string, args ...string) ([]byte, error) {
+	out, err := k.run(name, args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		failed := *exitErr
+		failed.Stderr = out
+		return nil, &failed
+	}
+	return out, err
+}
+
+// exitError returns the error of a process that exited with status
+func exitError(t *testing.T, status int) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", status)).Run()
+	if err == nil {
+		t.Fatal("sh exited successfully")
+	}
+	return err
+}
+
+func TestMacOSKeychainRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		quiet  bool
+	}{
+		{"not found exit status", securityItemNotFoundStatus, true},
+		{"not found message", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keychain := &fakeKeychain{items: make(map[string]string), notFound: exitError(t, tt.status), quiet: tt.quiet}
+			m := newTestMacOSManager(t, &fakeNetworksetup{})
+			m.runCommand = keychain.run
+			m.outputCommand = keychain.output
+			m.initKeychainManager()
+
+			if _, err := m.RetrieveKeychainCredentials(); !errors.Is(err, ErrKeychainItemNotFound) {
+				t.Fatalf("Retrieve before store = %v, want ErrKeychainItemNotFound", err)
+			}
+
+			if err := m.storeKeychainCredentials(); err != nil {
+				t.Fatalf("store: %v", err)
+			}
+			stored := keychain.items["OblivionFilter/native-service"]
+			if !strings.HasPrefix(stored, "oblivion-native-") {
+				t.Fatalf("stored token = %q", stored)
+			}
+			if err := m.storeKeychainCredentials(); err != nil {
+				t.Fatalf("second store must update in place: %v", err)
+			}
+
+			token, err := m.RetrieveKeychainCredentials()
+			if err != nil {
+				t.Fatalf("Retrieve: %v", err)
+			}
+			if token != keychain.items["OblivionFilter/native-service"] {
+				t.Errorf("Retrieve = %q, want the stored token", token)
+			}
+
+			if err := m.DeleteKeychainCredentials(); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if err := m.DeleteKeychainCredentials(); !errors.Is(err, ErrKeychainItemNotFound) {
+				t.Errorf("second Delete = %v, want ErrKeychainItemNotFound", err)
+			}
+			if _, err := m.RetrieveKeychainCredentials(); !errors.Is(err, ErrKeychainItemNotFound) {
+				t.Errorf("Retrieve after delete = %v, want ErrKeychainItemNotFound", err)
+			}
+		})
+	}
+}
+
+func TestMacOSKeychainErrors(t *testing.T) {
+	keychain := &fakeKeychain{items: map[string]string{"OblivionFilter/native-service": "secret"}, fail: exitError(t, 1)}
+	m := newTestMacOSManager(t, &fakeNetworksetup{})
+	m.runCommand = keychain.run
+	m.outputCommand = keychain.output
+	m.initKeychainManager()
+
+	if _, err := m.RetrieveKeychainCredentials(); err == nil || errors.Is(err, ErrKeychainItemNotFound) || !strings.Contains(err.Error(), "internal error") {
+		t.Errorf("Retrieve = %v, want a real error reporting what security printed", err)
+	}
+	if err := m.DeleteKeychainCredentials(); err == nil || errors.Is(err, ErrKeychainItemNotFound) {
+		t.Errorf("Delete = %v, want a real error", err)
+	}
+	if err := m.storeKeychainCredentials(); err == nil {
+		t.Error("store succeeded although security failed")
+	}
+}
+
+func TestMacOSKeychainRetrieveKeepsPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+	}{
+		{"plain", "secret"},
+		{"trailing newline", "secret\n"},
+		{"surrounding whitespace", " secret \t"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keychain := &fakeKeychain{items: map[string]string{"OblivionFilter/native-service": tt.password}}
+			m := newTestMacOSManager(t, &fakeNetworksetup{})
+			m.outputCommand = keychain.output
+			m.initKeychainManager()
+
+			got, err := m.RetrieveKeychainCredentials()
+			if err != nil {
+				t.Fatalf("Retrieve: %v", err)
+			}
+			if got != tt.password {
+				t.Errorf("Retrieve = %q, want %q", got, tt.password)
+			}
+		})
+	}
+}
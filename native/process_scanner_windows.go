@@ -0,0 +1,678 @@
+/**
+ * OblivionFilter v2.0.0 - Windows Process Scanner
+ *
+ * Maps network connections to processes for system-wide filtering:
+ * - ETW real-time session on the Microsoft-Windows-Kernel-Network provider
+ * - Connection tables from GetExtendedTcpTable/GetExtendedUdpTable as fallback
+ * - Process details from the Toolhelp snapshot and process image names
+ *
+ * Built together with system_wide_filtering.go on Windows.
+ *
+ * @version 2.0.0
+ * @author OblivionFilter Development Team
+ * @license GPL-3.0
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+	iphlpapi = syscall.NewLazyDLL("iphlpapi.dll")
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procStartTraceW                = advapi32.NewProc("StartTraceW")
+	procControlTraceW              = advapi32.NewProc("ControlTraceW")
+	procEnableTraceEx2             = advapi32.NewProc("EnableTraceEx2")
+	procOpenTraceW                 = advapi32.NewProc("OpenTraceW")
+	procProcessTrace               = advapi32.NewProc("ProcessTrace")
+	procCloseTrace                 = advapi32.NewProc("CloseTrace")
+	procGetExtendedTcpTable        = iphlpapi.NewProc("GetExtendedTcpTable")
+	procGetExtendedUdpTable        = iphlpapi.NewProc("GetExtendedUdpTable")
+	procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+const (
+	wnodeFlagTracedGUID         = 0x00020000
+	eventTraceRealTimeMode      = 0x00000100
+	eventTraceControlStop       = 1
+	eventControlCodeEnable      = 1
+	traceLevelInformation       = 4
+	processTraceModeRealTime    = 0x00000100
+	processTraceModeEventRecord = 0x10000000
+	errorAlreadyExists          = 183
+	errorInsufficientBuffer     = 122
+	invalidProcessTraceHandle   = ^uint64(0)
+	processQueryLimitedInfo     = 0x1000
+
+	kernelNetworkKeywordIPv4 = 0x10
+	kernelNetworkKeywordIPv6 = 0x20
+
+	afInet              = 2
+	afInet6             = 23
+	tcpTableOwnerPIDAll = 5
+	udpTableOwnerPID    = 1
+)
+
+// Microsoft-Windows-Kernel-Network {7DD42A49-5329-4832-8DFD-43D979153A88}
+var kernelNetworkProvider = syscall.GUID{
+	Data1: 0x7dd42a49,
+	Data2: 0x5329,
+	Data3: 0x4832,
+	Data4: [8]byte{0x8d, 0xfd, 0x43, 0xd9, 0x79, 0x15, 0x3a, 0x88},
+}
+
+// Kernel-Network event IDs carrying a connection; the payload layout depends on the address family
+var kernelNetworkEvents = map[uint16]struct {
+	protocol   string
+	ipv6       bool
+	disconnect bool
+}{
+	10: {"tcp", false, false}, // send
+	11: {"tcp", false, false}, // receive
+	12: {"tcp", false, false}, // connect
+	13: {"tcp", false, true},  // disconnect
+	14: {"tcp", false, false}, // retransmit
+	15: {"tcp", false, false}, // accept
+	16: {"tcp", false, false}, // reconnect
+	26: {"tcp", true, false},
+	27: {"tcp", true, false},
+	28: {"tcp", true, false},
+	29: {"tcp", true, true},
+	30: {"tcp", true, false},
+	31: {"tcp", true, false},
+	32: {"tcp", true, false},
+	42: {"udp", false, false}, // send
+	43: {"udp", false, false}, // receive
+	58: {"udp", true, false},
+	59: {"udp", true, false},
+}
+
+// MIB_TCP_STATE values
+var windowsTCPStates = map[uint32]string{
+	1:  "CLOSE",
+	2:  "LISTEN",
+	3:  "SYN_SENT",
+	4:  "SYN_RECV",
+	5:  "ESTABLISHED",
+	6:  "FIN_WAIT1",
+	7:  "FIN_WAIT2",
+	8:  "CLOSE_WAIT",
+	9:  "CLOSING",
+	10: "LAST_ACK",
+	11: "TIME_WAIT",
+	12: "DELETE_TCB",
+}
+
+// EVENT_TRACE_PROPERTIES followed by the session name
+type eventTraceProperties struct {
+	Wnode struct {
+		BufferSize        uint32
+		ProviderId        uint32
+		HistoricalContext uint64
+		TimeStamp         int64
+		Guid              syscall.GUID
+		ClientContext     uint32
+		Flags             uint32
+	}
+	BufferSize          uint32
+	MinimumBuffers      uint32
+	MaximumBuffers      uint32
+	MaximumFileSize     uint32
+	LogFileMode         uint32
+	FlushTimer          uint32
+	EnableFlags         uint32
+	AgeLimit            int32
+	NumberOfBuffers     uint32
+	FreeBuffers         uint32
+	EventsLost          uint32
+	BuffersWritten      uint32
+	LogBuffersLost      uint32
+	RealTimeBuffersLost uint32
+	LoggerThreadId      syscall.Handle
+	LogFileNameOffset   uint32
+	LoggerNameOffset    uint32
+}
+
+// EVENT_TRACE_LOGFILEW; the embedded event and logfile header are unused in real-time mode
+type eventTraceLogfile struct {
+	LogFileName      *uint16
+	LoggerName       *uint16
+	CurrentTime      int64
+	BuffersRead      uint32
+	ProcessTraceMode uint32
+	CurrentEvent     [88]byte
+	LogfileHeader    [280]byte
+	BufferCallback   uintptr
+	BufferSize       uint32
+	Filled           uint32
+	EventsLost       uint32
+	EventCallback    uintptr
+	IsKernelTrace    uint32
+	Context          uintptr
+}
+
+// EVENT_RECORD
+type eventRecord struct {
+	EventHeader struct {
+		Size            uint16
+		HeaderType      uint16
+		Flags           uint16
+		EventProperty   uint16
+		ThreadId        uint32
+		ProcessId       uint32
+		TimeStamp       int64
+		ProviderId      syscall.GUID
+		EventDescriptor struct {
+			Id      uint16
+			Version uint8
+			Channel uint8
+			Level   uint8
+			Opcode  uint8
+			Task    uint16
+			Keyword uint64
+		}
+		ProcessorTime uint64
+		ActivityId    syscall.GUID
+	}
+	BufferContext     uint32
+	ExtendedDataCount uint16
+	UserDataLength    uint16
+	ExtendedData      uintptr
+	UserData          *byte
+	UserContext       uintptr
+}
+
+// Key of a socket by its local endpoint
+type windowsConnKey struct {
+	protocol  string
+	localIP   string
+	localPort int
+}
+
+// Windows process scanner. Connections are mapped to PIDs from ETW network events
+// as they happen; the IP helper connection tables are polled when the trace
+// session is not running, e.g. without administrator rights.
+type WindowsProcessScanner struct {
+	sessionName     string
+	refreshInterval time.Duration
+	etwConnections  map[windowsConnKey]*NetworkConnection
+	tableCache      []*NetworkConnection
+	lastRefresh     time.Time
+	handler         ProcessEventHandler
+	sessionHandle   uint64
+	traceHandle     uint64
+	properties      []byte
+	etwActive       bool
+	mutex           sync.Mutex
+}
+
+// Scanners receiving events, keyed by the context passed to OpenTrace
+var (
+	etwScanners      = make(map[uintptr]*WindowsProcessScanner)
+	etwScannersMutex sync.Mutex
+	etwNextContext   uintptr
+	etwCallbackOnce  sync.Once
+	etwCallback      uintptr
+)
+
+func NewWindowsProcessScanner(sessionName string) *WindowsProcessScanner {
+	return &WindowsProcessScanner{
+		sessionName:     sessionName,
+		refreshInterval: 2 * time.Second,
+		etwConnections:  make(map[windowsConnKey]*NetworkConnection),
+	}
+}
+
+// Start the ETW session; handler, if set, is notified of every connection seen.
+// On error the scanner keeps working by polling the connection tables.
+func (s *WindowsProcessScanner) Start(handler ProcessEventHandler) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.etwActive {
+		return nil
+	}
+	s.handler = handler
+
+	name, err := syscall.UTF16FromString(s.sessionName)
+	if err != nil {
+		return fmt.Errorf("invalid session name %q: %v", s.sessionName, err)
+	}
+
+	// A session left over from an unclean exit keeps the name reserved
+	s.properties = newEventTraceProperties(name)
+	rc, _, _ := procStartTraceW.Call(uintptr(unsafe.Pointer(&s.sessionHandle)), uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&s.properties[0])))
+	if rc == errorAlreadyExists {
+		procControlTraceW.Call(0, uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&s.properties[0])), eventTraceControlStop)
+		s.properties = newEventTraceProperties(name)
+		rc, _, _ = procStartTraceW.Call(uintptr(unsafe.Pointer(&s.sessionHandle)), uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&s.properties[0])))
+	}
+	if rc != 0 {
+		return fmt.Errorf("StartTrace failed: %v", syscall.Errno(rc))
+	}
+
+	rc, _, _ = procEnableTraceEx2.Call(
+		uintptr(s.sessionHandle),
+		uintptr(unsafe.Pointer(&kernelNetworkProvider)),
+		eventControlCodeEnable,
+		traceLevelInformation,
+		kernelNetworkKeywordIPv4|kernelNetworkKeywordIPv6,
+		0, 0, 0)
+	if rc != 0 {
+		s.stopSession()
+		return fmt.Errorf("EnableTraceEx2 failed: %v", syscall.Errno(rc))
+	}
+
+	etwCallbackOnce.Do(func() {
+		etwCallback = syscall.NewCallback(dispatchETWEvent)
+	})
+
+	etwScannersMutex.Lock()
+	etwNextContext++
+	context := etwNextContext
+	etwScanners[context] = s
+	etwScannersMutex.Unlock()
+
+	logfile := eventTraceLogfile{
+		LoggerName:       &name[0],
+		ProcessTraceMode: processTraceModeRealTime | processTraceModeEventRecord,
+		EventCallback:    etwCallback,
+		Context:          context,
+	}
+	handle, _, _ := procOpenTraceW.Call(uintptr(unsafe.Pointer(&logfile)))
+	if uint64(handle) == invalidProcessTraceHandle {
+		s.unregister(context)
+		s.stopSession()
+		return fmt.Errorf("OpenTrace failed for session %s", s.sessionName)
+	}
+	s.traceHandle = uint64(handle)
+	s.etwActive = true
+
+	// ProcessTrace blocks delivering events until the session is closed
+	go func() {
+		traceHandle := uint64(handle)
+		procProcessTrace.Call(uintptr(unsafe.Pointer(&traceHandle)), 1, 0, 0)
+		s.unregister(context)
+
+		s.mutex.Lock()
+		s.etwActive = false
+		s.mutex.Unlock()
+	}()
+
+	return nil
+}
+
+// Stop the ETW session
+func (s *WindowsProcessScanner) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.etwActive {
+		return nil
+	}
+	procCloseTrace.Call(uintptr(s.traceHandle))
+	s.stopSession()
+	s.etwActive = false
+	return nil
+}
+
+// Whether connections are currently mapped from ETW rather than polled
+func (s *WindowsProcessScanner) ETWActive() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.etwActive
+}
+
+func (s *WindowsProcessScanner) ScanProcesses() ([]*ProcessInfo, error) {
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot processes: %v", err)
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	var entry syscall.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+
+	var processes []*ProcessInfo
+	for err = syscall.Process32First(snapshot, &entry); err == nil; err = syscall.Process32Next(snapshot, &entry) {
+		info, err := s.GetProcessInfo(int(entry.ProcessID))
+		if err != nil {
+			// Process exited or is not accessible
+			continue
+		}
+		processes = append(processes, info)
+	}
+	return processes, nil
+}
+
+func (s *WindowsProcessScanner) GetProcessInfo(pid int) (*ProcessInfo, error) {
+	path, err := processImagePath(pid)
+	if err != nil {
+		return nil, fmt.Errorf("process %d not found: %v", pid, err)
+	}
+
+	info := &ProcessInfo{
+		PID:  pid,
+		Name: filepath.Base(path),
+		Path: path,
+	}
+
+	if connections, err := s.GetProcessConnections(pid); err == nil {
+		info.Connections = connections
+	}
+
+	return info, nil
+}
+
+func (s *WindowsProcessScanner) GetProcessConnections(pid int) ([]*NetworkConnection, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refreshTables(false)
+
+	name := ""
+	if path, err := processImagePath(pid); err == nil {
+		name = filepath.Base(path)
+	}
+
+	var connections []*NetworkConnection
+	for _, conn := range s.tableCache {
+		if conn.ProcessID == pid {
+			connection := *conn
+			connection.ProcessName = name
+			connections = append(connections, &connection)
+		}
+	}
+	return connections, nil
+}
+
+// Resolve the process owning a local socket address
+func (s *WindowsProcessScanner) FindProcessByConnection(protocol string, localIP net.IP, localPort int) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.etwActive {
+		if pid, exists := findWindowsConnection(s.etwConnectionList(), protocol, localIP, localPort); exists {
+			return pid, nil
+		}
+	}
+
+	s.refreshTables(false)
+	if pid, exists := findWindowsConnection(s.tableCache, protocol, localIP, localPort); exists {
+		return pid, nil
+	}
+
+	// Socket may have been opened since the last refresh
+	s.refreshTables(true)
+	if pid, exists := findWindowsConnection(s.tableCache, protocol, localIP, localPort); exists {
+		return pid, nil
+	}
+	return 0, fmt.Errorf("no process found for %s %s:%d", protocol, localIP, localPort)
+}
+
+func (s *WindowsProcessScanner) etwConnectionList() []*NetworkConnection {
+	connections := make([]*NetworkConnection, 0, len(s.etwConnections))
+	for _, conn := range s.etwConnections {
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+func findWindowsConnection(connections []*NetworkConnection, protocol string, localIP net.IP, localPort int) (int, bool) {
+	for _, conn := range connections {
+		if conn.Protocol != protocol || conn.LocalPort != localPort {
+			continue
+		}
+		if localIP != nil && !conn.LocalIP.IsUnspecified() && !conn.LocalIP.Equal(localIP) {
+			continue
+		}
+		return conn.ProcessID, true
+	}
+	return 0, false
+}
+
+// Re-read the connection tables when stale or forced; the caller holds the mutex
+func (s *WindowsProcessScanner) refreshTables(force bool) {
+	if !force && time.Since(s.lastRefresh) <= s.refreshInterval {
+		return
+	}
+
+	var connections []*NetworkConnection
+	for _, family := range []uint32{afInet, afInet6} {
+		if table, err := readExtendedTable(procGetExtendedTcpTable, family, tcpTableOwnerPIDAll); err == nil {
+			connections = append(connections, parseTCPTable(table, family)...)
+		}
+		if table, err := readExtendedTable(procGetExtendedUdpTable, family, udpTableOwnerPID); err == nil {
+			connections = append(connections, parseUDPTable(table, family)...)
+		}
+	}
+
+	s.tableCache = connections
+	s.lastRefresh = time.Now()
+}
+
+// Record a connection reported by ETW and notify the handler
+func (s *WindowsProcessScanner) handleEvent(record *eventRecord) {
+	if record.EventHeader.ProviderId != kernelNetworkProvider || record.UserData == nil {
+		return
+	}
+	event, exists := kernelNetworkEvents[record.EventHeader.EventDescriptor.Id]
+	if !exists {
+		return
+	}
+
+	payload := unsafe.Slice(record.UserData, record.UserDataLength)
+	conn, ok := parseKernelNetworkPayload(payload, event.protocol, event.ipv6)
+	if !ok {
+		return
+	}
+	key := windowsConnKey{protocol: conn.Protocol, localIP: conn.LocalIP.String(), localPort: conn.LocalPort}
+
+	s.mutex.Lock()
+	if event.disconnect {
+		delete(s.etwConnections, key)
+	} else {
+		s.etwConnections[key] = conn
+	}
+	handler := s.handler
+	s.mutex.Unlock()
+
+	if handler != nil && !event.disconnect {
+		handler.OnNetworkActivity(conn.ProcessID, conn)
+	}
+}
+
+func (s *WindowsProcessScanner) stopSession() {
+	name, err := syscall.UTF16PtrFromString(s.sessionName)
+	if err != nil {
+		return
+	}
+	procControlTraceW.Call(uintptr(s.sessionHandle), uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&s.properties[0])), eventTraceControlStop)
+}
+
+func (s *WindowsProcessScanner) unregister(context uintptr) {
+	etwScannersMutex.Lock()
+	delete(etwScanners, context)
+	etwScannersMutex.Unlock()
+}
+
+// EventRecordCallback shared by all sessions
+func dispatchETWEvent(record *eventRecord) uintptr {
+	etwScannersMutex.Lock()
+	scanner := etwScanners[record.UserContext]
+	etwScannersMutex.Unlock()
+
+	if scanner != nil {
+		scanner.handleEvent(record)
+	}
+	return 0
+}
+
+// Allocate EVENT_TRACE_PROPERTIES with room for the session name after it
+func newEventTraceProperties(name []uint16) []byte {
+	size := unsafe.Sizeof(eventTraceProperties{})
+	buffer := make([]byte, size+uintptr(len(name))*2)
+
+	properties := (*eventTraceProperties)(unsafe.Pointer(&buffer[0]))
+	properties.Wnode.BufferSize = uint32(len(buffer))
+	properties.Wnode.ClientContext = 1 // QueryPerformanceCounter timestamps
+	properties.Wnode.Flags = wnodeFlagTracedGUID
+	properties.LogFileMode = eventTraceRealTimeMode
+	properties.FlushTimer = 1
+	properties.LoggerNameOffset = uint32(size)
+	return buffer
+}
+
+// Parse a Kernel-Network payload: PID, size, daddr, saddr, dport, sport, ...
+// Addresses are reported from the connection's point of view, so saddr/sport are
+// local for both sent and received data. Ports are in network byte order.
+func parseKernelNetworkPayload(payload []byte, protocol string, ipv6 bool) (*NetworkConnection, bool) {
+	addrLen := 4
+	if ipv6 {
+		addrLen = 16
+	}
+	if len(payload) < 8+2*addrLen+4 {
+		return nil, false
+	}
+
+	pid := binary.LittleEndian.Uint32(payload[0:4])
+	remoteIP := make(net.IP, addrLen)
+	copy(remoteIP, payload[8:8+addrLen])
+	localIP := make(net.IP, addrLen)
+	copy(localIP, payload[8+addrLen:8+2*addrLen])
+	ports := payload[8+2*addrLen:]
+
+	return &NetworkConnection{
+		LocalIP:    localIP,
+		LocalPort:  int(binary.BigEndian.Uint16(ports[2:4])),
+		RemoteIP:   remoteIP,
+		RemotePort: int(binary.BigEndian.Uint16(ports[0:2])),
+		Protocol:   protocol,
+		ProcessID:  int(pid),
+	}, true
+}
+
+// Call GetExtendedTcpTable/GetExtendedUdpTable, growing the buffer as requested
+func readExtendedTable(proc *syscall.LazyProc, family, class uint32) ([]byte, error) {
+	size := uint32(4096)
+	for attempt := 0; attempt < 5; attempt++ {
+		buffer := make([]byte, size)
+		rc, _, _ := proc.Call(uintptr(unsafe.Pointer(&buffer[0])), uintptr(unsafe.Pointer(&size)), 0, uintptr(family), uintptr(class), 0)
+		switch rc {
+		case 0:
+			return buffer[:size], nil
+		case errorInsufficientBuffer:
+			// Table grew between calls; size holds the new requirement
+			continue
+		default:
+			return nil, fmt.Errorf("%s failed: %v", proc.Name, syscall.Errno(rc))
+		}
+	}
+	return nil, fmt.Errorf("%s: table kept growing", proc.Name)
+}
+
+// Parse MIB_TCPTABLE_OWNER_PID or MIB_TCP6TABLE_OWNER_PID
+func parseTCPTable(table []byte, family uint32) []*NetworkConnection {
+	rowSize, addrLen := 24, 4
+	if family == afInet6 {
+		rowSize, addrLen = 56, 16
+	}
+
+	var connections []*NetworkConnection
+	for _, row := range tableRows(table, rowSize) {
+		conn := &NetworkConnection{Protocol: "tcp"}
+		var state uint32
+		if family == afInet {
+			state = binary.LittleEndian.Uint32(row[0:4])
+			conn.LocalIP = net.IP(append([]byte(nil), row[4:8]...))
+			conn.LocalPort = tablePort(row[8:12])
+			conn.RemoteIP = net.IP(append([]byte(nil), row[12:16]...))
+			conn.RemotePort = tablePort(row[16:20])
+			conn.ProcessID = int(binary.LittleEndian.Uint32(row[20:24]))
+		} else {
+			conn.LocalIP = net.IP(append([]byte(nil), row[0:addrLen]...))
+			conn.LocalPort = tablePort(row[20:24])
+			conn.RemoteIP = net.IP(append([]byte(nil), row[24:24+addrLen]...))
+			conn.RemotePort = tablePort(row[44:48])
+			state = binary.LittleEndian.Uint32(row[48:52])
+			conn.ProcessID = int(binary.LittleEndian.Uint32(row[52:56]))
+		}
+		conn.State = windowsTCPStates[state]
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+// Parse MIB_UDPTABLE_OWNER_PID or MIB_UDP6TABLE_OWNER_PID
+func parseUDPTable(table []byte, family uint32) []*NetworkConnection {
+	rowSize := 12
+	if family == afInet6 {
+		rowSize = 28
+	}
+
+	var connections []*NetworkConnection
+	for _, row := range tableRows(table, rowSize) {
+		conn := &NetworkConnection{Protocol: "udp"}
+		if family == afInet {
+			conn.LocalIP = net.IP(append([]byte(nil), row[0:4]...))
+			conn.LocalPort = tablePort(row[4:8])
+			conn.ProcessID = int(binary.LittleEndian.Uint32(row[8:12]))
+		} else {
+			conn.LocalIP = net.IP(append([]byte(nil), row[0:16]...))
+			conn.LocalPort = tablePort(row[20:24])
+			conn.ProcessID = int(binary.LittleEndian.Uint32(row[24:28]))
+		}
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+// Split a table into rows after its dwNumEntries header
+func tableRows(table []byte, rowSize int) [][]byte {
+	if len(table) < 4 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint32(table[0:4]))
+
+	var rows [][]byte
+	for i := 0; i < count; i++ {
+		offset := 4 + i*rowSize
+		if offset+rowSize > len(table) {
+			break
+		}
+		rows = append(rows, table[offset:offset+rowSize])
+	}
+	return rows
+}
+
+// Table ports are DWORDs holding a network-order port in the low 16 bits
+func tablePort(dword []byte) int {
+	return int(binary.BigEndian.Uint16(dword[0:2]))
+}
+
+func processImagePath(pid int) (string, error) {
+	handle, err := syscall.OpenProcess(processQueryLimitedInfo, false, uint32(pid))
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(handle)
+
+	buffer := make([]uint16, syscall.MAX_PATH)
+	size := uint32(len(buffer))
+	rc, _, err := procQueryFullProcessImageNameW.Call(uintptr(handle), 0, uintptr(unsafe.Pointer(&buffer[0])), uintptr(unsafe.Pointer(&size)))
+	if rc == 0 {
+		return "", err
+	}
+	return syscall.UTF16ToString(buffer[:size]), nil
+}
@@ -0,0 +1,277 @@
+//go:build windows
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// buildConnectionTable lays out rows after a dwNumEntries header as the IP helper
+// API returns them
+func buildConnectionTable(rows ...[]byte) []byte {
+	table := binary.LittleEndian.AppendUint32(nil, uint32(len(rows)))
+	for _, row := range rows {
+		table = append(table, row...)
+	}
+	return table
+}
+
+// tableDword encodes a port as a table DWORD: network order in the low 16 bits
+func tableDword(port int) []byte {
+	return []byte{byte(port >> 8), byte(port), 0, 0}
+}
+
+func tcp4Row(state uint32, local net.IP, localPort int, remote net.IP, remotePort, pid int) []byte {
+	row := binary.LittleEndian.AppendUint32(nil, state)
+	row = append(row, local.To4()...)
+	row = append(row, tableDword(localPort)...)
+	row = append(row, remote.To4()...)
+	row = append(row, tableDword(remotePort)...)
+	return binary.LittleEndian.AppendUint32(row, uint32(pid))
+}
+
+func tcp6Row(state uint32, local net.IP, localPort int, remote net.IP, remotePort, pid int) []byte {
+	row := append([]byte(nil), local.To16()...)
+	row = append(row, 0, 0, 0, 0) // scope ID
+	row = append(row, tableDword(localPort)...)
+	row = append(row, remote.To16()...)
+	row = append(row, 0, 0, 0, 0)
+	row = append(row, tableDword(remotePort)...)
+	row = binary.LittleEndian.AppendUint32(row, state)
+	return binary.LittleEndian.AppendUint32(row, uint32(pid))
+}
+
+func udp4Row(local net.IP, localPort, pid int) []byte {
+	row := append([]byte(nil), local.To4()...)
+	row = append(row, tableDword(localPort)...)
+	return binary.LittleEndian.AppendUint32(row, uint32(pid))
+}
+
+func udp6Row(local net.IP, localPort, pid int) []byte {
+	row := append([]byte(nil), local.To16()...)
+	row = append(row, 0, 0, 0, 0)
+	row = append(row, tableDword(localPort)...)
+	return binary.LittleEndian.AppendUint32(row, uint32(pid))
+}
+
+// connectionSummary keeps the fields a table row carries
+type connectionSummary struct {
+	Protocol   string
+	LocalIP    string
+	LocalPort  int
+	RemoteIP   string
+	RemotePort int
+	ProcessID  int
+}
+
+func summarizeConnections(connections []*NetworkConnection) []connectionSummary {
+	var summaries []connectionSummary
+	for _, conn := range connections {
+		summary := connectionSummary{
+			Protocol:   conn.Protocol,
+			LocalIP:    conn.LocalIP.String(),
+			LocalPort:  conn.LocalPort,
+			RemotePort: conn.RemotePort,
+			ProcessID:  conn.ProcessID,
+		}
+		if conn.RemoteIP != nil {
+			summary.RemoteIP = conn.RemoteIP.String()
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+func TestParseConnectionTables(t *testing.T) {
+	loopback4 := net.ParseIP("127.0.0.1")
+	remote4 := net.ParseIP("93.184.216.34")
+	loopback6 := net.ParseIP("::1")
+	remote6 := net.ParseIP("2001:db8::1")
+
+	tests := []struct {
+		name   string
+		parse  func([]byte, uint32) []*NetworkConnection
+		table  []byte
+		family uint32
+		want   []connectionSummary
+	}{
+		{
+			name:   "tcp ipv4",
+			parse:  parseTCPTable,
+			table:  buildConnectionTable(tcp4Row(5, loopback4, 50000, remote4, 443, 1234), tcp4Row(2, net.IPv4zero, 8080, net.IPv4zero, 0, 4321)),
+			family: afInet,
+			want: []connectionSummary{
+				{Protocol: "tcp", LocalIP: "127.0.0.1", LocalPort: 50000, RemoteIP: "93.184.216.34", RemotePort: 443, ProcessID: 1234},
+				{Protocol: "tcp", LocalIP: "0.0.0.0", LocalPort: 8080, RemoteIP: "0.0.0.0", ProcessID: 4321},
+			},
+		},
+		{
+			name:   "tcp ipv6",
+			parse:  parseTCPTable,
+			table:  buildConnectionTable(tcp6Row(5, loopback6, 50001, remote6, 8443, 99)),
+			family: afInet6,
+			want: []connectionSummary{
+				{Protocol: "tcp", LocalIP: "::1", LocalPort: 50001, RemoteIP: "2001:db8::1", RemotePort: 8443, ProcessID: 99},
+			},
+		},
+		{
+			name:   "udp ipv4",
+			parse:  parseUDPTable,
+			table:  buildConnectionTable(udp4Row(loopback4, 53, 7)),
+			family: afInet,
+			want: []connectionSummary{
+				{Protocol: "udp", LocalIP: "127.0.0.1", LocalPort: 53, ProcessID: 7},
+			},
+		},
+		{
+			name:   "udp ipv6",
+			parse:  parseUDPTable,
+			table:  buildConnectionTable(udp6Row(loopback6, 5353, 8)),
+			family: afInet6,
+			want: []connectionSummary{
+				{Protocol: "udp", LocalIP: "::1", LocalPort: 5353, ProcessID: 8},
+			},
+		},
+		{
+			name:   "count larger than the buffer",
+			parse:  parseUDPTable,
+			table:  append(binary.LittleEndian.AppendUint32(nil, 3), udp4Row(loopback4, 53, 7)...),
+			family: afInet,
+			want: []connectionSummary{
+				{Protocol: "udp", LocalIP: "127.0.0.1", LocalPort: 53, ProcessID: 7},
+			},
+		},
+		{
+			name:   "truncated header",
+			parse:  parseTCPTable,
+			table:  []byte{1, 0},
+			family: afInet,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summarizeConnections(tt.parse(tt.table, tt.family))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKernelNetworkPayload(t *testing.T) {
+	payload := binary.LittleEndian.AppendUint32(nil, 4242)
+	payload = binary.LittleEndian.AppendUint32(payload, 512) // size
+	payload = append(payload, 93, 184, 216, 34)              // daddr
+	payload = append(payload, 10, 0, 0, 5)                   // saddr
+	payload = append(payload, 0x01, 0xbb, 0xc3, 0x50)        // dport 443, sport 50000
+
+	conn, ok := parseKernelNetworkPayload(payload, "tcp", false)
+	if !ok {
+		t.Fatal("payload was rejected")
+	}
+	want := connectionSummary{Protocol: "tcp", LocalIP: "10.0.0.5", LocalPort: 50000, RemoteIP: "93.184.216.34", RemotePort: 443, ProcessID: 4242}
+	if got := summarizeConnections([]*NetworkConnection{conn})[0]; got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, ok := parseKernelNetworkPayload(payload[:len(payload)-1], "tcp", false); ok {
+		t.Error("truncated payload was accepted")
+	}
+	if _, ok := parseKernelNetworkPayload(payload, "tcp", true); ok {
+		t.Error("IPv4-sized payload was accepted as IPv6")
+	}
+}
+
+func TestFindWindowsConnection(t *testing.T) {
+	connections := []*NetworkConnection{
+		{Protocol: "tcp", LocalIP: net.ParseIP("127.0.0.1"), LocalPort: 8080, ProcessID: 10},
+		{Protocol: "udp", LocalIP: net.ParseIP("127.0.0.1"), LocalPort: 8080, ProcessID: 20},
+		{Protocol: "tcp", LocalIP: net.IPv4zero, LocalPort: 9090, ProcessID: 30},
+		{Protocol: "tcp", LocalIP: net.ParseIP("10.0.0.5"), LocalPort: 7070, ProcessID: 40},
+	}
+
+	tests := []struct {
+		name     string
+		protocol string
+		localIP  net.IP
+		port     int
+		wantPID  int
+		wantOK   bool
+	}{
+		{"exact match", "tcp", net.ParseIP("127.0.0.1"), 8080, 10, true},
+		{"protocol distinguishes sockets", "udp", net.ParseIP("127.0.0.1"), 8080, 20, true},
+		{"wildcard listener", "tcp", net.ParseIP("192.168.1.2"), 9090, 30, true},
+		{"any local address", "tcp", nil, 7070, 40, true},
+		{"different local address", "tcp", net.ParseIP("10.0.0.6"), 7070, 0, false},
+		{"unknown port", "tcp", net.ParseIP("127.0.0.1"), 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, ok := findWindowsConnection(connections, tt.protocol, tt.localIP, tt.port)
+			if pid != tt.wantPID || ok != tt.wantOK {
+				t.Errorf("findWindowsConnection() = %d, %v, want %d, %v", pid, ok, tt.wantPID, tt.wantOK)
+			}
+		})
+	}
+}
+
+// The table fallback maps sockets opened by this test to its own PID
+func TestFindProcessByConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+
+	tests := []struct {
+		name     string
+		protocol string
+		addr     net.Addr
+	}{
+		{"tcp listener", "tcp", listener.Addr()},
+		{"tcp client", "tcp", client.LocalAddr()},
+		{"udp socket", "udp", packetConn.LocalAddr()},
+	}
+
+	scanner := NewWindowsProcessScanner("OblivionFilterTest")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, portText, err := net.SplitHostPort(tt.addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			port, err := net.LookupPort(tt.protocol, portText)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pid, err := scanner.FindProcessByConnection(tt.protocol, net.ParseIP(host), port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pid != os.Getpid() {
+				t.Errorf("got PID %d, want %d", pid, os.Getpid())
+			}
+		})
+	}
+
+	if _, err := scanner.FindProcessByConnection("tcp", net.ParseIP("127.0.0.1"), 1); err == nil {
+		t.Error("expected an error for a port nobody has open")
+	}
+}
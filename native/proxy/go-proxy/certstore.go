@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloadDebounce coalesces the writes that replace a certificate and its key,
+// which usually land as several events in quick succession
+const certReloadDebounce = 500 * time.Millisecond
+
+// CertStore holds the server key pair and serves it to TLS handshakes. Reloading
+// swaps the pair atomically: new handshakes get the fresh certificate while
+// established connections keep the one they negotiated.
+type CertStore struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	logger   *Logger
+	watcher  *fsnotify.Watcher
+	mu       sync.Mutex
+}
+
+// NewCertStore creates a store and loads the key pair from certFile and keyFile
+func NewCertStore(certFile, keyFile string, logger *Logger) (*CertStore, error) {
+	cs := &CertStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := cs.Reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Reload reads the key pair from disk again. On failure the current certificate
+// stays in use.
+func (cs *CertStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+	if err != nil {
+		return err
+	}
+	cs.cert.Store(&cert)
+	return nil
+}
+
+// Certificate returns the current key pair
+func (cs *CertStore) Certificate() *tls.Certificate {
+	return cs.cert.Load()
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cs *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cs.cert.Load(), nil
+}
+
+// Watch reloads the key pair whenever either file changes. The parent directories
+// are watched rather than the files, and any change in them triggers a reload, so
+// atomic renames and the symlink swaps of certbot and Kubernetes secrets are seen.
+func (cs *CertStore) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{
+		filepath.Dir(filepath.Clean(cs.certFile)): true,
+		filepath.Dir(filepath.Clean(cs.keyFile)):  true,
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	cs.mu.Lock()
+	cs.watcher = watcher
+	cs.mu.Unlock()
+
+	reload := func() {
+		if err := cs.Reload(); err != nil {
+			cs.logger.Error("CERTIFICATE RELOAD FAILED for %s, keeping previous certificate: %v", cs.certFile, err)
+			return
+		}
+		cs.logger.Info("Reloaded TLS certificate from %s", cs.certFile)
+	}
+
+	go func() {
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					if debounce != nil {
+						debounce.Stop()
+					}
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if debounce == nil {
+					debounce = time.AfterFunc(certReloadDebounce, reload)
+				} else {
+					debounce.Reset(certReloadDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				cs.logger.Error("Certificate watcher error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the key pair files
+func (cs *CertStore) Close() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.watcher == nil {
+		return nil
+	}
+	err := cs.watcher.Close()
+	cs.watcher = nil
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestCertStore writes a server certificate signed by ca into dir and loads it
+func newTestCertStore(t *testing.T, dir string, ca *testCert) (*CertStore, *testCert, string, string) {
+	t.Helper()
+	logger, err := NewLogger(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestServerCert(t, ca)
+	certFile, keyFile := writeTestCert(t, dir, "server", cert)
+	store, err := NewCertStore(certFile, keyFile, logger)
+	if err != nil {
+		t.Fatalf("NewCertStore: %v", err)
+	}
+	return store, cert, certFile, keyFile
+}
+
+// servedSerial returns the serial number of the certificate store is serving
+func servedSerial(store *CertStore) string {
+	cert, _ := store.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return leaf.SerialNumber.String()
+}
+
+func TestCertStoreReload(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	store, first, certFile, keyFile := newTestCertStore(t, t.TempDir(), ca)
+	second := newTestServerCert(t, ca)
+
+	steps := []struct {
+		name    string
+		cert    []byte
+		key     []byte
+		wantErr bool
+		want    *testCert
+	}{
+		{"new key pair", second.certPEM, second.keyPEM, false, second},
+		{"mismatched key pair keeps the current one", first.certPEM, second.keyPEM, true, second},
+		{"unreadable certificate keeps the current one", []byte("garbage"), second.keyPEM, true, second},
+		{"back to the first", first.certPEM, first.keyPEM, false, first},
+	}
+
+	if got := servedSerial(store); got != first.cert.SerialNumber.String() {
+		t.Fatalf("serving %s, want the initial certificate %s", got, first.cert.SerialNumber)
+	}
+	for _, step := range steps {
+		replaceFile(t, certFile, string(step.cert))
+		replaceFile(t, keyFile, string(step.key))
+		if err := store.Reload(); (err != nil) != step.wantErr {
+			t.Errorf("%s: Reload error = %v, want error %v", step.name, err, step.wantErr)
+		}
+		if got := servedSerial(store); got != step.want.cert.SerialNumber.String() {
+			t.Errorf("%s: serving %s, want %s", step.name, got, step.want.cert.SerialNumber)
+		}
+	}
+}
+
+func TestCertStoreWatch(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	store, _, certFile, keyFile := newTestCertStore(t, t.TempDir(), ca)
+	if err := store.Watch(); err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer store.Close()
+
+	renewed := newTestServerCert(t, ca)
+	replaceFile(t, keyFile, string(renewed.keyPEM))
+	replaceFile(t, certFile, string(renewed.certPEM))
+
+	want := renewed.cert.SerialNumber.String()
+	if !waitFor(5*time.Second, func() bool { return servedSerial(store) == want }) {
+		t.Fatalf("still serving %s after the files changed, want %s", servedSerial(store), want)
+	}
+}
+
+// New handshakes present the reloaded certificate while established connections
+// carry on with the one they negotiated
+func TestProxyReloadCertificate(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	dir := t.TempDir()
+	first := newTestServerCert(t, ca)
+	certFile, keyFile := writeTestCert(t, dir, "server", first)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := newTestConfig()
+	config.TLSEnabled = true
+	config.CertFile, config.KeyFile = certFile, keyFile
+	ps, addr := startTLSTestProxy(t, config)
+
+	dial := func() *tls.Conn {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	presented := func(conn *tls.Conn) string {
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+	}
+
+	established := dial()
+	if got := presented(established); got != first.cert.SerialNumber.String() {
+		t.Fatalf("presented %s, want %s", got, first.cert.SerialNumber)
+	}
+
+	renewed := newTestServerCert(t, ca)
+	replaceFile(t, keyFile, string(renewed.keyPEM))
+	replaceFile(t, certFile, string(renewed.certPEM))
+	ps.ReloadCertificate()
+
+	if got := presented(dial()); got != renewed.cert.SerialNumber.String() {
+		t.Errorf("new handshake presented %s, want the renewed %s", got, renewed.cert.SerialNumber)
+	}
+
+	// The established connection still serves requests
+	io.WriteString(established, "GET /stats HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(established), nil)
+	if err != nil {
+		t.Fatalf("request on the established connection: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d on the established connection", resp.StatusCode)
+	}
+
+	// A broken renewal leaves the current certificate in place
+	replaceFile(t, certFile, "garbage")
+	ps.ReloadCertificate()
+	if got := presented(dial()); got != renewed.cert.SerialNumber.String() {
+		t.Errorf("after a failed reload presented %s, want %s", got, renewed.cert.SerialNumber)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tlsRecordTypeHandshake  = 0x16
+	tlsRecordTypeAlert      = 0x15
+	tlsHandshakeClientHello = 0x01
+	tlsExtensionServerName  = 0x0000
+	tlsExtensionGroups      = 0x000a
+	tlsExtensionPointFormat = 0x000b
+	tlsRecordHeaderLen      = 5
+	tlsMaxRecordLen         = 16384 + 2048
+)
+
+// tlsAlertCodes maps configurable alert names to TLS alert descriptions
+var tlsAlertCodes = map[string]byte{
+	"handshake_failure": 40,
+	"access_denied":     49,
+	"internal_error":    80,
+	"unrecognized_name": 112,
+}
+
+// errNotTLS is returned when the peeked bytes are not a TLS handshake record
+var errNotTLS = errors.New("not a TLS handshake")
+
+// ClientHelloInfo holds the fields extracted from a TLS ClientHello
+type ClientHelloInfo struct {
+	ServerName string
+	JA3        string // version,ciphers,extensions,groups,point formats
+	JA3Hash    string // MD5 of JA3 in hex, the usual form of the fingerprint
+}
+
+// ReadClientHello reads the first TLS record from conn. The returned bytes must be
+// forwarded to the target if the connection is allowed to proceed.
+func ReadClientHello(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header := make([]byte, tlsRecordHeaderLen)
+	n, err := io.ReadFull(conn, header)
+	if err != nil {
+		return header[:n], err
+	}
+	if header[0] != tlsRecordTypeHandshake {
+		return header, errNotTLS
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > tlsMaxRecordLen {
+		return header, fmt.Errorf("TLS record too large: %d bytes", length)
+	}
+
+	record := make([]byte, tlsRecordHeaderLen+length)
+	copy(record, header)
+	n, err = io.ReadFull(conn, record[tlsRecordHeaderLen:])
+	return record[:tlsRecordHeaderLen+n], err
+}
+
+// ParseClientHello parses a TLS record containing a ClientHello
+func ParseClientHello(record []byte) (*ClientHelloInfo, error) {
+	if len(record) < tlsRecordHeaderLen || record[0] != tlsRecordTypeHandshake {
+		return nil, errNotTLS
+	}
+
+	data := record[tlsRecordHeaderLen:]
+	if len(data) < 4 || data[0] != tlsHandshakeClientHello {
+		return nil, errors.New("not a ClientHello")
+	}
+	helloLen := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	data = data[4:]
+	if helloLen < len(data) {
+		data = data[:helloLen]
+	}
+
+	// Client version, then skip random
+	if len(data) < 34 {
+		return nil, errors.New("truncated ClientHello")
+	}
+	version := binary.BigEndian.Uint16(data)
+	data = data[34:]
+
+	// Skip session ID and compression methods, keep the cipher suites
+	var ok bool
+	if data, ok = skipVector(data, 1); !ok {
+		return nil, errors.New("truncated session ID")
+	}
+	var ciphers []byte
+	if ciphers, data, ok = readVector(data, 2); !ok {
+		return nil, errors.New("truncated cipher suites")
+	}
+	if data, ok = skipVector(data, 1); !ok {
+		return nil, errors.New("truncated compression methods")
+	}
+
+	info := &ClientHelloInfo{}
+	ja3 := ja3Fields{version: version, ciphers: uint16List(ciphers)}
+	if len(data) < 2 {
+		// No extensions
+		info.setJA3(ja3)
+		return info, nil
+	}
+	extLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if extLen > len(data) {
+		return nil, errors.New("truncated extensions")
+	}
+	data = data[:extLen]
+
+	for len(data) >= 4 {
+		extType := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if length > len(data) {
+			return nil, errors.New("truncated extension")
+		}
+		ext := data[:length]
+		data = data[length:]
+
+		ja3.extensions = append(ja3.extensions, extType)
+		switch extType {
+		case tlsExtensionServerName:
+			info.ServerName = parseServerNameExtension(ext)
+		case tlsExtensionGroups:
+			if groups, _, ok := readVector(ext, 2); ok {
+				ja3.groups = uint16List(groups)
+			}
+		case tlsExtensionPointFormat:
+			if formats, _, ok := readVector(ext, 1); ok {
+				for _, format := range formats {
+					ja3.pointFormats = append(ja3.pointFormats, uint16(format))
+				}
+			}
+		}
+	}
+
+	info.setJA3(ja3)
+	return info, nil
+}
+
+// ja3Fields are the ClientHello values that make up a JA3 fingerprint
+type ja3Fields struct {
+	version      uint16
+	ciphers      []uint16
+	extensions   []uint16
+	groups       []uint16
+	pointFormats []uint16
+}
+
+// setJA3 fills in the JA3 string and hash. GREASE values are left out, since
+// clients pick them at random and they would make every connection unique.
+func (info *ClientHelloInfo) setJA3(f ja3Fields) {
+	info.JA3 = strings.Join([]string{
+		strconv.Itoa(int(f.version)),
+		joinJA3Values(f.ciphers),
+		joinJA3Values(f.extensions),
+		joinJA3Values(f.groups),
+		joinJA3Values(f.pointFormats),
+	}, ",")
+	sum := md5.Sum([]byte(info.JA3))
+	info.JA3Hash = hex.EncodeToString(sum[:])
+}
+
+// joinJA3Values formats values as dash separated decimals, skipping GREASE
+func joinJA3Values(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC 8701),
+// 0x0a0a, 0x1a1a, ... 0xfafa
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// uint16List decodes a list of big-endian 16-bit values
+func uint16List(data []byte) []uint16 {
+	values := make([]uint16, 0, len(data)/2)
+	for len(data) >= 2 {
+		values = append(values, binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	return values
+}
+
+// parseServerNameExtension returns the host_name entry of a server_name extension
+func parseServerNameExtension(ext []byte) string {
+	if len(ext) < 2 {
+		return ""
+	}
+	ext = ext[2:]
+	for len(ext) >= 3 {
+		nameType := ext[0]
+		length := int(binary.BigEndian.Uint16(ext[1:]))
+		ext = ext[3:]
+		if length > len(ext) {
+			return ""
+		}
+		if nameType == 0 {
+			return strings.ToLower(string(ext[:length]))
+		}
+		ext = ext[length:]
+	}
+	return ""
+}
+
+// skipVector skips a length-prefixed vector with a prefix of lenBytes bytes
+func skipVector(data []byte, lenBytes int) ([]byte, bool) {
+	_, rest, ok := readVector(data, lenBytes)
+	return rest, ok
+}
+
+// readVector splits a length-prefixed vector with a prefix of lenBytes bytes into
+// its contents and the data following it
+func readVector(data []byte, lenBytes int) ([]byte, []byte, bool) {
+	if len(data) < lenBytes {
+		return nil, nil, false
+	}
+	length := 0
+	for i := 0; i < lenBytes; i++ {
+		length = length<<8 | int(data[i])
+	}
+	data = data[lenBytes:]
+	if length > len(data) {
+		return nil, nil, false
+	}
+	return data[:length], data[length:], true
+}
+
+// writeTLSAlert sends a fatal TLS alert record
+func writeTLSAlert(conn net.Conn, description byte) error {
+	_, err := conn.Write([]byte{tlsRecordTypeAlert, 0x03, 0x03, 0x00, 0x02, 0x02, description})
+	return err
+}
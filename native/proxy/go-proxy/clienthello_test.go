@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTLSTarget serves HTTPS on a loopback port for CONNECT tests and returns its
+// address and port
+func startTLSTarget(t *testing.T) (string, int) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "target")
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	addr := srv.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return addr, n
+}
+
+func TestSNIBlackhole(t *testing.T) {
+	target, port := startTLSTarget(t)
+
+	tests := []struct {
+		name    string
+		action  string
+		sni     string
+		wantErr string
+	}{
+		{"allowed sni tunnels", "handshake_failure", "allowed.example.com", ""},
+		{"blacklisted sni", "handshake_failure", "cdn.blocked.example", "handshake failure"},
+		{"subdomain of blacklisted sni", "handshake_failure", "a.cdn.blocked.example", "handshake failure"},
+		{"parent domain is not blacklisted", "handshake_failure", "blocked.example", ""},
+		{"custom alert", "access_denied", "cdn.blocked.example", "access denied"},
+		{"reset", "reset", "cdn.blocked.example", "reset by peer"},
+		{"reset leaves other snis", "reset", "allowed.example.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.ConnectAllowedPorts = []int{port}
+			config.SNIBlacklist = []string{"cdn.blocked.example"}
+			config.SNIBlackholeAction = tt.action
+			_, addr := startTestProxy(t, config)
+
+			conn, status := dialConnect(t, addr, target)
+			if status != http.StatusOK {
+				t.Fatalf("CONNECT status %d, want 200", status)
+			}
+
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: tt.sni, InsecureSkipVerify: true})
+			err := tlsConn.Handshake()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("handshake through tunnel: %v", err)
+				}
+				io.WriteString(tlsConn, "GET / HTTP/1.1\r\nHost: "+tt.sni+"\r\nConnection: close\r\n\r\n")
+				body, _ := io.ReadAll(tlsConn)
+				if !strings.HasSuffix(string(body), "target") {
+					t.Errorf("response through tunnel = %q, want the target's body", body)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("handshake error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBlackholedConnectNeverDialsTarget(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	_, targetPort, _ := net.SplitHostPort(target.Addr().String())
+	port, _ := strconv.Atoi(targetPort)
+
+	config := newTestConfig()
+	config.ConnectAllowedPorts = []int{port}
+	config.SNIBlacklist = []string{"cdn.blocked.example"}
+	_, addr := startTestProxy(t, config)
+
+	conn, status := dialConnect(t, addr, target.Addr().String())
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT status %d, want 200", status)
+	}
+	if err := tls.Client(conn, &tls.Config{ServerName: "cdn.blocked.example", InsecureSkipVerify: true}).Handshake(); err == nil {
+		t.Fatal("handshake with a blackholed SNI succeeded")
+	}
+
+	// Nothing accepts on the target, so a connection from the proxy would still be queued
+	target.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if upstream, err := target.Accept(); err == nil {
+		upstream.Close()
+		t.Error("the proxy connected to the target of a blackholed tunnel")
+	}
+}
+
+func TestIsSNIBlackholed(t *testing.T) {
+	config := newTestConfig()
+	config.SNIBlacklist = []string{"tracker.example.com", "Ads.Example.NET"}
+	fe := NewFilterEngine(config)
+
+	tests := []struct {
+		sni  string
+		want bool
+	}{
+		{"tracker.example.com", true},
+		{"eu.tracker.example.com", true},
+		{"TRACKER.example.com", true},
+		{"tracker.example.com.", true},
+		{"ads.example.net", true},
+		{"example.com", false},
+		{"nottracker.example.com", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := fe.IsSNIBlackholed(tt.sni); got != tt.want {
+			t.Errorf("IsSNIBlackholed(%q) = %v, want %v", tt.sni, got, tt.want)
+		}
+	}
+}
+
+// tlsExtension is a raw ClientHello extension
+type tlsExtension struct {
+	typ  uint16
+	data []byte
+}
+
+// buildClientHello lays out a ClientHello record with the given fields
+func buildClientHello(version uint16, ciphers []uint16, extensions []tlsExtension) []byte {
+	body := binary.BigEndian.AppendUint16(nil, version)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session ID
+	body = binary.BigEndian.AppendUint16(body, uint16(2*len(ciphers)))
+	for _, cipher := range ciphers {
+		body = binary.BigEndian.AppendUint16(body, cipher)
+	}
+	body = append(body, 1, 0) // null compression
+	if extensions != nil {
+		var exts []byte
+		for _, ext := range extensions {
+			exts = binary.BigEndian.AppendUint16(exts, ext.typ)
+			exts = binary.BigEndian.AppendUint16(exts, uint16(len(ext.data)))
+			exts = append(exts, ext.data...)
+		}
+		body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+		body = append(body, exts...)
+	}
+
+	handshake := []byte{tlsHandshakeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	handshake = append(handshake, body...)
+	record := []byte{tlsRecordTypeHandshake, 3, 1}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(handshake)))
+	return append(record, handshake...)
+}
+
+// uint16Vector encodes values as a vector with a two byte length
+func uint16Vector(values ...uint16) []byte {
+	data := binary.BigEndian.AppendUint16(nil, uint16(2*len(values)))
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	return data
+}
+
+func TestParseClientHelloJA3(t *testing.T) {
+	sni := []byte{0, 14, 0, 0, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm'}
+	readmeCiphers := []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4}
+
+	tests := []struct {
+		name     string
+		hello    []byte
+		wantJA3  string
+		wantHash string
+		wantSNI  string
+	}{
+		{
+			// The example from the JA3 README
+			name: "reference fingerprint",
+			hello: buildClientHello(0x0301, readmeCiphers, []tlsExtension{
+				{tlsExtensionServerName, sni},
+				{tlsExtensionGroups, uint16Vector(23, 24, 25)},
+				{tlsExtensionPointFormat, []byte{1, 0}},
+			}),
+			wantJA3:  "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			wantHash: "ada70206e40642a3e4461f35503241d5",
+			wantSNI:  "example.com",
+		},
+		{
+			name: "grease values are ignored",
+			hello: buildClientHello(0x0301, append([]uint16{0x0a0a}, readmeCiphers...), []tlsExtension{
+				{0x1a1a, nil},
+				{tlsExtensionServerName, sni},
+				{tlsExtensionGroups, uint16Vector(0x2a2a, 23, 24, 25)},
+				{tlsExtensionPointFormat, []byte{1, 0}},
+				{0xfafa, []byte{0}},
+			}),
+			wantJA3:  "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			wantHash: "ada70206e40642a3e4461f35503241d5",
+			wantSNI:  "example.com",
+		},
+		{
+			name:     "no extensions",
+			hello:    buildClientHello(0x0303, []uint16{4865, 4866, 4867}, nil),
+			wantJA3:  "771,4865-4866-4867,,,",
+			wantHash: "8350bf77ada0582bba22ae9bc38ba5b7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParseClientHello(tt.hello)
+			if err != nil {
+				t.Fatalf("ParseClientHello: %v", err)
+			}
+			if info.JA3 != tt.wantJA3 || info.JA3Hash != tt.wantHash || info.ServerName != tt.wantSNI {
+				t.Errorf("got %q %s SNI %q, want %q %s SNI %q", info.JA3, info.JA3Hash, info.ServerName, tt.wantJA3, tt.wantHash, tt.wantSNI)
+			}
+		})
+	}
+
+	truncated := buildClientHello(0x0303, []uint16{4865}, nil)
+	truncated = truncated[:len(truncated)-3]
+	if _, err := ParseClientHello(truncated); err == nil {
+		t.Error("truncated ClientHello was parsed")
+	}
+}
+
+// captureClientHello returns the ClientHello record a Go TLS client sends with config
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tls.Client(conn, config).Handshake()
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hello, err := ReadClientHello(conn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("read ClientHello: %v", err)
+	}
+	return hello
+}
+
+func TestJA3Denylist(t *testing.T) {
+	target, port := startTLSTarget(t)
+
+	denied := &tls.Config{ServerName: "example.com", InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	allowed := &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}
+	info, err := ParseClientHello(captureClientHello(t, denied))
+	if err != nil {
+		t.Fatalf("parse captured ClientHello: %v", err)
+	}
+	if other, err := ParseClientHello(captureClientHello(t, allowed)); err != nil || other.JA3Hash == info.JA3Hash {
+		t.Fatalf("the two client configs must fingerprint differently: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		action  string
+		client  *tls.Config
+		wantErr bool
+	}{
+		{"denylisted client is refused", "block", denied, true},
+		{"default action blocks", "", denied, true},
+		{"other clients tunnel", "block", allowed, false},
+		{"flag only logs", "flag", denied, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.ConnectAllowedPorts = []int{port}
+			config.JA3Denylist = []string{strings.ToUpper(info.JA3Hash)}
+			config.JA3Action = tt.action
+			config.SNIBlackholeAction = "handshake_failure"
+			_, addr := startTestProxy(t, config)
+
+			conn, status := dialConnect(t, addr, target)
+			if status != http.StatusOK {
+				t.Fatalf("CONNECT status %d, want 200", status)
+			}
+			err := tls.Client(conn, tt.client).Handshake()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "handshake failure") {
+					t.Errorf("handshake error = %v, want a handshake failure alert", err)
+				}
+			} else if err != nil {
+				t.Errorf("handshake through tunnel: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// CookieBlocking controls cookies on requests made on behalf of another site
+type CookieBlocking struct {
+	BlockThirdParty    bool     `json:"block_third_party"`    // strip Set-Cookie from third-party responses
+	WithholdThirdParty bool     `json:"withhold_third_party"` // drop the Cookie header on third-party requests
+	Whitelist          []string `json:"whitelist"`            // domains, including their subdomains, always allowed cookies
+}
+
+// registrableDomain returns the eTLD+1 of host, or the host itself for IPs and
+// names without a public suffix
+func registrableDomain(host string) string {
+	host = normalizeHost(host)
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// documentHost returns the host of the page that caused r, taken from Origin or
+// Referer, or "" for top-level navigations that carry neither
+func documentHost(r *http.Request) string {
+	for _, header := range []string{"Origin", "Referer"} {
+		value := r.Header.Get(header)
+		if value == "" || value == "null" {
+			continue
+		}
+		if u, err := url.Parse(value); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	return ""
+}
+
+// isThirdPartyRequest reports whether r targets a different site than the document
+// that made it
+func isThirdPartyRequest(r *http.Request) bool {
+	document := documentHost(r)
+	if document == "" {
+		return false
+	}
+
+	host := r.Host
+	if host == "" && r.URL != nil {
+		host = r.URL.Host
+	}
+	return registrableDomain(host) != registrableDomain(document)
+}
+
+// cookieWhitelisted reports whether host or one of its parent domains is whitelisted
+func (cb *CookieBlocking) cookieWhitelisted(host string) bool {
+	host = normalizeHost(host)
+	for _, domain := range cb.Whitelist {
+		domain = normalizeHost(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// thirdPartyCookiePolicy decides, for a request, whether its Cookie header should be
+// withheld and whether Set-Cookie should be stripped from the response
+func (ps *ProxyServer) thirdPartyCookiePolicy(r *http.Request) (withhold, strip bool) {
+	cb := &ps.config.CookieBlocking
+	if !cb.BlockThirdParty && !cb.WithholdThirdParty {
+		return false, false
+	}
+	if !isThirdPartyRequest(r) || cb.cookieWhitelisted(r.URL.Hostname()) {
+		return false, false
+	}
+	return cb.WithholdThirdParty, cb.BlockThirdParty
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsThirdPartyRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		want    bool
+	}{
+		{"top-level navigation", "http://tracker.example/", nil, false},
+		{"same host", "http://www.example.com/a", map[string]string{"Referer": "http://www.example.com/"}, false},
+		{"same site subdomain", "http://static.example.com/a.js", map[string]string{"Referer": "https://www.example.com/page"}, false},
+		{"public suffix split", "http://b.example.co.uk/", map[string]string{"Referer": "http://a.example.co.uk/"}, false},
+		{"other site", "http://tracker.example/pixel", map[string]string{"Referer": "https://www.example.com/"}, true},
+		{"origin wins over referer", "http://api.example.com/", map[string]string{"Origin": "https://shop.test", "Referer": "https://www.example.com/"}, true},
+		{"null origin falls back to referer", "http://api.example.com/", map[string]string{"Origin": "null", "Referer": "https://www.example.com/"}, false},
+		{"different registrable domain under same suffix", "http://other.co.uk/", map[string]string{"Referer": "http://example.co.uk/"}, true},
+		{"ip address", "http://127.0.0.1:8080/", map[string]string{"Referer": "http://127.0.0.1:9090/"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			if got := isThirdPartyRequest(r); got != tt.want {
+				t.Errorf("isThirdPartyRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieWhitelisted(t *testing.T) {
+	cb := &CookieBlocking{Whitelist: []string{"example.com", "Login.Test."}}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"EXAMPLE.COM:443", true},
+		{"login.test", true},
+		{"notexample.com", false},
+		{"example.com.evil", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := cb.cookieWhitelisted(tt.host); got != tt.want {
+				t.Errorf("cookieWhitelisted(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyThirdPartyCookies(t *testing.T) {
+	var sentCookie string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sentCookie = r.Header.Get("Cookie")
+		http.SetCookie(w, &http.Cookie{Name: "id", Value: "1"})
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	const (
+		firstParty = "http://127.0.0.1/"
+		thirdParty = "https://www.example.com/"
+	)
+
+	tests := []struct {
+		name          string
+		cookies       CookieBlocking
+		referer       string
+		wantSetCookie bool
+		wantCookie    bool
+	}{
+		{"blocking off", CookieBlocking{}, thirdParty, true, true},
+		{"first party", CookieBlocking{BlockThirdParty: true, WithholdThirdParty: true}, firstParty, true, true},
+		{"top-level navigation", CookieBlocking{BlockThirdParty: true, WithholdThirdParty: true}, "", true, true},
+		{"third party stripped", CookieBlocking{BlockThirdParty: true}, thirdParty, false, true},
+		{"third party withheld", CookieBlocking{WithholdThirdParty: true}, thirdParty, true, false},
+		{"third party stripped and withheld", CookieBlocking{BlockThirdParty: true, WithholdThirdParty: true}, thirdParty, false, false},
+		{"third party whitelisted", CookieBlocking{BlockThirdParty: true, WithholdThirdParty: true, Whitelist: []string{"127.0.0.1"}}, thirdParty, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.CookieBlocking = tt.cookies
+			_, addr := startTestProxy(t, config)
+			proxyURL, _ := url.Parse("http://" + addr)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			req, _ := http.NewRequest("GET", upstream.URL+"/", nil)
+			req.Header.Set("Cookie", "session=abc")
+			if tt.referer != "" {
+				req.Header.Set("Referer", tt.referer)
+			}
+			sentCookie = ""
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("GET through proxy: %v", err)
+			}
+			resp.Body.Close()
+
+			if got := len(resp.Header.Values("Set-Cookie")) > 0; got != tt.wantSetCookie {
+				t.Errorf("Set-Cookie kept = %v, want %v", got, tt.wantSetCookie)
+			}
+			if got := sentCookie != ""; got != tt.wantCookie {
+				t.Errorf("Cookie forwarded = %v, want %v", got, tt.wantCookie)
+			}
+		})
+	}
+}
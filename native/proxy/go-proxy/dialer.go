@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// happyEyeballsDelay is the head start given to each connection attempt before the
+// next address is tried (RFC 8305 section 5 recommends 250ms)
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// HappyEyeballsDialer races connections to all addresses of a host, IPv6 and IPv4
+// interleaved, so a broken address family costs a short delay instead of the full
+// dial timeout (RFC 8305)
+type HappyEyeballsDialer struct {
+	dialer   *net.Dialer
+	resolver hostResolver
+	delay    time.Duration
+}
+
+// errPrivateAddress is returned when a public-only dialer is asked for a private address
+var errPrivateAddress = errors.New("destination is a private address")
+
+// dialResult is the outcome of one connection attempt
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// NewHappyEyeballsDialer wraps dialer, which is used for the individual attempts
+func NewHappyEyeballsDialer(dialer *net.Dialer) *HappyEyeballsDialer {
+	return &HappyEyeballsDialer{
+		dialer:   dialer,
+		resolver: net.DefaultResolver,
+		delay:    happyEyeballsDelay,
+	}
+}
+
+// SetResolver replaces the system resolver used to look up hosts
+func (d *HappyEyeballsDialer) SetResolver(resolver hostResolver) {
+	d.resolver = resolver
+}
+
+// Dial connects to address on the named network
+func (d *HappyEyeballsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext resolves address and returns the first connection to succeed. IP
+// literals and non-TCP networks are dialed directly.
+func (d *HappyEyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || network != "tcp" || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := interleaveFamilies(addrs, d.dialer.LocalAddr)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable addresses for %s", host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	startNext := func() {
+		target := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialer.DialContext(ctx, "tcp", target)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(d.delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			// The current attempt is slow: start the next one alongside it
+			if next < len(ips) {
+				startNext()
+				timer.Reset(d.delay)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				cancel()
+				go closeLateConnections(results, pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			// A failed attempt hands over immediately instead of waiting for the timer
+			if next < len(ips) {
+				startNext()
+				timer.Reset(d.delay)
+			}
+		}
+	}
+
+	return nil, firstErr
+}
+
+// publicOnly returns a copy of dialer that refuses to connect to private addresses.
+// The check runs on the address about to be connected to, after resolution, so a
+// public name resolving to a private address is refused too.
+func publicOnly(dialer *net.Dialer) *net.Dialer {
+	restricted := *dialer
+	restricted.Control = func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip != nil && IsPrivateIP(ip) {
+			return errPrivateAddress
+		}
+		return nil
+	}
+	return &restricted
+}
+
+// closeLateConnections closes connections from attempts that lost the race
+func closeLateConnections(results <-chan dialResult, pending int) {
+	for i := 0; i < pending; i++ {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+// interleaveFamilies orders addresses IPv6 first, alternating with IPv4. When the
+// dialer is bound to a local address, only addresses of the same family are kept.
+func interleaveFamilies(addrs []net.IPAddr, localAddr net.Addr) []net.IP {
+	var v6, v4 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.IP)
+		} else {
+			v6 = append(v6, addr.IP)
+		}
+	}
+
+	if tcpAddr, ok := localAddr.(*net.TCPAddr); ok && tcpAddr.IP != nil {
+		if tcpAddr.IP.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+
+	ips := make([]net.IP, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	return ips
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewOutboundDialer(t *testing.T) {
+	tests := []struct {
+		name      string
+		sourceIP  string
+		wantLocal string
+		wantErr   string
+	}{
+		{"unset", "", "", ""},
+		{"loopback", "127.0.0.1", "127.0.0.1", ""},
+		{"not an address", "eth0", "", "invalid outbound source IP"},
+		{"not assigned locally", "192.0.2.1", "", "not assigned to a local interface"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer, err := newOutboundDialer(tt.sourceIP)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newOutboundDialer(%q) = %v, want error containing %q", tt.sourceIP, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newOutboundDialer(%q): %v", tt.sourceIP, err)
+			}
+			if tt.wantLocal == "" {
+				if dialer.LocalAddr != nil {
+					t.Errorf("LocalAddr = %v, want unset", dialer.LocalAddr)
+				}
+				return
+			}
+			local, ok := dialer.LocalAddr.(*net.TCPAddr)
+			if !ok || !local.IP.Equal(net.ParseIP(tt.wantLocal)) {
+				t.Errorf("LocalAddr = %v, want %s", dialer.LocalAddr, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestOutboundSourceIP(t *testing.T) {
+	remotes := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes <- r.RemoteAddr
+	}))
+	defer upstream.Close()
+
+	config := newTestConfig()
+	config.OutboundSourceIP = "127.0.0.1"
+	ps, addr := startTestProxy(t, config)
+	for name, d := range map[string]*HappyEyeballsDialer{"upstream": ps.dialer, "target": ps.targetDialer} {
+		if local, ok := d.dialer.LocalAddr.(*net.TCPAddr); !ok || !local.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("%s dialer LocalAddr = %v, want 127.0.0.1", name, d.dialer.LocalAddr)
+		}
+	}
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("request through proxy: %v", err)
+	}
+	resp.Body.Close()
+
+	host, _, _ := net.SplitHostPort(<-remotes)
+	if host != "127.0.0.1" {
+		t.Errorf("upstream saw the request from %s, want 127.0.0.1", host)
+	}
+
+	config = newTestConfig()
+	config.OutboundSourceIP = "192.0.2.1"
+	if _, err := NewProxyServer(config); err == nil {
+		t.Error("NewProxyServer accepted a source IP that is not assigned locally")
+	}
+}
+
+// staticResolver answers every lookup with the same addresses
+type staticResolver []string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if len(r) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, len(r))
+	for i, addr := range r {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(addr)}
+	}
+	return addrs, nil
+}
+
+// blackholeDialer returns a dialer whose connection attempts to the given
+// addresses hang until the test ends, like packets dropped by a broken route
+func blackholeDialer(t *testing.T, blackholed ...string) *net.Dialer {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			for _, addr := range blackholed {
+				if net.ParseIP(host).Equal(net.ParseIP(addr)) {
+					<-release
+					return errors.New("blackholed")
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tests := []struct {
+		name       string
+		addrs      []string
+		blackholed []string
+		maxElapsed time.Duration
+		wantErr    bool
+	}{
+		// The IPv4 attempt starts after the head start, long before the dial timeout
+		{"blackholed AAAA, working A", []string{"2001:db8::1", "127.0.0.1"}, []string{"2001:db8::1"}, happyEyeballsDelay + time.Second, false},
+		{"several blackholed AAAA", []string{"2001:db8::1", "2001:db8::2", "127.0.0.1"}, []string{"2001:db8::1", "2001:db8::2"}, happyEyeballsDelay + time.Second, false},
+		{"only A", []string{"127.0.0.1"}, nil, time.Second, false},
+		// A refused attempt hands over without waiting for the head start
+		{"refused first address", []string{"127.0.0.2", "127.0.0.1"}, nil, happyEyeballsDelay, false},
+		{"every address refused", []string{"127.0.0.2", "127.0.0.3"}, nil, 0, true},
+		{"no addresses", nil, nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewHappyEyeballsDialer(blackholeDialer(t, tt.blackholed...))
+			d.SetResolver(staticResolver(tt.addrs))
+			start := time.Now()
+			conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("dual-stack.test", port))
+			elapsed := time.Since(start)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("DialContext succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialContext: %v", err)
+			}
+			defer conn.Close()
+
+			if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+				t.Errorf("connected to %s, want 127.0.0.1", got)
+			}
+			if elapsed > tt.maxElapsed {
+				t.Errorf("connect took %v, want at most %v", elapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
+
+func TestHappyEyeballsDialIPLiteral(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A literal is dialed as is and never looked up
+	d := NewHappyEyeballsDialer(&net.Dialer{Timeout: time.Second})
+	d.SetResolver(staticResolver(nil))
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+}
+
+func TestPublicOnly(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tests := []struct {
+		name     string
+		resolver hostResolver
+		host     string
+		restrict bool
+		wantErr  error
+	}{
+		{"loopback literal", nil, "127.0.0.1", true, errPrivateAddress},
+		// Checked after resolution, so a public name cannot rebind to a private address
+		{"name resolving to loopback", staticResolver{"127.0.0.1"}, "rebind.test", true, errPrivateAddress},
+		{"unrestricted", nil, "127.0.0.1", false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &net.Dialer{Timeout: 5 * time.Second}
+			if tt.restrict {
+				base = publicOnly(base)
+			}
+			dialer := NewHappyEyeballsDialer(base)
+			if tt.resolver != nil {
+				dialer.SetResolver(tt.resolver)
+			}
+			conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort(tt.host, port))
+			if conn != nil {
+				conn.Close()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("dial %s = %v, want %v", tt.host, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	tests := []struct {
+		name      string
+		addrs     []string
+		localAddr net.Addr
+		want      string
+	}{
+		{"IPv6 first, alternating", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"}, nil, "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2]"},
+		{"extra IPv4 at the end", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1"}, nil, "[2001:db8::1 192.0.2.1 192.0.2.2 192.0.2.3]"},
+		{"bound to IPv4", []string{"192.0.2.1", "2001:db8::1"}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, "[192.0.2.1]"},
+		{"bound to IPv6", []string{"192.0.2.1", "2001:db8::1"}, &net.TCPAddr{IP: net.ParseIP("::1")}, "[2001:db8::1]"},
+		{"no addresses", nil, nil, "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addrs []net.IPAddr
+			for _, addr := range tt.addrs {
+				addrs = append(addrs, net.IPAddr{IP: net.ParseIP(addr)})
+			}
+			if got := fmt.Sprint(interleaveFamilies(addrs, tt.localAddr)); got != tt.want {
+				t.Errorf("interleaveFamilies = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
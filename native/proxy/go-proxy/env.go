@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the name of every environment variable that overrides a
+// configuration key
+const envPrefix = "OBLIVION_"
+
+// ApplyEnv overrides config with environment variables looked up through lookup,
+// usually os.LookupEnv. Each JSON key has one, named after it in upper case:
+// OBLIVION_LISTEN_PORT sets listen_port. Keys of nested objects are joined with an
+// underscore, as in OBLIVION_COOKIE_BLOCKING_WHITELIST. Lists are comma-separated
+// and maps are comma-separated key=value pairs; an empty value clears either.
+func ApplyEnv(config *Config, lookup func(string) (string, bool)) error {
+	var problems []error
+	applyEnvFields(reflect.ValueOf(config).Elem(), envPrefix, lookup, &problems)
+	return errors.Join(problems...)
+}
+
+// applyEnvFields sets the fields of the struct v from the variables under prefix
+func applyEnvFields(v reflect.Value, prefix string, lookup func(string) (string, bool), problems *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+
+		if field.Type.Kind() == reflect.Struct {
+			applyEnvFields(v.Field(i), name+"_", lookup, problems)
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(v.Field(i), value); err != nil {
+			*problems = append(*problems, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+}
+
+// setEnvValue parses value into field according to its type
+func setEnvValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean (use true or false)", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		items := splitEnvList(value)
+		list := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setEnvValue(list.Index(i), item); err != nil {
+				return err
+			}
+		}
+		field.Set(list)
+	case reflect.Map:
+		items := splitEnvList(value)
+		m := reflect.MakeMapWithSize(field.Type(), len(items))
+		for _, item := range items {
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("%q is not a key=value pair", item)
+			}
+			elem := reflect.New(field.Type().Elem()).Elem()
+			if err := setEnvValue(elem, strings.TrimSpace(v)); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), elem)
+		}
+		field.Set(m)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+// splitEnvList splits a comma-separated value, trimming spaces and skipping empty
+// entries
+func splitEnvList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
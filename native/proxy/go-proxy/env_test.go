@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// envLookup serves lookups from a fixed set of variables
+func envLookup(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		vars  map[string]string
+		check func(*Config) interface{}
+		want  interface{}
+	}{
+		{"string", map[string]string{"OBLIVION_LOG_LEVEL": "debug"}, func(c *Config) interface{} { return c.LogLevel }, "debug"},
+		{"int", map[string]string{"OBLIVION_LISTEN_PORT": "3128"}, func(c *Config) interface{} { return c.ListenPort }, 3128},
+		{"int64", map[string]string{"OBLIVION_BANDWIDTH_LIMIT": "1048576"}, func(c *Config) interface{} { return c.BandwidthLimit }, int64(1048576)},
+		{"bool", map[string]string{"OBLIVION_TLS_ENABLED": "true"}, func(c *Config) interface{} { return c.TLSEnabled }, true},
+		{"string list", map[string]string{"OBLIVION_FILTER_RULES": "||ads.test^, ||track.test^,"}, func(c *Config) interface{} { return c.FilterRules }, []string{"||ads.test^", "||track.test^"}},
+		{"int list", map[string]string{"OBLIVION_CONNECT_ALLOWED_PORTS": "443,8443,9443"}, func(c *Config) interface{} { return c.ConnectAllowedPorts }, []int{443, 8443, 9443}},
+		{"empty list clears", map[string]string{"OBLIVION_CONNECT_ALLOWED_PORTS": ""}, func(c *Config) interface{} { return len(c.ConnectAllowedPorts) }, 0},
+		{"map", map[string]string{"OBLIVION_CUSTOM_HEADERS": "X-One=1, X-Two = 2"}, func(c *Config) interface{} { return c.CustomHeaders }, map[string]string{"X-One": "1", "X-Two": "2"}},
+		{"nested", map[string]string{"OBLIVION_COOKIE_BLOCKING_WHITELIST": "example.com,example.org"}, func(c *Config) interface{} { return c.CookieBlocking.Whitelist }, []string{"example.com", "example.org"}},
+		{"unset leaves the value", map[string]string{}, func(c *Config) interface{} { return c.ListenPort }, 8080},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			if err := ApplyEnv(config, envLookup(tt.vars)); err != nil {
+				t.Fatalf("ApplyEnv: %v", err)
+			}
+			if got := tt.check(config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	err := ApplyEnv(DefaultConfig(), envLookup(map[string]string{
+		"OBLIVION_LISTEN_PORT":           "http",
+		"OBLIVION_TLS_ENABLED":           "yes please",
+		"OBLIVION_CONNECT_ALLOWED_PORTS": "443,https",
+		"OBLIVION_CUSTOM_HEADERS":        "X-One",
+	}))
+	if err == nil {
+		t.Fatal("ApplyEnv accepted invalid values")
+	}
+	for _, want := range []string{
+		`OBLIVION_LISTEN_PORT: "http" is not an integer`,
+		`OBLIVION_TLS_ENABLED: "yes please" is not a boolean`,
+		`OBLIVION_CONNECT_ALLOWED_PORTS: "https" is not an integer`,
+		`OBLIVION_CUSTOM_HEADERS: "X-One" is not a key=value pair`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ApplyEnv error lacks %q:\n%v", want, err)
+		}
+	}
+}
+
+// testFlags parses args with the configuration flags main defines
+func testFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	flags := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Int("port", 8080, "")
+	flags.String("addr", "127.0.0.1", "")
+	flags.String("filters", "", "")
+	flags.Bool("tls", false, "")
+	flags.String("cert", "", "")
+	flags.String("key", "", "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
+
+// Settings take precedence in the order defaults < file < environment < flags
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"listen_port": 9000, "listen_addr": "0.0.0.0", "log_level": "warn"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type settings struct {
+		port     int
+		addr     string
+		logLevel string
+		upstream string
+	}
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want settings
+	}{
+		{"defaults", "", nil, nil, settings{8080, "127.0.0.1", "info", ""}},
+		{"file over defaults", path, nil, nil, settings{9000, "0.0.0.0", "warn", ""}},
+		{"env over defaults", "", map[string]string{"OBLIVION_LISTEN_PORT": "9100"}, nil, settings{9100, "127.0.0.1", "info", ""}},
+		{"env over file", path, map[string]string{
+			"OBLIVION_LISTEN_PORT":    "9100",
+			"OBLIVION_LOG_LEVEL":      "error",
+			"OBLIVION_UPSTREAM_PROXY": "http://upstream.test:3128",
+		}, nil, settings{9100, "0.0.0.0", "error", "http://upstream.test:3128"}},
+		{"flags over env", path, map[string]string{
+			"OBLIVION_LISTEN_PORT": "9100",
+			"OBLIVION_LISTEN_ADDR": "10.0.0.1",
+		}, []string{"-port", "9200", "-addr", "127.0.0.2"}, settings{9200, "127.0.0.2", "warn", ""}},
+		// A flag left at its default does not undo the file or the environment
+		{"unset flags keep env", path, map[string]string{"OBLIVION_LISTEN_PORT": "9100"}, []string{"-addr", "127.0.0.2"}, settings{9100, "127.0.0.2", "warn", ""}},
+		{"flag at its default value still wins", path, nil, []string{"-port", "8080"}, settings{8080, "0.0.0.0", "warn", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			config, err := LoadConfig(tt.file, testFlags(t, tt.args...))
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+
+			got := settings{config.ListenPort, config.ListenAddr, config.LogLevel, config.UpstreamProxy}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyFlagsTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantTLS  bool
+		wantCert string
+	}{
+		{"tls off", []string{"-cert", "flag.pem"}, false, "env.pem"},
+		{"tls on keeps cert", []string{"-tls"}, true, "env.pem"},
+		{"tls on with cert", []string{"-tls", "-cert", "flag.pem"}, true, "flag.pem"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.CertFile = "env.pem"
+			applyFlags(config, testFlags(t, tt.args...))
+			if config.TLSEnabled != tt.wantTLS || config.CertFile != tt.wantCert {
+				t.Errorf("tls_enabled = %v, cert_file = %q, want %v, %q", config.TLSEnabled, config.CertFile, tt.wantTLS, tt.wantCert)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvErrors(t *testing.T) {
+	t.Setenv("OBLIVION_LISTEN_PORT", "http")
+	_, err := LoadConfig("", nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid environment configuration") {
+		t.Errorf("LoadConfig = %v, want an environment configuration error", err)
+	}
+
+	// Values that parse are still validated
+	t.Setenv("OBLIVION_LISTEN_PORT", "70000")
+	_, err = LoadConfig("", nil)
+	if err == nil || !strings.Contains(err.Error(), "listen_port") {
+		t.Errorf("LoadConfig = %v, want a listen_port error", err)
+	}
+}
+
+// Validation runs once every source is applied, so a flag can both break a valid
+// configuration and complete one the file and environment leave invalid
+func TestLoadConfigValidatesFlags(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.txt")
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"flag makes the port invalid", map[string]string{"OBLIVION_LISTEN_PORT": "9100"}, []string{"-port", "70000"}, "listen_port"},
+		{"persist_rules without a rules file", map[string]string{"OBLIVION_PERSIST_RULES": "true"}, nil, "persist_rules"},
+		{"filters flag supplies the rules file", map[string]string{"OBLIVION_PERSIST_RULES": "true"}, []string{"-filters", rules}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			config, err := LoadConfig("", testFlags(t, tt.args...))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				if config.RulesFile != rules {
+					t.Errorf("rules_file = %q, want %q", config.RulesFile, rules)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig = %v, want a %s error", err, tt.wantErr)
+			}
+		})
+	}
+}
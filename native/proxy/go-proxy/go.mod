@@ -3,10 +3,8 @@ module github.com/734ai/OblivionFilter/native/proxy/go-proxy
 go 1.21
 
 require (
-	github.com/gorilla/mux v1.8.0
-	github.com/gorilla/websocket v1.5.0
+	github.com/fsnotify/fsnotify v1.7.0
 	golang.org/x/net v0.17.0
-	golang.org/x/crypto v0.14.0
 )
 
 require (
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// gRPC status codes returned by the proxy itself
+const (
+	grpcStatusPermissionDenied = 7
+	grpcStatusUnavailable      = 14
+)
+
+// isGRPCRequest reports whether r is a gRPC call. gRPC-Web is plain HTTP and is
+// proxied like any other request.
+func isGRPCRequest(r *http.Request) bool {
+	if r.ProtoMajor != 2 {
+		return false
+	}
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// newGRPCTransport creates an HTTP/2 transport dialing through the proxy's dialer,
+// speaking h2c when plaintext is set and HTTP/2 over TLS otherwise
+func newGRPCTransport(dialer *HappyEyeballsDialer, plaintext bool) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: plaintext,
+		DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || plaintext {
+				return conn, err
+			}
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+}
+
+// handleGRPC forwards a gRPC call to the service named by its authority. Calls
+// that arrived over TLS go upstream over TLS, h2c calls over h2c. Request and
+// response bodies stream independently, so bidirectional calls work, and the
+// upstream trailers carrying grpc-status are passed back to the client.
+func (ps *ProxyServer) handleGRPC(w http.ResponseWriter, r *http.Request, startTime time.Time) {
+	scheme, transport := "http", ps.grpcTransport
+	if r.TLS != nil {
+		scheme, transport = "https", ps.grpcTLSTransport
+	}
+	r.URL.Scheme = scheme
+	r.URL.Host = r.Host
+
+	// Rules see the method path, /package.Service/Method
+	if blocked, reason := ps.filterEngine.Evaluate(r); blocked {
+		ps.logger.Access("Blocked gRPC: %s (%s)", r.URL.String(), reason)
+		ps.updateStats(0, 1, 0)
+		ps.recordBlocked(r.Host)
+		writeGRPCStatus(w, grpcStatusPermissionDenied, "blocked by filter: "+reason)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.URL = &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path}
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Authorization")
+
+	resp, err := transport.RoundTrip(req)
+	if errors.Is(err, errPrivateAddress) {
+		ps.logger.Access("Refused gRPC call to private address: %s", r.Host)
+		writeGRPCStatus(w, grpcStatusPermissionDenied, "calls to private addresses are not allowed")
+		return
+	}
+	if err != nil {
+		ps.logger.Error("gRPC request failed: %v", err)
+		writeGRPCStatus(w, grpcStatusUnavailable, "upstream unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+
+	// Calls may stream for as long as both ends keep them open
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+
+	w.WriteHeader(resp.StatusCode)
+	controller.Flush()
+
+	written, err := io.Copy(&flushWriter{w: w, controller: controller}, ps.throttle(resp.Body, ps.connectionBucket()))
+	if err != nil {
+		ps.logger.Error("Failed to copy gRPC response: %v", err)
+	}
+
+	// Trailers are only complete once the body has been read
+	for key, values := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+key] = values
+	}
+
+	duration := time.Since(startTime)
+	ps.updateStats(0, 0, written)
+	ps.updateResponseTime(duration)
+
+	ps.logger.Access("gRPC %s %s %d bytes %v", r.URL.String(), resp.Trailer.Get("Grpc-Status"), written, duration)
+}
+
+// writeGRPCStatus answers a call with a trailers-only gRPC error
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
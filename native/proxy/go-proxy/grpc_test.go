@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame wraps a message in the gRPC length-prefixed framing, uncompressed
+func grpcFrame(msg string) []byte {
+	frame := []byte{0}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// readGRPCFrame reads one length-prefixed message
+func readGRPCFrame(r io.Reader) (string, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// startEchoService serves a gRPC echo service over h2c. Unary echoes its single
+// message; Stream echoes each message as it arrives until the client half-closes.
+func startEchoService(t *testing.T) *httptest.Server {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		switch r.URL.Path {
+		case "/echo.Echo/Unary", "/echo.Echo/Stream":
+			for {
+				msg, err := readGRPCFrame(r.Body)
+				if err != nil {
+					break
+				}
+				w.Write(grpcFrame("echo: " + msg))
+				w.(http.Flusher).Flush()
+				if r.URL.Path == "/echo.Echo/Unary" {
+					break
+				}
+			}
+			w.Header().Set("Grpc-Status", "0")
+		default:
+			w.Header().Set("Grpc-Status", "12")
+			w.Header().Set("Grpc-Message", "unimplemented")
+		}
+	})
+
+	upstream := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// grpcClient speaks h2c to the proxy at addr whatever host a request names
+func grpcClient(addr string) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func newGRPCRequest(t *testing.T, host, method string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("POST", "http://"+host+method, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	return req
+}
+
+func TestIsGRPCRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		protoMajor  int
+		contentType string
+		want        bool
+	}{
+		{"grpc", 2, "application/grpc", true},
+		{"grpc with codec", 2, "application/grpc+proto", true},
+		{"grpc with parameters", 2, "application/grpc; charset=utf-8", true},
+		{"grpc-web", 2, "application/grpc-web", false},
+		{"http/1.1", 1, "application/grpc", false},
+		{"json over h2", 2, "application/json", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/echo.Echo/Unary", nil)
+			r.ProtoMajor = tt.protoMajor
+			r.Header.Set("Content-Type", tt.contentType)
+			if got := isGRPCRequest(r); got != tt.want {
+				t.Errorf("isGRPCRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyGRPCUnary(t *testing.T) {
+	upstream := startEchoService(t)
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	config := newTestConfig()
+	config.GRPCProxy = true
+	ps, addr := startTestProxy(t, config)
+	if _, err := ps.filterEngine.AddRule("/echo.Echo/Forbidden"); err != nil {
+		t.Fatal(err)
+	}
+	client := grpcClient(addr)
+
+	tests := []struct {
+		name        string
+		host        string
+		method      string
+		wantMessage string
+		wantStatus  string
+	}{
+		{"echo", upstreamHost, "/echo.Echo/Unary", "echo: hello", "0"},
+		{"upstream status passed through", upstreamHost, "/echo.Echo/Missing", "", "12"},
+		{"method blocked by path rule", upstreamHost, "/echo.Echo/Forbidden", "", "7"},
+		{"upstream unavailable", closedAddr(t), "/echo.Echo/Unary", "", "14"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.RoundTrip(newGRPCRequest(t, tt.host, tt.method, bytes.NewReader(grpcFrame("hello"))))
+			if err != nil {
+				t.Fatalf("call through proxy: %v", err)
+			}
+			defer resp.Body.Close()
+
+			msg, err := readGRPCFrame(resp.Body)
+			if tt.wantMessage != "" && (err != nil || msg != tt.wantMessage) {
+				t.Errorf("message = %q, %v, want %q", msg, err, tt.wantMessage)
+			}
+			io.Copy(io.Discard, resp.Body)
+
+			// Trailers-only responses carry the status in the headers
+			status := resp.Trailer.Get("Grpc-Status")
+			if status == "" {
+				status = resp.Header.Get("Grpc-Status")
+			}
+			if status != tt.wantStatus {
+				t.Errorf("grpc-status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestProxyGRPCBlockPrivateDestinations(t *testing.T) {
+	upstream := startEchoService(t)
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	config := newTestConfig()
+	config.GRPCProxy = true
+	config.BlockPrivateDestinations = true
+	_, addr := startTestProxy(t, config)
+	client := grpcClient(addr)
+
+	for _, host := range []string{strings.TrimPrefix(upstream.URL, "http://"), net.JoinHostPort("localhost", port)} {
+		resp, err := client.RoundTrip(newGRPCRequest(t, host, "/echo.Echo/Unary", bytes.NewReader(grpcFrame("hello"))))
+		if err != nil {
+			t.Fatalf("call through proxy: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		status := resp.Trailer.Get("Grpc-Status")
+		if status == "" {
+			status = resp.Header.Get("Grpc-Status")
+		}
+		if status != "7" {
+			t.Errorf("call to %s: grpc-status = %q, want 7 (permission denied)", host, status)
+		}
+	}
+}
+
+// Each reply arrives before the next request message is sent
+func TestProxyGRPCBidiStream(t *testing.T) {
+	upstream := startEchoService(t)
+	config := newTestConfig()
+	config.GRPCProxy = true
+	_, addr := startTestProxy(t, config)
+
+	requestBody, requestWriter := io.Pipe()
+	req := newGRPCRequest(t, strings.TrimPrefix(upstream.URL, "http://"), "/echo.Echo/Stream", requestBody)
+	resp, err := grpcClient(addr).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("call through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	for _, msg := range []string{"one", "two", "three"} {
+		if _, err := requestWriter.Write(grpcFrame(msg)); err != nil {
+			t.Fatalf("send %q: %v", msg, err)
+		}
+		got, err := readGRPCFrame(resp.Body)
+		if err != nil {
+			t.Fatalf("receive reply to %q: %v", msg, err)
+		}
+		if got != "echo: "+msg {
+			t.Errorf("reply = %q, want %q", got, "echo: "+msg)
+		}
+	}
+	requestWriter.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("finish stream: %v", err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("grpc-status = %q, want 0", status)
+	}
+}
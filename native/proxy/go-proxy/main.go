@@ -160,7 +160,6 @@ type ProxyStats struct {
 	BlockedRequests   int64     `json:"blocked_requests"`
 	ModifiedRequests  int64     `json:"modified_requests"`
 	BytesTransferred  int64     `json:"bytes_transferred"`
-	ActiveConnections int32     `json:"active_connections"`
 	Uptime           time.Duration `json:"uptime"`
 	StartTime        time.Time     `json:"start_time"`
 	mutex            sync.RWMutex
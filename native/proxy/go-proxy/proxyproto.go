@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyProtoV1MaxLen     = 107
+	proxyProtoV2HeaderLen  = 16
+	proxyProtoV2MaxAddrLen = 4096 // addresses plus TLVs; balancers send a few hundred bytes at most
+	proxyProtoReadTimeout  = 5 * time.Second
+)
+
+// proxyProtoV2Signature starts every PROXY protocol v2 header
+var proxyProtoV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errNoProxyHeader is returned when a connection does not start with a PROXY header
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// ParseTrustedNetworks parses IPs and CIDRs into networks; bare IPs become /32 or /128
+func ParseTrustedNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ProxyProtoListener recovers the real client address from PROXY protocol v1/v2
+// headers. Only connections from trusted peers are parsed; anyone else is served
+// with their own address, so the header cannot be used to spoof a client IP.
+type ProxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	logger  *Logger
+}
+
+// NewProxyProtoListener wraps listener to honour PROXY headers from trusted peers
+func NewProxyProtoListener(listener net.Listener, trusted []*net.IPNet, logger *Logger) *ProxyProtoListener {
+	return &ProxyProtoListener{Listener: listener, trusted: trusted, logger: logger}
+}
+
+// Accept returns the next connection. The header is read lazily on first use so a
+// slow peer cannot stall the accept loop.
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReaderSize(conn, 512), logger: l.logger}, nil
+}
+
+// isTrusted reports whether addr belongs to a trusted downstream network
+func (l *ProxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn reports the address from the PROXY header as its remote address
+type proxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+	logger     *Logger
+}
+
+// init consumes the PROXY header, if any, exactly once
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoReadTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		addr, err := ReadProxyHeader(c.reader)
+		switch {
+		case err == errNoProxyHeader:
+		case err != nil:
+			c.err = err
+			if c.logger != nil {
+				c.logger.Error("Invalid PROXY header from %s: %v", c.Conn.RemoteAddr(), err)
+			}
+		default:
+			c.remoteAddr = addr
+		}
+	})
+}
+
+// Read returns data following the PROXY header
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address carried in the PROXY header, or the peer
+// address when the header was absent or described a local connection
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ReadProxyHeader consumes a PROXY protocol v1 or v2 header from r. It returns a nil
+// address for LOCAL/UNKNOWN headers and errNoProxyHeader, consuming nothing, when the
+// stream does not start with a header.
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyProtoV2Signature))
+	if err == nil && bytes.Equal(peek, proxyProtoV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	peek, _ = r.Peek(6)
+	if string(peek) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+
+	return nil, errNoProxyHeader
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtoV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading v1 header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header longer than %d bytes", proxyProtoV1MaxLen)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 parses the binary v2 header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyProtoV2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %v", err)
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+
+	// The length covers the addresses and any TLVs after them. TLVs are read
+	// along with the addresses and ignored.
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if length > proxyProtoV2MaxAddrLen {
+		return nil, fmt.Errorf("v2 address block too large: %d bytes", length)
+	}
+	addrs := make([]byte, length)
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, fmt.Errorf("reading v2 addresses: %v", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL: health checks from the balancer itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	default:
+		// UDP and Unix sockets carry no client IP we can use
+		return nil, nil
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyHeaderV2 builds a v2 header with the given command, family and address block
+func proxyHeaderV2(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyProtoV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// v2Addrs builds a v2 address block: source and destination IPs, then their ports
+func v2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	block := append(append([]byte{}, src...), dst...)
+	block = binary.BigEndian.AppendUint16(block, srcPort)
+	return binary.BigEndian.AppendUint16(block, dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := v2Addrs(net.IPv4(203, 0, 113, 7).To4(), net.IPv4(10, 0, 0, 1).To4(), 51000, 8080)
+	v6 := v2Addrs(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1"), 51000, 8080)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string // empty for no address
+		wantErr string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 8080\r\n"), "203.0.113.7:51000", ""},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 8080\r\n"), "[2001:db8::7]:51000", ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::7 2001:db8::1 51000 8080\r\n"), "", "invalid v1 source address"},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 99999 8080\r\n"), "", "invalid v1 source port"},
+		{"v1 missing fields", []byte("PROXY TCP4 203.0.113.7\r\n"), "", "malformed v1 header"},
+		{"v1 unterminated", []byte("PROXY TCP4 " + strings.Repeat("1", 120)), "", "longer than"},
+		{"v2 ipv4", proxyHeaderV2(0x1, 0x11, v4), "203.0.113.7:51000", ""},
+		{"v2 ipv6", proxyHeaderV2(0x1, 0x21, v6), "[2001:db8::7]:51000", ""},
+		{"v2 local", proxyHeaderV2(0x0, 0x11, v4), "", ""},
+		{"v2 udp", proxyHeaderV2(0x1, 0x12, v4), "", ""},
+		{"v2 short ipv4 block", proxyHeaderV2(0x1, 0x11, v4[:8]), "", "short v2 IPv4"},
+		{"v2 bad command", proxyHeaderV2(0x2, 0x11, v4), "", "unsupported v2 command"},
+		{"v2 truncated", proxyHeaderV2(0x1, 0x11, v4)[:20], "", "reading v2 addresses"},
+		{"v2 too large", proxyHeaderV2(0x1, 0x11, make([]byte, proxyProtoV2MaxAddrLen+1)), "", "too large"},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", errNoProxyHeader.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ReadProxyHeader = %v, %v, want error containing %q", addr, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadProxyHeader: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderV2SkipsTLVs(t *testing.T) {
+	// An authority TLV and a padding TLV push the block past the 216 bytes of a v6 address
+	addrs := v2Addrs(net.IPv4(203, 0, 113, 7).To4(), net.IPv4(10, 0, 0, 1).To4(), 51000, 8080)
+	addrs = append(addrs, 0x02, 0, 11)
+	addrs = append(addrs, "example.com"...)
+	addrs = append(addrs, 0x04, 0x01, 0x2c)
+	addrs = append(addrs, make([]byte, 300)...)
+
+	r := bufio.NewReader(bytes.NewReader(append(proxyHeaderV2(0x1, 0x11, addrs), "GET / HTTP/1.1\r\n"...)))
+	addr, err := ReadProxyHeader(r)
+	if err != nil {
+		t.Fatalf("ReadProxyHeader: %v", err)
+	}
+	if addr.String() != "203.0.113.7:51000" {
+		t.Errorf("address = %s, want 203.0.113.7:51000", addr)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("data after the header = %q, want the request line", rest)
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	v2 := proxyHeaderV2(0x1, 0x11, v2Addrs(net.IPv4(198, 51, 100, 9).To4(), net.IPv4(10, 0, 0, 1).To4(), 40000, 8080))
+
+	tests := []struct {
+		name     string
+		trusted  []string
+		header   []byte
+		wantAddr string // empty for the peer's own address
+		wantData string
+	}{
+		{"trusted v1", []string{"127.0.0.0/8"}, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 8080\r\n"), "203.0.113.7:51000", "hello from the client"},
+		{"trusted v2", []string{"127.0.0.1"}, v2, "198.51.100.9:40000", "hello from the client"},
+		{"trusted without header", []string{"127.0.0.1"}, nil, "", "hello from the client"},
+		{"untrusted peer", []string{"192.0.2.0/24"}, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 8080\r\n"), "", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 8080\r\nhello from the client"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			trusted, err := ParseTrustedNetworks(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := NewProxyProtoListener(inner, trusted, nil)
+			defer listener.Close()
+
+			client, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			go client.Write(append(append([]byte{}, tt.header...), "hello from the client"...))
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := tt.wantAddr
+			if want == "" {
+				want = client.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr = %s, want %s", got, want)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			data := make([]byte, len(tt.wantData))
+			if _, err := io.ReadFull(conn, data); err != nil || string(data) != tt.wantData {
+				t.Errorf("read %q, %v, want %q", data, err, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	tests := []struct {
+		name          string
+		proxyProtocol bool
+		trusted       []string
+		remoteAddr    string
+		xff           []string
+		realIP        string
+		want          string
+	}{
+		{"no headers", false, nil, "203.0.113.7:4000", nil, "", "203.0.113.7"},
+		{"untrusted peer spoofing xff", false, nil, "203.0.113.7:4000", []string{"1.2.3.4"}, "", "203.0.113.7"},
+		{"untrusted peer spoofing real ip", false, nil, "203.0.113.7:4000", nil, "1.2.3.4", "203.0.113.7"},
+		{"trusted proxy", false, []string{"10.0.0.0/8"}, "10.0.0.2:4000", []string{"198.51.100.9"}, "", "198.51.100.9"},
+		{"trusted chain", false, []string{"10.0.0.0/8"}, "10.0.0.2:4000", []string{"1.2.3.4, 198.51.100.9, 10.0.0.3"}, "", "198.51.100.9"},
+		{"repeated header", false, []string{"10.0.0.0/8"}, "10.0.0.2:4000", []string{"1.2.3.4", "198.51.100.9"}, "", "198.51.100.9"},
+		{"only proxies", false, []string{"10.0.0.0/8"}, "10.0.0.2:4000", []string{"10.0.0.4, 10.0.0.3"}, "", "10.0.0.4"},
+		{"garbage xff", false, []string{"10.0.0.0/8"}, "10.0.0.2:4000", []string{"not-an-ip"}, "", "10.0.0.2"},
+		{"trusted real ip", false, []string{"10.0.0.0/8"}, "10.0.0.2:4000", nil, "198.51.100.9", "198.51.100.9"},
+		{"proxy protocol ignores xff", true, []string{"10.0.0.0/8"}, "198.51.100.9:4000", []string{"1.2.3.4"}, "5.6.7.8", "198.51.100.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.ProxyProtocol = tt.proxyProtocol
+			config.ProxyProtocolTrusted = []string{"10.0.0.1"}
+			config.TrustedProxies = tt.trusted
+			ps, err := NewProxyServer(config)
+			if err != nil {
+				t.Fatalf("NewProxyServer: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.xff {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := ps.getClientIP(r); got != tt.want {
+				t.Errorf("getClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlackholeResetThroughProxyProtoConn(t *testing.T) {
+	config := newTestConfig()
+	config.SNIBlackholeAction = "reset"
+	ps, err := NewProxyServer(config)
+	if err != nil {
+		t.Fatalf("NewProxyServer: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	trusted, _ := ParseTrustedNetworks([]string{"127.0.0.1"})
+	wrapped := NewProxyProtoListener(listener, trusted, nil)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 8080\r\n"))
+
+	conn, err := wrapped.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if underlyingTCPConn(conn) == nil {
+		t.Fatal("no TCP connection found beneath the PROXY protocol conn")
+	}
+	conn.RemoteAddr()
+	ps.blackholeConnection(conn)
+	conn.Close()
+
+	// SO_LINGER 0 turns the close into a reset instead of an orderly FIN
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if err == nil || err == io.EOF || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("client read after reset = %v, want connection reset", err)
+	}
+}
+
+func TestUnderlyingTCPConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tcpConn := conn.(*net.TCPConn)
+
+	tests := []struct {
+		name string
+		conn net.Conn
+		want *net.TCPConn
+	}{
+		{"tcp", tcpConn, tcpConn},
+		{"tls", tls.Server(tcpConn, &tls.Config{}), tcpConn},
+		{"proxy protocol", &proxyProtoConn{Conn: tcpConn}, tcpConn},
+		{"tls over proxy protocol", tls.Server(&proxyProtoConn{Conn: tcpConn}, &tls.Config{}), tcpConn},
+		{"pipe", &addrConn{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := underlyingTCPConn(tt.conn); got != tt.want {
+				t.Errorf("underlyingTCPConn = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
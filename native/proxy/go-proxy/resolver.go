@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// defaultDNSCacheTTL bounds how long an answer is cached, and is how long
+	// answers from the system resolver, which hides TTLs, are kept
+	defaultDNSCacheTTL = 60 * time.Second
+
+	// dnsQueryTimeout applies to queries made without a context deadline
+	dnsQueryTimeout = 5 * time.Second
+
+	// dnsMaxUDPResponse is the largest response read over UDP
+	dnsMaxUDPResponse = 4096
+)
+
+// hostResolver looks up the addresses of a host; *net.Resolver is one
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// CachingResolver caches host lookups until their TTL expires. With a server set,
+// queries go to it directly, which lets the proxy resolve through the local DNS
+// filter and honour the TTLs it returns. Otherwise the system resolver is used and
+// answers are kept for maxTTL.
+type CachingResolver struct {
+	server  string
+	maxTTL  time.Duration
+	system  *net.Resolver
+	entries map[string]resolverEntry
+	now     func() time.Time
+	mu      sync.Mutex
+}
+
+// resolverEntry is a cached answer
+type resolverEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// NewCachingResolver creates a resolver querying server (host:port), or the system
+// resolver when server is empty, caching answers for at most maxTTL
+func NewCachingResolver(server string, maxTTL time.Duration) *CachingResolver {
+	if maxTTL <= 0 {
+		maxTTL = defaultDNSCacheTTL
+	}
+	return &CachingResolver{
+		server:  server,
+		maxTTL:  maxTTL,
+		system:  net.DefaultResolver,
+		entries: make(map[string]resolverEntry),
+		now:     time.Now,
+	}
+}
+
+// LookupIPAddr returns the cached addresses of host, resolving them if they are
+// missing or expired. Failed lookups are not cached.
+func (cr *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	cr.mu.Lock()
+	entry, ok := cr.entries[host]
+	cr.mu.Unlock()
+	if ok && cr.now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, ttl, err := cr.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > cr.maxTTL {
+		ttl = cr.maxTTL
+	}
+
+	cr.mu.Lock()
+	if ttl > 0 {
+		cr.entries[host] = resolverEntry{addrs: addrs, expires: cr.now().Add(ttl)}
+	} else {
+		delete(cr.entries, host)
+	}
+	cr.mu.Unlock()
+
+	return addrs, nil
+}
+
+// Flush forgets every cached answer
+func (cr *CachingResolver) Flush() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.entries = make(map[string]resolverEntry)
+}
+
+// resolve looks up the A and AAAA records of host and the shortest TTL among them
+func (cr *CachingResolver) resolve(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	if cr.server == "" {
+		addrs, err := cr.system.LookupIPAddr(ctx, host)
+		return addrs, cr.maxTTL, err
+	}
+
+	type answer struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	answers := make(chan answer, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			addrs, ttl, err := cr.query(ctx, host, qtype)
+			answers <- answer{addrs, ttl, err}
+		}(qtype)
+	}
+
+	var addrs []net.IPAddr
+	ttl := cr.maxTTL
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		if a.err != nil {
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			continue
+		}
+		if len(a.addrs) > 0 {
+			addrs = append(addrs, a.addrs...)
+			if a.ttl < ttl {
+				ttl = a.ttl
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		if firstErr != nil {
+			return nil, 0, firstErr
+		}
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: cr.server, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+// query asks the server for one record type of host
+func (cr *CachingResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid host name %q: %v", host, err)
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := cr.exchange(ctx, "udp", packet)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid DNS response: %v", err)
+	}
+	if header.Truncated {
+		// Too large for UDP: ask again over TCP
+		if response, err = cr.exchange(ctx, "tcp", packet); err != nil {
+			return nil, 0, err
+		}
+		if header, err = parser.Start(response); err != nil {
+			return nil, 0, fmt.Errorf("invalid DNS response: %v", err)
+		}
+	}
+	if header.ID != msg.Header.ID {
+		return nil, 0, errors.New("DNS response ID mismatch")
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: cr.server, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server failure: " + header.RCode.String(), Name: host, Server: cr.server}
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0, fmt.Errorf("invalid DNS response: %v", err)
+	}
+
+	// CNAMEs are followed by the server; only the final addresses matter
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	for {
+		rh, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid DNS response: %v", err)
+		}
+
+		var ip net.IP
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid A record: %v", err)
+			}
+			ip = net.IP(r.A[:])
+		case dnsmessage.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid AAAA record: %v", err)
+			}
+			ip = net.IP(r.AAAA[:])
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, fmt.Errorf("invalid DNS response: %v", err)
+			}
+			continue
+		}
+
+		recordTTL := time.Duration(rh.TTL) * time.Second
+		if len(addrs) == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+
+	return addrs, ttl, nil
+}
+
+// exchange sends a query to the server and returns the raw response
+func (cr *CachingResolver) exchange(ctx context.Context, network string, packet []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, cr.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsQueryTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsMaxUDPResponse)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// Over TCP every message is preceded by its length
+	framed := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(framed, uint16(len(packet)))
+	copy(framed[2:], packet)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
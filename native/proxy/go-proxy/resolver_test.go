@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSRecord is what the fake server answers for a name
+type fakeDNSRecord struct {
+	a        []string
+	aaaa     []string
+	ttl      uint32
+	truncate bool // set TC over UDP so the client retries over TCP
+}
+
+// fakeDNSServer answers A and AAAA queries over UDP and TCP on the same port and
+// counts the queries it gets per name, type and network
+type fakeDNSServer struct {
+	addr    string
+	records map[string]fakeDNSRecord
+	queries map[string]int
+	mu      sync.Mutex
+}
+
+func startFakeDNSServer(t *testing.T, records map[string]fakeDNSRecord) *fakeDNSServer {
+	t.Helper()
+	s := &fakeDNSServer{records: records, queries: make(map[string]int)}
+
+	// The TCP listener has to share the UDP port, which may already be taken
+	var packetConn net.PacketConn
+	var listener net.Listener
+	for attempt := 0; listener == nil; attempt++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, err := net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			packetConn, listener = pc, l
+		} else if pc.Close(); attempt == 10 {
+			t.Fatalf("no port free for both UDP and TCP: %v", err)
+		}
+	}
+	s.addr = packetConn.LocalAddr().String()
+	t.Cleanup(func() {
+		packetConn.Close()
+		listener.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := s.answer(buf[:n], "udp"); response != nil {
+				packetConn.WriteTo(response, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				response := s.answer(query, "tcp")
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeDNSServer) answer(query []byte, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+
+	s.mu.Lock()
+	s.queries[name+" "+question.Type.String()+" "+network]++
+	record, ok := s.records[name]
+	s.mu.Unlock()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:        header.ID,
+		Response:  true,
+		RCode:     dnsmessage.RCodeSuccess,
+		Truncated: ok && record.truncate && network == "udp",
+	})
+	if !ok {
+		builder = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RCode: dnsmessage.RCodeNameError})
+	}
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+	if ok && !(record.truncate && network == "udp") {
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: record.ttl}
+		switch question.Type {
+		case dnsmessage.TypeA:
+			for _, ip := range record.a {
+				var a [4]byte
+				copy(a[:], net.ParseIP(ip).To4())
+				builder.AResource(rh, dnsmessage.AResource{A: a})
+			}
+		case dnsmessage.TypeAAAA:
+			for _, ip := range record.aaaa {
+				var aaaa [16]byte
+				copy(aaaa[:], net.ParseIP(ip).To16())
+				builder.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: aaaa})
+			}
+		}
+	}
+	response, _ := builder.Finish()
+	return response
+}
+
+// count returns how many queries of any type and network name has had
+func (s *fakeDNSServer) count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for key, n := range s.queries {
+		if strings.HasPrefix(key, name+" ") {
+			total += n
+		}
+	}
+	return total
+}
+
+func (s *fakeDNSServer) countOver(name, network string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for key, n := range s.queries {
+		if strings.HasPrefix(key, name+" ") && strings.HasSuffix(key, " "+network) {
+			total += n
+		}
+	}
+	return total
+}
+
+func ipStrings(addrs []net.IPAddr) []string {
+	var ips []string
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func TestCachingResolverLookup(t *testing.T) {
+	server := startFakeDNSServer(t, map[string]fakeDNSRecord{
+		"dual.test":  {a: []string{"192.0.2.1", "192.0.2.2"}, aaaa: []string{"2001:db8::1"}, ttl: 300},
+		"v4.test":    {a: []string{"192.0.2.3"}, ttl: 300},
+		"large.test": {a: []string{"192.0.2.4"}, ttl: 300, truncate: true},
+		"empty.test": {ttl: 300},
+	})
+
+	tests := []struct {
+		host    string
+		want    []string
+		wantErr bool
+	}{
+		{"dual.test", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}, false},
+		{"V4.Test.", []string{"192.0.2.3"}, false},
+		{"large.test", []string{"192.0.2.4"}, false},
+		{"empty.test", nil, true},
+		{"missing.test", nil, true},
+	}
+
+	cr := NewCachingResolver(server.addr, time.Hour)
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			addrs, err := cr.LookupIPAddr(context.Background(), tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LookupIPAddr(%s) error = %v, want error %v", tt.host, err, tt.wantErr)
+			}
+			if got := ipStrings(addrs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LookupIPAddr(%s) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+
+	// The truncated answers were fetched again over TCP
+	if got := server.countOver("large.test", "tcp"); got != 2 {
+		t.Errorf("large.test: %d TCP queries, want 2", got)
+	}
+}
+
+func TestCachingResolverExpiry(t *testing.T) {
+	server := startFakeDNSServer(t, map[string]fakeDNSRecord{
+		"short.test":    {a: []string{"192.0.2.1"}, ttl: 30},
+		"long.test":     {a: []string{"192.0.2.2"}, ttl: 86400},
+		"uncached.test": {a: []string{"192.0.2.3"}, ttl: 0},
+	})
+
+	tests := []struct {
+		host       string
+		stillFresh time.Duration // the answer is reused up to here
+		expired    time.Duration // and resolved again from here
+	}{
+		{"short.test", 29 * time.Second, 30 * time.Second},
+		// Capped at the resolver's maximum TTL
+		{"long.test", 59 * time.Second, 60 * time.Second},
+		{"uncached.test", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			now := time.Now()
+			cr := NewCachingResolver(server.addr, time.Minute)
+			cr.now = func() time.Time { return now }
+			start := server.count(tt.host)
+
+			lookup := func() {
+				t.Helper()
+				if _, err := cr.LookupIPAddr(context.Background(), tt.host); err != nil {
+					t.Fatalf("LookupIPAddr: %v", err)
+				}
+			}
+			queries := func() int { return (server.count(tt.host) - start) / 2 } // A and AAAA
+
+			lookup()
+			if tt.stillFresh > 0 {
+				now = now.Add(tt.stillFresh)
+				lookup()
+				if got := queries(); got != 1 {
+					t.Errorf("after %v: resolved %d times, want the cached answer", tt.stillFresh, got)
+				}
+				now = now.Add(tt.expired - tt.stillFresh)
+			}
+			lookup()
+			if got := queries(); got != 2 {
+				t.Errorf("after %v: resolved %d times, want a fresh lookup", tt.expired, got)
+			}
+		})
+	}
+}
+
+func TestCachingResolverFailuresNotCached(t *testing.T) {
+	records := map[string]fakeDNSRecord{}
+	server := startFakeDNSServer(t, records)
+	cr := NewCachingResolver(server.addr, time.Minute)
+
+	if _, err := cr.LookupIPAddr(context.Background(), "later.test"); err == nil {
+		t.Fatal("lookup of a missing name succeeded")
+	}
+	server.mu.Lock()
+	records["later.test"] = fakeDNSRecord{a: []string{"192.0.2.9"}, ttl: 300}
+	server.mu.Unlock()
+
+	addrs, err := cr.LookupIPAddr(context.Background(), "later.test")
+	if err != nil {
+		t.Fatalf("lookup after the name appeared: %v", err)
+	}
+	if got := ipStrings(addrs); !reflect.DeepEqual(got, []string{"192.0.2.9"}) {
+		t.Errorf("got %v, want [192.0.2.9]", got)
+	}
+}
+
+// Answers from the system resolver hide their TTL and are kept for the maximum
+func TestCachingResolverSystem(t *testing.T) {
+	server := startFakeDNSServer(t, map[string]fakeDNSRecord{
+		"system.test": {a: []string{"192.0.2.5"}, ttl: 1},
+	})
+	now := time.Now()
+	cr := NewCachingResolver("", time.Minute)
+	cr.now = func() time.Time { return now }
+	cr.system = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server.addr)
+		},
+	}
+
+	for _, elapsed := range []time.Duration{0, 30 * time.Second, 59 * time.Second} {
+		now = now.Add(elapsed)
+		addrs, err := cr.LookupIPAddr(context.Background(), "system.test")
+		if err != nil {
+			t.Fatalf("LookupIPAddr: %v", err)
+		}
+		if got := ipStrings(addrs); !reflect.DeepEqual(got, []string{"192.0.2.5"}) {
+			t.Errorf("got %v, want [192.0.2.5]", got)
+		}
+	}
+	first := server.count("system.test")
+
+	now = now.Add(time.Minute)
+	if _, err := cr.LookupIPAddr(context.Background(), "system.test"); err != nil {
+		t.Fatalf("LookupIPAddr: %v", err)
+	}
+	if server.count("system.test") == first {
+		t.Error("expired system answer was not resolved again")
+	}
+
+	cr.Flush()
+	before := server.count("system.test")
+	if _, err := cr.LookupIPAddr(context.Background(), "system.test"); err != nil {
+		t.Fatalf("LookupIPAddr: %v", err)
+	}
+	if server.count("system.test") == before {
+		t.Error("lookup after Flush used the cache")
+	}
+}
+
+// A second dial to the same host connects without resolving it again
+func TestHappyEyeballsDialCachedResolver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	server := startFakeDNSServer(t, map[string]fakeDNSRecord{
+		"service.test": {a: []string{"127.0.0.1"}, ttl: 300},
+	})
+	dialer := NewHappyEyeballsDialer(&net.Dialer{Timeout: 5 * time.Second})
+	dialer.SetResolver(NewCachingResolver(server.addr, time.Minute))
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("service.test", port))
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conn.Close()
+	}
+	if got := server.count("service.test"); got != 2 {
+		t.Errorf("%d queries for two dials, want one A and one AAAA", got)
+	}
+}
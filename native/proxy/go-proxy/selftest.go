@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SelfTestCase describes a request and whether the proxy is expected to block it
+type SelfTestCase struct {
+	Name          string
+	URL           string
+	ExpectBlocked bool
+}
+
+// SelfTestResult holds the outcome of a single self-test case
+type SelfTestResult struct {
+	Case    SelfTestCase
+	Blocked bool
+	Err     error
+}
+
+// Passed reports whether the case behaved as expected
+func (r SelfTestResult) Passed() bool {
+	return r.Err == nil && r.Blocked == r.Case.ExpectBlocked
+}
+
+// onlineSelfTestCases are well-known ad/tracker endpoints plus a known-good site
+var onlineSelfTestCases = []SelfTestCase{
+	{Name: "doubleclick", URL: "http://ad.doubleclick.net/ddm/ad/", ExpectBlocked: true},
+	{Name: "google-analytics", URL: "http://www.google-analytics.com/analytics.js", ExpectBlocked: true},
+	{Name: "googlesyndication", URL: "http://pagead2.googlesyndication.com/pagead/show_ads.js", ExpectBlocked: true},
+	{Name: "known-good", URL: "http://example.com/", ExpectBlocked: false},
+}
+
+// selfTestFixtureRules are bundled rules used by the offline self-test
+var selfTestFixtureRules = []string{
+	"||ads.fixture.test^",
+	"||tracker.fixture.test^",
+	"*/banner/*/ad.gif",
+}
+
+// offlineSelfTestCases are classified against selfTestFixtureRules without network access
+var offlineSelfTestCases = []SelfTestCase{
+	{Name: "fixture-ads", URL: "http://ads.fixture.test/serve.js", ExpectBlocked: true},
+	{Name: "fixture-tracker", URL: "http://tracker.fixture.test/pixel.gif", ExpectBlocked: true},
+	{Name: "fixture-banner", URL: "http://cdn.fixture.test/banner/728x90/ad.gif", ExpectBlocked: true},
+	{Name: "fixture-good", URL: "http://www.fixture.test/index.html", ExpectBlocked: false},
+}
+
+// RunOfflineSelfTest classifies cases with a filter engine built from config and the bundled fixture rules
+func RunOfflineSelfTest(config *Config, cases []SelfTestCase) []SelfTestResult {
+	testConfig := *config
+	testConfig.FilteringEnabled = true
+	testConfig.FilterRules = append(append([]string{}, config.FilterRules...), selfTestFixtureRules...)
+
+	engine := NewFilterEngine(&testConfig)
+
+	results := make([]SelfTestResult, 0, len(cases))
+	for _, tc := range cases {
+		req, err := http.NewRequest("GET", tc.URL, nil)
+		if err != nil {
+			results = append(results, SelfTestResult{Case: tc, Err: err})
+			continue
+		}
+		results = append(results, SelfTestResult{Case: tc, Blocked: engine.ShouldBlock(req)})
+	}
+
+	return results
+}
+
+// RunOnlineSelfTest sends each case through the running proxy at proxyAddr
+func RunOnlineSelfTest(proxyAddr string, cases []SelfTestCase, timeout time.Duration) []SelfTestResult {
+	proxyURL, err := url.Parse(proxyAddr)
+	if err != nil {
+		results := make([]SelfTestResult, 0, len(cases))
+		for _, tc := range cases {
+			results = append(results, SelfTestResult{Case: tc, Err: fmt.Errorf("invalid proxy address: %v", err)})
+		}
+		return results
+	}
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	results := make([]SelfTestResult, 0, len(cases))
+	for _, tc := range cases {
+		resp, err := client.Get(tc.URL)
+		if err != nil {
+			results = append(results, SelfTestResult{Case: tc, Err: err})
+			continue
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		results = append(results, SelfTestResult{Case: tc, Blocked: isFilterBlockResponse(resp.StatusCode, string(body))})
+	}
+
+	return results
+}
+
+// isFilterBlockResponse reports whether a response was produced by the proxy's filter
+func isFilterBlockResponse(statusCode int, body string) bool {
+	return statusCode == http.StatusForbidden && strings.Contains(body, "blocked by filter")
+}
+
+// printSelfTestResults writes a report and returns the number of failed cases
+func printSelfTestResults(w io.Writer, results []SelfTestResult) int {
+	failures := 0
+	for _, r := range results {
+		expected := "allowed"
+		if r.Case.ExpectBlocked {
+			expected = "blocked"
+		}
+
+		switch {
+		case r.Err != nil:
+			failures++
+			fmt.Fprintf(w, "FAIL  %-20s %s (expected %s, error: %v)\n", r.Case.Name, r.Case.URL, expected, r.Err)
+		case !r.Passed():
+			failures++
+			actual := "allowed"
+			if r.Blocked {
+				actual = "blocked"
+			}
+			fmt.Fprintf(w, "FAIL  %-20s %s (expected %s, got %s)\n", r.Case.Name, r.Case.URL, expected, actual)
+		default:
+			fmt.Fprintf(w, "PASS  %-20s %s (%s)\n", r.Case.Name, r.Case.URL, expected)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d/%d checks passed\n", len(results)-failures, len(results))
+	return failures
+}
+
+// runSelfTest implements the selftest subcommand and returns the process exit code
+func runSelfTest(config *Config, args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	proxyAddr := fs.String("proxy", fmt.Sprintf("http://%s:%d", config.ListenAddr, config.ListenPort), "Proxy address to test through")
+	offline := fs.Bool("offline", false, "Classify bundled fixtures without network access")
+	timeout := fs.Duration("timeout", 10*time.Second, "Per-request timeout")
+	fs.Parse(args)
+
+	var results []SelfTestResult
+	if *offline {
+		fmt.Println("Running offline self-test against bundled fixtures")
+		results = RunOfflineSelfTest(config, offlineSelfTestCases)
+	} else {
+		fmt.Printf("Running self-test through proxy %s\n", *proxyAddr)
+		results = RunOnlineSelfTest(*proxyAddr, onlineSelfTestCases, *timeout)
+	}
+
+	if printSelfTestResults(os.Stdout, results) > 0 {
+		return 1
+	}
+	return 0
+}
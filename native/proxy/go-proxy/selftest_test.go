@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunOfflineSelfTest(t *testing.T) {
+	results := RunOfflineSelfTest(newTestConfig(), offlineSelfTestCases)
+	if len(results) != len(offlineSelfTestCases) {
+		t.Fatalf("got %d results, want %d", len(results), len(offlineSelfTestCases))
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			t.Errorf("%s: blocked = %v, want %v (err %v)", r.Case.Name, r.Blocked, r.Case.ExpectBlocked, r.Err)
+		}
+	}
+}
+
+func TestRunOfflineSelfTestReportsMismatches(t *testing.T) {
+	cases := []SelfTestCase{
+		{Name: "blocked", URL: "http://ads.fixture.test/a.js", ExpectBlocked: true},
+		{Name: "wrongly-expected-allowed", URL: "http://tracker.fixture.test/p.gif", ExpectBlocked: false},
+		{Name: "wrongly-expected-blocked", URL: "http://www.fixture.test/", ExpectBlocked: true},
+		{Name: "bad-url", URL: "http://[::1", ExpectBlocked: false},
+	}
+	results := RunOfflineSelfTest(newTestConfig(), cases)
+
+	var out bytes.Buffer
+	if failures := printSelfTestResults(&out, results); failures != 3 {
+		t.Errorf("failures = %d, want 3\n%s", failures, out.String())
+	}
+	if !strings.Contains(out.String(), "1/4 checks passed") {
+		t.Errorf("report missing summary:\n%s", out.String())
+	}
+}
+
+func TestRunOnlineSelfTest(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer site.Close()
+
+	config := newTestConfig()
+	config.FilterRules = []string{"*/ads/*"}
+	_, addr := startTestProxy(t, config)
+
+	tests := []struct {
+		name          string
+		path          string
+		expectBlocked bool
+		wantPassed    bool
+	}{
+		{"blocked as expected", "/ads/banner.js", true, true},
+		{"allowed as expected", "/index.html", false, true},
+		{"allowed but expected blocked", "/index.html", true, false},
+		{"blocked but expected allowed", "/ads/pixel.gif", false, false},
+	}
+
+	var cases []SelfTestCase
+	for _, tt := range tests {
+		cases = append(cases, SelfTestCase{Name: tt.name, URL: site.URL + tt.path, ExpectBlocked: tt.expectBlocked})
+	}
+	results := RunOnlineSelfTest("http://"+addr, cases, 5*time.Second)
+
+	for i, tt := range tests {
+		if results[i].Err != nil {
+			t.Fatalf("%s: %v", tt.name, results[i].Err)
+		}
+		if got := results[i].Passed(); got != tt.wantPassed {
+			t.Errorf("%s: passed = %v, want %v", tt.name, got, tt.wantPassed)
+		}
+	}
+}
+
+func TestRunOnlineSelfTestUnreachableProxy(t *testing.T) {
+	cases := []SelfTestCase{{Name: "any", URL: "http://example.com/", ExpectBlocked: false}}
+	results := RunOnlineSelfTest("http://127.0.0.1:1", cases, time.Second)
+	if results[0].Err == nil || results[0].Passed() {
+		t.Errorf("expected an error through an unreachable proxy, got %+v", results[0])
+	}
+}
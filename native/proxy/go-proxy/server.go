@@ -2,8 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,11 +20,22 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/idna"
 )
 
 // Version information
@@ -29,36 +48,70 @@ var (
 type Config struct {
 	ListenAddr          string            `json:"listen_addr"`
 	ListenPort          int               `json:"listen_port"`
+	ListenAddresses     []string          `json:"listen_addresses"` // host:port or unix:/path entries; overrides listen_addr/listen_port
 	TLSEnabled          bool              `json:"tls_enabled"`
 	CertFile            string            `json:"cert_file"`
 	KeyFile             string            `json:"key_file"`
+	TLSMinVersion       string            `json:"tls_min_version"`           // 1.2 (default) or 1.3
+	TLSCipherSuites     []string          `json:"tls_cipher_suites"`         // TLS 1.2 suites by crypto/tls name, in order of preference; secure defaults when empty
+	TLSPreferServerCiphers bool           `json:"tls_prefer_server_ciphers"` // use the first tls_cipher_suites entry the client supports
+	ClientCAFile        string            `json:"client_ca_file"`    // require client certificates issued by these CAs (mTLS); auth_required still applies on top
+	ClientCertUsers     []string          `json:"client_cert_users"` // certificate CNs or SANs allowed to connect; empty allows any certificate from the CA
 	ProxyMode           string            `json:"proxy_mode"`
 	UpstreamProxy       string            `json:"upstream_proxy"`
+	OutboundSourceIP    string            `json:"outbound_source_ip"`
+	DNSCache            bool              `json:"dns_cache"`     // cache destination lookups instead of resolving on every dial
+	DNSServer           string            `json:"dns_server"`    // host:port to resolve through, such as the local DNS filter; the system resolver when empty
+	DNSCacheTTL         string            `json:"dns_cache_ttl"` // longest time an answer is cached, and how long system resolver answers are kept
+	ConnectAllowedPorts []int             `json:"connect_allowed_ports"` // ports CONNECT may tunnel to; empty allows any port
+	BlockPrivateDestinations bool         `json:"block_private_destinations"` // refuse to proxy to loopback, link-local and private addresses
+	ProxyProtocol       bool              `json:"proxy_protocol"`         // accept PROXY protocol v1/v2 headers from trusted peers
+	ProxyProtocolTrusted []string         `json:"proxy_protocol_trusted"` // IPs or CIDRs of load balancers allowed to send PROXY headers
+	TrustedProxies      []string          `json:"trusted_proxies"`        // IPs or CIDRs of reverse proxies whose X-Forwarded-For is believed; ignored with proxy_protocol
 	AuthRequired        bool              `json:"auth_required"`
 	Username            string            `json:"username"`
 	Password            string            `json:"password"`
 	FilteringEnabled    bool              `json:"filtering_enabled"`
+	FilterMode          string            `json:"filter_mode"` // blocklist (default) or allowlist, which blocks everything not allowed
 	FilterRules         []string          `json:"filter_rules"`
 	WhitelistDomains    []string          `json:"whitelist_domains"`
 	BlacklistDomains    []string          `json:"blacklist_domains"`
+	SNIBlacklist        []string          `json:"sni_blacklist"`
+	SNIBlackholeAction  string            `json:"sni_blackhole_action"` // reset, or a TLS alert name such as handshake_failure
+	JA3Denylist         []string          `json:"ja3_denylist"` // MD5 JA3 fingerprints of TLS clients refused on CONNECT
+	JA3Action           string            `json:"ja3_action"`   // block (default) or flag, which only logs the match
+	LogJA3              bool              `json:"log_ja3"`      // log the JA3 fingerprint of every CONNECT client
 	StealthMode         bool              `json:"stealth_mode"`
 	UserAgentRotation   bool              `json:"user_agent_rotation"`
 	HeaderObfuscation   bool              `json:"header_obfuscation"`
+	ForwardedHeaders    bool              `json:"forwarded_headers"` // append the client IP to X-Forwarded-For and set X-Real-IP and Forwarded; needs stealth_mode off
 	TimingRandomization bool              `json:"timing_randomization"`
 	MaxConnections      int               `json:"max_connections"`
+	MaxConnectionsPerClient int           `json:"max_connections_per_client"`
+	BandwidthLimit      int64             `json:"bandwidth_limit"`        // bytes/sec per connection, 0 for unlimited
+	GlobalBandwidthLimit int64            `json:"global_bandwidth_limit"` // bytes/sec across all connections, 0 for unlimited
 	ReadTimeout         string            `json:"read_timeout"`
 	WriteTimeout        string            `json:"write_timeout"`
 	IdleTimeout         string            `json:"idle_timeout"`
+	ShutdownGracePeriod string            `json:"shutdown_grace_period"` // how long shutdown waits for requests and tunnels before force-closing them
+	ConnectionIdleTimeout string          `json:"connection_idle_timeout"` // connections without traffic for longer are dropped from the network monitor
 	BufferSize          int               `json:"buffer_size"`
+	MaxRequestBodySize  int64             `json:"max_request_body_size"` // bytes, 0 for unlimited
 	LogLevel            string            `json:"log_level"`
 	LogFile             string            `json:"log_file"`
 	AccessLogEnabled    bool              `json:"access_log_enabled"`
 	ErrorLogEnabled     bool              `json:"error_log_enabled"`
 	CustomHeaders       map[string]string `json:"custom_headers"`
 	BlockedContentTypes []string          `json:"blocked_content_types"`
+	GRPCProxy           bool              `json:"grpc_proxy"` // forward gRPC over HTTP/2, accepting h2c when TLS is off
+	FingerprintingProtection FingerprintingProtection `json:"fingerprinting_protection"`
+	CookieBlocking      CookieBlocking    `json:"cookie_blocking"`
 	RateLimitEnabled    bool              `json:"rate_limit_enabled"`
 	RateLimitRequests   int               `json:"rate_limit_requests"`
 	RateLimitWindow     string            `json:"rate_limit_window"`
+	APIToken            string            `json:"api_token"`     // bearer token for /api/*; the API is disabled when empty
+	RulesFile           string            `json:"rules_file"`    // filter rules file, rewritten on API changes when PersistRules is set
+	PersistRules        bool              `json:"persist_rules"`
 }
 
 // DefaultConfig returns a default configuration
@@ -68,10 +121,14 @@ func DefaultConfig() *Config {
 		ListenPort:          8080,
 		TLSEnabled:          false,
 		ProxyMode:           "http",
+		ConnectAllowedPorts: []int{443, 8443},
 		FilteringEnabled:    true,
+		FilterMode:          "blocklist",
 		FilterRules:         []string{},
 		WhitelistDomains:    []string{},
 		BlacklistDomains:    []string{},
+		SNIBlacklist:        []string{},
+		SNIBlackholeAction:  "handshake_failure",
 		StealthMode:         true,
 		UserAgentRotation:   true,
 		HeaderObfuscation:   true,
@@ -80,7 +137,10 @@ func DefaultConfig() *Config {
 		ReadTimeout:         "30s",
 		WriteTimeout:        "30s",
 		IdleTimeout:         "60s",
+		ShutdownGracePeriod: "10s",
+		ConnectionIdleTimeout: "5m",
 		BufferSize:          32768,
+		MaxRequestBodySize:  10 << 20, // 10MB
 		LogLevel:            "info",
 		AccessLogEnabled:    true,
 		ErrorLogEnabled:     true,
@@ -92,12 +152,221 @@ func DefaultConfig() *Config {
 	}
 }
 
+// validProxyModes are the accepted values of Config.ProxyMode
+var validProxyModes = map[string]bool{
+	"http":        true,
+	"https":       true,
+	"socks4":      true,
+	"socks5":      true,
+	"transparent": true,
+}
+
+// Validate checks the configuration and returns every problem found, each prefixed
+// with the JSON name of the offending field
+func (c *Config) Validate() error {
+	var problems []error
+	add := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, v...))
+	}
+
+	if len(c.ListenAddresses) == 0 {
+		if c.ListenPort < 1 || c.ListenPort > 65535 {
+			add("listen_port: must be between 1 and 65535, got %d", c.ListenPort)
+		}
+		if c.ListenAddr != "" && net.ParseIP(c.ListenAddr) == nil && !IsValidDomain(c.ListenAddr) && c.ListenAddr != "localhost" {
+			add("listen_addr: %q is not an IP address or hostname", c.ListenAddr)
+		}
+	}
+	for _, endpoint := range c.ListenAddresses {
+		if strings.HasPrefix(endpoint, "unix:") {
+			if strings.TrimPrefix(endpoint, "unix:") == "" {
+				add("listen_addresses: %q has no socket path", endpoint)
+			}
+			continue
+		}
+		_, port, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			add("listen_addresses: %q must be host:port or unix:/path", endpoint)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			add("listen_addresses: %q has invalid port %q", endpoint, port)
+		}
+	}
+
+	for _, port := range c.ConnectAllowedPorts {
+		if port < 1 || port > 65535 {
+			add("connect_allowed_ports: must be between 1 and 65535, got %d", port)
+		}
+	}
+
+	if !validProxyModes[c.ProxyMode] {
+		add("proxy_mode: unknown mode %q (expected http, https, socks4, socks5 or transparent)", c.ProxyMode)
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		add("log_level: %v (expected debug, info, warn or error)", err)
+	}
+
+	if c.TLSEnabled {
+		for _, file := range []struct{ name, path string }{{"cert_file", c.CertFile}, {"key_file", c.KeyFile}} {
+			if file.path == "" {
+				add("%s: required when tls_enabled is true", file.name)
+			} else if _, err := os.Stat(file.path); err != nil {
+				add("%s: cannot read %s: %v", file.name, file.path, err)
+			}
+		}
+	}
+
+	if _, err := ParseTLSVersion(c.TLSMinVersion); err != nil {
+		add("tls_min_version: %v", err)
+	}
+	if _, err := ParseCipherSuites(c.TLSCipherSuites); err != nil {
+		add("tls_cipher_suites: %v", err)
+	}
+
+	if c.ClientCAFile != "" {
+		if !c.TLSEnabled {
+			add("client_ca_file: requires tls_enabled to be true")
+		} else if _, err := os.Stat(c.ClientCAFile); err != nil {
+			add("client_ca_file: cannot read %s: %v", c.ClientCAFile, err)
+		}
+	}
+	if len(c.ClientCertUsers) > 0 && c.ClientCAFile == "" {
+		add("client_cert_users: requires client_ca_file to be set")
+	}
+
+	for _, d := range []struct{ name, value string }{
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_grace_period", c.ShutdownGracePeriod},
+		{"connection_idle_timeout", c.ConnectionIdleTimeout},
+		{"rate_limit_window", c.RateLimitWindow},
+		{"dns_cache_ttl", c.DNSCacheTTL},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(d.value); err != nil {
+			add("%s: %q is not a duration (use a value like \"30s\" or \"1m\")", d.name, d.value)
+		} else if parsed < 0 {
+			add("%s: must not be negative, got %s", d.name, d.value)
+		}
+	}
+
+	if c.MaxConnections < 0 {
+		add("max_connections: must not be negative, got %d", c.MaxConnections)
+	}
+	if c.MaxConnectionsPerClient < 0 {
+		add("max_connections_per_client: must not be negative, got %d", c.MaxConnectionsPerClient)
+	}
+	if c.BandwidthLimit < 0 {
+		add("bandwidth_limit: must not be negative, got %d", c.BandwidthLimit)
+	}
+	if c.GlobalBandwidthLimit < 0 {
+		add("global_bandwidth_limit: must not be negative, got %d", c.GlobalBandwidthLimit)
+	}
+	if c.MaxRequestBodySize < 0 {
+		add("max_request_body_size: must not be negative, got %d", c.MaxRequestBodySize)
+	}
+	if c.BufferSize < 0 {
+		add("buffer_size: must not be negative, got %d", c.BufferSize)
+	}
+
+	if c.RateLimitEnabled {
+		if c.RateLimitRequests < 1 {
+			add("rate_limit_requests: must be at least 1 when rate_limit_enabled is true, got %d", c.RateLimitRequests)
+		}
+		if c.RateLimitWindow == "" {
+			add("rate_limit_window: required when rate_limit_enabled is true")
+		}
+	}
+
+	if c.UpstreamProxy != "" {
+		if _, err := ParseUpstreamProxy(c.UpstreamProxy); err != nil {
+			add("upstream_proxy: %v", err)
+		}
+	}
+	if c.ProxyProtocol && len(c.ProxyProtocolTrusted) == 0 {
+		add("proxy_protocol_trusted: required when proxy_protocol is true, otherwise any client could spoof its address")
+	}
+	if _, err := ParseTrustedNetworks(c.ProxyProtocolTrusted); err != nil {
+		add("proxy_protocol_trusted: %v", err)
+	}
+	if _, err := ParseTrustedNetworks(c.TrustedProxies); err != nil {
+		add("trusted_proxies: %v", err)
+	}
+	if c.OutboundSourceIP != "" && net.ParseIP(c.OutboundSourceIP) == nil {
+		add("outbound_source_ip: %q is not an IP address", c.OutboundSourceIP)
+	}
+	if c.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(c.DNSServer); err != nil {
+			add("dns_server: %q is not a host:port address", c.DNSServer)
+		} else if !c.DNSCache {
+			add("dns_server: requires dns_cache to be true")
+		}
+	}
+
+	if _, ok := tlsAlertCodes[c.SNIBlackholeAction]; !ok && c.SNIBlackholeAction != "reset" && c.SNIBlackholeAction != "" {
+		add("sni_blackhole_action: unknown action %q (expected reset, handshake_failure, access_denied, internal_error or unrecognized_name)", c.SNIBlackholeAction)
+	}
+
+	for _, fingerprint := range c.JA3Denylist {
+		if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != md5.Size {
+			add("ja3_denylist: %q is not an MD5 JA3 fingerprint", fingerprint)
+		}
+	}
+	if c.JA3Action != "" && c.JA3Action != "block" && c.JA3Action != "flag" {
+		add("ja3_action: unknown action %q (expected block or flag)", c.JA3Action)
+	}
+
+	if c.ForwardedHeaders && c.StealthMode {
+		add("forwarded_headers: cannot be used with stealth_mode, which strips the client address")
+	}
+
+	if c.FilterMode != "" && c.FilterMode != "blocklist" && c.FilterMode != "allowlist" {
+		add("filter_mode: unknown mode %q (expected blocklist or allowlist)", c.FilterMode)
+	}
+
+	if c.PersistRules && c.RulesFile == "" {
+		add("persist_rules: requires rules_file to be set")
+	}
+
+	return errors.Join(problems...)
+}
+
+// LogLevel is the minimum severity a Logger writes
+type LogLevel int
+
+// Log levels in increasing severity. Access lines are written at LevelInfo.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// ParseLogLevel converts a config log level name to a LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
 // Logger handles logging operations
 type Logger struct {
 	accessLog *log.Logger
 	errorLog  *log.Logger
 	infoLog   *log.Logger
 	debugLog  *log.Logger
+	level     LogLevel
 	mu        sync.RWMutex
 }
 
@@ -121,11 +390,25 @@ func NewLogger(config *Config) (*Logger, error) {
 	logger.infoLog = log.New(logWriter, "[INFO] ", log.LstdFlags)
 	logger.debugLog = log.New(logWriter, "[DEBUG] ", log.LstdFlags|log.Lshortfile)
 
+	level, err := ParseLogLevel(config.LogLevel)
+	if err != nil {
+		log.New(logWriter, "[WARN] ", log.LstdFlags).Printf("%v, defaulting to info", err)
+	}
+	logger.level = level
+
 	return logger, nil
 }
 
+// enabled reports whether messages at level should be written
+func (l *Logger) enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
 // Access logs access events
 func (l *Logger) Access(format string, v ...interface{}) {
+	if !l.enabled(LevelInfo) {
+		return
+	}
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	l.accessLog.Printf(format, v...)
@@ -133,6 +416,9 @@ func (l *Logger) Access(format string, v ...interface{}) {
 
 // Error logs error events
 func (l *Logger) Error(format string, v ...interface{}) {
+	if !l.enabled(LevelError) {
+		return
+	}
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	l.errorLog.Printf(format, v...)
@@ -140,6 +426,9 @@ func (l *Logger) Error(format string, v ...interface{}) {
 
 // Info logs info events
 func (l *Logger) Info(format string, v ...interface{}) {
+	if !l.enabled(LevelInfo) {
+		return
+	}
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	l.infoLog.Printf(format, v...)
@@ -147,6 +436,9 @@ func (l *Logger) Info(format string, v ...interface{}) {
 
 // Debug logs debug events
 func (l *Logger) Debug(format string, v ...interface{}) {
+	if !l.enabled(LevelDebug) {
+		return
+	}
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	l.debugLog.Printf(format, v...)
@@ -154,18 +446,20 @@ func (l *Logger) Debug(format string, v ...interface{}) {
 
 // RateLimiter implements rate limiting functionality
 type RateLimiter struct {
-	requests map[string][]time.Time
-	limit    int
-	window   time.Duration
-	mu       sync.RWMutex
+	requests    map[string][]time.Time
+	limit       int
+	window      time.Duration
+	lastCleanup time.Time
+	mu          sync.RWMutex
 }
 
 // NewRateLimiter creates a new rate limiter
 func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 	rl := &RateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    limit,
-		window:   window,
+		requests:    make(map[string][]time.Time),
+		limit:       limit,
+		window:      window,
+		lastCleanup: time.Now(),
 	}
 
 	// Start cleanup goroutine
@@ -176,6 +470,13 @@ func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 
 // Allow checks if a request is allowed
 func (rl *RateLimiter) Allow(clientIP string) bool {
+	allowed, _ := rl.Check(clientIP)
+	return allowed
+}
+
+// Check records a request if it is allowed, otherwise it reports how long until
+// the client's oldest request in the window expires and the next one would be
+func (rl *RateLimiter) Check(clientIP string) (bool, time.Duration) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
@@ -196,14 +497,15 @@ func (rl *RateLimiter) Allow(clientIP string) bool {
 	// Check if limit exceeded
 	if len(validRequests) >= rl.limit {
 		rl.requests[clientIP] = validRequests
-		return false
+		oldest := validRequests[len(validRequests)-rl.limit]
+		return false, oldest.Add(rl.window).Sub(now)
 	}
 
 	// Add current request
 	validRequests = append(validRequests, now)
 	rl.requests[clientIP] = validRequests
 
-	return true
+	return true, 0
 }
 
 // cleanup removes old entries from the rate limiter
@@ -215,6 +517,7 @@ func (rl *RateLimiter) cleanup() {
 		rl.mu.Lock()
 		now := time.Now()
 		cutoff := now.Add(-rl.window)
+		rl.lastCleanup = now
 
 		for ip, requests := range rl.requests {
 			var validRequests []time.Time
@@ -234,14 +537,83 @@ func (rl *RateLimiter) cleanup() {
 	}
 }
 
+// Alive reports whether the cleanup goroutine has run within the last two windows
+func (rl *RateLimiter) Alive() bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return time.Since(rl.lastCleanup) < 2*rl.window
+}
+
+// retryAfterSeconds formats a wait as a Retry-After value, rounding up so clients
+// never retry before the limiter would allow them
+func retryAfterSeconds(d time.Duration) string {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// ConnectionLimiter caps the number of concurrent connections per client
+type ConnectionLimiter struct {
+	active map[string]int
+	limit  int
+	mu     sync.Mutex
+}
+
+// NewConnectionLimiter creates a new connection limiter
+func NewConnectionLimiter(limit int) *ConnectionLimiter {
+	return &ConnectionLimiter{
+		active: make(map[string]int),
+		limit:  limit,
+	}
+}
+
+// Acquire reserves a connection slot for the client, returning false when the limit is reached
+func (cl *ConnectionLimiter) Acquire(clientIP string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.active[clientIP] >= cl.limit {
+		return false
+	}
+	cl.active[clientIP]++
+	return true
+}
+
+// Release frees a connection slot previously reserved with Acquire
+func (cl *ConnectionLimiter) Release(clientIP string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.active[clientIP] <= 1 {
+		delete(cl.active, clientIP)
+		return
+	}
+	cl.active[clientIP]--
+}
+
+// Active returns the number of open connections for the client
+func (cl *ConnectionLimiter) Active(clientIP string) int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.active[clientIP]
+}
+
 // FilterEngine handles request/response filtering
 type FilterEngine struct {
 	config          *Config
-	adblockRules    []string
+	rules           []ManagedRule // every active rule in load order; the maps and slices below are derived from it
+	adblockRules    []ManagedRule
+	allowRules      []ManagedRule // @@ exception rules, with the @@ kept in Rule
 	cosmeticRules   []string
-	domainRules     map[string]bool
+	domainRules     map[string]string // domain to the ID of the rule blocking it
+	hits            map[string]*RuleHits
 	whitelistDomain map[string]bool
 	blacklistDomain map[string]bool
+	sniBlacklist    map[string]bool
+	ja3Denylist     map[string]bool
+	loaded          int32 // set once the configured filter lists have been parsed
 	mu              sync.RWMutex
 }
 
@@ -249,11 +621,14 @@ type FilterEngine struct {
 func NewFilterEngine(config *Config) *FilterEngine {
 	fe := &FilterEngine{
 		config:          config,
-		adblockRules:    []string{},
+		adblockRules:    []ManagedRule{},
 		cosmeticRules:   []string{},
-		domainRules:     make(map[string]bool),
+		domainRules:     make(map[string]string),
+		hits:            make(map[string]*RuleHits),
 		whitelistDomain: make(map[string]bool),
 		blacklistDomain: make(map[string]bool),
+		sniBlacklist:    make(map[string]bool),
+		ja3Denylist:     make(map[string]bool),
 	}
 
 	// Parse filter rules
@@ -261,111 +636,517 @@ func NewFilterEngine(config *Config) *FilterEngine {
 
 	// Build domain maps
 	for _, domain := range config.WhitelistDomains {
-		fe.whitelistDomain[strings.ToLower(domain)] = true
+		fe.whitelistDomain[normalizeHost(domain)] = true
 	}
 
 	for _, domain := range config.BlacklistDomains {
-		fe.blacklistDomain[strings.ToLower(domain)] = true
+		fe.blacklistDomain[normalizeHost(domain)] = true
+	}
+
+	for _, sni := range config.SNIBlacklist {
+		fe.sniBlacklist[normalizeHost(sni)] = true
+	}
+
+	for _, fingerprint := range config.JA3Denylist {
+		fe.ja3Denylist[strings.ToLower(fingerprint)] = true
 	}
 
+	atomic.StoreInt32(&fe.loaded, 1)
+
 	return fe
 }
 
-// parseFilterRules parses the filter rules into different categories
-func (fe *FilterEngine) parseFilterRules() {
-	fe.mu.Lock()
-	defer fe.mu.Unlock()
+// normalizeHost lowercases host, drops any port and trailing dot, and converts
+// internationalized names to punycode so Unicode and xn-- spellings compare equal
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+// Loaded reports whether the filter lists have been parsed
+func (fe *FilterEngine) Loaded() bool {
+	return atomic.LoadInt32(&fe.loaded) == 1
+}
+
+// ManagedRule is a filter rule as listed by the rule API
+type ManagedRule struct {
+	ID   string `json:"id"`
+	Rule string `json:"rule"`
+}
+
+// RuleHits counts the requests a rule has blocked
+type RuleHits struct {
+	hits        int64
+	lastMatched int64 // unix nanoseconds
+}
+
+func (rh *RuleHits) record() {
+	atomic.AddInt64(&rh.hits, 1)
+	atomic.StoreInt64(&rh.lastMatched, time.Now().UnixNano())
+}
+
+// RuleStats is a rule's hit count as reported by /stats/rules
+type RuleStats struct {
+	ID          string     `json:"id"`
+	Rule        string     `json:"rule"`
+	Hits        int64      `json:"hits"`
+	LastMatched *time.Time `json:"last_matched,omitempty"`
+}
+
+// ruleID derives a stable ID from the rule text, so the same rule always has the same ID
+func ruleID(rule string) string {
+	sum := sha1.Sum([]byte(rule))
+	return hex.EncodeToString(sum[:6])
+}
+
+// validateRule rejects rules that would parse into an empty pattern
+func validateRule(rule string) error {
+	switch {
+	case strings.HasPrefix(rule, "@@"):
+		if strings.Trim(rule[2:], "|^*") == "" {
+			return fmt.Errorf("exception rule %q has no pattern", rule)
+		}
+	case strings.HasPrefix(rule, "##"):
+		if strings.TrimSpace(rule[2:]) == "" {
+			return fmt.Errorf("cosmetic rule %q has no selector", rule)
+		}
+	case strings.HasPrefix(rule, "||"):
+		if strings.Trim(rule, "|^*") == "" {
+			return fmt.Errorf("domain rule %q has no domain", rule)
+		}
+	}
+	return nil
+}
+
+// collectRules turns raw rule lines into deduplicated managed rules, skipping blank
+// lines and comments. Invalid rules are left out and reported.
+func collectRules(lines []string) ([]ManagedRule, []error) {
+	var rules []ManagedRule
+	var errs []error
 
-	for _, rule := range fe.config.FilterRules {
+	seen := make(map[string]bool)
+	for _, rule := range lines {
 		rule = strings.TrimSpace(rule)
 		if rule == "" || strings.HasPrefix(rule, "!") {
 			continue
 		}
+		if err := validateRule(rule); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		id := ruleID(rule)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		rules = append(rules, ManagedRule{ID: id, Rule: rule})
+	}
+
+	return rules, errs
+}
+
+// parseFilterRules parses the configured rules and the rules file into different categories
+func (fe *FilterEngine) parseFilterRules() {
+	lines := fe.config.FilterRules
+	if fe.config.RulesFile != "" {
+		fileRules, err := LoadFilterRules(fe.config.RulesFile)
+		if err != nil {
+			log.Printf("Warning: Failed to load filter rules: %v", err)
+		}
+		lines = append(append([]string{}, lines...), fileRules...)
+	}
+
+	rules, errs := collectRules(lines)
+	for _, err := range errs {
+		log.Printf("Warning: Skipping invalid filter rule: %v", err)
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	fe.rules = rules
+	fe.rebuildRules()
+}
+
+// ReloadRulesFile re-reads the rules file and swaps it in together with the configured
+// rules. On any read or parse error the current rules are kept.
+func (fe *FilterEngine) ReloadRulesFile() (int, error) {
+	fileRules, err := LoadFilterRules(fe.config.RulesFile)
+	if err != nil {
+		return 0, err
+	}
+
+	rules, errs := collectRules(append(append([]string{}, fe.config.FilterRules...), fileRules...))
+	if len(errs) > 0 {
+		return 0, fmt.Errorf("%d invalid rules, first: %v", len(errs), errs[0])
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	fe.rules = rules
+	fe.rebuildRules()
+	return len(rules), nil
+}
 
-		if strings.HasPrefix(rule, "##") {
+// rebuildRules recomputes the rule categories from fe.rules. Callers must hold fe.mu.
+func (fe *FilterEngine) rebuildRules() {
+	fe.adblockRules = []ManagedRule{}
+	fe.allowRules = []ManagedRule{}
+	fe.cosmeticRules = []string{}
+	fe.domainRules = make(map[string]string)
+
+	// Rules that stay active keep their counters
+	hits := make(map[string]*RuleHits, len(fe.rules))
+	for _, managed := range fe.rules {
+		if existing, ok := fe.hits[managed.ID]; ok {
+			hits[managed.ID] = existing
+		} else {
+			hits[managed.ID] = &RuleHits{}
+		}
+	}
+	fe.hits = hits
+
+	for _, managed := range fe.rules {
+		rule := managed.Rule
+		if strings.HasPrefix(rule, "@@") {
+			// Exception rule
+			fe.allowRules = append(fe.allowRules, managed)
+		} else if strings.HasPrefix(rule, "##") {
 			// Cosmetic rule
 			fe.cosmeticRules = append(fe.cosmeticRules, rule[2:])
 		} else if strings.HasPrefix(rule, "||") && strings.HasSuffix(rule, "^") {
 			// Domain rule
 			domain := strings.TrimSuffix(strings.TrimPrefix(rule, "||"), "^")
-			fe.domainRules[strings.ToLower(domain)] = true
+			fe.domainRules[normalizeHost(domain)] = managed.ID
 		} else {
 			// Adblock rule
-			fe.adblockRules = append(fe.adblockRules, rule)
+			fe.adblockRules = append(fe.adblockRules, managed)
+		}
+	}
+}
+
+// RuleStats returns every active rule with its hit count, most hit first. Cosmetic
+// rules never match requests and always report zero.
+func (fe *FilterEngine) RuleStats() []RuleStats {
+	fe.mu.RLock()
+	stats := make([]RuleStats, 0, len(fe.rules))
+	for _, managed := range fe.rules {
+		entry := RuleStats{ID: managed.ID, Rule: managed.Rule}
+		if rh, ok := fe.hits[managed.ID]; ok {
+			entry.Hits = atomic.LoadInt64(&rh.hits)
+			if last := atomic.LoadInt64(&rh.lastMatched); last != 0 {
+				t := time.Unix(0, last)
+				entry.LastMatched = &t
+			}
+		}
+		stats = append(stats, entry)
+	}
+	fe.mu.RUnlock()
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Hits > stats[j].Hits
+	})
+	return stats
+}
+
+// Rules returns the active rules in load order
+func (fe *FilterEngine) Rules() []ManagedRule {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	return append([]ManagedRule(nil), fe.rules...)
+}
+
+// AddRule validates a rule and adds it to the live engine, returning errRuleExists if
+// it is already active
+func (fe *FilterEngine) AddRule(rule string) (ManagedRule, error) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || strings.HasPrefix(rule, "!") {
+		return ManagedRule{}, fmt.Errorf("rule is empty or a comment")
+	}
+	if err := validateRule(rule); err != nil {
+		return ManagedRule{}, err
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	managed := ManagedRule{ID: ruleID(rule), Rule: rule}
+	for _, existing := range fe.rules {
+		if existing.ID == managed.ID {
+			return existing, errRuleExists
+		}
+	}
+
+	fe.rules = append(fe.rules, managed)
+	fe.rebuildRules()
+	return managed, nil
+}
+
+// RemoveRule removes the rule with the given ID, reporting whether it existed
+func (fe *FilterEngine) RemoveRule(id string) bool {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	for i, existing := range fe.rules {
+		if existing.ID == id {
+			fe.rules = append(fe.rules[:i:i], fe.rules[i+1:]...)
+			fe.rebuildRules()
+			return true
 		}
 	}
+	return false
+}
+
+// SaveRules writes the active rules to filename in the format read by LoadFilterRules
+func (fe *FilterEngine) SaveRules(filename string) error {
+	var buf strings.Builder
+	buf.WriteString("! OblivionFilter rules, managed through the rule API\n")
+	for _, managed := range fe.Rules() {
+		buf.WriteString(managed.Rule)
+		buf.WriteString("\n")
+	}
+
+	// Write to a temp file and rename so a crash never leaves a truncated rules file
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 // ShouldBlock checks if a request should be blocked
 func (fe *FilterEngine) ShouldBlock(req *http.Request) bool {
+	blocked, _ := fe.Evaluate(req)
+	return blocked
+}
+
+// Evaluate decides whether a request is blocked and why. Whitelisted domains and
+// @@ exception rules always pass; in allowlist mode nothing else does.
+func (fe *FilterEngine) Evaluate(req *http.Request) (bool, string) {
 	if !fe.config.FilteringEnabled {
-		return false
+		return false, ""
 	}
 
-	host := strings.ToLower(req.Host)
-	if host == "" {
-		if req.URL != nil {
-			host = strings.ToLower(req.URL.Host)
-		}
+	host := req.Host
+	if host == "" && req.URL != nil {
+		host = req.URL.Host
 	}
+	host = normalizeHost(host)
+	url := req.URL.String()
 
-	// Check whitelist first
 	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+
+	// Check whitelist first
 	if fe.whitelistDomain[host] {
-		fe.mu.RUnlock()
-		return false
+		return false, ""
+	}
+
+	// Check exception rules
+	for _, rule := range fe.allowRules {
+		if fe.matchesRule(url, rule.Rule[2:]) {
+			fe.hits[rule.ID].record()
+			return false, ""
+		}
+	}
+
+	if fe.config.FilterMode == "allowlist" {
+		return true, "host is not on the allowlist"
 	}
 
 	// Check blacklist
 	if fe.blacklistDomain[host] {
-		fe.mu.RUnlock()
-		return true
+		return true, "domain is blacklisted"
 	}
 
-	// Check domain rules
-	for domain := range fe.domainRules {
-		if strings.Contains(host, domain) {
-			fe.mu.RUnlock()
-			return true
+	// Check domain rules, which cover the domain and its subdomains
+	for domain, id := range fe.domainRules {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			fe.hits[id].record()
+			return true, "matched domain rule ||" + domain + "^"
 		}
 	}
-	fe.mu.RUnlock()
 
 	// Check adblock rules
-	url := req.URL.String()
 	for _, rule := range fe.adblockRules {
-		if fe.matchesRule(url, rule) {
-			return true
+		if fe.matchesRule(url, rule.Rule) {
+			fe.hits[rule.ID].record()
+			return true, "matched rule " + rule.Rule
 		}
 	}
 
-	return false
+	return false, ""
 }
 
-// matchesRule checks if a URL matches a filter rule
-func (fe *FilterEngine) matchesRule(url, rule string) bool {
-	// Simple pattern matching - in production, use a more sophisticated engine
-	if strings.Contains(rule, "*") {
-		// Wildcard matching
-		parts := strings.Split(rule, "*")
-		start := 0
-		for i, part := range parts {
-			if part == "" {
-				continue
-			}
-			index := strings.Index(url[start:], part)
-			if index == -1 {
-				return false
-			}
-			if i == 0 && index != 0 {
-				return false
-			}
-			start += index + len(part)
-		}
-		return true
+// HasSNIBlacklist reports whether any SNIs are configured to be blackholed
+func (fe *FilterEngine) HasSNIBlacklist() bool {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	return len(fe.sniBlacklist) > 0
+}
+
+// IsSNIBlackholed checks the SNI and its parent domains against the SNI blacklist
+func (fe *FilterEngine) IsSNIBlackholed(sni string) bool {
+	sni = normalizeHost(sni)
+	if sni == "" {
+		return false
 	}
 
-	return strings.Contains(url, rule)
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+
+	for {
+		if fe.sniBlacklist[sni] {
+			return true
+		}
+		dot := strings.Index(sni, ".")
+		if dot == -1 {
+			return false
+		}
+		sni = sni[dot+1:]
+	}
+}
+
+// HasJA3Denylist reports whether any client fingerprints are denylisted
+func (fe *FilterEngine) HasJA3Denylist() bool {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	return len(fe.ja3Denylist) > 0
+}
+
+// IsJA3Denied checks an MD5 JA3 fingerprint against the denylist
+func (fe *FilterEngine) IsJA3Denied(hash string) bool {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	return fe.ja3Denylist[strings.ToLower(hash)]
+}
+
+// ApplyCosmeticRules removes the elements matched by the ## rules from an HTML
+// body, reporting whether anything was removed. Only class and attribute
+// selectors are understood, and an element is assumed to end at the next closing tag.
+func (fe *FilterEngine) ApplyCosmeticRules(body []byte) ([]byte, bool) {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+
+	modified := false
+	for _, selector := range fe.cosmeticRules {
+		var pattern string
+		switch {
+		case strings.HasPrefix(selector, "."):
+			pattern = `<[^>]*class="[^"]*` + regexp.QuoteMeta(selector[1:]) + `[^"]*"[^>]*>.*?</[^>]*>`
+		case strings.HasPrefix(selector, "[") && strings.HasSuffix(selector, "]"):
+			pattern = `<[^>]*` + regexp.QuoteMeta(selector[1:len(selector)-1]) + `[^>]*>.*?</[^>]*>`
+		default:
+			continue
+		}
+
+		re := regexp.MustCompile(pattern)
+		if re.Match(body) {
+			body = re.ReplaceAll(body, nil)
+			modified = true
+		}
+	}
+	return body, modified
+}
+
+// matchesRule checks if a URL matches an Adblock Plus style filter. Matching is
+// case-insensitive; '*' matches anything and '^' a separator character or the end
+// of the URL. A leading '|' anchors the filter to the start of the URL, a leading
+// '||' to the start of the host or one of its parent domains, and a trailing '|'
+// to the end of the URL.
+func (fe *FilterEngine) matchesRule(url, rule string) bool {
+	url = strings.ToLower(url)
+	rule = strings.ToLower(rule)
+
+	domainAnchor, startAnchor, endAnchor := false, false, false
+	if strings.HasPrefix(rule, "||") {
+		domainAnchor, rule = true, rule[2:]
+	} else if strings.HasPrefix(rule, "|") {
+		startAnchor, rule = true, rule[1:]
+	}
+	if strings.HasSuffix(rule, "|") {
+		endAnchor, rule = true, rule[:len(rule)-1]
+	}
+
+	switch {
+	case startAnchor:
+		return matchFilterPattern(url, rule, endAnchor)
+	case domainAnchor:
+		// CONNECT requests have no scheme, just //host:port
+		hostStart := 0
+		if i := strings.Index(url, "://"); i >= 0 {
+			hostStart = i + 3
+		} else if strings.HasPrefix(url, "//") {
+			hostStart = 2
+		}
+		hostEnd := len(url)
+		if i := strings.IndexAny(url[hostStart:], "/?#"); i >= 0 {
+			hostEnd = hostStart + i
+		}
+		for i := hostStart; i < hostEnd; i++ {
+			if (i == hostStart || url[i-1] == '.') && matchFilterPattern(url[i:], rule, endAnchor) {
+				return true
+			}
+		}
+		return false
+	default:
+		// An unanchored filter may start anywhere, as if it began with '*'
+		return matchFilterPattern(url, "*"+rule, endAnchor)
+	}
+}
+
+// matchFilterPattern matches a filter pattern against the start of s, requiring it
+// to consume all of s when anchorEnd is set. On a mismatch only the last '*' seen
+// takes one more byte and matching resumes after it, so the time is bounded by
+// len(s)*len(pattern) however many stars the pattern has.
+func matchFilterPattern(s, pattern string, anchorEnd bool) bool {
+	si, pi := 0, 0
+	star, starSi := -1, 0 // pattern index after the last '*' and where in s it resumes
+	for {
+		if pi < len(pattern) {
+			switch c := pattern[pi]; {
+			case c == '*':
+				star, starSi = pi+1, si
+				pi++
+				continue
+			case c == '^' && si == len(s):
+				// The end of the URL counts as a separator
+				pi++
+				continue
+			case si < len(s) && (c == s[si] || c == '^' && isFilterSeparator(s[si])):
+				si, pi = si+1, pi+1
+				continue
+			}
+		} else if !anchorEnd || si == len(s) {
+			return true
+		}
+
+		if star < 0 || starSi == len(s) {
+			return false
+		}
+		starSi++
+		si, pi = starSi, star
+	}
+}
+
+// isFilterSeparator reports whether c is a separator for '^': anything but a
+// letter, a digit or one of _ - . %
+func isFilterSeparator(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return false
+	case c == '_', c == '-', c == '.', c == '%':
+		return false
+	}
+	return true
 }
 
 // StealthEngine handles request obfuscation and anti-detection
@@ -433,7 +1214,7 @@ func (se *StealthEngine) ObfuscateRequest(req *http.Request) {
 // ConnectionStats tracks connection statistics
 type ConnectionStats struct {
 	TotalConnections    int64
-	ActiveConnections   int64
+	ActiveConnections   int64 // updated atomically by trackConnState and handleConnect
 	BlockedRequests     int64
 	FilteredRequests    int64
 	BytesTransferred    int64
@@ -442,6 +1223,14 @@ type ConnectionStats struct {
 	mu                  sync.RWMutex
 }
 
+// ShutdownMetrics summarises how in-flight work was handled during shutdown
+type ShutdownMetrics struct {
+	InFlight     int64         `json:"in_flight"`
+	Drained      int64         `json:"drained"`
+	ForcedCloses int64         `json:"forced_closes"`
+	Duration     time.Duration `json:"duration"`
+}
+
 // ProxyServer represents the main proxy server
 type ProxyServer struct {
 	config       *Config
@@ -449,11 +1238,43 @@ type ProxyServer struct {
 	filterEngine *FilterEngine
 	stealthEngine *StealthEngine
 	rateLimiter  *RateLimiter
+	connLimiter  *ConnectionLimiter
+	upstreamURL  *url.URL
+	trustedProxies []*net.IPNet
+	dialer       *HappyEyeballsDialer
+	targetDialer *HappyEyeballsDialer // dials request targets, refusing private ones when configured
+	transport    *http.Transport
+	grpcTransport    *http2.Transport
+	grpcTLSTransport *http2.Transport
 	stats        *ConnectionStats
 	server       *http.Server
+	mux          *http.ServeMux
 	mu           sync.RWMutex
+	listening    int32
+	rulesWatcher *fsnotify.Watcher
+	certStore    *CertStore
+	globalBucket *TokenBucket
+	contentProcessor *ContentProcessor
+	topBlocked   *TopKCounter
+	monitor      *NetworkMonitor
+
+	activeRequests  int64
+	drainedRequests int64
+	draining        int32
+	tunnels         map[net.Conn]struct{}
+	clientSlots     map[net.Conn]clientSlot
+	shutdownMetrics *ShutdownMetrics
+}
+
+// clientSlot records the connection limiter slot taken for a client connection
+type clientSlot struct {
+	clientIP string
+	granted  bool
 }
 
+// connContextKey stores the client connection in each request context
+type connContextKey struct{}
+
 // NewProxyServer creates a new proxy server instance
 func NewProxyServer(config *Config) (*ProxyServer, error) {
 	logger, err := NewLogger(config)
@@ -473,20 +1294,91 @@ func NewProxyServer(config *Config) (*ProxyServer, error) {
 		rateLimiter = NewRateLimiter(config.RateLimitRequests, window)
 	}
 
+	var connLimiter *ConnectionLimiter
+	if config.MaxConnectionsPerClient > 0 {
+		connLimiter = NewConnectionLimiter(config.MaxConnectionsPerClient)
+	}
+
+	var upstreamURL *url.URL
+	if config.UpstreamProxy != "" {
+		upstreamURL, err = ParseUpstreamProxy(config.UpstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy: %v", err)
+		}
+	}
+
+	trustedProxies, err := ParseTrustedNetworks(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted_proxies: %v", err)
+	}
+
+	outboundDialer, err := newOutboundDialer(config.OutboundSourceIP)
+	if err != nil {
+		return nil, err
+	}
+	dialer := NewHappyEyeballsDialer(outboundDialer)
+	if config.DNSCache {
+		ttl, _ := time.ParseDuration(config.DNSCacheTTL)
+		dialer.SetResolver(NewCachingResolver(config.DNSServer, ttl))
+	}
+
+	// Request targets are dialed by their own dialer so private destinations can be
+	// refused. The check runs on the address being connected to, after resolution, so
+	// it covers HTTP, gRPC and CONNECT alike and a name rebinding to a private address.
+	targetDialer := dialer
+	if config.BlockPrivateDestinations {
+		targetDialer = NewHappyEyeballsDialer(publicOnly(outboundDialer))
+		targetDialer.SetResolver(dialer.resolver)
+	}
+
+	// Through an upstream proxy the transport only ever dials the proxy, which
+	// resolves and connects to the targets itself
+	transport := &http.Transport{
+		DialContext: targetDialer.DialContext,
+	}
+	if upstreamURL != nil {
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = http.ProxyURL(upstreamURL)
+	}
+
 	ps := &ProxyServer{
 		config:        config,
 		logger:        logger,
 		filterEngine:  filterEngine,
 		stealthEngine: stealthEngine,
 		rateLimiter:   rateLimiter,
+		connLimiter:   connLimiter,
+		upstreamURL:   upstreamURL,
+		trustedProxies: trustedProxies,
+		dialer:        dialer,
+		targetDialer:  targetDialer,
+		transport:     transport,
 		stats:         &ConnectionStats{},
+		tunnels:       make(map[net.Conn]struct{}),
+		clientSlots:   make(map[net.Conn]clientSlot),
+		contentProcessor: NewContentProcessor(config),
+		topBlocked:    NewTopKCounter(topBlockedCapacity),
+	}
+	if config.GlobalBandwidthLimit > 0 {
+		ps.globalBucket = NewTokenBucket(config.GlobalBandwidthLimit)
+	}
+	if config.GRPCProxy {
+		ps.grpcTransport = newGRPCTransport(targetDialer, true)
+		ps.grpcTLSTransport = newGRPCTransport(targetDialer, false)
 	}
 
 	// Create HTTP server
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", ps.handleHTTP)
-	mux.HandleFunc("/status", ps.handleStatus)
-	mux.HandleFunc("/stats", ps.handleStats)
+	ps.mux = http.NewServeMux()
+	ps.mux.HandleFunc("/", ps.handleHTTP)
+	ps.mux.HandleFunc("/status", ps.handleStatus)
+	ps.mux.HandleFunc("/stats", ps.handleStats)
+	ps.mux.HandleFunc("/stats/rules", ps.handleRuleStats)
+	ps.mux.HandleFunc("/metrics", ps.handleMetrics)
+	ps.mux.HandleFunc("/healthz", ps.handleHealthz)
+	ps.mux.HandleFunc("/readyz", ps.handleReadyz)
+	ps.mux.HandleFunc("/api/rules", ps.handleRulesAPI)
+	ps.mux.HandleFunc("/api/rules/", ps.handleRulesAPI)
+	ps.mux.HandleFunc("/api/top-blocked", ps.handleTopBlocked)
 
 	readTimeout, _ := time.ParseDuration(config.ReadTimeout)
 	writeTimeout, _ := time.ParseDuration(config.WriteTimeout)
@@ -494,45 +1386,477 @@ func NewProxyServer(config *Config) (*ProxyServer, error) {
 
 	ps.server = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", config.ListenAddr, config.ListenPort),
-		Handler:      mux,
+		Handler:      ps,
 		ReadTimeout:  readTimeout,
 		WriteTimeout: writeTimeout,
 		IdleTimeout:  idleTimeout,
 		MaxHeaderBytes: 1 << 20, // 1MB
+		ConnState:    ps.trackConnState,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	// ServeTLS negotiates HTTP/2 by itself; cleartext gRPC clients need h2c
+	if config.GRPCProxy && !config.TLSEnabled {
+		ps.server.Handler = h2c.NewHandler(ps, &http2.Server{})
+	}
+
+	if config.TLSEnabled {
+		// The certificate is served from a store so it can be replaced without a restart
+		ps.certStore, err = NewCertStore(config.CertFile, config.KeyFile, ps.logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		tlsConfig, err := CreateTLSConfig(ps.certStore, TLSOptions{
+			MinVersion:               config.TLSMinVersion,
+			CipherSuites:             config.TLSCipherSuites,
+			PreferServerCipherSuites: config.TLSPreferServerCiphers,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS config: %v", err)
+		}
+
+		// Clients without a valid certificate are refused during the handshake
+		if config.ClientCAFile != "" {
+			if err := RequireClientCerts(tlsConfig, config.ClientCAFile, config.ClientCertUsers); err != nil {
+				return nil, err
+			}
+		}
+		ps.server.TLSConfig = tlsConfig
 	}
 
+	connIdleTimeout, _ := time.ParseDuration(config.ConnectionIdleTimeout)
+	ps.monitor = NewNetworkMonitor(connIdleTimeout)
+
 	return ps, nil
 }
 
+// ServeHTTP sends proxy traffic (CONNECT and absolute-URI requests) to handleHTTP
+// and everything else to the local endpoints. ServeMux cannot route CONNECT itself
+// because its request path is empty.
+func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok && !ps.clientSlotGranted(conn) {
+		ps.logger.Access("Connection limit reached: %s %s %s", r.RemoteAddr, r.Method, r.URL.String())
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+	if r.Method == "CONNECT" || r.URL.IsAbs() || (ps.config.GRPCProxy && isGRPCRequest(r)) {
+		ps.handleHTTP(w, r)
+		return
+	}
+	ps.mux.ServeHTTP(w, r)
+}
+
+// newOutboundDialer creates the dialer used for all outbound connections, bound to
+// sourceIP when set. The address must be assigned to a local interface.
+func newOutboundDialer(sourceIP string) (*net.Dialer, error) {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if sourceIP == "" {
+		return dialer, nil
+	}
+
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid outbound source IP: %s", sourceIP)
+	}
+	if !isLocalInterfaceIP(ip) {
+		return nil, fmt.Errorf("outbound source IP %s is not assigned to a local interface", sourceIP)
+	}
+
+	dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	return dialer, nil
+}
+
+// isLocalInterfaceIP reports whether ip is assigned to one of the host's interfaces
+func isLocalInterfaceIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Start starts the proxy server
 func (ps *ProxyServer) Start() error {
 	ps.logger.Info("Starting OblivionFilter Proxy Server v%s", Version)
-	ps.logger.Info("Listening on %s", ps.server.Addr)
 	ps.logger.Info("Filtering enabled: %v", ps.config.FilteringEnabled)
 	ps.logger.Info("Stealth mode: %v", ps.config.StealthMode)
 
-	if ps.config.TLSEnabled {
-		return ps.server.ListenAndServeTLS(ps.config.CertFile, ps.config.KeyFile)
+	if ps.config.RulesFile != "" {
+		if err := ps.watchRulesFile(); err != nil {
+			ps.logger.Error("Failed to watch rules file %s, hot reload disabled: %v", ps.config.RulesFile, err)
+		}
+	}
+	if ps.certStore != nil {
+		if err := ps.certStore.Watch(); err != nil {
+			ps.logger.Error("Failed to watch certificate %s, reload on SIGHUP only: %v", ps.config.CertFile, err)
+		}
+	}
+
+	var trusted []*net.IPNet
+	if ps.config.ProxyProtocol {
+		var err error
+		if trusted, err = ParseTrustedNetworks(ps.config.ProxyProtocolTrusted); err != nil {
+			return fmt.Errorf("invalid proxy_protocol_trusted: %v", err)
+		}
+	}
+
+	var listeners []net.Listener
+	for _, endpoint := range ps.listenEndpoints() {
+		listener, err := listenEndpoint(endpoint)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %v", endpoint, err)
+		}
+		ps.logger.Info("Listening on %s", endpoint)
+
+		if ps.config.ProxyProtocol {
+			listener = NewProxyProtoListener(listener, trusted, ps.logger)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	atomic.StoreInt32(&ps.listening, 1)
+	defer atomic.StoreInt32(&ps.listening, 0)
+
+	// All listeners share ps.server, so Shutdown and Close stop every one of them
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if ps.config.TLSEnabled {
+				// The certificate comes from TLSConfig.GetCertificate
+				errs <- ps.server.ServeTLS(listener, "", "")
+				return
+			}
+			errs <- ps.server.Serve(listener)
+		}(listener)
+	}
+
+	// One listener failing takes the others down with it
+	err := <-errs
+	if err != http.ErrServerClosed {
+		ps.server.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-errs
+	}
+
+	return err
+}
+
+// listenEndpoints returns the configured listen endpoints, falling back to
+// listen_addr:listen_port
+func (ps *ProxyServer) listenEndpoints() []string {
+	if len(ps.config.ListenAddresses) > 0 {
+		return ps.config.ListenAddresses
+	}
+	return []string{ps.server.Addr}
+}
+
+// listenEndpoint opens a TCP listener for host:port or a Unix socket for unix:/path.
+// A stale socket file left by an unclean exit is removed first.
+func listenEndpoint(endpoint string) (net.Listener, error) {
+	if !strings.HasPrefix(endpoint, "unix:") {
+		return net.Listen("tcp", endpoint)
+	}
+
+	path := strings.TrimPrefix(endpoint, "unix:")
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// rulesReloadDebounce coalesces the burst of events editors produce when saving a file
+const rulesReloadDebounce = 500 * time.Millisecond
+
+// watchRulesFile reloads the rules file whenever it changes. The parent directory is
+// watched rather than the file so replacements by rename (editors, SaveRules) are seen.
+func (ps *ProxyServer) watchRulesFile() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Clean(ps.config.RulesFile)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	ps.rulesWatcher = watcher
+
+	go func() {
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					if debounce != nil {
+						debounce.Stop()
+					}
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op == fsnotify.Chmod {
+					continue
+				}
+				if debounce == nil {
+					debounce = time.AfterFunc(rulesReloadDebounce, ps.reloadRules)
+				} else {
+					debounce.Reset(rulesReloadDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				ps.logger.Error("Rules file watcher error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reloadRules swaps in the rules file, keeping the current rules when it fails to load
+func (ps *ProxyServer) reloadRules() {
+	count, err := ps.filterEngine.ReloadRulesFile()
+	if err != nil {
+		ps.logger.Error("FILTER RELOAD FAILED for %s, keeping previous rules: %v", ps.config.RulesFile, err)
+		return
 	}
+	ps.logger.Info("Reloaded %d filter rules from %s", count, ps.config.RulesFile)
+}
 
-	return ps.server.ListenAndServe()
+// ReloadCertificate reads the TLS key pair from disk again, keeping the current one
+// if that fails. Established connections are unaffected.
+func (ps *ProxyServer) ReloadCertificate() {
+	if ps.certStore == nil {
+		return
+	}
+	if err := ps.certStore.Reload(); err != nil {
+		ps.logger.Error("CERTIFICATE RELOAD FAILED for %s, keeping previous certificate: %v", ps.config.CertFile, err)
+		return
+	}
+	ps.logger.Info("Reloaded TLS certificate from %s", ps.config.CertFile)
 }
 
-// Stop stops the proxy server
+// defaultShutdownGracePeriod is used when shutdown_grace_period is unset
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// Stop stops the proxy server, draining in-flight requests and tunnels for up to
+// shutdown_grace_period before force-closing them
 func (ps *ProxyServer) Stop() error {
+	grace, _ := time.ParseDuration(ps.config.ShutdownGracePeriod)
+	if grace <= 0 {
+		grace = defaultShutdownGracePeriod
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	_, err := ps.Shutdown(ctx)
+	return err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests and tunnels
+// to finish until ctx expires, after which the remainder are force-closed
+func (ps *ProxyServer) Shutdown(ctx context.Context) (*ShutdownMetrics, error) {
 	ps.logger.Info("Shutting down proxy server...")
-	return ps.server.Close()
+	startTime := time.Now()
+
+	metrics := &ShutdownMetrics{InFlight: atomic.LoadInt64(&ps.activeRequests)}
+	atomic.StoreInt64(&ps.drainedRequests, 0)
+	atomic.StoreInt32(&ps.draining, 1)
+
+	// Hijacked tunnels are not tracked by http.Server, so wait on our own counter too
+	drainErr := ps.server.Shutdown(ctx)
+	if drainErr == nil {
+		drainErr = ps.waitForRequests(ctx)
+	}
+
+	atomic.StoreInt32(&ps.draining, 0)
+	metrics.Drained = atomic.LoadInt64(&ps.drainedRequests)
+
+	if ps.rulesWatcher != nil {
+		ps.rulesWatcher.Close()
+	}
+	if ps.certStore != nil {
+		ps.certStore.Close()
+	}
+	ps.monitor.Stop()
+
+	var err error
+	if drainErr != nil {
+		metrics.ForcedCloses = atomic.LoadInt64(&ps.activeRequests)
+		err = ps.server.Close()
+		ps.closeTunnels()
+	}
+	metrics.Duration = time.Since(startTime)
+
+	ps.mu.Lock()
+	ps.shutdownMetrics = metrics
+	ps.mu.Unlock()
+
+	ps.logger.Info("Shutdown complete in %v: %d in flight, %d drained, %d force-closed",
+		metrics.Duration, metrics.InFlight, metrics.Drained, metrics.ForcedCloses)
+	return metrics, err
+}
+
+// LastShutdownMetrics returns the metrics recorded by the last shutdown, or nil
+func (ps *ProxyServer) LastShutdownMetrics() *ShutdownMetrics {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.shutdownMetrics
+}
+
+// waitForRequests blocks until no requests are in flight or ctx expires
+func (ps *ProxyServer) waitForRequests(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&ps.activeRequests) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// finishRequest marks a request as complete, counting it as drained during shutdown
+func (ps *ProxyServer) finishRequest() {
+	if atomic.LoadInt32(&ps.draining) == 1 {
+		atomic.AddInt64(&ps.drainedRequests, 1)
+	}
+	atomic.AddInt64(&ps.activeRequests, -1)
+}
+
+// trackConnState keeps ActiveConnections and the network monitor in step with
+// client connections. A hijacked connection stays counted until the handler that
+// took it over returns.
+func (ps *ProxyServer) trackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&ps.stats.ActiveConnections, 1)
+	case http.StateActive:
+		ps.acquireClientSlot(conn)
+		// Like the client slot, the monitor waits for the first request so a PROXY
+		// protocol connection reports its real client address
+		ps.monitor.RecordRequest(monitorID(conn), conn.RemoteAddr().String())
+	case http.StateClosed:
+		atomic.AddInt64(&ps.stats.ActiveConnections, -1)
+		ps.releaseClientSlot(conn)
+		ps.monitor.UntrackConnection(monitorID(conn))
+	}
+}
+
+// monitorID identifies a client connection in the network monitor
+func monitorID(conn net.Conn) string {
+	return fmt.Sprintf("conn-%p", conn)
+}
+
+// acquireClientSlot takes a connection limiter slot for the peer address of conn
+// the first time it carries a request. The address comes from the connection,
+// never from request headers, so clients cannot pick the key they are counted
+// under. It is read here rather than on accept because a PROXY protocol
+// connection only knows its client once the header has been read.
+func (ps *ProxyServer) acquireClientSlot(conn net.Conn) {
+	if ps.connLimiter == nil {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, ok := ps.clientSlots[conn]; ok {
+		return
+	}
+	clientIP := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	ps.clientSlots[conn] = clientSlot{clientIP: clientIP, granted: ps.connLimiter.Acquire(clientIP)}
+}
+
+// releaseClientSlot frees the slot held by conn. The entry is removed so a
+// connection releases at most once, whether it closes or is hijacked.
+func (ps *ProxyServer) releaseClientSlot(conn net.Conn) {
+	ps.mu.Lock()
+	slot, ok := ps.clientSlots[conn]
+	delete(ps.clientSlots, conn)
+	ps.mu.Unlock()
+
+	if ok && slot.granted {
+		ps.connLimiter.Release(slot.clientIP)
+	}
+}
+
+// clientSlotGranted reports whether conn is within its client's connection limit
+func (ps *ProxyServer) clientSlotGranted(conn net.Conn) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	slot, ok := ps.clientSlots[conn]
+	return !ok || slot.granted
+}
+
+// trackTunnel registers hijacked connections so shutdown can force-close them
+func (ps *ProxyServer) trackTunnel(conns ...net.Conn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, conn := range conns {
+		ps.tunnels[conn] = struct{}{}
+	}
+}
+
+// untrackTunnel removes connections registered with trackTunnel
+func (ps *ProxyServer) untrackTunnel(conns ...net.Conn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, conn := range conns {
+		delete(ps.tunnels, conn)
+	}
+}
+
+// closeTunnels force-closes all tracked tunnel connections
+func (ps *ProxyServer) closeTunnels() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for conn := range ps.tunnels {
+		conn.Close()
+	}
 }
 
 // handleHTTP handles HTTP proxy requests
 func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
+	atomic.AddInt64(&ps.activeRequests, 1)
+	defer ps.finishRequest()
+
 	// Rate limiting
 	if ps.rateLimiter != nil {
 		clientIP := ps.getClientIP(r)
-		if !ps.rateLimiter.Allow(clientIP) {
+		if allowed, retryAfter := ps.rateLimiter.Check(clientIP); !allowed {
 			ps.logger.Access("Rate limited: %s %s", r.Method, r.URL.String())
+			w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
@@ -556,11 +1880,21 @@ func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ps.config.ForwardedHeaders {
+		setForwardedHeaders(r)
+	}
+
+	if ps.config.GRPCProxy && isGRPCRequest(r) {
+		ps.handleGRPC(w, r, startTime)
+		return
+	}
+
 	// Filter request
-	if ps.filterEngine.ShouldBlock(r) {
-		ps.logger.Access("Blocked: %s %s", r.Method, r.URL.String())
+	if blocked, reason := ps.filterEngine.Evaluate(r); blocked {
+		ps.logger.Access("Blocked: %s %s (%s)", r.Method, r.URL.String(), reason)
 		ps.updateStats(0, 1, 0)
-		http.Error(w, "Request blocked by filter", http.StatusForbidden)
+		ps.recordBlocked(r.Host)
+		http.Error(w, "Request blocked by filter: "+reason, http.StatusForbidden)
 		return
 	}
 
@@ -573,22 +1907,45 @@ func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 // handleConnect handles HTTPS CONNECT requests
 func (ps *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+	// Only allowed ports may be tunneled to, so CONNECT cannot reach arbitrary services
+	target, port := connectTarget(r.Host)
+	if !ps.connectPortAllowed(port) {
+		ps.logger.Access("Refused CONNECT to disallowed port: %s", target)
+		http.Error(w, fmt.Sprintf("CONNECT to port %d is not allowed", port), http.StatusForbidden)
+		return
+	}
+
 	// Filter CONNECT request
-	if ps.filterEngine.ShouldBlock(r) {
-		ps.logger.Access("Blocked CONNECT: %s", r.Host)
+	if blocked, reason := ps.filterEngine.Evaluate(r); blocked {
+		ps.logger.Access("Blocked CONNECT: %s (%s)", r.Host, reason)
 		ps.updateStats(0, 1, 0)
-		http.Error(w, "Connection blocked by filter", http.StatusForbidden)
+		ps.recordBlocked(r.Host)
+		http.Error(w, "Connection blocked by filter: "+reason, http.StatusForbidden)
 		return
 	}
 
-	// Establish connection to target
-	targetConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
-	if err != nil {
-		ps.logger.Error("Failed to connect to target: %v", err)
-		http.Error(w, "Failed to connect to target", http.StatusBadGateway)
-		return
+	// A ClientHello that has to be inspected is read before the target is dialed, so
+	// blackholed SNIs and denylisted clients never cause an upstream connection.
+	// Otherwise the target is dialed first and a failure still gets a status code.
+	inspect := ps.filterEngine.HasSNIBlacklist() || ps.filterEngine.HasJA3Denylist() || ps.config.LogJA3
+	var targetConn net.Conn
+	defer func() {
+		if targetConn != nil {
+			targetConn.Close()
+		}
+	}()
+	if !inspect {
+		conn, err := ps.dialConnectTarget(target)
+		if errors.Is(err, errPrivateAddress) {
+			http.Error(w, "CONNECT to private addresses is not allowed", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to connect to target", http.StatusBadGateway)
+			return
+		}
+		targetConn = conn
 	}
-	defer targetConn.Close()
 
 	// Send 200 Connection Established response
 	w.WriteHeader(http.StatusOK)
@@ -608,32 +1965,146 @@ func (ps *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 	defer clientConn.Close()
 
-	// Tunnel data between client and target
-	ps.tunnel(clientConn, targetConn)
-}
+	// The server stops tracking hijacked connections, so the tunnel releases its own count
+	defer atomic.AddInt64(&ps.stats.ActiveConnections, -1)
+	defer ps.releaseClientSlot(clientConn)
+	defer ps.monitor.UntrackConnection(monitorID(clientConn))
 
-// proxyRequest proxies an HTTP request
-func (ps *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, startTime time.Time) {
-	// Create client with upstream proxy if configured
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
+	ps.trackTunnel(clientConn)
+	defer ps.untrackTunnel(clientConn)
 
-	if ps.config.UpstreamProxy != "" {
-		proxyURL, err := url.Parse(ps.config.UpstreamProxy)
-		if err == nil {
-			client.Transport = &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
+	if inspect {
+		hello, allowed := ps.inspectClientHello(clientConn, r)
+		if !allowed {
+			return
+		}
+		// The client already has its 200, so a failed dial can only close the tunnel
+		if targetConn, err = ps.dialConnectTarget(target); err != nil {
+			return
+		}
+		if len(hello) > 0 {
+			if _, err := targetConn.Write(hello); err != nil {
+				ps.logger.Error("Failed to forward ClientHello: %v", err)
+				return
 			}
 		}
 	}
 
-	// Create request copy
-	req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
-	if err != nil {
+	ps.trackTunnel(targetConn)
+	defer ps.untrackTunnel(targetConn)
+
+	// Tunnel data between client and target
+	ps.tunnel(clientConn, targetConn, monitorID(clientConn))
+}
+
+// dialConnectTarget connects to the target of a CONNECT request, logging failures
+func (ps *ProxyServer) dialConnectTarget(target string) (net.Conn, error) {
+	conn, err := ps.targetDialer.Dial("tcp", target)
+	if errors.Is(err, errPrivateAddress) {
+		ps.logger.Access("Refused CONNECT to private address: %s", target)
+	} else if err != nil {
+		ps.logger.Error("Failed to connect to target: %v", err)
+	}
+	return conn, err
+}
+
+// inspectClientHello peeks the ClientHello of a tunnel so blackholed SNIs and
+// denylisted clients can be refused, blackholing the connection if so. It returns
+// the bytes read, which still have to be forwarded, and whether the tunnel may go on.
+func (ps *ProxyServer) inspectClientHello(clientConn net.Conn, r *http.Request) ([]byte, bool) {
+	hello, err := ReadClientHello(clientConn, 10*time.Second)
+	if err != nil {
+		if err != errNotTLS {
+			ps.logger.Debug("ClientHello peek failed for %s: %v", r.Host, err)
+		}
+		return hello, true
+	}
+	info, err := ParseClientHello(hello)
+	if err != nil {
+		return hello, true
+	}
+
+	if ps.config.LogJA3 {
+		ps.logger.Access("JA3 %s %s (CONNECT %s, SNI %s) %s", ps.getClientIP(r), info.JA3Hash, r.Host, info.ServerName, info.JA3)
+	}
+	if ps.filterEngine.IsSNIBlackholed(info.ServerName) {
+		ps.logger.Access("Blackholed SNI: %s (CONNECT %s)", info.ServerName, r.Host)
+		ps.updateStats(0, 1, 0)
+		ps.recordBlocked(info.ServerName)
+		ps.blackholeConnection(clientConn)
+		return nil, false
+	}
+	if ps.filterEngine.IsJA3Denied(info.JA3Hash) {
+		if ps.config.JA3Action == "flag" {
+			ps.logger.Access("Flagged JA3 %s from %s (CONNECT %s)", info.JA3Hash, ps.getClientIP(r), r.Host)
+		} else {
+			ps.logger.Access("Blocked JA3 %s from %s (CONNECT %s)", info.JA3Hash, ps.getClientIP(r), r.Host)
+			ps.updateStats(0, 1, 0)
+			ps.recordBlocked(r.Host)
+			ps.blackholeConnection(clientConn)
+			return nil, false
+		}
+	}
+	return hello, true
+}
+
+// blackholeConnection terminates a client connection with a TLS alert or a TCP reset
+func (ps *ProxyServer) blackholeConnection(conn net.Conn) {
+	if ps.config.SNIBlackholeAction == "reset" {
+		if tcpConn := underlyingTCPConn(conn); tcpConn != nil {
+			tcpConn.SetLinger(0)
+		}
+		return
+	}
+
+	alert, ok := tlsAlertCodes[ps.config.SNIBlackholeAction]
+	if !ok {
+		alert = tlsAlertCodes["handshake_failure"]
+	}
+	writeTLSAlert(conn, alert)
+}
+
+// underlyingTCPConn unwraps the TLS and PROXY protocol layers around conn, returning
+// nil when there is no TCP connection beneath them
+func underlyingTCPConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyProtoConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// proxyRequest proxies an HTTP request
+func (ps *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, startTime time.Time) {
+	// Create client; the shared transport applies the upstream proxy and source address
+	client := &http.Client{
+		Transport: ps.transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	if !ps.limitRequestBody(w, r) {
+		return
+	}
+
+	// The request timeout covers reading the body too, except for streams, which
+	// are allowed to stay open for as long as the client does
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timeout := time.AfterFunc(upstreamRequestTimeout, cancel)
+	defer timeout.Stop()
+
+	// Create request copy
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), r.Body)
+	if err != nil {
 		ps.logger.Error("Failed to create request: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -646,8 +2117,19 @@ func (ps *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, star
 		}
 	}
 
+	withholdCookies, stripCookies := ps.thirdPartyCookiePolicy(r)
+	if withholdCookies && req.Header.Get("Cookie") != "" {
+		req.Header.Del("Cookie")
+		ps.logger.Debug("Withheld cookies from third-party request to %s", r.URL.Host)
+	}
+
 	// Make request
 	resp, err := client.Do(req)
+	if errors.Is(err, errPrivateAddress) {
+		ps.logger.Access("Refused request to private address: %s", r.URL.Host)
+		http.Error(w, "Requests to private addresses are not allowed", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		ps.logger.Error("Request failed: %v", err)
 		http.Error(w, "Request failed", http.StatusBadGateway)
@@ -666,6 +2148,11 @@ func (ps *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, star
 		}
 	}
 
+	if stripCookies && len(resp.Header["Set-Cookie"]) > 0 {
+		resp.Header.Del("Set-Cookie")
+		ps.logger.Debug("Stripped third-party cookies from %s", r.URL.Host)
+	}
+
 	// Copy response headers
 	for key, values := range resp.Header {
 		for _, value := range values {
@@ -673,10 +2160,29 @@ func (ps *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, star
 		}
 	}
 
+	streaming := isStreamingResponse(resp)
+	body := io.Reader(resp.Body)
+	if !streaming && (ps.config.FilteringEnabled || ps.config.FingerprintingProtection.Enabled()) && isHTMLResponse(resp) {
+		body = ps.filterResponseBody(w, resp)
+	}
+
+	// Streams are flushed as they arrive and exempt from the server's deadlines
+	dst := io.Writer(w)
+	controller := http.NewResponseController(w)
+	if streaming {
+		timeout.Stop()
+		controller.SetReadDeadline(time.Time{})
+		controller.SetWriteDeadline(time.Time{})
+		dst = &flushWriter{w: w, controller: controller}
+	}
+
 	w.WriteHeader(resp.StatusCode)
+	if streaming {
+		controller.Flush()
+	}
 
 	// Copy response body
-	written, err := io.Copy(w, resp.Body)
+	written, err := io.Copy(dst, ps.throttle(body, ps.connectionBucket()))
 	if err != nil {
 		ps.logger.Error("Failed to copy response: %v", err)
 		return
@@ -690,28 +2196,250 @@ func (ps *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, star
 	ps.logger.Access("%s %s %d %d bytes %v", r.Method, r.URL.String(), resp.StatusCode, written, duration)
 }
 
-// tunnel tunnels data between two connections
-func (ps *ProxyServer) tunnel(client, target net.Conn) {
+// upstreamRequestTimeout bounds a proxied request, including reading its response,
+// unless the response is a stream
+const upstreamRequestTimeout = 30 * time.Second
+
+// streamingContentTypes are responses delivered incrementally over a long-lived
+// connection, which must not be buffered
+var streamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/stream+json",
+	"multipart/x-mixed-replace",
+}
+
+// isStreamingResponse reports whether resp is a stream such as Server-Sent Events
+func isStreamingResponse(resp *http.Response) bool {
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	for _, streamingType := range streamingContentTypes {
+		if strings.HasPrefix(contentType, streamingType) {
+			return true
+		}
+	}
+	return false
+}
+
+// flushWriter flushes every write through to the client
+type flushWriter struct {
+	w          io.Writer
+	controller *http.ResponseController
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := fw.controller.Flush(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// maxInjectedBodySize caps the HTML buffered for filtering; larger pages are passed
+// through untouched
+const maxInjectedBodySize = 5 << 20
+
+// isHTMLResponse reports whether resp carries an HTML document
+func isHTMLResponse(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	return strings.Contains(contentType, "text/html") || strings.Contains(contentType, "application/xhtml")
+}
+
+// filterResponseBody buffers an HTML body, applies the cosmetic rules and the
+// fingerprinting shims and fixes up the response headers, which must not have been
+// written yet. The transport has already removed any chunked framing. A body left
+// unmodified is replayed byte for byte under the upstream framing headers; a
+// modified one is sent decoded with an exact Content-Length.
+func (ps *ProxyServer) filterResponseBody(w http.ResponseWriter, resp *http.Response) io.Reader {
+	if resp.ContentLength > maxInjectedBodySize {
+		return resp.Body
+	}
+
+	original, err := io.ReadAll(io.LimitReader(resp.Body, maxInjectedBodySize+1))
+	if err != nil || len(original) > maxInjectedBodySize {
+		// Replay what was read; a read error surfaces again while copying
+		return io.MultiReader(bytes.NewReader(original), resp.Body)
+	}
+
+	content, ok := decodeResponseBody(original, resp.Header.Get("Content-Encoding"))
+	if !ok {
+		return bytes.NewReader(original)
+	}
+
+	modified := false
+	if ps.config.FilteringEnabled {
+		content, modified = ps.filterEngine.ApplyCosmeticRules(content)
+	}
+	if ps.config.FingerprintingProtection.Enabled() {
+		injected := ps.contentProcessor.InjectFingerprintingProtection(content)
+		modified = modified || !bytes.Equal(injected, content)
+		content = injected
+	}
+	if !modified {
+		return bytes.NewReader(original)
+	}
+
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	return bytes.NewReader(content)
+}
+
+// decodeResponseBody undoes a gzip Content-Encoding, reporting false for encodings
+// it can't decode and for bodies that inflate past maxInjectedBodySize
+func decodeResponseBody(body []byte, encoding string) ([]byte, bool) {
+	switch encoding {
+	case "", "identity":
+		return body, true
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, false
+		}
+		defer reader.Close()
+		decoded, err := io.ReadAll(io.LimitReader(reader, maxInjectedBodySize+1))
+		if err != nil || len(decoded) > maxInjectedBodySize {
+			return nil, false
+		}
+		return decoded, true
+	default:
+		return nil, false
+	}
+}
+
+// limitRequestBody enforces max_request_body_size, answering 413 and returning false
+// for oversized bodies. Bodies of unknown length are buffered so they are rejected
+// before anything is forwarded.
+func (ps *ProxyServer) limitRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	limit := ps.config.MaxRequestBodySize
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	if r.ContentLength > limit {
+		ps.logger.Access("Request body too large: %d bytes %s %s", r.ContentLength, r.Method, r.URL.String())
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	if r.ContentLength >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		return true
+	}
+
+	body, err := readRequestBody(r.Body, limit)
+	if err == errBodyTooLarge {
+		ps.logger.Access("Request body too large: over %d bytes %s %s", limit, r.Method, r.URL.String())
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		ps.logger.Error("Failed to read request body: %v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return false
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return true
+}
+
+// connectTarget returns the host:port a CONNECT request asks for and its port,
+// defaulting to 443 when the authority has none. The port is 0 if it is invalid.
+func connectTarget(authority string) (string, int) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return net.JoinHostPort(strings.Trim(authority, "[]"), "443"), 443
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return authority, 0
+	}
+	return net.JoinHostPort(host, port), n
+}
+
+// connectPortAllowed reports whether CONNECT may tunnel to port
+func (ps *ProxyServer) connectPortAllowed(port int) bool {
+	if port == 0 {
+		return false
+	}
+	if len(ps.config.ConnectAllowedPorts) == 0 {
+		return true
+	}
+	for _, allowed := range ps.config.ConnectAllowedPorts {
+		if port == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel tunnels data between two connections, reporting the traffic to the
+// network monitor under id so a busy tunnel is never swept as idle
+func (ps *ProxyServer) tunnel(client, target net.Conn, id string) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	// Both directions share the connection's bandwidth limit
+	bucket := ps.connectionBucket()
+
 	// Client to target
 	go func() {
 		defer wg.Done()
-		written, _ := io.Copy(target, client)
+		reader := &monitoredReader{reader: client, monitor: ps.monitor, id: id, fromClient: true}
+		written, _ := io.Copy(target, ps.throttle(reader, bucket))
 		ps.updateStats(0, 0, written)
+		closeWrite(target)
 	}()
 
 	// Target to client
 	go func() {
 		defer wg.Done()
-		written, _ := io.Copy(client, target)
+		reader := &monitoredReader{reader: target, monitor: ps.monitor, id: id}
+		written, _ := io.Copy(client, ps.throttle(reader, bucket))
 		ps.updateStats(0, 0, written)
+		closeWrite(client)
 	}()
 
 	wg.Wait()
 }
 
+// closeWrite passes the end of one direction of a tunnel on to the other side, so a
+// peer waiting for EOF finishes and the tunnel can end. Connections that cannot be
+// half-closed are closed outright.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else if tcpConn := underlyingTCPConn(conn); tcpConn != nil {
+		tcpConn.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// monitoredReader records the bytes read from one side of a tunnel in the network
+// monitor
+type monitoredReader struct {
+	reader     io.Reader
+	monitor    *NetworkMonitor
+	id         string
+	fromClient bool
+}
+
+func (mr *monitoredReader) Read(p []byte) (int, error) {
+	n, err := mr.reader.Read(p)
+	if n > 0 {
+		if mr.fromClient {
+			mr.monitor.RecordTransfer(mr.id, 0, int64(n))
+		} else {
+			mr.monitor.RecordTransfer(mr.id, int64(n), 0)
+		}
+	}
+	return n, err
+}
+
 // authenticate checks proxy authentication
 func (ps *ProxyServer) authenticate(r *http.Request) bool {
 	auth := r.Header.Get("Proxy-Authorization")
@@ -729,23 +2457,85 @@ func (ps *ProxyServer) encodeBasicAuth(username, password string) string {
 	return fmt.Sprintf("%s:%s", username, password) // Should be base64 encoded in real implementation
 }
 
-// getClientIP extracts client IP from request
+// getClientIP extracts client IP from request. Forwarding headers are only believed
+// when the peer is one of trusted_proxies; with PROXY protocol the connection already
+// reports the client address, so they are never consulted.
 func (ps *ProxyServer) getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return strings.Split(xff, ",")[0]
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ps.config.ProxyProtocol || !ps.isTrustedProxy(host) {
+		return host
+	}
+
+	// Walk X-Forwarded-For from the nearest hop and take the first address not
+	// added by one of our own proxies; anything further left is client-supplied
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !ps.isTrustedProxy(hop) || i == 0 {
+				return hop
+			}
+		}
 	}
 
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xri) != nil {
 		return xri
 	}
 
-	// Use remote address
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
 	return host
 }
 
+// isTrustedProxy reports whether ip belongs to one of trusted_proxies
+func (ps *ProxyServer) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range ps.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders records the client address for the upstream server, adding
+// to any X-Forwarded-For and Forwarded chain set by proxies in front of this one
+func setForwardedHeaders(r *http.Request) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+	} else {
+		r.Header.Set("X-Forwarded-For", clientIP)
+	}
+	r.Header.Set("X-Real-IP", clientIP)
+
+	// RFC 7239 quotes IPv6 addresses, which contain colons
+	node := clientIP
+	if strings.Contains(clientIP, ":") {
+		node = `"[` + clientIP + `]"`
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	forwarded := "for=" + node + ";proto=" + proto
+	if r.Host != "" {
+		forwarded += `;host="` + r.Host + `"`
+	}
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	r.Header.Set("Forwarded", forwarded)
+}
+
 // updateStats updates connection statistics
 func (ps *ProxyServer) updateStats(connections, blocked, bytes int64) {
 	ps.stats.mu.Lock()
@@ -772,6 +2562,7 @@ func (ps *ProxyServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 		"status":  "running",
 		"version": Version,
 		"uptime":  time.Since(time.Now()).String(),
+		"active_connections": atomic.LoadInt64(&ps.stats.ActiveConnections),
 		"config": map[string]interface{}{
 			"filtering_enabled": ps.config.FilteringEnabled,
 			"stealth_mode":      ps.config.StealthMode,
@@ -781,38 +2572,343 @@ func (ps *ProxyServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
+// ComponentHealth is the result of a single health check
+type ComponentHealth struct {
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthReport is the body returned by /healthz and /readyz
+type HealthReport struct {
+	Status     string                      `json:"status"`
+	Components map[string]*ComponentHealth `json:"components"`
+}
+
+// healthy reports whether every component passed
+func (hr *HealthReport) healthy() bool {
+	for _, component := range hr.Components {
+		if !component.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHealth runs the per-component health checks. The upstream and rate limiter
+// checks only apply when those features are configured.
+func (ps *ProxyServer) checkHealth() *HealthReport {
+	report := ps.checkReadiness()
+
+	if ps.upstreamURL != nil {
+		upstream := &ComponentHealth{Healthy: true}
+		conn, err := ps.dialer.Dial("tcp", ps.upstreamURL.Host)
+		if err != nil {
+			upstream.Healthy = false
+			upstream.Message = fmt.Sprintf("upstream %s unreachable: %v", ps.upstreamURL.Host, err)
+		} else {
+			conn.Close()
+		}
+		report.Components["upstream"] = upstream
+	}
+
+	if ps.rateLimiter != nil {
+		limiter := &ComponentHealth{Healthy: ps.rateLimiter.Alive()}
+		if !limiter.Healthy {
+			limiter.Message = "rate limiter cleanup has stalled"
+		}
+		report.Components["rate_limiter"] = limiter
+	}
+
+	return report
+}
+
+// checkReadiness checks only what must be in place before traffic is accepted
+func (ps *ProxyServer) checkReadiness() *HealthReport {
+	report := &HealthReport{Components: make(map[string]*ComponentHealth)}
+
+	listener := &ComponentHealth{Healthy: atomic.LoadInt32(&ps.listening) == 1}
+	if !listener.Healthy {
+		listener.Message = "not listening on " + strings.Join(ps.listenEndpoints(), ", ")
+	}
+	report.Components["listener"] = listener
+
+	filters := &ComponentHealth{Healthy: ps.filterEngine != nil && ps.filterEngine.Loaded()}
+	if !filters.Healthy {
+		filters.Message = "filter lists not loaded"
+	}
+	report.Components["filter_engine"] = filters
+
+	return report
+}
+
+// writeHealthReport writes the report as JSON with 200 when healthy and 503 otherwise
+func writeHealthReport(w http.ResponseWriter, report *HealthReport, okStatus, failStatus string) {
+	code := http.StatusOK
+	report.Status = okStatus
+	if !report.healthy() {
+		code = http.StatusServiceUnavailable
+		report.Status = failStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleHealthz reports overall and per-component health
+func (ps *ProxyServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, ps.checkHealth(), "healthy", "unhealthy")
+}
+
+// handleReadyz reports ready once the server is listening and the filter lists are loaded
+func (ps *ProxyServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, ps.checkReadiness(), "ready", "not_ready")
+}
+
+// errRuleExists is returned by FilterEngine.AddRule for a rule that is already active
+var errRuleExists = errors.New("rule already exists")
+
+// authorizeAPI checks the bearer token on a management API request, writing the
+// error response when it fails
+func (ps *ProxyServer) authorizeAPI(w http.ResponseWriter, r *http.Request) bool {
+	if ps.config.APIToken == "" {
+		http.Error(w, "Management API disabled", http.StatusForbidden)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(ps.config.APIToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="OblivionFilter API"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleRulesAPI serves GET/POST /api/rules and DELETE /api/rules/{id}
+func (ps *ProxyServer) handleRulesAPI(w http.ResponseWriter, r *http.Request) {
+	if !ps.authorizeAPI(w, r) {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rules"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ps.filterEngine.Rules())
+
+	case id == "" && r.Method == http.MethodPost:
+		var body struct {
+			Rule string `json:"rule"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := ps.filterEngine.AddRule(body.Rule)
+		if err == errRuleExists {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(rule)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ps.logger.Info("Rule added via API: %s (%s)", rule.Rule, rule.ID)
+		ps.persistRules()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+
+	case id != "" && r.Method == http.MethodDelete:
+		if !ps.filterEngine.RemoveRule(id) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+
+		ps.logger.Info("Rule removed via API: %s", id)
+		ps.persistRules()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// recordBlocked counts a blocked request towards the top-blocked report
+func (ps *ProxyServer) recordBlocked(host string) {
+	if host = normalizeHost(host); host != "" {
+		ps.topBlocked.Add(host)
+	}
+}
+
+// handleTopBlocked serves GET /api/top-blocked?n=N, the most blocked domains since
+// startup. Counts are exact unless more than topBlockedCapacity domains were seen.
+func (ps *ProxyServer) handleTopBlocked(w http.ResponseWriter, r *http.Request) {
+	if !ps.authorizeAPI(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 10
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ps.topBlocked.Top(n))
+}
+
+// persistRules writes the live rules back to the rules file when persistence is enabled
+func (ps *ProxyServer) persistRules() {
+	if !ps.config.PersistRules || ps.config.RulesFile == "" {
+		return
+	}
+
+	if err := ps.filterEngine.SaveRules(ps.config.RulesFile); err != nil {
+		ps.logger.Error("Failed to persist rules to %s: %v", ps.config.RulesFile, err)
+	}
+}
+
+// StatsSnapshot is a consistent copy of ConnectionStats as served by /stats
+type StatsSnapshot struct {
+	TotalConnections    int64
+	ActiveConnections   int64
+	BlockedRequests     int64
+	FilteredRequests    int64
+	BytesTransferred    int64
+	RequestsPerSecond   float64
+	AverageResponseTime time.Duration
+}
+
+// Snapshot copies the statistics
+func (cs *ConnectionStats) Snapshot() StatsSnapshot {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	return StatsSnapshot{
+		TotalConnections:    cs.TotalConnections,
+		ActiveConnections:   atomic.LoadInt64(&cs.ActiveConnections),
+		BlockedRequests:     cs.BlockedRequests,
+		FilteredRequests:    cs.FilteredRequests,
+		BytesTransferred:    cs.BytesTransferred,
+		RequestsPerSecond:   cs.RequestsPerSecond,
+		AverageResponseTime: cs.AverageResponseTime,
+	}
+}
+
 // handleStats handles stats endpoint
 func (ps *ProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
-	ps.stats.mu.RLock()
-	defer ps.stats.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ps.stats.Snapshot())
+}
+
+// handleMetrics serves the statistics in the Prometheus text exposition format
+func (ps *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snapshot := ps.stats.Snapshot()
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"oblivion_active_connections", "gauge", "Client connections currently open, including CONNECT tunnels.", snapshot.ActiveConnections},
+		{"oblivion_active_requests", "gauge", "Requests and tunnels currently being handled.", atomic.LoadInt64(&ps.activeRequests)},
+		{"oblivion_connections_total", "counter", "Proxy requests accepted since startup.", snapshot.TotalConnections},
+		{"oblivion_blocked_requests_total", "counter", "Requests blocked by the filter since startup.", snapshot.BlockedRequests},
+		{"oblivion_bytes_transferred_total", "counter", "Bytes proxied since startup.", snapshot.BytesTransferred},
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
 
+// handleRuleStats lists the filter rules by how many requests each has blocked
+func (ps *ProxyServer) handleRuleStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ps.stats)
+	json.NewEncoder(w).Encode(ps.filterEngine.RuleStats())
 }
 
-// LoadConfig loads configuration from file
-func LoadConfig(filename string) (*Config, error) {
+// LoadConfig loads configuration from file, which may be empty or missing, then
+// applies the OBLIVION_* environment overrides and the command line flags, if
+// any. Settings take precedence in the order defaults < file < environment <
+// flags, and the result is validated once, so a setting may rely on one given
+// by another source.
+func LoadConfig(filename string, flags *flag.FlagSet) (*Config, error) {
 	config := DefaultConfig()
 
-	if filename == "" {
-		return config, nil
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, config); err != nil {
+				return nil, fmt.Errorf("failed to parse config file: %v", err)
+			}
+		}
+	}
+
+	if err := ApplyEnv(config, os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("invalid environment configuration:\n%v", err)
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return config, nil
+	if flags != nil {
+		applyFlags(config, flags)
+	}
+
+	if err := config.Validate(); err != nil {
+		if filename == "" {
+			return nil, fmt.Errorf("invalid configuration:\n%v", err)
+		}
+		return nil, fmt.Errorf("invalid configuration in %s:\n%v", filename, err)
 	}
 
-	data, err := os.ReadFile(filename)
+	return config, nil
+}
+
+// ParseUpstreamProxy parses and validates an upstream proxy URL
+func ParseUpstreamProxy(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %v", err)
+		return nil, err
 	}
 
-	if err := json.Unmarshal(data, config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	case "":
+		return nil, fmt.Errorf("missing scheme in %q (expected http, https or socks5)", rawURL)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q (expected http, https or socks5)", proxyURL.Scheme)
 	}
 
-	return config, nil
+	host, port, err := net.SplitHostPort(proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy must be host:port: %v", err)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing host in %q", rawURL)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	return proxyURL, nil
 }
 
 // LoadFilterRules loads filter rules from file
@@ -836,20 +2932,48 @@ func LoadFilterRules(filename string) ([]string, error) {
 	return rules, scanner.Err()
 }
 
+// applyFlags overrides config with the command line flags in flags, but only those
+// given: an unset flag's default must not undo the file or the environment
+func applyFlags(config *Config, flags *flag.FlagSet) {
+	value := func(name string) interface{} {
+		return flags.Lookup(name).Value.(flag.Getter).Get()
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.ListenPort = value("port").(int)
+		case "addr":
+			config.ListenAddr = value("addr").(string)
+		case "filters":
+			config.RulesFile = value("filters").(string)
+		}
+	})
+	if value("tls").(bool) {
+		config.TLSEnabled = true
+		if certFile := value("cert").(string); certFile != "" {
+			config.CertFile = certFile
+		}
+		if keyFile := value("key").(string); keyFile != "" {
+			config.KeyFile = keyFile
+		}
+	}
+}
+
 // Main function
 func main() {
 	var (
-		configFile   = flag.String("config", "", "Configuration file path")
+		configFile   = flag.String("config", "", "Configuration file path; OBLIVION_* environment variables override it and flags override both")
 		port         = flag.Int("port", 8080, "Listen port")
 		addr         = flag.String("addr", "127.0.0.1", "Listen address")
-		filterFile   = flag.String("filters", "", "Filter rules file")
 		showVersion  = flag.Bool("version", false, "Show version information")
 		generatePAC  = flag.String("pac", "", "Generate PAC file")
-		enableTLS    = flag.Bool("tls", false, "Enable TLS")
-		certFile     = flag.String("cert", "", "TLS certificate file")
-		keyFile      = flag.String("key", "", "TLS key file")
 		enableProfile = flag.Bool("profile", false, "Enable profiling")
 	)
+	// Read by applyFlags
+	flag.String("filters", "", "Filter rules file, reloaded on change and rewritten by the rules API when persist_rules is set")
+	flag.Bool("tls", false, "Enable TLS")
+	flag.String("cert", "", "TLS certificate file")
+	flag.String("key", "", "TLS key file")
 	flag.Parse()
 
 	// Show version
@@ -871,36 +2995,14 @@ func main() {
 	}
 
 	// Load configuration
-	config, err := LoadConfig(*configFile)
+	config, err := LoadConfig(*configFile, flag.CommandLine)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Override with command line flags
-	if *port != 8080 {
-		config.ListenPort = *port
-	}
-	if *addr != "127.0.0.1" {
-		config.ListenAddr = *addr
-	}
-	if *enableTLS {
-		config.TLSEnabled = true
-		if *certFile != "" {
-			config.CertFile = *certFile
-		}
-		if *keyFile != "" {
-			config.KeyFile = *keyFile
-		}
-	}
-
-	// Load filter rules
-	if *filterFile != "" {
-		rules, err := LoadFilterRules(*filterFile)
-		if err != nil {
-			log.Printf("Warning: Failed to load filter rules: %v", err)
-		} else {
-			config.FilterRules = append(config.FilterRules, rules...)
-		}
+	// Run self-test subcommand
+	if flag.Arg(0) == "selftest" {
+		os.Exit(runSelfTest(config, flag.Args()[1:]))
 	}
 
 	// Enable profiling if requested
@@ -917,14 +3019,32 @@ func main() {
 		log.Fatalf("Failed to create proxy server: %v", err)
 	}
 
-	// Handle graceful shutdown
+	// SIGHUP reloads the TLS certificate, e.g. after renewal
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			proxy.ReloadCertificate()
+		}
+	}()
+
+	// SIGINT and SIGTERM drain in-flight requests and tunnels before exiting
+	stopped := make(chan struct{})
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		// Handle interrupt signals for graceful shutdown
-		// This would typically use signal.Notify in a real implementation
+		<-interrupts
+		if err := proxy.Stop(); err != nil {
+			log.Printf("Shutdown error: %v", err)
+		}
+		close(stopped)
 	}()
 
 	if err := proxy.Start(); err != nil {
-		log.Fatalf("Failed to start proxy server: %v", err)
+		if err != http.ErrServerClosed {
+			log.Fatalf("Failed to start proxy server: %v", err)
+		}
+		<-stopped
 	}
 }
 
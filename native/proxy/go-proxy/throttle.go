@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// maxThrottleBurst caps how many bytes a bucket lets through at once, so even fast
+// limits are applied in small steps instead of long bursts and pauses
+const maxThrottleBurst = 32 * 1024
+
+// TokenBucket limits a byte stream to rate bytes per second
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewTokenBucket creates a full bucket refilling at rate bytes per second
+func NewTokenBucket(rate int64) *TokenBucket {
+	burst := float64(rate)
+	if burst > maxThrottleBurst {
+		burst = maxThrottleBurst
+	}
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long the caller must wait before using
+// them. The bucket may go into debt, which later callers pay off by waiting.
+func (tb *TokenBucket) reserve(n int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// throttledReader delays reads so every bucket's rate is respected
+type throttledReader struct {
+	reader  io.Reader
+	buckets []*TokenBucket
+	chunk   int
+}
+
+// Read reads at most one burst and waits until the slowest bucket has room for it
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > tr.chunk {
+		p = p[:tr.chunk]
+	}
+
+	n, err := tr.reader.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, bucket := range tr.buckets {
+			if d := bucket.reserve(n); d > wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// connectionBucket returns a new per-connection bucket, or nil when unlimited
+func (ps *ProxyServer) connectionBucket() *TokenBucket {
+	if ps.config.BandwidthLimit <= 0 {
+		return nil
+	}
+	return NewTokenBucket(ps.config.BandwidthLimit)
+}
+
+// throttle wraps r so reads respect the connection bucket, which may be nil and
+// can be shared by both directions, and the server-wide bucket
+func (ps *ProxyServer) throttle(r io.Reader, connBucket *TokenBucket) io.Reader {
+	var buckets []*TokenBucket
+	if connBucket != nil {
+		buckets = append(buckets, connBucket)
+	}
+	if ps.globalBucket != nil {
+		buckets = append(buckets, ps.globalBucket)
+	}
+	if len(buckets) == 0 {
+		return r
+	}
+
+	chunk := maxThrottleBurst
+	for _, bucket := range buckets {
+		if int(bucket.burst) < chunk {
+			chunk = int(bucket.burst)
+		}
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+	return &throttledReader{reader: r, buckets: buckets, chunk: chunk}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// expectedThrottleTime is how long moving total bytes through a full bucket of the
+// given rate takes: the first burst is free, the rest is paid at the rate
+func expectedThrottleTime(total, rate int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	burst := rate
+	if burst > maxThrottleBurst {
+		burst = maxThrottleBurst
+	}
+	if total <= burst {
+		return 0
+	}
+	return time.Duration(float64(total-burst) / float64(rate) * float64(time.Second))
+}
+
+// checkThrottleTime fails the test unless elapsed is within the tolerance of want
+func checkThrottleTime(t *testing.T, elapsed, want time.Duration) {
+	t.Helper()
+	if elapsed < want*9/10 || elapsed > want+250*time.Millisecond {
+		t.Errorf("transfer took %v, want about %v", elapsed, want)
+	}
+}
+
+func TestThrottleRate(t *testing.T) {
+	tests := []struct {
+		name        string
+		connLimit   int64
+		globalLimit int64
+		payload     int64
+	}{
+		{"per connection", 200 * 1024, 0, 100 * 1024},
+		{"global", 0, 200 * 1024, 100 * 1024},
+		{"global slower than connection", 400 * 1024, 100 * 1024, 64 * 1024},
+		{"connection slower than global", 100 * 1024, 400 * 1024, 64 * 1024},
+		{"limit below the burst cap", 10 * 1024, 0, 15 * 1024},
+		{"payload within the burst", 200 * 1024, 0, 16 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := &ProxyServer{config: &Config{BandwidthLimit: tt.connLimit, GlobalBandwidthLimit: tt.globalLimit}}
+			if tt.globalLimit > 0 {
+				ps.globalBucket = NewTokenBucket(tt.globalLimit)
+			}
+			want := expectedThrottleTime(tt.payload, tt.connLimit)
+			if d := expectedThrottleTime(tt.payload, tt.globalLimit); d > want {
+				want = d
+			}
+
+			payload := bytes.Repeat([]byte("x"), int(tt.payload))
+			start := time.Now()
+			n, err := io.Copy(io.Discard, ps.throttle(bytes.NewReader(payload), ps.connectionBucket()))
+			elapsed := time.Since(start)
+			if err != nil || n != tt.payload {
+				t.Fatalf("copied %d bytes, err %v, want %d", n, err, tt.payload)
+			}
+			checkThrottleTime(t, elapsed, want)
+		})
+	}
+}
+
+func TestThrottleUnlimited(t *testing.T) {
+	ps := &ProxyServer{config: &Config{}}
+	if ps.connectionBucket() != nil {
+		t.Error("connectionBucket returned a bucket with no limit set")
+	}
+	r := strings.NewReader("data")
+	if got := ps.throttle(r, nil); got != io.Reader(r) {
+		t.Error("throttle wrapped a reader with no limits set")
+	}
+}
+
+func TestGlobalBandwidthShared(t *testing.T) {
+	const limit, payload, readers = 200 * 1024, 64 * 1024, 3
+	ps := &ProxyServer{config: &Config{}, globalBucket: NewTokenBucket(limit)}
+
+	// Concurrent connections split the global rate between them
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, ps.throttle(bytes.NewReader(make([]byte, payload)), nil))
+		}()
+	}
+	wg.Wait()
+	checkThrottleTime(t, time.Since(start), expectedThrottleTime(readers*payload, limit))
+}
+
+func TestProxyRequestBandwidthLimit(t *testing.T) {
+	const limit, payload = 64 * 1024, 96 * 1024
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, payload))
+	}))
+	defer upstream.Close()
+
+	config := newTestConfig()
+	config.BandwidthLimit = limit
+	_, addr := startTestProxy(t, config)
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	start := time.Now()
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil || n != payload {
+		t.Fatalf("read %d bytes, err %v, want %d", n, err, payload)
+	}
+	checkThrottleTime(t, time.Since(start), expectedThrottleTime(payload, limit))
+}
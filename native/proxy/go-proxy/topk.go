@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// topBlockedCapacity is how many distinct domains the top-blocked report tracks
+const topBlockedCapacity = 1000
+
+// TopKCounter finds the most frequent keys in bounded memory with the Space-Saving
+// algorithm: once full, a new key replaces the least counted one and inherits its
+// count. Any key counted more than total/capacity times is guaranteed to be
+// tracked, and its count is overestimated by at most the reported error.
+type TopKCounter struct {
+	capacity int
+	entries  topKHeap
+	index    map[string]*topKEntry
+	mu       sync.Mutex
+}
+
+// KeyCount is a counted key as reported by TopKCounter.Top
+type KeyCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+	Error int64  `json:"error"` // upper bound on the overestimate of Count
+}
+
+// topKEntry is a tracked key and its position in the heap
+type topKEntry struct {
+	key   string
+	count int64
+	err   int64
+	pos   int
+}
+
+// topKHeap is a min-heap of entries by count
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	entry := x.(*topKEntry)
+	entry.pos = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NewTopKCounter creates a counter tracking at most capacity keys
+func NewTopKCounter(capacity int) *TopKCounter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TopKCounter{
+		capacity: capacity,
+		index:    make(map[string]*topKEntry),
+	}
+}
+
+// Add counts one occurrence of key
+func (c *TopKCounter) Add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.index[key]; ok {
+		entry.count++
+		heap.Fix(&c.entries, entry.pos)
+		return
+	}
+
+	if len(c.entries) < c.capacity {
+		entry := &topKEntry{key: key, count: 1}
+		heap.Push(&c.entries, entry)
+		c.index[key] = entry
+		return
+	}
+
+	// Evict the least counted key; the newcomer may have been it all along
+	entry := c.entries[0]
+	delete(c.index, entry.key)
+	entry.key = key
+	entry.err = entry.count
+	entry.count++
+	c.index[key] = entry
+	heap.Fix(&c.entries, 0)
+}
+
+// Top returns up to n keys with the highest counts, most frequent first
+func (c *TopKCounter) Top(n int) []KeyCount {
+	c.mu.Lock()
+	result := make([]KeyCount, 0, len(c.entries))
+	for _, entry := range c.entries {
+		result = append(result, KeyCount{Key: entry.key, Count: entry.count, Error: entry.err})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// Reset forgets all counts
+func (c *TopKCounter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = nil
+	c.index = make(map[string]*topKEntry)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// skewedKeys returns the heavy keys repeated by their counts followed by tail
+// distinct keys seen once each, shuffled deterministically
+func skewedKeys(heavy map[string]int, tail int) []string {
+	var keys []string
+	for key, count := range heavy {
+		for i := 0; i < count; i++ {
+			keys = append(keys, key)
+		}
+	}
+	for i := 0; i < tail; i++ {
+		keys = append(keys, fmt.Sprintf("tail-%d.example", i))
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	return keys
+}
+
+func TestTopKCounterSkewed(t *testing.T) {
+	heavy := map[string]int{
+		"ads.example":       500,
+		"tracker.example":   300,
+		"metrics.example":   200,
+		"beacon.example":    100,
+		"telemetry.example": 50,
+	}
+	all := []string{"ads.example", "tracker.example", "metrics.example", "beacon.example", "telemetry.example"}
+
+	// Keys counted more than total/capacity times are guaranteed to be reported, in
+	// order once their counts differ by more than that bound
+	tests := []struct {
+		name     string
+		capacity int
+		tail     int
+		wantTop  []string
+	}{
+		{"fits in capacity", 100, 50, all},
+		{"tail overflows capacity", 100, 5000, all[:4]},
+		{"small capacity", 40, 2000, all[:4]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewTopKCounter(tt.capacity)
+			for _, key := range skewedKeys(heavy, tt.tail) {
+				c.Add(key)
+			}
+
+			top := c.Top(len(tt.wantTop))
+			var gotOrder []string
+			for _, entry := range top {
+				gotOrder = append(gotOrder, entry.Key)
+				// Space-Saving never underestimates, and the true count lies
+				// within the reported error
+				want := int64(heavy[entry.Key])
+				if entry.Count < want || entry.Count-entry.Error > want {
+					t.Errorf("%s: count %d (error %d), true count %d", entry.Key, entry.Count, entry.Error, want)
+				}
+			}
+			if !reflect.DeepEqual(gotOrder, tt.wantTop) {
+				t.Errorf("top keys = %v, want %v", gotOrder, tt.wantTop)
+			}
+
+			if got := len(c.Top(0)); got > tt.capacity {
+				t.Errorf("tracking %d keys, capacity is %d", got, tt.capacity)
+			}
+		})
+	}
+}
+
+func TestTopKCounterExactUnderCapacity(t *testing.T) {
+	c := NewTopKCounter(10)
+	for _, key := range []string{"b", "a", "c", "a", "b", "a"} {
+		c.Add(key)
+	}
+
+	want := []KeyCount{{Key: "a", Count: 3}, {Key: "b", Count: 2}, {Key: "c", Count: 1}}
+	if got := c.Top(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top(10) = %+v, want %+v", got, want)
+	}
+	if got := c.Top(2); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("Top(2) = %+v, want %+v", got, want[:2])
+	}
+
+	c.Reset()
+	if got := c.Top(10); len(got) != 0 {
+		t.Errorf("Top after Reset = %+v, want none", got)
+	}
+}
+
+func TestTopKCounterConcurrent(t *testing.T) {
+	c := NewTopKCounter(4)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Add("hot.example")
+				c.Add(fmt.Sprintf("cold-%d-%d.example", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	top := c.Top(1)
+	if len(top) != 1 || top[0].Key != "hot.example" || top[0].Count < 8000 {
+		t.Errorf("Top(1) = %+v, want hot.example counted at least 8000 times", top)
+	}
+}
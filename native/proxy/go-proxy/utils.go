@@ -5,9 +5,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -20,6 +23,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +43,25 @@ type FilterRule struct {
 	Description string            `json:"description"`
 	CreatedAt   time.Time         `json:"created_at"`
 	UpdatedAt   time.Time         `json:"updated_at"`
+	Hits        int64             `json:"hits"`         // updated atomically
+	LastMatched int64             `json:"last_matched"` // unix nanoseconds, updated atomically
+}
+
+// recordHit counts a match of the rule
+func (rule *FilterRule) recordHit() {
+	atomic.AddInt64(&rule.Hits, 1)
+	atomic.StoreInt64(&rule.LastMatched, time.Now().UnixNano())
+}
+
+// MarshalJSON encodes the rule with its hit counters read atomically, so a rule
+// can be marshaled while requests are matching it
+func (rule *FilterRule) MarshalJSON() ([]byte, error) {
+	type plain FilterRule
+	return json.Marshal(struct {
+		*plain
+		Hits        int64 `json:"hits"`
+		LastMatched int64 `json:"last_matched"`
+	}{(*plain)(rule), atomic.LoadInt64(&rule.Hits), atomic.LoadInt64(&rule.LastMatched)})
 }
 
 // RuleEngine provides advanced rule matching and processing
@@ -47,9 +70,10 @@ type RuleEngine struct {
 	domainRules map[string][]*FilterRule
 	pathRules   map[string][]*FilterRule
 	regexRules  []*FilterRule
-	cache       map[string]bool
+	cache       map[string]*FilterRule // matched rule, nil when nothing matched
 	cacheTTL    time.Duration
 	cacheExpiry map[string]time.Time
+	cacheMu     sync.Mutex // guards cache and cacheExpiry, written while mu is only read-locked
 	mu          sync.RWMutex
 }
 
@@ -60,7 +84,7 @@ func NewRuleEngine() *RuleEngine {
 		domainRules: make(map[string][]*FilterRule),
 		pathRules:   make(map[string][]*FilterRule),
 		regexRules:  make([]*FilterRule, 0),
-		cache:       make(map[string]bool),
+		cache:       make(map[string]*FilterRule),
 		cacheTTL:    5 * time.Minute,
 		cacheExpiry: make(map[string]time.Time),
 	}
@@ -94,8 +118,10 @@ func (re *RuleEngine) AddRule(rule *FilterRule) error {
 	re.rules = append(re.rules, rule)
 
 	// Clear cache
-	re.cache = make(map[string]bool)
+	re.cacheMu.Lock()
+	re.cache = make(map[string]*FilterRule)
 	re.cacheExpiry = make(map[string]time.Time)
+	re.cacheMu.Unlock()
 
 	return nil
 }
@@ -121,7 +147,8 @@ func (re *RuleEngine) LoadRulesFromFile(filename string) error {
 	return nil
 }
 
-// MatchRequest checks if a request matches any rules
+// MatchRequest checks if a request matches any rules, counting a hit on the
+// matched rule whether it was found by matching or served from the cache.
 func (re *RuleEngine) MatchRequest(req *http.Request) (*FilterRule, bool) {
 	re.mu.RLock()
 	defer re.mu.RUnlock()
@@ -130,17 +157,19 @@ func (re *RuleEngine) MatchRequest(req *http.Request) (*FilterRule, bool) {
 	cacheKey := fmt.Sprintf("%s://%s%s", req.URL.Scheme, req.URL.Host, req.URL.Path)
 
 	// Check cache
-	if result, exists := re.cache[cacheKey]; exists {
-		if expiry, ok := re.cacheExpiry[cacheKey]; ok && time.Now().Before(expiry) {
-			return nil, result
+	if rule, ok := re.cachedMatch(cacheKey); ok {
+		if rule != nil {
+			rule.recordHit()
 		}
+		return rule, rule != nil
 	}
 
 	// Check domain rules first
 	if rules, exists := re.domainRules[req.URL.Host]; exists {
 		for _, rule := range rules {
 			if re.matchRule(rule, req) {
-				re.updateCache(cacheKey, true)
+				rule.recordHit()
+				re.updateCache(cacheKey, rule)
 				return rule, true
 			}
 		}
@@ -150,7 +179,8 @@ func (re *RuleEngine) MatchRequest(req *http.Request) (*FilterRule, bool) {
 	if rules, exists := re.pathRules[req.URL.Path]; exists {
 		for _, rule := range rules {
 			if re.matchRule(rule, req) {
-				re.updateCache(cacheKey, true)
+				rule.recordHit()
+				re.updateCache(cacheKey, rule)
 				return rule, true
 			}
 		}
@@ -159,7 +189,8 @@ func (re *RuleEngine) MatchRequest(req *http.Request) (*FilterRule, bool) {
 	// Check regex rules
 	for _, rule := range re.regexRules {
 		if re.matchRule(rule, req) {
-			re.updateCache(cacheKey, true)
+			rule.recordHit()
+			re.updateCache(cacheKey, rule)
 			return rule, true
 		}
 	}
@@ -170,12 +201,13 @@ func (re *RuleEngine) MatchRequest(req *http.Request) (*FilterRule, bool) {
 			continue // Already checked above
 		}
 		if re.matchRule(rule, req) {
-			re.updateCache(cacheKey, true)
+			rule.recordHit()
+			re.updateCache(cacheKey, rule)
 			return rule, true
 		}
 	}
 
-	re.updateCache(cacheKey, false)
+	re.updateCache(cacheKey, nil)
 	return nil, false
 }
 
@@ -222,12 +254,79 @@ func (re *RuleEngine) matchRule(rule *FilterRule, req *http.Request) bool {
 	return false
 }
 
+// cachedMatch returns the unexpired cached result for key
+func (re *RuleEngine) cachedMatch(key string) (*FilterRule, bool) {
+	re.cacheMu.Lock()
+	defer re.cacheMu.Unlock()
+
+	rule, exists := re.cache[key]
+	if !exists || !time.Now().Before(re.cacheExpiry[key]) {
+		return nil, false
+	}
+	return rule, true
+}
+
 // updateCache updates the rule matching cache
-func (re *RuleEngine) updateCache(key string, result bool) {
-	re.cache[key] = result
+func (re *RuleEngine) updateCache(key string, rule *FilterRule) {
+	re.cacheMu.Lock()
+	defer re.cacheMu.Unlock()
+
+	re.cache[key] = rule
 	re.cacheExpiry[key] = time.Now().Add(re.cacheTTL)
 }
 
+// FingerprintingProtection selects the browser fingerprinting surfaces neutralized
+// by script injected into HTML responses
+type FingerprintingProtection struct {
+	Canvas bool `json:"canvas"` // add noise to canvas readback
+	WebGL  bool `json:"webgl"`  // report a generic GPU vendor and renderer
+	Audio  bool `json:"audio"`  // add noise to audio sample and frequency data
+	Fonts  bool `json:"fonts"`  // hide installed fonts from document.fonts.check
+	WebRTC bool `json:"webrtc"` // force TURN relays so ICE candidates do not leak local IPs
+}
+
+// Enabled reports whether any protection is selected
+func (fp FingerprintingProtection) Enabled() bool {
+	return fp.Canvas || fp.WebGL || fp.Audio || fp.Fonts || fp.WebRTC
+}
+
+// Fingerprinting shims, each self-contained so any combination can be injected
+const (
+	canvasShimJS = `(function(){` +
+		`var noise=function(c){try{var x=c.getContext('2d');if(!x)return;var d=x.getImageData(0,0,Math.min(c.width,16),Math.min(c.height,16));` +
+		`for(var i=0;i<d.data.length;i+=4){d.data[i]^=Math.random()<0.5?1:0;}x.putImageData(d,0,0);}catch(e){}};` +
+		`var toDataURL=HTMLCanvasElement.prototype.toDataURL;HTMLCanvasElement.prototype.toDataURL=function(){noise(this);return toDataURL.apply(this,arguments);};` +
+		`var toBlob=HTMLCanvasElement.prototype.toBlob;HTMLCanvasElement.prototype.toBlob=function(){noise(this);return toBlob.apply(this,arguments);};` +
+		`var getImageData=CanvasRenderingContext2D.prototype.getImageData;CanvasRenderingContext2D.prototype.getImageData=function(){` +
+		`var d=getImageData.apply(this,arguments);for(var i=0;i<d.data.length;i+=4){d.data[i]^=Math.random()<0.5?1:0;}return d;};` +
+		`})();`
+
+	webglShimJS = `(function(){` +
+		`var patch=function(proto){if(!proto)return;var getParameter=proto.getParameter;proto.getParameter=function(p){` +
+		`if(p===37445)return 'Google Inc.';if(p===37446)return 'ANGLE (Generic GPU)';return getParameter.apply(this,arguments);};};` +
+		`patch(window.WebGLRenderingContext&&WebGLRenderingContext.prototype);` +
+		`patch(window.WebGL2RenderingContext&&WebGL2RenderingContext.prototype);` +
+		`})();`
+
+	audioShimJS = `(function(){` +
+		`if(window.AudioBuffer){var getChannelData=AudioBuffer.prototype.getChannelData;AudioBuffer.prototype.getChannelData=function(){` +
+		`var d=getChannelData.apply(this,arguments);for(var i=0;i<d.length;i+=100){d[i]+=(Math.random()-0.5)*1e-7;}return d;};}` +
+		`if(window.AnalyserNode){var getFloat=AnalyserNode.prototype.getFloatFrequencyData;AnalyserNode.prototype.getFloatFrequencyData=function(a){` +
+		`getFloat.apply(this,arguments);for(var i=0;i<a.length;i++){a[i]+=(Math.random()-0.5)*0.1;}};}` +
+		`})();`
+
+	fontsShimJS = `(function(){` +
+		`if(window.FontFaceSet&&FontFaceSet.prototype.check){var check=FontFaceSet.prototype.check;FontFaceSet.prototype.check=function(font){` +
+		`return /(serif|sans-serif|monospace|cursive|fantasy|system-ui)\s*$/i.test(font)?check.apply(this,arguments):false;};}` +
+		`})();`
+
+	webrtcShimJS = `(function(){` +
+		`['RTCPeerConnection','webkitRTCPeerConnection'].forEach(function(name){var Original=window[name];if(!Original)return;` +
+		`var Patched=function(config){config=config||{};config.iceTransportPolicy='relay';return new Original(config);};` +
+		`Patched.prototype=Original.prototype;window[name]=Patched;});` +
+		`})();`
+)
+
 // ContentProcessor handles content modification and injection
 type ContentProcessor struct {
 	config          *Config
@@ -302,14 +401,13 @@ func (cp *ContentProcessor) ProcessHTML(content []byte, url string) []byte {
 	cosmeticCSS := cp.generateCosmeticCSS()
 	if cosmeticCSS != "" {
 		styleTag := fmt.Sprintf(`<style type="text/css">%s</style>`, cosmeticCSS)
-		
-		// Try to insert before closing head tag
-		if strings.Contains(html, "</head>") {
-			html = strings.Replace(html, "</head>", styleTag+"</head>", 1)
-		} else {
-			// Insert at the beginning of body
-			html = strings.Replace(html, "<body", styleTag+"<body", 1)
-		}
+		html = injectIntoHead(html, styleTag, true)
+	}
+
+	// Shims must run before any page script gets a chance to fingerprint
+	if fingerprintingJS := cp.generateFingerprintingJS(); fingerprintingJS != "" {
+		scriptTag := fmt.Sprintf(`<script type="text/javascript">%s</script>`, fingerprintingJS)
+		html = injectIntoHead(html, scriptTag, false)
 	}
 
 	// Inject anti-tracking scripts
@@ -328,6 +426,66 @@ func (cp *ContentProcessor) ProcessHTML(content []byte, url string) []byte {
 	return []byte(html)
 }
 
+// InjectFingerprintingProtection adds only the fingerprinting shims to an HTML
+// document, for responses that are not otherwise filtered
+func (cp *ContentProcessor) InjectFingerprintingProtection(content []byte) []byte {
+	fingerprintingJS := cp.generateFingerprintingJS()
+	if fingerprintingJS == "" {
+		return content
+	}
+
+	scriptTag := fmt.Sprintf(`<script type="text/javascript">%s</script>`, fingerprintingJS)
+	return []byte(injectIntoHead(string(content), scriptTag, false))
+}
+
+// Tags used to place injected markup
+var (
+	headOpenTag  = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+	headCloseTag = regexp.MustCompile(`(?i)</head\s*>`)
+	bodyOpenTag  = regexp.MustCompile(`(?i)<body[\s>]`)
+)
+
+// injectIntoHead inserts tag at the start of the document head, or at its end when
+// atEnd is set, falling back to the start of the body and then of the document
+func injectIntoHead(html, tag string, atEnd bool) string {
+	if atEnd {
+		if loc := headCloseTag.FindStringIndex(html); loc != nil {
+			return html[:loc[0]] + tag + html[loc[0]:]
+		}
+	} else if loc := headOpenTag.FindStringIndex(html); loc != nil {
+		return html[:loc[1]] + tag + html[loc[1]:]
+	}
+
+	if loc := bodyOpenTag.FindStringIndex(html); loc != nil {
+		return html[:loc[0]] + tag + html[loc[0]:]
+	}
+	return tag + html
+}
+
+// generateFingerprintingJS joins the shims for the enabled protections
+func (cp *ContentProcessor) generateFingerprintingJS() string {
+	fp := cp.config.FingerprintingProtection
+
+	var shims []string
+	if fp.Canvas {
+		shims = append(shims, canvasShimJS)
+	}
+	if fp.WebGL {
+		shims = append(shims, webglShimJS)
+	}
+	if fp.Audio {
+		shims = append(shims, audioShimJS)
+	}
+	if fp.Fonts {
+		shims = append(shims, fontsShimJS)
+	}
+	if fp.WebRTC {
+		shims = append(shims, webrtcShimJS)
+	}
+
+	return strings.Join(shims, "\n")
+}
+
 // generateCosmeticCSS generates CSS rules for hiding elements
 func (cp *ContentProcessor) generateCosmeticCSS() string {
 	cp.mu.RLock()
@@ -364,6 +522,9 @@ type NetworkMonitor struct {
 	latency         *LatencyMonitor
 	errorRates      map[string]float64
 	healthThreshold float64
+	idleTimeout     time.Duration // connections idle for longer are evicted by the sweeper
+	stop            chan struct{}
+	stopOnce        sync.Once
 	mu              sync.RWMutex
 }
 
@@ -396,15 +557,24 @@ type LatencyMonitor struct {
 	mu         sync.RWMutex
 }
 
-// NewNetworkMonitor creates a new network monitor
-func NewNetworkMonitor() *NetworkMonitor {
-	return &NetworkMonitor{
+// NewNetworkMonitor creates a new network monitor. Connections without activity for
+// idleTimeout are evicted in the background; 0 disables the sweeper.
+func NewNetworkMonitor(idleTimeout time.Duration) *NetworkMonitor {
+	nm := &NetworkMonitor{
 		connections:     make(map[string]*ConnectionInfo),
 		bandwidth:       NewBandwidthMonitor(60), // 60-second window
 		latency:         NewLatencyMonitor(100),  // 100 samples
 		errorRates:      make(map[string]float64),
 		healthThreshold: 0.95, // 95% success rate
+		idleTimeout:     idleTimeout,
+		stop:            make(chan struct{}),
 	}
+
+	if idleTimeout > 0 {
+		go nm.sweep()
+	}
+
+	return nm
 }
 
 // NewBandwidthMonitor creates a new bandwidth monitor
@@ -437,6 +607,98 @@ func (nm *NetworkMonitor) TrackConnection(id, remoteAddr string) {
 	}
 }
 
+// RecordRequest counts a request on a connection, tracking the connection first if
+// this is its first request
+func (nm *NetworkMonitor) RecordRequest(id, remoteAddr string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	now := time.Now()
+	conn, exists := nm.connections[id]
+	if !exists {
+		conn = &ConnectionInfo{
+			ID:         id,
+			RemoteAddr: remoteAddr,
+			StartTime:  now,
+			Status:     "active",
+		}
+		nm.connections[id] = conn
+	}
+	conn.LastActivity = now
+	conn.RequestCount++
+}
+
+// RecordTransfer adds bytes moved on a tracked connection, such as a CONNECT
+// tunnel, and marks it as active
+func (nm *NetworkMonitor) RecordTransfer(id string, bytesSent, bytesReceived int64) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if conn, exists := nm.connections[id]; exists {
+		conn.LastActivity = time.Now()
+		conn.BytesSent += bytesSent
+		conn.BytesReceived += bytesReceived
+		nm.bandwidth.RecordBytes(bytesSent + bytesReceived)
+	}
+}
+
+// UntrackConnection stops monitoring a connection; call it when the connection closes
+func (nm *NetworkMonitor) UntrackConnection(id string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	delete(nm.connections, id)
+}
+
+// RemoveIdleConnections evicts connections whose last activity is older than the
+// idle timeout and returns how many were removed
+func (nm *NetworkMonitor) RemoveIdleConnections(now time.Time) int {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	removed := 0
+	cutoff := now.Add(-nm.idleTimeout)
+	for id, conn := range nm.connections {
+		if conn.LastActivity.Before(cutoff) {
+			delete(nm.connections, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// sweep periodically evicts idle connections until Stop is called
+func (nm *NetworkMonitor) sweep() {
+	interval := nm.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-nm.stop:
+			return
+		case now := <-ticker.C:
+			nm.RemoveIdleConnections(now)
+		}
+	}
+}
+
+// Stop ends the background sweeper
+func (nm *NetworkMonitor) Stop() {
+	nm.stopOnce.Do(func() { close(nm.stop) })
+}
+
+// ConnectionCount returns the number of tracked connections
+func (nm *NetworkMonitor) ConnectionCount() int {
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+
+	return len(nm.connections)
+}
+
 // UpdateConnection updates connection statistics
 func (nm *NetworkMonitor) UpdateConnection(id string, bytesSent, bytesReceived int64, hasError bool) {
 	nm.mu.Lock()
@@ -649,7 +911,10 @@ func (sm *SecurityManager) ValidateRequest(req *http.Request) error {
 
 	// Check request body for malware signatures (if applicable)
 	if req.Method == "POST" && req.Body != nil {
-		bodyBytes, err := io.ReadAll(req.Body)
+		bodyBytes, err := readRequestBody(req.Body, sm.config.MaxRequestBodySize)
+		if err == errBodyTooLarge {
+			return fmt.Errorf("request body exceeds %d bytes", sm.config.MaxRequestBodySize)
+		}
 		if err == nil {
 			req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 			bodyStr := string(bodyBytes)
@@ -666,6 +931,26 @@ func (sm *SecurityManager) ValidateRequest(req *http.Request) error {
 	return nil
 }
 
+// errBodyTooLarge is returned by readRequestBody when the body exceeds the limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// readRequestBody reads the whole body, or fails with errBodyTooLarge once more than
+// limit bytes have been read. A limit of 0 means unlimited.
+func readRequestBody(body io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(body)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
 // AddSecurityHeaders adds security headers to response
 func (sm *SecurityManager) AddSecurityHeaders(w http.ResponseWriter) {
 	sm.mu.RLock()
@@ -815,15 +1100,25 @@ func (cm *CacheManager) cleanup() {
 	}
 }
 
-// GenerateRandomString generates a random string for tokens
+// GenerateRandomString generates a random string for tokens. Random bytes at or
+// above the largest multiple of the charset size are rejected to avoid modulo bias.
 func GenerateRandomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	bytes := make([]byte, length)
-	rand.Read(bytes)
-	for i, b := range bytes {
-		bytes[i] = charset[b%byte(len(charset))]
+	const limit = 256 - 256%len(charset)
+
+	result := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(result) < length {
+		if _, err := rand.Read(buf); err != nil {
+			panic(fmt.Sprintf("crypto/rand failed: %v", err))
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(result) < length {
+				result = append(result, charset[int(b)%len(charset)])
+			}
+		}
 	}
-	return string(bytes)
+	return string(result)
 }
 
 // EncodeBasicAuth properly encodes basic authentication
@@ -871,26 +1166,11 @@ func IsValidDomain(domain string) bool {
 	return true
 }
 
-// IsPrivateIP checks if an IP address is private
+// IsPrivateIP checks if an IP address is private: loopback, link-local,
+// unspecified, RFC 1918 or an IPv6 unique local address
 func IsPrivateIP(ip net.IP) bool {
-	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-		return true
-	}
-
-	privateRanges := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-	}
-
-	for _, cidr := range privateRanges {
-		_, network, _ := net.ParseCIDR(cidr)
-		if network.Contains(ip) {
-			return true
-		}
-	}
-
-	return false
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsPrivate()
 }
 
 // FormatBytes formats byte count in human readable format
@@ -925,23 +1205,173 @@ func FormatDuration(d time.Duration) string {
 	return fmt.Sprintf("%.1fh", d.Hours())
 }
 
-// CreateTLSConfig creates a TLS configuration
-func CreateTLSConfig(certFile, keyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// defaultCipherSuites are the TLS 1.2 suites offered when none are configured
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// TLSOptions are the operator-tunable parts of the server TLS configuration
+type TLSOptions struct {
+	MinVersion               string   // "1.2" (default) or "1.3"
+	CipherSuites             []string // TLS 1.2 suite names as in crypto/tls, in order of preference
+	PreferServerCipherSuites bool     // pick the first suite of CipherSuites the client offers
+}
+
+// ParseTLSVersion converts "1.2" or "1.3" to a crypto/tls version, defaulting to 1.2
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q (expected 1.2 or 1.3)", version)
+}
+
+// ParseCipherSuites converts suite names to IDs, keeping their order. Insecure
+// suites are refused, as are TLS 1.3 suites, which are always enabled and cannot
+// be configured. An empty list yields the defaults.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return append([]uint16(nil), defaultCipherSuites...), nil
+	}
+
+	// The ChaCha20 suites are also widely known without their _SHA256 suffix
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+		if strings.Contains(suite.Name, "CHACHA20") {
+			known[strings.TrimSuffix(suite.Name, "_SHA256")] = suite
+		}
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suite, ok := known[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+			return nil, fmt.Errorf("cipher suite %s is a TLS 1.3 suite, which is always enabled", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// CreateTLSConfig creates a TLS configuration serving the certificates in store
+func CreateTLSConfig(store *CertStore, options TLSOptions) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(options.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := ParseCipherSuites(options.CipherSuites)
 	if err != nil {
 		return nil, err
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h2", "http/1.1"},
-		MinVersion:   tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-		},
-	}, nil
+	config := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}
+	if options.PreferServerCipherSuites {
+		preferServerCipherSuites(config, store)
+	}
+	return config, nil
+}
+
+// preferServerCipherSuites makes TLS 1.2 handshakes use the first configured suite
+// the client offers. crypto/tls picks the suite itself and ignores the deprecated
+// PreferServerCipherSuites, so each handshake is offered only that one suite.
+func preferServerCipherSuites(config *tls.Config, store *CertStore) {
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// Only suites matching the certificate's key type can complete a handshake,
+		// and a reload may have changed it
+		_, isRSA := store.Certificate().PrivateKey.(*rsa.PrivateKey)
+		for _, id := range config.CipherSuites {
+			if strings.Contains(tls.CipherSuiteName(id), "_ECDSA_") == isRSA {
+				continue
+			}
+			for _, offered := range hello.CipherSuites {
+				if id == offered {
+					narrowed := config.Clone()
+					narrowed.GetConfigForClient = nil
+					narrowed.CipherSuites = []uint16{id}
+					return narrowed, nil
+				}
+			}
+		}
+		return nil, nil
+	}
+}
+
+// RequireClientCerts makes a server TLS configuration demand a client certificate
+// issued by a CA in caFile. When allowedUsers is not empty the certificate's common
+// name, or one of its DNS, email or URI SANs, must also be listed there.
+func RequireClientCerts(config *tls.Config, caFile string, allowedUsers []string) error {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if len(allowedUsers) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool, len(allowedUsers))
+	for _, user := range allowedUsers {
+		allowed[user] = true
+	}
+
+	// Runs after the chain has been verified against the client CAs
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no client certificate")
+		}
+		user := ClientCertUser(cs.PeerCertificates[0], allowed)
+		if user == "" {
+			return fmt.Errorf("client certificate %q is not an allowed user", cs.PeerCertificates[0].Subject.CommonName)
+		}
+		return nil
+	}
+	return nil
+}
+
+// ClientCertUser returns the first identity of cert found in allowed, checking the
+// common name before the SANs, or "" if none is
+func ClientCertUser(cert *x509.Certificate, allowed map[string]bool) string {
+	identities := []string{cert.Subject.CommonName}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	for _, identity := range identities {
+		if identity != "" && allowed[identity] {
+			return identity
+		}
+	}
+	return ""
 }
 
 // LogRequest logs HTTP request details
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateRandomString(t *testing.T) {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	tests := []struct {
+		name    string
+		length  int
+		samples int
+	}{
+		{"short tokens", 8, 80000},
+		{"long tokens", 256, 2500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := make(map[rune]int)
+			for i := 0; i < tt.samples; i++ {
+				s := GenerateRandomString(tt.length)
+				if len(s) != tt.length {
+					t.Fatalf("len(GenerateRandomString(%d)) = %d", tt.length, len(s))
+				}
+				for _, c := range s {
+					counts[c]++
+				}
+			}
+
+			// Chi-squared with 61 degrees of freedom; 120 is far beyond the
+			// p = 0.0001 critical value
+			expected := float64(tt.samples*tt.length) / float64(len(charset))
+			var chi2 float64
+			for _, c := range charset {
+				diff := float64(counts[c]) - expected
+				chi2 += diff * diff / expected
+			}
+			if len(counts) != len(charset) {
+				t.Errorf("saw %d distinct characters, want %d", len(counts), len(charset))
+			}
+			if chi2 > 120 {
+				t.Errorf("chi-squared = %.1f, distribution is not uniform", chi2)
+			}
+		})
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::", true},
+		{"93.184.216.34", false},
+		{"2606:4700::1111", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsPrivateIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsPrivateIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestReadRequestBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		wantErr error
+	}{
+		{"under the limit", 1023, 1024, nil},
+		{"at the limit", 1024, 1024, nil},
+		{"over the limit", 1025, 1024, errBodyTooLarge},
+		{"unlimited", 1 << 20, 0, nil},
+		{"empty", 0, 1024, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := readRequestBody(strings.NewReader(strings.Repeat("x", tt.size)), tt.limit)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(data) != tt.size {
+				t.Errorf("read %d bytes, want %d", len(data), tt.size)
+			}
+		})
+	}
+}
+
+func TestValidateRequestBodyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"just under the limit", 1023, false},
+		{"at the limit", 1024, false},
+		{"just over the limit", 1025, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.MaxRequestBodySize = 1024
+			sm := NewSecurityManager(config)
+
+			body := strings.Repeat("x", tt.size)
+			req := httptest.NewRequest("POST", "http://example.com/upload", strings.NewReader(body))
+			err := sm.ValidateRequest(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateRequest = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// The scanned body is put back for forwarding
+			forwarded, _ := io.ReadAll(req.Body)
+			if string(forwarded) != body {
+				t.Errorf("body after validation is %d bytes, want %d", len(forwarded), len(body))
+			}
+		})
+	}
+}
+
+func TestNetworkMonitorRemoveIdleConnections(t *testing.T) {
+	const idleTimeout = time.Minute
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		idle     []time.Duration // how long ago each connection was last active
+		wantLeft int
+	}{
+		{"all active", []time.Duration{0, time.Second, 30 * time.Second}, 3},
+		{"all idle", []time.Duration{2 * time.Minute, time.Hour}, 0},
+		{"mixed", []time.Duration{0, 2 * time.Minute, 10 * time.Second, time.Hour}, 2},
+		{"empty", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No background sweeper; the test sweeps by hand
+			nm := NewNetworkMonitor(0)
+			nm.idleTimeout = idleTimeout
+			for i, idle := range tt.idle {
+				id := fmt.Sprintf("conn-%d", i)
+				nm.RecordRequest(id, "127.0.0.1:40000")
+				nm.connections[id].LastActivity = now.Add(-idle)
+			}
+
+			removed := nm.RemoveIdleConnections(now)
+			if got := nm.ConnectionCount(); got != tt.wantLeft {
+				t.Errorf("%d connections left, want %d", got, tt.wantLeft)
+			}
+			if removed != len(tt.idle)-tt.wantLeft {
+				t.Errorf("removed %d, want %d", removed, len(tt.idle)-tt.wantLeft)
+			}
+			// Health only covers the connections still tracked
+			if health := nm.GetConnectionHealth(); len(health) != tt.wantLeft {
+				t.Errorf("health covers %d connections, want %d", len(health), tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestNetworkMonitorUntrackConnection(t *testing.T) {
+	nm := NewNetworkMonitor(0)
+	for i := 0; i < 100; i++ {
+		nm.RecordRequest(fmt.Sprintf("conn-%d", i), "127.0.0.1:40000")
+	}
+	for i := 0; i < 100; i++ {
+		nm.UntrackConnection(fmt.Sprintf("conn-%d", i))
+	}
+	if got := nm.ConnectionCount(); got != 0 {
+		t.Errorf("%d connections tracked after all were closed, want 0", got)
+	}
+
+	// Traffic on a closed connection does not bring it back
+	nm.RecordTransfer("conn-0", 10, 10)
+	if got := nm.ConnectionCount(); got != 0 {
+		t.Errorf("%d connections tracked after traffic on a closed one, want 0", got)
+	}
+}
+
+func TestNetworkMonitorSweeper(t *testing.T) {
+	nm := NewNetworkMonitor(100 * time.Millisecond)
+	defer nm.Stop()
+
+	nm.RecordRequest("idle", "127.0.0.1:40000")
+	deadline := time.Now().Add(3 * time.Second)
+	for nm.ConnectionCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection was never swept")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Stop is safe to call more than once
+	nm.Stop()
+	nm.Stop()
+}
+
+func TestFingerprintingShims(t *testing.T) {
+	shims := map[string]string{
+		"canvas": canvasShimJS,
+		"webgl":  webglShimJS,
+		"audio":  audioShimJS,
+		"fonts":  fontsShimJS,
+		"webrtc": webrtcShimJS,
+	}
+
+	tests := []struct {
+		name    string
+		fp      FingerprintingProtection
+		enabled []string
+	}{
+		{"none", FingerprintingProtection{}, nil},
+		{"canvas", FingerprintingProtection{Canvas: true}, []string{"canvas"}},
+		{"webgl", FingerprintingProtection{WebGL: true}, []string{"webgl"}},
+		{"audio", FingerprintingProtection{Audio: true}, []string{"audio"}},
+		{"fonts", FingerprintingProtection{Fonts: true}, []string{"fonts"}},
+		{"webrtc", FingerprintingProtection{WebRTC: true}, []string{"webrtc"}},
+		{"canvas and webrtc", FingerprintingProtection{Canvas: true, WebRTC: true}, []string{"canvas", "webrtc"}},
+		{"all", FingerprintingProtection{Canvas: true, WebGL: true, Audio: true, Fonts: true, WebRTC: true}, []string{"canvas", "webgl", "audio", "fonts", "webrtc"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.FingerprintingProtection = tt.fp
+			cp := NewContentProcessor(config)
+
+			if got, want := tt.fp.Enabled(), len(tt.enabled) > 0; got != want {
+				t.Errorf("Enabled() = %v, want %v", got, want)
+			}
+
+			page := []byte("<html><head><title>t</title></head><body></body></html>")
+			injected := string(cp.InjectFingerprintingProtection(page))
+			if len(tt.enabled) == 0 && injected != string(page) {
+				t.Errorf("page changed with every protection off: %s", injected)
+			}
+
+			for name, shim := range shims {
+				want := false
+				for _, enabled := range tt.enabled {
+					want = want || enabled == name
+				}
+				if got := strings.Contains(injected, shim); got != want {
+					t.Errorf("%s shim injected = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectIntoHead(t *testing.T) {
+	const tag = "<script>x</script>"
+
+	tests := []struct {
+		name  string
+		html  string
+		atEnd bool
+		want  string
+	}{
+		{"start of head", "<html><head><title>t</title></head></html>", false, "<html><head>" + tag + "<title>t</title></head></html>"},
+		{"head with attributes", `<HEAD lang="en"><title>t</title></HEAD>`, false, `<HEAD lang="en">` + tag + "<title>t</title></HEAD>"},
+		{"end of head", "<head><title>t</title></head><body></body>", true, "<head><title>t</title>" + tag + "</head><body></body>"},
+		{"header element is not head", "<header></header><body>x</body>", false, "<header></header>" + tag + "<body>x</body>"},
+		{"no head", "<html><body class=\"a\">x</body></html>", false, "<html>" + tag + "<body class=\"a\">x</body></html>"},
+		{"fragment", "<p>x</p>", true, tag + "<p>x</p>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := injectIntoHead(tt.html, tag, tt.atEnd); got != tt.want {
+				t.Errorf("injectIntoHead() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleEngineHits(t *testing.T) {
+	re := NewRuleEngine()
+	rules := []*FilterRule{
+		{ID: "domain", Domain: "ads.example", Pattern: "ads", Enabled: true},
+		{ID: "path", Path: "/track", Pattern: "track", Enabled: true},
+		{ID: "regex", Pattern: `pixel\.gif$`, Enabled: true},
+		{ID: "disabled", Pattern: "article", Enabled: false},
+	}
+	for _, rule := range rules {
+		if err := re.AddRule(rule); err != nil {
+			t.Fatalf("AddRule(%s): %v", rule.ID, err)
+		}
+	}
+
+	requests := []string{
+		"http://ads.example/a",
+		"http://ads.example/b",
+		"http://example.com/track",
+		"http://example.com/1/pixel.gif",
+		"http://example.com/2/pixel.gif",
+		"http://example.com/3/pixel.gif",
+		"http://example.com/article",
+		// Served from the cache, still a hit
+		"http://ads.example/a",
+		"http://example.com/article",
+	}
+	for _, target := range requests {
+		re.MatchRequest(httptest.NewRequest("GET", target, nil))
+	}
+
+	rule, matched := re.MatchRequest(httptest.NewRequest("GET", "http://example.com/track", nil))
+	if !matched || rule != rules[1] {
+		t.Errorf("cached match = %v, %v, want the path rule", rule, matched)
+	}
+
+	want := map[string]int64{"domain": 3, "path": 2, "regex": 3, "disabled": 0}
+	for _, rule := range rules {
+		if rule.Hits != want[rule.ID] {
+			t.Errorf("%s: %d hits, want %d", rule.ID, rule.Hits, want[rule.ID])
+		}
+		if (rule.LastMatched != 0) != (want[rule.ID] > 0) {
+			t.Errorf("%s: last matched %d with %d hits", rule.ID, rule.LastMatched, rule.Hits)
+		}
+	}
+}
+
+func TestFilterRuleMarshalWhileMatching(t *testing.T) {
+	re := NewRuleEngine()
+	rule := &FilterRule{ID: "ads", Domain: "ads.example", Pattern: "ads", Enabled: true}
+	if err := re.AddRule(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			re.MatchRequest(httptest.NewRequest("GET", "http://ads.example/a", nil))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := json.Marshal(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	data, err := json.Marshal(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded FilterRule
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != "ads" || decoded.Hits != 1000 || decoded.LastMatched == 0 {
+		t.Errorf("marshaled rule = %s, want 1000 hits", data)
+	}
+}
+
+// testCert is an ECDSA key pair, self-signed when it is a CA
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate from template, signed by parent or self-signed
+// when parent is nil
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+}
+
+func newTestServerCert(t *testing.T, ca *testCert) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+}
+
+func newTestClientCert(t *testing.T, ca *testCert, template *x509.Certificate) *testCert {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	return newTestCert(t, template, ca)
+}
+
+// writeTestCert writes the certificate and key as PEM files named after name in dir
+func writeTestCert(t *testing.T, dir, name string, c *testCert) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, c.certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestClientCertUser(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/alice")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice"},
+		DNSNames:       []string{"alice.example.org"},
+		EmailAddresses: []string{"alice@example.org"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		allowed []string
+		want    string
+	}{
+		{"common name", cert, []string{"alice"}, "alice"},
+		{"common name before sans", cert, []string{"alice@example.org", "alice"}, "alice"},
+		{"dns san", cert, []string{"alice.example.org"}, "alice.example.org"},
+		{"email san", cert, []string{"alice@example.org"}, "alice@example.org"},
+		{"uri san", cert, []string{"spiffe://example.org/alice"}, "spiffe://example.org/alice"},
+		{"not allowed", cert, []string{"bob"}, ""},
+		{"empty common name never matches", &x509.Certificate{}, []string{""}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := make(map[string]bool)
+			for _, user := range tt.allowed {
+				allowed[user] = true
+			}
+			if got := ClientCertUser(tt.cert, allowed); got != tt.want {
+				t.Errorf("ClientCertUser() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireClientCertsErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("no certificates here"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, caFile := range []string{filepath.Join(dir, "missing.pem"), empty} {
+		if err := RequireClientCerts(&tls.Config{}, caFile, nil); err == nil {
+			t.Errorf("RequireClientCerts(%s) succeeded", caFile)
+		}
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{"", tls.VersionTLS12, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"TLS1.3", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseTLSVersion(tt.version)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ParseTLSVersion(%q) = %#x, %v, want %#x, error %v", tt.version, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []uint16
+		wantErr string
+	}{
+		{"defaults", nil, defaultCipherSuites, ""},
+		{
+			"order is kept",
+			[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			"",
+		},
+		{
+			"chacha20 with and without suffix",
+			[]string{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+			"",
+		},
+		{"insecure suite", []string{"TLS_RSA_WITH_RC4_128_SHA"}, nil, "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure"},
+		{"unknown suite", []string{"TLS_FANCY_CIPHER"}, nil, `unknown cipher suite "TLS_FANCY_CIPHER"`},
+		{"tls 1.3 suite", []string{"TLS_AES_128_GCM_SHA256"}, nil, "cipher suite TLS_AES_128_GCM_SHA256 is a TLS 1.3 suite"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCipherSuites(tt.names)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCipherSuites: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// tlsHandshake runs a handshake between a server using serverConfig and a client
+// using clientConfig over an in-memory connection
+func tlsHandshake(serverConfig, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go func() {
+		tls.Server(serverConn, serverConfig).Handshake()
+		serverConn.Close()
+	}()
+	client := tls.Client(clientConn, clientConfig)
+	err := client.Handshake()
+	return client.ConnectionState(), err
+}
+
+func TestCreateTLSConfig(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "server", newTestServerCert(t, ca))
+	logger, err := NewLogger(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCertStore(certFile, keyFile, logger)
+	if err != nil {
+		t.Fatalf("NewCertStore: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// The test certificate has an ECDSA key, so only the ECDSA suites can be chosen
+	allSuites := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+
+	tests := []struct {
+		name        string
+		options     TLSOptions
+		wantMin     uint16
+		wantSuites  []uint16
+		clientMax   uint16
+		wantVersion uint16 // 0 when the handshake must fail
+		wantSuite   uint16
+	}{
+		{
+			name:        "defaults",
+			wantMin:     tls.VersionTLS12,
+			wantSuites:  defaultCipherSuites,
+			clientMax:   tls.VersionTLS12,
+			wantVersion: tls.VersionTLS12,
+		},
+		{
+			name:       "tls 1.3 only refuses 1.2 clients",
+			options:    TLSOptions{MinVersion: "1.3"},
+			wantMin:    tls.VersionTLS13,
+			wantSuites: defaultCipherSuites,
+			clientMax:  tls.VersionTLS12,
+		},
+		{
+			name:        "tls 1.3 only",
+			options:     TLSOptions{MinVersion: "1.3"},
+			wantMin:     tls.VersionTLS13,
+			wantSuites:  defaultCipherSuites,
+			clientMax:   tls.VersionTLS13,
+			wantVersion: tls.VersionTLS13,
+		},
+		{
+			name:        "server preference",
+			options:     TLSOptions{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}, PreferServerCipherSuites: true},
+			wantMin:     tls.VersionTLS12,
+			wantSuites:  []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			clientMax:   tls.VersionTLS12,
+			wantVersion: tls.VersionTLS12,
+			wantSuite:   tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		},
+		{
+			name:        "allowlist limits the suites",
+			options:     TLSOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}},
+			wantMin:     tls.VersionTLS12,
+			wantSuites:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			clientMax:   tls.VersionTLS12,
+			wantVersion: tls.VersionTLS12,
+			wantSuite:   tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := CreateTLSConfig(store, tt.options)
+			if err != nil {
+				t.Fatalf("CreateTLSConfig: %v", err)
+			}
+			if config.MinVersion != tt.wantMin || !reflect.DeepEqual(config.CipherSuites, tt.wantSuites) {
+				t.Errorf("MinVersion %#x, CipherSuites %v, want %#x, %v", config.MinVersion, config.CipherSuites, tt.wantMin, tt.wantSuites)
+			}
+
+			state, err := tlsHandshake(config, &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				MaxVersion:   tt.clientMax,
+				CipherSuites: allSuites,
+			})
+			if tt.wantVersion == 0 {
+				if err == nil {
+					t.Errorf("handshake succeeded with %#x", state.Version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			if state.Version != tt.wantVersion {
+				t.Errorf("negotiated version %#x, want %#x", state.Version, tt.wantVersion)
+			}
+			if tt.wantSuite != 0 && state.CipherSuite != tt.wantSuite {
+				t.Errorf("negotiated %s, want %s", tls.CipherSuiteName(state.CipherSuite), tls.CipherSuiteName(tt.wantSuite))
+			}
+		})
+	}
+
+	for _, options := range []TLSOptions{{MinVersion: "1.0"}, {CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}} {
+		if _, err := CreateTLSConfig(store, options); err == nil {
+			t.Errorf("CreateTLSConfig(%+v) succeeded", options)
+		}
+	}
+}
@@ -19,20 +19,30 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
+	
+	"github.com/oschwald/maxminddb-golang"
 )
 
 // System-Wide Filtering Manager
@@ -45,14 +55,30 @@ type SystemWideFilteringManager struct {
 	contentFilter      *ContentFilterEngine
 	networkMonitor     *NetworkAdapterMonitor
 	ruleEngine         *FilteringRuleEngine
+	geoIPFilter        *GeoIPFilter
 	logger             *log.Logger
 	ctx                context.Context
 	cancel             context.CancelFunc
 	metrics            *SystemFilteringMetrics
+	packetPool         *PacketWorkerPool
 	active             bool
 	mutex              sync.RWMutex
 }
 
+// Bounded worker pool for asynchronous packet processing
+type PacketWorkerPool struct {
+	jobs    chan packetJob
+	workers int
+	wg      sync.WaitGroup
+	mu      sync.RWMutex // held for reading while a packet is queued
+	closed  bool
+}
+
+type packetJob struct {
+	packet   *NetworkPacket
+	callback func(packet *NetworkPacket, decision FilterDecision)
+}
+
 // System Filtering Configuration
 type SystemFilteringConfig struct {
 	// Network Interception
@@ -60,6 +86,8 @@ type SystemFilteringConfig struct {
 	InterceptionMethods       []string `json:"interceptionMethods"`
 	MonitoredPorts           []int    `json:"monitoredPorts"`
 	MonitoredProtocols       []string `json:"monitoredProtocols"`
+	PacketWorkers            int      `json:"packetWorkers"`   // 0 processes packets synchronously only
+	PacketQueueSize          int      `json:"packetQueueSize"`
 	
 	// DNS Filtering
 	EnableDNSFiltering       bool     `json:"enableDNSFiltering"`
@@ -68,12 +96,24 @@ type SystemFilteringConfig struct {
 	WhitelistDomains         []string `json:"whitelistDomains"`
 	DNSOverHTTPS             bool     `json:"dnsOverHTTPS"`
 	DNSOverTLS               bool     `json:"dnsOverTLS"`
+	CNAMEUncloaking          bool     `json:"cnameUncloaking"` // also block queries whose CNAME chain reaches a blocked domain
+	CNAMEMaxDepth            int      `json:"cnameMaxDepth"`
+	DNSRebindingProtection   bool     `json:"dnsRebindingProtection"`
+	DNSRebindingAction       string   `json:"dnsRebindingAction"` // nxdomain (default), strip
+	DNSRebindingAllowlist    []string `json:"dnsRebindingAllowlist"` // domains allowed to resolve to private addresses
+	DNSConditionalForwarders map[string]string `json:"dnsConditionalForwarders"` // domain suffix -> resolver, overriding dnsServers
+	DNSNegativeCacheTTL      int      `json:"dnsNegativeCacheTTL"` // seconds to cache NXDOMAIN and blocked answers without an SOA minimum; defaults to 60
 	
 	// Firewall Integration
 	EnableFirewallIntegration bool   `json:"enableFirewallIntegration"`
 	FirewallProvider          string `json:"firewallProvider"` // windows, iptables, pf
 	AutoConfigureRules        bool   `json:"autoConfigureRules"`
 	DefaultPolicy             string `json:"defaultPolicy"` // allow, deny
+	FirewallDryRun            bool   `json:"firewallDryRun"`
+	FirewallPersistPath       string `json:"firewallPersistPath"`
+	RestoreFirewallRules      bool   `json:"restoreFirewallRules"`
+	BlockQUIC                 bool   `json:"blockQUIC"` // drop outbound UDP to QUICPorts so browsers fall back to TCP
+	QUICPorts                 []int  `json:"quicPorts"` // defaults to 443
 	
 	// Process Filtering
 	EnableProcessFiltering    bool     `json:"enableProcessFiltering"`
@@ -93,6 +133,9 @@ type SystemFilteringConfig struct {
 	MonitoredAdapters         []string `json:"monitoredAdapters"`
 	TrafficLogging            bool     `json:"trafficLogging"`
 	BandwidthMonitoring       bool     `json:"bandwidthMonitoring"`
+	
+	// GeoIP
+	GeoIPDatabasePath         string   `json:"geoipDatabasePath"` // MaxMind GeoLite2-Country .mmdb
 }
 
 // Network Interceptor
@@ -126,7 +169,7 @@ type NetworkPacket struct {
 }
 
 type FilterDecision struct {
-	Action    string `json:"action"` // allow, block, redirect, modify
+	Action    string `json:"action"` // allow, block, redirect, modify, error
 	Reason    string `json:"reason"`
 	Target    string `json:"target,omitempty"` // for redirects
 	Modified  []byte `json:"modified,omitempty"` // for modifications
@@ -183,10 +226,18 @@ type DNSFilterEngine struct {
 	whitelists     map[string]*Whitelist
 	dnsCache       *DNSCache
 	upstreamServers []string
+	conditionalForwarders map[string]string // normalized domain suffix -> resolver
+	cnameResolver  CNAMEResolver
+	cnameCache     *CNAMECache
 	config         *SystemFilteringConfig
 	active         bool
 }
 
+// Resolves the CNAME target of a host; *net.Resolver satisfies it
+type CNAMEResolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
 type DNSServer struct {
 	address      string
 	port         int
@@ -216,6 +267,8 @@ type DNSResponse struct {
 	Blocked    bool     `json:"blocked"`
 	Redirected bool     `json:"redirected"`
 	Source     string   `json:"source"` // cache, upstream, blocked
+	RCode      string   `json:"rcode,omitempty"` // NXDOMAIN when the answer was rejected
+	SOAMinimum int      `json:"soaMinimum,omitempty"` // negative TTL from the authority SOA (RFC 2308)
 }
 
 type Blocklist struct {
@@ -225,6 +278,15 @@ type Blocklist struct {
 	Patterns    []*regexp.Regexp  `json:"patterns"`
 	LastUpdated time.Time         `json:"lastUpdated"`
 	Enabled     bool              `json:"enabled"`
+	filter      *BloomFilter
+	filtered    int // domains covered by filter
+}
+
+// Bloom filter used as a fast negative check in front of blocklist maps
+type BloomFilter struct {
+	bits   []uint64
+	size   uint64 // number of bits
+	hashes uint64
 }
 
 type Whitelist struct {
@@ -234,10 +296,11 @@ type Whitelist struct {
 }
 
 type DNSCache struct {
-	entries map[string]*DNSCacheEntry
-	mutex   sync.RWMutex
-	maxSize int
-	ttl     time.Duration
+	entries     map[string]*DNSCacheEntry
+	mutex       sync.RWMutex
+	maxSize     int
+	ttl         time.Duration // upper bound for any entry
+	negativeTTL time.Duration // NXDOMAIN and blocked answers without an SOA minimum
 }
 
 type DNSCacheEntry struct {
@@ -247,6 +310,19 @@ type DNSCacheEntry struct {
 	HitCount  int64        `json:"hitCount"`
 }
 
+// Cache of resolved CNAME chains keyed by the queried domain
+type CNAMECache struct {
+	entries map[string]*CNAMECacheEntry
+	mutex   sync.RWMutex
+	maxSize int
+	ttl     time.Duration
+}
+
+type CNAMECacheEntry struct {
+	Chain   []string  `json:"chain"`
+	Expires time.Time `json:"expires"`
+}
+
 // Firewall Integration
 type FirewallIntegration struct {
 	provider     string
@@ -254,6 +330,7 @@ type FirewallIntegration struct {
 	ruleManager  FirewallManager
 	config       *SystemFilteringConfig
 	active       bool
+	mutex        sync.Mutex
 }
 
 type FirewallManager interface {
@@ -286,11 +363,20 @@ type ProcessFilterManager struct {
 	processMonitor *ProcessMonitor
 	processRules   map[string]*ProcessRule
 	processInfo    map[int]*ProcessInfo
+	processBytes   map[string]int64       // total bytes per process name
+	quotaUsage     map[string]*QuotaUsage // keyed by rule and process name
 	config         *SystemFilteringConfig
 	active         bool
 	mutex          sync.RWMutex
 }
 
+// Data consumed against a process rule's quota in the current period
+type QuotaUsage struct {
+	PeriodStart time.Time `json:"periodStart"`
+	Bytes       int64     `json:"bytes"`
+	Exceeded    bool      `json:"exceeded"`
+}
+
 type ProcessMonitor struct {
 	scanner       ProcessScanner
 	eventHandler  ProcessEventHandler
@@ -320,6 +406,8 @@ type ProcessInfo struct {
 	MemoryUsage int64             `json:"memoryUsage"`
 	Connections []*NetworkConnection `json:"connections"`
 	Allowed     bool              `json:"allowed"`
+	BytesSent     int64           `json:"bytesSent"`
+	BytesReceived int64           `json:"bytesReceived"`
 }
 
 type ProcessRule struct {
@@ -331,6 +419,8 @@ type ProcessRule struct {
 	BlockedHosts  []string `json:"blockedHosts"`
 	AllowedPorts  []int    `json:"allowedPorts"`
 	BlockedPorts  []int    `json:"blockedPorts"`
+	QuotaBytes    int64    `json:"quotaBytes"`  // data budget per period; 0 for unlimited
+	QuotaPeriod   string   `json:"quotaPeriod"` // hourly, daily (default), weekly, monthly
 	Enabled       bool     `json:"enabled"`
 }
 
@@ -352,6 +442,7 @@ type ContentFilterEngine struct {
 	contentScanner *ContentScanner
 	malwareDetector *MalwareDetector
 	trackerBlocker *TrackerBlocker
+	signatureMatcher *SignatureMatcher
 	config         *SystemFilteringConfig
 	active         bool
 }
@@ -364,6 +455,7 @@ type CategoryFilter struct {
 	Patterns    []*regexp.Regexp  `json:"patterns"`
 	Enabled     bool              `json:"enabled"`
 	Action      string            `json:"action"` // block, warn, log
+	Schedule    *Schedule         `json:"schedule,omitempty"`
 }
 
 type URLFilter struct {
@@ -412,6 +504,7 @@ type MalwareSignature struct {
 	Name        string `json:"name"`
 	Type        string `json:"type"`
 	Family      string `json:"family"`
+	Pattern     string `json:"pattern,omitempty"` // byte sequence matched in content
 	Severity    int    `json:"severity"`
 	Description string `json:"description"`
 }
@@ -524,6 +617,8 @@ type FilteringRuleEngine struct {
 	evaluator   *RuleEvaluator
 	actions     map[string]RuleAction
 	config      *SystemFilteringConfig
+	sweepInterval time.Duration
+	mutex       sync.RWMutex
 }
 
 type FilteringRule struct {
@@ -540,11 +635,23 @@ type FilteringRule struct {
 	CreatedAt   time.Time         `json:"createdAt"`
 	UpdatedAt   time.Time         `json:"updatedAt"`
 	Statistics  *RuleStatistics   `json:"statistics"`
+	Schedule    *Schedule         `json:"schedule,omitempty"`
+}
+
+// Weekly window during which a rule or category filter is active (local time)
+type Schedule struct {
+	Days   []string    `json:"days"`   // mon, tue, ... ; empty means every day
+	Ranges []TimeRange `json:"ranges"` // empty means all day
+}
+
+type TimeRange struct {
+	Start string `json:"start"` // HH:MM
+	End   string `json:"end"`   // HH:MM; earlier than Start for overnight ranges
 }
 
 type RuleCondition struct {
 	Field    string      `json:"field"`
-	Operator string      `json:"operator"` // equals, contains, matches, greater, less
+	Operator string      `json:"operator"` // equals, contains, matches, greater, less, greater_equal, less_equal, in, startswith, endswith
 	Value    interface{} `json:"value"`
 	Negate   bool        `json:"negate"`
 }
@@ -553,12 +660,14 @@ type RuleChain struct {
 	Name     string   `json:"name"`
 	Rules    []string `json:"rules"` // Rule IDs
 	Policy   string   `json:"policy"` // allow, deny
+	Order    int      `json:"order"`  // chains are traversed in ascending order
 	Enabled  bool     `json:"enabled"`
 }
 
 type RuleMatcher struct {
 	compiledPatterns map[string]*regexp.Regexp
 	fieldExtractors  map[string]FieldExtractor
+	mutex            sync.RWMutex
 }
 
 type FieldExtractor interface {
@@ -582,6 +691,21 @@ type RuleStatistics struct {
 	LastMatched   *time.Time `json:"lastMatched,omitempty"`
 	LastExecuted  *time.Time `json:"lastExecuted,omitempty"`
 	AvgExecTime   time.Duration `json:"avgExecTime"`
+	mutex         sync.Mutex
+}
+
+func (s *RuleStatistics) recordMatch(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.MatchCount++
+	s.LastMatched = &now
+}
+
+func (s *RuleStatistics) recordAction(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ActionCount++
+	s.LastExecuted = &now
 }
 
 // System Filtering Metrics
@@ -590,6 +714,7 @@ type SystemFilteringMetrics struct {
 	NetworkPacketsBlocked    int64 `json:"networkPacketsBlocked"`
 	DNSQueriesProcessed      int64 `json:"dnsQueriesProcessed"`
 	DNSQueriesBlocked        int64 `json:"dnsQueriesBlocked"`
+	DNSRebindingBlocked      int64 `json:"dnsRebindingBlocked"`
 	ProcessesMonitored       int64 `json:"processesMonitored"`
 	ProcessesBlocked         int64 `json:"processesBlocked"`
 	ContentScansPerformed    int64 `json:"contentScansPerformed"`
@@ -598,6 +723,10 @@ type SystemFilteringMetrics struct {
 	FilteringRulesActive     int64 `json:"filteringRulesActive"`
 	AvgProcessingTime        time.Duration `json:"avgProcessingTime"`
 	SystemResourceUsage      *ResourceUsage `json:"systemResourceUsage"`
+	
+	// Running mean of processing time; all counters are updated atomically
+	processingTimeTotal      int64
+	processingSamples        int64
 }
 
 type ResourceUsage struct {
@@ -705,10 +834,12 @@ func (m *SystemWideFilteringManager) initDNSFilter() error {
 		blocklists:      make(map[string]*Blocklist),
 		whitelists:      make(map[string]*Whitelist),
 		upstreamServers: m.config.DNSServers,
+		conditionalForwarders: make(map[string]string),
 		dnsCache: &DNSCache{
-			entries: make(map[string]*DNSCacheEntry),
-			maxSize: 10000,
-			ttl:     300 * time.Second,
+			entries:     make(map[string]*DNSCacheEntry),
+			maxSize:     10000,
+			ttl:         300 * time.Second,
+			negativeTTL: 60 * time.Second,
 		},
 		dnsServer: &DNSServer{
 			address:  "127.0.0.1",
@@ -717,6 +848,28 @@ func (m *SystemWideFilteringManager) initDNSFilter() error {
 		},
 	}
 	
+	if m.config.DNSNegativeCacheTTL > 0 {
+		m.dnsFilter.dnsCache.negativeTTL = time.Duration(m.config.DNSNegativeCacheTTL) * time.Second
+	}
+	
+	for suffix, resolver := range m.config.DNSConditionalForwarders {
+		suffix = strings.Trim(strings.ToLower(suffix), ".")
+		if suffix == "" || resolver == "" {
+			m.logger.Printf("Ignoring invalid conditional forwarder %q -> %q", suffix, resolver)
+			continue
+		}
+		m.dnsFilter.conditionalForwarders[suffix] = resolver
+	}
+	
+	if m.config.CNAMEUncloaking {
+		m.dnsFilter.cnameResolver = net.DefaultResolver
+		m.dnsFilter.cnameCache = &CNAMECache{
+			entries: make(map[string]*CNAMECacheEntry),
+			maxSize: 10000,
+			ttl:     300 * time.Second,
+		}
+	}
+	
 	// Load blocklists
 	for _, source := range m.config.BlocklistSources {
 		blocklist, err := m.loadBlocklist(source)
@@ -724,7 +877,7 @@ func (m *SystemWideFilteringManager) initDNSFilter() error {
 			m.logger.Printf("Failed to load blocklist from %s: %v", source, err)
 			continue
 		}
-		m.dnsFilter.blocklists[blocklist.Name] = blocklist
+		m.dnsFilter.SetBlocklist(blocklist)
 	}
 	
 	// Load whitelists
@@ -758,7 +911,7 @@ func (m *SystemWideFilteringManager) initFirewallIntegration() error {
 	case "windows":
 		firewallManager = &WindowsFirewallManager{}
 	case "iptables":
-		firewallManager = &IptablesManager{}
+		firewallManager = NewIptablesManager(m.config.FirewallDryRun)
 	case "pf":
 		firewallManager = &PfManager{}
 	default:
@@ -767,7 +920,7 @@ func (m *SystemWideFilteringManager) initFirewallIntegration() error {
 		case "windows":
 			firewallManager = &WindowsFirewallManager{}
 		case "linux":
-			firewallManager = &IptablesManager{}
+			firewallManager = NewIptablesManager(m.config.FirewallDryRun)
 		case "darwin":
 			firewallManager = &PfManager{}
 		default:
@@ -782,6 +935,16 @@ func (m *SystemWideFilteringManager) initFirewallIntegration() error {
 		config:      m.config,
 	}
 	
+	// Reinstall persisted rules from a previous run
+	if m.config.RestoreFirewallRules && m.config.FirewallPersistPath != "" {
+		restored, err := m.firewallIntegration.RestoreRules()
+		if err != nil {
+			m.logger.Printf("Failed to restore persisted firewall rules: %v", err)
+		} else {
+			m.logger.Printf("Restored %d persisted firewall rules", restored)
+		}
+	}
+	
 	// Configure default rules if enabled
 	if m.config.AutoConfigureRules {
 		err = m.configureDefaultFirewallRules()
@@ -790,11 +953,197 @@ func (m *SystemWideFilteringManager) initFirewallIntegration() error {
 		}
 	}
 	
+	if m.config.BlockQUIC {
+		if err := m.installQUICFirewallRules(); err != nil {
+			m.logger.Printf("Failed to install QUIC blocking firewall rules: %v", err)
+		}
+	}
+	
 	m.logger.Printf("Firewall integration initialized with provider: %s", 
 		m.config.FirewallProvider)
 	return nil
 }
 
+// Install a rule through the firewall manager and persist it unless temporary
+func (f *FirewallIntegration) AddRule(rule *FirewallRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	
+	if err := f.ruleManager.AddRule(rule); err != nil {
+		return err
+	}
+	f.rules[rule.ID] = rule
+	
+	if rule.Temporary {
+		return nil
+	}
+	return f.saveRulesLocked()
+}
+
+// Remove a rule from the firewall and the persistent store
+func (f *FirewallIntegration) RemoveRule(ruleID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	
+	if err := f.ruleManager.RemoveRule(ruleID); err != nil {
+		return err
+	}
+	rule, exists := f.rules[ruleID]
+	delete(f.rules, ruleID)
+	
+	if exists && rule.Temporary {
+		return nil
+	}
+	return f.saveRulesLocked()
+}
+
+// Write managed, non-temporary rules to the configured persistence file
+func (f *FirewallIntegration) SaveRules() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.saveRulesLocked()
+}
+
+func (f *FirewallIntegration) saveRulesLocked() error {
+	if f.config.FirewallPersistPath == "" {
+		return nil
+	}
+	
+	var rules []*FirewallRule
+	for _, rule := range f.rules {
+		if !rule.Temporary {
+			rules = append(rules, rule)
+		}
+	}
+	
+	tmpPath := f.config.FirewallPersistPath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmpPath, err)
+	}
+	
+	if err := exportFirewallRules(file, rules); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, f.config.FirewallPersistPath)
+}
+
+// Reinstall rules from the persistence file, returning how many were restored
+func (f *FirewallIntegration) RestoreRules() (int, error) {
+	file, err := os.Open(f.config.FirewallPersistPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+	
+	rules, err := importFirewallRules(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", f.config.FirewallPersistPath, err)
+	}
+	
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	
+	restored := 0
+	for _, rule := range rules {
+		if err := f.ruleManager.AddRule(rule); err != nil {
+			return restored, fmt.Errorf("failed to restore rule %s: %v", rule.ID, err)
+		}
+		f.rules[rule.ID] = rule
+		restored++
+	}
+	return restored, nil
+}
+
+// Serialize rules in iptables-save format. Rule names are kept in comment lines,
+// which iptables-restore ignores, and disabled rules are written commented out.
+func exportFirewallRules(w io.Writer, rules []*FirewallRule) error {
+	sorted := append([]*FirewallRule(nil), rules...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "# Generated by OblivionFilter on %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintln(buf, "*filter")
+	for _, rule := range sorted {
+		fmt.Fprintf(buf, "# rule %s name=%s\n", rule.ID, rule.Name)
+		prefix := ""
+		if !rule.Enabled {
+			prefix = "#"
+		}
+		for _, args := range buildIptablesArgs("-A", rule, false) {
+			fmt.Fprintln(buf, prefix+strings.Join(args, " "))
+		}
+	}
+	fmt.Fprintln(buf, "COMMIT")
+	return buf.Flush()
+}
+
+// Parse rules written by exportFirewallRules
+func importFirewallRules(r io.Reader) ([]*FirewallRule, error) {
+	var order []string
+	rules := make(map[string]*FirewallRule)
+	names := make(map[string]string)
+	
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		
+		if strings.HasPrefix(line, "# rule ") {
+			fields := strings.SplitN(strings.TrimPrefix(line, "# rule "), " ", 2)
+			if len(fields) == 2 {
+				names[fields[0]] = strings.TrimPrefix(fields[1], "name=")
+			}
+			continue
+		}
+		
+		enabled := true
+		if strings.HasPrefix(line, "#-A ") {
+			enabled = false
+			line = line[1:]
+		}
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		
+		rule := parseIptablesRule(line)
+		if rule == nil {
+			continue
+		}
+		rule.Enabled = enabled
+		if existing, exists := rules[rule.ID]; exists {
+			// Rules for both directions are written once per chain
+			if existing.Direction != rule.Direction {
+				existing.Direction = "both"
+			}
+			continue
+		}
+		rules[rule.ID] = rule
+		order = append(order, rule.ID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	
+	result := make([]*FirewallRule, 0, len(order))
+	for _, id := range order {
+		rule := rules[id]
+		if name, exists := names[id]; exists {
+			rule.Name = name
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
 // Initialize process filter
 func (m *SystemWideFilteringManager) initProcessFilter() error {
 	if !m.config.EnableProcessFiltering {
@@ -806,9 +1155,9 @@ func (m *SystemWideFilteringManager) initProcessFilter() error {
 	// Initialize platform-specific process scanner
 	switch runtime.GOOS {
 	case "windows":
-		processScanner = &WindowsProcessScanner{}
+		processScanner = NewWindowsProcessScanner("OblivionFilter-Network")
 	case "linux":
-		processScanner = &LinuxProcessScanner{}
+		processScanner = NewLinuxProcessScanner("/proc")
 	case "darwin":
 		processScanner = &DarwinProcessScanner{}
 	default:
@@ -819,12 +1168,23 @@ func (m *SystemWideFilteringManager) initProcessFilter() error {
 		config:       m.config,
 		processRules: make(map[string]*ProcessRule),
 		processInfo:  make(map[int]*ProcessInfo),
+		processBytes: make(map[string]int64),
+		quotaUsage:   make(map[string]*QuotaUsage),
 		processMonitor: &ProcessMonitor{
 			scanner:        processScanner,
 			updateInterval: 5 * time.Second,
 		},
 	}
 	
+	m.processFilter.processMonitor.eventHandler = m.processFilter
+	
+	// Map connections to processes from ETW events where available
+	if scanner, ok := processScanner.(*WindowsProcessScanner); ok {
+		if err := scanner.Start(m.processFilter); err != nil {
+			m.logger.Printf("ETW network tracing unavailable, polling connection tables: %v", err)
+		}
+	}
+	
 	// Load process rules
 	m.loadProcessRules()
 	
@@ -859,6 +1219,7 @@ func (m *SystemWideFilteringManager) initContentFilter() error {
 			trackerLists: make(map[string]*TrackerList),
 			enabled:      m.config.EnableTrackerBlocking,
 		},
+		signatureMatcher: NewSignatureMatcher(),
 	}
 	
 	// Load content categories
@@ -939,7 +1300,8 @@ func (m *SystemWideFilteringManager) initRuleEngine() error {
 		evaluator: &RuleEvaluator{
 			operators: make(map[string]OperatorFunc),
 		},
-		actions: make(map[string]RuleAction),
+		actions:       make(map[string]RuleAction),
+		sweepInterval: 10 * time.Second,
 	}
 	
 	// Register operators
@@ -951,17 +1313,58 @@ func (m *SystemWideFilteringManager) initRuleEngine() error {
 	}
 	m.ruleEngine.evaluator.operators["matches"] = func(field, value interface{}) bool {
 		pattern := fmt.Sprintf("%v", value)
-		if compiled, exists := m.ruleEngine.matcher.compiledPatterns[pattern]; exists {
+		m.ruleEngine.matcher.mutex.RLock()
+		compiled, exists := m.ruleEngine.matcher.compiledPatterns[pattern]
+		m.ruleEngine.matcher.mutex.RUnlock()
+		if exists {
 			return compiled.MatchString(fmt.Sprintf("%v", field))
 		}
 		return false
 	}
+	m.ruleEngine.evaluator.operators["greater"] = func(field, value interface{}) bool {
+		a, b, ok := toNumericPair(field, value)
+		return ok && a > b
+	}
+	m.ruleEngine.evaluator.operators["less"] = func(field, value interface{}) bool {
+		a, b, ok := toNumericPair(field, value)
+		return ok && a < b
+	}
+	m.ruleEngine.evaluator.operators["greater_equal"] = func(field, value interface{}) bool {
+		a, b, ok := toNumericPair(field, value)
+		return ok && a >= b
+	}
+	m.ruleEngine.evaluator.operators["less_equal"] = func(field, value interface{}) bool {
+		a, b, ok := toNumericPair(field, value)
+		return ok && a <= b
+	}
+	m.ruleEngine.evaluator.operators["in"] = func(field, value interface{}) bool {
+		fieldStr := fmt.Sprintf("%v", field)
+		for _, member := range toValueList(value) {
+			if fmt.Sprintf("%v", member) == fieldStr {
+				return true
+			}
+		}
+		return false
+	}
+	m.ruleEngine.evaluator.operators["startswith"] = func(field, value interface{}) bool {
+		return strings.HasPrefix(fmt.Sprintf("%v", field), fmt.Sprintf("%v", value))
+	}
+	m.ruleEngine.evaluator.operators["endswith"] = func(field, value interface{}) bool {
+		return strings.HasSuffix(fmt.Sprintf("%v", field), fmt.Sprintf("%v", value))
+	}
+	
+	// GeoIP lookups fail open when the database is unavailable
+	m.geoIPFilter = NewGeoIPFilter(m.config.GeoIPDatabasePath, m.logger)
 	
 	// Register field extractors
 	m.ruleEngine.matcher.fieldExtractors["source_ip"] = &SourceIPExtractor{}
 	m.ruleEngine.matcher.fieldExtractors["dest_ip"] = &DestIPExtractor{}
 	m.ruleEngine.matcher.fieldExtractors["protocol"] = &ProtocolExtractor{}
 	m.ruleEngine.matcher.fieldExtractors["process_name"] = &ProcessNameExtractor{}
+	m.ruleEngine.matcher.fieldExtractors["source_port"] = &SourcePortExtractor{}
+	m.ruleEngine.matcher.fieldExtractors["dest_port"] = &DestPortExtractor{}
+	m.ruleEngine.matcher.fieldExtractors["dest_country"] = &DestCountryExtractor{geoIP: m.geoIPFilter}
+	m.ruleEngine.matcher.fieldExtractors["direction"] = &DirectionExtractor{}
 	
 	// Register actions
 	m.ruleEngine.actions["block"] = &BlockAction{}
@@ -1026,6 +1429,14 @@ func (m *SystemWideFilteringManager) Start() error {
 		m.networkMonitor.active = true
 	}
 	
+	// Start expired rule sweeper
+	go m.runRuleExpirySweeper()
+	
+	// Start packet worker pool
+	if m.config.PacketWorkers > 0 {
+		m.startPacketWorkers()
+	}
+	
 	// Start metrics collection
 	go m.runMetricsCollection()
 	
@@ -1048,6 +1459,8 @@ func (m *SystemWideFilteringManager) Stop() error {
 	// Stop all components
 	m.cancel()
 	
+	m.stopPacketWorkers()
+	
 	// Stop network interceptor
 	if m.networkInterceptor != nil && m.networkInterceptor.active {
 		for _, interceptor := range m.networkInterceptor.interceptors {
@@ -1066,6 +1479,9 @@ func (m *SystemWideFilteringManager) Stop() error {
 		m.firewallIntegration.active = false
 	}
 	if m.processFilter != nil {
+		if scanner, ok := m.processFilter.processMonitor.scanner.(*WindowsProcessScanner); ok {
+			scanner.Stop()
+		}
 		m.processFilter.active = false
 	}
 	if m.contentFilter != nil {
@@ -1083,23 +1499,24 @@ func (m *SystemWideFilteringManager) Stop() error {
 // Process network packet through filtering pipeline
 func (m *SystemWideFilteringManager) ProcessPacket(packet *NetworkPacket) FilterDecision {
 	startTime := time.Now()
-	m.metrics.NetworkPacketsProcessed++
+	atomic.AddInt64(&m.metrics.NetworkPacketsProcessed, 1)
 	
 	// Apply rule engine
 	decision := m.applyFilteringRules(packet)
 	if decision.Action == "block" {
-		m.metrics.NetworkPacketsBlocked++
+		atomic.AddInt64(&m.metrics.NetworkPacketsBlocked, 1)
 		m.updateProcessingTime(time.Since(startTime))
 		return decision
 	}
 	
 	// Apply DNS filtering if it's a DNS packet
+	var dnsDecision FilterDecision
 	if packet.DestPort == 53 {
-		decision = m.processDNSPacket(packet)
-		if decision.Action == "block" {
-			m.metrics.DNSQueriesBlocked++
+		dnsDecision = m.processDNSPacket(packet)
+		if dnsDecision.Action == "block" {
+			atomic.AddInt64(&m.metrics.DNSQueriesBlocked, 1)
 			m.updateProcessingTime(time.Since(startTime))
-			return decision
+			return dnsDecision
 		}
 	}
 	
@@ -1107,7 +1524,7 @@ func (m *SystemWideFilteringManager) ProcessPacket(packet *NetworkPacket) Filter
 	if m.config.EnableProcessFiltering && packet.ProcessID > 0 {
 		decision = m.processFilterCheck(packet)
 		if decision.Action == "block" {
-			m.metrics.ProcessesBlocked++
+			atomic.AddInt64(&m.metrics.ProcessesBlocked, 1)
 			m.updateProcessingTime(time.Since(startTime))
 			return decision
 		}
@@ -1122,6 +1539,12 @@ func (m *SystemWideFilteringManager) ProcessPacket(packet *NetworkPacket) Filter
 		}
 	}
 	
+	// A query for another resolver is redirected once nothing else blocked it
+	if dnsDecision.Action == "redirect" {
+		m.updateProcessingTime(time.Since(startTime))
+		return dnsDecision
+	}
+	
 	// Default allow if no rules matched
 	decision = FilterDecision{
 		Action: "allow",
@@ -1133,30 +1556,180 @@ func (m *SystemWideFilteringManager) ProcessPacket(packet *NetworkPacket) Filter
 	return decision
 }
 
+// Start workers that drain the packet queue until the manager is stopped
+func (m *SystemWideFilteringManager) startPacketWorkers() {
+	queueSize := m.config.PacketQueueSize
+	if queueSize <= 0 {
+		queueSize = m.config.PacketWorkers * 64
+	}
+	
+	pool := &PacketWorkerPool{
+		jobs:    make(chan packetJob, queueSize),
+		workers: m.config.PacketWorkers,
+	}
+	
+	for i := 0; i < pool.workers; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for {
+				select {
+				case <-m.ctx.Done():
+					return
+				case job := <-pool.jobs:
+					decision := m.ProcessPacket(job.packet)
+					if job.callback != nil {
+						job.callback(job.packet, decision)
+					}
+				}
+			}
+		}()
+	}
+	
+	m.packetPool = pool
+	m.logger.Printf("Packet worker pool started with %d workers (queue %d)", pool.workers, queueSize)
+}
+
+// Packets still queued when filtering stops are answered with this decision
+var packetWorkersStoppedDecision = FilterDecision{
+	Action: "error",
+	Reason: "System filtering stopped before the packet was processed",
+}
+
+// Wait for packet workers to finish their current packets once the context is
+// cancelled, then answer the packets left in the queue so no callback is lost
+func (m *SystemWideFilteringManager) stopPacketWorkers() {
+	pool := m.packetPool
+	if pool == nil {
+		return
+	}
+	
+	// Senders blocked on a full queue give up once the context is cancelled
+	pool.mu.Lock()
+	pool.closed = true
+	pool.mu.Unlock()
+	
+	pool.wg.Wait()
+	for {
+		select {
+		case job := <-pool.jobs:
+			if job.callback != nil {
+				job.callback(job.packet, packetWorkersStoppedDecision)
+			}
+		default:
+			m.packetPool = nil
+			return
+		}
+	}
+}
+
+// Queue a packet for asynchronous processing, blocking while the queue is full
+func (m *SystemWideFilteringManager) SubmitPacket(packet *NetworkPacket, callback func(*NetworkPacket, FilterDecision)) error {
+	m.mutex.RLock()
+	pool := m.packetPool
+	m.mutex.RUnlock()
+	if pool == nil {
+		return fmt.Errorf("packet worker pool is not running")
+	}
+	
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if pool.closed {
+		return fmt.Errorf("system filtering is stopping")
+	}
+	select {
+	case pool.jobs <- packetJob{packet: packet, callback: callback}:
+		return nil
+	case <-m.ctx.Done():
+		return fmt.Errorf("system filtering is stopping")
+	}
+}
+
+// Queue a packet without blocking, returning false when the queue is full
+func (m *SystemWideFilteringManager) TrySubmitPacket(packet *NetworkPacket, callback func(*NetworkPacket, FilterDecision)) bool {
+	m.mutex.RLock()
+	pool := m.packetPool
+	m.mutex.RUnlock()
+	if pool == nil {
+		return false
+	}
+	
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if pool.closed {
+		return false
+	}
+	select {
+	case pool.jobs <- packetJob{packet: packet, callback: callback}:
+		return true
+	default:
+		return false
+	}
+}
+
 // Apply filtering rules to packet
 func (m *SystemWideFilteringManager) applyFilteringRules(packet *NetworkPacket) FilterDecision {
-	// Evaluate rules in priority order
+	now := time.Now()
+	
+	m.ruleEngine.mutex.RLock()
+	chains := m.ruleEngine.orderedChains()
+	chained := make(map[string]bool)
+	chainRules := make([][]*FilteringRule, len(chains))
+	for i, chain := range chains {
+		for _, id := range chain.Rules {
+			chained[id] = true
+			if rule, exists := m.ruleEngine.rules[id]; exists {
+				chainRules[i] = append(chainRules[i], rule)
+			}
+		}
+	}
+	
+	// Rules that are not part of any chain are evaluated in priority order
 	var applicableRules []*FilteringRule
 	for _, rule := range m.ruleEngine.rules {
-		if rule.Enabled && m.ruleMatches(rule, packet) {
+		if !chained[rule.ID] {
 			applicableRules = append(applicableRules, rule)
 		}
 	}
+	m.ruleEngine.mutex.RUnlock()
 	
-	// Sort by priority
-	for i := 0; i < len(applicableRules); i++ {
-		for j := i + 1; j < len(applicableRules); j++ {
-			if applicableRules[i].Priority < applicableRules[j].Priority {
-				applicableRules[i], applicableRules[j] = applicableRules[j], applicableRules[i]
+	// Traverse chains in order; an allow policy passes the packet on to the next chain
+	for i, chain := range chains {
+		if decision, matched := m.evaluateRules(chainRules[i], packet, now); matched {
+			return decision
+		}
+		if chain.Policy == "deny" {
+			return FilterDecision{
+				Action: "block",
+				Reason: fmt.Sprintf("Chain %s default policy: deny", chain.Name),
+				Logged: true,
 			}
 		}
 	}
 	
-	// Apply first matching rule
-	for _, rule := range applicableRules {
-		rule.Statistics.MatchCount++
-		now := time.Now()
-		rule.Statistics.LastMatched = &now
+	// Sort by priority, breaking ties by ID so equal priorities evaluate in a stable order
+	sort.Slice(applicableRules, func(i, j int) bool {
+		if applicableRules[i].Priority != applicableRules[j].Priority {
+			return applicableRules[i].Priority > applicableRules[j].Priority
+		}
+		return applicableRules[i].ID < applicableRules[j].ID
+	})
+	
+	if decision, matched := m.evaluateRules(applicableRules, packet, now); matched {
+		return decision
+	}
+	
+	return FilterDecision{Action: "allow", Reason: "No rules matched"}
+}
+
+// Apply the first rule in rules that matches the packet and executes an action
+func (m *SystemWideFilteringManager) evaluateRules(rules []*FilteringRule, packet *NetworkPacket, now time.Time) (FilterDecision, bool) {
+	for _, rule := range rules {
+		if !rule.Enabled || rule.IsExpired(now) || !rule.Schedule.IsActive(now) || !m.ruleMatches(rule, packet) {
+			continue
+		}
+		
+		rule.Statistics.recordMatch(now)
 		
 		// Execute rule actions
 		for _, actionType := range rule.Actions {
@@ -1167,74 +1740,630 @@ func (m *SystemWideFilteringManager) applyFilteringRules(packet *NetworkPacket)
 					continue
 				}
 				
-				rule.Statistics.ActionCount++
-				rule.Statistics.LastExecuted = &now
+				rule.Statistics.recordAction(now)
 				
 				return FilterDecision{
 					Action: actionType,
 					Reason: fmt.Sprintf("Matched rule: %s", rule.Name),
 					Logged: true,
-				}
+				}, true
 			}
 		}
 	}
 	
-	return FilterDecision{Action: "allow", Reason: "No rules matched"}
+	return FilterDecision{}, false
 }
 
-// Process DNS packet
-func (m *SystemWideFilteringManager) processDNSPacket(packet *NetworkPacket) FilterDecision {
-	if !m.config.EnableDNSFiltering || m.dnsFilter == nil {
-		return FilterDecision{Action: "allow"}
+// Add or replace a rule chain
+func (e *FilteringRuleEngine) AddRuleChain(chain *RuleChain) error {
+	if chain.Name == "" {
+		return fmt.Errorf("rule chain name is required")
+	}
+	if chain.Policy != "allow" && chain.Policy != "deny" {
+		return fmt.Errorf("invalid policy for chain %s: %s", chain.Name, chain.Policy)
 	}
 	
-	// Extract domain from DNS query (simplified)
-	domain := m.extractDomainFromDNSPacket(packet)
-	if domain == "" {
-		return FilterDecision{Action: "allow"}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.ruleChains[chain.Name] = chain
+	return nil
+}
+
+// Remove a rule chain by name
+func (e *FilteringRuleEngine) RemoveRuleChain(name string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.ruleChains, name)
+}
+
+// Enabled chains sorted by Order, then name. Caller must hold the engine lock.
+func (e *FilteringRuleEngine) orderedChains() []*RuleChain {
+	var chains []*RuleChain
+	for _, chain := range e.ruleChains {
+		if chain.Enabled {
+			chains = append(chains, chain)
+		}
+	}
+	
+	sort.Slice(chains, func(i, j int) bool {
+		if chains[i].Order != chains[j].Order {
+			return chains[i].Order < chains[j].Order
+		}
+		return chains[i].Name < chains[j].Name
+	})
+	return chains
+}
+
+// Add a rule that expires after ttl
+func (e *FilteringRuleEngine) AddTemporaryRule(rule *FilteringRule, ttl time.Duration) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	
+	rule.Temporary = true
+	rule.ExpiresAt = &expiresAt
+	if rule.CreatedAt.IsZero() {
+		rule.CreatedAt = now
+	}
+	rule.UpdatedAt = now
+	if rule.Statistics == nil {
+		rule.Statistics = &RuleStatistics{}
 	}
 	
-	m.metrics.DNSQueriesProcessed++
+	e.mutex.Lock()
+	e.rules[rule.ID] = rule
+	e.mutex.Unlock()
+}
+
+// Remove rules whose expiry time has passed
+func (e *FilteringRuleEngine) RemoveExpiredRules(now time.Time) int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 	
-	// Check whitelist first
-	for _, whitelist := range m.dnsFilter.whitelists {
-		if whitelist.Enabled && whitelist.Domains[domain] {
-			return FilterDecision{
-				Action: "allow",
-				Reason: fmt.Sprintf("Domain %s is whitelisted", domain),
-				Logged: true,
-			}
+	removed := 0
+	for id, rule := range e.rules {
+		if rule.IsExpired(now) {
+			delete(e.rules, id)
+			removed++
 		}
 	}
+	return removed
+}
+
+// Check whether a rule has passed its expiry time
+func (r *FilteringRule) IsExpired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// Check whether the schedule is active at t. A nil schedule is always active.
+// Overnight ranges belong to the day they start on, so a Friday 22:00-06:00
+// range also covers early Saturday morning.
+func (s *Schedule) IsActive(t time.Time) bool {
+	if s == nil {
+		return true
+	}
 	
-	// Check blocklists
-	for _, blocklist := range m.dnsFilter.blocklists {
-		if !blocklist.Enabled {
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	if len(s.Ranges) == 0 {
+		return s.includesDay(today)
+	}
+	
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range s.Ranges {
+		start, ok := parseClockMinutes(r.Start)
+		if !ok {
 			continue
 		}
-		
-		// Direct domain match
-		if blocklist.Domains[domain] {
-			return FilterDecision{
-				Action: "block",
-				Reason: fmt.Sprintf("Domain %s is blocked by %s", domain, blocklist.Name),
-				Logged: true,
-			}
+		end, ok := parseClockMinutes(r.End)
+		if !ok {
+			continue
 		}
 		
-		// Pattern matching
-		for _, pattern := range blocklist.Patterns {
-			if pattern.MatchString(domain) {
+		switch {
+		case start == end:
+			// Whole day
+			if s.includesDay(today) {
+				return true
+			}
+		case start < end:
+			if minute >= start && minute < end && s.includesDay(today) {
+				return true
+			}
+		default:
+			if minute >= start && s.includesDay(today) {
+				return true
+			}
+			if minute < end && s.includesDay(yesterday) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Schedule) includesDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, name := range s.Days {
+		if parsed, ok := parseWeekday(name); ok && parsed == day {
+			return true
+		}
+	}
+	return false
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) < 3 {
+		return 0, false
+	}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// Parse "HH:MM" into minutes since midnight
+func parseClockMinutes(value string) (int, bool) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, false
+	}
+	return parsed.Hour()*60 + parsed.Minute(), true
+}
+
+// Periodically remove expired rules until the manager is stopped
+func (m *SystemWideFilteringManager) runRuleExpirySweeper() {
+	ticker := time.NewTicker(m.ruleEngine.sweepInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if removed := m.ruleEngine.RemoveExpiredRules(now); removed > 0 {
+				m.logger.Printf("Removed %d expired filtering rules", removed)
+			}
+		}
+	}
+}
+
+// Process DNS packet
+func (m *SystemWideFilteringManager) processDNSPacket(packet *NetworkPacket) FilterDecision {
+	if !m.config.EnableDNSFiltering || m.dnsFilter == nil {
+		return FilterDecision{Action: "allow"}
+	}
+	
+	// Extract domain from DNS query (simplified)
+	domain := m.extractDomainFromDNSPacket(packet)
+	if domain == "" {
+		return FilterDecision{Action: "allow"}
+	}
+	
+	atomic.AddInt64(&m.metrics.DNSQueriesProcessed, 1)
+	
+	// Check whitelist first
+	for _, whitelist := range m.dnsFilter.whitelists {
+		if whitelist.Enabled && whitelist.Domains[domain] {
+			return m.forwardDNSQuery(packet, domain, FilterDecision{
+				Action: "allow",
+				Reason: fmt.Sprintf("Domain %s is whitelisted", domain),
+				Logged: true,
+			})
+		}
+	}
+	
+	// Names recently blocked or answered NXDOMAIN upstream are answered from the
+	// negative cache
+	if cached, exists := m.dnsFilter.dnsCache.Get(domain, ""); exists && (cached.Blocked || cached.RCode == "NXDOMAIN") {
+		reason := fmt.Sprintf("Domain %s does not exist (cached)", domain)
+		if cached.Blocked {
+			reason = fmt.Sprintf("Domain %s is blocked (cached)", domain)
+		}
+		return FilterDecision{
+			Action: "block",
+			Reason: reason,
+			Logged: true,
+		}
+	}
+	
+	// Check blocklists
+	if reason, blocked := m.dnsFilter.matchBlocklists(domain); blocked {
+		m.dnsFilter.cacheBlocked(domain)
+		return FilterDecision{
+			Action: "block",
+			Reason: reason,
+			Logged: true,
+		}
+	}
+	
+	// Uncloak first-party CNAMEs pointing at blocked trackers
+	if m.config.CNAMEUncloaking && m.dnsFilter.cnameResolver != nil {
+		for _, target := range m.dnsFilter.resolveCNAMEChain(domain) {
+			if reason, blocked := m.dnsFilter.matchBlocklists(target); blocked {
+				m.dnsFilter.cacheBlocked(domain)
 				return FilterDecision{
 					Action: "block",
-					Reason: fmt.Sprintf("Domain %s matches blocked pattern", domain),
+					Reason: fmt.Sprintf("Domain %s is a CNAME alias: %s", domain, reason),
 					Logged: true,
 				}
 			}
 		}
 	}
 	
-	return FilterDecision{Action: "allow"}
+	return m.forwardDNSQuery(packet, domain, FilterDecision{Action: "allow"})
+}
+
+// Redirect an allowed query to the resolver UpstreamsFor picks for domain when the
+// client sent it elsewhere. DoH and DoT upstreams cannot take a raw query packet,
+// so those queries keep the allow decision.
+func (m *SystemWideFilteringManager) forwardDNSQuery(packet *NetworkPacket, domain string, allowed FilterDecision) FilterDecision {
+	upstreams := m.dnsFilter.UpstreamsFor(domain)
+	if len(upstreams) == 0 {
+		return allowed
+	}
+	
+	destination := net.JoinHostPort(packet.DestIP.String(), strconv.Itoa(packet.DestPort))
+	for _, upstream := range upstreams {
+		if addr, ok := plainResolverAddr(upstream); ok && addr == destination {
+			return allowed
+		}
+	}
+	
+	target, ok := plainResolverAddr(upstreams[0])
+	if !ok {
+		return allowed
+	}
+	return FilterDecision{
+		Action: "redirect",
+		Reason: fmt.Sprintf("Domain %s is resolved by %s", domain, upstreams[0]),
+		Target: target,
+		Logged: allowed.Logged,
+	}
+}
+
+// Address of a plain DNS resolver as host:port, defaulting to port 53. Reports
+// false for anything that is not an IP, such as a DoH URL.
+func plainResolverAddr(resolver string) (string, bool) {
+	host, port, err := net.SplitHostPort(resolver)
+	if err != nil {
+		host, port = resolver, "53"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	return net.JoinHostPort(ip.String(), port), true
+}
+
+// Remember a blocked name so retries skip the blocklist and CNAME lookups
+func (d *DNSFilterEngine) cacheBlocked(domain string) {
+	d.dnsCache.Set(&DNSResponse{
+		Domain:  domain,
+		Blocked: true,
+		Source:  "blocked",
+		RCode:   "NXDOMAIN",
+	})
+}
+
+// Filter an upstream answer before it is returned to the client, caching the result.
+// NXDOMAIN answers are cached too, so a client retrying a dead name does not reach
+// upstream again until the negative TTL runs out.
+func (m *SystemWideFilteringManager) FilterDNSResponse(response *DNSResponse) *DNSResponse {
+	filtered := m.filterRebinding(response)
+	if filtered != nil && m.dnsFilter != nil {
+		m.dnsFilter.dnsCache.Set(filtered)
+	}
+	return filtered
+}
+
+// With rebinding protection enabled, answers pointing a public name at private,
+// loopback or link-local addresses are turned into NXDOMAIN, or have those records
+// stripped
+func (m *SystemWideFilteringManager) filterRebinding(response *DNSResponse) *DNSResponse {
+	if !m.config.DNSRebindingProtection || response == nil || response.Blocked {
+		return response
+	}
+	
+	domain := strings.ToLower(strings.TrimSuffix(response.Domain, "."))
+	if domainInList(domain, m.config.DNSRebindingAllowlist) {
+		return response
+	}
+	
+	var public []net.IP
+	for _, ip := range response.IPs {
+		if !isRebindingAddress(ip) {
+			public = append(public, ip)
+		}
+	}
+	if len(public) == len(response.IPs) {
+		return response
+	}
+	
+	atomic.AddInt64(&m.metrics.DNSRebindingBlocked, 1)
+	m.logger.Printf("Blocked DNS rebinding answer for %s: %v", domain, response.IPs)
+	
+	if m.config.DNSRebindingAction == "strip" && len(public) > 0 {
+		filtered := *response
+		filtered.IPs = public
+		return &filtered
+	}
+	
+	return &DNSResponse{
+		Domain:  response.Domain,
+		Type:    response.Type,
+		TTL:     response.TTL,
+		Blocked: true,
+		Source:  "blocked",
+		RCode:   "NXDOMAIN",
+	}
+}
+
+// Report whether ip is in a range a public name should never resolve to
+func isRebindingAddress(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+	
+	privateRanges := []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"100.64.0.0/10",
+		"fc00::/7",
+	}
+	
+	for _, cidr := range privateRanges {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	
+	return false
+}
+
+// Report whether domain or one of its parent domains is in the list
+func domainInList(domain string, list []string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+		if domain == entry || strings.HasSuffix(domain, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolvers to forward a query for domain to. The conditional forwarder with the
+// longest matching suffix wins; otherwise the global upstream servers are used.
+func (d *DNSFilterEngine) UpstreamsFor(domain string) []string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	
+	// Try the whole name first, then drop one label at a time
+	for suffix := domain; suffix != ""; {
+		if resolver, exists := d.conditionalForwarders[suffix]; exists {
+			return []string{resolver}
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 {
+			break
+		}
+		suffix = suffix[dot+1:]
+	}
+	return d.upstreamServers
+}
+
+// Install or replace a blocklist. Cached blocked answers are dropped, since they
+// were decided against the old lists.
+func (d *DNSFilterEngine) SetBlocklist(blocklist *Blocklist) {
+	d.blocklists[blocklist.Name] = blocklist
+	d.dnsCache.FlushBlocked()
+}
+
+// Remove a blocklist, dropping the blocked answers it may have produced
+func (d *DNSFilterEngine) RemoveBlocklist(name string) {
+	delete(d.blocklists, name)
+	d.dnsCache.FlushBlocked()
+}
+
+// Install or replace a whitelist, dropping cached blocked answers for names it may
+// now allow
+func (d *DNSFilterEngine) SetWhitelist(whitelist *Whitelist) {
+	d.whitelists[whitelist.Name] = whitelist
+	d.dnsCache.FlushBlocked()
+}
+
+// Check domain against the enabled blocklists, returning why it is blocked
+func (d *DNSFilterEngine) matchBlocklists(domain string) (string, bool) {
+	for _, blocklist := range d.blocklists {
+		if !blocklist.Enabled {
+			continue
+		}
+		
+		// Direct domain match
+		if blocklist.Contains(domain) {
+			return fmt.Sprintf("Domain %s is blocked by %s", domain, blocklist.Name), true
+		}
+		
+		// Pattern matching
+		for _, pattern := range blocklist.Patterns {
+			if pattern.MatchString(domain) {
+				return fmt.Sprintf("Domain %s matches blocked pattern", domain), true
+			}
+		}
+	}
+	return "", false
+}
+
+// Follow the CNAME chain of domain and return its targets in order. Chains are
+// cached so repeated queries for the same name cost no extra lookups.
+func (d *DNSFilterEngine) resolveCNAMEChain(domain string) []string {
+	if d.cnameCache != nil {
+		if chain, ok := d.cnameCache.Get(domain); ok {
+			return chain
+		}
+	}
+	
+	maxDepth := d.config.CNAMEMaxDepth
+	if maxDepth <= 0 {
+		maxDepth = 8
+	}
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	
+	var chain []string
+	seen := map[string]bool{domain: true}
+	current := domain
+	for len(chain) < maxDepth {
+		target, err := d.cnameResolver.LookupCNAME(ctx, current)
+		if err != nil {
+			break
+		}
+		
+		// The resolver returns the name itself once there are no more aliases
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		if target == "" || seen[target] {
+			break
+		}
+		seen[target] = true
+		chain = append(chain, target)
+		current = target
+	}
+	
+	if d.cnameCache != nil {
+		d.cnameCache.Set(domain, chain)
+	}
+	return chain
+}
+
+// Return the cached chain for domain if it has not expired
+func (c *CNAMECache) Get(domain string) ([]string, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	
+	entry, exists := c.entries[domain]
+	if !exists || time.Now().After(entry.Expires) {
+		return nil, false
+	}
+	return entry.Chain, true
+}
+
+// Cached answer for domain and query type. A negative answer covers every type of
+// the name, as NXDOMAIN means the name does not exist at all.
+func (c *DNSCache) Get(domain, qtype string) (*DNSResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	now := time.Now()
+	for _, key := range []string{dnsCacheKey(domain, ""), dnsCacheKey(domain, qtype)} {
+		entry, exists := c.entries[key]
+		if !exists {
+			continue
+		}
+		if now.Sub(entry.Timestamp) > entry.TTL {
+			delete(c.entries, key)
+			continue
+		}
+		entry.HitCount++
+		
+		cached := *entry.Response
+		cached.Source = "cache"
+		return &cached, true
+	}
+	return nil, false
+}
+
+// Store an answer. Positive answers live for their record TTL, negative ones for
+// the SOA minimum when known, else the configured negative TTL, both capped at
+// the cache TTL.
+func (c *DNSCache) Set(response *DNSResponse) {
+	ttl := time.Duration(response.TTL) * time.Second
+	key := dnsCacheKey(response.Domain, response.Type)
+	if response.Blocked || response.RCode == "NXDOMAIN" {
+		ttl = c.negativeTTL
+		if response.SOAMinimum > 0 {
+			ttl = time.Duration(response.SOAMinimum) * time.Second
+		}
+		key = dnsCacheKey(response.Domain, "")
+	}
+	if c.ttl > 0 && ttl > c.ttl {
+		ttl = c.ttl
+	}
+	if ttl <= 0 {
+		return
+	}
+	
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	now := time.Now()
+	if c.maxSize > 0 && len(c.entries) >= c.maxSize {
+		for key, entry := range c.entries {
+			if now.Sub(entry.Timestamp) > entry.TTL {
+				delete(c.entries, key)
+			}
+		}
+		// Still full: drop an arbitrary entry
+		for key := range c.entries {
+			if len(c.entries) < c.maxSize {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	
+	// The name resolves again: drop a negative entry that would shadow the answer
+	if negative := dnsCacheKey(response.Domain, ""); key != negative {
+		delete(c.entries, negative)
+	}
+	c.entries[key] = &DNSCacheEntry{Response: response, Timestamp: now, TTL: ttl}
+}
+
+// Drop every blocked answer, keeping upstream answers including NXDOMAIN
+func (c *DNSCache) FlushBlocked() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	for key, entry := range c.entries {
+		if entry.Response.Blocked {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Cache key for a name and query type; negative entries use an empty type
+func dnsCacheKey(domain, qtype string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".") + "/" + strings.ToUpper(qtype)
+}
+
+// Store the chain for domain, evicting expired entries when the cache is full
+func (c *CNAMECache) Set(domain string, chain []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	now := time.Now()
+	if c.maxSize > 0 && len(c.entries) >= c.maxSize {
+		for key, entry := range c.entries {
+			if now.After(entry.Expires) {
+				delete(c.entries, key)
+			}
+		}
+		// Still full: drop an arbitrary entry
+		for key := range c.entries {
+			if len(c.entries) < c.maxSize {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	
+	c.entries[domain] = &CNAMECacheEntry{Chain: chain, Expires: now.Add(c.ttl)}
 }
 
 // Process filter check
@@ -1244,7 +2373,9 @@ func (m *SystemWideFilteringManager) processFilterCheck(packet *NetworkPacket) F
 	}
 	
 	// Get process info
+	m.processFilter.mutex.RLock()
 	processInfo, exists := m.processFilter.processInfo[packet.ProcessID]
+	m.processFilter.mutex.RUnlock()
 	if !exists {
 		// Process not in cache, try to get info
 		var err error
@@ -1252,7 +2383,9 @@ func (m *SystemWideFilteringManager) processFilterCheck(packet *NetworkPacket) F
 		if err != nil {
 			return FilterDecision{Action: "allow"} // Allow if we can't get process info
 		}
+		m.processFilter.mutex.Lock()
 		m.processFilter.processInfo[packet.ProcessID] = processInfo
+		m.processFilter.mutex.Unlock()
 	}
 	
 	// Check process rules
@@ -1296,12 +2429,132 @@ func (m *SystemWideFilteringManager) processFilterCheck(packet *NetworkPacket) F
 					}
 				}
 			}
+			
+			// Check the data quota
+			if rule.QuotaBytes > 0 && !m.processFilter.chargeQuota(rule, processInfo.Name, len(packet.Data), time.Now()) {
+				return FilterDecision{
+					Action: "block",
+					Reason: fmt.Sprintf("Process %s exceeded its data quota of %d bytes", processInfo.Name, rule.QuotaBytes),
+					Logged: true,
+				}
+			}
 		}
 	}
 	
+	m.processFilter.recordTraffic(processInfo, packet)
 	return FilterDecision{Action: "allow"}
 }
 
+// Add an allowed packet to the per-PID and per-name byte counters
+func (p *ProcessFilterManager) recordTraffic(info *ProcessInfo, packet *NetworkPacket) {
+	size := int64(len(packet.Data))
+	
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	
+	if packet.Direction == "inbound" {
+		info.BytesReceived += size
+	} else {
+		info.BytesSent += size
+	}
+	p.processBytes[info.Name] += size
+}
+
+// Total bytes seen for a process name
+func (p *ProcessFilterManager) ProcessBytes(name string) int64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.processBytes[name]
+}
+
+// Cache a process reported by the scanner
+func (p *ProcessFilterManager) OnProcessStart(info *ProcessInfo) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.processInfo[info.PID] = info
+}
+
+func (p *ProcessFilterManager) OnProcessStop(pid int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.processInfo, pid)
+}
+
+// Attach a connection seen by the scanner to its process, so packets on it are
+// matched from the cache instead of querying the process per packet
+func (p *ProcessFilterManager) OnNetworkActivity(pid int, connection *NetworkConnection) {
+	p.mutex.RLock()
+	_, exists := p.processInfo[pid]
+	p.mutex.RUnlock()
+	if !exists {
+		info, err := p.processMonitor.scanner.GetProcessInfo(pid)
+		if err != nil {
+			return
+		}
+		p.mutex.Lock()
+		if _, exists := p.processInfo[pid]; !exists {
+			p.processInfo[pid] = info
+		}
+		p.mutex.Unlock()
+	}
+	
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	
+	info := p.processInfo[pid]
+	connection.ProcessName = info.Name
+	for i, existing := range info.Connections {
+		if existing.Protocol == connection.Protocol && existing.LocalPort == connection.LocalPort &&
+			existing.LocalIP.Equal(connection.LocalIP) {
+			info.Connections[i] = connection
+			return
+		}
+	}
+	info.Connections = append(info.Connections, connection)
+}
+
+// Charge n bytes to rule's quota for the named process, starting a fresh budget
+// each period. Once a packet would overrun the budget the process stays blocked
+// until the next period, and nothing is charged.
+func (p *ProcessFilterManager) chargeQuota(rule *ProcessRule, name string, n int, now time.Time) bool {
+	key := rule.ProcessName + "\x00" + rule.ProcessPath + "\x00" + name
+	periodStart := quotaPeriodStart(rule.QuotaPeriod, now)
+	
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	
+	usage, exists := p.quotaUsage[key]
+	if !exists || usage.PeriodStart.Before(periodStart) {
+		usage = &QuotaUsage{PeriodStart: periodStart}
+		p.quotaUsage[key] = usage
+	}
+	
+	if usage.Exceeded || usage.Bytes+int64(n) > rule.QuotaBytes {
+		usage.Exceeded = true
+		return false
+	}
+	usage.Bytes += int64(n)
+	return true
+}
+
+// Start of the quota period containing now, in local time. Weeks start on Monday.
+func quotaPeriodStart(period string, now time.Time) time.Time {
+	year, month, day := now.Date()
+	loc := now.Location()
+	
+	switch period {
+	case "hourly":
+		return time.Date(year, month, day, now.Hour(), 0, 0, 0, loc)
+	case "weekly":
+		sinceMonday := (int(now.Weekday()) + 6) % 7
+		return time.Date(year, month, day-sinceMonday, 0, 0, 0, 0, loc)
+	case "monthly":
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	}
+}
+
 // Process content filter
 func (m *SystemWideFilteringManager) processContentFilter(packet *NetworkPacket) FilterDecision {
 	if !m.config.EnableContentFiltering || m.contentFilter == nil {
@@ -1324,8 +2577,9 @@ func (m *SystemWideFilteringManager) processContentFilter(packet *NetworkPacket)
 	}
 	
 	// Check category filters
+	now := time.Now()
 	for _, categoryFilter := range m.contentFilter.categoryFilters {
-		if !categoryFilter.Enabled {
+		if !categoryFilter.Enabled || !categoryFilter.Schedule.IsActive(now) {
 			continue
 		}
 		
@@ -1356,7 +2610,7 @@ func (m *SystemWideFilteringManager) processContentFilter(packet *NetworkPacket)
 	if len(packet.Data) > 0 {
 		scanResult := m.scanContent(packet.Data)
 		if scanResult.Detected {
-			m.metrics.ThreatsDetected++
+			atomic.AddInt64(&m.metrics.ThreatsDetected, 1)
 			return FilterDecision{
 				Action: "block",
 				Reason: fmt.Sprintf("Content threat detected: %v", scanResult.Threats),
@@ -1377,6 +2631,21 @@ func (m *SystemWideFilteringManager) scanContent(content []byte) ScanResult {
 		Confidence: 0.0,
 	}
 	
+	// Match all loaded signatures in a single pass
+	if matches := m.contentFilter.signatureMatcher.Match(content); len(matches) > 0 {
+		result.Detected = true
+		result.Confidence = 1.0
+		result.Details = map[string]interface{}{"signatures": matches}
+		for _, match := range matches {
+			result.Threats = append(result.Threats, match.Name)
+			if match.Severity > result.Severity {
+				result.Severity = match.Severity
+			}
+		}
+		
+		m.logger.Printf("Signatures matched: %v", result.Threats)
+	}
+	
 	// Run all content scanners
 	for scannerType, scanner := range m.contentFilter.contentScanner.scanners {
 		scanResult := scanner.ScanContent(content)
@@ -1394,36 +2663,483 @@ func (m *SystemWideFilteringManager) scanContent(content []byte) ScanResult {
 		}
 	}
 	
-	m.metrics.ContentScansPerformed++
+	atomic.AddInt64(&m.metrics.ContentScansPerformed, 1)
 	return result
 }
 
-// Helper functions and implementations continue...
-// (Due to length constraints, many helper functions, interface implementations, 
-// and platform-specific code are simplified or omitted)
-
-// Utility functions
-func (m *SystemWideFilteringManager) updateProcessingTime(duration time.Duration) {
-	if m.metrics.AvgProcessingTime == 0 {
-		m.metrics.AvgProcessingTime = duration
-	} else {
-		m.metrics.AvgProcessingTime = (m.metrics.AvgProcessingTime + duration) / 2
+// Add a content signature to the scanner and the signature automaton
+func (c *ContentFilterEngine) AddContentSignature(sig ContentSignature) error {
+	if sig.Pattern == "" {
+		return fmt.Errorf("content signature %s has an empty pattern", sig.Name)
 	}
+	
+	c.contentScanner.signatures[sig.Name] = sig
+	c.signatureMatcher.Add(sig.Name, sig.Type, sig.Severity, []byte(sig.Pattern))
+	return nil
+}
+
+// Add a malware signature to the detector and the signature automaton
+func (c *ContentFilterEngine) AddMalwareSignature(sig *MalwareSignature) error {
+	if sig.Pattern == "" {
+		return fmt.Errorf("malware signature %s has an empty pattern", sig.Name)
+	}
+	
+	c.malwareDetector.signatures[sig.Name] = sig
+	c.signatureMatcher.Add(sig.Name, sig.Type, sig.Severity, []byte(sig.Pattern))
+	return nil
+}
+
+// Aho-Corasick automaton matching many signatures in one pass over the content.
+// Patterns are inserted into the trie as they are added; failure links are
+// recomputed lazily before the next match.
+type SignatureMatcher struct {
+	nodes    []signatureNode
+	entries  []signatureEntry
+	built    bool
+	mutex    sync.RWMutex
+}
+
+type signatureNode struct {
+	next    map[byte]int
+	fail    int
+	terms   []int // entries ending exactly at this node
+	outputs []int // terms plus those reachable through failure links
+}
+
+type signatureEntry struct {
+	match  SignatureMatch
+	length int
+}
+
+type SignatureMatch struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Severity int    `json:"severity"`
+	Offset   int    `json:"offset"` // offset of the first occurrence
+}
+
+func NewSignatureMatcher() *SignatureMatcher {
+	return &SignatureMatcher{
+		nodes: []signatureNode{{next: make(map[byte]int)}},
+		built: true,
+	}
+}
+
+// Insert a pattern into the trie
+func (s *SignatureMatcher) Add(name, sigType string, severity int, pattern []byte) {
+	if len(pattern) == 0 {
+		return
+	}
+	
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	node := 0
+	for _, b := range pattern {
+		child, exists := s.nodes[node].next[b]
+		if !exists {
+			child = len(s.nodes)
+			s.nodes = append(s.nodes, signatureNode{next: make(map[byte]int)})
+			s.nodes[node].next[b] = child
+		}
+		node = child
+	}
+	
+	s.entries = append(s.entries, signatureEntry{
+		match:  SignatureMatch{Name: name, Type: sigType, Severity: severity},
+		length: len(pattern),
+	})
+	s.nodes[node].terms = append(s.nodes[node].terms, len(s.entries)-1)
+	s.built = false
+}
+
+// Number of loaded signatures
+func (s *SignatureMatcher) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.entries)
+}
+
+// Compute failure links and merged outputs breadth-first. Caller must hold the write lock.
+func (s *SignatureMatcher) build() {
+	s.nodes[0].fail = 0
+	s.nodes[0].outputs = s.nodes[0].terms
+	
+	queue := make([]int, 0, len(s.nodes))
+	for _, child := range s.nodes[0].next {
+		s.nodes[child].fail = 0
+		queue = append(queue, child)
+	}
+	
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		
+		fail := s.nodes[node].fail
+		s.nodes[node].outputs = append(append([]int{}, s.nodes[node].terms...), s.nodes[fail].outputs...)
+		
+		for b, child := range s.nodes[node].next {
+			f := fail
+			for {
+				if next, exists := s.nodes[f].next[b]; exists {
+					s.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					s.nodes[child].fail = 0
+					break
+				}
+				f = s.nodes[f].fail
+			}
+			queue = append(queue, child)
+		}
+	}
+	
+	s.built = true
+}
+
+// Return every signature found in content, each reported once at its first occurrence
+func (s *SignatureMatcher) Match(content []byte) []SignatureMatch {
+	s.mutex.RLock()
+	if !s.built {
+		s.mutex.RUnlock()
+		s.mutex.Lock()
+		if !s.built {
+			s.build()
+		}
+		s.mutex.Unlock()
+		s.mutex.RLock()
+	}
+	defer s.mutex.RUnlock()
+	
+	if len(s.entries) == 0 {
+		return nil
+	}
+	
+	var matches []SignatureMatch
+	seen := make(map[int]bool)
+	node := 0
+	for i, b := range content {
+		for {
+			if next, exists := s.nodes[node].next[b]; exists {
+				node = next
+				break
+			}
+			if node == 0 {
+				break
+			}
+			node = s.nodes[node].fail
+		}
+		
+		for _, idx := range s.nodes[node].outputs {
+			if seen[idx] {
+				continue
+			}
+			seen[idx] = true
+			
+			match := s.entries[idx].match
+			match.Offset = i + 1 - s.entries[idx].length
+			matches = append(matches, match)
+		}
+	}
+	
+	return matches
+}
+
+// Helper functions and implementations continue...
+// (Due to length constraints, many helper functions, interface implementations, 
+// and platform-specific code are simplified or omitted)
+
+// Utility functions
+func (m *SystemWideFilteringManager) updateProcessingTime(duration time.Duration) {
+	atomic.AddInt64(&m.metrics.processingTimeTotal, int64(duration))
+	atomic.AddInt64(&m.metrics.processingSamples, 1)
+}
+
+// Get a consistent snapshot of the filtering metrics
+func (m *SystemWideFilteringManager) GetMetrics() SystemFilteringMetrics {
+	metrics := m.metrics
+	snapshot := SystemFilteringMetrics{
+		NetworkPacketsProcessed: atomic.LoadInt64(&metrics.NetworkPacketsProcessed),
+		NetworkPacketsBlocked:   atomic.LoadInt64(&metrics.NetworkPacketsBlocked),
+		DNSQueriesProcessed:     atomic.LoadInt64(&metrics.DNSQueriesProcessed),
+		DNSQueriesBlocked:       atomic.LoadInt64(&metrics.DNSQueriesBlocked),
+		DNSRebindingBlocked:     atomic.LoadInt64(&metrics.DNSRebindingBlocked),
+		ProcessesMonitored:      atomic.LoadInt64(&metrics.ProcessesMonitored),
+		ProcessesBlocked:        atomic.LoadInt64(&metrics.ProcessesBlocked),
+		ContentScansPerformed:   atomic.LoadInt64(&metrics.ContentScansPerformed),
+		ThreatsDetected:         atomic.LoadInt64(&metrics.ThreatsDetected),
+		FirewallRulesActive:     atomic.LoadInt64(&metrics.FirewallRulesActive),
+		FilteringRulesActive:    atomic.LoadInt64(&metrics.FilteringRulesActive),
+		SystemResourceUsage:     metrics.SystemResourceUsage,
+	}
+	
+	total := atomic.LoadInt64(&metrics.processingTimeTotal)
+	samples := atomic.LoadInt64(&metrics.processingSamples)
+	if samples > 0 {
+		snapshot.AvgProcessingTime = time.Duration(total / samples)
+	}
+	return snapshot
 }
 
 func (m *SystemWideFilteringManager) ruleMatches(rule *FilteringRule, packet *NetworkPacket) bool {
-	// Simplified rule matching implementation
+	// All conditions must hold; unknown fields or operators never match
+	for _, condition := range rule.Conditions {
+		extractor, exists := m.ruleEngine.matcher.fieldExtractors[condition.Field]
+		if !exists {
+			return false
+		}
+		
+		operator, exists := m.ruleEngine.evaluator.operators[condition.Operator]
+		if !exists {
+			return false
+		}
+		
+		if condition.Operator == "matches" {
+			if err := m.ruleEngine.matcher.compilePattern(fmt.Sprintf("%v", condition.Value)); err != nil {
+				m.logger.Printf("Invalid pattern in rule %s: %v", rule.ID, err)
+				return false
+			}
+		}
+		
+		// A nil value means the field is unknown, which never matches even when negated
+		fieldValue := extractor.ExtractField(packet, condition.Field)
+		if fieldValue == nil {
+			return false
+		}
+		if operator(fieldValue, condition.Value) == condition.Negate {
+			return false
+		}
+	}
 	return true
 }
 
+// Convert a field/condition pair to numbers for the comparison operators
+func toNumericPair(field, value interface{}) (float64, float64, bool) {
+	a, ok := toNumber(field)
+	if !ok {
+		return 0, 0, false
+	}
+	b, ok := toNumber(value)
+	if !ok {
+		return 0, 0, false
+	}
+	return a, b, true
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, false
+		}
+		return f, true
+	default:
+		return 0, false
+	}
+}
+
+// Expand a condition value into the members used by the in operator
+func toValueList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	case []int:
+		list := make([]interface{}, len(v))
+		for i, n := range v {
+			list[i] = n
+		}
+		return list
+	case string:
+		var list []interface{}
+		for _, s := range strings.Split(v, ",") {
+			list = append(list, strings.TrimSpace(s))
+		}
+		return list
+	default:
+		return []interface{}{v}
+	}
+}
+
+// Compile and cache a regular expression used by the matches operator
+func (rm *RuleMatcher) compilePattern(pattern string) error {
+	rm.mutex.RLock()
+	_, exists := rm.compiledPatterns[pattern]
+	rm.mutex.RUnlock()
+	if exists {
+		return nil
+	}
+	
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	
+	rm.mutex.Lock()
+	rm.compiledPatterns[pattern] = compiled
+	rm.mutex.Unlock()
+	return nil
+}
+
 func (m *SystemWideFilteringManager) extractDomainFromDNSPacket(packet *NetworkPacket) string {
 	// Simplified DNS domain extraction
 	return "example.com"
 }
 
 func (m *SystemWideFilteringManager) extractURLFromHTTPPacket(packet *NetworkPacket) string {
-	// Simplified HTTP URL extraction
-	return "http://example.com"
+	// TLS handshake record: use the SNI from the ClientHello
+	if len(packet.Data) > 0 && packet.Data[0] == 0x16 {
+		if serverName := parseTLSServerName(packet.Data); serverName != "" {
+			return "https://" + serverName
+		}
+		return ""
+	}
+	
+	return parseHTTPRequestURL(packet.Data)
+}
+
+// Extract the server_name extension from a TLS ClientHello record.
+// Returns empty for anything malformed or truncated.
+func parseTLSServerName(data []byte) string {
+	// Record header: type(1) version(2) length(2)
+	if len(data) < 5 || data[0] != 0x16 {
+		return ""
+	}
+	data = data[5:]
+	
+	// Handshake header: type(1) length(3)
+	if len(data) < 4 || data[0] != 0x01 {
+		return ""
+	}
+	data = data[4:]
+	
+	// client_version(2) random(32)
+	if len(data) < 34 {
+		return ""
+	}
+	data = data[34:]
+	
+	// session_id, cipher_suites, compression_methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		if len(data) < lenBytes {
+			return ""
+		}
+		length := 0
+		for i := 0; i < lenBytes; i++ {
+			length = length<<8 | int(data[i])
+		}
+		data = data[lenBytes:]
+		if len(data) < length {
+			return ""
+		}
+		data = data[length:]
+	}
+	
+	// extensions
+	if len(data) < 2 {
+		return ""
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < extensionsLen {
+		return ""
+	}
+	data = data[:extensionsLen]
+	
+	for len(data) >= 4 {
+		extType := binary.BigEndian.Uint16(data)
+		extLen := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < extLen {
+			return ""
+		}
+		if extType != 0x0000 {
+			data = data[extLen:]
+			continue
+		}
+		
+		// server_name_list: length(2) then entries of type(1) length(2) name
+		ext := data[:extLen]
+		if len(ext) < 2 {
+			return ""
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			nameLen := int(binary.BigEndian.Uint16(ext[1:]))
+			ext = ext[3:]
+			if len(ext) < nameLen {
+				return ""
+			}
+			if nameType == 0 {
+				return strings.ToLower(string(ext[:nameLen]))
+			}
+			ext = ext[nameLen:]
+		}
+		return ""
+	}
+	return ""
+}
+
+// Build a URL from a plaintext HTTP request line and Host header
+func parseHTTPRequestURL(data []byte) string {
+	headerEnd := strings.Index(string(data), "\r\n\r\n")
+	if headerEnd == -1 {
+		// Headers may be fragmented; work with what we have
+		headerEnd = len(data)
+	}
+	lines := strings.Split(string(data[:headerEnd]), "\r\n")
+	
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) != 3 || !strings.HasPrefix(requestLine[2], "HTTP/") {
+		return ""
+	}
+	target := requestLine[1]
+	
+	// Absolute-form request target (proxy requests)
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return target
+	}
+	
+	host := ""
+	for _, line := range lines[1:] {
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(line[:colon]), "Host") {
+			host = strings.TrimSpace(line[colon+1:])
+			break
+		}
+	}
+	if host == "" || !strings.HasPrefix(target, "/") {
+		return ""
+	}
+	
+	return "http://" + strings.ToLower(host) + target
 }
 
 func (m *SystemWideFilteringManager) loadTrafficSignatures() {
@@ -1432,12 +3148,101 @@ func (m *SystemWideFilteringManager) loadTrafficSignatures() {
 
 func (m *SystemWideFilteringManager) loadBlocklist(source string) (*Blocklist, error) {
 	// Load blocklist from source
-	return &Blocklist{
+	blocklist := &Blocklist{
 		Name:    "example",
 		Source:  source,
 		Domains: make(map[string]bool),
 		Enabled: true,
-	}, nil
+	}
+	blocklist.BuildFilter(0.01)
+	return blocklist, nil
+}
+
+// Add a domain to the blocklist, keeping the Bloom filter in sync
+func (b *Blocklist) AddDomain(domain string) {
+	if !b.Domains[domain] {
+		b.Domains[domain] = true
+		if b.filter != nil {
+			b.filter.Add(domain)
+			b.filtered++
+		}
+	}
+}
+
+// Rebuild the Bloom filter from Domains for the given false positive rate
+func (b *Blocklist) BuildFilter(falsePositiveRate float64) {
+	b.filter = NewBloomFilter(len(b.Domains), falsePositiveRate)
+	for domain := range b.Domains {
+		b.filter.Add(domain)
+	}
+	b.filtered = len(b.Domains)
+}
+
+// Check whether domain is blocked. The Bloom filter rules out most misses and
+// possible hits are confirmed against the domain map. The filter is bypassed
+// if Domains was modified directly since it was built.
+func (b *Blocklist) Contains(domain string) bool {
+	if b.filter != nil && b.filtered == len(b.Domains) && !b.filter.MayContain(domain) {
+		return false
+	}
+	return b.Domains[domain]
+}
+
+// Create a Bloom filter sized for expected items at the given false positive rate
+func NewBloomFilter(expected int, falsePositiveRate float64) *BloomFilter {
+	if expected < 1 {
+		expected = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+	
+	// m = -n ln(p) / ln(2)^2, k = m/n ln(2)
+	size := uint64(math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if size < 64 {
+		size = 64
+	}
+	hashes := uint64(math.Round(float64(size) / float64(expected) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	
+	return &BloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+func (f *BloomFilter) Add(item string) {
+	h1, h2 := bloomHashes(item)
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Report whether item may be present; false means it is definitely absent
+func (f *BloomFilter) MayContain(item string) bool {
+	h1, h2 := bloomHashes(item)
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Derive two hashes for double hashing from a single 64-bit FNV-1a hash
+func bloomHashes(item string) (uint64, uint64) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(item))
+	sum := hasher.Sum64()
+	
+	h1 := sum & 0xffffffff
+	h2 := sum>>32 | 1 // odd so successive probes differ
+	return h1, h2
 }
 
 func (m *SystemWideFilteringManager) loadCategoryFilter(category string) (*CategoryFilter, error) {
@@ -1456,6 +3261,66 @@ func (m *SystemWideFilteringManager) loadProcessRules() {
 
 func (m *SystemWideFilteringManager) loadDefaultRules() {
 	// Load default filtering rules
+	if m.config.BlockQUIC {
+		rule := m.quicBlockRule()
+		m.ruleEngine.mutex.Lock()
+		m.ruleEngine.rules[rule.ID] = rule
+		m.ruleEngine.mutex.Unlock()
+	}
+}
+
+// Ports treated as QUIC when BlockQUIC is enabled
+func (m *SystemWideFilteringManager) quicPorts() []int {
+	if len(m.config.QUICPorts) > 0 {
+		return m.config.QUICPorts
+	}
+	return []int{443}
+}
+
+// Rule dropping outbound UDP to the QUIC ports. HTTP/3 would otherwise bypass the
+// TCP proxy entirely; browsers fall back to TCP once their QUIC attempts fail.
+func (m *SystemWideFilteringManager) quicBlockRule() *FilteringRule {
+	now := time.Now()
+	return &FilteringRule{
+		ID:          "block-quic",
+		Name:        "Block QUIC",
+		Description: "Drop outbound UDP to QUIC ports to force TCP fallback",
+		Type:        "network",
+		Conditions: []RuleCondition{
+			{Field: "protocol", Operator: "matches", Value: "(?i)^udp$"},
+			{Field: "dest_port", Operator: "in", Value: m.quicPorts()},
+			{Field: "direction", Operator: "equals", Value: "inbound", Negate: true},
+		},
+		Actions:    []string{"block"},
+		Priority:   1000,
+		Enabled:    true,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Statistics: &RuleStatistics{},
+	}
+}
+
+// Install firewall rules dropping outbound UDP to the QUIC ports. They are
+// recreated on every start, so they are not persisted.
+func (m *SystemWideFilteringManager) installQUICFirewallRules() error {
+	now := time.Now()
+	for _, port := range m.quicPorts() {
+		rule := &FirewallRule{
+			ID:        fmt.Sprintf("block-quic-%d", port),
+			Name:      "Block QUIC",
+			Action:    "block",
+			Direction: "out",
+			Protocol:  "udp",
+			DestPort:  strconv.Itoa(port),
+			Enabled:   true,
+			Temporary: true,
+			CreatedAt: now,
+		}
+		if err := m.firewallIntegration.AddRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *SystemWideFilteringManager) configureDefaultFirewallRules() error {
@@ -1482,6 +3347,661 @@ func (m *SystemWideFilteringManager) runMetricsCollection() {
 // Platform-specific implementations would be in separate files
 // (WindowsFirewallManager, IptablesManager, etc.)
 
+// iptables/ip6tables firewall manager. Rules are tagged with a comment carrying
+// the rule ID so they can be removed precisely without touching foreign rules.
+type IptablesManager struct {
+	iptablesPath  string
+	ip6tablesPath string
+	dryRun        bool
+	runCommand    func(name string, args ...string) ([]byte, error)
+	executed      [][]string
+	rules         map[string]*FirewallRule
+	mutex         sync.Mutex
+}
+
+const iptablesCommentPrefix = "oblivionfilter:"
+
+func NewIptablesManager(dryRun bool) *IptablesManager {
+	return &IptablesManager{
+		iptablesPath:  "iptables",
+		ip6tablesPath: "ip6tables",
+		dryRun:        dryRun,
+		runCommand: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).CombinedOutput()
+		},
+		rules: make(map[string]*FirewallRule),
+	}
+}
+
+// Verify that the iptables binaries are installed
+func (i *IptablesManager) CheckAvailable() error {
+	for _, binary := range []string{i.iptablesPath, i.ip6tablesPath} {
+		if _, err := exec.LookPath(binary); err != nil {
+			return fmt.Errorf("%s not found: %v", binary, err)
+		}
+	}
+	return nil
+}
+
+// Commands issued so far, including those skipped in dry-run mode
+func (i *IptablesManager) ExecutedCommands() [][]string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return append([][]string(nil), i.executed...)
+}
+
+func (i *IptablesManager) AddRule(rule *FirewallRule) error {
+	if rule.ID == "" {
+		return fmt.Errorf("firewall rule has no ID")
+	}
+	
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	
+	if rule.Enabled {
+		for _, binary := range i.binariesForRule(rule) {
+			for _, args := range buildIptablesArgs("-A", rule, binary == i.ip6tablesPath) {
+				if _, err := i.run(binary, args...); err != nil {
+					return fmt.Errorf("failed to add rule %s: %v", rule.ID, err)
+				}
+			}
+		}
+	}
+	
+	i.rules[rule.ID] = rule
+	return nil
+}
+
+func (i *IptablesManager) RemoveRule(ruleID string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	
+	if err := i.deleteTagged(iptablesCommentPrefix + ruleID); err != nil {
+		return fmt.Errorf("failed to remove rule %s: %v", ruleID, err)
+	}
+	delete(i.rules, ruleID)
+	return nil
+}
+
+func (i *IptablesManager) UpdateRule(ruleID string, rule *FirewallRule) error {
+	if err := i.RemoveRule(ruleID); err != nil {
+		return err
+	}
+	return i.AddRule(rule)
+}
+
+func (i *IptablesManager) ListRules() ([]*FirewallRule, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	
+	if i.dryRun {
+		rules := make([]*FirewallRule, 0, len(i.rules))
+		for _, rule := range i.rules {
+			rules = append(rules, rule)
+		}
+		sort.Slice(rules, func(a, b int) bool { return rules[a].ID < rules[b].ID })
+		return rules, nil
+	}
+	
+	lines, err := i.taggedRuleLines()
+	if err != nil {
+		return nil, err
+	}
+	
+	seen := make(map[string]bool)
+	var rules []*FirewallRule
+	for _, line := range lines {
+		rule := parseIptablesRule(line.spec)
+		if rule == nil || seen[rule.ID] {
+			continue
+		}
+		seen[rule.ID] = true
+		if known, exists := i.rules[rule.ID]; exists {
+			rule = known
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (i *IptablesManager) FlushRules() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	
+	if err := i.deleteTagged(iptablesCommentPrefix); err != nil {
+		return fmt.Errorf("failed to flush rules: %v", err)
+	}
+	i.rules = make(map[string]*FirewallRule)
+	return nil
+}
+
+func (i *IptablesManager) GetProvider() string { return "iptables" }
+
+func (i *IptablesManager) run(binary string, args ...string) ([]byte, error) {
+	i.executed = append(i.executed, append([]string{binary}, args...))
+	if i.dryRun {
+		return nil, nil
+	}
+	
+	output, err := i.runCommand(binary, args...)
+	if err != nil {
+		return output, fmt.Errorf("%s %s: %v: %s", binary, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// Pick iptables and/or ip6tables depending on the address family of the rule
+func (i *IptablesManager) binariesForRule(rule *FirewallRule) []string {
+	switch ipFamily(rule.SourceIP, rule.DestIP) {
+	case 4:
+		return []string{i.iptablesPath}
+	case 6:
+		return []string{i.ip6tablesPath}
+	default:
+		return []string{i.iptablesPath, i.ip6tablesPath}
+	}
+}
+
+type iptablesRuleLine struct {
+	binary string
+	spec   string
+}
+
+// List installed rules carrying the OblivionFilter comment tag, in -S format
+func (i *IptablesManager) taggedRuleLines() ([]iptablesRuleLine, error) {
+	var lines []iptablesRuleLine
+	for _, binary := range []string{i.iptablesPath, i.ip6tablesPath} {
+		for _, chain := range []string{"INPUT", "OUTPUT"} {
+			output, err := i.runCommand(binary, "-S", chain)
+			if err != nil {
+				return nil, fmt.Errorf("%s -S %s: %v", binary, chain, err)
+			}
+			for _, line := range strings.Split(string(output), "\n") {
+				if strings.Contains(line, "--comment "+iptablesCommentPrefix) ||
+					strings.Contains(line, "--comment \""+iptablesCommentPrefix) {
+					lines = append(lines, iptablesRuleLine{binary: binary, spec: strings.TrimSpace(line)})
+				}
+			}
+		}
+	}
+	return lines, nil
+}
+
+// Delete every installed rule whose comment tag equals tag, or starts with it when tag is the bare prefix
+func (i *IptablesManager) deleteTagged(tag string) error {
+	if i.dryRun {
+		for id, rule := range i.rules {
+			if tag != iptablesCommentPrefix && iptablesCommentPrefix+id != tag {
+				continue
+			}
+			for _, binary := range i.binariesForRule(rule) {
+				for _, args := range buildIptablesArgs("-D", rule, binary == i.ip6tablesPath) {
+					i.run(binary, args...)
+				}
+			}
+		}
+		return nil
+	}
+	
+	lines, err := i.taggedRuleLines()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line.spec)
+		comment := iptablesRuleComment(fields)
+		if comment != tag && !(tag == iptablesCommentPrefix && strings.HasPrefix(comment, tag)) {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		fields[0] = "-D"
+		if _, err := i.run(line.binary, fields...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Translate a FirewallRule into iptables arguments, one argument list per chain
+func buildIptablesArgs(op string, rule *FirewallRule, ipv6 bool) [][]string {
+	var chains []string
+	switch rule.Direction {
+	case "in":
+		chains = []string{"INPUT"}
+	case "out":
+		chains = []string{"OUTPUT"}
+	default:
+		chains = []string{"INPUT", "OUTPUT"}
+	}
+	
+	target := "DROP"
+	switch rule.Action {
+	case "allow":
+		target = "ACCEPT"
+	case "reject":
+		target = "REJECT"
+	}
+	
+	var argSets [][]string
+	for _, chain := range chains {
+		args := []string{op, chain}
+		
+		protocol := rule.Protocol
+		if protocol == "icmp" && ipv6 {
+			protocol = "ipv6-icmp"
+		}
+		if protocol != "" && protocol != "all" {
+			args = append(args, "-p", protocol)
+		}
+		if rule.SourceIP != "" {
+			args = append(args, "-s", rule.SourceIP)
+		}
+		if rule.DestIP != "" {
+			args = append(args, "-d", rule.DestIP)
+		}
+		if protocol == "tcp" || protocol == "udp" {
+			if rule.SourcePort != "" {
+				args = append(args, "--sport", rule.SourcePort)
+			}
+			if rule.DestPort != "" {
+				args = append(args, "--dport", rule.DestPort)
+			}
+		}
+		
+		args = append(args, "-m", "comment", "--comment", iptablesCommentPrefix+rule.ID, "-j", target)
+		argSets = append(argSets, args)
+	}
+	return argSets
+}
+
+// Reconstruct a FirewallRule from an iptables -S line
+func parseIptablesRule(spec string) *FirewallRule {
+	fields := strings.Fields(spec)
+	comment := iptablesRuleComment(fields)
+	if !strings.HasPrefix(comment, iptablesCommentPrefix) {
+		return nil
+	}
+	
+	rule := &FirewallRule{
+		ID:       strings.TrimPrefix(comment, iptablesCommentPrefix),
+		Protocol: "all",
+		Enabled:  true,
+	}
+	rule.Name = rule.ID
+	
+	for j := 0; j+1 < len(fields); j++ {
+		value := fields[j+1]
+		switch fields[j] {
+		case "-A":
+			switch value {
+			case "INPUT":
+				rule.Direction = "in"
+			case "OUTPUT":
+				rule.Direction = "out"
+			}
+		case "-p":
+			rule.Protocol = value
+			if value == "ipv6-icmp" {
+				rule.Protocol = "icmp"
+			}
+		case "-s":
+			rule.SourceIP = value
+		case "-d":
+			rule.DestIP = value
+		case "--sport":
+			rule.SourcePort = value
+		case "--dport":
+			rule.DestPort = value
+		case "-j":
+			switch value {
+			case "ACCEPT":
+				rule.Action = "allow"
+			case "REJECT":
+				rule.Action = "reject"
+			default:
+				rule.Action = "block"
+			}
+		}
+	}
+	return rule
+}
+
+func iptablesRuleComment(fields []string) string {
+	for j := 0; j+1 < len(fields); j++ {
+		if fields[j] == "--comment" {
+			return strings.Trim(fields[j+1], "\"")
+		}
+	}
+	return ""
+}
+
+// Determine the address family implied by rule addresses: 4, 6, or 0 for any
+func ipFamily(addresses ...string) int {
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+		host := address
+		if slash := strings.Index(host, "/"); slash != -1 {
+			host = host[:slash]
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() != nil {
+				return 4
+			}
+			return 6
+		}
+	}
+	return 0
+}
+
+// Linux process scanner backed by /proc
+type LinuxProcessScanner struct {
+	procRoot        string
+	refreshInterval time.Duration
+	inodeToPID      map[uint64]int
+	lastRefresh     time.Time
+	mutex           sync.Mutex
+}
+
+// Socket entry parsed from /proc/net/{tcp,tcp6,udp,udp6}
+type procSocketEntry struct {
+	connection *NetworkConnection
+	inode      uint64
+}
+
+var procNetTables = []struct {
+	file     string
+	protocol string
+}{
+	{"tcp", "tcp"},
+	{"tcp6", "tcp"},
+	{"udp", "udp"},
+	{"udp6", "udp"},
+}
+
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+func NewLinuxProcessScanner(procRoot string) *LinuxProcessScanner {
+	return &LinuxProcessScanner{
+		procRoot:        procRoot,
+		refreshInterval: 2 * time.Second,
+		inodeToPID:      make(map[uint64]int),
+	}
+}
+
+func (s *LinuxProcessScanner) ScanProcesses() ([]*ProcessInfo, error) {
+	entries, err := os.ReadDir(s.procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", s.procRoot, err)
+	}
+	
+	var processes []*ProcessInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		
+		info, err := s.GetProcessInfo(pid)
+		if err != nil {
+			// Process exited or is not accessible
+			continue
+		}
+		processes = append(processes, info)
+	}
+	return processes, nil
+}
+
+func (s *LinuxProcessScanner) GetProcessInfo(pid int) (*ProcessInfo, error) {
+	pidDir := filepath.Join(s.procRoot, strconv.Itoa(pid))
+	
+	comm, err := os.ReadFile(filepath.Join(pidDir, "comm"))
+	if err != nil {
+		return nil, fmt.Errorf("process %d not found: %v", pid, err)
+	}
+	
+	info := &ProcessInfo{
+		PID:  pid,
+		Name: strings.TrimSpace(string(comm)),
+	}
+	
+	if exe, err := os.Readlink(filepath.Join(pidDir, "exe")); err == nil {
+		info.Path = exe
+	}
+	
+	if cmdline, err := os.ReadFile(filepath.Join(pidDir, "cmdline")); err == nil {
+		info.CommandLine = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	
+	if status, err := os.ReadFile(filepath.Join(pidDir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "Uid:":
+				info.User = fields[1]
+			case "VmRSS:":
+				if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+					info.MemoryUsage = kb * 1024
+				}
+			}
+		}
+	}
+	
+	if connections, err := s.GetProcessConnections(pid); err == nil {
+		info.Connections = connections
+	}
+	
+	return info, nil
+}
+
+func (s *LinuxProcessScanner) GetProcessConnections(pid int) ([]*NetworkConnection, error) {
+	inodes, err := s.socketInodes(pid)
+	if err != nil {
+		return nil, err
+	}
+	if len(inodes) == 0 {
+		return nil, nil
+	}
+	
+	name := ""
+	if comm, err := os.ReadFile(filepath.Join(s.procRoot, strconv.Itoa(pid), "comm")); err == nil {
+		name = strings.TrimSpace(string(comm))
+	}
+	
+	var connections []*NetworkConnection
+	for _, entry := range s.readSocketTables() {
+		if inodes[entry.inode] {
+			entry.connection.ProcessID = pid
+			entry.connection.ProcessName = name
+			connections = append(connections, entry.connection)
+		}
+	}
+	return connections, nil
+}
+
+// Resolve the process owning a local socket address
+func (s *LinuxProcessScanner) FindProcessByConnection(protocol string, localIP net.IP, localPort int) (int, error) {
+	for _, entry := range s.readSocketTables() {
+		conn := entry.connection
+		if conn.Protocol != protocol || conn.LocalPort != localPort {
+			continue
+		}
+		if localIP != nil && !conn.LocalIP.IsUnspecified() && !conn.LocalIP.Equal(localIP) {
+			continue
+		}
+		
+		if pid, exists := s.lookupInode(entry.inode); exists {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no process found for %s %s:%d", protocol, localIP, localPort)
+}
+
+// Look up the owning PID of a socket inode, refreshing the cache when stale or missing
+func (s *LinuxProcessScanner) lookupInode(inode uint64) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if time.Since(s.lastRefresh) > s.refreshInterval {
+		s.refreshInodeCache()
+	}
+	if pid, exists := s.inodeToPID[inode]; exists {
+		return pid, true
+	}
+	
+	// Socket may belong to a process started since the last refresh
+	s.refreshInodeCache()
+	pid, exists := s.inodeToPID[inode]
+	return pid, exists
+}
+
+func (s *LinuxProcessScanner) refreshInodeCache() {
+	inodeToPID := make(map[uint64]int)
+	
+	entries, err := os.ReadDir(s.procRoot)
+	if err == nil {
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			if err != nil {
+				continue
+			}
+			inodes, err := s.socketInodes(pid)
+			if err != nil {
+				continue
+			}
+			for inode := range inodes {
+				inodeToPID[inode] = pid
+			}
+		}
+	}
+	
+	s.inodeToPID = inodeToPID
+	s.lastRefresh = time.Now()
+}
+
+// Collect socket inodes referenced by a process's file descriptors
+func (s *LinuxProcessScanner) socketInodes(pid int) (map[uint64]bool, error) {
+	fdDir := filepath.Join(s.procRoot, strconv.Itoa(pid), "fd")
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	
+	inodes := make(map[uint64]bool)
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+		if err == nil {
+			inodes[inode] = true
+		}
+	}
+	return inodes, nil
+}
+
+func (s *LinuxProcessScanner) readSocketTables() []procSocketEntry {
+	var entries []procSocketEntry
+	for _, table := range procNetTables {
+		file, err := os.Open(filepath.Join(s.procRoot, "net", table.file))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, parseProcNetTable(file, table.protocol)...)
+		file.Close()
+	}
+	return entries
+}
+
+// Parse a /proc/net socket table
+func parseProcNetTable(r io.Reader, protocol string) []procSocketEntry {
+	var entries []procSocketEntry
+	
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		
+		localIP, localPort, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remotePort, err := parseProcNetAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+		
+		state := fields[3]
+		if protocol == "tcp" {
+			if name, exists := tcpStates[state]; exists {
+				state = name
+			}
+		}
+		
+		entries = append(entries, procSocketEntry{
+			connection: &NetworkConnection{
+				LocalIP:    localIP,
+				LocalPort:  localPort,
+				RemoteIP:   remoteIP,
+				RemotePort: remotePort,
+				Protocol:   protocol,
+				State:      state,
+			},
+			inode: inode,
+		})
+	}
+	return entries
+}
+
+// Parse a hex "ADDR:PORT" pair; addresses are stored as host-order 32-bit words
+func parseProcNetAddress(s string) (net.IP, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in %q", s)
+	}
+	
+	ip := make(net.IP, len(raw))
+	for word := 0; word < len(raw); word += 4 {
+		binary.BigEndian.PutUint32(ip[word:], binary.LittleEndian.Uint32(raw[word:]))
+	}
+	return ip, int(port), nil
+}
+
 // Simplified interface implementations for demonstration
 type WFPInterceptor struct{}
 func (w *WFPInterceptor) Start() error { return nil }
@@ -1542,6 +4062,90 @@ func (c *ContentCategoryScanner) ScanContent(content []byte) ScanResult {
 }
 func (c *ContentCategoryScanner) GetType() string { return "content" }
 
+// GeoIP country resolution backed by a MaxMind database
+type GeoIPFilter struct {
+	reader *maxminddb.Reader
+	logger *log.Logger
+	mutex  sync.RWMutex
+}
+
+type geoIPCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func NewGeoIPFilter(dbPath string, logger *log.Logger) *GeoIPFilter {
+	g := &GeoIPFilter{logger: logger}
+	if dbPath == "" {
+		return g
+	}
+	
+	if err := g.Load(dbPath); err != nil {
+		logger.Printf("Warning: GeoIP database unavailable, country rules will not match: %v", err)
+	}
+	return g
+}
+
+// Open a database, replacing any previously loaded one
+func (g *GeoIPFilter) Load(dbPath string) error {
+	reader, err := maxminddb.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	
+	g.mutex.Lock()
+	old := g.reader
+	g.reader = reader
+	g.mutex.Unlock()
+	
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Resolve an IP to its ISO 3166-1 alpha-2 country code
+func (g *GeoIPFilter) LookupCountry(ip net.IP) (string, error) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	
+	if g.reader == nil {
+		return "", fmt.Errorf("no GeoIP database loaded")
+	}
+	if ip == nil {
+		return "", fmt.Errorf("no IP address")
+	}
+	
+	var record geoIPCountryRecord
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode, nil
+	}
+	if record.RegisteredCountry.ISOCode != "" {
+		return record.RegisteredCountry.ISOCode, nil
+	}
+	return "", fmt.Errorf("no country for %s", ip)
+}
+
+func (g *GeoIPFilter) Close() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	
+	if g.reader == nil {
+		return nil
+	}
+	err := g.reader.Close()
+	g.reader = nil
+	return err
+}
+
 // Field extractors
 type SourceIPExtractor struct{}
 func (s *SourceIPExtractor) ExtractField(packet *NetworkPacket, field string) interface{} {
@@ -1563,6 +4167,35 @@ func (p *ProcessNameExtractor) ExtractField(packet *NetworkPacket, field string)
 	return packet.ProcessName
 }
 
+type SourcePortExtractor struct{}
+func (s *SourcePortExtractor) ExtractField(packet *NetworkPacket, field string) interface{} {
+	return packet.SourcePort
+}
+
+type DestPortExtractor struct{}
+func (d *DestPortExtractor) ExtractField(packet *NetworkPacket, field string) interface{} {
+	return packet.DestPort
+}
+
+type DirectionExtractor struct{}
+func (d *DirectionExtractor) ExtractField(packet *NetworkPacket, field string) interface{} {
+	return packet.Direction
+}
+
+type DestCountryExtractor struct {
+	geoIP *GeoIPFilter
+}
+func (d *DestCountryExtractor) ExtractField(packet *NetworkPacket, field string) interface{} {
+	if d.geoIP == nil {
+		return nil
+	}
+	country, err := d.geoIP.LookupCountry(packet.DestIP)
+	if err != nil {
+		return nil
+	}
+	return country
+}
+
 // Rule actions
 type BlockAction struct{}
 func (b *BlockAction) Execute(packet *NetworkPacket, rule *FilteringRule) error {
@@ -0,0 +1,2234 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestFilteringManager creates a manager with every optional component disabled
+// and its logging discarded
+func newTestFilteringManager(t *testing.T, config *SystemFilteringConfig) *SystemWideFilteringManager {
+	t.Helper()
+	if config == nil {
+		config = &SystemFilteringConfig{}
+	}
+	m, err := NewSystemWideFilteringManager(config)
+	if err != nil {
+		t.Fatalf("NewSystemWideFilteringManager: %v", err)
+	}
+	m.logger = log.New(io.Discard, "", 0)
+	return m
+}
+
+func TestRuleMatches(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+
+	packet := &NetworkPacket{
+		Protocol:   "tcp",
+		SourceIP:   net.ParseIP("192.168.1.10"),
+		DestIP:     net.ParseIP("203.0.113.5"),
+		SourcePort: 51000,
+		DestPort:   443,
+		Direction:  "outbound",
+	}
+
+	tests := []struct {
+		name       string
+		conditions []RuleCondition
+		want       bool
+	}{
+		{"no conditions", nil, true},
+		{"source ip", []RuleCondition{{Field: "source_ip", Operator: "equals", Value: "192.168.1.10"}}, true},
+		{"other source ip", []RuleCondition{{Field: "source_ip", Operator: "equals", Value: "192.168.1.11"}}, false},
+		{"dest ip", []RuleCondition{{Field: "dest_ip", Operator: "equals", Value: "203.0.113.5"}}, true},
+		{"dest ip prefix", []RuleCondition{{Field: "dest_ip", Operator: "matches", Value: `^203\.0\.113\.`}}, true},
+		{"protocol", []RuleCondition{{Field: "protocol", Operator: "equals", Value: "tcp"}}, true},
+		{"other protocol", []RuleCondition{{Field: "protocol", Operator: "equals", Value: "udp"}}, false},
+		{"negated protocol", []RuleCondition{{Field: "protocol", Operator: "equals", Value: "udp", Negate: true}}, true},
+		{"negated match", []RuleCondition{{Field: "protocol", Operator: "equals", Value: "tcp", Negate: true}}, false},
+		{"all conditions hold", []RuleCondition{
+			{Field: "source_ip", Operator: "equals", Value: "192.168.1.10"},
+			{Field: "dest_ip", Operator: "equals", Value: "203.0.113.5"},
+			{Field: "protocol", Operator: "equals", Value: "tcp"},
+		}, true},
+		{"one condition fails", []RuleCondition{
+			{Field: "source_ip", Operator: "equals", Value: "192.168.1.10"},
+			{Field: "dest_ip", Operator: "equals", Value: "198.51.100.1"},
+			{Field: "protocol", Operator: "equals", Value: "tcp"},
+		}, false},
+		{"unknown field", []RuleCondition{{Field: "user", Operator: "equals", Value: "root"}}, false},
+		{"unknown operator", []RuleCondition{{Field: "protocol", Operator: "like", Value: "tcp"}}, false},
+		{"invalid pattern", []RuleCondition{{Field: "protocol", Operator: "matches", Value: "("}}, false},
+		{"unknown value never matches", []RuleCondition{{Field: "dest_country", Operator: "equals", Value: "US", Negate: true}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &FilteringRule{ID: "test", Conditions: tt.conditions}
+			if got := m.ruleMatches(rule, packet); got != tt.want {
+				t.Errorf("ruleMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleOperators(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+
+	tests := []struct {
+		operator string
+		field    interface{}
+		value    interface{}
+		want     bool
+	}{
+		{"greater", 443, 80, true},
+		{"greater", 80, 443, false},
+		{"greater", 443, 443, false},
+		{"greater", 443, "80", true},
+		{"greater", "8080", 443.5, true},
+		{"greater", "https", 80, false},
+		{"greater", 443, "port", false},
+		{"greater", nil, 1, false},
+		{"less", 80, 443, true},
+		{"less", 443, 80, false},
+		{"less", 443, 443, false},
+		{"less", "abc", 443, false},
+		{"greater_equal", 443, 443, true},
+		{"greater_equal", 442, 443, false},
+		{"greater_equal", []int{1}, 0, false},
+		{"less_equal", 443, 443, true},
+		{"less_equal", 444, 443, false},
+		{"less_equal", true, 1, false},
+		{"in", 443, []int{80, 443}, true},
+		{"in", 22, []int{80, 443}, false},
+		{"in", 443, []interface{}{float64(80), "443"}, true},
+		{"in", "udp", []string{"tcp", "udp"}, true},
+		{"in", "icmp", []string{"tcp", "udp"}, false},
+		{"in", 443, "80, 443", true},
+		{"in", 8443, "80, 443", false},
+		{"in", "tcp", "tcp", true},
+		{"startswith", "chrome.exe", "chrome", true},
+		{"startswith", "firefox", "chrome", false},
+		{"startswith", 443, 44, true},
+		{"endswith", "updates.example.com", ".example.com", true},
+		{"endswith", "example.org", ".example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%v/%v", tt.operator, tt.field, tt.value), func(t *testing.T) {
+			operator, ok := m.ruleEngine.evaluator.operators[tt.operator]
+			if !ok {
+				t.Fatalf("operator %s is not registered", tt.operator)
+			}
+			if got := operator(tt.field, tt.value); got != tt.want {
+				t.Errorf("%s(%v, %v) = %v, want %v", tt.operator, tt.field, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortConditions(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+	packet := &NetworkPacket{Protocol: "tcp", SourcePort: 51000, DestPort: 443}
+
+	tests := []struct {
+		name      string
+		condition RuleCondition
+		want      bool
+	}{
+		{"dest port in set", RuleCondition{Field: "dest_port", Operator: "in", Value: []int{80, 443}}, true},
+		{"dest port not in set", RuleCondition{Field: "dest_port", Operator: "in", Value: []int{22, 25}}, false},
+		{"dest port below", RuleCondition{Field: "dest_port", Operator: "less", Value: 1024}, true},
+		{"source port ephemeral", RuleCondition{Field: "source_port", Operator: "greater_equal", Value: 49152}, true},
+		{"source port privileged", RuleCondition{Field: "source_port", Operator: "less", Value: 1024}, false},
+		{"non-numeric bound", RuleCondition{Field: "dest_port", Operator: "greater", Value: "high"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &FilteringRule{ID: "ports", Conditions: []RuleCondition{tt.condition}}
+			if got := m.ruleMatches(rule, packet); got != tt.want {
+				t.Errorf("ruleMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemporaryRuleExpiry(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+	m.ruleEngine.sweepInterval = 10 * time.Millisecond
+	t.Cleanup(m.cancel)
+
+	packet := &NetworkPacket{Protocol: "tcp", DestIP: net.ParseIP("203.0.113.5"), DestPort: 443}
+	m.ruleEngine.AddTemporaryRule(&FilteringRule{
+		ID:         "temp-block",
+		Name:       "temporary block",
+		Conditions: []RuleCondition{{Field: "dest_ip", Operator: "equals", Value: "203.0.113.5"}},
+		Actions:    []string{"block"},
+		Enabled:    true,
+	}, 100*time.Millisecond)
+
+	if decision := m.applyFilteringRules(packet); decision.Action != "block" {
+		t.Fatalf("before expiry: action = %q, want block", decision.Action)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if decision := m.applyFilteringRules(packet); decision.Action != "allow" {
+		t.Errorf("after expiry: action = %q, want allow", decision.Action)
+	}
+
+	go m.runRuleExpirySweeper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m.ruleEngine.mutex.RLock()
+		_, exists := m.ruleEngine.rules["temp-block"]
+		m.ruleEngine.mutex.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired rule was not removed by the sweeper")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoveExpiredRules(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	rules := []struct {
+		id        string
+		expiresAt *time.Time
+		removed   bool
+	}{
+		{"permanent", nil, false},
+		{"expired", &past, true},
+		{"expires now", &now, true},
+		{"still valid", &future, false},
+	}
+	for _, r := range rules {
+		m.ruleEngine.rules[r.id] = &FilteringRule{ID: r.id, ExpiresAt: r.expiresAt}
+	}
+
+	if removed := m.ruleEngine.RemoveExpiredRules(now); removed != 2 {
+		t.Errorf("RemoveExpiredRules = %d, want 2", removed)
+	}
+	for _, r := range rules {
+		if _, exists := m.ruleEngine.rules[r.id]; exists == r.removed {
+			t.Errorf("rule %q: present = %v, want %v", r.id, exists, !r.removed)
+		}
+	}
+}
+
+func TestRulePriorityOrder(t *testing.T) {
+	packet := &NetworkPacket{Protocol: "tcp", DestPort: 443}
+	rule := func(id string, priority int, action string) *FilteringRule {
+		return &FilteringRule{
+			ID:         id,
+			Name:       id,
+			Conditions: []RuleCondition{{Field: "protocol", Operator: "equals", Value: "tcp"}},
+			Actions:    []string{action},
+			Priority:   priority,
+			Enabled:    true,
+			Statistics: &RuleStatistics{},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		rules []*FilteringRule
+		want  string
+	}{
+		{"higher priority wins", []*FilteringRule{rule("a", 1, "allow"), rule("b", 10, "block")}, "Matched rule: b"},
+		{"equal priority by id", []*FilteringRule{rule("b", 5, "block"), rule("a", 5, "allow")}, "Matched rule: a"},
+		{"ties below a higher rule", []*FilteringRule{rule("c", 5, "allow"), rule("b", 5, "allow"), rule("z", 7, "block")}, "Matched rule: z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Repeat to catch map iteration order leaking into the result
+			for i := 0; i < 20; i++ {
+				m := newTestFilteringManager(t, nil)
+				for _, r := range tt.rules {
+					m.ruleEngine.rules[r.ID] = r
+				}
+				if got := m.applyFilteringRules(packet).Reason; got != tt.want {
+					t.Fatalf("reason = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkRules returns n enabled rules with mixed priorities that never match
+// the benchmark packet, so every call orders and evaluates all of them
+func benchmarkRules(n int) map[string]*FilteringRule {
+	rules := make(map[string]*FilteringRule, n)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("rule-%05d", i)
+		rules[id] = &FilteringRule{
+			ID:         id,
+			Conditions: []RuleCondition{{Field: "dest_port", Operator: "equals", Value: 1}},
+			Actions:    []string{"block"},
+			Priority:   (i * 7919) % 100,
+			Enabled:    true,
+			Statistics: &RuleStatistics{},
+		}
+	}
+	return rules
+}
+
+// bubbleSortRules is the ordering applyFilteringRules used before sort.Slice,
+// kept as the baseline for BenchmarkRuleOrdering
+func bubbleSortRules(rules []*FilteringRule) {
+	for i := 0; i < len(rules); i++ {
+		for j := i + 1; j < len(rules); j++ {
+			if rules[i].Priority < rules[j].Priority {
+				rules[i], rules[j] = rules[j], rules[i]
+			}
+		}
+	}
+}
+
+func BenchmarkRuleOrdering(b *testing.B) {
+	rules := benchmarkRules(3000)
+
+	b.Run("bubble sort", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			applicable := make([]*FilteringRule, 0, len(rules))
+			for _, rule := range rules {
+				applicable = append(applicable, rule)
+			}
+			bubbleSortRules(applicable)
+		}
+	})
+
+	b.Run("applyFilteringRules", func(b *testing.B) {
+		m, err := NewSystemWideFilteringManager(&SystemFilteringConfig{})
+		if err != nil {
+			b.Fatalf("NewSystemWideFilteringManager: %v", err)
+		}
+		m.logger = log.New(io.Discard, "", 0)
+		m.ruleEngine.rules = rules
+		packet := &NetworkPacket{Protocol: "tcp", DestPort: 443}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.applyFilteringRules(packet)
+		}
+	})
+}
+
+// procFixture describes a process in a synthetic /proc tree
+type procFixture struct {
+	pid     int
+	comm    string
+	exe     string
+	cmdline []string
+	status  string
+	inodes  []uint64
+}
+
+// writeProcFixture creates a /proc tree under a temp root with the given processes
+// and /proc/net tables, which map file names such as "tcp6" to their data rows
+func writeProcFixture(t *testing.T, procs []procFixture, tables map[string][]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, p := range procs {
+		writeTestProcess(t, root, p)
+	}
+
+	netDir := filepath.Join(root, "net")
+	if err := os.MkdirAll(netDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	for name, rows := range tables {
+		data := header + strings.Join(rows, "\n") + "\n"
+		if err := os.WriteFile(filepath.Join(netDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func writeTestProcess(t *testing.T, root string, p procFixture) {
+	t.Helper()
+	dir := filepath.Join(root, strconv.Itoa(p.pid))
+	if err := os.MkdirAll(filepath.Join(dir, "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"comm":    p.comm + "\n",
+		"cmdline": strings.Join(p.cmdline, "\x00") + "\x00",
+		"status":  p.status,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.exe != "" {
+		if err := os.Symlink(p.exe, filepath.Join(dir, "exe")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// fd 0 is a regular file and must not be taken for a socket
+	if err := os.Symlink("/dev/null", filepath.Join(dir, "fd", "0")); err != nil {
+		t.Fatal(err)
+	}
+	for i, inode := range p.inodes {
+		link := fmt.Sprintf("socket:[%d]", inode)
+		if err := os.Symlink(link, filepath.Join(dir, "fd", strconv.Itoa(i+3))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// procNetRow formats a /proc/net table row
+func procNetRow(local, remote, state string, inode uint64) string {
+	return fmt.Sprintf("   0: %s %s %s 00000000:00000000 00:00000000 00000000  1000        0 %d 1 0000000000000000 100 0 0 10 0",
+		local, remote, state, inode)
+}
+
+func TestLinuxProcessScanner(t *testing.T) {
+	root := writeProcFixture(t, []procFixture{
+		{
+			pid:     100,
+			comm:    "curl",
+			exe:     "/usr/bin/curl",
+			cmdline: []string{"curl", "-s", "https://example.com"},
+			status:  "Name:\tcurl\nUid:\t1000\t1000\t1000\t1000\nVmRSS:\t    2048 kB\n",
+			inodes:  []uint64{1001},
+		},
+		{
+			pid:     200,
+			comm:    "resolved",
+			exe:     "/usr/lib/systemd/resolved",
+			cmdline: []string{"/usr/lib/systemd/resolved"},
+			inodes:  []uint64{2001, 2002},
+		},
+	}, map[string][]string{
+		"tcp": {
+			procNetRow("0100007F:C350", "0500000A:01BB", "01", 1001),
+			procNetRow("0100007F:1F90", "00000000:0000", "0A", 9999),
+		},
+		"tcp6": {procNetRow("00000000000000000000000001000000:01BB", "00000000000000000000000000000000:0000", "0A", 2002)},
+		"udp":  {procNetRow("00000000:0035", "00000000:0000", "07", 2001)},
+	})
+	s := NewLinuxProcessScanner(root)
+
+	processes, err := s.ScanProcesses()
+	if err != nil {
+		t.Fatalf("ScanProcesses: %v", err)
+	}
+	if len(processes) != 2 {
+		t.Fatalf("ScanProcesses found %d processes, want 2", len(processes))
+	}
+
+	info, err := s.GetProcessInfo(100)
+	if err != nil {
+		t.Fatalf("GetProcessInfo: %v", err)
+	}
+	if info.Name != "curl" || info.Path != "/usr/bin/curl" || info.CommandLine != "curl -s https://example.com" {
+		t.Errorf("GetProcessInfo = %q %q %q", info.Name, info.Path, info.CommandLine)
+	}
+	if info.User != "1000" || info.MemoryUsage != 2048*1024 {
+		t.Errorf("user = %q, memory = %d", info.User, info.MemoryUsage)
+	}
+	if len(info.Connections) != 1 {
+		t.Fatalf("curl has %d connections, want 1", len(info.Connections))
+	}
+	conn := info.Connections[0]
+	if !conn.LocalIP.Equal(net.ParseIP("127.0.0.1")) || conn.LocalPort != 50000 ||
+		!conn.RemoteIP.Equal(net.ParseIP("10.0.0.5")) || conn.RemotePort != 443 ||
+		conn.State != "ESTABLISHED" || conn.ProcessID != 100 || conn.ProcessName != "curl" {
+		t.Errorf("connection = %+v", conn)
+	}
+
+	if _, err := s.GetProcessInfo(300); err == nil {
+		t.Error("GetProcessInfo succeeded for a missing process")
+	}
+
+	tests := []struct {
+		name     string
+		protocol string
+		localIP  string
+		port     int
+		wantPID  int
+	}{
+		{"tcp established", "tcp", "127.0.0.1", 50000, 100},
+		{"tcp6 listener", "tcp", "::1", 443, 200},
+		{"udp wildcard listener", "udp", "192.168.1.2", 53, 200},
+		{"any local address", "udp", "", 53, 200},
+		{"other address", "tcp", "127.0.0.2", 50000, 0},
+		{"socket without process", "tcp", "127.0.0.1", 8080, 0},
+		{"protocol mismatch", "udp", "127.0.0.1", 50000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, err := s.FindProcessByConnection(tt.protocol, net.ParseIP(tt.localIP), tt.port)
+			if tt.wantPID == 0 {
+				if err == nil {
+					t.Errorf("FindProcessByConnection = %d, want an error", pid)
+				}
+				return
+			}
+			if err != nil || pid != tt.wantPID {
+				t.Errorf("FindProcessByConnection = %d, %v, want %d", pid, err, tt.wantPID)
+			}
+		})
+	}
+
+	// A process started after the cache was filled is found on the next miss
+	writeTestProcess(t, root, procFixture{pid: 300, comm: "nginx", inodes: []uint64{9999}})
+	if pid, err := s.FindProcessByConnection("tcp", net.ParseIP("127.0.0.1"), 8080); err != nil || pid != 300 {
+		t.Errorf("FindProcessByConnection after new process = %d, %v, want 300", pid, err)
+	}
+}
+
+func TestParseProcNetAddress(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantIP   string
+		wantPort int
+		wantErr  bool
+	}{
+		{"0100007F:1F90", "127.0.0.1", 8080, false},
+		{"0500000A:01BB", "10.0.0.5", 443, false},
+		{"00000000:0035", "0.0.0.0", 53, false},
+		{"00000000000000000000000001000000:01BB", "::1", 443, false},
+		{"B80D0120000000000000000001000000:0050", "2001:db8::1", 80, false},
+		{"0100007F", "", 0, true},
+		{"0100007:1F90", "", 0, true},
+		{"0100007F00:1F90", "", 0, true},
+		{"0100007F:FFFFF", "", 0, true},
+		{"zz00007F:1F90", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ip, port, err := parseProcNetAddress(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseProcNetAddress(%q) = %v:%d, want an error", tt.in, ip, port)
+				}
+				return
+			}
+			if err != nil || !ip.Equal(net.ParseIP(tt.wantIP)) || port != tt.wantPort {
+				t.Errorf("parseProcNetAddress(%q) = %v:%d, %v, want %s:%d", tt.in, ip, port, err, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestBuildIptablesArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		rule FirewallRule
+		ipv6 bool
+		want [][]string
+	}{
+		{
+			name: "block outbound tcp port",
+			rule: FirewallRule{ID: "r1", Action: "block", Direction: "out", Protocol: "tcp", DestIP: "203.0.113.0/24", DestPort: "443"},
+			want: [][]string{{"-A", "OUTPUT", "-p", "tcp", "-d", "203.0.113.0/24", "--dport", "443", "-m", "comment", "--comment", "oblivionfilter:r1", "-j", "DROP"}},
+		},
+		{
+			name: "allow inbound udp from source",
+			rule: FirewallRule{ID: "r2", Action: "allow", Direction: "in", Protocol: "udp", SourceIP: "10.0.0.1", SourcePort: "53"},
+			want: [][]string{{"-A", "INPUT", "-p", "udp", "-s", "10.0.0.1", "--sport", "53", "-m", "comment", "--comment", "oblivionfilter:r2", "-j", "ACCEPT"}},
+		},
+		{
+			name: "reject both directions",
+			rule: FirewallRule{ID: "r3", Action: "reject", Direction: "both", Protocol: "all", DestIP: "198.51.100.7"},
+			want: [][]string{
+				{"-A", "INPUT", "-d", "198.51.100.7", "-m", "comment", "--comment", "oblivionfilter:r3", "-j", "REJECT"},
+				{"-A", "OUTPUT", "-d", "198.51.100.7", "-m", "comment", "--comment", "oblivionfilter:r3", "-j", "REJECT"},
+			},
+		},
+		{
+			name: "ports ignored without tcp or udp",
+			rule: FirewallRule{ID: "r4", Action: "block", Direction: "out", Protocol: "icmp", DestPort: "80"},
+			want: [][]string{{"-A", "OUTPUT", "-p", "icmp", "-m", "comment", "--comment", "oblivionfilter:r4", "-j", "DROP"}},
+		},
+		{
+			name: "icmp over ipv6",
+			rule: FirewallRule{ID: "r5", Action: "block", Direction: "in", Protocol: "icmp"},
+			ipv6: true,
+			want: [][]string{{"-A", "INPUT", "-p", "ipv6-icmp", "-m", "comment", "--comment", "oblivionfilter:r5", "-j", "DROP"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildIptablesArgs("-A", &tt.rule, tt.ipv6)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("buildIptablesArgs =\n%v\nwant\n%v", got, tt.want)
+			}
+
+			// Each generated rule parses back to the same match
+			parsed := parseIptablesRule(strings.Join(got[0], " "))
+			if parsed == nil || parsed.ID != tt.rule.ID || parsed.Action != tt.rule.Action || parsed.DestIP != tt.rule.DestIP {
+				t.Errorf("parseIptablesRule = %+v", parsed)
+			}
+		})
+	}
+}
+
+// newMockIptablesManager returns a manager whose commands are recorded instead of
+// executed; -S listings are answered from listings, keyed by "binary chain"
+func newMockIptablesManager(listings map[string]string) (*IptablesManager, *[][]string) {
+	var calls [][]string
+	i := NewIptablesManager(false)
+	i.runCommand = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{name}, args...))
+		if len(args) == 2 && args[0] == "-S" {
+			return []byte(listings[name+" "+args[1]]), nil
+		}
+		return nil, nil
+	}
+	return i, &calls
+}
+
+func TestIptablesManagerCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		rule FirewallRule
+		want []string
+	}{
+		{"ipv4 rule uses iptables", FirewallRule{ID: "v4", Action: "block", Direction: "out", DestIP: "203.0.113.5", Enabled: true},
+			[]string{"iptables -A OUTPUT -d 203.0.113.5 -m comment --comment oblivionfilter:v4 -j DROP"}},
+		{"ipv6 rule uses ip6tables", FirewallRule{ID: "v6", Action: "block", Direction: "out", DestIP: "2001:db8::/32", Enabled: true},
+			[]string{"ip6tables -A OUTPUT -d 2001:db8::/32 -m comment --comment oblivionfilter:v6 -j DROP"}},
+		{"rule without addresses uses both", FirewallRule{ID: "any", Action: "allow", Direction: "in", Protocol: "tcp", DestPort: "22", Enabled: true},
+			[]string{
+				"iptables -A INPUT -p tcp --dport 22 -m comment --comment oblivionfilter:any -j ACCEPT",
+				"ip6tables -A INPUT -p tcp --dport 22 -m comment --comment oblivionfilter:any -j ACCEPT",
+			}},
+		{"disabled rule is not installed", FirewallRule{ID: "off", Action: "block", DestIP: "203.0.113.5"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, calls := newMockIptablesManager(nil)
+			if err := i.AddRule(&tt.rule); err != nil {
+				t.Fatalf("AddRule: %v", err)
+			}
+			var got []string
+			for _, call := range *calls {
+				got = append(got, strings.Join(call, " "))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("commands =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestIptablesManagerRemoveRule(t *testing.T) {
+	i, calls := newMockIptablesManager(map[string]string{
+		"iptables OUTPUT": "-P OUTPUT ACCEPT\n" +
+			"-A OUTPUT -d 203.0.113.5/32 -m comment --comment oblivionfilter:r1 -j DROP\n" +
+			"-A OUTPUT -d 203.0.113.6/32 -m comment --comment oblivionfilter:r10 -j DROP\n" +
+			"-A OUTPUT -d 198.51.100.1/32 -m comment --comment \"managed by someone else\" -j DROP\n",
+		"ip6tables INPUT": "-A INPUT -s 2001:db8::1/128 -m comment --comment oblivionfilter:r1 -j DROP\n",
+	})
+
+	if err := i.RemoveRule("r1"); err != nil {
+		t.Fatalf("RemoveRule: %v", err)
+	}
+	var deletes []string
+	for _, call := range *calls {
+		if call[1] == "-D" {
+			deletes = append(deletes, strings.Join(call, " "))
+		}
+	}
+	want := []string{
+		"iptables -D OUTPUT -d 203.0.113.5/32 -m comment --comment oblivionfilter:r1 -j DROP",
+		"ip6tables -D INPUT -s 2001:db8::1/128 -m comment --comment oblivionfilter:r1 -j DROP",
+	}
+	if strings.Join(deletes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("RemoveRule deleted\n%s\nwant\n%s", strings.Join(deletes, "\n"), strings.Join(want, "\n"))
+	}
+
+	rules, err := i.ListRules()
+	if err != nil {
+		t.Fatalf("ListRules: %v", err)
+	}
+	var ids []string
+	for _, rule := range rules {
+		ids = append(ids, rule.ID)
+	}
+	if strings.Join(ids, ",") != "r1,r10" {
+		t.Errorf("ListRules = %v, want the tagged rules r1 and r10 only", ids)
+	}
+}
+
+func TestIptablesManagerDryRun(t *testing.T) {
+	i := NewIptablesManager(true)
+	i.runCommand = func(name string, args ...string) ([]byte, error) {
+		t.Errorf("dry run executed %s %v", name, args)
+		return nil, nil
+	}
+
+	rule := &FirewallRule{ID: "dry", Action: "block", Direction: "out", DestIP: "203.0.113.5", Enabled: true}
+	if err := i.AddRule(rule); err != nil {
+		t.Fatalf("AddRule: %v", err)
+	}
+	if rules, _ := i.ListRules(); len(rules) != 1 || rules[0] != rule {
+		t.Errorf("ListRules = %v, want the added rule", rules)
+	}
+	if err := i.FlushRules(); err != nil {
+		t.Fatalf("FlushRules: %v", err)
+	}
+
+	want := []string{
+		"iptables -A OUTPUT -d 203.0.113.5 -m comment --comment oblivionfilter:dry -j DROP",
+		"iptables -D OUTPUT -d 203.0.113.5 -m comment --comment oblivionfilter:dry -j DROP",
+	}
+	var got []string
+	for _, cmd := range i.ExecutedCommands() {
+		got = append(got, strings.Join(cmd, " "))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ExecutedCommands =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFirewallRulesRoundTrip(t *testing.T) {
+	rules := []*FirewallRule{
+		{ID: "allow-dns", Name: "Allow DNS", Action: "allow", Direction: "out", Protocol: "udp", DestIP: "9.9.9.9", DestPort: "53", Enabled: true},
+		{ID: "block-range", Name: "Block test range", Action: "block", Direction: "both", Protocol: "all", DestIP: "203.0.113.0/24", Enabled: true},
+		{ID: "reject-smtp", Name: "Reject SMTP", Action: "reject", Direction: "out", Protocol: "tcp", DestPort: "25", Enabled: false},
+		{ID: "ssh-in", Name: "ssh", Action: "allow", Direction: "in", Protocol: "tcp", SourceIP: "10.0.0.0/8", SourcePort: "1024:65535", DestPort: "22", Enabled: true},
+	}
+
+	var buf strings.Builder
+	if err := exportFirewallRules(&buf, rules); err != nil {
+		t.Fatalf("exportFirewallRules: %v", err)
+	}
+	if !strings.Contains(buf.String(), "*filter\n") || !strings.HasSuffix(buf.String(), "COMMIT\n") {
+		t.Errorf("export is not in iptables-save format:\n%s", buf.String())
+	}
+
+	got, err := importFirewallRules(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("importFirewallRules: %v", err)
+	}
+	if len(got) != len(rules) {
+		t.Fatalf("imported %d rules, want %d", len(got), len(rules))
+	}
+	byID := make(map[string]*FirewallRule)
+	for _, rule := range got {
+		byID[rule.ID] = rule
+	}
+	for _, want := range rules {
+		rule := byID[want.ID]
+		if rule == nil {
+			t.Errorf("rule %s was not imported", want.ID)
+			continue
+		}
+		if *rule != *want {
+			t.Errorf("rule %s round-tripped to\n%+v\nwant\n%+v", want.ID, *rule, *want)
+		}
+	}
+}
+
+func TestFirewallIntegrationPersistence(t *testing.T) {
+	config := &SystemFilteringConfig{FirewallPersistPath: filepath.Join(t.TempDir(), "rules.v4")}
+	f := &FirewallIntegration{
+		rules:       make(map[string]*FirewallRule),
+		ruleManager: NewIptablesManager(true),
+		config:      config,
+	}
+
+	permanent := &FirewallRule{ID: "perm", Name: "perm", Action: "block", Direction: "out", Protocol: "tcp", DestIP: "203.0.113.5", DestPort: "443", Enabled: true}
+	temporary := &FirewallRule{ID: "temp", Name: "temp", Action: "block", Direction: "out", Protocol: "all", DestIP: "198.51.100.1", Enabled: true, Temporary: true}
+	removed := &FirewallRule{ID: "gone", Name: "gone", Action: "block", Direction: "in", Protocol: "all", SourceIP: "192.0.2.1", Enabled: true}
+	for _, rule := range []*FirewallRule{permanent, temporary, removed} {
+		if err := f.AddRule(rule); err != nil {
+			t.Fatalf("AddRule(%s): %v", rule.ID, err)
+		}
+	}
+	if err := f.RemoveRule("gone"); err != nil {
+		t.Fatalf("RemoveRule: %v", err)
+	}
+
+	// A fresh integration, as after a reboot, reinstalls only the persisted rule
+	manager := NewIptablesManager(true)
+	restoredF := &FirewallIntegration{
+		rules:       make(map[string]*FirewallRule),
+		ruleManager: manager,
+		config:      config,
+	}
+	restored, err := restoredF.RestoreRules()
+	if err != nil {
+		t.Fatalf("RestoreRules: %v", err)
+	}
+	if restored != 1 || restoredF.rules["perm"] == nil {
+		t.Fatalf("restored %d rules (%v), want only perm", restored, restoredF.rules)
+	}
+	if *restoredF.rules["perm"] != *permanent {
+		t.Errorf("restored rule = %+v, want %+v", *restoredF.rules["perm"], *permanent)
+	}
+	if cmds := manager.ExecutedCommands(); len(cmds) != 1 || !strings.Contains(strings.Join(cmds[0], " "), "oblivionfilter:perm") {
+		t.Errorf("restore executed %v, want the perm rule installed once", cmds)
+	}
+
+	// Without a persistence file there is nothing to restore
+	config.FirewallPersistPath = filepath.Join(t.TempDir(), "missing")
+	if restored, err := restoredF.RestoreRules(); restored != 0 || err != nil {
+		t.Errorf("RestoreRules without a file = %d, %v, want 0, nil", restored, err)
+	}
+}
+
+// captureTLSClientHello records the first TLS record a crypto/tls client sends
+// for serverName
+func captureTLSClientHello(t *testing.T, serverName string, maxVersion uint16) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, MaxVersion: maxVersion, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	return record
+}
+
+func TestExtractURLFromTLSPacket(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+
+	tests := []struct {
+		serverName string
+		maxVersion uint16
+		want       string
+	}{
+		{"www.google.com", 0, "https://www.google.com"},
+		{"github.com", tls.VersionTLS12, "https://github.com"},
+		{"Cdn.Example.ORG", 0, "https://cdn.example.org"},
+		{"", 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			hello := captureTLSClientHello(t, tt.serverName, tt.maxVersion)
+			packet := &NetworkPacket{Protocol: "tcp", DestPort: 443, Data: hello}
+			if got := m.extractURLFromHTTPPacket(packet); got != tt.want {
+				t.Errorf("extractURLFromHTTPPacket = %q, want %q", got, tt.want)
+			}
+
+			// Every truncation of the handshake is rejected without panicking
+			for n := 0; n < len(hello); n++ {
+				if got := parseTLSServerName(hello[:n]); got != "" {
+					t.Fatalf("parseTLSServerName(hello[:%d]) = %q, want empty", n, got)
+				}
+			}
+		})
+	}
+
+	malformed := map[string][]byte{
+		"not a handshake":   {0x17, 0x03, 0x03, 0x00, 0x01, 0x00},
+		"server hello":      {0x16, 0x03, 0x03, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00},
+		"header only":       {0x16, 0x03, 0x01},
+		"oversized lengths": append([]byte{0x16, 0x03, 0x01, 0xff, 0xff, 0x01, 0xff, 0xff, 0xff}, make([]byte, 34)...),
+		"empty":             nil,
+	}
+	for name, data := range malformed {
+		if got := parseTLSServerName(data); got != "" {
+			t.Errorf("%s: parseTLSServerName = %q, want empty", name, got)
+		}
+	}
+}
+
+func TestExtractURLFromHTTPPacket(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"origin form", "GET /index.html HTTP/1.1\r\nHost: Example.com\r\nAccept: */*\r\n\r\n", "http://example.com/index.html"},
+		{"host with port", "POST /api?q=1 HTTP/1.1\r\nhost: example.com:8080\r\n\r\n", "http://example.com:8080/api?q=1"},
+		{"absolute form", "GET http://proxy.example.net/a HTTP/1.1\r\nHost: other\r\n\r\n", "http://proxy.example.net/a"},
+		{"fragmented headers", "GET /partial HTTP/1.1\r\nHost: example.com\r\nUser-Ag", "http://example.com/partial"},
+		{"missing host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", ""},
+		{"host not yet received", "GET / HTTP/1.1\r\nAcc", ""},
+		{"not http", "SSH-2.0-OpenSSH_9.6\r\n", ""},
+		{"truncated request line", "GET /index", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := &NetworkPacket{Protocol: "tcp", DestPort: 80, Data: []byte(tt.data)}
+			if got := m.extractURLFromHTTPPacket(packet); got != tt.want {
+				t.Errorf("extractURLFromHTTPPacket = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// blockPortRule blocks every packet to port
+func blockPortRule(id string, port int) *FilteringRule {
+	return &FilteringRule{
+		ID:         id,
+		Name:       id,
+		Conditions: []RuleCondition{{Field: "dest_port", Operator: "equals", Value: port}},
+		Actions:    []string{"block"},
+		Enabled:    true,
+		Statistics: &RuleStatistics{},
+	}
+}
+
+func TestPacketWorkerPool(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{PacketWorkers: 8, PacketQueueSize: 16})
+	t.Cleanup(m.cancel)
+	m.ruleEngine.rules["block-8443"] = blockPortRule("block-8443", 8443)
+	m.startPacketWorkers()
+
+	const packets = 2000
+	var wg sync.WaitGroup
+	var blocked, allowed int64
+	wg.Add(packets)
+	for i := 0; i < packets; i++ {
+		port := 22
+		if i%2 == 0 {
+			port = 8443
+		}
+		err := m.SubmitPacket(&NetworkPacket{Protocol: "tcp", DestPort: port}, func(packet *NetworkPacket, decision FilterDecision) {
+			defer wg.Done()
+			switch {
+			case decision.Action == "block" && packet.DestPort == 8443:
+				atomic.AddInt64(&blocked, 1)
+			case decision.Action == "allow" && packet.DestPort == 22:
+				atomic.AddInt64(&allowed, 1)
+			default:
+				t.Errorf("port %d: unexpected decision %q", packet.DestPort, decision.Action)
+			}
+		})
+		if err != nil {
+			t.Fatalf("SubmitPacket: %v", err)
+		}
+	}
+	wg.Wait()
+
+	if blocked != packets/2 || allowed != packets/2 {
+		t.Errorf("callbacks saw %d blocked and %d allowed, want %d each", blocked, allowed, packets/2)
+	}
+	metrics := m.GetMetrics()
+	if metrics.NetworkPacketsProcessed != packets || metrics.NetworkPacketsBlocked != packets/2 {
+		t.Errorf("metrics: %d processed, %d blocked, want %d and %d",
+			metrics.NetworkPacketsProcessed, metrics.NetworkPacketsBlocked, packets, packets/2)
+	}
+}
+
+func TestPacketWorkerPoolBackpressure(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{PacketWorkers: 1, PacketQueueSize: 2})
+	t.Cleanup(m.cancel)
+
+	packet := &NetworkPacket{Protocol: "tcp", DestPort: 22}
+	if m.TrySubmitPacket(packet, nil) {
+		t.Error("TrySubmitPacket accepted a packet before the pool was started")
+	}
+	if err := m.SubmitPacket(packet, nil); err == nil {
+		t.Error("SubmitPacket accepted a packet before the pool was started")
+	}
+
+	m.startPacketWorkers()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	m.SubmitPacket(packet, func(*NetworkPacket, FilterDecision) {
+		close(started)
+		<-release
+	})
+	<-started
+
+	// The only worker is busy, so the queue fills up and further packets are refused
+	for i := 0; i < 2; i++ {
+		if !m.TrySubmitPacket(packet, nil) {
+			t.Fatalf("TrySubmitPacket refused packet %d with room in the queue", i)
+		}
+	}
+	if m.TrySubmitPacket(packet, nil) {
+		t.Error("TrySubmitPacket accepted a packet with the queue full")
+	}
+	close(release)
+}
+
+func TestStopPacketWorkersAnswersQueuedPackets(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{PacketWorkers: 1, PacketQueueSize: 8})
+	m.startPacketWorkers()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	packet := &NetworkPacket{Protocol: "tcp", DestPort: 22}
+	m.SubmitPacket(packet, func(*NetworkPacket, FilterDecision) {
+		close(started)
+		<-release
+	})
+	<-started
+
+	// The only worker is busy, so these stay queued until the pool is stopped
+	const queued = 5
+	var answered int64
+	for i := 0; i < queued; i++ {
+		err := m.SubmitPacket(packet, func(packet *NetworkPacket, decision FilterDecision) {
+			if decision.Action != "allow" && decision.Action != "error" {
+				t.Errorf("queued packet: unexpected decision %q", decision.Action)
+			}
+			atomic.AddInt64(&answered, 1)
+		})
+		if err != nil {
+			t.Fatalf("SubmitPacket: %v", err)
+		}
+	}
+
+	m.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		m.stopPacketWorkers()
+		close(stopped)
+	}()
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopPacketWorkers did not return")
+	}
+
+	if n := atomic.LoadInt64(&answered); n != queued {
+		t.Errorf("%d of %d queued callbacks were called", n, queued)
+	}
+	if m.TrySubmitPacket(packet, nil) {
+		t.Error("TrySubmitPacket accepted a packet after the pool was stopped")
+	}
+}
+
+func TestProcessPacketConcurrentMetrics(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+	m.ruleEngine.rules["block-8443"] = blockPortRule("block-8443", 8443)
+
+	const goroutines, perGoroutine = 32, 250
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				port := 22
+				if (g+i)%4 == 0 {
+					port = 8443
+				}
+				m.ProcessPacket(&NetworkPacket{Protocol: "tcp", DestPort: port})
+				if i%50 == 0 {
+					m.GetMetrics()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	metrics := m.GetMetrics()
+	if want := int64(goroutines * perGoroutine); metrics.NetworkPacketsProcessed != want {
+		t.Errorf("NetworkPacketsProcessed = %d, want %d", metrics.NetworkPacketsProcessed, want)
+	}
+	if want := int64(goroutines * perGoroutine / 4); metrics.NetworkPacketsBlocked != want {
+		t.Errorf("NetworkPacketsBlocked = %d, want %d", metrics.NetworkPacketsBlocked, want)
+	}
+	stats := m.ruleEngine.rules["block-8443"].Statistics
+	stats.mutex.Lock()
+	matches := stats.MatchCount
+	stats.mutex.Unlock()
+	if matches != goroutines*perGoroutine/4 {
+		t.Errorf("rule matches = %d, want %d", matches, goroutines*perGoroutine/4)
+	}
+	if metrics.AvgProcessingTime <= 0 {
+		t.Errorf("AvgProcessingTime = %v, want a positive mean", metrics.AvgProcessingTime)
+	}
+}
+
+func TestAverageProcessingTime(t *testing.T) {
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		want      time.Duration
+	}{
+		{"no samples", nil, 0},
+		{"one sample", []time.Duration{10 * time.Millisecond}, 10 * time.Millisecond},
+		{"running mean", []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 60 * time.Millisecond}, 30 * time.Millisecond},
+		// A halving average would report 50ms here
+		{"not biased to the last sample", []time.Duration{0, 0, 0, 100 * time.Millisecond}, 25 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestFilteringManager(t, nil)
+			for _, d := range tt.durations {
+				m.updateProcessingTime(d)
+			}
+			if got := m.GetMetrics().AvgProcessingTime; got != tt.want {
+				t.Errorf("AvgProcessingTime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// mmdbValue encodes a value in the MaxMind DB data section format. Only the
+// types a country database needs are supported.
+func mmdbValue(v interface{}) []byte {
+	control := func(typ, size int) []byte {
+		if typ <= 7 {
+			return []byte{byte(typ<<5 | size)}
+		}
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case uint16:
+		return append(control(5, 2), byte(v>>8), byte(v))
+	case uint32:
+		return append(control(6, 4), binary.BigEndian.AppendUint32(nil, v)...)
+	case uint64:
+		return append(control(9, 8), binary.BigEndian.AppendUint64(nil, v)...)
+	case []string:
+		out := control(11, len(v))
+		for _, item := range v {
+			out = append(out, mmdbValue(item)...)
+		}
+		return out
+	case [][2]interface{}:
+		// Map as ordered key/value pairs
+		out := control(7, len(v))
+		for _, pair := range v {
+			out = append(out, mmdbValue(pair[0])...)
+			out = append(out, mmdbValue(pair[1])...)
+		}
+		return out
+	}
+	panic(fmt.Sprintf("mmdbValue: unsupported type %T", v))
+}
+
+// writeTestMMDB writes an IPv4 MaxMind database mapping each CIDR to its record
+// and returns its path
+func writeTestMMDB(t *testing.T, networks map[string]interface{}) string {
+	t.Helper()
+
+	// Binary trie over the network bits; children are node indexes, -1 when
+	// empty, or -2-i for the data record of network i
+	type node struct{ children [2]int }
+	nodes := []node{{[2]int{-1, -1}}}
+	var data []byte
+	var leafOffsets []int
+
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP.To4()
+
+		leafOffsets = append(leafOffsets, len(data))
+		data = append(data, mmdbValue(record)...)
+
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[current].children[bit] = -2 - (len(leafOffsets) - 1)
+				break
+			}
+			if nodes[current].children[bit] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[current].children[bit] = len(nodes) - 1
+			}
+			current = nodes[current].children[bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	var file []byte
+	for _, n := range nodes {
+		for _, child := range n.children {
+			value := nodeCount // no data
+			switch {
+			case child >= 0:
+				value = child
+			case child <= -2:
+				value = nodeCount + 16 + leafOffsets[-2-child]
+			}
+			file = append(file, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, "\xab\xcd\xefMaxMind.com"...)
+	file = append(file, mmdbValue([][2]interface{}{
+		{"binary_format_major_version", uint16(2)},
+		{"binary_format_minor_version", uint16(0)},
+		{"build_epoch", uint64(time.Now().Unix())},
+		{"database_type", "Test-Country"},
+		{"description", [][2]interface{}{{"en", "test database"}}},
+		{"ip_version", uint16(4)},
+		{"languages", []string{"en"}},
+		{"node_count", uint32(nodeCount)},
+		{"record_size", uint16(24)},
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test-country.mmdb")
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// countryRecord builds a GeoLite2-Country style record
+func countryRecord(field, isoCode string) [][2]interface{} {
+	return [][2]interface{}{{field, [][2]interface{}{{"iso_code", isoCode}}}}
+}
+
+func TestGeoIPCountryRules(t *testing.T) {
+	dbPath := writeTestMMDB(t, map[string]interface{}{
+		"192.0.2.0/24":    countryRecord("country", "US"),
+		"198.51.100.0/24": countryRecord("country", "DE"),
+		"203.0.113.0/25":  countryRecord("registered_country", "JP"),
+	})
+	m := newTestFilteringManager(t, &SystemFilteringConfig{GeoIPDatabasePath: dbPath})
+	m.ruleEngine.rules["block-de"] = &FilteringRule{
+		ID:         "block-de",
+		Name:       "block-de",
+		Conditions: []RuleCondition{{Field: "dest_country", Operator: "equals", Value: "DE"}},
+		Actions:    []string{"block"},
+		Enabled:    true,
+		Statistics: &RuleStatistics{},
+	}
+
+	tests := []struct {
+		ip          string
+		wantCountry string
+		wantAction  string
+	}{
+		{"192.0.2.10", "US", "allow"},
+		{"198.51.100.7", "DE", "block"},
+		{"198.51.100.255", "DE", "block"},
+		{"203.0.113.1", "JP", "allow"},
+		{"203.0.113.200", "", "allow"},
+		{"10.0.0.1", "", "allow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			country, err := m.geoIPFilter.LookupCountry(net.ParseIP(tt.ip))
+			if country != tt.wantCountry || (err == nil) != (tt.wantCountry != "") {
+				t.Errorf("LookupCountry = %q, %v, want %q", country, err, tt.wantCountry)
+			}
+			packet := &NetworkPacket{Protocol: "tcp", DestIP: net.ParseIP(tt.ip), DestPort: 22}
+			if got := m.applyFilteringRules(packet).Action; got != tt.wantAction {
+				t.Errorf("action = %q, want %q", got, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestGeoIPFailsOpen(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.mmdb")
+	m := newTestFilteringManager(t, &SystemFilteringConfig{GeoIPDatabasePath: missing})
+	m.ruleEngine.rules["block-de"] = &FilteringRule{
+		ID:         "block-de",
+		Conditions: []RuleCondition{{Field: "dest_country", Operator: "equals", Value: "DE"}},
+		Actions:    []string{"block"},
+		Enabled:    true,
+		Statistics: &RuleStatistics{},
+	}
+
+	if _, err := m.geoIPFilter.LookupCountry(net.ParseIP("198.51.100.7")); err == nil {
+		t.Error("LookupCountry succeeded without a database")
+	}
+	packet := &NetworkPacket{Protocol: "tcp", DestIP: net.ParseIP("198.51.100.7"), DestPort: 22}
+	if got := m.applyFilteringRules(packet).Action; got != "allow" {
+		t.Errorf("action without a database = %q, want allow", got)
+	}
+}
+
+func TestScheduleIsActive(t *testing.T) {
+	// 5 January 2024 was a Friday
+	at := func(day int, clock string) time.Time {
+		parsed, _ := time.Parse("15:04", clock)
+		return time.Date(2024, time.January, day, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+	}
+	weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+	evening := []TimeRange{{Start: "18:00", End: "21:30"}}
+	overnight := []TimeRange{{Start: "22:00", End: "06:00"}}
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		at       time.Time
+		want     bool
+	}{
+		{"nil schedule", nil, at(5, "12:00"), true},
+		{"empty schedule", &Schedule{}, at(6, "03:00"), true},
+		{"listed day", &Schedule{Days: weekdays}, at(5, "12:00"), true},
+		{"unlisted day", &Schedule{Days: weekdays}, at(6, "12:00"), false},
+		{"full day names", &Schedule{Days: []string{"Saturday", "SUNDAY"}}, at(7, "12:00"), true},
+		{"in window", &Schedule{Ranges: evening}, at(5, "19:00"), true},
+		{"window start is inclusive", &Schedule{Ranges: evening}, at(5, "18:00"), true},
+		{"window end is exclusive", &Schedule{Ranges: evening}, at(5, "21:30"), false},
+		{"before window", &Schedule{Ranges: evening}, at(5, "17:59"), false},
+		{"window on unlisted day", &Schedule{Days: weekdays, Ranges: evening}, at(6, "19:00"), false},
+		{"overnight before midnight", &Schedule{Ranges: overnight}, at(5, "23:15"), true},
+		{"overnight after midnight", &Schedule{Ranges: overnight}, at(6, "05:59"), true},
+		{"overnight ended", &Schedule{Ranges: overnight}, at(6, "06:00"), false},
+		{"overnight not started", &Schedule{Ranges: overnight}, at(5, "21:59"), false},
+		// Friday night's range runs into Saturday morning even though Saturday is not listed
+		{"overnight carries into next day", &Schedule{Days: []string{"fri"}, Ranges: overnight}, at(6, "02:00"), true},
+		{"overnight from unlisted day", &Schedule{Days: []string{"fri"}, Ranges: overnight}, at(5, "02:00"), false},
+		{"equal bounds cover the whole day", &Schedule{Days: []string{"fri"}, Ranges: []TimeRange{{Start: "00:00", End: "00:00"}}}, at(5, "23:59"), true},
+		{"second range", &Schedule{Ranges: []TimeRange{{Start: "07:00", End: "08:00"}, {Start: "18:00", End: "21:30"}}}, at(5, "20:00"), true},
+		{"invalid range is ignored", &Schedule{Ranges: []TimeRange{{Start: "7pm", End: "21:00"}}}, at(5, "20:00"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.IsActive(tt.at); got != tt.want {
+				t.Errorf("IsActive(%s) = %v, want %v", tt.at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduledRuleEvaluation(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+	rule := blockPortRule("bedtime", 443)
+	rule.Schedule = &Schedule{Ranges: []TimeRange{{Start: "22:00", End: "06:00"}}}
+	packet := &NetworkPacket{Protocol: "tcp", DestPort: 443}
+
+	tests := []struct {
+		clock string
+		want  bool
+	}{
+		{"23:00", true},
+		{"01:30", true},
+		{"12:00", false},
+	}
+
+	for _, tt := range tests {
+		parsed, _ := time.Parse("15:04", tt.clock)
+		now := time.Date(2024, time.January, 5, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+		if _, matched := m.evaluateRules([]*FilteringRule{rule}, packet, now); matched != tt.want {
+			t.Errorf("at %s: matched = %v, want %v", tt.clock, matched, tt.want)
+		}
+	}
+}
+
+func TestRuleChains(t *testing.T) {
+	allowSSH := blockPortRule("allow-ssh", 22)
+	allowSSH.Actions = []string{"allow"}
+	blockTelnet := blockPortRule("block-telnet", 23)
+	blockDNS := blockPortRule("block-dns", 53)
+
+	tests := []struct {
+		name       string
+		chains     []*RuleChain
+		port       int
+		wantAction string
+		wantReason string
+	}{
+		{
+			name:       "default deny blocks unmatched packets",
+			chains:     []*RuleChain{{Name: "lockdown", Rules: []string{"allow-ssh"}, Policy: "deny", Enabled: true}},
+			port:       8080,
+			wantAction: "block",
+			wantReason: "Chain lockdown default policy: deny",
+		},
+		{
+			name:       "default deny lets matching rules decide",
+			chains:     []*RuleChain{{Name: "lockdown", Rules: []string{"allow-ssh"}, Policy: "deny", Enabled: true}},
+			port:       22,
+			wantAction: "allow",
+			wantReason: "Matched rule: allow-ssh",
+		},
+		{
+			name:       "default allow passes unmatched packets",
+			chains:     []*RuleChain{{Name: "legacy", Rules: []string{"block-telnet"}, Policy: "allow", Enabled: true}},
+			port:       8080,
+			wantAction: "allow",
+			wantReason: "No rules matched",
+		},
+		{
+			name:       "default allow still applies its rules",
+			chains:     []*RuleChain{{Name: "legacy", Rules: []string{"block-telnet"}, Policy: "allow", Enabled: true}},
+			port:       23,
+			wantAction: "block",
+			wantReason: "Matched rule: block-telnet",
+		},
+		{
+			name: "packet traverses chains in order",
+			chains: []*RuleChain{
+				{Name: "second", Rules: []string{"allow-ssh"}, Policy: "deny", Order: 2, Enabled: true},
+				{Name: "first", Rules: []string{"block-telnet"}, Policy: "allow", Order: 1, Enabled: true},
+			},
+			port:       8080,
+			wantAction: "block",
+			wantReason: "Chain second default policy: deny",
+		},
+		{
+			name: "earlier chain decides first",
+			chains: []*RuleChain{
+				{Name: "late", Rules: []string{"allow-ssh"}, Policy: "allow", Order: 5, Enabled: true},
+				{Name: "early", Rules: []string{"block-telnet"}, Policy: "deny", Order: 1, Enabled: true},
+			},
+			port:       22,
+			wantAction: "block",
+			wantReason: "Chain early default policy: deny",
+		},
+		{
+			name:       "disabled chain is skipped",
+			chains:     []*RuleChain{{Name: "off", Rules: []string{"allow-ssh"}, Policy: "deny"}},
+			port:       8080,
+			wantAction: "allow",
+			wantReason: "No rules matched",
+		},
+		{
+			name:       "unchained rules run after the chains",
+			chains:     []*RuleChain{{Name: "legacy", Rules: []string{"block-telnet"}, Policy: "allow", Enabled: true}},
+			port:       53,
+			wantAction: "block",
+			wantReason: "Matched rule: block-dns",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestFilteringManager(t, nil)
+			for _, rule := range []*FilteringRule{allowSSH, blockTelnet, blockDNS} {
+				m.ruleEngine.rules[rule.ID] = rule
+			}
+			for _, chain := range tt.chains {
+				if err := m.ruleEngine.AddRuleChain(chain); err != nil {
+					t.Fatalf("AddRuleChain: %v", err)
+				}
+			}
+
+			decision := m.applyFilteringRules(&NetworkPacket{Protocol: "tcp", DestPort: tt.port})
+			if decision.Action != tt.wantAction || decision.Reason != tt.wantReason {
+				t.Errorf("decision = %q (%s), want %q (%s)", decision.Action, decision.Reason, tt.wantAction, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestAddRuleChainValidation(t *testing.T) {
+	m := newTestFilteringManager(t, nil)
+	for _, chain := range []*RuleChain{
+		{Policy: "deny"},
+		{Name: "bad-policy", Policy: "drop"},
+	} {
+		if err := m.ruleEngine.AddRuleChain(chain); err == nil {
+			t.Errorf("AddRuleChain(%+v) succeeded, want an error", *chain)
+		}
+	}
+}
+
+func TestSignatureMatcher(t *testing.T) {
+	s := NewSignatureMatcher()
+	s.Add("he", "test", 1, []byte("he"))
+	s.Add("she", "test", 2, []byte("she"))
+	s.Add("his", "test", 3, []byte("his"))
+	s.Add("hers", "test", 4, []byte("hers"))
+
+	tests := []struct {
+		content string
+		want    string // name@offset, in report order
+	}{
+		{"ushers", "she@1,he@2,hers@2"},
+		{"ahishers", "his@1,she@3,he@4,hers@4"},
+		{"hehehe", "he@0"},
+		{"nothing here", "he@8"},
+		{"xyz", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			var got []string
+			for _, match := range s.Match([]byte(tt.content)) {
+				got = append(got, fmt.Sprintf("%s@%d", match.Name, match.Offset))
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("Match(%q) = %s, want %s", tt.content, strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+
+	// Signatures added after a match are picked up by the next one
+	s.Add("us", "test", 5, []byte("us"))
+	if matches := s.Match([]byte("ushers")); len(matches) != 4 || matches[0].Name != "us" {
+		t.Errorf("after Add: Match = %+v, want us reported first", matches)
+	}
+	if s.Len() != 5 {
+		t.Errorf("Len = %d, want 5", s.Len())
+	}
+}
+
+func TestScanContentSignatures(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{EnableContentFiltering: true})
+
+	// Bury the planted signatures among many that never occur
+	for i := 0; i < 1000; i++ {
+		m.contentFilter.AddContentSignature(ContentSignature{Name: fmt.Sprintf("filler-%d", i), Pattern: fmt.Sprintf("<absent-%04d>", i), Severity: 1})
+	}
+	if err := m.contentFilter.AddContentSignature(ContentSignature{Name: "coinminer", Type: "cryptojacking", Pattern: "CoinHive.Anonymous(", Severity: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.contentFilter.AddMalwareSignature(&MalwareSignature{Name: "eicar", Type: "test", Pattern: "EICAR-STANDARD-ANTIVIRUS-TEST-FILE", Severity: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.contentFilter.AddContentSignature(ContentSignature{Name: "empty"}); err == nil {
+		t.Error("AddContentSignature accepted an empty pattern")
+	}
+
+	body := []byte(`<html><script>var miner = new CoinHive.Anonymous("key");</script>` +
+		`<pre>X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*</pre></html>`)
+	result := m.scanContent(body)
+
+	if !result.Detected || result.Severity != 9 {
+		t.Errorf("Detected = %v, Severity = %d, want true and 9", result.Detected, result.Severity)
+	}
+	if strings.Join(result.Threats, ",") != "coinminer,eicar" {
+		t.Errorf("Threats = %v, want [coinminer eicar]", result.Threats)
+	}
+
+	if clean := m.scanContent([]byte("<html>nothing to see</html>")); clean.Detected {
+		t.Errorf("clean body reported threats %v", clean.Threats)
+	}
+}
+
+// syntheticBlocklist returns a blocklist of n generated domains with its Bloom filter built
+func syntheticBlocklist(n int) *Blocklist {
+	b := &Blocklist{Name: "synthetic", Domains: make(map[string]bool, n), Enabled: true}
+	for i := 0; i < n; i++ {
+		b.Domains[fmt.Sprintf("tracker-%d.example-%d.com", i, i%97)] = true
+	}
+	b.BuildFilter(0.01)
+	return b
+}
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	b := syntheticBlocklist(50000)
+	for domain := range b.Domains {
+		if !b.filter.MayContain(domain) || !b.Contains(domain) {
+			t.Fatalf("%s is in the blocklist but was reported absent", domain)
+		}
+	}
+
+	// False positives stay near the configured rate and never reach the result
+	const probes = 100000
+	falsePositives := 0
+	for i := 0; i < probes; i++ {
+		domain := fmt.Sprintf("clean-%d.example.org", i)
+		if b.filter.MayContain(domain) {
+			falsePositives++
+		}
+		if b.Contains(domain) {
+			t.Fatalf("%s is not in the blocklist but Contains reported it", domain)
+		}
+	}
+	if rate := float64(falsePositives) / probes; rate > 0.02 {
+		t.Errorf("false positive rate %.4f, want about 0.01", rate)
+	}
+}
+
+func TestBlocklistFilterStaysInSync(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(b *Blocklist)
+		domain string
+		want   bool
+	}{
+		{"added through AddDomain", func(b *Blocklist) { b.AddDomain("new.example.com") }, "new.example.com", true},
+		{"added to the map directly", func(b *Blocklist) { b.Domains["direct.example.com"] = true }, "direct.example.com", true},
+		{"never added", func(b *Blocklist) {}, "absent.example.com", false},
+		{"empty blocklist", func(b *Blocklist) { b.Domains = map[string]bool{}; b.BuildFilter(0.01) }, "tracker-1.example-1.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := syntheticBlocklist(100)
+			tt.modify(b)
+			if got := b.Contains(tt.domain); got != tt.want {
+				t.Errorf("Contains(%q) = %v, want %v", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkBlocklistLookup(b *testing.B) {
+	list := syntheticBlocklist(200000)
+	misses := make([]string, 1024)
+	hits := make([]string, 0, len(misses))
+	for i := range misses {
+		misses[i] = fmt.Sprintf("clean-%d.example.org", i)
+	}
+	for domain := range list.Domains {
+		if len(hits) == cap(hits) {
+			break
+		}
+		hits = append(hits, domain)
+	}
+
+	b.Run("map only miss", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = list.Domains[misses[i%len(misses)]]
+		}
+	})
+	b.Run("bloom filter miss", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			list.Contains(misses[i%len(misses)])
+		}
+	})
+	b.Run("bloom filter hit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			list.Contains(hits[i%len(hits)])
+		}
+	})
+}
+
+// fakeCNAMEResolver answers LookupCNAME from a fixed alias table and counts the
+// lookups it serves. Names without an alias resolve to themselves, as with
+// net.Resolver.
+type fakeCNAMEResolver struct {
+	aliases map[string]string
+	lookups atomic.Int32
+}
+
+func (r *fakeCNAMEResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	r.lookups.Add(1)
+	if target, ok := r.aliases[host]; ok {
+		return target + ".", nil
+	}
+	return host + ".", nil
+}
+
+// newCNAMETestManager creates a manager that uncloaks CNAMEs through resolver
+// and blocks the given domains
+func newCNAMETestManager(t *testing.T, resolver CNAMEResolver, maxDepth int, blocked ...string) *SystemWideFilteringManager {
+	t.Helper()
+	m := newTestFilteringManager(t, &SystemFilteringConfig{
+		EnableDNSFiltering: true,
+		CNAMEUncloaking:    true,
+		CNAMEMaxDepth:      maxDepth,
+	})
+	m.dnsFilter.cnameResolver = resolver
+	blocklist := &Blocklist{Name: "trackers", Domains: make(map[string]bool), Enabled: true}
+	for _, domain := range blocked {
+		blocklist.AddDomain(domain)
+	}
+	blocklist.BuildFilter(0.01)
+	m.dnsFilter.blocklists[blocklist.Name] = blocklist
+	return m
+}
+
+func TestCNAMEUncloaking(t *testing.T) {
+	// The DNS packet parser is a stub that always reports example.com, so every
+	// case aliases that name
+	tests := []struct {
+		name     string
+		aliases  map[string]string
+		blocked  []string
+		maxDepth int
+		want     string
+	}{
+		{"alias to blocked tracker", map[string]string{"example.com": "tracker.net"}, []string{"tracker.net"}, 0, "block"},
+		{"blocked at end of chain", map[string]string{"example.com": "metrics.example.com", "metrics.example.com": "edge.cdn.net", "edge.cdn.net": "tracker.net"}, []string{"tracker.net"}, 0, "block"},
+		{"chain with no blocked target", map[string]string{"example.com": "edge.cdn.net"}, []string{"tracker.net"}, 0, "allow"},
+		{"no alias", nil, []string{"tracker.net"}, 0, "allow"},
+		{"blocked target beyond max depth", map[string]string{"example.com": "a.net", "a.net": "b.net", "b.net": "tracker.net"}, []string{"tracker.net"}, 2, "allow"},
+		{"alias loop", map[string]string{"example.com": "a.net", "a.net": "example.com"}, []string{"tracker.net"}, 0, "allow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeCNAMEResolver{aliases: tt.aliases}
+			m := newCNAMETestManager(t, resolver, tt.maxDepth, tt.blocked...)
+			decision := m.processDNSPacket(&NetworkPacket{Protocol: "UDP", DestPort: 53})
+			if decision.Action != tt.want {
+				t.Errorf("Action = %q (%s), want %q", decision.Action, decision.Reason, tt.want)
+			}
+			if tt.want == "block" && !strings.Contains(decision.Reason, "CNAME alias") {
+				t.Errorf("Reason = %q, want it to name the CNAME alias", decision.Reason)
+			}
+		})
+	}
+}
+
+func TestCNAMEUncloakingDisabled(t *testing.T) {
+	resolver := &fakeCNAMEResolver{aliases: map[string]string{"example.com": "tracker.net"}}
+	m := newCNAMETestManager(t, resolver, 0, "tracker.net")
+	m.config.CNAMEUncloaking = false
+
+	if decision := m.processDNSPacket(&NetworkPacket{Protocol: "UDP", DestPort: 53}); decision.Action != "allow" {
+		t.Errorf("Action = %q with uncloaking off, want allow", decision.Action)
+	}
+	if n := resolver.lookups.Load(); n != 0 {
+		t.Errorf("resolver called %d times with uncloaking off, want 0", n)
+	}
+}
+
+func TestCNAMEChainCached(t *testing.T) {
+	resolver := &fakeCNAMEResolver{aliases: map[string]string{"metrics.example.com": "edge.cdn.net", "edge.cdn.net": "tracker.net"}}
+	m := newCNAMETestManager(t, resolver, 0)
+
+	want := []string{"edge.cdn.net", "tracker.net"}
+	first := m.dnsFilter.resolveCNAMEChain("metrics.example.com")
+	lookups := resolver.lookups.Load()
+	second := m.dnsFilter.resolveCNAMEChain("metrics.example.com")
+
+	for _, chain := range [][]string{first, second} {
+		if strings.Join(chain, " ") != strings.Join(want, " ") {
+			t.Errorf("chain = %v, want %v", chain, want)
+		}
+	}
+	if n := resolver.lookups.Load(); n != lookups {
+		t.Errorf("second resolution made %d more lookups, want 0", n-lookups)
+	}
+}
+
+// parseIPs parses a list of addresses, failing the test on a bad one
+func parseIPs(t *testing.T, addrs ...string) []net.IP {
+	t.Helper()
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			t.Fatalf("invalid IP %q", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func TestDNSRebindingProtection(t *testing.T) {
+	tests := []struct {
+		name      string
+		domain    string
+		ips       []string
+		action    string
+		allowlist []string
+		wantRCode string
+		wantIPs   []string
+		wantCount int64
+	}{
+		{"loopback answer", "evil.example.com", []string{"127.0.0.1"}, "", nil, "NXDOMAIN", nil, 1},
+		{"private answer", "evil.example.com", []string{"10.0.0.5"}, "", nil, "NXDOMAIN", nil, 1},
+		{"IPv6 loopback answer", "evil.example.com", []string{"::1"}, "", nil, "NXDOMAIN", nil, 1},
+		{"link-local answer", "evil.example.com", []string{"169.254.169.254"}, "", nil, "NXDOMAIN", nil, 1},
+		{"mixed answer", "evil.example.com", []string{"93.184.216.34", "10.1.2.3"}, "", nil, "NXDOMAIN", nil, 1},
+		{"mixed answer stripped", "evil.example.com", []string{"93.184.216.34", "10.1.2.3"}, "strip", nil, "", []string{"93.184.216.34"}, 1},
+		{"only private answer stripped", "evil.example.com", []string{"127.0.0.1"}, "strip", nil, "NXDOMAIN", nil, 1},
+		{"public answer", "example.com", []string{"93.184.216.34"}, "", nil, "", []string{"93.184.216.34"}, 0},
+		{"allowlisted domain", "router.lan", []string{"192.168.1.1"}, "", []string{"lan"}, "", []string{"192.168.1.1"}, 0},
+		{"allowlist does not match suffix text", "evillan", []string{"192.168.1.1"}, "", []string{"lan"}, "NXDOMAIN", nil, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestFilteringManager(t, &SystemFilteringConfig{
+				EnableDNSFiltering:     true,
+				DNSRebindingProtection: true,
+				DNSRebindingAction:     tt.action,
+				DNSRebindingAllowlist:  tt.allowlist,
+			})
+
+			got := m.FilterDNSResponse(&DNSResponse{Domain: tt.domain, Type: "A", TTL: 60, IPs: parseIPs(t, tt.ips...), Source: "upstream"})
+			if got.RCode != tt.wantRCode {
+				t.Errorf("RCode = %q, want %q", got.RCode, tt.wantRCode)
+			}
+			if blocked := tt.wantRCode == "NXDOMAIN"; got.Blocked != blocked {
+				t.Errorf("Blocked = %v, want %v", got.Blocked, blocked)
+			}
+			if fmt.Sprint(got.IPs) != fmt.Sprint(parseIPs(t, tt.wantIPs...)) {
+				t.Errorf("IPs = %v, want %v", got.IPs, tt.wantIPs)
+			}
+			if n := atomic.LoadInt64(&m.metrics.DNSRebindingBlocked); n != tt.wantCount {
+				t.Errorf("DNSRebindingBlocked = %d, want %d", n, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestDNSRebindingProtectionDisabled(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{EnableDNSFiltering: true})
+
+	got := m.FilterDNSResponse(&DNSResponse{Domain: "evil.example.com", Type: "A", IPs: parseIPs(t, "127.0.0.1")})
+	if got.Blocked || len(got.IPs) != 1 {
+		t.Errorf("answer = %+v, want it passed through unchanged", got)
+	}
+	if n := atomic.LoadInt64(&m.metrics.DNSRebindingBlocked); n != 0 {
+		t.Errorf("DNSRebindingBlocked = %d, want 0", n)
+	}
+}
+
+func TestDNSRebindingAnswerCached(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{EnableDNSFiltering: true, DNSRebindingProtection: true})
+	m.FilterDNSResponse(&DNSResponse{Domain: "evil.example.com", Type: "A", TTL: 60, IPs: parseIPs(t, "10.0.0.1")})
+
+	cached, ok := m.dnsFilter.dnsCache.Get("evil.example.com", "A")
+	if !ok || !cached.Blocked || cached.RCode != "NXDOMAIN" {
+		t.Errorf("cached answer = %+v, %v, want the NXDOMAIN", cached, ok)
+	}
+}
+
+func TestBlockQUIC(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockQUIC bool
+		ports     []int
+		packet    NetworkPacket
+		want      string
+	}{
+		{"outbound UDP 443 blocked", true, nil, NetworkPacket{Protocol: "UDP", DestPort: 443, Direction: "outbound"}, "block"},
+		{"lower-case protocol blocked", true, nil, NetworkPacket{Protocol: "udp", DestPort: 443, Direction: "outbound"}, "block"},
+		{"unknown direction blocked", true, nil, NetworkPacket{Protocol: "UDP", DestPort: 443}, "block"},
+		{"option disabled", false, nil, NetworkPacket{Protocol: "UDP", DestPort: 443, Direction: "outbound"}, "allow"},
+		{"TCP 443 passes", true, nil, NetworkPacket{Protocol: "TCP", DestPort: 443, Direction: "outbound"}, "allow"},
+		{"other UDP port passes", true, nil, NetworkPacket{Protocol: "UDP", DestPort: 123, Direction: "outbound"}, "allow"},
+		{"inbound UDP 443 passes", true, nil, NetworkPacket{Protocol: "UDP", DestPort: 443, Direction: "inbound"}, "allow"},
+		{"configured port blocked", true, []int{443, 8443}, NetworkPacket{Protocol: "UDP", DestPort: 8443, Direction: "outbound"}, "block"},
+		{"default port not in configured list", true, []int{8443}, NetworkPacket{Protocol: "UDP", DestPort: 443, Direction: "outbound"}, "allow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestFilteringManager(t, &SystemFilteringConfig{BlockQUIC: tt.blockQUIC, QUICPorts: tt.ports})
+			packet := tt.packet
+			if got := m.ProcessPacket(&packet); got.Action != tt.want {
+				t.Errorf("Action = %q (%s), want %q", got.Action, got.Reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockQUICFirewallRules(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{
+		EnableFirewallIntegration: true,
+		FirewallProvider:          "iptables",
+		FirewallDryRun:            true,
+		FirewallPersistPath:       filepath.Join(t.TempDir(), "rules.v4"),
+		BlockQUIC:                 true,
+		QUICPorts:                 []int{443, 8443},
+	})
+
+	var got []string
+	for _, cmd := range m.firewallIntegration.ruleManager.(*IptablesManager).ExecutedCommands() {
+		got = append(got, strings.Join(cmd, " "))
+	}
+	// Both address families are covered since the rules name no address
+	want := []string{
+		"iptables -A OUTPUT -p udp --dport 443 -m comment --comment oblivionfilter:block-quic-443 -j DROP",
+		"ip6tables -A OUTPUT -p udp --dport 443 -m comment --comment oblivionfilter:block-quic-443 -j DROP",
+		"iptables -A OUTPUT -p udp --dport 8443 -m comment --comment oblivionfilter:block-quic-8443 -j DROP",
+		"ip6tables -A OUTPUT -p udp --dport 8443 -m comment --comment oblivionfilter:block-quic-8443 -j DROP",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ExecutedCommands =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The rules are recreated on every start rather than persisted
+	if _, err := os.Stat(m.config.FirewallPersistPath); !os.IsNotExist(err) {
+		t.Errorf("QUIC rules were persisted (stat: %v)", err)
+	}
+}
+
+// newQuotaTestManager creates a manager with process filtering and a known process
+// for each of the given PIDs, named after the map values
+func newQuotaTestManager(t *testing.T, processes map[int]string, rules ...*ProcessRule) *SystemWideFilteringManager {
+	t.Helper()
+	m := newTestFilteringManager(t, &SystemFilteringConfig{EnableProcessFiltering: true})
+	for pid, name := range processes {
+		m.processFilter.processInfo[pid] = &ProcessInfo{PID: pid, Name: name, Path: "/usr/bin/" + name}
+	}
+	for _, rule := range rules {
+		m.processFilter.processRules[rule.ProcessName] = rule
+	}
+	return m
+}
+
+func TestProcessDataQuota(t *testing.T) {
+	rule := &ProcessRule{ProcessName: "curl", NetworkAccess: true, QuotaBytes: 1000, Enabled: true}
+	m := newQuotaTestManager(t, map[int]string{100: "curl", 200: "wget"}, rule)
+
+	tests := []struct {
+		pid  int
+		size int
+		want string
+	}{
+		{100, 300, "allow"},
+		{100, 300, "allow"},
+		{100, 400, "allow"}, // exactly at the quota
+		{100, 1, "block"},
+		{200, 5000, "allow"}, // other processes are not affected
+		{100, 0, "block"},    // stays blocked for the rest of the period
+	}
+
+	for i, tt := range tests {
+		packet := &NetworkPacket{Protocol: "TCP", DestPort: 8080, ProcessID: tt.pid, Direction: "outbound", Data: make([]byte, tt.size)}
+		if got := m.ProcessPacket(packet); got.Action != tt.want {
+			t.Fatalf("packet %d (pid %d, %d bytes): Action = %q (%s), want %q", i, tt.pid, tt.size, got.Action, got.Reason, tt.want)
+		}
+	}
+
+	// Only allowed packets are counted
+	if got := m.processFilter.ProcessBytes("curl"); got != 1000 {
+		t.Errorf("ProcessBytes(curl) = %d, want 1000", got)
+	}
+	if got := m.processFilter.ProcessBytes("wget"); got != 5000 {
+		t.Errorf("ProcessBytes(wget) = %d, want 5000", got)
+	}
+}
+
+func TestProcessTrafficAccounting(t *testing.T) {
+	m := newQuotaTestManager(t, map[int]string{100: "curl", 101: "curl"})
+
+	packets := []struct {
+		pid       int
+		direction string
+		size      int
+	}{
+		{100, "outbound", 100},
+		{100, "inbound", 1000},
+		{101, "outbound", 50},
+		{101, "", 25}, // unknown direction counts as sent
+	}
+	for _, p := range packets {
+		m.ProcessPacket(&NetworkPacket{Protocol: "TCP", DestPort: 8080, ProcessID: p.pid, Direction: p.direction, Data: make([]byte, p.size)})
+	}
+
+	for pid, want := range map[int][2]int64{100: {100, 1000}, 101: {75, 0}} {
+		info := m.processFilter.processInfo[pid]
+		if info.BytesSent != want[0] || info.BytesReceived != want[1] {
+			t.Errorf("pid %d: sent %d, received %d, want %d and %d", pid, info.BytesSent, info.BytesReceived, want[0], want[1])
+		}
+	}
+	// Processes sharing a name share the per-name total
+	if got := m.processFilter.ProcessBytes("curl"); got != 1175 {
+		t.Errorf("ProcessBytes(curl) = %d, want 1175", got)
+	}
+}
+
+func TestProcessQuotaResets(t *testing.T) {
+	tests := []struct {
+		period string
+		next   time.Duration // a time in the following period
+	}{
+		{"hourly", time.Hour},
+		{"daily", 24 * time.Hour},
+		{"", 24 * time.Hour},
+		{"weekly", 7 * 24 * time.Hour},
+		{"monthly", 31 * 24 * time.Hour},
+	}
+
+	start := time.Date(2024, time.March, 6, 10, 30, 0, 0, time.Local)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("period %q", tt.period), func(t *testing.T) {
+			m := newQuotaTestManager(t, nil)
+			rule := &ProcessRule{ProcessName: "curl", QuotaBytes: 100, QuotaPeriod: tt.period}
+
+			if !m.processFilter.chargeQuota(rule, "curl", 100, start) {
+				t.Fatal("first 100 bytes rejected")
+			}
+			if m.processFilter.chargeQuota(rule, "curl", 1, start.Add(time.Minute)) {
+				t.Fatal("quota not enforced within the period")
+			}
+			if !m.processFilter.chargeQuota(rule, "curl", 100, start.Add(tt.next)) {
+				t.Error("quota did not reset in the next period")
+			}
+		})
+	}
+}
+
+func TestQuotaPeriodStart(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2024, time.March, 6, 10, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		period string
+		want   time.Time
+	}{
+		{"hourly", time.Date(2024, time.March, 6, 10, 0, 0, 0, time.UTC)},
+		{"daily", time.Date(2024, time.March, 6, 0, 0, 0, 0, time.UTC)},
+		{"", time.Date(2024, time.March, 6, 0, 0, 0, 0, time.UTC)},
+		{"weekly", time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		if got := quotaPeriodStart(tt.period, now); !got.Equal(tt.want) {
+			t.Errorf("quotaPeriodStart(%q) = %v, want %v", tt.period, got, tt.want)
+		}
+	}
+
+	// Sunday still belongs to the week that started on Monday
+	sunday := time.Date(2024, time.March, 10, 23, 0, 0, 0, time.UTC)
+	if got := quotaPeriodStart("weekly", sunday); !got.Equal(time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("quotaPeriodStart(weekly, Sunday) = %v, want Monday March 4", got)
+	}
+}
+
+func TestConditionalForwarding(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{
+		EnableDNSFiltering: true,
+		DNSServers:         []string{"https://dns.example/dns-query"},
+		DNSConditionalForwarders: map[string]string{
+			"corp.example.com":     "10.0.0.53",
+			"dev.corp.example.com": "10.1.0.53",
+			".Lan.":                "192.168.1.1",
+			"":                     "10.9.9.9",
+			"ignored.example":      "",
+		},
+	})
+	defaults := []string{"https://dns.example/dns-query"}
+
+	tests := []struct {
+		domain string
+		want   []string
+	}{
+		{"corp.example.com", []string{"10.0.0.53"}},
+		{"wiki.corp.example.com", []string{"10.0.0.53"}},
+		{"build.dev.corp.example.com", []string{"10.1.0.53"}},
+		{"dev.corp.example.com.", []string{"10.1.0.53"}},
+		{"PRINTER.LAN", []string{"192.168.1.1"}},
+		{"example.com", defaults},
+		{"notcorp.example.com", defaults},
+		{"ignored.example", defaults},
+		{"www.google.com", defaults},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if got := m.dnsFilter.UpstreamsFor(tt.domain); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UpstreamsFor(%q) = %v, want %v", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSQueryForwarding(t *testing.T) {
+	// The DNS packet parser is a stub that always reports example.com
+	tests := []struct {
+		name       string
+		servers    []string
+		forwarders map[string]string
+		destIP     string
+		want       string
+		wantTarget string
+	}{
+		{"conditional forwarder", []string{"8.8.8.8"}, map[string]string{"example.com": "10.0.0.53"}, "8.8.8.8", "redirect", "10.0.0.53:53"},
+		{"forwarder with port", nil, map[string]string{"example.com": "10.0.0.53:5353"}, "8.8.8.8", "redirect", "10.0.0.53:5353"},
+		{"already sent to the forwarder", nil, map[string]string{"example.com": "10.0.0.53"}, "10.0.0.53", "allow", ""},
+		{"other suffix uses the upstream servers", []string{"8.8.8.8"}, map[string]string{"corp.example.com": "10.0.0.53"}, "9.9.9.9", "redirect", "8.8.8.8:53"},
+		{"sent to a configured upstream", []string{"8.8.8.8", "1.1.1.1"}, nil, "1.1.1.1", "allow", ""},
+		{"doh upstream", []string{"https://dns.example/dns-query"}, nil, "9.9.9.9", "allow", ""},
+		{"no upstreams", nil, nil, "9.9.9.9", "allow", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestFilteringManager(t, &SystemFilteringConfig{
+				EnableDNSFiltering:       true,
+				DNSServers:               tt.servers,
+				DNSConditionalForwarders: tt.forwarders,
+			})
+			packet := &NetworkPacket{Protocol: "UDP", DestIP: net.ParseIP(tt.destIP), DestPort: 53}
+			decision := m.processDNSPacket(packet)
+			if decision.Action != tt.want || decision.Target != tt.wantTarget {
+				t.Errorf("decision = %s %q (%s), want %s %q", decision.Action, decision.Target, decision.Reason, tt.want, tt.wantTarget)
+			}
+			if tt.want == "redirect" {
+				if got := m.ProcessPacket(packet); got.Action != "redirect" || got.Target != tt.wantTarget {
+					t.Errorf("ProcessPacket = %s %q, want the redirect", got.Action, got.Target)
+				}
+			}
+		})
+	}
+}
+
+// ageDNSCache moves every cached answer back in time by age
+func ageDNSCache(c *DNSCache, age time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, entry := range c.entries {
+		entry.Timestamp = entry.Timestamp.Add(-age)
+	}
+}
+
+func TestDNSNegativeCacheTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		configTTL  int
+		response   DNSResponse
+		wantTTL    time.Duration
+		wantCached bool
+	}{
+		{"nxdomain default ttl", 0, DNSResponse{Domain: "dead.example", Type: "A", RCode: "NXDOMAIN"}, 60 * time.Second, true},
+		{"nxdomain configured ttl", 15, DNSResponse{Domain: "dead.example", Type: "A", RCode: "NXDOMAIN"}, 15 * time.Second, true},
+		{"nxdomain soa minimum", 15, DNSResponse{Domain: "dead.example", Type: "A", RCode: "NXDOMAIN", SOAMinimum: 120}, 120 * time.Second, true},
+		{"soa minimum capped", 0, DNSResponse{Domain: "dead.example", Type: "A", RCode: "NXDOMAIN", SOAMinimum: 86400}, 300 * time.Second, true},
+		{"blocked", 30, DNSResponse{Domain: "ads.example", Blocked: true, RCode: "NXDOMAIN"}, 30 * time.Second, true},
+		{"positive answer uses record ttl", 15, DNSResponse{Domain: "example.com", Type: "A", TTL: 200, IPs: []net.IP{net.ParseIP("93.184.216.34")}}, 200 * time.Second, true},
+		{"zero ttl answer not cached", 15, DNSResponse{Domain: "example.com", Type: "A", IPs: []net.IP{net.ParseIP("93.184.216.34")}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestFilteringManager(t, &SystemFilteringConfig{EnableDNSFiltering: true, DNSNegativeCacheTTL: tt.configTTL})
+			cache := m.dnsFilter.dnsCache
+			response := tt.response
+			cache.Set(&response)
+
+			if !tt.wantCached {
+				if _, ok := cache.Get(tt.response.Domain, "A"); ok {
+					t.Error("answer was cached")
+				}
+				return
+			}
+			// Just before the TTL runs out the answer is still served, just after it is gone
+			ageDNSCache(cache, tt.wantTTL-time.Second)
+			cached, ok := cache.Get(tt.response.Domain, "A")
+			if !ok {
+				t.Fatalf("answer expired before %v", tt.wantTTL)
+			}
+			if cached.Source != "cache" {
+				t.Errorf("Source = %q, want cache", cached.Source)
+			}
+			ageDNSCache(cache, 2*time.Second)
+			if _, ok := cache.Get(tt.response.Domain, "A"); ok {
+				t.Errorf("answer still cached after %v", tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDNSNegativeCacheCoversAllTypes(t *testing.T) {
+	m := newTestFilteringManager(t, &SystemFilteringConfig{EnableDNSFiltering: true})
+	m.FilterDNSResponse(&DNSResponse{Domain: "Dead.Example.", Type: "A", RCode: "NXDOMAIN", Source: "upstream"})
+
+	// A retry for the same name, whatever its type, never reaches upstream
+	for _, qtype := range []string{"A", "AAAA", "MX"} {
+		cached, ok := m.dnsFilter.dnsCache.Get("dead.example", qtype)
+		if !ok || cached.RCode != "NXDOMAIN" || cached.Source != "cache" {
+			t.Errorf("%s lookup = %+v, %v, want the cached NXDOMAIN", qtype, cached, ok)
+		}
+	}
+
+	// The name resolving again replaces the negative entry
+	m.FilterDNSResponse(&DNSResponse{Domain: "dead.example", Type: "A", TTL: 60, IPs: parseIPs(t, "93.184.216.34"), Source: "upstream"})
+	if cached, ok := m.dnsFilter.dnsCache.Get("dead.example", "AAAA"); ok {
+		t.Errorf("AAAA lookup = %+v, want a miss once the name resolves", cached)
+	}
+	if cached, ok := m.dnsFilter.dnsCache.Get("dead.example", "A"); !ok || cached.Blocked {
+		t.Errorf("A lookup = %+v, %v, want the positive answer", cached, ok)
+	}
+}
+
+func TestBlockedDomainCached(t *testing.T) {
+	// The DNS packet parser is a stub that always reports example.com
+	m := newCNAMETestManager(t, &fakeCNAMEResolver{}, 0, "example.com")
+	packet := &NetworkPacket{Protocol: "UDP", DestPort: 53}
+
+	if decision := m.processDNSPacket(packet); decision.Action != "block" {
+		t.Fatalf("first lookup: Action = %q, want block", decision.Action)
+	}
+
+	// The retry is answered from the negative cache, not the blocklists
+	delete(m.dnsFilter.blocklists, "trackers")
+	decision := m.processDNSPacket(packet)
+	if decision.Action != "block" || !strings.Contains(decision.Reason, "cached") {
+		t.Errorf("retry: %+v, want a cached block", decision)
+	}
+
+	ageDNSCache(m.dnsFilter.dnsCache, 61*time.Second)
+	if decision := m.processDNSPacket(packet); decision.Action != "allow" {
+		t.Errorf("after the negative TTL: Action = %q, want allow", decision.Action)
+	}
+}
+
+func TestUpstreamNXDOMAINServedFromCache(t *testing.T) {
+	// The DNS packet parser is a stub that always reports example.com
+	m := newCNAMETestManager(t, &fakeCNAMEResolver{}, 0)
+	packet := &NetworkPacket{Protocol: "UDP", DestPort: 53}
+
+	m.FilterDNSResponse(&DNSResponse{Domain: "example.com", Type: "A", RCode: "NXDOMAIN", Source: "upstream"})
+	decision := m.processDNSPacket(packet)
+	if decision.Action != "block" || !strings.Contains(decision.Reason, "does not exist") {
+		t.Errorf("lookup after NXDOMAIN: %+v, want the cached NXDOMAIN", decision)
+	}
+
+	// Upstream answers are not tied to the lists
+	m.dnsFilter.SetBlocklist(&Blocklist{Name: "other", Domains: make(map[string]bool), Enabled: true})
+	if decision := m.processDNSPacket(packet); decision.Action != "block" {
+		t.Errorf("after a blocklist change: Action = %q, want the cached NXDOMAIN", decision.Action)
+	}
+}
+
+func TestBlockedCacheFlushedOnListChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(d *DNSFilterEngine)
+		want   string
+	}{
+		{"blocklist removed", func(d *DNSFilterEngine) { d.RemoveBlocklist("trackers") }, "allow"},
+		{"blocklist replaced", func(d *DNSFilterEngine) {
+			d.SetBlocklist(&Blocklist{Name: "trackers", Domains: make(map[string]bool), Enabled: true})
+		}, "allow"},
+		// Still blocked, but decided by the blocklist again rather than the cache
+		{"whitelist changed", func(d *DNSFilterEngine) {
+			d.SetWhitelist(&Whitelist{Name: "default", Domains: map[string]bool{"other.example": true}, Enabled: true})
+		}, "block"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The DNS packet parser is a stub that always reports example.com
+			m := newCNAMETestManager(t, &fakeCNAMEResolver{}, 0, "example.com")
+			packet := &NetworkPacket{Protocol: "UDP", DestPort: 53}
+			if decision := m.processDNSPacket(packet); decision.Action != "block" {
+				t.Fatalf("first lookup: Action = %q, want block", decision.Action)
+			}
+
+			tt.change(m.dnsFilter)
+			if decision := m.processDNSPacket(packet); decision.Action != tt.want || strings.Contains(decision.Reason, "cached") {
+				t.Errorf("after the change: %+v, want %s without the cache", decision, tt.want)
+			}
+		})
+	}
+}
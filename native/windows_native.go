@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -28,7 +29,7 @@ import (
 	"syscall"
 	"time"
 	"unsafe"
-
+	
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"golang.org/x/sys/windows/svc"
@@ -48,6 +49,10 @@ type WindowsNativeManager struct {
 	browserManager  *WindowsBrowserManager
 	securityManager *WindowsSecurityManager
 	installPath     string
+	registryRoot    registry.Key // hive holding per-user proxy settings, HKCU unless overridden
+	machineRegistryRoot registry.Key // hive holding machine-wide proxy settings, HKLM unless overridden
+	isAdmin         func() bool
+	runCommand      func(name string, args ...string) ([]byte, error)
 	isService       bool
 	ctx             context.Context
 	cancel          context.CancelFunc
@@ -61,6 +66,7 @@ type WindowsProxyConfig struct {
 	Bypass       string `json:"bypass"`
 	AutoConfigURL string `json:"autoConfigURL"`
 	PACFile      string `json:"pacFile"`
+	MachineWide  bool   `json:"machineWide"` // configure HKLM for all users; requires administrator
 }
 
 // Windows Browser Manager
@@ -110,6 +116,21 @@ const (
 	PROXY_TYPE_AUTO_DETECT              = 8
 )
 
+// Registry locations
+const (
+	internetSettingsKey  = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+	proxyBackupKey       = `Software\OblivionFilter\ProxyBackup`
+	proxyBackupMissing   = "MissingValues" // original values that did not exist
+	proxyPolicyKey       = `Software\Policies\Microsoft\Windows\CurrentVersion\Internet Settings`
+	proxyPerUserValue    = "ProxySettingsPerUser" // 0 makes WinINET use the HKLM settings
+	winHTTPSettingsKey   = internetSettingsKey + `\Connections`
+	winHTTPSettingsValue = "WinHttpSettings" // the machine-wide WinHTTP proxy written by netsh winhttp
+	winHTTPBackupKey     = `Software\OblivionFilter\WinHTTPBackup`
+)
+
+// WinINET values saved before SetupSystemProxy overwrites them
+var wininetProxyValues = []string{"ProxyEnable", "ProxyServer", "ProxyOverride"}
+
 // Windows service implementation
 type oblivionService struct {
 	manager *WindowsNativeManager
@@ -159,7 +180,11 @@ func NewWindowsNativeManager() *WindowsNativeManager {
 		ctx:                ctx,
 		cancel:             cancel,
 		installPath:        getInstallPath(),
+		registryRoot:       registry.CURRENT_USER,
+		machineRegistryRoot: registry.LOCAL_MACHINE,
+		runCommand:         runWindowsCommand,
 	}
+	manager.isAdmin = manager.isRunningAsAdmin
 	
 	// Initialize logger
 	manager.initLogger()
@@ -369,6 +394,12 @@ func (w *WindowsNativeManager) UninstallService() error {
 		w.logger.Printf("Failed to remove event log: %v", err)
 	}
 	
+	// Remove Defender exclusions and firewall rules
+	err = w.TeardownWindowsSecurity()
+	if err != nil {
+		w.logger.Printf("Failed to remove Windows security features: %v", err)
+	}
+	
 	w.logger.Println("Windows service uninstalled successfully")
 	return nil
 }
@@ -507,8 +538,19 @@ func (w *WindowsNativeManager) stopService() {
 func (w *WindowsNativeManager) SetupSystemProxy() error {
 	w.logger.Println("Setting up Windows system proxy...")
 	
+	root, err := w.proxyRegistryRoot()
+	if err != nil {
+		return err
+	}
+	
+	// Stash the current settings so cleanup can put them back
+	err = w.saveProxySettings(root)
+	if err != nil {
+		return fmt.Errorf("failed to save current proxy settings: %v", err)
+	}
+	
 	// Open Internet Settings registry key
-	key, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.SET_VALUE)
+	key, err := registry.OpenKey(root, internetSettingsKey, registry.SET_VALUE)
 	if err != nil {
 		return fmt.Errorf("failed to open registry key: %v", err)
 	}
@@ -533,9 +575,28 @@ func (w *WindowsNativeManager) SetupSystemProxy() error {
 		return fmt.Errorf("failed to set proxy bypass: %v", err)
 	}
 	
+	// Make WinINET read the machine settings instead of each user's
+	if w.proxyConfig.MachineWide {
+		err = w.setProxySettingsPerUser(root, 0)
+		if err != nil {
+			return fmt.Errorf("failed to enable machine-wide proxy policy: %v", err)
+		}
+	}
+	
 	// Notify system of changes
 	w.notifyProxyChange()
 	
+	// WinHTTP keeps its own machine-wide setting used by services and background
+	// apps. Writing it needs administrator rights, so a failure is not fatal. It is
+	// only changed once the current setting is saved, so cleanup can put it back.
+	err = w.saveWinHTTPSettings()
+	if err == nil {
+		err = w.setWinHTTPProxy(proxyServer, w.proxyConfig.Bypass)
+	}
+	if err != nil {
+		w.logger.Printf("Failed to configure WinHTTP proxy: %v", err)
+	}
+	
 	w.logger.Printf("System proxy configured: %s", proxyServer)
 	return nil
 }
@@ -544,8 +605,28 @@ func (w *WindowsNativeManager) SetupSystemProxy() error {
 func (w *WindowsNativeManager) CleanupSystemProxy() error {
 	w.logger.Println("Cleaning up Windows system proxy...")
 	
-	// Open Internet Settings registry key
-	key, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.SET_VALUE)
+	root, err := w.proxyRegistryRoot()
+	if err != nil {
+		return err
+	}
+	
+	err = w.restoreWinHTTPSettings()
+	if err != nil {
+		w.logger.Printf("Failed to restore WinHTTP proxy: %v", err)
+	}
+	
+	restored, err := w.restoreProxySettings(root)
+	if err != nil {
+		return fmt.Errorf("failed to restore proxy settings: %v", err)
+	}
+	if restored {
+		w.notifyProxyChange()
+		w.logger.Println("Restored original proxy settings")
+		return nil
+	}
+	
+	// Nothing saved; just disable our proxy
+	key, err := registry.OpenKey(root, internetSettingsKey, registry.SET_VALUE)
 	if err != nil {
 		return fmt.Errorf("failed to open registry key: %v", err)
 	}
@@ -570,6 +651,325 @@ func (w *WindowsNativeManager) CleanupSystemProxy() error {
 	return nil
 }
 
+// Set the WinHTTP proxy to the same server and bypass list as WinINET
+func (w *WindowsNativeManager) setWinHTTPProxy(proxyServer, bypass string) error {
+	args := []string{"winhttp", "set", "proxy", "proxy-server=" + proxyServer}
+	if bypass != "" {
+		args = append(args, "bypass-list="+bypass)
+	}
+	return w.netsh(args...)
+}
+
+// Reset the WinHTTP proxy to direct access
+func (w *WindowsNativeManager) resetWinHTTPProxy() error {
+	return w.netsh("winhttp", "reset", "proxy")
+}
+
+// Copy the WinHTTP proxy setting into its own backup key under HKLM. As with
+// saveProxySettings, an existing backup still holds the original and is kept. A
+// backup without the value means WinHTTP was using direct access.
+func (w *WindowsNativeManager) saveWinHTTPSettings() error {
+	root := w.machineRegistryRoot
+	backup, err := registry.OpenKey(root, winHTTPBackupKey, registry.QUERY_VALUE)
+	if err == nil {
+		backup.Close()
+		w.logger.Println("Keeping existing WinHTTP proxy backup")
+		return nil
+	}
+	
+	backup, _, err = registry.CreateKey(root, winHTTPBackupKey, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to create WinHTTP backup key: %v", err)
+	}
+	defer backup.Close()
+	
+	settings, err := registry.OpenKey(root, winHTTPSettingsKey, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return nil
+	}
+	if err == nil {
+		_, err = copyRegistryValue(settings, backup, winHTTPSettingsValue)
+		settings.Close()
+	}
+	if err != nil {
+		registry.DeleteKey(root, winHTTPBackupKey)
+		return fmt.Errorf("failed to save %s: %v", winHTTPSettingsValue, err)
+	}
+	
+	return nil
+}
+
+// Write back the WinHTTP proxy saved by saveWinHTTPSettings and remove the backup,
+// resetting to direct access if there was no setting to save
+func (w *WindowsNativeManager) restoreWinHTTPSettings() error {
+	root := w.machineRegistryRoot
+	backup, err := registry.OpenKey(root, winHTTPBackupKey, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return w.resetWinHTTPProxy()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open WinHTTP backup key: %v", err)
+	}
+	defer backup.Close()
+	
+	_, _, err = backup.GetValue(winHTTPSettingsValue, nil)
+	if err == registry.ErrNotExist {
+		err = w.resetWinHTTPProxy()
+	} else {
+		var settings registry.Key
+		settings, _, err = registry.CreateKey(root, winHTTPSettingsKey, registry.SET_VALUE)
+		if err == nil {
+			_, err = copyRegistryValue(backup, settings, winHTTPSettingsValue)
+			settings.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	
+	backup.Close()
+	return registry.DeleteKey(root, winHTTPBackupKey)
+}
+
+// Run netsh with the given arguments
+func (w *WindowsNativeManager) netsh(args ...string) error {
+	output, err := w.runCommand("netsh", args...)
+	if err != nil {
+		return fmt.Errorf("netsh %s failed: %v, output: %s", strings.Join(args, " "), err, output)
+	}
+	return nil
+}
+
+func runWindowsCommand(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// Select the hive for proxy settings. Machine-wide settings live under HKLM and
+// can only be written by an administrator.
+func (w *WindowsNativeManager) proxyRegistryRoot() (registry.Key, error) {
+	if !w.proxyConfig.MachineWide {
+		return w.registryRoot, nil
+	}
+	if !w.isAdmin() {
+		return 0, fmt.Errorf("administrator privileges required for machine-wide proxy")
+	}
+	return w.machineRegistryRoot, nil
+}
+
+// Set the ProxySettingsPerUser policy value
+func (w *WindowsNativeManager) setProxySettingsPerUser(root registry.Key, value uint32) error {
+	policy, _, err := registry.CreateKey(root, proxyPolicyKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer policy.Close()
+	
+	return policy.SetDWordValue(proxyPerUserValue, value)
+}
+
+// Copy the WinINET proxy values into the app's backup key. An existing backup
+// is from a run that did not clean up and still holds the user's originals, so
+// it is kept.
+func (w *WindowsNativeManager) saveProxySettings(root registry.Key) error {
+	backup, err := registry.OpenKey(root, proxyBackupKey, registry.QUERY_VALUE)
+	if err == nil {
+		backup.Close()
+		w.logger.Println("Keeping existing proxy settings backup")
+		return nil
+	}
+	
+	settings, err := registry.OpenKey(root, internetSettingsKey, registry.QUERY_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to open registry key: %v", err)
+	}
+	defer settings.Close()
+	
+	backup, _, err = registry.CreateKey(root, proxyBackupKey, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to create backup key: %v", err)
+	}
+	defer backup.Close()
+	
+	var missing []string
+	for _, name := range wininetProxyValues {
+		found, err := copyRegistryValue(settings, backup, name)
+		if err != nil {
+			registry.DeleteKey(root, proxyBackupKey)
+			return fmt.Errorf("failed to save %s: %v", name, err)
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	
+	// Machine-wide mode also changes the per-user policy
+	if w.proxyConfig.MachineWide {
+		found := false
+		policy, err := registry.OpenKey(root, proxyPolicyKey, registry.QUERY_VALUE)
+		if err == nil {
+			found, err = copyRegistryValue(policy, backup, proxyPerUserValue)
+			policy.Close()
+		} else if err == registry.ErrNotExist {
+			err = nil
+		}
+		if err != nil {
+			registry.DeleteKey(root, proxyBackupKey)
+			return fmt.Errorf("failed to save %s: %v", proxyPerUserValue, err)
+		}
+		if !found {
+			missing = append(missing, proxyPerUserValue)
+		}
+	}
+	
+	err = backup.SetStringsValue(proxyBackupMissing, missing)
+	if err != nil {
+		registry.DeleteKey(root, proxyBackupKey)
+		return fmt.Errorf("failed to save missing values: %v", err)
+	}
+	
+	return nil
+}
+
+// Write the backed up values back verbatim and remove the backup key. Reports
+// false if there was no backup.
+func (w *WindowsNativeManager) restoreProxySettings(root registry.Key) (bool, error) {
+	backup, err := registry.OpenKey(root, proxyBackupKey, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open backup key: %v", err)
+	}
+	defer backup.Close()
+	
+	settings, err := registry.OpenKey(root, internetSettingsKey, registry.SET_VALUE)
+	if err != nil {
+		return false, fmt.Errorf("failed to open registry key: %v", err)
+	}
+	defer settings.Close()
+	
+	missing, _, err := backup.GetStringsValue(proxyBackupMissing)
+	if err != nil && err != registry.ErrNotExist {
+		return false, fmt.Errorf("failed to read missing values: %v", err)
+	}
+	
+	for _, name := range wininetProxyValues {
+		if containsString(missing, name) {
+			err := settings.DeleteValue(name)
+			if err != nil && err != registry.ErrNotExist {
+				return false, fmt.Errorf("failed to remove %s: %v", name, err)
+			}
+			continue
+		}
+		
+		_, err := copyRegistryValue(backup, settings, name)
+		if err != nil {
+			return false, fmt.Errorf("failed to restore %s: %v", name, err)
+		}
+	}
+	
+	// Put back the per-user policy if the backup recorded it
+	err = w.restoreProxyPolicy(root, backup, missing)
+	if err != nil {
+		return false, fmt.Errorf("failed to restore %s: %v", proxyPerUserValue, err)
+	}
+	
+	backup.Close()
+	err = registry.DeleteKey(root, proxyBackupKey)
+	if err != nil {
+		w.logger.Printf("Failed to remove proxy settings backup: %v", err)
+	}
+	
+	return true, nil
+}
+
+// Restore or remove ProxySettingsPerUser as recorded in the backup key
+func (w *WindowsNativeManager) restoreProxyPolicy(root, backup registry.Key, missing []string) error {
+	if containsString(missing, proxyPerUserValue) {
+		policy, err := registry.OpenKey(root, proxyPolicyKey, registry.SET_VALUE)
+		if err == registry.ErrNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer policy.Close()
+		
+		err = policy.DeleteValue(proxyPerUserValue)
+		if err != nil && err != registry.ErrNotExist {
+			return err
+		}
+		return nil
+	}
+	
+	// Backups of per-user settings do not record the policy
+	_, _, err := backup.GetValue(proxyPerUserValue, nil)
+	if err == registry.ErrNotExist {
+		return nil
+	}
+	
+	policy, _, err := registry.CreateKey(root, proxyPolicyKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer policy.Close()
+	
+	_, err = copyRegistryValue(backup, policy, proxyPerUserValue)
+	return err
+}
+
+// Copy a registry value keeping its type. Reports false if src has no such value.
+func copyRegistryValue(src, dst registry.Key, name string) (bool, error) {
+	_, valType, err := src.GetValue(name, nil)
+	if err == registry.ErrNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	
+	switch valType {
+	case registry.DWORD:
+		value, _, err := src.GetIntegerValue(name)
+		if err != nil {
+			return false, err
+		}
+		return true, dst.SetDWordValue(name, uint32(value))
+	case registry.QWORD:
+		value, _, err := src.GetIntegerValue(name)
+		if err != nil {
+			return false, err
+		}
+		return true, dst.SetQWordValue(name, value)
+	case registry.SZ, registry.EXPAND_SZ:
+		value, _, err := src.GetStringValue(name)
+		if err != nil {
+			return false, err
+		}
+		if valType == registry.EXPAND_SZ {
+			return true, dst.SetExpandStringValue(name, value)
+		}
+		return true, dst.SetStringValue(name, value)
+	case registry.BINARY:
+		value, _, err := src.GetBinaryValue(name)
+		if err != nil {
+			return false, err
+		}
+		return true, dst.SetBinaryValue(name, value)
+	default:
+		return false, fmt.Errorf("unsupported registry value type %d", valType)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Setup browser integration
 func (w *WindowsNativeManager) SetupBrowserIntegration() error {
 	w.logger.Println("Setting up Windows browser integration...")
@@ -658,14 +1058,34 @@ func (w *WindowsNativeManager) SetupWindowsSecurity() error {
 	return nil
 }
 
+// Teardown Windows security features added by SetupWindowsSecurity
+func (w *WindowsNativeManager) TeardownWindowsSecurity() error {
+	w.logger.Println("Removing Windows security features...")
+	
+	var errs []error
+	
+	// Remove Windows Defender exclusions
+	err := w.removeDefenderExclusions()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove Defender exclusions: %v", err))
+	}
+	
+	// Remove Windows Firewall rules
+	err = w.removeFirewallRules()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove firewall rules: %v", err))
+	}
+	
+	return errors.Join(errs...)
+}
+
 // Add Windows Defender exclusions
 func (w *WindowsNativeManager) addDefenderExclusions() error {
 	for _, exclusion := range w.securityManager.defenderExclusions {
-		cmd := exec.Command("powershell", "-Command", 
+		output, err := w.runCommand("powershell", "-Command", 
 			fmt.Sprintf("Add-MpPreference -ExclusionPath '%s'", exclusion))
-		err := cmd.Run()
 		if err != nil {
-			w.logger.Printf("Failed to add Defender exclusion for %s: %v", exclusion, err)
+			w.logger.Printf("Failed to add Defender exclusion for %s: %v, output: %s", exclusion, err, output)
 			continue
 		}
 		w.logger.Printf("Added Defender exclusion: %s", exclusion)
@@ -673,26 +1093,47 @@ func (w *WindowsNativeManager) addDefenderExclusions() error {
 	return nil
 }
 
+// Remove Windows Defender exclusions. Removing a path that is not excluded
+// is a no-op for Remove-MpPreference.
+func (w *WindowsNativeManager) removeDefenderExclusions() error {
+	var failed []string
+	for _, exclusion := range w.securityManager.defenderExclusions {
+		output, err := w.runCommand("powershell", "-Command", 
+			fmt.Sprintf("Remove-MpPreference -ExclusionPath '%s'", exclusion))
+		if err != nil {
+			w.logger.Printf("Failed to remove Defender exclusion for %s: %v, output: %s", exclusion, err, output)
+			failed = append(failed, exclusion)
+			continue
+		}
+		w.logger.Printf("Removed Defender exclusion: %s", exclusion)
+	}
+	
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove exclusions: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 // Setup Windows Firewall rules
 func (w *WindowsNativeManager) setupFirewallRules() error {
 	for _, rule := range w.securityManager.firewallRules {
-		var cmd *exec.Cmd
+		var args []string
 		if rule.Port > 0 {
-			cmd = exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
+			args = []string{"advfirewall", "firewall", "add", "rule",
 				fmt.Sprintf("name=%s", rule.Name),
 				fmt.Sprintf("dir=%s", rule.Direction),
 				fmt.Sprintf("action=%s", rule.Action),
 				fmt.Sprintf("protocol=%s", rule.Protocol),
-				fmt.Sprintf("localport=%d", rule.Port))
+				fmt.Sprintf("localport=%d", rule.Port)}
 		} else {
-			cmd = exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
+			args = []string{"advfirewall", "firewall", "add", "rule",
 				fmt.Sprintf("name=%s", rule.Name),
 				fmt.Sprintf("dir=%s", rule.Direction),
 				fmt.Sprintf("action=%s", rule.Action),
-				fmt.Sprintf("program=%s", rule.Program))
+				fmt.Sprintf("program=%s", rule.Program)}
 		}
 		
-		err := cmd.Run()
+		err := w.netsh(args...)
 		if err != nil {
 			w.logger.Printf("Failed to add firewall rule %s: %v", rule.Name, err)
 			continue
@@ -702,6 +1143,33 @@ func (w *WindowsNativeManager) setupFirewallRules() error {
 	return nil
 }
 
+// Remove Windows Firewall rules, skipping rules that no longer exist. netsh
+// show rule exits non-zero when no rule matches, whatever the system language.
+func (w *WindowsNativeManager) removeFirewallRules() error {
+	var failed []string
+	for _, rule := range w.securityManager.firewallRules {
+		name := fmt.Sprintf("name=%s", rule.Name)
+		_, err := w.runCommand("netsh", "advfirewall", "firewall", "show", "rule", name)
+		if err != nil {
+			w.logger.Printf("Firewall rule already removed: %s", rule.Name)
+			continue
+		}
+		
+		err = w.netsh("advfirewall", "firewall", "delete", "rule", name)
+		if err != nil {
+			w.logger.Printf("Failed to remove firewall rule %s: %v", rule.Name, err)
+			failed = append(failed, rule.Name)
+			continue
+		}
+		w.logger.Printf("Removed firewall rule: %s", rule.Name)
+	}
+	
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove firewall rules: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 // Utility functions
 
 // Check if running as administrator
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// fakeWindowsCommands records the commands run by the manager. Commands whose
+// line starts with a key in failing fail with that output.
+type fakeWindowsCommands struct {
+	calls   []string
+	failing map[string]string
+}
+
+func (f *fakeWindowsCommands) run(name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.calls = append(f.calls, line)
+	for prefix, output := range f.failing {
+		if strings.HasPrefix(line, prefix) {
+			return []byte(output), fmt.Errorf("exit status 1")
+		}
+	}
+	return nil, nil
+}
+
+// newTestRegistryRoot creates a scratch key under HKCU that stands in for a hive
+func newTestRegistryRoot(t *testing.T) registry.Key {
+	t.Helper()
+	path := fmt.Sprintf(`Software\OblivionFilterTest\%d`, time.Now().UnixNano())
+	root, _, err := registry.CreateKey(registry.CURRENT_USER, path, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("create test registry root: %v", err)
+	}
+	t.Cleanup(func() {
+		root.Close()
+		deleteRegistryTree(registry.CURRENT_USER, path)
+	})
+	return root
+}
+
+// deleteRegistryTree removes a key and all of its subkeys
+func deleteRegistryTree(parent registry.Key, path string) {
+	key, err := registry.OpenKey(parent, path, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return
+	}
+	names, _ := key.ReadSubKeyNames(-1)
+	for _, name := range names {
+		deleteRegistryTree(key, name)
+	}
+	key.Close()
+	registry.DeleteKey(parent, path)
+}
+
+// writeTestRegistryValues creates path under root holding values, which are
+// uint32 for DWORDs and string for SZ values
+func writeTestRegistryValues(t *testing.T, root registry.Key, path string, values map[string]interface{}) {
+	t.Helper()
+	key, _, err := registry.CreateKey(root, path, registry.SET_VALUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	for name, value := range values {
+		switch v := value.(type) {
+		case uint32:
+			err = key.SetDWordValue(name, v)
+		case string:
+			err = key.SetStringValue(name, v)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestRegistryValues returns the named values under path, omitting missing ones
+func readTestRegistryValues(t *testing.T, root registry.Key, path string, names ...string) map[string]interface{} {
+	t.Helper()
+	values := make(map[string]interface{})
+	key, err := registry.OpenKey(root, path, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return values
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	for _, name := range names {
+		_, valType, err := key.GetValue(name, nil)
+		if err == registry.ErrNotExist {
+			continue
+		}
+		switch valType {
+		case registry.DWORD:
+			v, _, _ := key.GetIntegerValue(name)
+			values[name] = uint32(v)
+		case registry.SZ:
+			values[name], _, _ = key.GetStringValue(name)
+		default:
+			t.Fatalf("%s has unexpected type %d", name, valType)
+		}
+	}
+	return values
+}
+
+func registryKeyExists(root registry.Key, path string) bool {
+	key, err := registry.OpenKey(root, path, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	key.Close()
+	return true
+}
+
+func newTestWindowsManager(t *testing.T, commands *fakeWindowsCommands) *WindowsNativeManager {
+	t.Helper()
+	w := &WindowsNativeManager{
+		logger:              log.New(io.Discard, "", 0),
+		installPath:         t.TempDir(),
+		registryRoot:        newTestRegistryRoot(t),
+		machineRegistryRoot: newTestRegistryRoot(t),
+		isAdmin:             func() bool { return false },
+		runCommand:          commands.run,
+	}
+	w.initProxyConfig()
+	w.initSecurityManager()
+	return w
+}
+
+func TestWindowsProxySaveAndRestore(t *testing.T) {
+	tests := []struct {
+		name     string
+		original map[string]interface{}
+	}{
+		{
+			name: "corporate proxy",
+			original: map[string]interface{}{
+				"ProxyEnable":   uint32(1),
+				"ProxyServer":   "http=corp.example.com:3128;https=corp.example.com:3129",
+				"ProxyOverride": "*.corp.example.com;<local>",
+			},
+		},
+		{
+			name:     "proxy disabled",
+			original: map[string]interface{}{"ProxyEnable": uint32(0)},
+		},
+		{
+			name:     "no proxy values",
+			original: map[string]interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWindowsManager(t, &fakeWindowsCommands{})
+			writeTestRegistryValues(t, w.registryRoot, internetSettingsKey, tt.original)
+
+			if err := w.SetupSystemProxy(); err != nil {
+				t.Fatalf("SetupSystemProxy: %v", err)
+			}
+			configured := readTestRegistryValues(t, w.registryRoot, internetSettingsKey, wininetProxyValues...)
+			wantConfigured := map[string]interface{}{
+				"ProxyEnable":   uint32(1),
+				"ProxyServer":   fmt.Sprintf("%s:%d", w.proxyConfig.Server, w.proxyConfig.Port),
+				"ProxyOverride": w.proxyConfig.Bypass,
+			}
+			if !reflect.DeepEqual(configured, wantConfigured) {
+				t.Errorf("configured values = %v, want %v", configured, wantConfigured)
+			}
+			if !registryKeyExists(w.registryRoot, proxyBackupKey) {
+				t.Fatal("backup key not created")
+			}
+
+			// A second run must not overwrite the backup with our own settings
+			if err := w.SetupSystemProxy(); err != nil {
+				t.Fatalf("second SetupSystemProxy: %v", err)
+			}
+
+			if err := w.CleanupSystemProxy(); err != nil {
+				t.Fatalf("CleanupSystemProxy: %v", err)
+			}
+			restored := readTestRegistryValues(t, w.registryRoot, internetSettingsKey, wininetProxyValues...)
+			if !reflect.DeepEqual(restored, tt.original) {
+				t.Errorf("restored values = %v, want the originals %v", restored, tt.original)
+			}
+			if registryKeyExists(w.registryRoot, proxyBackupKey) {
+				t.Error("backup key left after restore")
+			}
+		})
+	}
+}
+
+func TestWindowsCleanupWithoutBackup(t *testing.T) {
+	w := newTestWindowsManager(t, &fakeWindowsCommands{})
+	writeTestRegistryValues(t, w.registryRoot, internetSettingsKey, map[string]interface{}{
+		"ProxyEnable": uint32(1),
+		"ProxyServer": "127.0.0.1:8080",
+	})
+
+	if err := w.CleanupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestRegistryValues(t, w.registryRoot, internetSettingsKey, "ProxyEnable", "ProxyServer")
+	want := map[string]interface{}{"ProxyEnable": uint32(0), "ProxyServer": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("values = %v, want the proxy disabled %v", got, want)
+	}
+}
+
+func TestWindowsMachineWideProxy(t *testing.T) {
+	tests := []struct {
+		name        string
+		machineWide bool
+		admin       bool
+		wantErr     string
+		wantMachine bool // settings written to the machine hive rather than the user's
+	}{
+		{"per user", false, false, "", false},
+		{"per user as admin", false, true, "", false},
+		{"machine wide as admin", true, true, "", true},
+		{"machine wide without admin", true, false, "administrator privileges required", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWindowsManager(t, &fakeWindowsCommands{})
+			w.proxyConfig.MachineWide = tt.machineWide
+			w.isAdmin = func() bool { return tt.admin }
+			for _, root := range []registry.Key{w.registryRoot, w.machineRegistryRoot} {
+				writeTestRegistryValues(t, root, internetSettingsKey, map[string]interface{}{"ProxyEnable": uint32(0)})
+			}
+
+			err := w.SetupSystemProxy()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SetupSystemProxy = %v, want error containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("SetupSystemProxy: %v", err)
+			}
+
+			userEnabled := readTestRegistryValues(t, w.registryRoot, internetSettingsKey, "ProxyEnable")["ProxyEnable"] == uint32(1)
+			machineEnabled := readTestRegistryValues(t, w.machineRegistryRoot, internetSettingsKey, "ProxyEnable")["ProxyEnable"] == uint32(1)
+			if machineEnabled != tt.wantMachine || userEnabled != (tt.wantErr == "" && !tt.wantMachine) {
+				t.Errorf("proxy enabled for user = %v, machine = %v", userEnabled, machineEnabled)
+			}
+
+			policy := readTestRegistryValues(t, w.machineRegistryRoot, proxyPolicyKey, proxyPerUserValue)
+			if tt.wantMachine && policy[proxyPerUserValue] != uint32(0) {
+				t.Errorf("%s = %v, want 0 so WinINET reads HKLM", proxyPerUserValue, policy[proxyPerUserValue])
+			}
+			if !tt.wantMachine && len(policy) != 0 {
+				t.Errorf("policy written without machine-wide mode: %v", policy)
+			}
+			if tt.wantErr != "" {
+				if registryKeyExists(w.registryRoot, proxyBackupKey) || registryKeyExists(w.machineRegistryRoot, proxyBackupKey) {
+					t.Error("backup written although setup was refused")
+				}
+				return
+			}
+
+			if err := w.CleanupSystemProxy(); err != nil {
+				t.Fatalf("CleanupSystemProxy: %v", err)
+			}
+			// The policy value did not exist before, so cleanup removes it
+			if policy := readTestRegistryValues(t, w.machineRegistryRoot, proxyPolicyKey, proxyPerUserValue); len(policy) != 0 {
+				t.Errorf("policy left after cleanup: %v", policy)
+			}
+			for _, root := range []registry.Key{w.registryRoot, w.machineRegistryRoot} {
+				if got := readTestRegistryValues(t, root, internetSettingsKey, "ProxyEnable"); got["ProxyEnable"] != uint32(0) {
+					t.Errorf("ProxyEnable after cleanup = %v, want 0", got["ProxyEnable"])
+				}
+			}
+		})
+	}
+}
+
+func TestWindowsMachineWideRestoresExistingPolicy(t *testing.T) {
+	w := newTestWindowsManager(t, &fakeWindowsCommands{})
+	w.proxyConfig.MachineWide = true
+	w.isAdmin = func() bool { return true }
+	writeTestRegistryValues(t, w.machineRegistryRoot, internetSettingsKey, map[string]interface{}{})
+	writeTestRegistryValues(t, w.machineRegistryRoot, proxyPolicyKey, map[string]interface{}{proxyPerUserValue: uint32(1)})
+
+	if err := w.SetupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CleanupSystemProxy(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestRegistryValues(t, w.machineRegistryRoot, proxyPolicyKey, proxyPerUserValue); got[proxyPerUserValue] != uint32(1) {
+		t.Errorf("%s after cleanup = %v, want the original 1", proxyPerUserValue, got[proxyPerUserValue])
+	}
+
+	w.isAdmin = func() bool { return false }
+	if err := w.CleanupSystemProxy(); err == nil || !strings.Contains(err.Error(), "administrator") {
+		t.Errorf("machine-wide cleanup without admin = %v, want an administrator error", err)
+	}
+}
+
+func TestWindowsWinHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		bypass    string
+		failing   map[string]string
+		wantSetup string
+	}{
+		{
+			name:      "server and bypass list",
+			bypass:    "localhost;*.local",
+			wantSetup: "netsh winhttp set proxy proxy-server=127.0.0.1:8080 bypass-list=localhost;*.local",
+		},
+		{
+			name:      "no bypass list",
+			wantSetup: "netsh winhttp set proxy proxy-server=127.0.0.1:8080",
+		},
+		{
+			// Writing WinHTTP settings needs administrator rights; WinINET is still configured
+			name:      "netsh failure is not fatal",
+			bypass:    "<local>",
+			failing:   map[string]string{"netsh winhttp": "Error writing proxy settings. (5) Access is denied."},
+			wantSetup: "netsh winhttp set proxy proxy-server=127.0.0.1:8080 bypass-list=<local>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := &fakeWindowsCommands{failing: tt.failing}
+			w := newTestWindowsManager(t, commands)
+			w.proxyConfig.Bypass = tt.bypass
+			writeTestRegistryValues(t, w.registryRoot, internetSettingsKey, map[string]interface{}{})
+
+			if err := w.SetupSystemProxy(); err != nil {
+				t.Fatalf("SetupSystemProxy: %v", err)
+			}
+			if !reflect.DeepEqual(commands.calls, []string{tt.wantSetup}) {
+				t.Errorf("setup commands = %q, want %q", commands.calls, tt.wantSetup)
+			}
+
+			commands.calls = nil
+			if err := w.CleanupSystemProxy(); err != nil {
+				t.Fatalf("CleanupSystemProxy: %v", err)
+			}
+			if want := []string{"netsh winhttp reset proxy"}; !reflect.DeepEqual(commands.calls, want) {
+				t.Errorf("cleanup commands = %q, want %q", commands.calls, want)
+			}
+		})
+	}
+}
+
+func TestWindowsWinHTTPProxyRestored(t *testing.T) {
+	original := []byte{0x18, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0x0e, 0, 0, 0}
+	ours := []byte{0x18, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0x0e, 0, 0, 1}
+
+	// netsh is faked, so the test writes the value it would have set
+	setWinHTTPSettings := func(w *WindowsNativeManager, value []byte) {
+		t.Helper()
+		key, _, err := registry.CreateKey(w.machineRegistryRoot, winHTTPSettingsKey, registry.SET_VALUE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer key.Close()
+		if err := key.SetBinaryValue(winHTTPSettingsValue, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commands := &fakeWindowsCommands{}
+	w := newTestWindowsManager(t, commands)
+	writeTestRegistryValues(t, w.registryRoot, internetSettingsKey, map[string]interface{}{})
+	setWinHTTPSettings(w, original)
+
+	if err := w.SetupSystemProxy(); err != nil {
+		t.Fatalf("SetupSystemProxy: %v", err)
+	}
+	setWinHTTPSettings(w, ours)
+	// A second run must not overwrite the backup with our own setting
+	if err := w.SetupSystemProxy(); err != nil {
+		t.Fatalf("second SetupSystemProxy: %v", err)
+	}
+
+	commands.calls = nil
+	if err := w.CleanupSystemProxy(); err != nil {
+		t.Fatalf("CleanupSystemProxy: %v", err)
+	}
+	if len(commands.calls) != 0 {
+		t.Errorf("cleanup ran %q, want the saved setting written back instead", commands.calls)
+	}
+	key, err := registry.OpenKey(w.machineRegistryRoot, winHTTPSettingsKey, registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	if restored, _, err := key.GetBinaryValue(winHTTPSettingsValue); err != nil || !reflect.DeepEqual(restored, original) {
+		t.Errorf("%s after cleanup = %v, %v, want the original %v", winHTTPSettingsValue, restored, err, original)
+	}
+	if registryKeyExists(w.machineRegistryRoot, winHTTPBackupKey) {
+		t.Error("WinHTTP backup key left after restore")
+	}
+}
+
+func TestWindowsTeardownSecurity(t *testing.T) {
+	tests := []struct {
+		name      string
+		failing   map[string]string
+		wantCalls func(w *WindowsNativeManager) []string
+		wantErr   []string
+	}{
+		{
+			name: "removes every item",
+			wantCalls: func(w *WindowsNativeManager) []string {
+				var calls []string
+				for _, exclusion := range w.securityManager.defenderExclusions {
+					calls = append(calls, fmt.Sprintf("powershell -Command Remove-MpPreference -ExclusionPath '%s'", exclusion))
+				}
+				for _, rule := range w.securityManager.firewallRules {
+					calls = append(calls,
+						"netsh advfirewall firewall show rule name="+rule.Name,
+						"netsh advfirewall firewall delete rule name="+rule.Name)
+				}
+				return calls
+			},
+		},
+		{
+			name:    "rules already removed",
+			failing: map[string]string{"netsh advfirewall firewall show rule": "Keine Regeln entsprechen den angegebenen Kriterien."},
+			wantCalls: func(w *WindowsNativeManager) []string {
+				var calls []string
+				for _, exclusion := range w.securityManager.defenderExclusions {
+					calls = append(calls, fmt.Sprintf("powershell -Command Remove-MpPreference -ExclusionPath '%s'", exclusion))
+				}
+				for _, rule := range w.securityManager.firewallRules {
+					calls = append(calls, "netsh advfirewall firewall show rule name="+rule.Name)
+				}
+				return calls
+			},
+		},
+		{
+			name: "failures are reported together",
+			failing: map[string]string{
+				"powershell -Command Remove-MpPreference": "Access is denied.",
+				"netsh advfirewall firewall delete rule":  "The requested operation requires elevation.",
+			},
+			wantErr: []string{"Defender exclusions", "firewall rules", "OblivionFilter Proxy", "OblivionFilter Native Host"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := &fakeWindowsCommands{failing: tt.failing}
+			w := newTestWindowsManager(t, commands)
+
+			err := w.TeardownWindowsSecurity()
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatalf("TeardownWindowsSecurity: %v", err)
+			}
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("TeardownWindowsSecurity = %v, want error containing %q", err, want)
+				}
+			}
+			if tt.wantCalls != nil {
+				if want := tt.wantCalls(w); !reflect.DeepEqual(commands.calls, want) {
+					t.Errorf("commands =\n%s\nwant\n%s", strings.Join(commands.calls, "\n"), strings.Join(want, "\n"))
+				}
+			}
+		})
+	}
+}